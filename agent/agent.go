@@ -0,0 +1,499 @@
+// Package agent implements the node-local flow control agent. The agent serves a small HTTP API on a UNIX socket
+// which operators (via flowctl) use to act on the shaping the CNI plugin has programmed for each pod, and
+// optionally the read-only part of it over TCP for the cluster aggregator.
+package agent
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/cni-plugin/cloud"
+	"github.com/projectcalico/cni-plugin/logging"
+	"github.com/projectcalico/cni-plugin/metrics"
+	"github.com/projectcalico/cni-plugin/state"
+	"github.com/projectcalico/cni-plugin/utils"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// DefaultSocketPath is where the agent listens when no socket is configured.
+	DefaultSocketPath = "/var/run/cni_flow_control/agent.sock"
+
+	// DefaultLineRate is the rate, in bits per second, used in place of a pod's limits while it is paused.
+	DefaultLineRate = 10 * 1000 * 1000 * 1000
+
+	// DefaultPauseTTL is how long a pod stays paused when the request doesn't specify a TTL.
+	DefaultPauseTTL = 15 * time.Minute
+
+	// DefaultGCInterval is how often stale state records are pruned.
+	DefaultGCInterval = 5 * time.Minute
+)
+
+// agentLog is the logger of the agent, whose level is set apart from the plugin's datapath and tc logging.
+var agentLog = logging.Logger(logging.Agent)
+
+// Config holds the agent configuration.
+type Config struct {
+	SocketPath string
+	StateDir   string
+	LineRate   uint64
+	PauseTTL   time.Duration
+	GCInterval time.Duration
+	// MaintenanceTTL is how long the node stays in maintenance when the request doesn't specify a TTL.
+	MaintenanceTTL time.Duration
+	// CounterInterval is how often the traffic counters of pods are checkpointed.
+	CounterInterval time.Duration
+	// SaturationWindow is how long a direction of a pod must use its whole limit with drops, at every checkpoint
+	// of its counters, to be reported saturated. SaturationAnnotation also publishes the saturated directions of
+	// pods as an annotation, with the Kubernetes integration.
+	SaturationWindow     time.Duration
+	SaturationAnnotation bool
+	// ReconcileRate is how many pods per second have their classes updated or rebuilt, by ApplyPolicy, the
+	// templates of the cluster policy and repairs.
+	ReconcileRate float64
+
+	// MetricsBackend selects how metrics are exported: prometheus (the default), statsd or otlp. MetricsAddr is
+	// the address metrics are served on or pushed to, or empty to disable them.
+	MetricsBackend string
+	MetricsAddr    string
+
+	// AutoRepair rebuilds the shaping of a pod when one of its managed interfaces is deleted or its tc
+	// hierarchy is modified outside of the plugin.
+	AutoRepair bool
+	// ReconcileInterval, if set, is how often the shaping of every pod is checked against its record and what is
+	// missing rebuilt, starting when the agent starts, to catch changes made while no notification was watched for.
+	ReconcileInterval time.Duration
+
+	// NodeName enables the Kubernetes integration: the cluster policy is distributed to the plugin, the shaping
+	// status of pods is published as annotations, and hostNetwork pods scheduled to the node are recorded, and
+	// shaped on HostNetworkNIC if it is set. Kubeconfig is empty when running in-cluster.
+	NodeName       string
+	Kubeconfig     string
+	HostNetworkNIC string
+
+	// PolicyConfigMap is the namespace/name of the ConfigMap the cluster policy is copied from.
+	PolicyConfigMap string
+
+	// DiscoverCapacity looks up the node's instance type in its cloud provider's metadata service, to find its
+	// capacity when the policy doesn't configure one for it.
+	DiscoverCapacity bool
+
+	// ListenAddr, if set, is the TCP address the read-only part of the API (listing pods and events) is also
+	// served on, for the cluster aggregator to scrape.
+	ListenAddr string
+
+	// IPFIXCollector, if set, is the UDP address of an IPFIX collector the traffic each pod sends is exported to
+	// every IPFIXInterval, per connection, for billing pods by what they sent at the point they are shaped. Flows
+	// are read from conntrack and attributed to pods by their recorded IPs.
+	IPFIXCollector string
+	IPFIXInterval  time.Duration
+
+	// WebhookAddr, if set, is the TCP address the throttle webhook is served on, for external systems such as
+	// anomaly detectors to throttle pods temporarily. Requests must bear WebhookToken, which is then required.
+	WebhookAddr  string
+	WebhookToken string
+
+	// TenantAddr, if set, is the TCP address the tenant API is served on over TLS, with the certificate and key in
+	// TenantCertFile and TenantKeyFile: pods, events and throttles scoped to the namespaces of the caller. Callers
+	// authenticate with a client certificate signed by TenantClientCAFile, or a service account token bound to
+	// TenantAudience (DefaultTenantAudience if empty), which the Kubernetes integration reviews.
+	TenantAddr         string
+	TenantCertFile     string
+	TenantKeyFile      string
+	TenantClientCAFile string
+	TenantAudience     string
+}
+
+// Agent acts on the shaping state recorded by the CNI plugin.
+type Agent struct {
+	config Config
+	store  *state.Store
+	kube   *kubernetes.Clientset
+	budget *opsBudget
+
+	mu     sync.Mutex
+	timers map[string]*time.Timer
+	// throttleTimers lift the throttles of pods when they expire.
+	throttleTimers map[string]*time.Timer
+	// maintenance is the maintenance mode of the node, if it is in maintenance, and maintenanceTimer ends it.
+	maintenance      *state.Maintenance
+	maintenanceTimer *time.Timer
+
+	events eventLog
+
+	// tokens caches the tenants the bearer tokens of the tenant API were reviewed as.
+	tokens tokenReviews
+
+	tcPendingMu sync.Mutex
+	tcPending   map[int]bool
+
+	// saturation is the saturation of each pod as of its last counter checkpoint.
+	saturationMu sync.Mutex
+	saturation   map[string]*podSaturation
+
+	// published holds the last status patch sent for each pod.
+	publishedMu sync.Mutex
+	published   map[string]string
+
+	// instance is the discovered cloud instance, if any.
+	instanceOnce sync.Once
+	instance     *cloud.Instance
+}
+
+// metricsSpoolInterval is how often the counters spooled by the plugin are added to the agent's.
+const metricsSpoolInterval = 10 * time.Second
+
+// runMetricsSpool adds the counters spooled by plugin processes to the agent's own every interval, forever.
+func (a *Agent) runMetricsSpool(interval time.Duration) {
+	for {
+		if err := metrics.DefaultRegistry.ReadSpool(utils.MetricsSpoolDir(a.config.StateDir)); err != nil {
+			agentLog.WithError(err).Warn("Failed to read metrics spooled by the plugin")
+		}
+		time.Sleep(interval)
+	}
+}
+
+// New creates an agent, filling in defaults for any unset configuration.
+func New(config Config) *Agent {
+	if config.SocketPath == "" {
+		config.SocketPath = DefaultSocketPath
+	}
+	if config.LineRate == 0 {
+		config.LineRate = DefaultLineRate
+	}
+	if config.PauseTTL == 0 {
+		config.PauseTTL = DefaultPauseTTL
+	}
+	if config.GCInterval == 0 {
+		config.GCInterval = DefaultGCInterval
+	}
+	if config.MaintenanceTTL == 0 {
+		config.MaintenanceTTL = DefaultMaintenanceTTL
+	}
+	if config.CounterInterval == 0 {
+		config.CounterInterval = DefaultCounterInterval
+	}
+	if config.SaturationWindow == 0 {
+		config.SaturationWindow = DefaultSaturationWindow
+	}
+	if config.ReconcileRate <= 0 {
+		config.ReconcileRate = DefaultReconcileRate
+	}
+	if config.PolicyConfigMap == "" {
+		config.PolicyConfigMap = DefaultPolicyConfigMap
+	}
+	if config.IPFIXInterval == 0 {
+		config.IPFIXInterval = DefaultIPFIXInterval
+	}
+	return &Agent{
+		config:         config,
+		store:          state.NewStore(config.StateDir),
+		budget:         newOpsBudget(config.ReconcileRate),
+		timers:         map[string]*time.Timer{},
+		throttleTimers: map[string]*time.Timer{},
+		tcPending:      map[int]bool{},
+		saturation:     map[string]*podSaturation{},
+		published:      map[string]string{},
+	}
+}
+
+// Run re-arms the auto-resume of any pods paused, the expiry of any pods throttled and the end of any maintenance
+// started before the agent (re)started, starts the background loops and then serves the API until the listener
+// fails.
+func (a *Agent) Run() error {
+	if err := a.restorePauses(); err != nil {
+		return err
+	}
+	if err := a.restoreThrottles(); err != nil {
+		return err
+	}
+	if err := a.restoreMaintenance(); err != nil {
+		return err
+	}
+	go a.runGC(a.config.GCInterval)
+	go a.runCounterCheckpoints(a.config.CounterInterval)
+	go a.runSchedules()
+	if a.config.ReconcileInterval > 0 {
+		go a.runReconcile(a.config.ReconcileInterval)
+	}
+	if a.config.NodeName != "" {
+		kube, err := newKubeClient(a.config.Kubeconfig)
+		if err != nil {
+			return fmt.Errorf("failed to create Kubernetes client: %v", err)
+		}
+		a.kube = kube
+		go a.runHostNetworkSync(hostNetworkResync)
+		go a.runStatusSync(statusResync)
+		go a.runPolicySync(policyResync)
+	}
+	if err := a.watchLinks(make(chan struct{})); err != nil {
+		return fmt.Errorf("failed to subscribe to link updates: %v", err)
+	}
+	if err := a.watchTC(); err != nil {
+		return fmt.Errorf("failed to subscribe to tc updates: %v", err)
+	}
+
+	if a.config.IPFIXCollector != "" {
+		if err := enableConntrackAccounting(); err != nil {
+			return fmt.Errorf("failed to enable conntrack accounting: %v", err)
+		}
+		exporter, err := newIPFIXExporter(a.config.IPFIXCollector, conntrackSource{})
+		if err != nil {
+			return err
+		}
+		go a.runIPFIXExport(exporter, a.config.IPFIXInterval)
+	}
+
+	if a.config.MetricsAddr != "" {
+		exporter, err := metrics.NewExporter(a.config.MetricsBackend, a.config.MetricsAddr)
+		if err != nil {
+			return err
+		}
+		if err = exporter.Start(metrics.DefaultRegistry); err != nil {
+			return err
+		}
+		go a.runMetricsSpool(metricsSpoolInterval)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(a.config.SocketPath), 0700); err != nil {
+		return err
+	}
+	if err := os.Remove(a.config.SocketPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	l, err := net.Listen("unix", a.config.SocketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", a.config.SocketPath, err)
+	}
+	if a.config.WebhookAddr != "" {
+		if a.config.WebhookToken == "" {
+			return fmt.Errorf("the throttle webhook requires a token")
+		}
+		go func() {
+			agentLog.WithField("addr", a.config.WebhookAddr).Info("Serving throttle webhook")
+			agentLog.WithError(http.ListenAndServe(a.config.WebhookAddr, a.webhookHandler())).Error("Throttle webhook failed")
+		}()
+	}
+	if a.config.TenantAddr != "" {
+		if a.config.TenantCertFile == "" || a.config.TenantKeyFile == "" {
+			return fmt.Errorf("the tenant API requires a certificate and key")
+		}
+		go func() {
+			agentLog.WithField("addr", a.config.TenantAddr).Info("Serving tenant API")
+			agentLog.WithError(a.serveTenantAPI()).Error("Tenant API failed")
+		}()
+	}
+	if a.config.ListenAddr != "" {
+		go func() {
+			agentLog.WithField("addr", a.config.ListenAddr).Info("Serving read-only agent API")
+			agentLog.WithError(http.ListenAndServe(a.config.ListenAddr, a.readOnlyHandler())).Error("Read-only agent API failed")
+		}()
+	}
+	agentLog.WithField("socket", a.config.SocketPath).Info("Flow control agent listening")
+	return http.Serve(l, a.handler())
+}
+
+// Pause suspends shaping of the pod identified by id (container ID or workload) by raising the ceil of its classes
+// to line rate: they keep their rates, so the pod borrows what is left idle without taking the guarantees of its
+// siblings. Classes with nothing to borrow from are raised to line rate, as utils.RelaxedLimits does. The classes
+// themselves are kept, and the pod is automatically resumed once ttl has elapsed.
+func (a *Agent) Pause(id string, ttl time.Duration) (*state.Record, error) {
+	if ttl <= 0 {
+		ttl = a.config.PauseTTL
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	r, err := a.store.Find(id)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := state.LockTC()
+	if err != nil {
+		return nil, err
+	}
+	ingressRate, egressRate := r.ActiveRates()
+	ingress, egress, ingressCeil, egressCeil := utils.RelaxedLimits(r, ingressRate, egressRate, a.config.LineRate)
+	err = utils.SetRecordLimits(r, ingress, egress, ingressCeil, egressCeil)
+	unlock()
+	if err != nil {
+		return nil, err
+	}
+	until := time.Now().Add(ttl)
+	r.Paused = true
+	r.PausedUntil = &until
+	r.MarkReconciled()
+	if err = a.saveRecord(r); err != nil {
+		return nil, err
+	}
+	a.scheduleResume(r.Key(), ttl)
+	a.audit(r, state.AuditUpdate, state.AuditTriggerAPI, "paused until %s", until.Format(time.RFC3339))
+	agentLog.WithFields(log.Fields{"container": r.ContainerID, "until": until}).Info("Paused shaping")
+	return r, nil
+}
+
+// Resume restores the recorded limits of a paused pod, or those of its throttle.
+func (a *Agent) Resume(id string) (*state.Record, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.resume(id, state.AuditTriggerAPI)
+}
+
+// resume restores the limits of a paused pod, auditing it as made by trigger.
+func (a *Agent) resume(id, trigger string) (*state.Record, error) {
+	r, err := a.store.Find(id)
+	if err != nil {
+		return nil, err
+	}
+	if t, ok := a.timers[r.Key()]; ok {
+		t.Stop()
+		delete(a.timers, r.Key())
+	}
+	ingress, egress := r.ActiveRates()
+	if err = a.setRecordRates(r, ingress, egress); err != nil {
+		return nil, err
+	}
+	r.Paused = false
+	r.PausedUntil = nil
+	r.MarkReconciled()
+	if err = a.saveRecord(r); err != nil {
+		return nil, err
+	}
+	a.audit(r, state.AuditUpdate, trigger, "resumed")
+	agentLog.WithField("container", r.ContainerID).Info("Resumed shaping")
+	return r, nil
+}
+
+// Reshape rebuilds the shaping of the pod identified by id with a new latency class and non-IP policy, switching
+// its traffic over to the new classes and filters without dropping any. Paused and throttled pods must be resumed
+// or unthrottled first, since the new classes are built at the pod's recorded rates.
+func (a *Agent) Reshape(id, latencyClass, nonIPPolicy string) (*state.Record, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	r, err := a.store.Find(id)
+	if err != nil {
+		return nil, err
+	}
+	if r.Paused {
+		return nil, fmt.Errorf("shaping of %s is paused", r.ContainerID)
+	}
+	if r.Throttle != nil {
+		return nil, fmt.Errorf("%s is throttled", r.ContainerID)
+	}
+	if latencyClass != "" && latencyClass != utils.LatencyClassLow {
+		return nil, fmt.Errorf("invalid latency class %q", latencyClass)
+	}
+	a.retireCounters(r, true, true)
+	unlock, err := state.LockTC()
+	if err != nil {
+		return nil, err
+	}
+	err = utils.SwapShaping(r, r.IngressRate, r.EgressRate, latencyClass, nonIPPolicy)
+	unlock()
+	if err != nil {
+		return nil, err
+	}
+	r.MarkReconciled()
+	if err = a.saveRecord(r); err != nil {
+		return nil, err
+	}
+	a.audit(r, state.AuditUpdate, state.AuditTriggerAPI, "reshaped to generation %d, latency class %q, non-IP policy %q",
+		r.ShapingGeneration, r.LatencyClass, r.NonIPPolicy)
+	agentLog.WithFields(log.Fields{"container": r.ContainerID, "generation": r.ShapingGeneration}).Info("Reshaped pod")
+	return r, nil
+}
+
+// Resize changes the recorded rates of the pod identified by id (container ID or workload) to ingressRate and
+// egressRate, in bits per second, replacing the classes in place so that the pod keeps running. A zero rate leaves
+// its direction alone; a direction the pod wasn't limited in when it was set up has no classes and can't be resized.
+// A throttled or paused pod takes its new rates once the throttle is lifted or it is resumed. Ceils are kept where
+// they are still above the new rates.
+func (a *Agent) Resize(id string, ingressRate, egressRate uint64) (*state.Record, error) {
+	if ingressRate == 0 && egressRate == 0 {
+		return nil, fmt.Errorf("a resize needs an ingress or egress rate")
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	r, err := a.store.Find(id)
+	if err != nil {
+		return nil, err
+	}
+	if ingressRate != 0 && r.IngressRate == 0 {
+		return nil, fmt.Errorf("ingress of %s isn't limited, so it can't be resized", r.Workload)
+	}
+	if egressRate != 0 && r.EgressRate == 0 {
+		return nil, fmt.Errorf("egress of %s isn't limited, so it can't be resized", r.Workload)
+	}
+	if ingressRate != 0 {
+		r.IngressRate = ingressRate
+		if r.IngressCeil <= ingressRate {
+			r.IngressCeil = 0
+		}
+	}
+	if egressRate != 0 {
+		r.EgressRate = egressRate
+		if r.EgressCeil <= egressRate {
+			r.EgressCeil = 0
+		}
+	}
+	if !r.Paused {
+		ingress, egress := r.ActiveRates()
+		if err = a.setRecordRates(r, ingress, egress); err != nil {
+			return nil, err
+		}
+		r.MarkReconciled()
+	}
+	if err = a.saveRecord(r); err != nil {
+		return nil, err
+	}
+	a.audit(r, state.AuditUpdate, state.AuditTriggerAPI, "resized to ingress=%d,egress=%d", r.IngressRate, r.EgressRate)
+	agentLog.WithFields(log.Fields{
+		"container": r.ContainerID,
+		"ingress":   r.IngressRate,
+		"egress":    r.EgressRate,
+	}).Info("Resized pod")
+	return r, nil
+}
+
+// scheduleResume arms (or re-arms) the auto-resume timer of the pod stored under key. The caller must hold a.mu.
+func (a *Agent) scheduleResume(key string, after time.Duration) {
+	if t, ok := a.timers[key]; ok {
+		t.Stop()
+	}
+	a.timers[key] = time.AfterFunc(after, func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		delete(a.timers, key)
+		if _, err := a.resume(key, state.AuditTriggerExpiry); err != nil && err != state.ErrNotFound {
+			agentLog.WithError(err).WithField("container", key).Error("Failed to auto-resume shaping")
+		}
+	})
+}
+
+func (a *Agent) restorePauses() error {
+	records, err := a.store.List()
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, r := range records {
+		if !r.Paused || r.PausedUntil == nil {
+			continue
+		}
+		after := r.PausedUntil.Sub(time.Now())
+		if after < 0 {
+			after = 0
+		}
+		a.scheduleResume(r.Key(), after)
+	}
+	return nil
+}
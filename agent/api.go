@@ -0,0 +1,295 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/cni-plugin/state"
+)
+
+// errorResponse is the body returned with any non-2xx status.
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func (a *Agent) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/pods", a.handleListPods)
+	mux.HandleFunc("/v1/pods/", a.handlePod)
+	mux.HandleFunc("/v1/events", a.handleEvents)
+	mux.HandleFunc("/v1/presets/", a.handlePreset)
+	mux.HandleFunc("/v1/maintenance", a.handleMaintenance)
+	mux.HandleFunc("/v1/maintenance/", a.handleMaintenance)
+	return mux
+}
+
+// readOnlyHandler serves the parts of the API that don't change anything, which are safe to expose over TCP.
+func (a *Agent) readOnlyHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/pods", a.handleListPods)
+	mux.HandleFunc("/v1/events", a.handleEvents)
+	return mux
+}
+
+func (a *Agent) handleEvents(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	writeJSON(w, http.StatusOK, a.Events())
+}
+
+// handleListPods serves /v1/pods, a page of the pods shaped on the node. The limit query parameter sets the page
+// size, and continue is the token returned with the previous page.
+func (a *Agent) handleListPods(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	q := req.URL.Query()
+	limit := 0
+	if s := q.Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid limit: "+err.Error())
+			return
+		}
+	}
+	list, err := a.ListShapedPods(limit, q.Get("continue"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// handlePod serves /v1/pods/<id>, the shaping and reconcile status of a pod, and /v1/pods/<id>/<action>, where id
+// is a container ID or workload name.
+func (a *Agent) handlePod(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/v1/pods/"), "/")
+	if len(parts) == 1 && parts[0] != "" {
+		a.handleGetPod(w, req, parts[0])
+		return
+	}
+	if len(parts) != 2 || parts[0] == "" {
+		writeError(w, http.StatusNotFound, "unknown path "+req.URL.Path)
+		return
+	}
+	id, action := parts[0], parts[1]
+	if action == "capture" {
+		a.handleCapture(w, req, id)
+		return
+	}
+	if req.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+
+	var r *state.Record
+	var err error
+	switch action {
+	case "pause":
+		var ttl time.Duration
+		if s := req.URL.Query().Get("ttl"); s != "" {
+			if ttl, err = time.ParseDuration(s); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid ttl: "+err.Error())
+				return
+			}
+		}
+		r, err = a.Pause(id, ttl)
+	case "resume":
+		r, err = a.Resume(id)
+	case "throttle":
+		q := req.URL.Query()
+		var ingress, egress uint64
+		var ttl time.Duration
+		if ingress, err = parsePolicyRate(q.Get("ingress")); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid ingress rate: "+err.Error())
+			return
+		}
+		if egress, err = parsePolicyRate(q.Get("egress")); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid egress rate: "+err.Error())
+			return
+		}
+		if s := q.Get("ttl"); s != "" {
+			if ttl, err = time.ParseDuration(s); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid ttl: "+err.Error())
+				return
+			}
+		}
+		r, err = a.Throttle(id, ingress, egress, ttl, q.Get("reason"))
+	case "unthrottle":
+		r, err = a.Unthrottle(id)
+	case "resize":
+		q := req.URL.Query()
+		var ingress, egress uint64
+		if ingress, err = parsePolicyRate(q.Get("ingress")); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid ingress rate: "+err.Error())
+			return
+		}
+		if egress, err = parsePolicyRate(q.Get("egress")); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid egress rate: "+err.Error())
+			return
+		}
+		r, err = a.Resize(id, ingress, egress)
+	case "reshape":
+		q := req.URL.Query()
+		r, err = a.Reshape(id, q.Get("latency-class"), q.Get("non-ip-policy"))
+	default:
+		writeError(w, http.StatusNotFound, "unknown action "+action)
+		return
+	}
+
+	if err == state.ErrNotFound {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, r)
+}
+
+func (a *Agent) handleGetPod(w http.ResponseWriter, req *http.Request, id string) {
+	if req.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	p, err := a.ShapedPod(id)
+	if err == state.ErrNotFound {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+// handleCapture serves /v1/pods/<id>/capture, which streams the packets of the pod in pcap format for the duration
+// query parameter, keeping those matching the filter query parameter, a pcap filter expression.
+func (a *Agent) handleCapture(w http.ResponseWriter, req *http.Request, id string) {
+	if req.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	q := req.URL.Query()
+	duration := DefaultCaptureDuration
+	if s := q.Get("duration"); s != "" {
+		var err error
+		if duration, err = time.ParseDuration(s); err != nil || duration <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid duration "+s)
+			return
+		}
+	}
+	if duration > MaxCaptureDuration {
+		writeError(w, http.StatusBadRequest, "captures last at most "+MaxCaptureDuration.String())
+		return
+	}
+	c, err := a.OpenCapture(id, q.Get("filter"))
+	if err == state.ErrNotFound {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer c.Close()
+
+	w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+	w.WriteHeader(http.StatusOK)
+	// Packets are flushed as they are captured; the capture ends early if the client goes away.
+	if err = c.WriteTo(flushWriter{w}, duration); err != nil {
+		agentLog.WithError(err).WithField("pod", id).Info("Packet capture ended early")
+	}
+}
+
+// flushWriter flushes every write to an HTTP response, so that it is streamed to the client.
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if flusher, ok := f.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, err
+}
+
+// handlePreset serves /v1/presets/<preset>/apply, which applies the current cluster policy to the pods of a preset.
+func (a *Agent) handlePreset(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/v1/presets/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] != "apply" {
+		writeError(w, http.StatusNotFound, "unknown path "+req.URL.Path)
+		return
+	}
+	if req.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	result, err := a.ApplyPolicy(parts[0])
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// handleMaintenance serves /v1/maintenance, the maintenance mode of the node, and /v1/maintenance/on and
+// /v1/maintenance/off, which start it, for the ttl query parameter, and end it.
+func (a *Agent) handleMaintenance(w http.ResponseWriter, req *http.Request) {
+	action := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/v1/maintenance"), "/")
+	if action == "" {
+		if req.Method != "GET" {
+			writeError(w, http.StatusMethodNotAllowed, "use GET")
+			return
+		}
+		writeJSON(w, http.StatusOK, a.Maintenance())
+		return
+	}
+	if req.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	var status *MaintenanceStatus
+	var err error
+	switch action {
+	case "on":
+		q := req.URL.Query()
+		var ttl time.Duration
+		if s := q.Get("ttl"); s != "" {
+			if ttl, err = time.ParseDuration(s); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid ttl: "+err.Error())
+				return
+			}
+		}
+		status, err = a.StartMaintenance(ttl, q.Get("reason"))
+	case "off":
+		status, err = a.EndMaintenance()
+	default:
+		writeError(w, http.StatusNotFound, "unknown path "+req.URL.Path)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, errorResponse{Error: msg})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		agentLog.WithError(err).Warn("Failed to write API response")
+	}
+}
@@ -0,0 +1,187 @@
+package agent
+
+import (
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/cni-plugin/policy"
+	"github.com/projectcalico/cni-plugin/state"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// PolicyApplication is the outcome of applying the cluster policy to the pods of a preset.
+type PolicyApplication struct {
+	Preset string `json:"preset"`
+	// Updated are the workloads whose classes were updated.
+	Updated []string `json:"updated"`
+	// Unchanged counts the pods whose rates were already those of the policy.
+	Unchanged int `json:"unchanged"`
+	// Failed are the workloads that couldn't be updated, with the reason.
+	Failed map[string]string `json:"failed,omitempty"`
+}
+
+// ApplyPolicy recomputes the rates of every pod on the node whose rates come from preset, from the current cluster
+// policy, and updates the classes of those whose rates or class priority changed, within the reconcile budget. With the Kubernetes integration enabled, the policy is read from its ConfigMap first, so that an edit
+// takes effect without waiting for the next sync, and the annotations of each pod are taken into account.
+func (a *Agent) ApplyPolicy(preset string) (*PolicyApplication, error) {
+	if a.kube != nil {
+		if err := a.syncPolicy(); err != nil {
+			return nil, fmt.Errorf("failed to sync cluster flow control policy: %v", err)
+		}
+	}
+	p, err := policy.Load(a.config.StateDir)
+	if err != nil {
+		return nil, err
+	}
+	records, err := a.store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &PolicyApplication{Preset: preset, Updated: []string{}}
+	for _, r := range records {
+		if r.HostNetwork || r.Preset != preset {
+			continue
+		}
+		updated, err := a.applyPolicy(p, r.Key(), false, state.AuditTriggerAPI)
+		switch {
+		case err == state.ErrNotFound:
+			// Deleted since it was listed.
+		case err != nil:
+			if result.Failed == nil {
+				result.Failed = map[string]string{}
+			}
+			result.Failed[r.Workload] = err.Error()
+		case updated:
+			result.Updated = append(result.Updated, r.Workload)
+		default:
+			result.Unchanged++
+		}
+	}
+	agentLog.WithFields(log.Fields{
+		"preset":    preset,
+		"updated":   len(result.Updated),
+		"unchanged": result.Unchanged,
+		"failed":    len(result.Failed),
+	}).Info("Applied cluster flow control policy")
+	return result, nil
+}
+
+// applyPolicy updates the classes of the pod stored under key to the rates and class priority p gives it, and reports whether they
+// changed. Paused pods only have their record updated, to take effect when they are resumed, and the rates of
+// throttled pods take effect in the directions their throttle doesn't set. With templatedOnly, pods no template
+// applies to, now or before, are left alone. The change is audited as made by trigger.
+func (a *Agent) applyPolicy(p *policy.Policy, key string, templatedOnly bool, trigger string) (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	r, err := a.store.Load(key)
+	if err != nil {
+		return false, err
+	}
+	annotations := map[string]string{policy.PresetAnnotation: r.Preset}
+	var labels map[string]string
+	if a.kube != nil && r.Pod != "" {
+		pod, err := a.kube.Pods(r.Namespace).Get(r.Pod, metav1.GetOptions{})
+		if err != nil {
+			return false, fmt.Errorf("failed to get pod: %v", err)
+		}
+		annotations, labels = pod.Annotations, pod.Labels
+	}
+	rendered, err := p.Render(policy.Pod{Namespace: r.Namespace, Name: r.Pod, Labels: labels, Annotations: annotations})
+	if err != nil {
+		return false, err
+	}
+	if templatedOnly && rendered == nil && r.Template == "" {
+		return false, nil
+	}
+	classPriority := r.ClassPriority
+	if _, t, ok := p.Treatment(r.PriorityClass); ok && r.PriorityClass != "" {
+		p = p.WithTreatment(t)
+		classPriority = t.ClassPriority
+	}
+	ingress, egress := p.Apply(r.Namespace, annotations)
+	template := ""
+	if rendered != nil {
+		template = rendered.Template
+		if rendered.Ingress != "" {
+			ingress = rendered.Ingress
+		}
+		if rendered.Egress != "" {
+			egress = rendered.Egress
+		}
+		if rendered.ClassPriority != nil {
+			classPriority = *rendered.ClassPriority
+		}
+	}
+	ingressRate, err := parsePolicyRate(ingress)
+	if err != nil {
+		return false, err
+	}
+	egressRate, err := parsePolicyRate(egress)
+	if err != nil {
+		return false, err
+	}
+	if ingressRate == r.IngressRate && egressRate == r.EgressRate && classPriority == r.ClassPriority &&
+		template == r.Template {
+		return false, nil
+	}
+	if (r.IngressRate == 0) != (ingressRate == 0) || (r.EgressRate == 0) != (egressRate == 0) {
+		return false, fmt.Errorf("the policy changes which directions are limited, which requires recreating the pod")
+	}
+
+	r.IngressRate, r.EgressRate, r.ClassPriority = ingressRate, egressRate, classPriority
+	r.Preset = p.Preset(r.Namespace, annotations)
+	r.Template = template
+	if !r.Paused {
+		ingress, egress := r.ActiveRates()
+		a.budget.wait()
+		if err = a.setRecordRates(r, ingress, egress); err != nil {
+			return false, err
+		}
+		r.MarkReconciled()
+	}
+	if err = a.saveRecord(r); err != nil {
+		return false, err
+	}
+	a.audit(r, state.AuditUpdate, trigger, "applied preset %q, template %q, class priority %d", r.Preset, r.Template,
+		r.ClassPriority)
+	return true, nil
+}
+
+// applyTemplates renders the templates of the cluster policy for every pod on the node and updates the classes of
+// those whose rates changed, so that edits of the templates and of the labels they read take effect.
+func (a *Agent) applyTemplates() error {
+	p, err := policy.Load(a.config.StateDir)
+	if err != nil {
+		return err
+	}
+	if len(p.Templates) == 0 {
+		return nil
+	}
+	records, err := a.store.List()
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		if r.HostNetwork || r.Pod == "" {
+			continue
+		}
+		updated, err := a.applyPolicy(p, r.Key(), true, state.AuditTriggerPolicy)
+		switch {
+		case err == state.ErrNotFound:
+		case err != nil:
+			agentLog.WithError(err).WithField("container", r.ContainerID).Warn("Failed to apply flow control template")
+		case updated:
+			agentLog.WithField("container", r.ContainerID).Info("Applied flow control template")
+		}
+	}
+	return nil
+}
+
+// parsePolicyRate parses a rate from the policy, where empty means unlimited.
+func parsePolicyRate(rate string) (uint64, error) {
+	if rate == "" {
+		return 0, nil
+	}
+	return policy.ParseRate(rate)
+}
@@ -0,0 +1,14 @@
+package agent
+
+import (
+	"fmt"
+
+	"github.com/projectcalico/cni-plugin/state"
+	"github.com/projectcalico/cni-plugin/utils"
+)
+
+// audit writes the change action, made by trigger, to the shaping of the pod of r, or of the node if r is nil, to
+// the audit log.
+func (a *Agent) audit(r *state.Record, action, trigger, format string, args ...interface{}) {
+	utils.AuditRecord(a.store, r, action, trigger, fmt.Sprintf(format, args...), agentLog)
+}
@@ -0,0 +1,60 @@
+package agent
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/projectcalico/cni-plugin/metrics"
+)
+
+// DefaultReconcileRate is how many pods per second the agent reshapes when it applies a policy change or repairs
+// tampered shaping, so that updating a node full of pods doesn't flood rtnetlink and stall the plugin's own
+// netlink calls for new pods.
+const DefaultReconcileRate = 20
+
+// loopJitter is the fraction of their interval by which the periodic loops are randomly delayed, so that the
+// agents of a cluster don't hit the API server in lockstep and the loops of one agent drift apart.
+const loopJitter = 0.2
+
+var budgetWaitSeconds = metrics.NewCounter("flowcontrol_reconcile_budget_wait_seconds_total",
+	"Time pod updates waited for the reconcile budget.")
+
+// opsBudget spaces out operations to at most a rate per second, on average. Each operation is delayed from the
+// previous one by a jittered share of the budget, so that batches of updates don't line up with other periodic
+// netlink traffic.
+type opsBudget struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newOpsBudget(perSecond float64) *opsBudget {
+	return &opsBudget{interval: time.Duration(float64(time.Second) / perSecond)}
+}
+
+// wait blocks until the next operation fits the budget.
+func (b *opsBudget) wait() {
+	b.mu.Lock()
+	now := time.Now()
+	if b.next.Before(now) {
+		b.next = now
+	}
+	at := b.next
+	b.next = b.next.Add(jitter(b.interval, 1))
+	b.mu.Unlock()
+	if d := at.Sub(now); d > 0 {
+		budgetWaitSeconds.Add(d.Seconds())
+		time.Sleep(d)
+	}
+}
+
+// jitter returns d randomly shifted by up to fraction of it either way.
+func jitter(d time.Duration, fraction float64) time.Duration {
+	return d + time.Duration(fraction*(2*rand.Float64()-1)*float64(d))
+}
+
+// sleepJittered sleeps for a periodic loop's interval, delayed by up to loopJitter of it.
+func sleepJittered(interval time.Duration) {
+	time.Sleep(interval + time.Duration(loopJitter*rand.Float64()*float64(interval)))
+}
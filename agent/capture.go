@@ -0,0 +1,38 @@
+package agent
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/cni-plugin/utils"
+)
+
+const (
+	// DefaultCaptureDuration is how long a packet capture lasts if no duration is given.
+	DefaultCaptureDuration = 30 * time.Second
+	// MaxCaptureDuration bounds how long a packet capture can last.
+	MaxCaptureDuration = 10 * time.Minute
+)
+
+// OpenCapture starts capturing the packets of the pod identified by id (container ID or workload) on its host veth,
+// keeping those matching filter, a pcap filter expression such as "port 443", or all of them if it is empty.
+func (a *Agent) OpenCapture(id, filter string) (*utils.Capture, error) {
+	r, err := a.store.Find(id)
+	if err != nil {
+		return nil, err
+	}
+	if r.HostVeth == "" {
+		return nil, fmt.Errorf("%s has no host veth to capture on", r.Workload)
+	}
+	c, err := utils.OpenCapture(r.HostVeth, filter, utils.DefaultCaptureSnaplen)
+	if err != nil {
+		return nil, err
+	}
+	agentLog.WithFields(log.Fields{
+		"container": r.ContainerID,
+		"interface": r.HostVeth,
+		"filter":    filter,
+	}).Info("Capturing packets of pod")
+	return c, nil
+}
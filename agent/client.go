@@ -0,0 +1,247 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/projectcalico/cni-plugin/state"
+)
+
+// Client talks to the agent API over its UNIX socket, or to its read-only API over TCP.
+type Client struct {
+	http *http.Client
+	base string
+}
+
+// NewClient returns a client for the agent listening on socketPath, or DefaultSocketPath if it is empty.
+func NewClient(socketPath string) *Client {
+	if socketPath == "" {
+		socketPath = DefaultSocketPath
+	}
+	return &Client{
+		http: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				Dial: func(_, _ string) (net.Conn, error) {
+					return net.Dial("unix", socketPath)
+				},
+			},
+		},
+		base: "http://agent",
+	}
+}
+
+// NewRemoteClient returns a client for the read-only API an agent serves on addr, a host:port.
+func NewRemoteClient(addr string, timeout time.Duration) *Client {
+	return &Client{http: &http.Client{Timeout: timeout}, base: "http://" + addr}
+}
+
+// Pause suspends shaping of the pod for ttl (the agent default if zero).
+func (c *Client) Pause(id string, ttl time.Duration) (*state.Record, error) {
+	q := url.Values{}
+	if ttl > 0 {
+		q.Set("ttl", ttl.String())
+	}
+	return c.podAction(id, "pause", q)
+}
+
+// Resume restores the limits of a paused pod.
+func (c *Client) Resume(id string) (*state.Record, error) {
+	return c.podAction(id, "resume", nil)
+}
+
+// Throttle limits the pod to the given rates in bits per second, where zero leaves a direction alone, until ttl has
+// elapsed, or until it is unthrottled if ttl is zero. reason, if set, is recorded with the throttle.
+func (c *Client) Throttle(id string, ingressRate, egressRate uint64, ttl time.Duration, reason string) (*state.Record, error) {
+	q := url.Values{}
+	if ingressRate > 0 {
+		q.Set("ingress", strconv.FormatUint(ingressRate, 10))
+	}
+	if egressRate > 0 {
+		q.Set("egress", strconv.FormatUint(egressRate, 10))
+	}
+	if ttl > 0 {
+		q.Set("ttl", ttl.String())
+	}
+	if reason != "" {
+		q.Set("reason", reason)
+	}
+	return c.podAction(id, "throttle", q)
+}
+
+// Unthrottle restores the recorded limits of a throttled pod.
+func (c *Client) Unthrottle(id string) (*state.Record, error) {
+	return c.podAction(id, "unthrottle", nil)
+}
+
+// Resize changes the recorded rates of the pod, in bits per second, where zero leaves a direction alone.
+func (c *Client) Resize(id string, ingressRate, egressRate uint64) (*state.Record, error) {
+	q := url.Values{}
+	if ingressRate > 0 {
+		q.Set("ingress", strconv.FormatUint(ingressRate, 10))
+	}
+	if egressRate > 0 {
+		q.Set("egress", strconv.FormatUint(egressRate, 10))
+	}
+	return c.podAction(id, "resize", q)
+}
+
+// Reshape rebuilds the shaping of the pod with a new latency class and non-IP policy.
+func (c *Client) Reshape(id, latencyClass, nonIPPolicy string) (*state.Record, error) {
+	q := url.Values{}
+	q.Set("latency-class", latencyClass)
+	q.Set("non-ip-policy", nonIPPolicy)
+	return c.podAction(id, "reshape", q)
+}
+
+// ApplyPolicy applies the current cluster policy to the pods whose rates come from preset.
+func (c *Client) ApplyPolicy(preset string) (*PolicyApplication, error) {
+	result := &PolicyApplication{}
+	if err := c.do("POST", fmt.Sprintf("%s/v1/presets/%s/apply", c.base, url.QueryEscape(preset)), result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Maintenance returns the maintenance mode of the node.
+func (c *Client) Maintenance() (*MaintenanceStatus, error) {
+	status := &MaintenanceStatus{}
+	if err := c.do("GET", c.base+"/v1/maintenance", status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// StartMaintenance puts the node in maintenance for ttl (the agent default if zero), relaxing the limits of every
+// pod. reason, if set, is recorded with it.
+func (c *Client) StartMaintenance(ttl time.Duration, reason string) (*MaintenanceStatus, error) {
+	q := url.Values{}
+	if ttl > 0 {
+		q.Set("ttl", ttl.String())
+	}
+	if reason != "" {
+		q.Set("reason", reason)
+	}
+	status := &MaintenanceStatus{}
+	if err := c.do("POST", c.base+"/v1/maintenance/on?"+q.Encode(), status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// EndMaintenance takes the node out of maintenance, restoring the limits of every pod.
+func (c *Client) EndMaintenance() (*MaintenanceStatus, error) {
+	status := &MaintenanceStatus{}
+	if err := c.do("POST", c.base+"/v1/maintenance/off", status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// Events returns the agent's recent events.
+func (c *Client) Events() ([]Event, error) {
+	var events []Event
+	if err := c.do("GET", c.base+"/v1/events", &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// ShapedPod returns the shaping and reconcile status of the pod.
+func (c *Client) ShapedPod(id string) (*ShapedPod, error) {
+	p := &ShapedPod{}
+	if err := c.do("GET", fmt.Sprintf("%s/v1/pods/%s", c.base, url.QueryEscape(id)), p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// ListShapedPods returns a page of up to limit pods shaped on the node (the agent default if zero), starting after
+// the continue token of the previous page, or from the start if it is empty.
+func (c *Client) ListShapedPods(limit int, continueToken string) (*ShapedPodList, error) {
+	q := url.Values{}
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	if continueToken != "" {
+		q.Set("continue", continueToken)
+	}
+	list := &ShapedPodList{}
+	if err := c.do("GET", c.base+"/v1/pods?"+q.Encode(), list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// Capture streams the packets of the pod matching filter, a pcap filter expression (all if empty), to w in pcap
+// format for duration (the agent default if zero).
+func (c *Client) Capture(id, filter string, duration time.Duration, w io.Writer) error {
+	q := url.Values{}
+	if filter != "" {
+		q.Set("filter", filter)
+	}
+	if duration > 0 {
+		q.Set("duration", duration.String())
+	}
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/v1/pods/%s/capture?%s", c.base, url.QueryEscape(id), q.Encode()), nil)
+	if err != nil {
+		return err
+	}
+	// The capture outlasts the client's timeout, which is meant for requests answered straight away.
+	client := *c.http
+	client.Timeout = 0
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach flow control agent: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		e := errorResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Error == "" {
+			return fmt.Errorf("agent returned %s", resp.Status)
+		}
+		return errors.New(e.Error)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+func (c *Client) podAction(id, action string, q url.Values) (*state.Record, error) {
+	u := fmt.Sprintf("%s/v1/pods/%s/%s", c.base, url.QueryEscape(id), action)
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	r := &state.Record{}
+	if err := c.do("POST", u, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (c *Client) do(method, u string, out interface{}) error {
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach flow control agent: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		e := errorResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Error == "" {
+			return fmt.Errorf("agent returned %s", resp.Status)
+		}
+		return errors.New(e.Error)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,119 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/projectcalico/cni-plugin/state"
+	"github.com/projectcalico/cni-plugin/sysctl"
+)
+
+// flow is the traffic of one direction of a connection a pod sent, attributed to the pod.
+type flow struct {
+	record           *state.Record
+	src, dst         net.IP
+	proto            uint8
+	srcPort, dstPort uint16
+	bytes, packets   uint64
+}
+
+// key identifies the direction of the connection across polls.
+func (f flow) key() string {
+	return fmt.Sprintf("%s|%s|%d|%d|%d", f.src, f.dst, f.proto, f.srcPort, f.dstPort)
+}
+
+// flowSource lists the cumulative traffic pods sent on each of their connections. Sources other than conntrack,
+// e.g. sampled packets, plug in here.
+type flowSource interface {
+	Flows(pods map[string]*state.Record) ([]flow, error)
+}
+
+// conntrackSource reads the byte and packet counts of connections from conntrack, with conntrack(8). Counting must
+// be enabled with enableConntrackAccounting; connections opened before that aren't counted.
+type conntrackSource struct{}
+
+// enableConntrackAccounting makes conntrack count the bytes and packets of connections.
+func enableConntrackAccounting() error {
+	b := &sysctl.Batch{}
+	b.Set("net.netfilter.nf_conntrack_acct", "1")
+	return b.Apply("")
+}
+
+// Flows attributes each direction of the connections in conntrack to the pod that sent it, by its source address:
+// the original direction to the pod that opened the connection, the reply direction to the pod that accepted it,
+// after any DNAT. pods maps the addresses of pods to their records.
+func (conntrackSource) Flows(pods map[string]*state.Record) ([]flow, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("conntrack", "-L", "-o", "extended")
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("conntrack failed: %v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	var flows []flow
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		orig, reply, ok := parseConntrackEntry(scanner.Text())
+		if !ok {
+			continue
+		}
+		for _, f := range []flow{orig, reply} {
+			if r, ok := pods[f.src.String()]; ok {
+				f.record = r
+				flows = append(flows, f)
+			}
+		}
+	}
+	return flows, scanner.Err()
+}
+
+// parseConntrackEntry parses a line of `conntrack -L -o extended`, e.g.
+//
+//	ipv4 2 tcp 6 431999 ESTABLISHED src=10.0.0.5 dst=10.96.0.1 sport=40000 dport=443 packets=3 bytes=180
+//	    src=10.0.0.9 dst=10.0.0.5 sport=6443 dport=40000 packets=2 bytes=120 [ASSURED] mark=0 use=1
+//
+// into its original and reply directions. Each key=value of a direction appears once; the second src starts the
+// reply.
+func parseConntrackEntry(line string) (orig, reply flow, ok bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 4 {
+		return flow{}, flow{}, false
+	}
+	proto, err := strconv.ParseUint(fields[3], 10, 8)
+	if err != nil {
+		return flow{}, flow{}, false
+	}
+	orig.proto, reply.proto = uint8(proto), uint8(proto)
+	cur, srcs := &orig, 0
+	for _, field := range fields[4:] {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "src":
+			if srcs++; srcs == 2 {
+				cur = &reply
+			}
+			cur.src = net.ParseIP(kv[1])
+		case "dst":
+			cur.dst = net.ParseIP(kv[1])
+		case "sport":
+			port, _ := strconv.ParseUint(kv[1], 10, 16)
+			cur.srcPort = uint16(port)
+		case "dport":
+			port, _ := strconv.ParseUint(kv[1], 10, 16)
+			cur.dstPort = uint16(port)
+		case "packets":
+			cur.packets, _ = strconv.ParseUint(kv[1], 10, 64)
+		case "bytes":
+			cur.bytes, _ = strconv.ParseUint(kv[1], 10, 64)
+		}
+	}
+	return orig, reply, srcs == 2 && orig.src != nil && orig.dst != nil && reply.src != nil && reply.dst != nil
+}
@@ -0,0 +1,116 @@
+package agent
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/cni-plugin/metrics"
+	"github.com/projectcalico/cni-plugin/state"
+	"github.com/projectcalico/cni-plugin/utils"
+)
+
+// DefaultCounterInterval is how often the traffic counters of pods are checkpointed into the state store.
+const DefaultCounterInterval = time.Minute
+
+var (
+	podBytes = metrics.NewCounter("flowcontrol_pod_bytes_total",
+		"Bytes through the classes of each pod, carried across rebuilds of its classes.", "namespace", "pod", "direction")
+	podPackets = metrics.NewCounter("flowcontrol_pod_packets_total",
+		"Packets through the classes of each pod, carried across rebuilds of its classes.", "namespace", "pod", "direction")
+	podDrops = metrics.NewCounter("flowcontrol_pod_drops_total",
+		"Packets dropped by the classes of each pod, carried across rebuilds of its classes.", "namespace", "pod", "direction")
+	podOverlimits = metrics.NewCounter("flowcontrol_pod_overlimits_total",
+		"Times the classes of each pod held back a packet over their rate, carried across rebuilds of its classes.",
+		"namespace", "pod", "direction")
+	podOffloaded = metrics.NewGauge("flowcontrol_pod_hw_offloaded",
+		"1 for pods shaped on the uplink whose traffic it polices in hardware, 0 for those shaped in software.",
+		"namespace", "pod", "nic")
+)
+
+// runCounterCheckpoints checkpoints the traffic counters of pods every interval, forever.
+func (a *Agent) runCounterCheckpoints(interval time.Duration) {
+	for {
+		if err := a.checkpointCounters(); err != nil {
+			agentLog.WithError(err).Error("Failed to checkpoint traffic counters")
+		}
+		time.Sleep(interval)
+	}
+}
+
+// checkpointCounters reads the counters of the classes of every pod into its checkpoint, so that its cumulative
+// traffic and drops survive the classes being rebuilt, and exports the totals, along with which pods on the uplink
+// are offloaded to its hardware and which are saturated.
+func (a *Agent) checkpointCounters() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	records, err := a.store.List()
+	if err != nil {
+		return err
+	}
+	podBytes.Reset()
+	podPackets.Reset()
+	podDrops.Reset()
+	podOverlimits.Reset()
+	podOffloaded.Reset()
+	podSaturated.Reset()
+	now := time.Now()
+	current := map[string]bool{}
+	for _, r := range records {
+		current[r.Key()] = true
+		c, err := a.loadCounters(r.Key())
+		if err != nil {
+			agentLog.WithError(err).WithField("container", r.ContainerID).Warn("Failed to load traffic counters")
+			continue
+		}
+		c.Observe(utils.ReadTraffic(r, c.Current))
+		if err := a.store.SaveCounters(r.Key(), c); err != nil {
+			agentLog.WithError(err).WithField("container", r.ContainerID).Warn("Failed to checkpoint traffic counters")
+		}
+
+		namespace, pod := r.Namespace, r.Pod
+		if pod == "" {
+			pod = r.Workload
+		}
+		total := c.Total()
+		a.observeSaturation(r, total, now)
+		podBytes.Set(float64(total.IngressBytes), namespace, pod, "ingress")
+		podBytes.Set(float64(total.EgressBytes), namespace, pod, "egress")
+		podPackets.Set(float64(total.IngressPackets), namespace, pod, "ingress")
+		podPackets.Set(float64(total.EgressPackets), namespace, pod, "egress")
+		podDrops.Set(float64(total.IngressDrops), namespace, pod, "ingress")
+		podDrops.Set(float64(total.EgressDrops), namespace, pod, "egress")
+		podOverlimits.Set(float64(total.IngressOverlimits), namespace, pod, "ingress")
+		podOverlimits.Set(float64(total.EgressOverlimits), namespace, pod, "egress")
+		if r.ShapingMode == utils.ShapingModeNIC {
+			offloaded := 0.0
+			if r.NICOffloaded {
+				offloaded = 1
+			}
+			podOffloaded.Set(offloaded, namespace, pod, r.NIC)
+		}
+	}
+	a.forgetSaturation(current)
+	return nil
+}
+
+// retireCounters reads the counters of the classes of the given directions of a pod one last time before they are
+// replaced. The caller must hold a.mu.
+func (a *Agent) retireCounters(r *state.Record, ingress, egress bool) {
+	c, err := a.loadCounters(r.Key())
+	if err == nil {
+		c.Retire(utils.ReadTraffic(r, c.Current), ingress, egress)
+		err = a.store.SaveCounters(r.Key(), c)
+	}
+	if err != nil {
+		agentLog.WithError(err).WithField("container", r.ContainerID).Warn("Failed to checkpoint traffic counters before a rebuild")
+	}
+}
+
+// loadCounters returns the checkpointed counters stored under key, or new ones if it has none yet.
+func (a *Agent) loadCounters(key string) (*state.Counters, error) {
+	c, err := a.store.LoadCounters(key)
+	if err == state.ErrNotFound {
+		return &state.Counters{}, nil
+	}
+	return c, err
+}
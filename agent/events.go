@@ -0,0 +1,78 @@
+package agent
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/cni-plugin/metrics"
+	"github.com/projectcalico/cni-plugin/state"
+)
+
+// maxEvents is the number of events the agent keeps for the events API.
+const maxEvents = 1000
+
+var eventsTotal = metrics.NewCounter("flowcontrol_events_total",
+	"Events recorded by the agent about the shaping of pods.", "reason")
+
+// Event is something noteworthy that happened to the shaping of a pod.
+type Event struct {
+	Time        time.Time `json:"time"`
+	ContainerID string    `json:"container_id"`
+	Workload    string    `json:"workload,omitempty"`
+	Reason      string    `json:"reason"`
+	Message     string    `json:"message"`
+}
+
+// eventLog is a bounded, in-memory log of recent events.
+type eventLog struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (l *eventLog) add(e Event) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, e)
+	if len(l.events) > maxEvents {
+		l.events = l.events[len(l.events)-maxEvents:]
+	}
+}
+
+func (l *eventLog) list() []Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]Event(nil), l.events...)
+}
+
+// recordEvent logs an event about the pod described by r, counts it and keeps it for the events API.
+func (a *Agent) recordEvent(r *state.Record, reason, format string, args ...interface{}) {
+	a.addEvent(Event{
+		Time:        time.Now(),
+		ContainerID: r.ContainerID,
+		Workload:    r.Workload,
+		Reason:      reason,
+		Message:     fmt.Sprintf(format, args...),
+	})
+}
+
+// recordNodeEvent logs an event about the node as a whole, counts it and keeps it for the events API.
+func (a *Agent) recordNodeEvent(reason, format string, args ...interface{}) {
+	a.addEvent(Event{Time: time.Now(), Reason: reason, Message: fmt.Sprintf(format, args...)})
+}
+
+func (a *Agent) addEvent(e Event) {
+	agentLog.WithFields(log.Fields{
+		"container": e.ContainerID,
+		"workload":  e.Workload,
+		"reason":    e.Reason,
+	}).Warn(e.Message)
+	eventsTotal.Inc(e.Reason)
+	a.events.add(e)
+}
+
+// Events returns the most recent events, oldest first.
+func (a *Agent) Events() []Event {
+	return a.events.list()
+}
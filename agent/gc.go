@@ -0,0 +1,155 @@
+package agent
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/cni-plugin/metrics"
+	"github.com/projectcalico/cni-plugin/shaping"
+	"github.com/projectcalico/cni-plugin/state"
+	"github.com/projectcalico/cni-plugin/utils"
+	"github.com/vishvananda/netlink"
+)
+
+// gcGracePeriod protects records that were written very recently, e.g. while a re-ADD of the container is
+// recreating its veth.
+const gcGracePeriod = 2 * time.Minute
+
+var (
+	gcPrunedRecords = metrics.NewCounter("flowcontrol_gc_pruned_records_total",
+		"State records pruned because the interface they describe no longer exists.")
+	gcRuns = metrics.NewCounter("flowcontrol_gc_runs_total",
+		"Garbage collection passes over the state store.", "result")
+	gcInterruptedOps = metrics.NewCounter("flowcontrol_gc_interrupted_operations_total",
+		"CNI operations cleaned up after because the plugin was killed before completing them.", "op")
+)
+
+// runGC collects garbage every interval, forever.
+func (a *Agent) runGC(interval time.Duration) {
+	for {
+		sleepJittered(interval)
+		if _, err := a.collectGarbage(); err != nil {
+			agentLog.WithError(err).Error("Failed to collect stale shaping state")
+		}
+		if err := a.collectInterrupted(); err != nil {
+			agentLog.WithError(err).Error("Failed to clean up after interrupted operations")
+		}
+	}
+}
+
+// collectInterrupted cleans up after CNI operations whose plugin process died before completing them. Usually the
+// next operation on the container does this, but the runtime may never retry, e.g. if the pod was deleted.
+func (a *Agent) collectInterrupted() error {
+	journal := state.NewJournal(a.config.StateDir)
+	entries, err := journal.List()
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, e := range entries {
+		if utils.ProcessAlive(e.PID) && time.Since(e.Started) < gcGracePeriod {
+			continue
+		}
+		logger := agentLog.WithFields(log.Fields{
+			"container":   e.ContainerID,
+			"op":          e.Op,
+			"interrupted": e.Interrupted,
+		})
+		logger.Info("Cleaning up after an interrupted operation")
+		if err := utils.CleanUpInterrupted(utils.NetConf{StateDir: a.config.StateDir}, e, logger); err != nil {
+			logger.WithError(err).Warn("Failed to clean up after an interrupted operation")
+			continue
+		}
+		if err := journal.Complete(e.Key()); err != nil {
+			return err
+		}
+		gcInterruptedOps.Inc(e.Op)
+	}
+	return nil
+}
+
+// collectGarbage prunes state records whose host veth no longer exists, which happens when the DEL for a container
+// never arrived (node reimage, manual cleanup), with the IFB device they recorded. It returns the number of records
+// pruned.
+func (a *Agent) collectGarbage() (int, error) {
+	records, err := a.store.List()
+	if err != nil {
+		gcRuns.Inc("error")
+		return 0, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	pruned := 0
+	for _, r := range records {
+		// hostNetwork records have no interface and are pruned by the hostNetwork sync instead. Those of containers
+		// attached with a slave device have no host veth to go missing, and are left to DEL.
+		if r.HostNetwork || r.HostVeth == "" || time.Since(r.Updated) < gcGracePeriod {
+			continue
+		}
+		if _, err := netlink.LinkByName(r.HostVeth); err == nil {
+			continue
+		} else if _, ok := err.(netlink.LinkNotFoundError); !ok {
+			agentLog.WithError(err).WithField("interface", r.HostVeth).Warn("Failed to look up interface, keeping state")
+			continue
+		}
+
+		agentLog.WithFields(log.Fields{
+			"container": r.ContainerID,
+			"interface": r.HostVeth,
+		}).Info("Pruning shaping state of missing interface")
+		if t, ok := a.timers[r.Key()]; ok {
+			t.Stop()
+			delete(a.timers, r.Key())
+		}
+		if r.ShapingMode == utils.ShapingModeNIC {
+			if err := utils.CleanUpNICShaping(a.store, r); err != nil {
+				agentLog.WithError(err).WithField("nic", r.NIC).Warn("Failed to remove uplink shaping")
+			}
+		}
+		if r.ConntrackMark != 0 {
+			if err := utils.UnstampConntrack(r.HostVeth); err != nil {
+				agentLog.WithError(err).WithField("interface", r.HostVeth).Warn("Failed to stop stamping connections")
+			}
+		}
+		if !utils.PacketLimitsOf(r).Empty() {
+			if err := utils.RemovePacketLimits(r.HostVeth); err != nil {
+				agentLog.WithError(err).WithField("interface", r.HostVeth).Warn("Failed to remove packet rate limits")
+			}
+		}
+		// The IFB device outlives the host veth, and nothing remembers it once the record is gone, unless a newer
+		// container was given the same name.
+		if r.IFB != "" && !ifbClaimed(records, r) {
+			if _, err := shaping.DeleteIFB(r.IFB); err != nil {
+				agentLog.WithError(err).WithField("interface", r.IFB).Warn("Failed to delete IFB device")
+			}
+		}
+		if err := a.store.DeleteCounters(r.Key()); err != nil {
+			agentLog.WithError(err).WithField("container", r.ContainerID).Warn("Failed to remove traffic counters")
+		}
+		if err := utils.ReleaseNames(a.store, r.Key()); err != nil {
+			agentLog.WithError(err).WithField("container", r.ContainerID).Warn("Failed to release device names")
+		}
+		if err := a.store.Delete(r.Key()); err != nil {
+			gcRuns.Inc("error")
+			return pruned, err
+		}
+		a.audit(r, state.AuditDelete, state.AuditTriggerGC, "pruned record of a container that no longer exists")
+		pruned++
+	}
+	gcPrunedRecords.Add(float64(pruned))
+	gcRuns.Inc("success")
+	return pruned, nil
+}
+
+// ifbClaimed reports whether a record of records other than r has the IFB device of r.
+func ifbClaimed(records []*state.Record, r *state.Record) bool {
+	for _, other := range records {
+		if other.IFB == r.IFB && other.Key() != r.Key() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,177 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/cni-plugin/policy"
+	"github.com/projectcalico/cni-plugin/state"
+	"github.com/projectcalico/cni-plugin/utils"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// hostNetworkResync is how often the pods of the node are listed to find hostNetwork pods with bandwidth
+// annotations.
+const hostNetworkResync = time.Minute
+
+const reasonHostNetworkUnsupported = "HostNetworkUnsupported"
+
+// newKubeClient returns a client for the kubeconfig at path, or the in-cluster configuration if path is empty.
+func newKubeClient(path string) (*kubernetes.Clientset, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", path)
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+// hostNetworkID is the ID hostNetwork pods are recorded under. They have no container ID of their own since the
+// plugin is never invoked for them.
+func hostNetworkID(pod *v1.Pod) string {
+	return "hostnet-" + string(pod.UID)
+}
+
+// runHostNetworkSync syncs the state of hostNetwork pods every interval, forever.
+func (a *Agent) runHostNetworkSync(interval time.Duration) {
+	for {
+		if err := a.syncHostNetworkPods(); err != nil {
+			agentLog.WithError(err).Error("Failed to sync hostNetwork pods")
+		}
+		sleepJittered(interval)
+	}
+}
+
+// syncHostNetworkPods records the hostNetwork pods of the node which request bandwidth limits. The CNI plugin
+// never sees these pods, so without this their annotations would silently have no effect. Unless HostNetworkNIC
+// is configured, they are recorded as Unsupported; otherwise their egress is shaped on the uplink by cgroup.
+func (a *Agent) syncHostNetworkPods() error {
+	pods, err := a.kube.Pods("").List(metav1.ListOptions{FieldSelector: "spec.nodeName=" + a.config.NodeName})
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	seen := map[string]bool{}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if !pod.Spec.HostNetwork {
+			continue
+		}
+		ingress := pod.Annotations["kubernetes.io/ingress-bandwidth"]
+		egress := pod.Annotations["kubernetes.io/egress-bandwidth"]
+		if ingress == "" && egress == "" {
+			continue
+		}
+		seen[hostNetworkID(pod)] = true
+		if err := a.syncHostNetworkPod(pod, ingress, egress); err != nil {
+			agentLog.WithError(err).WithField("pod", pod.Name).Error("Failed to sync hostNetwork pod")
+		}
+	}
+
+	records, err := a.store.List()
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		if !r.HostNetwork || seen[r.ContainerID] {
+			continue
+		}
+		if r.ShapingMode == utils.ShapingModeNIC {
+			if err := utils.CleanUpNICShaping(a.store, r); err != nil {
+				agentLog.WithError(err).WithField("workload", r.Workload).Warn("Failed to remove uplink shaping")
+			}
+		}
+		if err := a.store.Delete(r.Key()); err != nil {
+			return err
+		}
+		a.audit(r, state.AuditDelete, state.AuditTriggerAnnotation, "hostNetwork pod gone or without bandwidth annotations")
+	}
+	return nil
+}
+
+func (a *Agent) syncHostNetworkPod(pod *v1.Pod, ingress, egress string) error {
+	id := hostNetworkID(pod)
+	ingressRate, _ := policy.ParseRate(ingress)
+	egressRate, _ := policy.ParseRate(egress)
+
+	old, err := a.store.Load(id)
+	// Pods whose shaping failed are retried, e.g. in case their cgroups didn't exist yet.
+	unchanged := err == nil && old.IngressRate == ingressRate && old.EgressRate == egressRate
+	if unchanged && (old.Status == state.StatusApplied || a.config.HostNetworkNIC == "") {
+		return nil
+	} else if err != nil && err != state.ErrNotFound {
+		return err
+	}
+
+	r := &state.Record{
+		ContainerID: id,
+		Workload:    fmt.Sprintf("%s.%s", pod.Namespace, pod.Name),
+		Namespace:   pod.Namespace,
+		Pod:         pod.Name,
+		HostNetwork: true,
+		IngressRate: ingressRate,
+		EgressRate:  egressRate,
+		Status:      state.StatusUnsupported,
+	}
+	if old != nil {
+		r.NIC = old.NIC
+		r.NICClassMinor = old.NICClassMinor
+		r.ShapingMode = old.ShapingMode
+	}
+
+	switch {
+	case a.config.HostNetworkNIC == "":
+		r.StatusReason = "hostNetwork pods bypass the CNI plugin and are not shaped"
+	case egressRate == 0:
+		r.StatusReason = "only egress of hostNetwork pods can be shaped"
+	default:
+		var unlock func()
+		if unlock, err = state.LockTC(); err != nil {
+			r.StatusReason = fmt.Sprintf("failed to shape egress: %v", err)
+			r.MarkReconcileFailed(errors.New(r.StatusReason))
+			break
+		}
+		if r.ShapingMode == utils.ShapingModeNIC {
+			err = utils.SetRecordRates(r, 0, egressRate)
+		} else {
+			r.NIC = a.config.HostNetworkNIC
+			r.NICClassMinor, err = utils.SetupCgroupShaping(a.store, r.NIC, r, string(pod.UID), egressRate)
+		}
+		unlock()
+		if err != nil {
+			r.StatusReason = fmt.Sprintf("failed to shape egress: %v", err)
+			r.MarkReconcileFailed(errors.New(r.StatusReason))
+			break
+		}
+		r.ShapingMode = utils.ShapingModeNIC
+		r.Status = state.StatusApplied
+		r.MarkReconciled()
+		if ingressRate != 0 {
+			r.StatusReason = "ingress of hostNetwork pods is not shaped"
+		}
+	}
+
+	if r.Status == state.StatusUnsupported && (old == nil || old.StatusReason != r.StatusReason) {
+		a.recordEvent(r, reasonHostNetworkUnsupported, "bandwidth annotations of hostNetwork pod not applied: %s",
+			r.StatusReason)
+	}
+	if err = a.saveRecord(r); err != nil {
+		return err
+	}
+	action := state.AuditUpdate
+	if old == nil {
+		action = state.AuditCreate
+	}
+	detail := "egress shaped on " + r.NIC
+	if r.Status != state.StatusApplied {
+		detail = r.StatusReason
+	}
+	a.audit(r, action, state.AuditTriggerAnnotation, "%s", detail)
+	return nil
+}
@@ -0,0 +1,214 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/projectcalico/cni-plugin/metrics"
+	"github.com/projectcalico/cni-plugin/state"
+)
+
+// DefaultIPFIXInterval is how often the traffic of pods is exported to the IPFIX collector.
+const DefaultIPFIXInterval = time.Minute
+
+var ipfixRecords = metrics.NewCounter("flowcontrol_ipfix_records_total",
+	"Flow records exported to the IPFIX collector.", "result")
+
+// IPFIX (RFC 7011) message layout.
+const (
+	ipfixVersion        = 10
+	ipfixTemplateSetID  = 2
+	ipfixTemplateIPv4   = 256
+	ipfixTemplateIPv6   = 257
+	ipfixVariableLength = 65535
+	// ipfixMaxMessage keeps messages within a datagram on a 1500 byte MTU.
+	ipfixMaxMessage = 1400
+)
+
+// Information elements exported for each flow. The pod is identified by the name of its host veth
+// (interfaceName) and by namespace/pod (interfaceDescription), so that collectors can aggregate per namespace
+// without enterprise-specific elements.
+const (
+	ieOctetDeltaCount          = 1
+	iePacketDeltaCount         = 2
+	ieProtocolIdentifier       = 4
+	ieSourceTransportPort      = 7
+	ieSourceIPv4Address        = 8
+	ieDestinationTransportPort = 11
+	ieDestinationIPv4Address   = 12
+	ieSourceIPv6Address        = 27
+	ieDestinationIPv6Address   = 28
+	ieInterfaceName            = 82
+	ieInterfaceDescription     = 83
+	ieFlowEndSeconds           = 151
+)
+
+// ipfixTemplate returns the field specifiers of the template of a family, as pairs of element and length.
+func ipfixTemplate(ipv6 bool) []uint16 {
+	src, dst, addrLen := uint16(ieSourceIPv4Address), uint16(ieDestinationIPv4Address), uint16(net.IPv4len)
+	if ipv6 {
+		src, dst, addrLen = ieSourceIPv6Address, ieDestinationIPv6Address, net.IPv6len
+	}
+	return []uint16{
+		src, addrLen,
+		dst, addrLen,
+		ieProtocolIdentifier, 1,
+		ieSourceTransportPort, 2,
+		ieDestinationTransportPort, 2,
+		ieOctetDeltaCount, 8,
+		iePacketDeltaCount, 8,
+		ieFlowEndSeconds, 4,
+		ieInterfaceName, ipfixVariableLength,
+		ieInterfaceDescription, ipfixVariableLength,
+	}
+}
+
+// ipfixExporter sends the traffic pods sent since the last export to an IPFIX collector over UDP, as delta counts
+// per connection and direction.
+type ipfixExporter struct {
+	conn   net.Conn
+	source flowSource
+	// last holds the cumulative counts of each flow at the previous export.
+	last     map[string]flow
+	sequence uint32
+}
+
+func newIPFIXExporter(collector string, source flowSource) (*ipfixExporter, error) {
+	conn, err := net.Dial("udp", collector)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to IPFIX collector %s: %v", collector, err)
+	}
+	return &ipfixExporter{conn: conn, source: source, last: map[string]flow{}}, nil
+}
+
+// runIPFIXExport exports the traffic of pods to the collector every interval, forever.
+func (a *Agent) runIPFIXExport(e *ipfixExporter, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if err := a.exportFlows(e); err != nil {
+			agentLog.WithError(err).Error("Failed to export flows to the IPFIX collector")
+		}
+	}
+}
+
+// exportFlows sends a record for each flow that carried traffic since the last export. Connections that closed in
+// between lose what they sent after the last export.
+func (a *Agent) exportFlows(e *ipfixExporter) error {
+	records, err := a.store.List()
+	if err != nil {
+		return err
+	}
+	pods := map[string]*state.Record{}
+	for _, r := range records {
+		for _, ip := range r.IPs {
+			if parsed := net.ParseIP(ip); parsed != nil {
+				pods[parsed.String()] = r
+			}
+		}
+	}
+	flows, err := e.source.Flows(pods)
+	if err != nil {
+		return err
+	}
+
+	seen := map[string]flow{}
+	var deltas []flow
+	for _, f := range flows {
+		key := f.key()
+		seen[key] = f
+		prev, ok := e.last[key]
+		// A connection whose counts went backwards was replaced by a new one with the same tuple.
+		if ok && f.bytes >= prev.bytes && f.packets >= prev.packets {
+			f.bytes -= prev.bytes
+			f.packets -= prev.packets
+		}
+		if f.packets != 0 {
+			deltas = append(deltas, f)
+		}
+	}
+	e.last = seen
+
+	now := time.Now()
+	for len(deltas) > 0 {
+		msg, n := e.message(deltas, now)
+		if _, err = e.conn.Write(msg); err != nil {
+			ipfixRecords.Inc("error")
+			return fmt.Errorf("failed to send IPFIX message: %v", err)
+		}
+		ipfixRecords.Add(float64(n), "exported")
+		deltas = deltas[n:]
+	}
+	return nil
+}
+
+// message encodes as many of flows as fit in a message, with the templates, and returns it and how many flows it
+// holds. Templates are sent in every message, since over UDP the collector may have missed earlier ones.
+func (e *ipfixExporter) message(flows []flow, now time.Time) ([]byte, int) {
+	var body bytes.Buffer
+	for _, ipv6 := range []bool{false, true} {
+		id := uint16(ipfixTemplateIPv4)
+		if ipv6 {
+			id = ipfixTemplateIPv6
+		}
+		fields := ipfixTemplate(ipv6)
+		writeSetHeader(&body, ipfixTemplateSetID, 4+4+2*len(fields))
+		binary.Write(&body, binary.BigEndian, []uint16{id, uint16(len(fields) / 2)})
+		binary.Write(&body, binary.BigEndian, fields)
+	}
+
+	n := 0
+	for n < len(flows) {
+		// Each record is in a data set of its own, so that IPv4 and IPv6 records can be mixed.
+		var rec bytes.Buffer
+		f := flows[n]
+		ipv6 := f.src.To4() == nil
+		id, src, dst := uint16(ipfixTemplateIPv4), []byte(f.src.To4()), []byte(f.dst.To4())
+		if ipv6 {
+			id, src, dst = ipfixTemplateIPv6, f.src.To16(), f.dst.To16()
+		}
+		rec.Write(src)
+		rec.Write(dst)
+		rec.WriteByte(f.proto)
+		binary.Write(&rec, binary.BigEndian, []uint16{f.srcPort, f.dstPort})
+		binary.Write(&rec, binary.BigEndian, []uint64{f.bytes, f.packets})
+		binary.Write(&rec, binary.BigEndian, uint32(now.Unix()))
+		pod := f.record.Pod
+		if pod == "" {
+			pod = f.record.Workload
+		}
+		writeVariable(&rec, f.record.HostVeth)
+		writeVariable(&rec, f.record.Namespace+"/"+pod)
+
+		if 16+body.Len()+4+rec.Len() > ipfixMaxMessage && n > 0 {
+			break
+		}
+		writeSetHeader(&body, id, 4+rec.Len())
+		body.Write(rec.Bytes())
+		n++
+	}
+
+	var msg bytes.Buffer
+	binary.Write(&msg, binary.BigEndian, []uint16{ipfixVersion, uint16(16 + body.Len())})
+	binary.Write(&msg, binary.BigEndian, []uint32{uint32(now.Unix()), e.sequence, 0})
+	msg.Write(body.Bytes())
+	e.sequence += uint32(n)
+	return msg.Bytes(), n
+}
+
+func writeSetHeader(b *bytes.Buffer, id uint16, length int) {
+	binary.Write(b, binary.BigEndian, []uint16{id, uint16(length)})
+}
+
+// writeVariable writes a variable-length string field, prefixed by its length.
+func writeVariable(b *bytes.Buffer, s string) {
+	if len(s) < 255 {
+		b.WriteByte(byte(len(s)))
+	} else {
+		b.WriteByte(255)
+		binary.Write(b, binary.BigEndian, uint16(len(s)))
+	}
+	b.WriteString(s)
+}
@@ -0,0 +1,64 @@
+package agent
+
+import (
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/cni-plugin/state"
+	"github.com/vishvananda/netlink"
+)
+
+// linkDeleteSettle is how long the agent waits after an interface disappears before deciding the deletion was
+// unexpected. A CNI DEL removes the interfaces slightly before the state record, so deletions whose record is
+// gone by then are ordinary teardowns.
+const linkDeleteSettle = 5 * time.Second
+
+const (
+	reasonInterfaceDeleted = "InterfaceDeleted"
+	reasonReconciled       = "Reconciled"
+	reasonReconcileFailed  = "ReconcileFailed"
+)
+
+// watchLinks subscribes to netlink link notifications and handles deletions of interfaces the plugin manages.
+func (a *Agent) watchLinks(done <-chan struct{}) error {
+	updates := make(chan netlink.LinkUpdate)
+	if err := netlink.LinkSubscribe(updates, done); err != nil {
+		return err
+	}
+	go func() {
+		for u := range updates {
+			if u.Header.Type != syscall.RTM_DELLINK {
+				continue
+			}
+			name := u.Attrs().Name
+			time.AfterFunc(linkDeleteSettle, func() { a.handleLinkDeleted(name) })
+		}
+	}()
+	return nil
+}
+
+// handleLinkDeleted marks the pod owning the deleted interface as degraded and, if configured, repairs its
+// shaping. Only the IFB device can be rebuilt; a pod whose host veth is gone has lost its connectivity and its
+// record is left for the garbage collector.
+func (a *Agent) handleLinkDeleted(name string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	r := a.findByInterface(name)
+	if r == nil {
+		return
+	}
+
+	a.recordEvent(r, reasonInterfaceDeleted, "managed interface %s was deleted outside of a CNI DEL", name)
+	r.Status = state.StatusDegraded
+	r.StatusReason = "interface " + name + " deleted"
+	if err := a.saveRecord(r); err != nil {
+		agentLog.WithError(err).Error("Failed to record degraded shaping state")
+		return
+	}
+
+	if a.config.AutoRepair && name == r.IFB {
+		a.repair(r, false, true)
+	}
+}
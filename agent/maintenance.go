@@ -0,0 +1,207 @@
+package agent
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/cni-plugin/state"
+	"github.com/projectcalico/cni-plugin/utils"
+)
+
+// DefaultMaintenanceTTL is how long the node stays in maintenance when the request doesn't specify a TTL.
+const DefaultMaintenanceTTL = time.Hour
+
+const (
+	reasonMaintenanceStarted = "MaintenanceStarted"
+	reasonMaintenanceEnded   = "MaintenanceEnded"
+)
+
+// MaintenanceStatus is the maintenance mode of the node, and the outcome of turning it on or off.
+type MaintenanceStatus struct {
+	Enabled bool       `json:"enabled"`
+	Since   *time.Time `json:"since,omitempty"`
+	Until   *time.Time `json:"until,omitempty"`
+	Reason  string     `json:"reason,omitempty"`
+	// Updated counts the pods whose limits were relaxed or restored by turning maintenance on or off.
+	Updated int `json:"updated,omitempty"`
+	// Failed are the workloads whose limits couldn't be changed, with the reason.
+	Failed map[string]string `json:"failed,omitempty"`
+}
+
+// Maintenance returns the maintenance mode of the node.
+func (a *Agent) Maintenance() *MaintenanceStatus {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return maintenanceStatus(a.maintenance)
+}
+
+func maintenanceStatus(m *state.Maintenance) *MaintenanceStatus {
+	if m == nil {
+		return &MaintenanceStatus{}
+	}
+	since, until := m.Since, m.Until
+	return &MaintenanceStatus{Enabled: true, Since: &since, Until: &until, Reason: m.Reason}
+}
+
+// StartMaintenance puts the node in maintenance for ttl (the configured default if zero): the classes of every pod
+// keep their rates but may borrow up to line rate, for incident mitigation and node drains, and the recorded
+// limits are restored once ttl has elapsed. Classes and records are kept as they are. Starting maintenance again
+// extends it. Paused pods are already relaxed, and pods set up during maintenance are shaped at their limits.
+func (a *Agent) StartMaintenance(ttl time.Duration, reason string) (*MaintenanceStatus, error) {
+	if ttl <= 0 {
+		ttl = a.config.MaintenanceTTL
+	}
+	now := time.Now()
+	m := &state.Maintenance{Since: now, Until: now.Add(ttl), Reason: reason}
+	a.mu.Lock()
+	if a.maintenance != nil {
+		m.Since = a.maintenance.Since
+	}
+	if err := a.store.SaveMaintenance(m); err != nil {
+		a.mu.Unlock()
+		return nil, err
+	}
+	a.maintenance = m
+	a.scheduleMaintenanceEnd(m, ttl)
+	a.mu.Unlock()
+
+	a.recordNodeEvent(reasonMaintenanceStarted, "node in maintenance until %s: %s", m.Until.Format(time.RFC3339),
+		reason)
+	a.audit(nil, state.AuditUpdate, state.AuditTriggerAPI, "maintenance until %s: %s", m.Until.Format(time.RFC3339),
+		reason)
+	status := maintenanceStatus(m)
+	a.reapplyLimits(status)
+	agentLog.WithFields(log.Fields{
+		"until":   m.Until,
+		"reason":  reason,
+		"updated": status.Updated,
+		"failed":  len(status.Failed),
+	}).Info("Started maintenance")
+	return status, nil
+}
+
+// EndMaintenance takes the node out of maintenance, restoring the limits of every pod.
+func (a *Agent) EndMaintenance() (*MaintenanceStatus, error) {
+	a.mu.Lock()
+	m := a.maintenance
+	a.mu.Unlock()
+	return a.endMaintenance(m, state.AuditTriggerAPI)
+}
+
+// endMaintenance ends the maintenance m, unless it has since ended or been extended, auditing it as made by
+// trigger.
+func (a *Agent) endMaintenance(m *state.Maintenance, trigger string) (*MaintenanceStatus, error) {
+	a.mu.Lock()
+	if m == nil || a.maintenance != m {
+		defer a.mu.Unlock()
+		return maintenanceStatus(a.maintenance), nil
+	}
+	if err := a.store.DeleteMaintenance(); err != nil {
+		a.mu.Unlock()
+		return nil, err
+	}
+	a.maintenance = nil
+	if a.maintenanceTimer != nil {
+		a.maintenanceTimer.Stop()
+		a.maintenanceTimer = nil
+	}
+	a.mu.Unlock()
+
+	a.recordNodeEvent(reasonMaintenanceEnded, "node out of maintenance started at %s", m.Since.Format(time.RFC3339))
+	a.audit(nil, state.AuditUpdate, trigger, "ended maintenance started at %s", m.Since.Format(time.RFC3339))
+	status := maintenanceStatus(nil)
+	a.reapplyLimits(status)
+	agentLog.WithFields(log.Fields{"updated": status.Updated, "failed": len(status.Failed)}).Info("Ended maintenance")
+	return status, nil
+}
+
+// scheduleMaintenanceEnd arms (or re-arms) the timer ending the maintenance m. The caller must hold a.mu.
+func (a *Agent) scheduleMaintenanceEnd(m *state.Maintenance, after time.Duration) {
+	if a.maintenanceTimer != nil {
+		a.maintenanceTimer.Stop()
+	}
+	a.maintenanceTimer = time.AfterFunc(after, func() {
+		if _, err := a.endMaintenance(m, state.AuditTriggerExpiry); err != nil {
+			agentLog.WithError(err).Error("Failed to end expired maintenance")
+		}
+	})
+}
+
+// restoreMaintenance re-arms the end of a maintenance started before the agent (re)started. The limits of the pods
+// were left relaxed in the kernel; a maintenance that expired while the agent was down is ended straight away.
+func (a *Agent) restoreMaintenance() error {
+	m, err := a.store.LoadMaintenance()
+	if err == state.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.maintenance = m
+	after := m.Until.Sub(time.Now())
+	if after < 0 {
+		after = 0
+	}
+	a.scheduleMaintenanceEnd(m, after)
+	return nil
+}
+
+// reapplyLimits sets the classes of every pod that isn't paused to its active rates, relaxed if the node is in
+// maintenance, within the reconcile budget, and counts the outcome in status.
+func (a *Agent) reapplyLimits(status *MaintenanceStatus) {
+	records, err := a.store.List()
+	if err != nil {
+		agentLog.WithError(err).Error("Failed to list shaping state")
+		return
+	}
+	for _, r := range records {
+		if r.HostNetwork && r.ShapingMode != utils.ShapingModeNIC {
+			continue
+		}
+		updated, err := a.reapplyRecordLimits(r.Key())
+		switch {
+		case err == state.ErrNotFound:
+			// Deleted since it was listed.
+		case err != nil:
+			if status.Failed == nil {
+				status.Failed = map[string]string{}
+			}
+			status.Failed[r.Workload] = err.Error()
+		case updated:
+			status.Updated++
+		}
+	}
+}
+
+// reapplyRecordLimits sets the classes of the pod stored under key to its active rates, relaxed if the node is in maintenance, and
+// reports whether it did; paused pods are left relaxed.
+func (a *Agent) reapplyRecordLimits(key string) (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	r, err := a.store.Load(key)
+	if err != nil || r.Paused {
+		return false, err
+	}
+	a.budget.wait()
+	ingress, egress := r.ActiveRates()
+	if err = a.setRecordRates(r, ingress, egress); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// setRecordRates changes the rates of the classes of the pod of r, relaxing them while the node is in maintenance.
+// The caller must hold a.mu.
+func (a *Agent) setRecordRates(r *state.Record, ingressRate, egressRate uint64) error {
+	unlock, err := state.LockTC()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if a.maintenance == nil {
+		return utils.SetRecordRates(r, ingressRate, egressRate)
+	}
+	ingress, egress, ingressCeil, egressCeil := utils.RelaxedLimits(r, ingressRate, egressRate, a.config.LineRate)
+	return utils.SetRecordLimits(r, ingress, egress, ingressCeil, egressCeil)
+}
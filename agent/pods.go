@@ -0,0 +1,131 @@
+package agent
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/projectcalico/cni-plugin/state"
+	"github.com/projectcalico/cni-plugin/utils"
+)
+
+const (
+	// DefaultListLimit is the page size of ListShapedPods when the request doesn't set one.
+	DefaultListLimit = 500
+	// maxListLimit bounds the page size a request can ask for.
+	maxListLimit = 5000
+)
+
+// ShapedPod summarizes the shaping of a pod on the node.
+type ShapedPod struct {
+	// ContainerID and IfName are the container and its interface shaped, as pods attached to several networks have
+	// a record for each.
+	ContainerID string `json:"container_id"`
+	IfName      string `json:"if_name,omitempty"`
+	Namespace   string `json:"namespace,omitempty"`
+	Pod         string `json:"pod,omitempty"`
+	Workload    string `json:"workload,omitempty"`
+	HostNetwork bool   `json:"host_network,omitempty"`
+
+	// Rates are in bits per second, from the point of view of the pod. Zero means unlimited.
+	IngressRate uint64 `json:"ingress_rate"`
+	EgressRate  uint64 `json:"egress_rate"`
+	// Backend is where the pod is shaped: "veth" or "nic".
+	Backend string `json:"backend"`
+
+	// Health is the status of the pod's shaping, one of the state.Status values, with the reason if it isn't
+	// Applied.
+	Health       string `json:"health"`
+	HealthReason string `json:"health_reason,omitempty"`
+	Paused       bool   `json:"paused,omitempty"`
+	// Throttle is the temporary limit applied in place of the rates above, if any.
+	Throttle *state.Throttle `json:"throttle,omitempty"`
+
+	// LastReconciled is when the shaping was last programmed or found intact.
+	LastReconciled time.Time `json:"last_reconciled"`
+	// LastAttempt is when the shaping was last programmed, checked or repaired, and LastError why that failed, if
+	// it did.
+	LastAttempt *time.Time `json:"last_attempt,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+// ShapedPodList is a page of ShapedPods, ordered by container ID and interface. Continue is passed to the next request to get
+// the following page, and is empty on the last one.
+type ShapedPodList struct {
+	Pods     []ShapedPod `json:"pods"`
+	Continue string      `json:"continue,omitempty"`
+}
+
+// ListShapedPods returns up to limit pods (DefaultListLimit if zero) with record keys after continueFrom.
+func (a *Agent) ListShapedPods(limit int, continueFrom string) (*ShapedPodList, error) {
+	return a.listShapedPods(limit, continueFrom, nil)
+}
+
+// listShapedPods is ListShapedPods for the pods whose records keep accepts, or every pod if it is nil.
+func (a *Agent) listShapedPods(limit int, continueFrom string, keep func(*state.Record) bool) (*ShapedPodList, error) {
+	if limit < 0 || limit > maxListLimit {
+		return nil, fmt.Errorf("limit must be between 0 and %d", maxListLimit)
+	} else if limit == 0 {
+		limit = DefaultListLimit
+	}
+	records, err := a.store.List()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Key() < records[j].Key() })
+
+	list := &ShapedPodList{Pods: []ShapedPod{}}
+	for _, r := range records {
+		if r.Key() <= continueFrom || (keep != nil && !keep(r)) {
+			continue
+		}
+		if len(list.Pods) == limit {
+			last := list.Pods[limit-1]
+			list.Continue = state.RecordKey(last.ContainerID, last.IfName)
+			break
+		}
+		list.Pods = append(list.Pods, shapedPod(r))
+	}
+	return list, nil
+}
+
+// ShapedPod returns the pod identified by id, a container ID or workload name.
+func (a *Agent) ShapedPod(id string) (*ShapedPod, error) {
+	r, err := a.store.Find(id)
+	if err != nil {
+		return nil, err
+	}
+	p := shapedPod(r)
+	return &p, nil
+}
+
+func shapedPod(r *state.Record) ShapedPod {
+	p := ShapedPod{
+		ContainerID:    r.ContainerID,
+		IfName:         r.IfName,
+		Namespace:      r.Namespace,
+		Pod:            r.Pod,
+		Workload:       r.Workload,
+		HostNetwork:    r.HostNetwork,
+		IngressRate:    r.IngressRate,
+		EgressRate:     r.EgressRate,
+		Backend:        r.ShapingMode,
+		Health:         r.Status,
+		HealthReason:   r.StatusReason,
+		Paused:         r.Paused,
+		Throttle:       r.Throttle,
+		LastReconciled: r.Updated,
+		LastAttempt:    r.ReconcileAttempted,
+		LastError:      r.ReconcileError,
+	}
+	if p.Backend == "" {
+		p.Backend = utils.ShapingModeVeth
+	}
+	if p.Health == "" {
+		p.Health = state.StatusApplied
+	}
+	if r.Reconciled != nil {
+		p.LastReconciled = *r.Reconciled
+	}
+	return p
+}
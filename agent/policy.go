@@ -0,0 +1,131 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/cni-plugin/cloud"
+	"github.com/projectcalico/cni-plugin/policy"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// DefaultPolicyConfigMap is the namespace/name of the ConfigMap holding the cluster flow control policy.
+const DefaultPolicyConfigMap = "kube-system/flowcontrol-policy"
+
+// policyResync is how often the policy ConfigMap is read.
+const policyResync = time.Minute
+
+// instanceTypeLabels are the node labels the instance type is read from, newest first.
+var instanceTypeLabels = []string{"node.kubernetes.io/instance-type", "beta.kubernetes.io/instance-type"}
+
+// runPolicySync copies the cluster policy and the bandwidth quotas to the state directory every interval, forever,
+// and applies the templates of the policy.
+func (a *Agent) runPolicySync(interval time.Duration) {
+	for {
+		if err := a.syncPolicy(); err != nil {
+			agentLog.WithError(err).Error("Failed to sync cluster flow control policy")
+		} else if err = a.applyTemplates(); err != nil {
+			agentLog.WithError(err).Error("Failed to apply flow control templates")
+		}
+		if err := a.syncQuotas(); err != nil {
+			agentLog.WithError(err).Error("Failed to sync bandwidth quotas")
+		}
+		sleepJittered(interval)
+	}
+}
+
+// syncPolicy reads the policy ConfigMap, resolves the capacity of the local node and writes the result where the
+// CNI plugin reads it. The local copy is removed if the ConfigMap is, so that pods fall back to their annotations.
+func (a *Agent) syncPolicy() error {
+	parts := strings.SplitN(a.config.PolicyConfigMap, "/", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("policy ConfigMap %q is not of the form namespace/name", a.config.PolicyConfigMap)
+	}
+	cm, err := a.kube.ConfigMaps(parts[0]).Get(parts[1], metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return policy.Remove(a.config.StateDir)
+	} else if err != nil {
+		return err
+	}
+	p, err := policy.Parse([]byte(cm.Data[policy.ConfigMapKey]))
+	if err != nil {
+		return err
+	}
+
+	if len(p.NodeCapacity) > 0 {
+		node, err := a.kube.Nodes().Get(a.config.NodeName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		for _, label := range instanceTypeLabels {
+			if instanceType, ok := node.Labels[label]; ok {
+				p.Capacity = p.NodeCapacity[instanceType]
+				break
+			}
+		}
+	}
+	// Configured capacities win; otherwise fall back to what the cloud provider says the instance type has.
+	if p.Capacity == 0 && a.config.DiscoverCapacity {
+		if instance := a.cloudInstance(); instance != nil {
+			if c, ok := p.NodeCapacity[instance.Type]; ok {
+				p.Capacity = c
+			} else if c, ok := cloud.Capacity(*instance); ok {
+				p.Capacity = c
+			} else {
+				agentLog.WithFields(log.Fields{"provider": instance.Provider, "type": instance.Type}).Debug("Unknown instance type")
+			}
+		}
+	}
+	// Pods without a PriorityClass are in the global default one, which only the API server knows.
+	if len(p.PriorityClasses) > 0 {
+		if p.DefaultPriorityClass, err = a.defaultPriorityClass(); err != nil {
+			agentLog.WithError(err).Warn("Failed to resolve the default PriorityClass")
+		}
+	}
+	return policy.Save(a.config.StateDir, p)
+}
+
+// defaultPriorityClass returns the name of the PriorityClass marked as the global default, or "" if there is none.
+// The vendored client predates the scheduling API, so the classes are read raw.
+func (a *Agent) defaultPriorityClass() (string, error) {
+	data, err := a.kube.Core().RESTClient().Get().AbsPath("/apis/scheduling.k8s.io/v1/priorityclasses").Do().Raw()
+	if err != nil {
+		return "", err
+	}
+	var list struct {
+		Items []struct {
+			Metadata struct {
+				Name string `json:"name"`
+			} `json:"metadata"`
+			GlobalDefault bool `json:"globalDefault"`
+		} `json:"items"`
+	}
+	if err = json.Unmarshal(data, &list); err != nil {
+		return "", fmt.Errorf("failed to parse PriorityClasses: %v", err)
+	}
+	for _, c := range list.Items {
+		if c.GlobalDefault {
+			return c.Metadata.Name, nil
+		}
+	}
+	return "", nil
+}
+
+// cloudInstance discovers the instance type of the node the first time it is called, or returns nil if the node
+// isn't on a supported cloud.
+func (a *Agent) cloudInstance() *cloud.Instance {
+	a.instanceOnce.Do(func() {
+		instance, err := cloud.NewDiscoverer().Discover()
+		if err != nil {
+			agentLog.WithError(err).Warn("Failed to discover instance type, node capacity must be configured")
+			return
+		}
+		agentLog.WithFields(log.Fields{"provider": instance.Provider, "type": instance.Type}).Info("Discovered instance type")
+		a.instance = &instance
+	})
+	return a.instance
+}
@@ -0,0 +1,26 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/projectcalico/cni-plugin/quota"
+	"k8s.io/apimachinery/pkg/api/errors"
+)
+
+// syncQuotas copies the BandwidthQuotas of every namespace, with the usage the aggregator last observed, to the
+// state directory, where the CNI plugin checks new pods against them. The local copy is removed if the cluster
+// doesn't serve BandwidthQuotas. The vendored client predates custom resources, so they are read raw.
+func (a *Agent) syncQuotas() error {
+	data, err := a.kube.Core().RESTClient().Get().AbsPath(quota.ListPath()).Do().Raw()
+	if errors.IsNotFound(err) {
+		return quota.Remove(a.config.StateDir)
+	} else if err != nil {
+		return err
+	}
+	list := quota.List{}
+	if err = json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("failed to parse bandwidth quotas: %v", err)
+	}
+	return quota.Save(a.config.StateDir, list.Items)
+}
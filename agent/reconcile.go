@@ -0,0 +1,32 @@
+package agent
+
+import "time"
+
+// runReconcile checks the shaping of every pod against its record when the agent starts and every interval after,
+// rebuilding what is missing, forever. The tc and link watchers only see the changes made while the agent runs,
+// and a flush of tc state is repaired by them only with AutoRepair; the sweep catches the rest.
+func (a *Agent) runReconcile(interval time.Duration) {
+	for {
+		a.reconcileAll()
+		time.Sleep(interval)
+	}
+}
+
+// reconcileAll checks the shaping of every recorded pod, repairing the pods whose hierarchy has drifted. The lock is
+// taken pod by pod, so that the API isn't held up by a sweep of a busy node.
+func (a *Agent) reconcileAll() {
+	records, err := a.store.List()
+	if err != nil {
+		agentLog.WithError(err).Error("Failed to list shaping state to reconcile")
+		return
+	}
+	for _, listed := range records {
+		a.mu.Lock()
+		// The pod may have changed or gone since it was listed.
+		if r, err := a.store.Load(listed.Key()); err == nil {
+			a.checkShaping(r, true)
+		}
+		a.mu.Unlock()
+	}
+	agentLog.WithField("pods", len(records)).Debug("Reconciled shaping of pods")
+}
@@ -0,0 +1,168 @@
+package agent
+
+import (
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/cni-plugin/metrics"
+	"github.com/projectcalico/cni-plugin/state"
+	"github.com/projectcalico/cni-plugin/utils"
+)
+
+// A direction of a pod is saturated when it has used all of its limit, and its classes dropped packets, at every
+// checkpoint of its counters for a window: the pod wants more than it is allowed, rather than bursting. Autoscalers
+// and developers can take it as the reason to raise its limits or scale it out.
+
+// DefaultSaturationWindow is how long a direction of a pod must use its whole limit with drops to be saturated.
+const DefaultSaturationWindow = 5 * time.Minute
+
+const (
+	// saturationUtilization is the share of its limit a direction must use between two checkpoints to count as
+	// using all of it; shaped traffic never quite reaches the limit as counted by the classes.
+	saturationUtilization = 0.95
+
+	// saturationAnnotation lists the saturated directions of a pod, if the agent publishes them.
+	saturationAnnotation = "flowcontrol.cni/bandwidth-saturated"
+
+	reasonBandwidthSaturated = "BandwidthSaturated"
+)
+
+var podSaturated = metrics.NewGauge("flowcontrol_pod_bandwidth_saturated",
+	"1 for the directions of pods that used their whole limit and dropped packets for the saturation window, 0 for the others.",
+	"namespace", "pod", "direction")
+
+// directionSaturation tracks whether a direction of a pod is saturated.
+type directionSaturation struct {
+	// since is the checkpoint since which the direction used its whole limit with drops, zero if it didn't at the
+	// last one.
+	since     time.Time
+	saturated bool
+}
+
+// podSaturation is the saturation of a pod as of its last checkpoint.
+type podSaturation struct {
+	at      time.Time
+	traffic state.Traffic
+	ingress directionSaturation
+	egress  directionSaturation
+}
+
+// observeSaturation updates the saturation of the pod of r with its cumulative traffic t, counted at now. The
+// caller must hold a.mu.
+func (a *Agent) observeSaturation(r *state.Record, t state.Traffic, now time.Time) {
+	a.saturationMu.Lock()
+	p, ok := a.saturation[r.Key()]
+	if !ok {
+		a.saturation[r.Key()] = &podSaturation{at: now, traffic: t}
+		a.saturationMu.Unlock()
+		return
+	}
+	// Pods paused, or relaxed by maintenance, aren't held to their limits.
+	relaxed := r.Paused || a.maintenance != nil
+	ingressRate, egressRate := r.ActiveRates()
+	ingressLimit, egressLimit := utils.CeilsOf(r, ingressRate, egressRate)
+	seconds := now.Sub(p.at).Seconds()
+	ingressChanged := p.ingress.observe(!relaxed && saturatedBetween(p.traffic.IngressBytes, t.IngressBytes,
+		p.traffic.IngressDrops, t.IngressDrops, ingressLimit, seconds), p.at, now, a.config.SaturationWindow)
+	egressChanged := p.egress.observe(!relaxed && saturatedBetween(p.traffic.EgressBytes, t.EgressBytes,
+		p.traffic.EgressDrops, t.EgressDrops, egressLimit, seconds), p.at, now, a.config.SaturationWindow)
+	p.at, p.traffic = now, t
+	ingress, egress := p.ingress.saturated, p.egress.saturated
+	a.saturationMu.Unlock()
+
+	namespace, pod := r.Namespace, r.Pod
+	if pod == "" {
+		pod = r.Workload
+	}
+	podSaturated.Set(gaugeValue(ingress), namespace, pod, "ingress")
+	podSaturated.Set(gaugeValue(egress), namespace, pod, "egress")
+	for _, d := range []struct {
+		direction string
+		changed   bool
+		saturated bool
+		limit     uint64
+	}{
+		{"ingress", ingressChanged, ingress, ingressLimit},
+		{"egress", egressChanged, egress, egressLimit},
+	} {
+		if !d.changed {
+			continue
+		}
+		if d.saturated {
+			a.recordEvent(r, reasonBandwidthSaturated, "%s saturated its limit of %d bit/s with drops for %s",
+				d.direction, d.limit, a.config.SaturationWindow)
+		} else {
+			agentLog.WithFields(log.Fields{"container": r.ContainerID, "direction": d.direction}).Info("Pod no longer saturated")
+		}
+	}
+	if (ingressChanged || egressChanged) && a.config.SaturationAnnotation && a.kube != nil {
+		copied := *r
+		go a.publishStatus(&copied)
+	}
+}
+
+// observe records whether the direction was saturated between the checkpoints at last and now, and returns whether
+// that changed whether it is saturated.
+func (d *directionSaturation) observe(hot bool, last, now time.Time, window time.Duration) bool {
+	was := d.saturated
+	switch {
+	case !hot:
+		d.since, d.saturated = time.Time{}, false
+	case d.since.IsZero():
+		d.since = last
+		fallthrough
+	default:
+		d.saturated = now.Sub(d.since) >= window
+	}
+	return d.saturated != was
+}
+
+// saturatedBetween tells whether a direction limited to limit bits per second, whose bytes and drops went from the
+// first to the second counts in seconds, used its whole limit and dropped packets.
+func saturatedBetween(bytes, nextBytes, drops, nextDrops, limit uint64, seconds float64) bool {
+	if limit == 0 || seconds <= 0 || nextBytes < bytes || nextDrops <= drops {
+		return false
+	}
+	return float64(nextBytes-bytes)*8 >= saturationUtilization*float64(limit)*seconds
+}
+
+func gaugeValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// saturatedDirections returns the value of the saturation annotation of the pod stored under key, nil if it isn't saturated.
+func (a *Agent) saturatedDirections(key string) *string {
+	a.saturationMu.Lock()
+	defer a.saturationMu.Unlock()
+	p, ok := a.saturation[key]
+	if !ok {
+		return nil
+	}
+	var directions []string
+	if p.ingress.saturated {
+		directions = append(directions, "ingress")
+	}
+	if p.egress.saturated {
+		directions = append(directions, "egress")
+	}
+	if len(directions) == 0 {
+		return nil
+	}
+	value := strings.Join(directions, ",")
+	return &value
+}
+
+// forgetSaturation drops the saturation of the containers that are no longer recorded.
+func (a *Agent) forgetSaturation(current map[string]bool) {
+	a.saturationMu.Lock()
+	defer a.saturationMu.Unlock()
+	for id := range a.saturation {
+		if !current[id] {
+			delete(a.saturation, id)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package agent
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/cni-plugin/state"
+)
+
+// scheduleInterval is how often the agent checks which window of their bandwidth schedule pods are in. Windows
+// start and end on the minute, so the checks are aligned to it.
+const scheduleInterval = time.Minute
+
+// reasonScheduleWindow is the event reason of a pod entering or leaving a window of its bandwidth schedule.
+const reasonScheduleWindow = "ScheduleWindow"
+
+// runSchedules switches the classes of pods to the rates of the window of their bandwidth schedule they are in,
+// forever.
+func (a *Agent) runSchedules() {
+	windows := map[string]int{}
+	for {
+		a.applySchedules(windows, time.Now())
+		now := time.Now()
+		time.Sleep(now.Truncate(scheduleInterval).Add(scheduleInterval).Sub(now))
+	}
+}
+
+// applySchedules updates the classes of the pods with a bandwidth schedule that are in another window at now than
+// windows, the window each was in when last applied, holds for them, and of those it holds nothing for, as the
+// plugin sets pods up at their recorded rates. A pod whose classes can't be updated is tried again at the next
+// check.
+func (a *Agent) applySchedules(windows map[string]int, now time.Time) {
+	records, err := a.store.List()
+	if err != nil {
+		agentLog.WithError(err).Error("Failed to list shaping state for bandwidth schedules")
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	scheduled := map[string]bool{}
+	for _, r := range records {
+		if len(r.Schedule) == 0 {
+			continue
+		}
+		key := r.Key()
+		scheduled[key] = true
+		w := r.ActiveWindow(now)
+		last, seen := windows[key]
+		if seen && last == w {
+			continue
+		}
+		// The pod may have changed since it was listed.
+		if r, err = a.store.Load(key); err != nil {
+			continue
+		}
+		if err = a.applySchedule(r, w, now, seen); err != nil {
+			agentLog.WithError(err).WithField("container", r.ContainerID).Error("Failed to apply bandwidth schedule")
+			continue
+		}
+		windows[key] = w
+	}
+	for key := range windows {
+		if !scheduled[key] {
+			delete(windows, key)
+		}
+	}
+}
+
+// applySchedule sets the classes of the pod of r to the rates of window w of its schedule at now, or to its
+// recorded ones if w is -1, auditing it and recording an event if the pod changed window rather than was first
+// seen. Paused pods are left relaxed; they get the rates of the window they are in when they are resumed. The caller
+// must hold a.mu.
+func (a *Agent) applySchedule(r *state.Record, w int, now time.Time, changed bool) error {
+	if r.Paused {
+		return nil
+	}
+	a.budget.wait()
+	ingress, egress := r.ActiveRatesAt(now)
+	if err := a.setRecordRates(r, ingress, egress); err != nil {
+		return err
+	}
+	r.MarkReconciled()
+	if err := a.saveRecord(r); err != nil {
+		return err
+	}
+	detail := "outside bandwidth schedule windows"
+	if w >= 0 {
+		detail = "in bandwidth schedule window " + r.Schedule[w].String()
+	}
+	if changed {
+		a.audit(r, state.AuditUpdate, state.AuditTriggerSchedule, "%s, ingress=%d,egress=%d", detail, ingress, egress)
+		a.recordEvent(r, reasonScheduleWindow, "%s, ingress=%d,egress=%d", detail, ingress, egress)
+	}
+	agentLog.WithFields(log.Fields{
+		"container": r.ContainerID,
+		"window":    w,
+		"ingress":   ingress,
+		"egress":    egress,
+	}).Info("Applied bandwidth schedule")
+	return nil
+}
@@ -0,0 +1,121 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/cni-plugin/state"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Annotations the agent publishes on pods so that users can see whether their bandwidth request is in effect.
+const (
+	statusAnnotation       = "flowcontrol.cni/status"
+	ratesAnnotation        = "flowcontrol.cni/rates"
+	statusReasonAnnotation = "flowcontrol.cni/status-reason"
+)
+
+// statusResync is how often the status of every recorded pod is compared with what was last published, which is
+// how records written by the plugin itself get published.
+const statusResync = 30 * time.Second
+
+// saveRecord saves r and publishes its status to the pod. The caller must hold a.mu.
+func (a *Agent) saveRecord(r *state.Record) error {
+	if err := a.store.Save(r); err != nil {
+		return err
+	}
+	if a.kube != nil {
+		copied := *r
+		go a.publishStatus(&copied)
+	}
+	return nil
+}
+
+// runStatusSync publishes the status of all recorded pods every interval, forever.
+func (a *Agent) runStatusSync(interval time.Duration) {
+	for {
+		records, err := a.store.List()
+		if err != nil {
+			agentLog.WithError(err).Error("Failed to list shaping state")
+		}
+		current := map[string]bool{}
+		for _, r := range records {
+			current[r.Key()] = true
+			a.publishStatus(r)
+		}
+		a.publishedMu.Lock()
+		for id := range a.published {
+			if !current[id] {
+				delete(a.published, id)
+			}
+		}
+		a.publishedMu.Unlock()
+		sleepJittered(interval)
+	}
+}
+
+// statusAnnotations returns the annotations describing the shaping of r. A nil value removes the annotation.
+func statusAnnotations(r *state.Record) map[string]*string {
+	status := r.Status
+	if status == "" {
+		status = state.StatusApplied
+	}
+	rates := fmt.Sprintf("ingress=%d,egress=%d", r.IngressRate, r.EgressRate)
+	var reason *string
+	if r.StatusReason != "" {
+		reason = &r.StatusReason
+	} else if r.Paused && r.PausedUntil != nil {
+		paused := "paused until " + r.PausedUntil.Format(time.RFC3339)
+		reason = &paused
+	} else if r.Throttle != nil {
+		throttled := "throttled"
+		if r.Throttle.Until != nil {
+			throttled += " until " + r.Throttle.Until.Format(time.RFC3339)
+		}
+		if r.Throttle.Reason != "" {
+			throttled += ": " + r.Throttle.Reason
+		}
+		reason = &throttled
+	}
+	return map[string]*string{
+		statusAnnotation:       &status,
+		ratesAnnotation:        &rates,
+		statusReasonAnnotation: reason,
+	}
+}
+
+// publishStatus patches the status annotations of the pod described by r, unless they are unchanged since they
+// were last published. The annotations describe the primary interface of the pod, as its bandwidth annotations do.
+func (a *Agent) publishStatus(r *state.Record) {
+	if r.Pod == "" || state.Secondary(r.IfName) {
+		return
+	}
+	annotations := statusAnnotations(r)
+	if a.config.SaturationAnnotation {
+		annotations[saturationAnnotation] = a.saturatedDirections(r.Key())
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": annotations},
+	})
+	if err != nil {
+		agentLog.WithError(err).Error("Failed to build status patch")
+		return
+	}
+
+	a.publishedMu.Lock()
+	unchanged := a.published[r.Key()] == string(patch)
+	a.publishedMu.Unlock()
+	if unchanged {
+		return
+	}
+
+	if _, err = a.kube.Pods(r.Namespace).Patch(r.Pod, types.MergePatchType, patch); err != nil {
+		agentLog.WithError(err).WithField("workload", r.Workload).Warn("Failed to publish shaping status to pod")
+		return
+	}
+	a.publishedMu.Lock()
+	a.published[r.Key()] = string(patch)
+	a.publishedMu.Unlock()
+}
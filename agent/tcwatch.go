@@ -0,0 +1,223 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/cni-plugin/state"
+	"github.com/projectcalico/cni-plugin/utils"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// tcCheckSettle is how long the agent waits after a tc notification before checking the hierarchy of the device,
+// so that the burst of notifications produced by a single setup or repair results in one check.
+const tcCheckSettle = 2 * time.Second
+
+const reasonShapingTampered = "ShapingTampered"
+
+// watchTC subscribes to rtnetlink tc notifications and schedules a check of any device they concern.
+func (a *Agent) watchTC() error {
+	sock, err := nl.Subscribe(syscall.NETLINK_ROUTE, unix.RTNLGRP_TC)
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer sock.Close()
+		for {
+			msgs, err := sock.Receive()
+			if err != nil {
+				agentLog.WithError(err).Error("Failed to receive tc notifications, no longer watching tc state")
+				return
+			}
+			for _, m := range msgs {
+				switch m.Header.Type {
+				case syscall.RTM_NEWQDISC, syscall.RTM_DELQDISC,
+					syscall.RTM_NEWTCLASS, syscall.RTM_DELTCLASS,
+					syscall.RTM_NEWTFILTER, syscall.RTM_DELTFILTER:
+					a.scheduleTCCheck(int(nl.DeserializeTcMsg(m.Data).Ifindex))
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func (a *Agent) scheduleTCCheck(ifindex int) {
+	a.tcPendingMu.Lock()
+	defer a.tcPendingMu.Unlock()
+	if a.tcPending[ifindex] {
+		return
+	}
+	a.tcPending[ifindex] = true
+	time.AfterFunc(tcCheckSettle, func() {
+		a.tcPendingMu.Lock()
+		delete(a.tcPending, ifindex)
+		a.tcPendingMu.Unlock()
+		a.checkTC(ifindex)
+	})
+}
+
+// checkTC checks the hierarchy of the pod owning the device, repairing it if the agent auto-repairs. The check
+// compares against the intended hierarchy rather than trusting the notification, so the agent's own updates and
+// repairs don't count as tampering.
+func (a *Agent) checkTC(ifindex int) {
+	link, err := netlink.LinkByIndex(ifindex)
+	if err != nil {
+		// The device is gone; that's handled by the link watcher.
+		return
+	}
+	name := link.Attrs().Name
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if r := a.findByInterface(name); r != nil {
+		a.checkShaping(r, a.config.AutoRepair)
+	}
+}
+
+// checkShaping verifies the hierarchy of the pod of r and, when it has drifted, marks the pod degraded and, if
+// repair is set, repairs it. Pods whose host veth is gone are left for the garbage collector. The caller must hold
+// a.mu.
+func (a *Agent) checkShaping(r *state.Record, repair bool) {
+	// Pods shaped on the uplink share its hierarchy, which isn't checked per pod, pods policed with nftables have none,
+	// nor do pods the node couldn't shape, and pods shaped in their network namespace have it out of sight of the host.
+	if r.ShapingMode == utils.ShapingModeNIC || r.ShapingMode == utils.ShapingModeNFTables ||
+		r.ShapingMode == utils.ShapingModeContainer || r.Status == state.StatusUnsupported {
+		return
+	}
+	var drift utils.ShapingDrift
+	var err error
+	switch r.Qdisc {
+	case utils.QdiscEBPF:
+		drift, err = utils.CheckEBPFShaping(r)
+	case utils.QdiscPolice:
+		drift, err = utils.CheckPoliceShaping(r)
+	default:
+		drift, err = utils.CheckShaping(r.HostVeth, r.IFB, r.ShapingGeneration, r.Qdisc, r.IngressRate != 0)
+	}
+	if err != nil {
+		return
+	}
+	if drift.Empty() {
+		r.MarkReconciled()
+		if err = a.saveRecord(r); err != nil {
+			agentLog.WithError(err).Error("Failed to record reconciled shaping state")
+		}
+		return
+	}
+
+	problems := append(drift.Ingress, drift.Egress...)
+	a.recordEvent(r, reasonShapingTampered, "shaping was modified outside of the plugin: %s", strings.Join(problems, "; "))
+	r.Status = state.StatusDegraded
+	r.StatusReason = strings.Join(problems, "; ")
+	r.MarkReconcileFailed(fmt.Errorf("shaping drifted: %s", r.StatusReason))
+	if err = a.saveRecord(r); err != nil {
+		agentLog.WithError(err).Error("Failed to record degraded shaping state")
+		return
+	}
+	if repair {
+		a.repair(r, len(drift.Ingress) > 0, len(drift.Egress) > 0)
+	}
+}
+
+// findByInterface returns the record of the pod owning the named host veth or IFB device, or nil. The caller
+// must hold a.mu.
+func (a *Agent) findByInterface(name string) *state.Record {
+	records, err := a.store.List()
+	if err != nil {
+		agentLog.WithError(err).Error("Failed to list shaping state")
+		return nil
+	}
+	for _, r := range records {
+		if r.HostVeth == name || r.IFB == name {
+			return r
+		}
+	}
+	return nil
+}
+
+// repair rebuilds the requested directions of a pod's shaping, within the reconcile budget, and records the
+// outcome. The caller must hold a.mu.
+func (a *Agent) repair(r *state.Record, ingress, egress bool) {
+	a.budget.wait()
+	ingressRate, egressRate := r.ActiveRates()
+	a.retireCounters(r, ingress, egress)
+	split, bursts := utils.ProtocolSplitOf(r), utils.BurstsOf(r)
+	ingressCeil, egressCeil := utils.CeilsOf(r, ingressRate, egressRate)
+	if r.Paused || a.maintenance != nil {
+		ingressRate, egressRate, ingressCeil, egressCeil = utils.RelaxedLimits(r, ingressRate, egressRate, a.config.LineRate)
+	}
+	restoreIngress := func() error {
+		if r.Qdisc == utils.QdiscEBPF {
+			return utils.RestoreEBPF(r, true, false, ingressRate, egressRate)
+		}
+		if r.Qdisc == utils.QdiscPolice {
+			return utils.RestorePolice(r, true, false, ingressRate, egressRate)
+		}
+		if r.Qdisc == utils.QdiscTBF {
+			return utils.RestoreIngressTBF(r.HostVeth, ingressRate, bursts)
+		}
+		return utils.RestoreIngressShaping(r.HostVeth, r.ShapingGeneration, ingressRate, ingressCeil, r.LatencyClass, r.LeafQdisc, r.ClassPriority, r.NonIPPolicy, r.IPFamilyBudget, r.Classifier, r.MirrorTo, split,
+			r.Classes, bursts)
+	}
+	restoreEgress := func() error {
+		if r.Qdisc == utils.QdiscEBPF {
+			return utils.RestoreEBPF(r, false, true, ingressRate, egressRate)
+		}
+		if r.Qdisc == utils.QdiscPolice {
+			return utils.RestorePolice(r, false, true, ingressRate, egressRate)
+		}
+		if r.EgressPoliced {
+			return utils.RestoreEgressPolicer(r.HostVeth, egressRate, bursts)
+		}
+		if r.Qdisc == utils.QdiscTBF {
+			return utils.RestoreEgressTBF(r.HostVeth, r.IFB, egressRate, bursts, r.NonIPPolicy)
+		}
+		return utils.RestoreEgressShaping(r.HostVeth, r.IFB, r.ShapingGeneration, egressRate, egressCeil, r.LatencyClass, r.LeafQdisc, r.ClassPriority, r.NonIPPolicy, r.IPFamilyBudget, r.Classifier, r.MirrorTo, r.DSCP,
+			split, r.Classes, bursts)
+	}
+	unlock, err := state.LockTC()
+	if err != nil {
+		a.repairFailed(r, "failed to rebuild shaping: %v", err)
+		return
+	}
+	defer unlock()
+	if ingress {
+		if err := restoreIngress(); err != nil {
+			a.repairFailed(r, "failed to rebuild ingress shaping: %v", err)
+			return
+		}
+	}
+	if egress {
+		if err := restoreEgress(); err != nil {
+			a.repairFailed(r, "failed to rebuild egress shaping: %v", err)
+			return
+		}
+	}
+	r.Status = state.StatusApplied
+	r.StatusReason = ""
+	r.MarkReconciled()
+	if err := a.saveRecord(r); err != nil {
+		agentLog.WithError(err).Error("Failed to record repaired shaping state")
+		return
+	}
+	a.recordEvent(r, reasonReconciled, "rebuilt shaping of %s", r.HostVeth)
+	a.audit(r, state.AuditUpdate, state.AuditTriggerReconcile, "rebuilt shaping of %s", r.HostVeth)
+}
+
+// repairFailed records that the shaping of a pod could not be rebuilt. The caller must hold a.mu.
+func (a *Agent) repairFailed(r *state.Record, format string, err error) {
+	a.recordEvent(r, reasonReconcileFailed, format, err)
+	r.Status = state.StatusFailed
+	r.StatusReason = fmt.Sprintf(format, err)
+	r.MarkReconcileFailed(errors.New(r.StatusReason))
+	if err := a.saveRecord(r); err != nil {
+		agentLog.WithError(err).Error("Failed to record failed shaping state")
+	}
+}
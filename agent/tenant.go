@@ -0,0 +1,334 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/cni-plugin/state"
+)
+
+// DefaultTenantAudience is the audience the service account tokens of tenants must be bound to when none is
+// configured.
+const DefaultTenantAudience = "cni-flow-control"
+
+// tokenReviewTTL is how long the outcome of the review of a token is trusted before it is reviewed again.
+const tokenReviewTTL = time.Minute
+
+// serviceAccountPrefix starts the username of a service account, system:serviceaccount:<namespace>:<name>.
+const serviceAccountPrefix = "system:serviceaccount:"
+
+// Tenant is who a request to the tenant API was authenticated as, and the namespaces whose pods it may view and
+// update.
+type Tenant struct {
+	Name       string
+	Namespaces []string
+}
+
+// allows reports whether the tenant may access the pods of namespace. Pods recorded without a namespace belong to
+// no tenant.
+func (t *Tenant) allows(namespace string) bool {
+	for _, ns := range t.Namespaces {
+		if ns != "" && ns == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// throttleReason is the reason a throttle set by the tenant is recorded with, which tells it apart from throttles
+// set by the operator or the webhook.
+func (t *Tenant) throttleReason(reason string) string {
+	return "tenant " + t.Name + ": " + reason
+}
+
+// tokenReviews caches the tenants bearer tokens were reviewed as, by the hash of the token.
+type tokenReviews struct {
+	mu      sync.Mutex
+	tenants map[[sha256.Size]byte]reviewedToken
+}
+
+type reviewedToken struct {
+	tenant  *Tenant
+	expires time.Time
+}
+
+func (c *tokenReviews) get(token string) (*Tenant, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := sha256.Sum256([]byte(token))
+	rt, ok := c.tenants[key]
+	if !ok || time.Now().After(rt.expires) {
+		delete(c.tenants, key)
+		return nil, false
+	}
+	return rt.tenant, true
+}
+
+func (c *tokenReviews) put(token string, t *Tenant) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tenants == nil {
+		c.tenants = map[[sha256.Size]byte]reviewedToken{}
+	}
+	now := time.Now()
+	for key, rt := range c.tenants {
+		if now.After(rt.expires) {
+			delete(c.tenants, key)
+		}
+	}
+	c.tenants[sha256.Sum256([]byte(token))] = reviewedToken{tenant: t, expires: now.Add(tokenReviewTTL)}
+}
+
+// serveTenantAPI serves the tenant API over TLS on the configured address, until it fails.
+func (a *Agent) serveTenantAPI() error {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if a.config.TenantClientCAFile != "" {
+		data, err := ioutil.ReadFile(a.config.TenantClientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read tenant client CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificates in tenant client CA %s", a.config.TenantClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	server := &http.Server{Addr: a.config.TenantAddr, Handler: a.tenantHandler(), TLSConfig: tlsConfig}
+	return server.ListenAndServeTLS(a.config.TenantCertFile, a.config.TenantKeyFile)
+}
+
+// tenantHandler serves the tenant API: the pods and events of the API, and throttling pods, scoped to the
+// namespaces of the authenticated tenant. Pods of other namespaces are reported as not found, so that tenants
+// can't tell which exist.
+func (a *Agent) tenantHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/pods", a.withTenant(a.handleTenantListPods))
+	mux.HandleFunc("/v1/pods/", a.withTenant(a.handleTenantPod))
+	mux.HandleFunc("/v1/events", a.withTenant(a.handleTenantEvents))
+	return mux
+}
+
+// withTenant authenticates the requests of h, rejecting those that can't be.
+func (a *Agent) withTenant(h func(http.ResponseWriter, *http.Request, *Tenant)) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		t, err := a.authenticateTenant(req)
+		if err != nil {
+			agentLog.WithError(err).WithField("remote", req.RemoteAddr).Info("Rejected tenant API request")
+			writeError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		agentLog.WithFields(log.Fields{"tenant": t.Name, "method": req.Method, "path": req.URL.Path}).Debug(
+			"Tenant API request")
+		h(w, req, t)
+	}
+}
+
+// authenticateTenant authenticates req by its client certificate, verified against the tenant client CA, whose
+// subject's common name is the tenant and organizations its namespaces, or else by its bearer token, a service
+// account token reviewed by the Kubernetes API, which gives access to the namespace of the service account.
+func (a *Agent) authenticateTenant(req *http.Request) (*Tenant, error) {
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		subject := req.TLS.VerifiedChains[0][0].Subject
+		if subject.CommonName == "" || len(subject.Organization) == 0 {
+			return nil, fmt.Errorf("client certificate names no tenant or namespaces")
+		}
+		return &Tenant{Name: subject.CommonName, Namespaces: subject.Organization}, nil
+	}
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil, fmt.Errorf("a client certificate or bearer token is required")
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	if t, ok := a.tokens.get(token); ok {
+		return t, nil
+	}
+	if a.kube == nil {
+		return nil, fmt.Errorf("bearer tokens need the Kubernetes integration")
+	}
+	username, err := a.reviewToken(token)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(strings.TrimPrefix(username, serviceAccountPrefix), ":")
+	if !strings.HasPrefix(username, serviceAccountPrefix) || len(parts) != 2 {
+		return nil, fmt.Errorf("%s isn't a service account", username)
+	}
+	t := &Tenant{Name: username, Namespaces: []string{parts[0]}}
+	a.tokens.put(token, t)
+	return t, nil
+}
+
+// reviewToken asks the Kubernetes API who token authenticates, for the tenant audience. The vendored client
+// predates the authentication API, so the review is posted raw.
+func (a *Agent) reviewToken(token string) (string, error) {
+	audience := a.config.TenantAudience
+	if audience == "" {
+		audience = DefaultTenantAudience
+	}
+	type tokenReview struct {
+		APIVersion string `json:"apiVersion"`
+		Kind       string `json:"kind"`
+		Spec       struct {
+			Token     string   `json:"token"`
+			Audiences []string `json:"audiences"`
+		} `json:"spec"`
+		Status struct {
+			Authenticated bool `json:"authenticated"`
+			User          struct {
+				Username string `json:"username"`
+			} `json:"user"`
+			Audiences []string `json:"audiences"`
+			Error     string   `json:"error"`
+		} `json:"status"`
+	}
+	review := tokenReview{APIVersion: "authentication.k8s.io/v1", Kind: "TokenReview"}
+	review.Spec.Token, review.Spec.Audiences = token, []string{audience}
+	body, err := json.Marshal(review)
+	if err != nil {
+		return "", err
+	}
+	data, err := a.kube.Core().RESTClient().Post().AbsPath("/apis/authentication.k8s.io/v1/tokenreviews").Body(body).
+		Do().Raw()
+	if err != nil {
+		return "", fmt.Errorf("failed to review token: %v", err)
+	}
+	review = tokenReview{}
+	if err = json.Unmarshal(data, &review); err != nil {
+		return "", fmt.Errorf("failed to parse token review: %v", err)
+	}
+	if !review.Status.Authenticated {
+		return "", fmt.Errorf("invalid token: %s", review.Status.Error)
+	}
+	// An API server that ignores audiences would accept tokens meant for anything else.
+	for _, aud := range review.Status.Audiences {
+		if aud == audience {
+			return review.Status.User.Username, nil
+		}
+	}
+	return "", fmt.Errorf("token isn't bound to audience %s", audience)
+}
+
+// handleTenantListPods serves /v1/pods, a page of the pods of the tenant's namespaces, as handleListPods does.
+func (a *Agent) handleTenantListPods(w http.ResponseWriter, req *http.Request, t *Tenant) {
+	if req.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	q := req.URL.Query()
+	limit := 0
+	if s := q.Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid limit: "+err.Error())
+			return
+		}
+	}
+	list, err := a.listShapedPods(limit, q.Get("continue"), func(r *state.Record) bool { return t.allows(r.Namespace) })
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// handleTenantEvents serves /v1/events, the events of the pods of the tenant's namespaces.
+func (a *Agent) handleTenantEvents(w http.ResponseWriter, req *http.Request, t *Tenant) {
+	if req.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	records, err := a.store.List()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	own := map[string]bool{}
+	for _, r := range records {
+		if t.allows(r.Namespace) {
+			own[r.ContainerID] = true
+		}
+	}
+	events := []Event{}
+	for _, e := range a.Events() {
+		if own[e.ContainerID] {
+			events = append(events, e)
+		}
+	}
+	writeJSON(w, http.StatusOK, events)
+}
+
+// handleTenantPod serves /v1/pods/<id>, the shaping of a pod of the tenant, /v1/pods/<id>/throttle, which lowers
+// its rates for a while under the rules of the throttle webhook, and /v1/pods/<id>/unthrottle, which lifts a
+// throttle the tenant set. Tenants can neither raise the rates of their pods nor lift the throttles of others.
+func (a *Agent) handleTenantPod(w http.ResponseWriter, req *http.Request, t *Tenant) {
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/v1/pods/"), "/")
+	if parts[0] == "" || len(parts) > 2 {
+		writeError(w, http.StatusNotFound, "unknown path "+req.URL.Path)
+		return
+	}
+	r, err := a.store.Find(parts[0])
+	if err == state.ErrNotFound || (err == nil && !t.allows(r.Namespace)) {
+		writeError(w, http.StatusNotFound, state.ErrNotFound.Error())
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(parts) == 1 {
+		a.handleGetPod(w, req, r.Key())
+		return
+	}
+	if req.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	own := r.Throttle != nil && strings.HasPrefix(r.Throttle.Reason, t.throttleReason(""))
+	switch parts[1] {
+	case "throttle":
+		if r.Throttle != nil && !own {
+			writeError(w, http.StatusConflict, "pod is throttled by the operator: "+r.Throttle.Reason)
+			return
+		}
+		q := req.URL.Query()
+		if q.Get("reason") == "" {
+			writeError(w, http.StatusBadRequest, "a reason is required")
+			return
+		}
+		r, err = a.boundedThrottle(ThrottleRequest{
+			Pod:      r.Key(),
+			Ingress:  q.Get("ingress"),
+			Egress:   q.Get("egress"),
+			Duration: q.Get("ttl"),
+			Reason:   t.throttleReason(q.Get("reason")),
+		}, "the tenant API")
+	case "unthrottle":
+		if !own {
+			writeError(w, http.StatusConflict, "pod has no throttle set by "+t.Name)
+			return
+		}
+		r, err = a.Unthrottle(r.Key())
+	default:
+		writeError(w, http.StatusNotFound, "unknown action "+parts[1])
+		return
+	}
+	if err == state.ErrNotFound {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	agentLog.WithFields(log.Fields{"tenant": t.Name, "pod": r.Workload, "action": parts[1]}).Info("Tenant changed shaping")
+	writeJSON(w, http.StatusOK, r)
+}
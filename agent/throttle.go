@@ -0,0 +1,148 @@
+package agent
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/cni-plugin/state"
+)
+
+// Throttle temporarily limits the pod identified by id (container ID or workload) to the given rates in bits per
+// second, in place of its recorded ones. A zero rate leaves its direction at the recorded rate, and only directions
+// the pod is already limited in can be throttled. The recorded rates are restored once ttl has elapsed, or only by
+// Unthrottle if ttl is zero. reason is kept with the throttle. A throttle replaces any previous one.
+func (a *Agent) Throttle(id string, ingressRate, egressRate uint64, ttl time.Duration, reason string) (*state.Record, error) {
+	if ingressRate == 0 && egressRate == 0 {
+		return nil, fmt.Errorf("a throttle needs an ingress or egress rate")
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	r, err := a.store.Find(id)
+	if err != nil {
+		return nil, err
+	}
+	if ingressRate != 0 && r.IngressRate == 0 {
+		return nil, fmt.Errorf("ingress of %s isn't limited, so it can't be throttled", r.Workload)
+	}
+	if egressRate != 0 && r.EgressRate == 0 {
+		return nil, fmt.Errorf("egress of %s isn't limited, so it can't be throttled", r.Workload)
+	}
+
+	r.Throttle = &state.Throttle{IngressRate: ingressRate, EgressRate: egressRate, Reason: reason}
+	if ttl > 0 {
+		until := time.Now().Add(ttl)
+		r.Throttle.Until = &until
+	}
+	// Paused pods stay relaxed to line rate; the throttle takes effect when they are resumed.
+	if !r.Paused {
+		ingress, egress := r.ActiveRates()
+		if err = a.setRecordRates(r, ingress, egress); err != nil {
+			return nil, err
+		}
+		r.MarkReconciled()
+	}
+	if err = a.saveRecord(r); err != nil {
+		return nil, err
+	}
+	detail := fmt.Sprintf("throttled to ingress=%d,egress=%d", ingressRate, egressRate)
+	if ttl > 0 {
+		a.scheduleUnthrottle(r.Key(), ttl)
+		detail += " until " + r.Throttle.Until.Format(time.RFC3339)
+	} else {
+		a.cancelUnthrottle(r.Key())
+	}
+	if reason != "" {
+		detail += ": " + reason
+	}
+	a.audit(r, state.AuditUpdate, state.AuditTriggerAPI, "%s", detail)
+	agentLog.WithFields(log.Fields{
+		"container": r.ContainerID,
+		"ingress":   ingressRate,
+		"egress":    egressRate,
+		"until":     r.Throttle.Until,
+		"reason":    reason,
+	}).Info("Throttled pod")
+	return r, nil
+}
+
+// Unthrottle lifts the throttle of a pod, restoring its recorded rates.
+func (a *Agent) Unthrottle(id string) (*state.Record, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.unthrottle(id, state.AuditTriggerAPI)
+}
+
+// unthrottle lifts the throttle of a pod, auditing it as made by trigger.
+func (a *Agent) unthrottle(id, trigger string) (*state.Record, error) {
+	r, err := a.store.Find(id)
+	if err != nil {
+		return nil, err
+	}
+	a.cancelUnthrottle(r.Key())
+	if r.Throttle == nil {
+		return r, nil
+	}
+	r.Throttle = nil
+	if !r.Paused {
+		ingress, egress := r.ActiveRates()
+		if err = a.setRecordRates(r, ingress, egress); err != nil {
+			return nil, err
+		}
+		r.MarkReconciled()
+	}
+	if err = a.saveRecord(r); err != nil {
+		return nil, err
+	}
+	a.audit(r, state.AuditUpdate, trigger, "lifted throttle")
+	agentLog.WithField("container", r.ContainerID).Info("Lifted throttle")
+	return r, nil
+}
+
+// scheduleUnthrottle arms (or re-arms) the timer lifting the throttle of the pod stored under key. The caller must hold a.mu.
+func (a *Agent) scheduleUnthrottle(key string, after time.Duration) {
+	a.cancelUnthrottle(key)
+	a.throttleTimers[key] = time.AfterFunc(after, func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		delete(a.throttleTimers, key)
+		r, err := a.unthrottle(key, state.AuditTriggerExpiry)
+		if err == nil {
+			a.recordEvent(r, reasonThrottleExpired, "throttle expired, restored ingress=%d,egress=%d", r.IngressRate,
+				r.EgressRate)
+		} else if err != state.ErrNotFound {
+			agentLog.WithError(err).WithField("container", key).Error("Failed to lift expired throttle")
+		}
+	})
+}
+
+// cancelUnthrottle stops the timer lifting the throttle of the pod stored under key, if any. The caller must hold a.mu.
+func (a *Agent) cancelUnthrottle(key string) {
+	if t, ok := a.throttleTimers[key]; ok {
+		t.Stop()
+		delete(a.throttleTimers, key)
+	}
+}
+
+// restoreThrottles re-arms the expiry of the throttles recorded before the agent (re)started. Throttles that
+// expired while it was down are lifted straight away.
+func (a *Agent) restoreThrottles() error {
+	records, err := a.store.List()
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, r := range records {
+		if r.Throttle == nil || r.Throttle.Until == nil {
+			continue
+		}
+		after := r.Throttle.Until.Sub(time.Now())
+		if after < 0 {
+			after = 0
+		}
+		a.scheduleUnthrottle(r.Key(), after)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package agent
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/projectcalico/cni-plugin/state"
+)
+
+// MaxWebhookThrottle is the longest a pod can be throttled through the webhook, so that a misbehaving detector
+// can't leave pods throttled indefinitely.
+const MaxWebhookThrottle = 24 * time.Hour
+
+// maxWebhookReason bounds the reason recorded with a webhook throttle.
+const maxWebhookReason = 256
+
+const (
+	reasonThrottled       = "Throttled"
+	reasonThrottleExpired = "ThrottleExpired"
+)
+
+// ThrottleRequest is what an external system, such as an anomaly detector, POSTs to the webhook to throttle a pod.
+type ThrottleRequest struct {
+	// Pod is the container ID or workload of the pod.
+	Pod string `json:"pod"`
+	// Ingress and Egress are the rates of the throttle, in the format of the bandwidth annotations. At least one
+	// must be set, and each must be below the pod's recorded rate in its direction.
+	Ingress string `json:"ingress,omitempty"`
+	Egress  string `json:"egress,omitempty"`
+	// Duration is how long the throttle lasts, e.g. "15m", up to MaxWebhookThrottle.
+	Duration string `json:"duration"`
+	// Reason is why the pod is throttled. It is required and recorded with the throttle.
+	Reason string `json:"reason"`
+}
+
+// webhookHandler serves the throttle webhook, for requests bearing the configured token.
+func (a *Agent) webhookHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/webhooks/throttle", a.handleThrottleWebhook)
+	return mux
+}
+
+func (a *Agent) handleThrottleWebhook(w http.ResponseWriter, req *http.Request) {
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(a.config.WebhookToken)) != 1 {
+		writeError(w, http.StatusUnauthorized, "invalid token")
+		return
+	}
+	if req.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	var t ThrottleRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 4096)).Decode(&t); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request: "+err.Error())
+		return
+	}
+	r, err := a.WebhookThrottle(t)
+	if err == state.ErrNotFound {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, r)
+}
+
+// WebhookThrottle validates a throttle requested through the webhook and applies it. Unlike Throttle, it only lowers
+// the rates of a pod, always expires, and requires a reason.
+func (a *Agent) WebhookThrottle(t ThrottleRequest) (*state.Record, error) {
+	return a.boundedThrottle(t, "the webhook")
+}
+
+// boundedThrottle applies a throttle under the rules of WebhookThrottle, requested through via.
+func (a *Agent) boundedThrottle(t ThrottleRequest, via string) (*state.Record, error) {
+	if t.Pod == "" {
+		return nil, fmt.Errorf("a pod is required")
+	}
+	if t.Reason == "" || len(t.Reason) > maxWebhookReason {
+		return nil, fmt.Errorf("a reason of at most %d bytes is required", maxWebhookReason)
+	}
+	ttl, err := time.ParseDuration(t.Duration)
+	if err != nil || ttl <= 0 || ttl > MaxWebhookThrottle {
+		return nil, fmt.Errorf("invalid duration %q, must be positive and at most %v", t.Duration, MaxWebhookThrottle)
+	}
+	ingress, err := parsePolicyRate(t.Ingress)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ingress rate: %v", err)
+	}
+	egress, err := parsePolicyRate(t.Egress)
+	if err != nil {
+		return nil, fmt.Errorf("invalid egress rate: %v", err)
+	}
+	r, err := a.store.Find(t.Pod)
+	if err != nil {
+		return nil, err
+	}
+	// A zero recorded rate is an unlimited direction, which Throttle refuses on its own.
+	if (ingress != 0 && r.IngressRate != 0 && ingress >= r.IngressRate) ||
+		(egress != 0 && r.EgressRate != 0 && egress >= r.EgressRate) {
+		return nil, fmt.Errorf("the webhook can only lower the rates of %s", r.Workload)
+	}
+
+	if r, err = a.Throttle(r.Key(), ingress, egress, ttl, t.Reason); err != nil {
+		return nil, err
+	}
+	a.recordEvent(r, reasonThrottled, "throttled through %s to ingress=%d,egress=%d for %v: %s", via, ingress, egress,
+		ttl, t.Reason)
+	return r, nil
+}
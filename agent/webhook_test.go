@@ -0,0 +1,54 @@
+package agent_test
+
+import (
+	"io/ioutil"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/cni-plugin/agent"
+	"github.com/projectcalico/cni-plugin/state"
+)
+
+var _ = Describe("WebhookThrottle", func() {
+	var dir string
+	var a *agent.Agent
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "flowcontrol-agent")
+		Expect(err).NotTo(HaveOccurred())
+		a = agent.New(agent.Config{StateDir: dir})
+		// The pod is paused, so a throttle is only recorded and no tc is run.
+		r := &state.Record{ContainerID: "abc", Workload: "default/web", EgressRate: 10000000, Paused: true}
+		Expect(state.NewStore(dir).Save(r)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	throttle := func(ingress, egress string) error {
+		_, err := a.WebhookThrottle(agent.ThrottleRequest{Pod: "default/web", Ingress: ingress, Egress: egress,
+			Duration: "1m", Reason: "noisy"})
+		return err
+	}
+
+	It("lowers a limited direction of a pod left unlimited in the other", func() {
+		Expect(throttle("", "1M")).To(Succeed())
+
+		r, err := state.NewStore(dir).Load("abc")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(r.Throttle.EgressRate).To(Equal(uint64(1000000)))
+	})
+
+	DescribeTable("rejects",
+		func(ingress, egress, message string) {
+			Expect(throttle(ingress, egress)).To(MatchError(ContainSubstring(message)))
+		},
+		Entry("a rate above the recorded one", "", "20M", "can only lower"),
+		Entry("the recorded rate", "", "10M", "can only lower"),
+		Entry("an unlimited direction as unlimited rather than as raised", "1M", "", "isn't limited"),
+	)
+})
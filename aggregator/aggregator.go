@@ -0,0 +1,233 @@
+// Package aggregator implements the optional cluster-wide view of flow control. It periodically scrapes the
+// read-only API of every node agent, and serves a summary of pods without shaping, degraded pods and per-namespace
+// totals as JSON and as metrics. It also acts as the controller of bandwidth quotas, writing the usage of their
+// namespaces to their status.
+package aggregator
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/cni-plugin/agent"
+	"github.com/projectcalico/cni-plugin/metrics"
+	"github.com/projectcalico/cni-plugin/policy"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	// DefaultAgentPort is the port agents are expected to serve their read-only API on.
+	DefaultAgentPort = 9652
+	// DefaultListenAddr is where the aggregator serves the summary and metrics.
+	DefaultListenAddr = ":9653"
+	// DefaultInterval is how often the agents are scraped.
+	DefaultInterval = time.Minute
+
+	// scrapeConcurrency bounds the number of agents scraped at once.
+	scrapeConcurrency = 16
+	scrapeTimeout     = 10 * time.Second
+)
+
+// Config holds the aggregator configuration.
+type Config struct {
+	// Kubeconfig is empty when running in-cluster.
+	Kubeconfig string
+	AgentPort  int
+	ListenAddr string
+	Interval   time.Duration
+}
+
+// Aggregator scrapes the node agents and serves the cluster-wide summary.
+type Aggregator struct {
+	config Config
+	kube   *kubernetes.Clientset
+
+	registry      *metrics.Registry
+	shapedPods    *metrics.Gauge
+	degradedPods  *metrics.Gauge
+	unshapedPods  *metrics.Gauge
+	ingressRate   *metrics.Gauge
+	egressRate    *metrics.Gauge
+	failedScrapes *metrics.Gauge
+
+	mu      sync.Mutex
+	summary *Summary
+}
+
+// New creates an aggregator, filling in defaults for any unset configuration.
+func New(config Config) *Aggregator {
+	if config.AgentPort == 0 {
+		config.AgentPort = DefaultAgentPort
+	}
+	if config.ListenAddr == "" {
+		config.ListenAddr = DefaultListenAddr
+	}
+	if config.Interval == 0 {
+		config.Interval = DefaultInterval
+	}
+	r := metrics.NewRegistry()
+	return &Aggregator{
+		config:   config,
+		registry: r,
+		shapedPods: r.NewGauge("flowcontrol_cluster_shaped_pods",
+			"Pods whose bandwidth limits are in effect, by namespace.", "namespace"),
+		degradedPods: r.NewGauge("flowcontrol_cluster_degraded_pods",
+			"Pods whose shaping was modified or couldn't be rebuilt, by namespace.", "namespace"),
+		unshapedPods: r.NewGauge("flowcontrol_cluster_unshaped_pods",
+			"Pods requesting bandwidth limits that aren't in effect, by namespace.", "namespace"),
+		ingressRate: r.NewGauge("flowcontrol_cluster_ingress_rate_bits",
+			"Sum of the ingress limits of shaped pods in bits per second, by namespace.", "namespace"),
+		egressRate: r.NewGauge("flowcontrol_cluster_egress_rate_bits",
+			"Sum of the egress limits of shaped pods in bits per second, by namespace.", "namespace"),
+		failedScrapes: r.NewGauge("flowcontrol_cluster_failed_scrapes",
+			"Node agents that couldn't be scraped in the last pass."),
+	}
+}
+
+// Run starts scraping the agents and then serves the summary until the listener fails.
+func (g *Aggregator) Run() error {
+	config, err := clientcmd.BuildConfigFromFlags("", g.config.Kubeconfig)
+	if err != nil {
+		return err
+	}
+	if g.kube, err = kubernetes.NewForConfig(config); err != nil {
+		return fmt.Errorf("failed to create Kubernetes client: %v", err)
+	}
+	go func() {
+		for {
+			if err := g.collect(); err != nil {
+				log.WithError(err).Error("Failed to collect flow control state")
+			}
+			time.Sleep(g.config.Interval)
+		}
+	}()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/summary", g.handleSummary)
+	mux.Handle("/metrics", g.registry.Handler())
+	log.WithField("addr", g.config.ListenAddr).Info("Flow control aggregator listening")
+	return http.ListenAndServe(g.config.ListenAddr, mux)
+}
+
+func (g *Aggregator) handleSummary(w http.ResponseWriter, req *http.Request) {
+	g.mu.Lock()
+	s := g.summary
+	g.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if s == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, `{"error": "no summary collected yet"}`)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(s); err != nil {
+		log.WithError(err).Warn("Failed to write summary")
+	}
+}
+
+// collect scrapes every node agent, summarizes what they report and publishes the summary, and updates the usage of
+// bandwidth quotas.
+func (g *Aggregator) collect() error {
+	nodes, err := g.kube.Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	pods, err := g.kube.Pods("").List(metav1.ListOptions{FieldSelector: "status.phase=Running"})
+	if err != nil {
+		return err
+	}
+
+	results := make([]NodePods, len(nodes.Items))
+	sem := make(chan struct{}, scrapeConcurrency)
+	var wg sync.WaitGroup
+	for i := range nodes.Items {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() { <-sem; wg.Done() }()
+			results[i] = g.scrape(&nodes.Items[i])
+		}(i)
+	}
+	wg.Wait()
+
+	var requesting []PodRef
+	for _, pod := range pods.Items {
+		if pod.Spec.NodeName != "" && requestsLimits(pod.Annotations) {
+			requesting = append(requesting, PodRef{Namespace: pod.Namespace, Name: pod.Name, Node: pod.Spec.NodeName})
+		}
+	}
+	now := time.Now()
+	s := Summarize(results, requesting, now)
+	g.publish(s)
+	return g.syncQuotas(results, now)
+}
+
+// scrape pages through the pods reported by the agent of node.
+func (g *Aggregator) scrape(node *v1.Node) NodePods {
+	result := NodePods{Node: node.Name}
+	addr := ""
+	for _, a := range node.Status.Addresses {
+		if a.Type == v1.NodeInternalIP {
+			addr = a.Address
+			break
+		}
+	}
+	if addr == "" {
+		result.Error = fmt.Errorf("node has no internal IP")
+		return result
+	}
+	client := agent.NewRemoteClient(net.JoinHostPort(addr, strconv.Itoa(g.config.AgentPort)), scrapeTimeout)
+	token := ""
+	for {
+		page, err := client.ListShapedPods(0, token)
+		if err != nil {
+			result.Error = err
+			return result
+		}
+		result.Pods = append(result.Pods, page.Pods...)
+		if token = page.Continue; token == "" {
+			return result
+		}
+	}
+}
+
+// requestsLimits reports whether the annotations of a pod request bandwidth limits.
+func requestsLimits(annotations map[string]string) bool {
+	for _, key := range []string{"kubernetes.io/ingress-bandwidth", "kubernetes.io/egress-bandwidth", policy.PresetAnnotation} {
+		if annotations[key] != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *Aggregator) publish(s *Summary) {
+	g.mu.Lock()
+	g.summary = s
+	g.mu.Unlock()
+
+	for _, gauge := range []*metrics.Gauge{g.shapedPods, g.degradedPods, g.unshapedPods, g.ingressRate, g.egressRate} {
+		gauge.Reset()
+	}
+	for namespace, t := range s.Namespaces {
+		g.shapedPods.Set(float64(t.ShapedPods), namespace)
+		g.degradedPods.Set(float64(t.DegradedPods), namespace)
+		g.unshapedPods.Set(float64(t.UnshapedPods), namespace)
+		g.ingressRate.Set(float64(t.IngressRate), namespace)
+		g.egressRate.Set(float64(t.EgressRate), namespace)
+	}
+	failed := 0
+	for _, n := range s.Nodes {
+		if n.Error != "" {
+			failed++
+		}
+	}
+	g.failedScrapes.Set(float64(failed))
+}
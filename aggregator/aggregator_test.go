@@ -0,0 +1,68 @@
+package aggregator_test
+
+import (
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/cni-plugin/agent"
+	"github.com/projectcalico/cni-plugin/aggregator"
+	"github.com/projectcalico/cni-plugin/policy"
+)
+
+var _ = Describe("Summarize", func() {
+	nodes := []aggregator.NodePods{
+		{Node: "node-a", Pods: []agent.ShapedPod{
+			{ContainerID: "a1", Namespace: "web", Pod: "front-1", Health: "Applied", IngressRate: 1000, EgressRate: 500},
+			{ContainerID: "a2", Namespace: "web", Pod: "front-2", Health: "Applied", IngressRate: 2000},
+			{ContainerID: "a3", Namespace: "batch", Pod: "job-1", Health: "Degraded", HealthReason: "class deleted"},
+			{ContainerID: "hostnet-1", Namespace: "infra", Pod: "proxy", Health: "Unsupported", HealthReason: "not shaped"},
+		}},
+		{Node: "node-b", Error: errors.New("connection refused")},
+	}
+	requesting := []aggregator.PodRef{
+		{Namespace: "web", Name: "front-1", Node: "node-a"},
+		{Namespace: "web", Name: "front-3", Node: "node-a"},
+		{Namespace: "web", Name: "front-4", Node: "node-b"},
+	}
+
+	It("adds up shaped pods per namespace", func() {
+		s := aggregator.Summarize(nodes, requesting, time.Now())
+		Expect(*s.Namespaces["web"]).To(Equal(aggregator.NamespaceTotals{
+			ShapedPods:   2,
+			UnshapedPods: 1,
+			IngressRate:  3000,
+			EgressRate:   500,
+		}))
+		Expect(s.Namespaces["batch"].DegradedPods).To(Equal(1))
+	})
+
+	It("lists degraded and unshaped pods", func() {
+		s := aggregator.Summarize(nodes, requesting, time.Now())
+		Expect(s.Degraded).To(HaveLen(1))
+		Expect(s.Degraded[0].Node).To(Equal("node-a"))
+		Expect(s.Degraded[0].Pod).To(Equal("job-1"))
+
+		Expect(s.Unshaped).To(Equal([]aggregator.UnshapedPod{
+			{Namespace: "infra", Pod: "proxy", Node: "node-a", Reason: "not shaped"},
+			{Namespace: "web", Pod: "front-3", Node: "node-a", Reason: "no shaping recorded by the node agent"},
+		}))
+	})
+
+	It("reports agents that couldn't be scraped", func() {
+		s := aggregator.Summarize(nodes, requesting, time.Now())
+		Expect(s.Nodes).To(Equal([]aggregator.NodeStatus{
+			{Name: "node-a", ShapedPods: 4},
+			{Name: "node-b", Error: "connection refused"},
+		}))
+	})
+
+	It("counts the limits of degraded pods against quotas", func() {
+		used, pods, unscraped := aggregator.QuotaUsage(nodes)
+		Expect(used["web"]).To(Equal(policy.Rates{Ingress: 3000, Egress: 500}))
+		Expect(pods).To(Equal(map[string]int{"web": 2, "batch": 1}))
+		Expect(used).NotTo(HaveKey("infra"))
+		Expect(unscraped).To(Equal(1))
+	})
+})
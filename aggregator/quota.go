@@ -0,0 +1,69 @@
+package aggregator
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/cni-plugin/policy"
+	"github.com/projectcalico/cni-plugin/quota"
+	"github.com/projectcalico/cni-plugin/state"
+	"k8s.io/apimachinery/pkg/api/errors"
+)
+
+// QuotaUsage adds up the recorded limits of the pods the agents of nodes reported, by namespace, for the quotas of
+// their namespaces: degraded pods keep their limits and count, unshaped ones don't. It also returns how many nodes
+// couldn't be scraped, whose pods are left out.
+func QuotaUsage(nodes []NodePods) (used map[string]policy.Rates, pods map[string]int, unscraped int) {
+	used, pods = map[string]policy.Rates{}, map[string]int{}
+	for _, n := range nodes {
+		if n.Error != nil {
+			unscraped++
+			continue
+		}
+		for _, p := range n.Pods {
+			if p.Health == state.StatusUnsupported {
+				continue
+			}
+			u := used[p.Namespace]
+			u.Ingress += p.IngressRate
+			u.Egress += p.EgressRate
+			used[p.Namespace] = u
+			pods[p.Namespace]++
+		}
+	}
+	return used, pods, unscraped
+}
+
+// syncQuotas writes what the pods of each namespace use to the status of its BandwidthQuotas. Nothing is done if the
+// cluster doesn't serve BandwidthQuotas. The vendored client predates custom resources, so they are handled raw.
+func (g *Aggregator) syncQuotas(nodes []NodePods, now time.Time) error {
+	rest := g.kube.Core().RESTClient()
+	data, err := rest.Get().AbsPath(quota.ListPath()).Do().Raw()
+	if errors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	list := quota.List{}
+	if err = json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("failed to parse bandwidth quotas: %v", err)
+	}
+	used, pods, unscraped := QuotaUsage(nodes)
+	for i := range list.Items {
+		q := &list.Items[i]
+		q.Status = q.Observe(used[q.Namespace], pods[q.Namespace], now)
+		if unscraped > 0 && q.Status.Message == "" {
+			q.Status.Message = fmt.Sprintf("usage leaves out the pods of %d nodes whose agents couldn't be scraped", unscraped)
+		}
+		body, err := json.Marshal(q)
+		if err != nil {
+			return err
+		}
+		if err = rest.Put().AbsPath(quota.StatusPath(q.Namespace, q.Name)).Body(body).Do().Error(); err != nil {
+			log.WithError(err).WithField("quota", q.Namespace+"/"+q.Name).Warn("Failed to update bandwidth quota status")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package aggregator
+
+import (
+	"sort"
+	"time"
+
+	"github.com/projectcalico/cni-plugin/agent"
+	"github.com/projectcalico/cni-plugin/state"
+)
+
+// NodePods are the pods the agent of a node reported, or the error scraping it.
+type NodePods struct {
+	Node  string
+	Pods  []agent.ShapedPod
+	Error error
+}
+
+// PodRef is a running pod that requests bandwidth limits, as listed from the API server.
+type PodRef struct {
+	Namespace string
+	Name      string
+	Node      string
+}
+
+// Summary is the cluster-wide view of flow control.
+type Summary struct {
+	Collected time.Time `json:"collected"`
+	// Nodes are the nodes whose agents were scraped, with the error if the scrape failed.
+	Nodes []NodeStatus `json:"nodes"`
+	// Namespaces are per-namespace totals. Workloads not run by Kubernetes are under "".
+	Namespaces map[string]*NamespaceTotals `json:"namespaces"`
+	// Degraded are pods whose shaping was found modified or couldn't be rebuilt.
+	Degraded []NodePod `json:"degraded"`
+	// Unshaped are pods requesting bandwidth limits that aren't in effect.
+	Unshaped []UnshapedPod `json:"unshaped"`
+}
+
+// NodeStatus is the outcome of scraping the agent of a node.
+type NodeStatus struct {
+	Name       string `json:"name"`
+	ShapedPods int    `json:"shaped_pods"`
+	Error      string `json:"error,omitempty"`
+}
+
+// NamespaceTotals add up the pods of a namespace. The rates are the sums of the limits of its shaped pods, in
+// bits per second.
+type NamespaceTotals struct {
+	ShapedPods   int    `json:"shaped_pods"`
+	DegradedPods int    `json:"degraded_pods"`
+	UnshapedPods int    `json:"unshaped_pods"`
+	IngressRate  uint64 `json:"ingress_rate"`
+	EgressRate   uint64 `json:"egress_rate"`
+}
+
+// NodePod is a pod reported by the agent of Node.
+type NodePod struct {
+	Node string `json:"node"`
+	agent.ShapedPod
+}
+
+// UnshapedPod is a pod whose bandwidth limits aren't in effect, and why.
+type UnshapedPod struct {
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+	Node      string `json:"node"`
+	Reason    string `json:"reason"`
+}
+
+// Summarize builds the summary of what the agents of nodes reported. Pods in requesting that are on a scraped node
+// but not reported by its agent are counted as unshaped; those on nodes that couldn't be scraped are left out.
+func Summarize(nodes []NodePods, requesting []PodRef, now time.Time) *Summary {
+	s := &Summary{
+		Collected:  now,
+		Nodes:      []NodeStatus{},
+		Namespaces: map[string]*NamespaceTotals{},
+		Degraded:   []NodePod{},
+		Unshaped:   []UnshapedPod{},
+	}
+	totals := func(namespace string) *NamespaceTotals {
+		t, ok := s.Namespaces[namespace]
+		if !ok {
+			t = &NamespaceTotals{}
+			s.Namespaces[namespace] = t
+		}
+		return t
+	}
+
+	scraped := map[string]bool{}
+	reported := map[PodRef]bool{}
+	for _, n := range nodes {
+		status := NodeStatus{Name: n.Node, ShapedPods: len(n.Pods)}
+		if n.Error != nil {
+			status.Error = n.Error.Error()
+			s.Nodes = append(s.Nodes, status)
+			continue
+		}
+		scraped[n.Node] = true
+		s.Nodes = append(s.Nodes, status)
+
+		for _, p := range n.Pods {
+			reported[PodRef{Namespace: p.Namespace, Name: p.Pod, Node: n.Node}] = true
+			t := totals(p.Namespace)
+			switch p.Health {
+			case state.StatusDegraded, state.StatusFailed:
+				t.DegradedPods++
+				s.Degraded = append(s.Degraded, NodePod{Node: n.Node, ShapedPod: p})
+			case state.StatusUnsupported:
+				t.UnshapedPods++
+				s.Unshaped = append(s.Unshaped, UnshapedPod{Namespace: p.Namespace, Pod: p.Pod, Node: n.Node, Reason: p.HealthReason})
+			default:
+				t.ShapedPods++
+				t.IngressRate += p.IngressRate
+				t.EgressRate += p.EgressRate
+			}
+		}
+	}
+
+	for _, ref := range requesting {
+		if !scraped[ref.Node] || reported[ref] {
+			continue
+		}
+		totals(ref.Namespace).UnshapedPods++
+		s.Unshaped = append(s.Unshaped, UnshapedPod{
+			Namespace: ref.Namespace,
+			Pod:       ref.Name,
+			Node:      ref.Node,
+			Reason:    "no shaping recorded by the node agent",
+		})
+	}
+
+	sort.Slice(s.Nodes, func(i, j int) bool { return s.Nodes[i].Name < s.Nodes[j].Name })
+	sort.Slice(s.Degraded, func(i, j int) bool {
+		a, b := s.Degraded[i], s.Degraded[j]
+		return a.Namespace < b.Namespace || a.Namespace == b.Namespace && a.Pod < b.Pod
+	})
+	sort.Slice(s.Unshaped, func(i, j int) bool {
+		a, b := s.Unshaped[i], s.Unshaped[j]
+		return a.Namespace < b.Namespace || a.Namespace == b.Namespace && a.Pod < b.Pod
+	})
+	return s
+}
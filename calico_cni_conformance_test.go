@@ -0,0 +1,212 @@
+package main_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+	. "github.com/projectcalico/cni-plugin/test_utils"
+)
+
+// These specs run the scenarios of the CNI conformance suite against the plugin binary, so that the behaviour
+// runtimes rely on keeps to the spec as features are added. Run them alone with `make test-conformance`.
+var _ = Describe("CNI conformance", func() {
+	BeforeEach(func() {
+		WipeEtcd()
+	})
+
+	cniVersion := os.Getenv("CNI_SPEC_VERSION")
+	netconf := fmt.Sprintf(`
+	{
+	  "cniVersion": "%s",
+	  "name": "net1",
+	  "type": "calico",
+	  "etcd_endpoints": "http://%s:2379",
+	  "ipam": {
+	    "type": "host-local",
+	    "subnet": "10.0.0.0/8"
+	  }
+	}`, cniVersion, os.Getenv("ETCD_IP"))
+
+	// cniError is the error a plugin prints on stdout when it fails.
+	type cniError struct {
+		Code    uint   `json:"code"`
+		Msg     string `json:"msg"`
+		Details string `json:"details"`
+	}
+
+	Describe("VERSION", func() {
+		It("reports every spec version the plugin supports", func() {
+			out, exitCode, err := RunCNICommand("VERSION", `{"cniVersion": "0.3.1"}`, "", "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exitCode).To(Equal(0))
+
+			var info struct {
+				CNIVersion        string   `json:"cniVersion"`
+				SupportedVersions []string `json:"supportedVersions"`
+			}
+			Expect(json.Unmarshal(out, &info)).To(Succeed())
+			Expect(info.SupportedVersions).To(ConsistOf("0.1.0", "0.2.0", "0.3.0", "0.3.1"))
+		})
+
+		It("fails ADD for a spec version it doesn't support, with a CNI error", func() {
+			containerNs, containerID, netnspath, err := CreateContainerNamespace()
+			Expect(err).NotTo(HaveOccurred())
+			defer containerNs.Close()
+
+			conf := fmt.Sprintf(`{"cniVersion": "99.0.0", "name": "net1", "type": "calico", "etcd_endpoints": "http://%s:2379",
+			  "ipam": {"type": "host-local", "subnet": "10.0.0.0/8"}}`, os.Getenv("ETCD_IP"))
+			out, exitCode, err := RunCNICommand("ADD", conf, netnspath, containerID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exitCode).NotTo(Equal(0))
+
+			var e cniError
+			Expect(json.Unmarshal(out, &e)).To(Succeed())
+			Expect(e.Code).NotTo(BeZero())
+			Expect(e.Msg).NotTo(BeEmpty())
+		})
+	})
+
+	Describe("ADD and DEL ordering", func() {
+		It("returns a result in the version of the configuration", func() {
+			containerID, netnspath, session, _, _, _, containerNs, err := CreateContainer(netconf, "", "")
+			Expect(err).NotTo(HaveOccurred())
+			defer containerNs.Close()
+			Eventually(session).Should(gexec.Exit(0))
+
+			if cniVersion != "" {
+				var result struct {
+					CNIVersion string `json:"cniVersion"`
+				}
+				Expect(json.Unmarshal(session.Out.Contents(), &result)).To(Succeed())
+				Expect(result.CNIVersion).To(Equal(cniVersion))
+			}
+
+			_, err = DeleteContainerWithId(netconf, netnspath, "", containerID)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("succeeds DEL repeatedly, and DEL of a container that was never added", func() {
+			containerNs, containerID, netnspath, err := CreateContainerNamespace()
+			Expect(err).NotTo(HaveOccurred())
+			defer containerNs.Close()
+
+			exitCode, err := DeleteContainerWithId(netconf, netnspath, "", containerID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exitCode).To(Equal(0))
+
+			session, _, _, _, err := RunCNIPluginWithId(netconf, "", "", netnspath, containerID, containerNs)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+			for i := 0; i < 2; i++ {
+				exitCode, err = DeleteContainerWithId(netconf, netnspath, "", containerID)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(exitCode).To(Equal(0))
+			}
+		})
+
+		It("succeeds DEL once the network namespace is gone", func() {
+			containerNs, containerID, netnspath, err := CreateContainerNamespace()
+			Expect(err).NotTo(HaveOccurred())
+
+			session, _, _, _, err := RunCNIPluginWithId(netconf, "", "", netnspath, containerID, containerNs)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(containerNs.Close()).To(Succeed())
+			exitCode, err := DeleteContainerWithId(netconf, netnspath, "", containerID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exitCode).To(Equal(0))
+		})
+
+		It("succeeds ADD again after DEL of the same container", func() {
+			containerNs, containerID, netnspath, err := CreateContainerNamespace()
+			Expect(err).NotTo(HaveOccurred())
+			defer containerNs.Close()
+
+			for i := 0; i < 2; i++ {
+				session, _, _, _, err := RunCNIPluginWithId(netconf, "", "", netnspath, containerID, containerNs)
+				Expect(err).NotTo(HaveOccurred())
+				Eventually(session).Should(gexec.Exit(0))
+				exitCode, err := DeleteContainerWithId(netconf, netnspath, "", containerID)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(exitCode).To(Equal(0))
+			}
+		})
+	})
+
+	Describe("chaining", func() {
+		It("accepts a prevResult in its configuration", func() {
+			containerNs, containerID, netnspath, err := CreateContainerNamespace()
+			Expect(err).NotTo(HaveOccurred())
+			defer containerNs.Close()
+
+			conf := fmt.Sprintf(`{"cniVersion": "0.3.1", "name": "net1", "type": "calico", "etcd_endpoints": "http://%s:2379",
+			  "ipam": {"type": "host-local", "subnet": "10.0.0.0/8"},
+			  "prevResult": {"cniVersion": "0.3.1", "interfaces": [{"name": "lo"}], "ips": []}}`, os.Getenv("ETCD_IP"))
+			session, _, _, _, err := RunCNIPluginWithId(conf, "", "", netnspath, containerID, containerNs)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			exitCode, err := DeleteContainerWithId(conf, netnspath, "", containerID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exitCode).To(Equal(0))
+		})
+
+		It("fails CHECK without a prevResult, with a CNI error", func() {
+			containerNs, containerID, netnspath, err := CreateContainerNamespace()
+			Expect(err).NotTo(HaveOccurred())
+			defer containerNs.Close()
+
+			out, exitCode, err := RunCNICommand("CHECK", netconf, netnspath, containerID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exitCode).NotTo(Equal(0))
+
+			var e cniError
+			Expect(json.Unmarshal(out, &e)).To(Succeed())
+			Expect(e.Msg).To(ContainSubstring("prevResult"))
+		})
+
+		It("passes CHECK after ADD, and reports the drift once the host veth is down", func() {
+			containerNs, containerID, netnspath, err := CreateContainerNamespace()
+			Expect(err).NotTo(HaveOccurred())
+			defer containerNs.Close()
+
+			conf := fmt.Sprintf(`{"cniVersion": "0.3.1", "name": "net1", "type": "calico", "etcd_endpoints": "http://%s:2379",
+			  "ipam": {"type": "host-local", "subnet": "10.0.0.0/8"}}`, os.Getenv("ETCD_IP"))
+			session, _, _, _, err := RunCNIPluginWithId(conf, "", "", netnspath, containerID, containerNs)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+			defer DeleteContainerWithId(conf, netnspath, "", containerID)
+
+			var checkConf map[string]interface{}
+			Expect(json.Unmarshal([]byte(conf), &checkConf)).To(Succeed())
+			var prevResult map[string]interface{}
+			Expect(json.Unmarshal(session.Out.Contents(), &prevResult)).To(Succeed())
+			checkConf["prevResult"] = prevResult
+			data, err := json.Marshal(checkConf)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, exitCode, err := RunCNICommand("CHECK", string(data), netnspath, containerID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exitCode).To(Equal(0))
+
+			hostVeth := "cali" + containerID
+			if len(hostVeth) > 15 {
+				hostVeth = hostVeth[:15]
+			}
+			Cmd("ip link set " + hostVeth + " down")
+			out, exitCode, err := RunCNICommand("CHECK", string(data), netnspath, containerID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exitCode).NotTo(Equal(0))
+
+			var e cniError
+			Expect(json.Unmarshal(out, &e)).To(Succeed())
+			Expect(e.Code).To(BeEquivalentTo(107))
+			Expect(e.Details).To(ContainSubstring(hostVeth + " is down"))
+		})
+	})
+})
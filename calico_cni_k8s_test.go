@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/containernetworking/cni/pkg/skel"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/gexec"
@@ -39,7 +40,7 @@ var _ = Describe("CalicoCni", func() {
 	})
 
 	Describe("Run Calico CNI plugin in K8s mode", func() {
-		utils.ConfigureLogging("info")
+		utils.ConfigureLogging(utils.NetConf{LogLevel: "info"}, &skel.CmdArgs{})
 		logger := utils.CreateContextLogger("k8s_tests")
 		cniVersion := os.Getenv("CNI_SPEC_VERSION")
 
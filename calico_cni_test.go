@@ -2,6 +2,7 @@ package main_test
 
 import (
 	"fmt"
+	"io/ioutil"
 	"log"
 	"math/rand"
 	"os"
@@ -12,10 +13,11 @@ import (
 
 	"github.com/containernetworking/cni/pkg/ns"
 	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/gexec"
+	"github.com/projectcalico/cni-plugin/internal/util"
 	. "github.com/projectcalico/cni-plugin/test_utils"
-	"github.com/projectcalico/cni-plugin/utils"
 	"github.com/projectcalico/libcalico-go/lib/api"
 	"github.com/projectcalico/libcalico-go/lib/client"
 	cnet "github.com/projectcalico/libcalico-go/lib/net"
@@ -112,7 +114,7 @@ var _ = Describe("CalicoCni", func() {
 
 				// Routes and interface on host - there's is nothing to assert on the routes since felix adds those.
 				//fmt.Println(Cmd("ip link show")) // Useful for debugging
-				hostVethName := "cali" + containerID[:utils.Min(11, len(containerID))] //"cali" + containerID
+				hostVethName := "cali" + util.Prefix(containerID, 11) //"cali" + containerID
 
 				hostVeth, err := netlink.LinkByName(hostVethName)
 				Expect(err).ToNot(HaveOccurred())
@@ -185,16 +187,96 @@ var _ = Describe("CalicoCni", func() {
 			})
 
 			Context("when the same hostVeth exists", func() {
-				It("successfully networks the namespace", func() {
-					container_id := fmt.Sprintf("con%d", rand.Uint32())
-					if err := CreateHostVeth(container_id, "", ""); err != nil {
-						panic(err)
-					}
-					_, netnspath, session, _, _, _, _, err := CreateContainerWithId(netconf, "", "", container_id)
+				// The alias of a host veth names the container that owns it, and only a veth the container owns is
+				// deleted to make way for its own.
+				DescribeTable("only replaces a host veth owned by the container",
+					func(alias func(containerID string) string, owned bool) {
+						container_id := fmt.Sprintf("con%d", rand.Uint32())
+						if err := CreateHostVeth(container_id, "", ""); err != nil {
+							panic(err)
+						}
+						hostVethName := "cali" + util.Prefix(container_id, 11)
+						if a := alias(container_id); a != "" {
+							veth, err := netlink.LinkByName(hostVethName)
+							Expect(err).ShouldNot(HaveOccurred())
+							Expect(netlink.LinkSetAlias(veth, a)).To(Succeed())
+						}
+						_, netnspath, session, _, _, _, _, err := CreateContainerWithId(netconf, "", "", container_id)
+						Expect(err).ShouldNot(HaveOccurred())
+
+						if owned {
+							Eventually(session).Should(gexec.Exit(0))
+							veth, err := netlink.LinkByName(hostVethName)
+							Expect(err).ShouldNot(HaveOccurred())
+							Expect(veth.Attrs().Alias).To(Equal("flowcontrol:" + container_id))
+							_, err = DeleteContainerWithId(netconf, netnspath, "", container_id)
+							Expect(err).ShouldNot(HaveOccurred())
+							return
+						}
+						Eventually(session).Should(gexec.Exit())
+						Expect(session.ExitCode()).NotTo(Equal(0))
+						Expect(string(session.Out.Contents())).To(ContainSubstring(`"code": 102`))
+						Expect(string(session.Out.Contents())).To(ContainSubstring("doesn't belong to container"))
+						// The veth is left to its owner.
+						veth, err := netlink.LinkByName(hostVethName)
+						Expect(err).ShouldNot(HaveOccurred())
+						Expect(veth.Attrs().Alias).To(Equal(alias(container_id)))
+						Expect(netlink.LinkDel(veth)).To(Succeed())
+					},
+					Entry("left by an earlier ADD of the container", func(id string) string { return "flowcontrol:" + id }, true),
+					Entry("owned by another container sharing its prefix", func(id string) string { return "flowcontrol:" + id + "0" },
+						false),
+					Entry("marked by another plugin", func(string) string { return "weave" }, false),
+					Entry("without an ownership marker", func(string) string { return "" }, false),
+				)
+			})
+
+			Context("when IPAM returns routes", func() {
+				It("programs them through their gateway in the namespace", func() {
+					routesConf := fmt.Sprintf(`
+					{
+					  "cniVersion": "%s",
+					  "name": "net1",
+					  "type": "calico",
+					  "etcd_endpoints": "http://%s:2379",
+					  "ipam": {
+					    "type": "host-local",
+					    "subnet": "10.0.0.0/8",
+					    "routes": [{"dst": "192.168.0.0/16", "gw": "10.0.0.254"}, {"dst": "172.16.0.0/12"}]
+					  }
+					}`, cniVersion, os.Getenv("ETCD_IP"))
+					_, netnspath, session, contVeth, _, contRoutes, _, err := CreateContainer(routesConf, "", "")
 					Expect(err).ShouldNot(HaveOccurred())
 					Eventually(session).Should(gexec.Exit(0))
 
-					_, err = DeleteContainerWithId(netconf, netnspath, "", container_id)
+					gw := net.ParseIP("10.0.0.254").To4()
+					Expect(contRoutes).Should(SatisfyAll(
+						ContainElement(netlink.Route{
+							LinkIndex: contVeth.Attrs().Index,
+							Scope:     netlink.SCOPE_LINK,
+							Dst:       &net.IPNet{IP: gw, Mask: net.CIDRMask(32, 32)},
+							Protocol:  syscall.RTPROT_BOOT,
+							Table:     syscall.RT_TABLE_MAIN,
+							Type:      syscall.RTN_UNICAST,
+						}),
+						ContainElement(netlink.Route{
+							LinkIndex: contVeth.Attrs().Index,
+							Dst:       &net.IPNet{IP: net.IPv4(192, 168, 0, 0).To4(), Mask: net.CIDRMask(16, 32)},
+							Gw:        gw,
+							Protocol:  syscall.RTPROT_BOOT,
+							Table:     syscall.RT_TABLE_MAIN,
+							Type:      syscall.RTN_UNICAST,
+						}),
+						ContainElement(netlink.Route{
+							LinkIndex: contVeth.Attrs().Index,
+							Dst:       &net.IPNet{IP: net.IPv4(172, 16, 0, 0).To4(), Mask: net.CIDRMask(12, 32)},
+							Gw:        net.IPv4(169, 254, 1, 1).To4(),
+							Protocol:  syscall.RTPROT_BOOT,
+							Table:     syscall.RT_TABLE_MAIN,
+							Type:      syscall.RTN_UNICAST,
+						})))
+
+					_, err = DeleteContainer(routesConf, netnspath, "")
 					Expect(err).ShouldNot(HaveOccurred())
 				})
 			})
@@ -392,4 +474,200 @@ var _ = Describe("CalicoCni", func() {
 			})
 		})
 	})
+
+	Describe("ADD retried after an earlier attempt shaped the pod", func() {
+		var stateDir string
+
+		BeforeEach(func() {
+			var err error
+			stateDir, err = ioutil.TempDir("", "flowcontrol-state")
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(stateDir)
+		})
+
+		shapedConf := func(egress string) string {
+			return fmt.Sprintf(`
+			{
+			  "cniVersion": "%s",
+			  "name": "net1",
+			  "type": "calico",
+			  "etcd_endpoints": "http://%s:2379",
+			  "state_dir": "%s",
+			  "shaper": "htb",
+			  "egress_rate": "%s",
+			  "ipam": {
+			    "type": "host-local",
+			    "subnet": "10.0.0.0/24"
+			  }
+			}`, cniVersion, os.Getenv("ETCD_IP"), stateDir, egress)
+		}
+
+		// ifbShaping returns the classes of the IFB device of the container and the number of filters on it.
+		ifbShaping := func(containerID string) ([]netlink.Class, int) {
+			ifb, err := netlink.LinkByName("ifb" + util.Prefix(containerID, 11))
+			Expect(err).ShouldNot(HaveOccurred())
+			classes, err := netlink.ClassList(ifb, netlink.MakeHandle(1, 0))
+			Expect(err).ShouldNot(HaveOccurred())
+			filters, err := netlink.FilterList(ifb, netlink.MakeHandle(1, 0))
+			Expect(err).ShouldNot(HaveOccurred())
+			return classes, len(filters)
+		}
+
+		DescribeTable("reconciles the qdiscs, classes and filters left on the IFB device instead of duplicating them",
+			func(firstEgress, retryEgress string, rate uint64) {
+				containerID, netnspath, session, _, _, _, contNs, err := CreateContainer(shapedConf(firstEgress), "", "")
+				Expect(err).ShouldNot(HaveOccurred())
+				Eventually(session).Should(gexec.Exit(0))
+				classes, filters := ifbShaping(containerID)
+				Expect(classes).To(HaveLen(1))
+
+				// Without its endpoint, the retried ADD networks the pod again over what the first one left.
+				WipeEtcd()
+				session, _, _, _, err = RunCNIPluginWithId(shapedConf(retryEgress), "", "", netnspath, containerID, contNs)
+				Expect(err).ShouldNot(HaveOccurred())
+				Eventually(session).Should(gexec.Exit(0))
+
+				retriedClasses, retriedFilters := ifbShaping(containerID)
+				Expect(retriedClasses).To(HaveLen(1))
+				Expect(retriedClasses[0].Attrs().Handle).To(Equal(classes[0].Attrs().Handle))
+				Expect(retriedClasses[0].(*netlink.HtbClass).Rate).To(Equal(rate / 8))
+				Expect(retriedFilters).To(Equal(filters))
+
+				_, err = DeleteContainer(shapedConf(retryEgress), netnspath, "")
+				Expect(err).ShouldNot(HaveOccurred())
+			},
+			Entry("with the same rate", "10M", "10M", uint64(10*1000*1000)),
+			Entry("with a new rate", "10M", "20M", uint64(20*1000*1000)),
+		)
+	})
+
+	Describe("ADD of a pod limited in some directions", func() {
+		var stateDir string
+
+		BeforeEach(func() {
+			var err error
+			stateDir, err = ioutil.TempDir("", "flowcontrol-state")
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(stateDir)
+		})
+
+		limitedConf := func(options, ingress, egress string) string {
+			return fmt.Sprintf(`
+			{
+			  "cniVersion": "%s",
+			  "name": "net1",
+			  "type": "calico",
+			  "etcd_endpoints": "http://%s:2379",
+			  "state_dir": "%s",
+			  %s
+			  "ingress_rate": "%s",
+			  "egress_rate": "%s",
+			  "ipam": {
+			    "type": "host-local",
+			    "subnet": "10.0.0.0/24"
+			  }
+			}`, cniVersion, os.Getenv("ETCD_IP"), stateDir, options, ingress, egress)
+		}
+
+		// qdiscTypes returns the types of the qdiscs of link.
+		qdiscTypes := func(link netlink.Link) []string {
+			qdiscs, err := netlink.QdiscList(link)
+			Expect(err).ShouldNot(HaveOccurred())
+			var types []string
+			for _, q := range qdiscs {
+				types = append(types, q.Type())
+			}
+			return types
+		}
+
+		// The IFB device shapes what leaves the pod, fed by the ingress qdisc of its host veth, so only an egress
+		// limit needs them; with lazy_ifb, a pod limited in egress only is shaped in its namespace instead.
+		DescribeTable("only creates the IFB device and ingress qdisc an egress limit needs",
+			func(options, ingress, egress string, ifb, containerShaped bool) {
+				conf := limitedConf(options, ingress, egress)
+				containerID, netnspath, session, contVeth, _, _, contNs, err := CreateContainer(conf, "", "")
+				Expect(err).ShouldNot(HaveOccurred())
+				Eventually(session).Should(gexec.Exit(0))
+
+				hostVeth, err := netlink.LinkByName("cali" + util.Prefix(containerID, 11))
+				Expect(err).ShouldNot(HaveOccurred())
+				_, err = netlink.LinkByName("ifb" + util.Prefix(containerID, 11))
+				if ifb {
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(qdiscTypes(hostVeth)).To(ContainElement("ingress"))
+				} else {
+					Expect(err).Should(HaveOccurred())
+					Expect(qdiscTypes(hostVeth)).NotTo(ContainElement("ingress"))
+				}
+				var contTypes []string
+				Expect(contNs.Do(func(_ ns.NetNS) error {
+					contTypes = qdiscTypes(contVeth)
+					return nil
+				})).To(Succeed())
+				if containerShaped {
+					Expect(contTypes).To(ContainElement("tbf"))
+				} else {
+					Expect(contTypes).NotTo(ContainElement("tbf"))
+				}
+
+				_, err = DeleteContainer(conf, netnspath, "")
+				Expect(err).ShouldNot(HaveOccurred())
+				_, err = netlink.LinkByName("ifb" + util.Prefix(containerID, 11))
+				Expect(err).Should(HaveOccurred())
+			},
+			Entry("limited in ingress only", "", "10M", "", false, false),
+			Entry("limited in egress only", "", "", "10M", true, false),
+			Entry("limited in both directions", "", "10M", "10M", true, false),
+			Entry("limited in egress only with lazy_ifb", `"lazy_ifb": true,`, "", "10M", false, true),
+			Entry("limited in both directions with lazy_ifb", `"lazy_ifb": true,`, "10M", "10M", true, false),
+		)
+
+		// rootHTBRate returns the rate of the class under the root HTB qdisc major: of link, in bits per second, or
+		// 0 if link has no root HTB qdisc.
+		rootHTBRate := func(link netlink.Link, major uint16) uint64 {
+			for _, q := range qdiscTypes(link) {
+				if q != "htb" {
+					continue
+				}
+				classes, err := netlink.ClassList(link, netlink.MakeHandle(major, 0))
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(classes).To(HaveLen(1))
+				return classes[0].(*netlink.HtbClass).Rate * 8
+			}
+			return 0
+		}
+
+		DescribeTable("shapes each direction with its own HTB hierarchy, and nothing for an unlimited one",
+			func(ingress, egress string, ingressRate, egressRate uint64) {
+				conf := limitedConf(`"shaper": "htb",`, ingress, egress)
+				containerID, netnspath, session, _, _, _, _, err := CreateContainer(conf, "", "")
+				Expect(err).ShouldNot(HaveOccurred())
+				Eventually(session).Should(gexec.Exit(0))
+
+				// Traffic into the pod is shaped on its host veth, and traffic out of it on its IFB device.
+				hostVeth, err := netlink.LinkByName("cali" + util.Prefix(containerID, 11))
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(rootHTBRate(hostVeth, 2)).To(Equal(ingressRate))
+				ifb, err := netlink.LinkByName("ifb" + util.Prefix(containerID, 11))
+				if egressRate == 0 {
+					Expect(err).Should(HaveOccurred())
+				} else {
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(rootHTBRate(ifb, 1)).To(Equal(egressRate))
+				}
+
+				_, err = DeleteContainer(conf, netnspath, "")
+				Expect(err).ShouldNot(HaveOccurred())
+			},
+			Entry("limited in ingress only", "10M", "", uint64(10*1000*1000), uint64(0)),
+			Entry("limited in egress only", "", "20M", uint64(0), uint64(20*1000*1000)),
+			Entry("limited in both directions", "10M", "20M", uint64(10*1000*1000), uint64(20*1000*1000)),
+		)
+	})
 })
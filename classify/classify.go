@@ -0,0 +1,233 @@
+// Package classify evaluates tc filters against a packet in userspace, to explain which class or action the kernel
+// would pick for it without sending any traffic.
+package classify
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"syscall"
+)
+
+// Transport protocols a Packet can carry, named as nftables and /etc/protocols name them.
+const (
+	ProtoTCP    = "tcp"
+	ProtoUDP    = "udp"
+	ProtoICMP   = "icmp"
+	ProtoICMPv6 = "ipv6-icmp"
+	// ProtoARP is not a transport protocol: the packet is an ARP request between Src and Dst.
+	ProtoARP = "arp"
+)
+
+var protoNumbers = map[string]byte{ProtoTCP: 6, ProtoUDP: 17, ProtoICMP: 1, ProtoICMPv6: 58}
+
+// Packet describes the packet to classify. Addresses that aren't set are zero in the headers the filters see.
+type Packet struct {
+	Proto   string `json:"proto"`
+	Src     net.IP `json:"src,omitempty"`
+	Dst     net.IP `json:"dst,omitempty"`
+	SrcPort uint16 `json:"sport,omitempty"`
+	DstPort uint16 `json:"dport,omitempty"`
+}
+
+// Validate checks that the protocol is known and consistent with the addresses and ports.
+func (p Packet) Validate() error {
+	if _, ok := protoNumbers[p.Proto]; !ok && p.Proto != ProtoARP {
+		return fmt.Errorf("unknown protocol %q, must be %s, %s, %s, %s or %s", p.Proto,
+			ProtoTCP, ProtoUDP, ProtoICMP, ProtoICMPv6, ProtoARP)
+	}
+	if (p.SrcPort != 0 || p.DstPort != 0) && p.Proto != ProtoTCP && p.Proto != ProtoUDP {
+		return fmt.Errorf("ports are only valid for %s and %s", ProtoTCP, ProtoUDP)
+	}
+	if p.Src != nil && p.Dst != nil && (p.Src.To4() == nil) != (p.Dst.To4() == nil) {
+		return fmt.Errorf("source %s and destination %s are of different IP families", p.Src, p.Dst)
+	}
+	if p.IPv6() && (p.Proto == ProtoICMP || p.Proto == ProtoARP) {
+		return fmt.Errorf("%s doesn't run over IPv6", p.Proto)
+	}
+	return nil
+}
+
+// IPv6 reports whether the packet is an IPv6 one.
+func (p Packet) IPv6() bool {
+	for _, ip := range []net.IP{p.Src, p.Dst} {
+		if ip != nil && ip.To4() == nil {
+			return true
+		}
+	}
+	return p.Proto == ProtoICMPv6
+}
+
+// EtherType returns the link layer protocol of the packet.
+func (p Packet) EtherType() uint16 {
+	switch {
+	case p.Proto == ProtoARP:
+		return syscall.ETH_P_ARP
+	case p.IPv6():
+		return syscall.ETH_P_IPV6
+	}
+	return syscall.ETH_P_IP
+}
+
+// Header returns the packet from its network header on, as u32 filters see it: the IP header followed by the start
+// of the transport header, or the ARP header.
+func (p Packet) Header() []byte {
+	if p.Proto == ProtoARP {
+		arp := make([]byte, 28)
+		binary.BigEndian.PutUint16(arp[0:], 1)
+		binary.BigEndian.PutUint16(arp[2:], syscall.ETH_P_IP)
+		arp[4], arp[5] = 6, 4
+		binary.BigEndian.PutUint16(arp[6:], 1)
+		copy(arp[14:18], p.Src.To4())
+		copy(arp[24:28], p.Dst.To4())
+		return arp
+	}
+
+	transport := make([]byte, 8)
+	switch p.Proto {
+	case ProtoTCP:
+		transport = make([]byte, 20)
+		transport[12] = 5 << 4
+		transport[13] = 0x02 // SYN
+	case ProtoICMP:
+		transport[0] = 8 // echo request
+	case ProtoICMPv6:
+		transport[0] = 128 // echo request
+	}
+	if p.Proto == ProtoTCP || p.Proto == ProtoUDP {
+		binary.BigEndian.PutUint16(transport[0:], p.SrcPort)
+		binary.BigEndian.PutUint16(transport[2:], p.DstPort)
+	}
+
+	if p.IPv6() {
+		ip := make([]byte, 40)
+		ip[0] = 6 << 4
+		binary.BigEndian.PutUint16(ip[4:], uint16(len(transport)))
+		ip[6] = protoNumbers[p.Proto]
+		ip[7] = 64
+		copy(ip[8:24], p.Src.To16())
+		copy(ip[24:40], p.Dst.To16())
+		return append(ip, transport...)
+	}
+	ip := make([]byte, 20)
+	ip[0] = 4<<4 | 5
+	binary.BigEndian.PutUint16(ip[2:], uint16(len(ip)+len(transport)))
+	ip[8] = 64
+	ip[9] = protoNumbers[p.Proto]
+	copy(ip[12:16], p.Src.To4())
+	copy(ip[16:20], p.Dst.To4())
+	return append(ip, transport...)
+}
+
+// Actions of a Verdict.
+const (
+	ActionClassify = "classify"
+	ActionRedirect = "redirect"
+	ActionPass     = "pass"
+	ActionDrop     = "drop"
+)
+
+// Verdict is what a filter does with the packets it matches.
+type Verdict struct {
+	Action string `json:"action"`
+	// Class is the ID of the class packets are classified into, e.g. "2:56cb".
+	Class string `json:"class,omitempty"`
+	// Device is the device packets are redirected to.
+	Device string `json:"device,omitempty"`
+}
+
+func (v Verdict) String() string {
+	switch v.Action {
+	case ActionClassify:
+		return "classify into " + v.Class
+	case ActionRedirect:
+		return "redirect to " + v.Device
+	}
+	return v.Action
+}
+
+// Key is a match of a u32 filter: the big-endian word at offset Off of the network header, masked with Mask, must
+// equal Val.
+type Key struct {
+	Val  uint32 `json:"val"`
+	Mask uint32 `json:"mask"`
+	Off  int32  `json:"off"`
+}
+
+// Filter is a tc filter, reduced to what decides whether it matches a packet and what it does with it.
+type Filter struct {
+	Device   string `json:"device"`
+	Parent   string `json:"parent"`
+	Priority uint16 `json:"priority"`
+	// Protocol is the link layer protocol the filter is attached for; ETH_P_ALL matches them all.
+	Protocol uint16 `json:"protocol"`
+	// Kind is the classifier, "u32" or "matchall"; filters of other kinds can't be evaluated and never match.
+	Kind    string  `json:"kind"`
+	Keys    []Key   `json:"keys,omitempty"`
+	Verdict Verdict `json:"verdict"`
+}
+
+// Step is a filter a packet was tried against, in priority order.
+type Step struct {
+	Filter  Filter `json:"filter"`
+	Matched bool   `json:"matched"`
+	// Reason says why the filter didn't match.
+	Reason string `json:"reason,omitempty"`
+}
+
+// Decision is the outcome of classifying a packet on a device.
+type Decision struct {
+	Device string `json:"device"`
+	Steps  []Step `json:"steps"`
+	// Verdict is that of the first filter that matched, or nil if none did.
+	Verdict *Verdict `json:"verdict,omitempty"`
+}
+
+// Evaluate tries the packet against the filters of a device in priority order, stopping at the first that matches,
+// as the kernel does with terminal filters.
+func Evaluate(device string, filters []Filter, p Packet) Decision {
+	sorted := append([]Filter(nil), filters...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Priority < sorted[j].Priority })
+	header, etherType := p.Header(), p.EtherType()
+
+	decision := Decision{Device: device}
+	for _, f := range sorted {
+		step := Step{Filter: f}
+		switch {
+		case f.Protocol != syscall.ETH_P_ALL && f.Protocol != etherType:
+			step.Reason = fmt.Sprintf("attached for protocol 0x%04x, the packet is 0x%04x", f.Protocol, etherType)
+		case f.Kind == "matchall":
+			step.Matched = true
+		case f.Kind == "u32":
+			step.Reason = matchKeys(f.Keys, header)
+			step.Matched = step.Reason == ""
+		default:
+			step.Reason = fmt.Sprintf("%s filters can't be evaluated", f.Kind)
+		}
+		decision.Steps = append(decision.Steps, step)
+		if step.Matched {
+			verdict := f.Verdict
+			decision.Verdict = &verdict
+			break
+		}
+	}
+	return decision
+}
+
+// matchKeys returns why header doesn't match keys, or an empty string if it does.
+func matchKeys(keys []Key, header []byte) string {
+	for i, k := range keys {
+		if k.Off < 0 || int(k.Off)+4 > len(header) {
+			if k.Mask == 0 {
+				continue
+			}
+			return fmt.Sprintf("key %d is at offset %d, past the headers", i, k.Off)
+		}
+		word := binary.BigEndian.Uint32(header[k.Off:])
+		if word&k.Mask != k.Val&k.Mask {
+			return fmt.Sprintf("key %d wants %08x/%08x at offset %d, the packet has %08x", i, k.Val, k.Mask, k.Off, word)
+		}
+	}
+	return ""
+}
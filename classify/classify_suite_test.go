@@ -0,0 +1,13 @@
+package classify_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Classify Suite")
+}
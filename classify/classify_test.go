@@ -0,0 +1,94 @@
+package classify_test
+
+import (
+	"net"
+	"syscall"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/cni-plugin/classify"
+)
+
+// vethEgressFilters are the filters the plugin adds to the ingress qdisc of a host veth with the drop non-IP
+// policy.
+var vethEgressFilters = []classify.Filter{
+	{Priority: 3, Protocol: syscall.ETH_P_ALL, Kind: "matchall", Verdict: classify.Verdict{Action: classify.ActionDrop}},
+	{Priority: 1, Protocol: syscall.ETH_P_IP, Kind: "u32", Keys: []classify.Key{{Off: 16}},
+		Verdict: classify.Verdict{Action: classify.ActionRedirect, Device: "ifb1234"}},
+	{Priority: 2, Protocol: syscall.ETH_P_ARP, Kind: "matchall", Verdict: classify.Verdict{Action: classify.ActionPass}},
+	{Priority: 2, Protocol: syscall.ETH_P_IPV6, Kind: "matchall",
+		Verdict: classify.Verdict{Action: classify.ActionRedirect, Device: "ifb1234"}},
+}
+
+// nicFilters match the source address of a pod, as the egress filters of the nic backend do.
+var nicFilters = []classify.Filter{
+	{Priority: 1, Protocol: syscall.ETH_P_IP, Kind: "u32", Keys: []classify.Key{{Val: 0x0a000001, Mask: 0xffffffff, Off: 12}},
+		Verdict: classify.Verdict{Action: classify.ActionClassify, Class: "1:2"}},
+	{Priority: 1, Protocol: syscall.ETH_P_IP, Kind: "u32", Keys: []classify.Key{{Val: 0x0a000002, Mask: 0xffffffff, Off: 12}},
+		Verdict: classify.Verdict{Action: classify.ActionClassify, Class: "1:3"}},
+	{Priority: 4, Protocol: syscall.ETH_P_ALL, Kind: "cgroup", Verdict: classify.Verdict{Action: classify.ActionPass}},
+}
+
+var _ = Describe("Evaluate", func() {
+	DescribeTable("picks the first matching filter by priority",
+		func(filters []classify.Filter, p classify.Packet, verdict string) {
+			d := classify.Evaluate("dev", filters, p)
+			if verdict == "" {
+				Expect(d.Verdict).To(BeNil())
+				return
+			}
+			Expect(d.Verdict).NotTo(BeNil())
+			Expect(d.Verdict.String()).To(Equal(verdict))
+		},
+		Entry("IPv4 is redirected", vethEgressFilters,
+			classify.Packet{Proto: classify.ProtoTCP, Dst: net.ParseIP("8.8.8.8"), DstPort: 443}, "redirect to ifb1234"),
+		Entry("IPv6 is redirected", vethEgressFilters,
+			classify.Packet{Proto: classify.ProtoUDP, Dst: net.ParseIP("2001:db8::1"), DstPort: 53}, "redirect to ifb1234"),
+		Entry("ARP passes", vethEgressFilters, classify.Packet{Proto: classify.ProtoARP}, "pass"),
+		Entry("ICMPv6 is IPv6", vethEgressFilters, classify.Packet{Proto: classify.ProtoICMPv6}, "redirect to ifb1234"),
+		Entry("keys pick the class", nicFilters,
+			classify.Packet{Proto: classify.ProtoTCP, Src: net.ParseIP("10.0.0.2"), Dst: net.ParseIP("8.8.8.8")}, "classify into 1:3"),
+		Entry("unmatched addresses are unclassified", nicFilters,
+			classify.Packet{Proto: classify.ProtoTCP, Src: net.ParseIP("10.0.0.3"), Dst: net.ParseIP("8.8.8.8")}, ""),
+	)
+
+	It("explains the filters that didn't match", func() {
+		d := classify.Evaluate("eth0", nicFilters, classify.Packet{Proto: classify.ProtoUDP, Src: net.ParseIP("10.0.0.3")})
+		Expect(d.Steps).To(HaveLen(3))
+		Expect(d.Steps[0].Reason).To(ContainSubstring("0a000001/ffffffff at offset 12"))
+		Expect(d.Steps[2].Reason).To(Equal("cgroup filters can't be evaluated"))
+	})
+})
+
+var _ = Describe("Packet", func() {
+	It("lays out IPv4 headers for u32", func() {
+		h := classify.Packet{Proto: classify.ProtoTCP, Src: net.ParseIP("10.0.0.1"), Dst: net.ParseIP("8.8.8.8"), SrcPort: 1234, DstPort: 443}.Header()
+		Expect(h[9]).To(Equal(byte(6)))
+		Expect(h[12:16]).To(Equal([]byte{10, 0, 0, 1}))
+		Expect(h[16:20]).To(Equal([]byte{8, 8, 8, 8}))
+		Expect(h[20:24]).To(Equal([]byte{0x04, 0xd2, 0x01, 0xbb}))
+	})
+
+	It("lays out IPv6 headers for u32", func() {
+		h := classify.Packet{Proto: classify.ProtoUDP, Dst: net.ParseIP("2001:db8::1"), DstPort: 53}.Header()
+		Expect(h[6]).To(Equal(byte(17)))
+		Expect(h[24:40]).To(Equal([]byte(net.ParseIP("2001:db8::1"))))
+		Expect(h[42:44]).To(Equal([]byte{0, 53}))
+	})
+
+	DescribeTable("validates",
+		func(p classify.Packet, valid bool) {
+			if valid {
+				Expect(p.Validate()).To(Succeed())
+			} else {
+				Expect(p.Validate()).NotTo(Succeed())
+			}
+		},
+		Entry("tcp", classify.Packet{Proto: classify.ProtoTCP, DstPort: 443}, true),
+		Entry("unknown protocol", classify.Packet{Proto: "sctp"}, false),
+		Entry("ports without tcp or udp", classify.Packet{Proto: classify.ProtoICMP, DstPort: 1}, false),
+		Entry("mixed families", classify.Packet{Proto: classify.ProtoTCP, Src: net.ParseIP("10.0.0.1"), Dst: net.ParseIP("::1")}, false),
+		Entry("ICMP over IPv6", classify.Packet{Proto: classify.ProtoICMP, Dst: net.ParseIP("::1")}, false),
+	)
+})
@@ -0,0 +1,227 @@
+// Package cloud discovers the instance type of the node from its cloud provider's metadata service, and knows the
+// network bandwidth of common instance types, so that node capacity doesn't have to be configured per node pool.
+package cloud
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Supported providers.
+const (
+	AWS   = "aws"
+	GCE   = "gce"
+	Azure = "azure"
+)
+
+// DefaultTimeout bounds each metadata request, so that discovery is quick off-cloud.
+const DefaultTimeout = time.Second
+
+// Instance is what discovery found out about the node.
+type Instance struct {
+	Provider string
+	Type     string
+}
+
+// Discoverer queries the metadata services of the supported providers.
+type Discoverer struct {
+	// Endpoints are the base URLs of the metadata service of each provider; the well known addresses by default.
+	Endpoints map[string]string
+	Client    *http.Client
+}
+
+// NewDiscoverer returns a discoverer using the real metadata services.
+func NewDiscoverer() *Discoverer {
+	return &Discoverer{
+		Endpoints: map[string]string{
+			AWS:   "http://169.254.169.254",
+			GCE:   "http://metadata.google.internal",
+			Azure: "http://169.254.169.254",
+		},
+		Client: &http.Client{Timeout: DefaultTimeout},
+	}
+}
+
+// Discover returns the provider and instance type of the node, trying each provider in turn.
+func (d *Discoverer) Discover() (Instance, error) {
+	var errs []string
+	for _, provider := range []string{AWS, GCE, Azure} {
+		base, ok := d.Endpoints[provider]
+		if !ok {
+			continue
+		}
+		var instanceType string
+		var err error
+		switch provider {
+		case AWS:
+			instanceType, err = d.aws(base)
+		case GCE:
+			instanceType, err = d.gce(base)
+		case Azure:
+			instanceType, err = d.azure(base)
+		}
+		if err == nil && instanceType != "" {
+			return Instance{Provider: provider, Type: instanceType}, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", provider, err))
+	}
+	return Instance{}, fmt.Errorf("no cloud metadata service found (%s)", strings.Join(errs, "; "))
+}
+
+func (d *Discoverer) get(method, url string, headers map[string]string) (string, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return "", err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s %s returned %s", method, url, resp.Status)
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// aws uses IMDSv2, which needs a session token first.
+func (d *Discoverer) aws(base string) (string, error) {
+	token, err := d.get("PUT", base+"/latest/api/token", map[string]string{"X-aws-ec2-metadata-token-ttl-seconds": "60"})
+	if err != nil {
+		return "", err
+	}
+	return d.get("GET", base+"/latest/meta-data/instance-type", map[string]string{"X-aws-ec2-metadata-token": token})
+}
+
+// gce returns the machine type, which the metadata server reports as projects/<n>/machineTypes/<type>.
+func (d *Discoverer) gce(base string) (string, error) {
+	machineType, err := d.get("GET", base+"/computeMetadata/v1/instance/machine-type", map[string]string{"Metadata-Flavor": "Google"})
+	if err != nil {
+		return "", err
+	}
+	return machineType[strings.LastIndex(machineType, "/")+1:], nil
+}
+
+func (d *Discoverer) azure(base string) (string, error) {
+	return d.get("GET", base+"/metadata/instance/compute/vmSize?api-version=2021-02-01&format=text", map[string]string{"Metadata": "true"})
+}
+
+const (
+	mbps = 1000 * 1000
+	gbps = 1000 * mbps
+)
+
+// awsBandwidth is the peak network bandwidth of common EC2 instance types.
+var awsBandwidth = map[string]uint64{
+	"t3.micro":     5 * gbps,
+	"t3.small":     5 * gbps,
+	"t3.medium":    5 * gbps,
+	"t3.large":     5 * gbps,
+	"t3.xlarge":    5 * gbps,
+	"t3.2xlarge":   5 * gbps,
+	"m5.large":     10 * gbps,
+	"m5.xlarge":    10 * gbps,
+	"m5.2xlarge":   10 * gbps,
+	"m5.4xlarge":   10 * gbps,
+	"m5.8xlarge":   10 * gbps,
+	"m5.12xlarge":  12 * gbps,
+	"m5.16xlarge":  20 * gbps,
+	"m5.24xlarge":  25 * gbps,
+	"c5.large":     10 * gbps,
+	"c5.xlarge":    10 * gbps,
+	"c5.2xlarge":   10 * gbps,
+	"c5.4xlarge":   10 * gbps,
+	"c5.9xlarge":   12 * gbps,
+	"c5.12xlarge":  12 * gbps,
+	"c5.18xlarge":  25 * gbps,
+	"c5.24xlarge":  25 * gbps,
+	"r5.large":     10 * gbps,
+	"r5.xlarge":    10 * gbps,
+	"r5.2xlarge":   10 * gbps,
+	"r5.4xlarge":   10 * gbps,
+	"r5.8xlarge":   10 * gbps,
+	"r5.12xlarge":  12 * gbps,
+	"r5.16xlarge":  20 * gbps,
+	"r5.24xlarge":  25 * gbps,
+	"m6i.large":    12500 * mbps,
+	"m6i.xlarge":   12500 * mbps,
+	"m6i.2xlarge":  12500 * mbps,
+	"m6i.4xlarge":  12500 * mbps,
+	"m6i.8xlarge":  12500 * mbps,
+	"m6i.16xlarge": 25 * gbps,
+	"m6i.32xlarge": 50 * gbps,
+}
+
+// azureBandwidth is the expected network bandwidth of common Azure VM sizes.
+var azureBandwidth = map[string]uint64{
+	"Standard_D2s_v3":  1 * gbps,
+	"Standard_D4s_v3":  2 * gbps,
+	"Standard_D8s_v3":  4 * gbps,
+	"Standard_D16s_v3": 8 * gbps,
+	"Standard_D32s_v3": 16 * gbps,
+	"Standard_D64s_v3": 30 * gbps,
+	"Standard_D2s_v5":  12500 * mbps,
+	"Standard_D4s_v5":  12500 * mbps,
+	"Standard_D8s_v5":  12500 * mbps,
+	"Standard_D16s_v5": 12500 * mbps,
+	"Standard_D32s_v5": 16 * gbps,
+	"Standard_D64s_v5": 30 * gbps,
+}
+
+// gceSharedCore is the egress bandwidth of GCE shared-core machine types, which have no vCPU count in their name.
+var gceSharedCore = map[string]uint64{
+	"f1-micro":  1 * gbps,
+	"g1-small":  1 * gbps,
+	"e2-micro":  1 * gbps,
+	"e2-small":  1 * gbps,
+	"e2-medium": 2 * gbps,
+}
+
+// GCE allows 2 Gbps of egress per vCPU, up to 16 Gbps without Tier_1 networking.
+const (
+	gcePerVCPU = 2 * gbps
+	gceMax     = 16 * gbps
+)
+
+// Capacity returns the network bandwidth, in bits per second, of an instance type, or false if it isn't known.
+func Capacity(i Instance) (uint64, bool) {
+	switch i.Provider {
+	case AWS:
+		c, ok := awsBandwidth[i.Type]
+		return c, ok
+	case Azure:
+		c, ok := azureBandwidth[i.Type]
+		return c, ok
+	case GCE:
+		if c, ok := gceSharedCore[i.Type]; ok {
+			return c, true
+		}
+		// Predefined machine types end with their vCPU count, e.g. n2-standard-8; custom ones with the vCPU count
+		// followed by the memory, e.g. n2-custom-8-16384.
+		parts := strings.Split(i.Type, "-")
+		vcpuPart := parts[len(parts)-1]
+		if len(parts) == 4 && parts[1] == "custom" {
+			vcpuPart = parts[2]
+		}
+		vcpus, err := strconv.ParseUint(vcpuPart, 10, 64)
+		if err != nil || vcpus == 0 {
+			return 0, false
+		}
+		if c := vcpus * gcePerVCPU; c < gceMax {
+			return c, true
+		}
+		return gceMax, true
+	}
+	return 0, false
+}
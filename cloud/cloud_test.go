@@ -0,0 +1,57 @@
+package cloud_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/cni-plugin/cloud"
+)
+
+var _ = Describe("Discoverer", func() {
+	It("finds the GCE machine type", func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.Header.Get("Metadata-Flavor") != "Google" || req.URL.Path != "/computeMetadata/v1/instance/machine-type" {
+				http.NotFound(w, req)
+				return
+			}
+			w.Write([]byte("projects/123/machineTypes/n2-standard-4"))
+		}))
+		defer server.Close()
+
+		d := cloud.NewDiscoverer()
+		d.Endpoints = map[string]string{cloud.AWS: server.URL, cloud.GCE: server.URL}
+		Expect(d.Discover()).To(Equal(cloud.Instance{Provider: cloud.GCE, Type: "n2-standard-4"}))
+	})
+
+	It("fails off-cloud", func() {
+		server := httptest.NewServer(http.NotFoundHandler())
+		defer server.Close()
+
+		d := cloud.NewDiscoverer()
+		d.Endpoints = map[string]string{cloud.AWS: server.URL, cloud.GCE: server.URL, cloud.Azure: server.URL}
+		_, err := d.Discover()
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("Capacity", func() {
+	capacity := func(provider, instanceType string) uint64 {
+		c, ok := cloud.Capacity(cloud.Instance{Provider: provider, Type: instanceType})
+		Expect(ok).To(BeTrue())
+		return c
+	}
+
+	It("looks up known instance types", func() {
+		Expect(capacity(cloud.AWS, "m5.large")).To(BeEquivalentTo(10000000000))
+		_, ok := cloud.Capacity(cloud.Instance{Provider: cloud.AWS, Type: "x9.huge"})
+		Expect(ok).To(BeFalse())
+	})
+
+	It("derives GCE egress from the vCPU count", func() {
+		Expect(capacity(cloud.GCE, "n2-standard-4")).To(BeEquivalentTo(8000000000))
+		Expect(capacity(cloud.GCE, "n2-custom-2-4096")).To(BeEquivalentTo(4000000000))
+		Expect(capacity(cloud.GCE, "n2-standard-64")).To(BeEquivalentTo(16000000000))
+	})
+})
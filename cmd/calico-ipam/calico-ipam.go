@@ -27,6 +27,8 @@ import (
 	"github.com/containernetworking/cni/pkg/types"
 	"github.com/containernetworking/cni/pkg/types/current"
 	cniSpecVersion "github.com/containernetworking/cni/pkg/version"
+	"github.com/projectcalico/cni-plugin/logging"
+	"github.com/projectcalico/cni-plugin/specversion"
 	"github.com/projectcalico/cni-plugin/utils"
 	"github.com/projectcalico/libcalico-go/lib/client"
 	"github.com/projectcalico/libcalico-go/lib/errors"
@@ -71,7 +73,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 
 	cniVersion := conf.CNIVersion
 
-	utils.ConfigureLogging(conf.LogLevel)
+	utils.ConfigureLogging(conf, args)
 
 	calicoClient, err := utils.CreateClient(conf)
 	if err != nil {
@@ -82,7 +84,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 	if err != nil {
 		return err
 	}
-	logger := utils.CreateContextLogger(workloadID)
+	logger := logging.In(logging.IPAM, utils.CreateContextLogger(workloadID))
 
 	ipamArgs := ipamArgs{}
 	if err = types.LoadArgs(args.Args, &ipamArgs); err != nil {
@@ -91,7 +93,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 
 	r := &current.Result{}
 	if ipamArgs.IP != nil {
-		fmt.Fprintf(os.Stderr, "Calico CNI IPAM request IP: %v\n", ipamArgs.IP)
+		logger.WithField("IP", ipamArgs.IP).Info("Requesting IP")
 
 		// The hostname will be defaulted to the actual hostname if conf.Hostname is empty
 		assignArgs := client.AssignIPArgs{IP: cnet.IP{ipamArgs.IP}, HandleID: &workloadID, Hostname: conf.Hostname}
@@ -135,7 +137,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 			num6 = 1
 		}
 
-		fmt.Fprintf(os.Stderr, "Calico CNI IPAM request count IPv4=%d IPv6=%d\n", num4, num6)
+		logger.WithFields(log.Fields{"IPv4": num4, "IPv6": num6}).Info("Requesting addresses")
 
 		v4pools, err := utils.ParsePools(conf.IPAM.IPv4Pools, true)
 		if err != nil {
@@ -157,7 +159,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 		}
 		logger.WithField("assignArgs", assignArgs).Info("Auto assigning IP")
 		assignedV4, assignedV6, err := calicoClient.IPAM().AutoAssign(assignArgs)
-		fmt.Fprintf(os.Stderr, "Calico CNI IPAM assigned addresses IPv4=%v IPv6=%v\n", assignedV4, assignedV6)
+		logger.WithFields(log.Fields{"IPv4": assignedV4, "IPv6": assignedV6}).Info("Assigned addresses")
 		if err != nil {
 			return err
 		}
@@ -187,7 +189,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 	}
 
 	// Print result to stdout, in the format defined by the requested cniVersion.
-	return types.PrintResult(r, cniVersion)
+	return specversion.Print(r, cniVersion)
 }
 
 func cmdDel(args *skel.CmdArgs) error {
@@ -196,7 +198,7 @@ func cmdDel(args *skel.CmdArgs) error {
 		return fmt.Errorf("failed to load netconf: %v", err)
 	}
 
-	utils.ConfigureLogging(conf.LogLevel)
+	utils.ConfigureLogging(conf, args)
 
 	calicoClient, err := utils.CreateClient(conf)
 	if err != nil {
@@ -209,7 +211,7 @@ func cmdDel(args *skel.CmdArgs) error {
 		return err
 	}
 
-	logger := utils.CreateContextLogger(workloadID)
+	logger := logging.In(logging.IPAM, utils.CreateContextLogger(workloadID))
 
 	logger.Info("Releasing address using workloadID")
 	if err := calicoClient.IPAM().ReleaseByHandle(workloadID); err != nil {
@@ -19,7 +19,11 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"runtime"
+	"sync"
+	"syscall"
+	"time"
 
 	"net"
 
@@ -30,6 +34,10 @@ import (
 	"github.com/containernetworking/cni/pkg/types/current"
 	cniSpecVersion "github.com/containernetworking/cni/pkg/version"
 	"github.com/projectcalico/cni-plugin/k8s"
+	"github.com/projectcalico/cni-plugin/metrics"
+	"github.com/projectcalico/cni-plugin/specversion"
+	"github.com/projectcalico/cni-plugin/state"
+	"github.com/projectcalico/cni-plugin/tracing"
 	. "github.com/projectcalico/cni-plugin/utils"
 	"github.com/projectcalico/libcalico-go/lib/api"
 	"github.com/projectcalico/libcalico-go/lib/errors"
@@ -63,10 +71,16 @@ func cmdAdd(args *skel.CmdArgs) error {
 	if err := json.Unmarshal(args.StdinData, &conf); err != nil {
 		return fmt.Errorf("failed to load netconf: %v", err)
 	}
+	if err := conf.Validate(); err != nil {
+		return err
+	}
 
 	cniVersion := conf.CNIVersion
 
-	ConfigureLogging(conf.LogLevel)
+	ConfigureLogging(conf, args)
+	if err := ConfigureSlowNetlink(conf.SlowNetlinkThreshold); err != nil {
+		return err
+	}
 
 	workload, orchestrator, err := GetIdentifiers(args)
 	if err != nil {
@@ -105,7 +119,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 		endpoint = &endpoints.Items[0]
 	}
 
-	fmt.Fprintf(os.Stderr, "Calico CNI checking for existing endpoint: %v\n", endpoint)
+	logger.WithField("endpoint", endpoint).Info("Checked for existing endpoint")
 
 	// Collect the result in this variable - this is ultimately what gets "returned" by this function by printing
 	// it to stdout.
@@ -128,7 +142,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 			// Don't create the veth or do any networking.
 			// Just update the profile on the endpoint. The profile will be created if needed during the
 			// profile processing step.
-			fmt.Fprintf(os.Stderr, "Calico CNI appending profile: %s\n", profileID)
+			logger.WithField("profile", profileID).Info("Appending profile")
 			endpoint.Spec.Profiles = append(endpoint.Spec.Profiles, profileID)
 			result, err = CreateResultFromEndpoint(endpoint)
 			logger.WithField("result", result).Debug("Created result from endpoint")
@@ -144,7 +158,9 @@ func cmdAdd(args *skel.CmdArgs) error {
 			// 1) Run the IPAM plugin and make sure there's an IP address returned.
 			logger.WithFields(log.Fields{"paths": os.Getenv("CNI_PATH"),
 				"type": conf.IPAM.Type}).Debug("Looking for IPAM plugin in paths")
+			span := tracing.Start("ipam")
 			ipamResult, err := ipam.ExecAdd(conf.IPAM.Type, args.StdinData)
+			span.End(err)
 			logger.WithField("IPAM result", ipamResult).Info("Got result from IPAM plugin")
 			if err != nil {
 				return err
@@ -188,10 +204,11 @@ func cmdAdd(args *skel.CmdArgs) error {
 			}
 			logger.WithField("endpoint", endpoint).Info("Populated endpoint (with nets)")
 
-			fmt.Fprintf(os.Stderr, "Calico CNI using IPs: %s\n", endpoint.Spec.IPNetworks)
+			logger.WithField("IPs", endpoint.Spec.IPNetworks).Info("Using IPs")
 
 			// 3) Set up the veth
-			hostVethName, contVethMac, err := DoNetworking(args, conf, result, logger, "", "", "")
+			ingress, egress := RuntimeBandwidth(&conf)
+			hostVethName, contVethMac, err := DoNetworking(args, conf, result, logger, "", ingress, egress)
 			if err != nil {
 				// Cleanup IP allocation and return the error.
 				ReleaseIPAllocation(logger, conf.IPAM.Type, args.StdinData)
@@ -246,7 +263,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 			// The profile doesn't exist so needs to be created. The rules vary depending on whether k8s is being used.
 			// Under k8s (without full policy support) the rule is permissive and allows all traffic.
 			// Otherwise, incoming traffic is only allowed from profiles with the same tag.
-			fmt.Fprintf(os.Stderr, "Calico CNI creating profile: %s\n", conf.Name)
+			logger.WithField("profile", conf.Name).Info("Creating profile")
 			var inboundRules []api.Rule
 			if orchestrator == "k8s" {
 				inboundRules = []api.Rule{{Action: "allow"}}
@@ -282,8 +299,12 @@ func cmdAdd(args *skel.CmdArgs) error {
 		ip.Gateway = nil
 	}
 
+	// Return the DNS settings of the network configuration along with any from IPAM, so that runtimes can
+	// configure the container's resolver.
+	MergeDNS(result, conf.DNS)
+
 	// Print result to stdout, in the format defined by the requested cniVersion.
-	return types.PrintResult(result, cniVersion)
+	return specversion.Print(result, cniVersion)
 }
 
 func cmdDel(args *skel.CmdArgs) error {
@@ -292,7 +313,11 @@ func cmdDel(args *skel.CmdArgs) error {
 		return fmt.Errorf("failed to load netconf: %v", err)
 	}
 
-	ConfigureLogging(conf.LogLevel)
+	ConfigureLogging(conf, args)
+	if err := ConfigureSlowNetlink(conf.SlowNetlinkThreshold); err != nil {
+		// Tear down regardless, with the default threshold.
+		log.WithError(err).Warn("Ignoring slowNetlinkThreshold")
+	}
 
 	workload, orchestrator, err := GetIdentifiers(args)
 	if err != nil {
@@ -340,9 +365,8 @@ func cmdDel(args *skel.CmdArgs) error {
 		}
 	}
 
-	// Clean up namespace by removing the interfaces.
-	err = CleanUpNamespace(args, logger)
-	if err != nil {
+	// Remove the shaping, routes, interfaces and shaping state of the container, in that order.
+	if err = TeardownContainer(args, conf, logger); err != nil {
 		return err
 	}
 
@@ -351,6 +375,16 @@ func cmdDel(args *skel.CmdArgs) error {
 	return ipamErr
 }
 
+// cmdCheck verifies that the networking ADD set up for a container is still in place.
+func cmdCheck(args *skel.CmdArgs) error {
+	conf := NetConf{}
+	if err := json.Unmarshal(args.StdinData, &conf); err != nil {
+		return fmt.Errorf("failed to load netconf: %v", err)
+	}
+	ConfigureLogging(conf, args)
+	return CheckContainer(args, conf)
+}
+
 // VERSION is filled out during the build process (using git describe output)
 var VERSION string
 
@@ -374,5 +408,130 @@ func main() {
 		os.Exit(1)
 	}
 
-	skel.PluginMain(cmdAdd, cmdDel, cniSpecVersion.All)
+	// The vendored skel predates CHECK, so it is dispatched here.
+	if os.Getenv("CNI_COMMAND") == "CHECK" {
+		args, err := CheckArgsFromEnv()
+		if err == nil {
+			err = reported(traced("CHECK", cmdCheck))(args)
+		}
+		if err != nil {
+			if err := PrintError(err); err != nil {
+				log.WithError(err).Error("Failed to print error")
+			}
+			os.Exit(1)
+		}
+		return
+	}
+
+	skel.PluginMain(reported(traced("ADD", journaled("ADD", spooled(cmdAdd)))), reported(traced("DEL", journaled("DEL", spooled(cmdDel)))), cniSpecVersion.All)
+}
+
+// reported turns the errors of the operation with a known cause into CNI errors carrying a remediation hint.
+func reported(cmd func(*skel.CmdArgs) error) func(*skel.CmdArgs) error {
+	return func(args *skel.CmdArgs) error {
+		return CNIError(cmd(args))
+	}
+}
+
+// spooled hands the counters of the operation, such as failed netlink operations, to the agent to export.
+func spooled(cmd func(*skel.CmdArgs) error) func(*skel.CmdArgs) error {
+	return func(args *skel.CmdArgs) error {
+		err := cmd(args)
+		conf := NetConf{}
+		json.Unmarshal(args.StdinData, &conf)
+		if !conf.CalicoCompat {
+			if err := metrics.DefaultRegistry.WriteSpool(MetricsSpoolDir(conf.StateDir)); err != nil {
+				log.WithError(err).Warn("Failed to spool metrics")
+			}
+		}
+		return err
+	}
+}
+
+// journaled records the operation in the journal while it runs, so that if the plugin is killed part way through,
+// the next operation on the container or the agent's garbage collector knows to clean up after it.
+func journaled(op string, cmd func(*skel.CmdArgs) error) func(*skel.CmdArgs) error {
+	return func(args *skel.CmdArgs) error {
+		conf := NetConf{}
+		json.Unmarshal(args.StdinData, &conf)
+		if conf.CalicoCompat {
+			// calico-cni keeps no journal.
+			return cmd(args)
+		}
+		logger := log.WithField("ContainerID", args.ContainerID)
+		journal := state.NewJournal(conf.StateDir)
+
+		key := state.RecordKey(args.ContainerID, args.IfName)
+		if old, err := journal.Load(key); err == nil && !ProcessAlive(old.PID) {
+			logger.WithField("op", old.Op).Warn("Cleaning up after an interrupted operation")
+			if err = CleanUpInterrupted(conf, old, logger); err != nil {
+				logger.WithError(err).Warn("Failed to clean up after an interrupted operation")
+			}
+		}
+
+		entry := &state.Entry{
+			ContainerID: args.ContainerID,
+			IfName:      args.IfName,
+			Op:          op,
+			PID:         os.Getpid(),
+			Started:     time.Now(),
+		}
+		// The names come from the shaping record of the container if it has one, so that they are right even if
+		// the naming strategy changed since it was set up. A misconfigured namer fails the command itself; the entry
+		// just goes without the names.
+		if hostVeth, ifb, err := ContainerDeviceNames(args, conf); err == nil {
+			entry.HostVeth, entry.IFB = hostVeth, ifb
+		}
+		if err := journal.Write(entry); err != nil {
+			logger.WithError(err).Warn("Failed to journal operation")
+		}
+
+		// SIGKILL can't be handled, but the entry written above already marks the operation as incomplete. For the
+		// signals that can, note which one interrupted the operation before exiting.
+		var mu sync.Mutex
+		finished := false
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+		go func() {
+			sig := <-sigs
+			mu.Lock()
+			if finished {
+				mu.Unlock()
+				return
+			}
+			entry.Interrupted = sig.String()
+			journal.Write(entry)
+			os.Exit(1)
+		}()
+
+		err := cmd(args)
+
+		mu.Lock()
+		finished = true
+		mu.Unlock()
+		signal.Stop(sigs)
+		if err := journal.Complete(key); err != nil {
+			logger.WithError(err).Warn("Failed to complete journal entry")
+		}
+		return err
+	}
+}
+
+// traced wraps a CNI command in the root span of its trace, which is exported if tracing is configured.
+func traced(op string, cmd func(*skel.CmdArgs) error) func(*skel.CmdArgs) error {
+	return func(args *skel.CmdArgs) error {
+		// Errors in the config are reported by the command itself.
+		conf := NetConf{}
+		json.Unmarshal(args.StdinData, &conf)
+
+		span := tracing.Init(conf.OTLPTracesEndpoint, "calico-cni", "cni."+op)
+		span.SetAttribute("cni.container_id", args.ContainerID)
+		span.SetAttribute("cni.ifname", args.IfName)
+		err := cmd(args)
+		span.End(err)
+		if err := tracing.Flush(); err != nil {
+			log.WithError(err).Warn("Failed to export trace")
+		}
+		return err
+	}
 }
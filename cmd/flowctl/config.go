@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/projectcalico/cni-plugin/policy"
+	"github.com/projectcalico/cni-plugin/state"
+	"github.com/projectcalico/cni-plugin/utils"
+)
+
+// defaultConfDir is where container runtimes read CNI network configurations from.
+const defaultConfDir = "/etc/cni/net.d"
+
+// pluginType is the type of the plugin in network configurations.
+const pluginType = "calico"
+
+// nodeConfig is the effective configuration of the plugin on a node: its network configuration, with the
+// defaults the plugin applies to unset options filled in, and the copy of the cluster policy the agent distributed
+// to the node.
+type nodeConfig struct {
+	ConfFile        string `json:"confFile"`
+	Network         string `json:"network"`
+	Backend         string `json:"backend"`
+	NIC             string `json:"nic,omitempty"`
+	StateDir        string `json:"stateDir"`
+	Naming          string `json:"naming"`
+	LowRatePolicy   string `json:"lowRatePolicy"`
+	LinkSpeedPolicy string `json:"linkSpeedPolicy"`
+	// Capacity is the bits per second the policy gives the node, or zero if it doesn't know it.
+	Capacity uint64 `json:"capacity"`
+	// DefaultPreset, and the rates it stands for, apply to pods without bandwidth annotations.
+	DefaultPreset    string        `json:"defaultPreset,omitempty"`
+	Defaults         *policy.Rates `json:"defaults,omitempty"`
+	ExemptNamespaces []string      `json:"exemptNamespaces"`
+
+	Plugin utils.NetConf  `json:"plugin"`
+	Policy *policy.Policy `json:"policy"`
+}
+
+func runConfig(args []string) error {
+	if len(args) == 0 || args[0] != "show" {
+		return fmt.Errorf("usage: config show [-output text|json] [-conf-dir dir] [-conf file]")
+	}
+	flagSet := flag.NewFlagSet("config show", flag.ExitOnError)
+	output := flagSet.String("output", "text", "output format: text or json")
+	confDir := flagSet.String("conf-dir", defaultConfDir, "directory of the CNI network configurations")
+	confFile := flagSet.String("conf", "", "network configuration of the plugin (the first in -conf-dir using it if unset)")
+	if err := flagSet.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *output != "text" && *output != "json" {
+		return fmt.Errorf("unknown output format %q, must be text or json", *output)
+	}
+
+	file := *confFile
+	if file == "" {
+		var err error
+		if file, err = findConfFile(*confDir); err != nil {
+			return err
+		}
+	}
+	conf, network, err := loadPluginConf(file)
+	if err != nil {
+		return err
+	}
+	c, err := effectiveConfig(file, network, conf)
+	if err != nil {
+		return err
+	}
+	if *output == "json" {
+		return printJSON(c)
+	}
+	return printConfig(c)
+}
+
+// findConfFile returns the first network configuration of dir, in the order runtimes pick them, that uses the
+// plugin.
+func findConfFile(dir string) (string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	var names []string
+	for _, f := range files {
+		switch filepath.Ext(f.Name()) {
+		case ".conf", ".conflist", ".json":
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		file := filepath.Join(dir, name)
+		if _, _, err := loadPluginConf(file); err == nil {
+			return file, nil
+		}
+	}
+	return "", fmt.Errorf("no network configuration in %s uses the %s plugin", dir, pluginType)
+}
+
+// loadPluginConf reads the configuration of the plugin from a network configuration or configuration list, and
+// returns it with the name of the network.
+func loadPluginConf(file string) (utils.NetConf, string, error) {
+	var conf utils.NetConf
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return conf, "", err
+	}
+	var list struct {
+		Name    string            `json:"name"`
+		Type    string            `json:"type"`
+		Plugins []json.RawMessage `json:"plugins"`
+	}
+	if err = json.Unmarshal(data, &list); err != nil {
+		return conf, "", fmt.Errorf("failed to parse %s: %v", file, err)
+	}
+	if list.Plugins == nil {
+		if list.Type != pluginType {
+			return conf, "", fmt.Errorf("%s doesn't use the %s plugin", file, pluginType)
+		}
+		if err = json.Unmarshal(data, &conf); err != nil {
+			return conf, "", fmt.Errorf("failed to parse %s: %v", file, err)
+		}
+		return conf, list.Name, nil
+	}
+	for _, plugin := range list.Plugins {
+		if err = json.Unmarshal(plugin, &conf); err != nil {
+			return conf, "", fmt.Errorf("failed to parse %s: %v", file, err)
+		}
+		if conf.Type == pluginType {
+			return conf, list.Name, nil
+		}
+		conf = utils.NetConf{}
+	}
+	return conf, "", fmt.Errorf("%s doesn't use the %s plugin", file, pluginType)
+}
+
+// effectiveConfig fills in the defaults of conf and the cluster policy of its state directory.
+func effectiveConfig(file, network string, conf utils.NetConf) (*nodeConfig, error) {
+	p, err := policy.Load(conf.StateDir)
+	if err != nil {
+		return nil, err
+	}
+	// host_interface stands for the nic shaping mode on it.
+	backend := conf.ShapingMode
+	if backend == "" && conf.HostInterface != "" {
+		backend = utils.ShapingModeNIC
+	}
+	c := &nodeConfig{
+		ConfFile:         file,
+		Network:          network,
+		Backend:          orDefault(backend, utils.ShapingModeVeth),
+		NIC:              orDefault(conf.NICName, conf.HostInterface),
+		StateDir:         orDefault(conf.StateDir, state.DefaultDir),
+		Naming:           orDefault(conf.Naming.Strategy, utils.NamingCalico),
+		LowRatePolicy:    orDefault(conf.LowRatePolicy, utils.LowRatePolicyAdjust),
+		LinkSpeedPolicy:  orDefault(conf.LinkSpeedPolicy, utils.LinkSpeedPolicyIgnore),
+		Capacity:         p.Capacity,
+		DefaultPreset:    p.DefaultPreset,
+		ExemptNamespaces: p.ExemptNamespaces,
+		Plugin:           conf,
+		Policy:           p,
+	}
+	if rates, ok := p.Presets[p.DefaultPreset]; ok {
+		c.Defaults = &rates
+	}
+	if c.ExemptNamespaces == nil {
+		c.ExemptNamespaces = []string{}
+	}
+	return c, nil
+}
+
+func orDefault(value, def string) string {
+	if value == "" {
+		return def
+	}
+	return value
+}
+
+// printConfig prints the summary fields of c, leaving the full plugin configuration and policy to the JSON output.
+func printConfig(c *nodeConfig) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	row := func(key string, value interface{}) { fmt.Fprintf(w, "%s:\t%v\n", key, value) }
+	row("Configuration", c.ConfFile)
+	row("Network", c.Network)
+	row("Backend", c.Backend)
+	if c.NIC != "" {
+		row("NIC", c.NIC)
+	}
+	row("State directory", c.StateDir)
+	row("Naming", c.Naming)
+	row("Low rate policy", c.LowRatePolicy)
+	row("Link speed policy", c.LinkSpeedPolicy)
+	if c.Capacity != 0 {
+		row("Capacity", fmt.Sprintf("%d bit/s", c.Capacity))
+	} else {
+		row("Capacity", "unknown")
+	}
+	if c.Defaults != nil {
+		row("Defaults", fmt.Sprintf("%s (ingress %d bit/s, egress %d bit/s)", c.DefaultPreset, c.Defaults.Ingress,
+			c.Defaults.Egress))
+	} else {
+		row("Defaults", "none")
+	}
+	row("Exempt namespaces", strings.Join(c.ExemptNamespaces, ","))
+	return w.Flush()
+}
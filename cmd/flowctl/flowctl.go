@@ -0,0 +1,611 @@
+// flowctl is the operator CLI for the flow control plugin. It runs the node agent and talks to it.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/cni-plugin/agent"
+	"github.com/projectcalico/cni-plugin/aggregator"
+	"github.com/projectcalico/cni-plugin/classify"
+	"github.com/projectcalico/cni-plugin/logging"
+	"github.com/projectcalico/cni-plugin/metrics"
+	"github.com/projectcalico/cni-plugin/policy"
+	"github.com/projectcalico/cni-plugin/simulate"
+	"github.com/projectcalico/cni-plugin/state"
+	"github.com/projectcalico/cni-plugin/utils"
+)
+
+// VERSION is filled out during the build process (using git describe output)
+var VERSION string
+
+// command is a flowctl subcommand. run is passed the arguments following the subcommand name.
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"agent":        {"run the node agent", runAgent},
+	"aggregator":   {"run the cluster aggregator scraping every node agent", runAggregator},
+	"apply-policy": {"apply the current cluster policy to the pods of a preset: apply-policy <preset>", runApplyPolicy},
+	"audit":        {"query the audit log of shaping changes: audit [-pod <pod>] [-trigger api] [-since 24h] [-limit 100]", runAudit},
+	"backends":     {"show the features each shaping backend supports on this node", runBackends},
+	"capture":      {"capture packets of a pod as pcap: capture [-duration 30s] [-filter \"port 443\"] [-o file] <pod>", runCapture},
+	"classify":     {"show how a packet of a pod would be shaped: classify -pod <pod> -proto tcp -dport 443 -dst 8.8.8.8", runClassify},
+	"config":       {"show the effective configuration of the node: config show [-output json]", runConfig},
+	"events":       {"list recent shaping events", runEvents},
+	"genconf":      {"generate a CNI conflist for the plugin", runGenconf},
+	"get":          {"show the shaping and reconcile status of a pod: get <pod>", runGet},
+	"inspect":      {"attribute the classes on an uplink to pods: inspect -nic eth0", runInspect},
+	"maintenance":  {"relax the limits of every pod of the node for a while: maintenance on [-ttl 1h] [-reason drain] | off | status", runMaintenance},
+	"pause":        {"pause shaping of a pod: pause [-ttl 10m] <pod>", runPause},
+	"reshape":      {"rebuild shaping of a pod with new settings: reshape [-latency-class low] [-non-ip-policy drop] <pod>", runReshape},
+	"resize":       {"change the rates of a pod without restarting it: resize [-ingress 10M] [-egress 10M] <pod>", runResize},
+	"resume":       {"resume shaping of a paused pod: resume <pod>", runResume},
+	"selftest":     {"verify the node enforces rates on a scratch pod: selftest [-rate 10M] [-duration 5s]", runSelfTest},
+	"status":       {"show the tc state shaping a pod, with its counters: status [-o json] <pod>", runStatus},
+	"simulate":     {"estimate the rates pods settle at on an uplink: simulate -pods pods.json -capacity 10G [-hierarchy h.json] [-policy p.json]", runSimulate},
+	"throttle":     {"temporarily limit a pod below its rates: throttle [-ingress 1M] [-egress 1M] [-ttl 10m] <pod>", runThrottle},
+	"unthrottle":   {"restore the rates of a throttled pod: unthrottle <pod>", runUnthrottle},
+	"version":      {"display the version", func([]string) error { fmt.Println(VERSION); return nil }},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(1)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(1)
+	}
+	if err := cmd.run(os.Args[2:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [options]\n\nCommands:\n", os.Args[0])
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].usage)
+	}
+}
+
+func runAgent(args []string) error {
+	flagSet := flag.NewFlagSet("agent", flag.ExitOnError)
+	socket := flagSet.String("socket", agent.DefaultSocketPath, "path of the agent API socket")
+	stateDir := flagSet.String("state-dir", "", "directory of the plugin's shaping state")
+	lineRate := flagSet.Uint64("line-rate", agent.DefaultLineRate, "rate in bits/s applied to paused pods")
+	pauseTTL := flagSet.Duration("pause-ttl", agent.DefaultPauseTTL, "default time before a paused pod is resumed")
+	maintenanceTTL := flagSet.Duration("maintenance-ttl", agent.DefaultMaintenanceTTL, "default time before maintenance of the node ends")
+	gcInterval := flagSet.Duration("gc-interval", agent.DefaultGCInterval, "interval between prunes of stale shaping state")
+	counterInterval := flagSet.Duration("counter-interval", agent.DefaultCounterInterval, "interval between checkpoints of pod traffic counters")
+	saturationWindow := flagSet.Duration("saturation-window", agent.DefaultSaturationWindow, "time a pod must use its whole limit with drops to be reported saturated")
+	saturationAnnotation := flagSet.Bool("saturation-annotation", false, "publish the saturated directions of pods as the flowcontrol.cni/bandwidth-saturated annotation")
+	reconcileRate := flagSet.Float64("reconcile-rate", agent.DefaultReconcileRate, "pods per second whose classes may be updated by policy changes and repairs")
+	metricsBackend := flagSet.String("metrics-backend", metrics.BackendPrometheus, "metrics backend: prometheus, statsd or otlp")
+	metricsAddr := flagSet.String("metrics-addr", "", "address to serve metrics on (e.g. :9650) or push them to "+
+		"(e.g. 127.0.0.1:8125 for statsd, http://127.0.0.1:4318/v1/metrics for otlp)")
+	autoRepair := flagSet.Bool("auto-repair", false, "rebuild shaping when managed interfaces or tc state are removed")
+	reconcileInterval := flagSet.Duration("reconcile-interval", 0, "interval between checks of the shaping of every pod, rebuilding what is missing, e.g. after a reboot or tc flush (0 to disable)")
+	nodeName := flagSet.String("node-name", "", "Kubernetes node name; enables handling of hostNetwork pods")
+	kubeconfig := flagSet.String("kubeconfig", "", "path to a kubeconfig (in-cluster configuration if unset)")
+	hostNetworkNIC := flagSet.String("host-network-nic", "", "uplink to shape hostNetwork pod egress on by cgroup")
+	policyConfigMap := flagSet.String("policy-configmap", agent.DefaultPolicyConfigMap, "namespace/name of the cluster policy ConfigMap")
+	discoverCapacity := flagSet.Bool("discover-capacity", false, "find the node capacity from cloud provider metadata")
+	listenAddr := flagSet.String("listen", "", "TCP address to also serve the read-only API on, for the aggregator (e.g. :9652)")
+	ipfixCollector := flagSet.String("ipfix-collector", "", "UDP address of an IPFIX collector to export pod flows to (e.g. 10.0.0.1:4739)")
+	ipfixInterval := flagSet.Duration("ipfix-interval", agent.DefaultIPFIXInterval, "interval between exports of pod flows to the IPFIX collector")
+	webhookAddr := flagSet.String("webhook-listen", "", "TCP address to serve the throttle webhook on (e.g. :9653)")
+	webhookTokenFile := flagSet.String("webhook-token-file", "", "file holding the bearer token webhook requests must bear")
+	tenantAddr := flagSet.String("tenant-listen", "", "TCP address to serve the tenant API on over TLS (e.g. :9654)")
+	tenantCert := flagSet.String("tenant-cert", "", "certificate of the tenant API")
+	tenantKey := flagSet.String("tenant-key", "", "key of the tenant API certificate")
+	tenantClientCA := flagSet.String("tenant-client-ca", "", "CA signing the client certificates of tenants; the organizations of their subject are their namespaces")
+	tenantAudience := flagSet.String("tenant-audience", agent.DefaultTenantAudience, "audience the service account tokens of tenants must be bound to")
+	logLevel := flagSet.String("log-level", "info", "log level")
+	slowNetlink := flagSet.Duration("slow-netlink-threshold", utils.DefaultSlowNetlinkThreshold, "duration after which netlink operations are logged and counted as slow (0 to disable)")
+	logLevels := flagSet.String("log-levels", "", "per-subsystem log levels overriding -log-level, e.g. tc=debug,agent=warn")
+	if err := flagSet.Parse(args); err != nil {
+		return err
+	}
+	level, err := log.ParseLevel(*logLevel)
+	if err != nil {
+		return err
+	}
+	log.SetLevel(level)
+	levels, err := logging.ParseLevels(*logLevels)
+	if err != nil {
+		return err
+	}
+	if err := logging.Configure(level, levels); err != nil {
+		return err
+	}
+	utils.SetSlowNetlinkThreshold(*slowNetlink)
+	var webhookToken string
+	if *webhookTokenFile != "" {
+		data, err := ioutil.ReadFile(*webhookTokenFile)
+		if err != nil {
+			return fmt.Errorf("failed to read webhook token: %v", err)
+		}
+		webhookToken = strings.TrimSpace(string(data))
+	}
+
+	return agent.New(agent.Config{
+		SocketPath:      *socket,
+		StateDir:        *stateDir,
+		LineRate:        *lineRate,
+		PauseTTL:        *pauseTTL,
+		MaintenanceTTL:  *maintenanceTTL,
+		GCInterval:      *gcInterval,
+		CounterInterval: *counterInterval,
+		ReconcileRate:   *reconcileRate,
+		MetricsBackend:  *metricsBackend,
+		MetricsAddr:     *metricsAddr,
+		AutoRepair:      *autoRepair,
+
+		ReconcileInterval: *reconcileInterval,
+
+		SaturationWindow:     *saturationWindow,
+		SaturationAnnotation: *saturationAnnotation,
+
+		NodeName:       *nodeName,
+		Kubeconfig:     *kubeconfig,
+		HostNetworkNIC: *hostNetworkNIC,
+
+		PolicyConfigMap:  *policyConfigMap,
+		DiscoverCapacity: *discoverCapacity,
+
+		ListenAddr: *listenAddr,
+
+		IPFIXCollector: *ipfixCollector,
+		IPFIXInterval:  *ipfixInterval,
+
+		WebhookAddr:  *webhookAddr,
+		WebhookToken: webhookToken,
+
+		TenantAddr:         *tenantAddr,
+		TenantCertFile:     *tenantCert,
+		TenantKeyFile:      *tenantKey,
+		TenantClientCAFile: *tenantClientCA,
+		TenantAudience:     *tenantAudience,
+	}).Run()
+}
+
+func runAggregator(args []string) error {
+	flagSet := flag.NewFlagSet("aggregator", flag.ExitOnError)
+	kubeconfig := flagSet.String("kubeconfig", "", "path to a kubeconfig (in-cluster configuration if unset)")
+	agentPort := flagSet.Int("agent-port", aggregator.DefaultAgentPort, "port node agents serve their read-only API on")
+	listenAddr := flagSet.String("listen", aggregator.DefaultListenAddr, "address to serve the summary and metrics on")
+	interval := flagSet.Duration("interval", aggregator.DefaultInterval, "interval between scrapes of the node agents")
+	logLevel := flagSet.String("log-level", "info", "log level")
+	if err := flagSet.Parse(args); err != nil {
+		return err
+	}
+	level, err := log.ParseLevel(*logLevel)
+	if err != nil {
+		return err
+	}
+	log.SetLevel(level)
+
+	return aggregator.New(aggregator.Config{
+		Kubeconfig: *kubeconfig,
+		AgentPort:  *agentPort,
+		ListenAddr: *listenAddr,
+		Interval:   *interval,
+	}).Run()
+}
+
+func runGet(args []string) error {
+	flagSet := flag.NewFlagSet("get", flag.ExitOnError)
+	socket := flagSet.String("socket", agent.DefaultSocketPath, "path of the agent API socket")
+	if err := flagSet.Parse(args); err != nil {
+		return err
+	}
+	if flagSet.NArg() != 1 {
+		return fmt.Errorf("usage: get <container ID or workload>")
+	}
+	p, err := agent.NewClient(*socket).ShapedPod(flagSet.Arg(0))
+	if err != nil {
+		return err
+	}
+	return printJSON(p)
+}
+
+func runPause(args []string) error {
+	flagSet := flag.NewFlagSet("pause", flag.ExitOnError)
+	socket := flagSet.String("socket", agent.DefaultSocketPath, "path of the agent API socket")
+	ttl := flagSet.Duration("ttl", 0, "time before shaping is automatically resumed (agent default if unset)")
+	if err := flagSet.Parse(args); err != nil {
+		return err
+	}
+	if flagSet.NArg() != 1 {
+		return fmt.Errorf("usage: pause [-ttl 10m] <container ID or workload>")
+	}
+	r, err := agent.NewClient(*socket).Pause(flagSet.Arg(0), *ttl)
+	if err != nil {
+		return err
+	}
+	return printJSON(r)
+}
+
+func runResume(args []string) error {
+	flagSet := flag.NewFlagSet("resume", flag.ExitOnError)
+	socket := flagSet.String("socket", agent.DefaultSocketPath, "path of the agent API socket")
+	if err := flagSet.Parse(args); err != nil {
+		return err
+	}
+	if flagSet.NArg() != 1 {
+		return fmt.Errorf("usage: resume <container ID or workload>")
+	}
+	r, err := agent.NewClient(*socket).Resume(flagSet.Arg(0))
+	if err != nil {
+		return err
+	}
+	return printJSON(r)
+}
+
+func runCapture(args []string) error {
+	flagSet := flag.NewFlagSet("capture", flag.ExitOnError)
+	socket := flagSet.String("socket", agent.DefaultSocketPath, "path of the agent API socket")
+	duration := flagSet.Duration("duration", agent.DefaultCaptureDuration, "how long to capture for")
+	filter := flagSet.String("filter", "", "pcap filter expression selecting the packets, e.g. \"port 443\"")
+	output := flagSet.String("o", "-", "file the pcap is written to, or - for stdout")
+	if err := flagSet.Parse(args); err != nil {
+		return err
+	}
+	if flagSet.NArg() != 1 {
+		return fmt.Errorf("usage: capture [-duration 30s] [-filter \"port 443\"] [-o file] <container ID or workload>")
+	}
+	w := os.Stdout
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	return agent.NewClient(*socket).Capture(flagSet.Arg(0), *filter, *duration, w)
+}
+
+func runThrottle(args []string) error {
+	flagSet := flag.NewFlagSet("throttle", flag.ExitOnError)
+	socket := flagSet.String("socket", agent.DefaultSocketPath, "path of the agent API socket")
+	ingress := flagSet.String("ingress", "", "ingress rate of the throttle, e.g. 1M (unchanged if unset)")
+	egress := flagSet.String("egress", "", "egress rate of the throttle, e.g. 1M (unchanged if unset)")
+	ttl := flagSet.Duration("ttl", 0, "time before the throttle is automatically lifted (never if unset)")
+	reason := flagSet.String("reason", "", "why the pod is throttled, recorded with the throttle")
+	if err := flagSet.Parse(args); err != nil {
+		return err
+	}
+	if flagSet.NArg() != 1 || (*ingress == "" && *egress == "") {
+		return fmt.Errorf("usage: throttle [-ingress 1M] [-egress 1M] [-ttl 10m] <container ID or workload>")
+	}
+	var ingressRate, egressRate uint64
+	var err error
+	if *ingress != "" {
+		if ingressRate, err = policy.ParseRate(*ingress); err != nil {
+			return err
+		}
+	}
+	if *egress != "" {
+		if egressRate, err = policy.ParseRate(*egress); err != nil {
+			return err
+		}
+	}
+	r, err := agent.NewClient(*socket).Throttle(flagSet.Arg(0), ingressRate, egressRate, *ttl, *reason)
+	if err != nil {
+		return err
+	}
+	return printJSON(r)
+}
+
+func runResize(args []string) error {
+	flagSet := flag.NewFlagSet("resize", flag.ExitOnError)
+	socket := flagSet.String("socket", agent.DefaultSocketPath, "path of the agent API socket")
+	ingress := flagSet.String("ingress", "", "new ingress rate, e.g. 10M (unchanged if unset)")
+	egress := flagSet.String("egress", "", "new egress rate, e.g. 10M (unchanged if unset)")
+	if err := flagSet.Parse(args); err != nil {
+		return err
+	}
+	if flagSet.NArg() != 1 || (*ingress == "" && *egress == "") {
+		return fmt.Errorf("usage: resize [-ingress 10M] [-egress 10M] <container ID or workload>")
+	}
+	var ingressRate, egressRate uint64
+	var err error
+	if *ingress != "" {
+		if ingressRate, err = policy.ParseRate(*ingress); err != nil {
+			return err
+		}
+	}
+	if *egress != "" {
+		if egressRate, err = policy.ParseRate(*egress); err != nil {
+			return err
+		}
+	}
+	r, err := agent.NewClient(*socket).Resize(flagSet.Arg(0), ingressRate, egressRate)
+	if err != nil {
+		return err
+	}
+	return printJSON(r)
+}
+
+func runUnthrottle(args []string) error {
+	flagSet := flag.NewFlagSet("unthrottle", flag.ExitOnError)
+	socket := flagSet.String("socket", agent.DefaultSocketPath, "path of the agent API socket")
+	if err := flagSet.Parse(args); err != nil {
+		return err
+	}
+	if flagSet.NArg() != 1 {
+		return fmt.Errorf("usage: unthrottle <container ID or workload>")
+	}
+	r, err := agent.NewClient(*socket).Unthrottle(flagSet.Arg(0))
+	if err != nil {
+		return err
+	}
+	return printJSON(r)
+}
+
+func runReshape(args []string) error {
+	flagSet := flag.NewFlagSet("reshape", flag.ExitOnError)
+	socket := flagSet.String("socket", agent.DefaultSocketPath, "path of the agent API socket")
+	latencyClass := flagSet.String("latency-class", "", "latency class of the pod: low, or empty for none")
+	nonIPPolicy := flagSet.String("non-ip-policy", "", "handling of non-IP traffic: unshaped, shaped or drop")
+	if err := flagSet.Parse(args); err != nil {
+		return err
+	}
+	if flagSet.NArg() != 1 {
+		return fmt.Errorf("usage: reshape [-latency-class low] [-non-ip-policy drop] <container ID or workload>")
+	}
+	r, err := agent.NewClient(*socket).Reshape(flagSet.Arg(0), *latencyClass, *nonIPPolicy)
+	if err != nil {
+		return err
+	}
+	return printJSON(r)
+}
+
+func runApplyPolicy(args []string) error {
+	flagSet := flag.NewFlagSet("apply-policy", flag.ExitOnError)
+	socket := flagSet.String("socket", agent.DefaultSocketPath, "path of the agent API socket")
+	if err := flagSet.Parse(args); err != nil {
+		return err
+	}
+	if flagSet.NArg() != 1 {
+		return fmt.Errorf("usage: apply-policy <preset>")
+	}
+	result, err := agent.NewClient(*socket).ApplyPolicy(flagSet.Arg(0))
+	if err != nil {
+		return err
+	}
+	return printJSON(result)
+}
+
+func runMaintenance(args []string) error {
+	flagSet := flag.NewFlagSet("maintenance", flag.ExitOnError)
+	socket := flagSet.String("socket", agent.DefaultSocketPath, "path of the agent API socket")
+	ttl := flagSet.Duration("ttl", 0, "time before maintenance automatically ends (agent default if unset)")
+	reason := flagSet.String("reason", "", "why the node is in maintenance, recorded with it")
+	usage := fmt.Errorf("usage: maintenance on [-ttl 1h] [-reason drain] | off | status")
+	if len(args) == 0 {
+		return usage
+	}
+	action := args[0]
+	if err := flagSet.Parse(args[1:]); err != nil {
+		return err
+	}
+	if flagSet.NArg() != 0 {
+		return usage
+	}
+	client := agent.NewClient(*socket)
+	var status *agent.MaintenanceStatus
+	var err error
+	switch action {
+	case "on":
+		status, err = client.StartMaintenance(*ttl, *reason)
+	case "off":
+		status, err = client.EndMaintenance()
+	case "status":
+		status, err = client.Maintenance()
+	default:
+		return usage
+	}
+	if err != nil {
+		return err
+	}
+	return printJSON(status)
+}
+
+func runEvents(args []string) error {
+	flagSet := flag.NewFlagSet("events", flag.ExitOnError)
+	socket := flagSet.String("socket", agent.DefaultSocketPath, "path of the agent API socket")
+	if err := flagSet.Parse(args); err != nil {
+		return err
+	}
+	events, err := agent.NewClient(*socket).Events()
+	if err != nil {
+		return err
+	}
+	return printJSON(events)
+}
+
+func runInspect(args []string) error {
+	flagSet := flag.NewFlagSet("inspect", flag.ExitOnError)
+	nic := flagSet.String("nic", "", "uplink whose shared shaping hierarchy to inspect")
+	stateDir := flagSet.String("state-dir", "", "directory of the plugin's shaping state")
+	if err := flagSet.Parse(args); err != nil {
+		return err
+	}
+	if *nic == "" || flagSet.NArg() != 0 {
+		return fmt.Errorf("usage: inspect -nic <uplink>")
+	}
+	classes, err := utils.InspectNIC(state.NewStore(*stateDir), *nic)
+	if err != nil {
+		return err
+	}
+	return printJSON(classes)
+}
+
+func runSimulate(args []string) error {
+	flagSet := flag.NewFlagSet("simulate", flag.ExitOnError)
+	podsFile := flagSet.String("pods", "", "JSON list of the pods on the node, with their limits and demand")
+	capacity := flagSet.String("capacity", "", "speed of the uplink, e.g. 10G (the rate of the hierarchy if unset)")
+	hierarchyFile := flagSet.String("hierarchy", "", "JSON nicHierarchy of the node, if any")
+	policyFile := flagSet.String("policy", "", "cluster policy document giving pods without limits those of their preset")
+	if err := flagSet.Parse(args); err != nil {
+		return err
+	}
+	if *podsFile == "" || flagSet.NArg() != 0 {
+		return fmt.Errorf("usage: simulate -pods pods.json -capacity 10G [-hierarchy h.json] [-policy p.json]")
+	}
+	var pods []simulate.Pod
+	if err := readJSON(*podsFile, &pods); err != nil {
+		return err
+	}
+	node := simulate.Node{}
+	var err error
+	if *capacity != "" {
+		if node.Capacity, err = policy.ParseRate(*capacity); err != nil {
+			return err
+		}
+	}
+	if *hierarchyFile != "" {
+		node.Hierarchy = &utils.NICHierarchy{}
+		if err = readJSON(*hierarchyFile, node.Hierarchy); err != nil {
+			return err
+		}
+	}
+	if *policyFile != "" {
+		data, err := ioutil.ReadFile(*policyFile)
+		if err != nil {
+			return err
+		}
+		p, err := policy.Parse(data)
+		if err != nil {
+			return err
+		}
+		if pods, err = simulate.WithPolicy(p, pods); err != nil {
+			return err
+		}
+	}
+	result, err := simulate.Run(node, pods)
+	if err != nil {
+		return err
+	}
+	return printJSON(result)
+}
+
+// readJSON decodes the JSON file at path into v.
+func readJSON(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return nil
+}
+
+func runAudit(args []string) error {
+	flagSet := flag.NewFlagSet("audit", flag.ExitOnError)
+	pod := flagSet.String("pod", "", "container ID or workload whose changes to show (all if unset)")
+	trigger := flagSet.String("trigger", "", "show only changes made by this trigger: cni-add, cni-del, api, policy, annotation, reconcile, gc or expiry")
+	since := flagSet.Duration("since", 0, "show only changes made within this duration (all if unset)")
+	limit := flagSet.Int("limit", 0, "show only the last changes, up to this number (all if unset)")
+	stateDir := flagSet.String("state-dir", "", "directory of the plugin's shaping state")
+	if err := flagSet.Parse(args); err != nil {
+		return err
+	}
+	if flagSet.NArg() != 0 {
+		return fmt.Errorf("usage: audit [-pod <container ID or workload>] [-trigger api] [-since 24h] [-limit 100]")
+	}
+	q := state.AuditQuery{ID: *pod, Trigger: *trigger, Limit: *limit}
+	if *since > 0 {
+		q.Since = time.Now().Add(-*since)
+	}
+	entries, err := state.NewAuditLog(*stateDir).Query(q)
+	if err != nil {
+		return err
+	}
+	return printJSON(entries)
+}
+
+func runBackends(args []string) error {
+	flagSet := flag.NewFlagSet("backends", flag.ExitOnError)
+	stateDir := flagSet.String("state-dir", "", "directory of the plugin's shaping state")
+	if err := flagSet.Parse(args); err != nil {
+		return err
+	}
+	matrix, err := utils.GetBackendCapabilities(state.NewStore(*stateDir), log.NewEntry(log.StandardLogger()))
+	if err != nil {
+		return err
+	}
+	return printJSON(matrix)
+}
+
+func runClassify(args []string) error {
+	flagSet := flag.NewFlagSet("classify", flag.ExitOnError)
+	pod := flagSet.String("pod", "", "container ID or workload of the pod")
+	direction := flagSet.String("direction", "egress", "direction of the packet from the point of view of the pod: ingress or egress")
+	proto := flagSet.String("proto", classify.ProtoTCP, "protocol: tcp, udp, icmp, ipv6-icmp or arp")
+	src := flagSet.String("src", "", "source address (the pod's for egress if unset)")
+	dst := flagSet.String("dst", "", "destination address (the pod's for ingress if unset)")
+	sport := flagSet.Uint("sport", 0, "source port")
+	dport := flagSet.Uint("dport", 0, "destination port")
+	stateDir := flagSet.String("state-dir", "", "directory of the plugin's shaping state")
+	if err := flagSet.Parse(args); err != nil {
+		return err
+	}
+	if *pod == "" || flagSet.NArg() != 0 {
+		return fmt.Errorf("usage: classify -pod <container ID or workload> [-direction ingress] [-proto tcp] [-src IP] [-dst IP] [-sport N] [-dport N]")
+	}
+	if *sport > 0xffff || *dport > 0xffff {
+		return fmt.Errorf("ports must be below 65536")
+	}
+	p := classify.Packet{Proto: *proto, SrcPort: uint16(*sport), DstPort: uint16(*dport)}
+	for _, addr := range []struct {
+		flag  string
+		value string
+		ip    *net.IP
+	}{{"src", *src, &p.Src}, {"dst", *dst, &p.Dst}} {
+		if addr.value == "" {
+			continue
+		}
+		if *addr.ip = net.ParseIP(addr.value); *addr.ip == nil {
+			return fmt.Errorf("invalid -%s address %q", addr.flag, addr.value)
+		}
+	}
+
+	r, err := state.NewStore(*stateDir).Find(*pod)
+	if err != nil {
+		return err
+	}
+	c, err := utils.ClassifyPacket(r, *direction, p)
+	if err != nil {
+		return err
+	}
+	return printJSON(c)
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/projectcalico/cni-plugin/agent"
+	"github.com/projectcalico/cni-plugin/policy"
+	"github.com/projectcalico/cni-plugin/utils"
+)
+
+// conflist is the CNI network configuration list format read by the container runtime.
+type conflist struct {
+	CNIVersion string                   `json:"cniVersion"`
+	Name       string                   `json:"name"`
+	Plugins    []map[string]interface{} `json:"plugins"`
+}
+
+func runGenconf(args []string) error {
+	flagSet := flag.NewFlagSet("genconf", flag.ExitOnError)
+	name := flagSet.String("name", "k8s-pod-network", "network name")
+	cniVersion := flagSet.String("cni-version", "0.3.1", "CNI spec version of the conflist")
+	chainAfter := flagSet.String("chain-after", "", "type of the plugin to chain after, or empty for a standalone conflist")
+	hostRoutes := flagSet.Bool("host-routes", true, "program routes to pod addresses on the host (disable if another plugin or BGP does)")
+	manageSysctls := flagSet.Bool("manage-sysctls", true, "configure the sysctls of host veths (disable if another plugin owns connectivity)")
+	backend := flagSet.String("backend", utils.ShapingModeVeth, "where pods are shaped: veth, nic, or nftables to police rather than shape")
+	nic := flagSet.String("nic", "", "uplink for the nic backend (the default route's interface if unset)")
+	ipam := flagSet.String("ipam", "calico-ipam", "IPAM plugin type")
+	etcdEndpoints := flagSet.String("etcd-endpoints", "http://127.0.0.1:2379", "etcd endpoints")
+	kubeconfig := flagSet.String("kubeconfig", "", "kubeconfig the plugin uses to read pod annotations")
+	stateDir := flagSet.String("state-dir", "", "directory of the plugin's shaping state")
+	lowRatePolicy := flagSet.String("low-rate-policy", "", "adjust, reject or police rates too low for HTB to enforce")
+	linkSpeedPolicy := flagSet.String("link-speed-policy", "", "ignore, clamp or reject rates above the speed of the uplink")
+	policeThreshold := flagSet.Uint64("police-threshold", 0, "bits/s below which the police low rate policy polices rates (the HTB minimum if 0)")
+	latencyClass := flagSet.String("latency-class", "", "default latency class")
+	familyBudget := flagSet.String("ip-family-budget", "", "shared (default) or separate limits for the IPv4 and IPv6 traffic of a pod")
+	naming := flagSet.String("naming", "", "how host veths and IFB devices are named: calico (default), prefix, hash or sequential")
+	vethPrefix := flagSet.String("veth-prefix", "", "host veth name prefix of the non-calico naming strategies (Felix must use the same)")
+	ifbPrefix := flagSet.String("ifb-prefix", "", "IFB device name prefix of the non-calico naming strategies")
+	defaultIngress := flagSet.Uint64("default-ingress", 0, "ingress limit in bits/s of pods without annotations")
+	defaultEgress := flagSet.Uint64("default-egress", 0, "egress limit in bits/s of pods without annotations")
+	exempt := flagSet.String("exempt-namespaces", "", "comma-separated namespaces that are never shaped")
+	dnsRateLimit := flagSet.Uint64("dns-rate-limit", 0, "packets/s the DNS queries of pods without annotations are policed to")
+	icmpRateLimit := flagSet.Uint64("icmp-rate-limit", 0, "packets/s the ICMP of pods without annotations is policed to")
+	icmpv6RateLimit := flagSet.Uint64("icmpv6-rate-limit", 0, "packets/s the ICMPv6 of pods without annotations is policed to")
+	policyOut := flagSet.String("policy-out", "", "file to write the policy ConfigMap for defaults and exemptions to")
+	if err := flagSet.Parse(args); err != nil {
+		return err
+	}
+
+	switch *backend {
+	case utils.ShapingModeVeth, utils.ShapingModeNIC, utils.ShapingModeNFTables:
+	default:
+		return fmt.Errorf("unknown backend %q, must be %s, %s or %s", *backend, utils.ShapingModeVeth, utils.ShapingModeNIC,
+			utils.ShapingModeNFTables)
+	}
+	if *nic != "" && *backend != utils.ShapingModeNIC {
+		return fmt.Errorf("-nic requires the %s backend", utils.ShapingModeNIC)
+	}
+	switch *lowRatePolicy {
+	case "", utils.LowRatePolicyAdjust, utils.LowRatePolicyReject, utils.LowRatePolicyPolice:
+	default:
+		return fmt.Errorf("unknown low rate policy %q", *lowRatePolicy)
+	}
+	switch *linkSpeedPolicy {
+	case "", utils.LinkSpeedPolicyIgnore, utils.LinkSpeedPolicyClamp, utils.LinkSpeedPolicyReject:
+	default:
+		return fmt.Errorf("unknown link speed policy %q", *linkSpeedPolicy)
+	}
+	if *policeThreshold != 0 && *lowRatePolicy != utils.LowRatePolicyPolice {
+		return fmt.Errorf("-police-threshold requires the %s low rate policy", utils.LowRatePolicyPolice)
+	}
+	if *latencyClass != "" && *latencyClass != utils.LatencyClassLow {
+		return fmt.Errorf("unknown latency class %q", *latencyClass)
+	}
+	switch *familyBudget {
+	case "", utils.IPFamilyBudgetShared:
+	case utils.IPFamilyBudgetSeparate:
+		if *backend != utils.ShapingModeVeth {
+			return fmt.Errorf("the %s backend only supports shared IP family budgets", *backend)
+		}
+	default:
+		return fmt.Errorf("unknown IP family budget %q", *familyBudget)
+	}
+
+	namingConf := utils.NamingConf{Strategy: *naming, VethPrefix: *vethPrefix, IFBPrefix: *ifbPrefix}
+	if _, err := utils.NewNamer(utils.NetConf{Naming: namingConf}); err != nil {
+		return err
+	}
+
+	plugin := map[string]interface{}{
+		"type":           "calico",
+		"etcd_endpoints": *etcdEndpoints,
+		"ipam":           map[string]interface{}{"type": *ipam},
+	}
+	if *ipam == "host-local" {
+		plugin["ipam"] = map[string]interface{}{"type": *ipam, "subnet": "usePodCidr"}
+	}
+	if *kubeconfig != "" {
+		plugin["kubernetes"] = map[string]interface{}{"kubeconfig": *kubeconfig}
+		plugin["policy"] = map[string]interface{}{"type": "k8s"}
+	}
+	for key, value := range map[string]string{
+		"state_dir":       *stateDir,
+		"lowRatePolicy":   *lowRatePolicy,
+		"linkSpeedPolicy": *linkSpeedPolicy,
+		"latencyClass":    *latencyClass,
+		"ipFamilyBudget":  *familyBudget,
+		"nicName":         *nic,
+	} {
+		if value != "" {
+			plugin[key] = value
+		}
+	}
+	if *backend != utils.ShapingModeVeth {
+		plugin["shapingMode"] = *backend
+	}
+	if !*hostRoutes {
+		plugin["programHostRoutes"] = false
+	}
+	if !*manageSysctls {
+		plugin["manageSysctls"] = false
+	}
+	if *policeThreshold != 0 {
+		plugin["policeThreshold"] = *policeThreshold
+	}
+	if namingConf != (utils.NamingConf{}) {
+		plugin["naming"] = namingConf
+	}
+
+	// Catch anything the plugin itself would fail to parse.
+	data, err := json.Marshal(plugin)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(data, &utils.NetConf{}); err != nil {
+		return fmt.Errorf("generated an invalid plugin configuration: %v", err)
+	}
+
+	list := conflist{CNIVersion: *cniVersion, Name: *name}
+	if *chainAfter != "" {
+		list.Plugins = append(list.Plugins, map[string]interface{}{"type": *chainAfter})
+	}
+	list.Plugins = append(list.Plugins, plugin)
+
+	// Defaults and exemptions are cluster-wide, so they go in the policy ConfigMap rather than the conflist.
+	limits := packetLimits{dns: *dnsRateLimit, icmp: *icmpRateLimit, icmpv6: *icmpv6RateLimit}
+	if *defaultIngress != 0 || *defaultEgress != 0 || *exempt != "" || limits != (packetLimits{}) {
+		if *policyOut == "" {
+			return fmt.Errorf("defaults and exemptions are written to the policy ConfigMap, set -policy-out")
+		}
+		if err = writePolicyConfigMap(*policyOut, *defaultIngress, *defaultEgress, *exempt, limits); err != nil {
+			return err
+		}
+	}
+	return printJSON(list)
+}
+
+// packetLimits are the default packet rate limits of pods, in packets per second.
+type packetLimits struct {
+	dns, icmp, icmpv6 uint64
+}
+
+// writePolicyConfigMap writes a ConfigMap manifest holding a policy with the given defaults and exemptions.
+func writePolicyConfigMap(file string, ingress, egress uint64, exempt string, limits packetLimits) error {
+	p := &policy.Policy{DNSRateLimit: limits.dns, ICMPRateLimit: limits.icmp, ICMPv6RateLimit: limits.icmpv6}
+	if ingress != 0 || egress != 0 {
+		p.Presets = map[string]policy.Rates{"default": {Ingress: ingress, Egress: egress}}
+		p.DefaultPreset = "default"
+	}
+	if exempt != "" {
+		p.ExemptNamespaces = strings.Split(exempt, ",")
+	}
+	doc, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	parts := strings.SplitN(agent.DefaultPolicyConfigMap, "/", 2)
+	manifest := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata":   map[string]string{"namespace": parts[0], "name": parts[1]},
+		"data":       map[string]string{policy.ConfigMapKey: string(doc)},
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, append(data, '\n'), 0644)
+}
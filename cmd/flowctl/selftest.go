@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/projectcalico/cni-plugin/policy"
+	"github.com/projectcalico/cni-plugin/utils"
+)
+
+func runSelfTest(args []string) error {
+	flagSet := flag.NewFlagSet("selftest", flag.ExitOnError)
+	rate := flagSet.String("rate", "10M", "rate to shape the scratch pod to in both directions")
+	duration := flagSet.Duration("duration", 5*time.Second, "how long to send traffic in each direction")
+	output := flagSet.String("output", "text", "output format: text or json")
+	if err := flagSet.Parse(args); err != nil {
+		return err
+	}
+	if *output != "text" && *output != "json" {
+		return fmt.Errorf("unknown output format %q, must be text or json", *output)
+	}
+	bps, err := policy.ParseRate(*rate)
+	if err != nil {
+		return err
+	}
+	if bps == 0 {
+		return fmt.Errorf("the rate of the self-test must be positive")
+	}
+
+	results, err := utils.SelfTest(bps, *duration)
+	if err != nil {
+		return err
+	}
+	if *output == "json" {
+		err = printJSON(results)
+	} else {
+		err = printSelfTest(results)
+	}
+	if err != nil {
+		return err
+	}
+	for _, r := range results {
+		if !r.Passed {
+			return fmt.Errorf("self-test failed: the node doesn't enforce shaping within %.0f%% of the rate",
+				utils.SelfTestTolerance*100)
+		}
+	}
+	return nil
+}
+
+func printSelfTest(results []utils.SelfTestResult) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "DIRECTION\tRATE\tACHIEVED\tRESULT")
+	for _, r := range results {
+		result := "pass"
+		if !r.Passed {
+			result = "FAIL"
+		}
+		fmt.Fprintf(w, "%s\t%d bit/s\t%d bit/s\t%s\n", r.Direction, r.Rate, r.Achieved, result)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/projectcalico/cni-plugin/state"
+	"github.com/projectcalico/cni-plugin/utils"
+)
+
+func runStatus(args []string) error {
+	flagSet := flag.NewFlagSet("status", flag.ExitOnError)
+	output := flagSet.String("o", "text", "output format: text or json")
+	stateDir := flagSet.String("state-dir", "", "directory of the plugin's shaping state")
+	if err := flagSet.Parse(args); err != nil {
+		return err
+	}
+	if flagSet.NArg() != 1 {
+		return fmt.Errorf("usage: status [-o json] <container ID or workload>")
+	}
+	if *output != "text" && *output != "json" {
+		return fmt.Errorf("unknown output format %q, must be text or json", *output)
+	}
+
+	r, err := state.NewStore(*stateDir).Find(flagSet.Arg(0))
+	if err != nil {
+		return err
+	}
+	status, err := utils.ReadTCStatus(r)
+	if err != nil {
+		return err
+	}
+	if *output == "json" {
+		return printJSON(status)
+	}
+	return printStatus(status)
+}
+
+func printStatus(s *utils.TCStatus) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Container:\t%s\n", s.ContainerID)
+	fmt.Fprintf(w, "Workload:\t%s\n", s.Workload)
+	if s.ShapingMode != "" {
+		fmt.Fprintf(w, "Shaping mode:\t%s\n", s.ShapingMode)
+	}
+	fmt.Fprintf(w, "Ingress rate:\t%s\n", statusRate(s.IngressRate))
+	fmt.Fprintf(w, "Egress rate:\t%s\n", statusRate(s.EgressRate))
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	for _, d := range s.Devices {
+		fmt.Printf("\n%s (%s)", d.Name, d.Direction)
+		if d.Missing {
+			fmt.Println(": missing")
+			continue
+		}
+		fmt.Printf(": sent %d bytes, %d packets, dropped %d\n\n", d.TxBytes, d.TxPackets, d.TxDropped)
+
+		// Each table is aligned on its own.
+		w = tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "QDISC\tHANDLE\tPARENT\tRATE")
+		for _, q := range d.Qdiscs {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", q.Kind, q.Handle, q.Parent, optionalRate(q.Rate))
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		fmt.Println()
+		w = tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "CLASS\tHANDLE\tPARENT\tRATE\tCEIL\tBYTES\tPACKETS\tDROPS\tOVERLIMITS")
+		for _, c := range d.Classes {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\n", c.Kind, c.Handle, c.Parent, optionalRate(c.Rate),
+				optionalRate(c.Ceil), c.Bytes, c.Packets, c.Drops, c.Overlimits)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		fmt.Println()
+		w = tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "FILTER\tPARENT\tPRIORITY\tPROTOCOL\tCLASS")
+		for _, f := range d.Filters {
+			classID := f.ClassID
+			if classID == "" {
+				classID = "-"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%#04x\t%s\n", f.Kind, f.Parent, f.Priority, f.Protocol, classID)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// statusRate formats a recorded rate of a pod, zero meaning it is unlimited.
+func statusRate(rate uint64) string {
+	if rate == 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%d bit/s", rate)
+}
+
+// optionalRate formats a rate tc state may not have, zero meaning it doesn't.
+func optionalRate(rate uint64) string {
+	if rate == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%d bit/s", rate)
+}
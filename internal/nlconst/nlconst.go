@@ -0,0 +1,66 @@
+// Package nlconst encodes the protocols and filter handles of tc objects as the kernel reads them from netlink messages and
+// sockets, whatever the byte order of the node. Netlink structures are in host byte order, but link layer protocols
+// within them are in network byte order, so they must be swapped on little-endian nodes (amd64, arm64, ppc64le)
+// and left alone on big-endian ones (ppc64, s390x).
+package nlconst
+
+import (
+	"encoding/binary"
+	"syscall"
+	"unsafe"
+)
+
+// Link layer protocols, in host byte order.
+const (
+	ProtoAll  uint16 = syscall.ETH_P_ALL
+	ProtoIP   uint16 = syscall.ETH_P_IP
+	ProtoIPv6 uint16 = syscall.ETH_P_IPV6
+	ProtoARP  uint16 = syscall.ETH_P_ARP
+)
+
+// Native is the byte order of the node.
+var Native = nativeOrder()
+
+func nativeOrder() binary.ByteOrder {
+	v := uint16(1)
+	if *(*byte)(unsafe.Pointer(&v)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}
+
+// Htons converts a short from host to network byte order: the result is laid out in memory, and so in netlink
+// messages, as v in big-endian.
+func Htons(v uint16) uint16 {
+	return HtonsFor(Native, v)
+}
+
+// Htonl converts a long from host to network byte order.
+func Htonl(v uint32) uint32 {
+	return HtonlFor(Native, v)
+}
+
+// HtonsFor is Htons on a node of byte order order.
+func HtonsFor(order binary.ByteOrder, v uint16) uint16 {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return order.Uint16(b)
+}
+
+// HtonlFor is Htonl on a node of byte order order.
+func HtonlFor(order binary.ByteOrder, v uint32) uint32 {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return order.Uint32(b)
+}
+
+// FilterInfo returns the tcm_info of a filter with priority prio matching protocol, in host byte order: the
+// priority in the upper half and the protocol, in network byte order, in the lower half.
+func FilterInfo(prio, protocol uint16) uint32 {
+	return FilterInfoFor(Native, prio, protocol)
+}
+
+// FilterInfoFor is FilterInfo on a node of byte order order.
+func FilterInfoFor(order binary.ByteOrder, prio, protocol uint16) uint32 {
+	return uint32(prio)<<16 | uint32(HtonsFor(order, protocol))
+}
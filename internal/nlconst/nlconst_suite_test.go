@@ -0,0 +1,13 @@
+package nlconst_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestNlconst(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Nlconst Suite")
+}
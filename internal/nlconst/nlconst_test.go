@@ -0,0 +1,58 @@
+package nlconst_test
+
+import (
+	"encoding/binary"
+	"runtime"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/cni-plugin/internal/nlconst"
+)
+
+// bytesOf lays v out in memory as a node of byte order order does.
+func bytesOf(order binary.ByteOrder, v uint16) []byte {
+	b := make([]byte, 2)
+	order.PutUint16(b, v)
+	return b
+}
+
+var _ = Describe("Byte order", func() {
+	It("detects the byte order of the architectures nodes run on", func() {
+		switch runtime.GOARCH {
+		case "amd64", "arm64", "ppc64le", "386", "arm":
+			Expect(nlconst.Native).To(Equal(binary.LittleEndian))
+		case "ppc64", "s390x":
+			Expect(nlconst.Native).To(Equal(binary.BigEndian))
+		}
+	})
+
+	// amd64, arm64 and ppc64le are little-endian; ppc64 and s390x big-endian.
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		order := order
+		Context("on "+order.String()+" nodes", func() {
+			It("lays protocols out in network byte order", func() {
+				Expect(bytesOf(order, nlconst.HtonsFor(order, nlconst.ProtoIP))).To(Equal([]byte{0x08, 0x00}))
+				Expect(bytesOf(order, nlconst.HtonsFor(order, nlconst.ProtoIPv6))).To(Equal([]byte{0x86, 0xdd}))
+				Expect(bytesOf(order, nlconst.HtonsFor(order, nlconst.ProtoARP))).To(Equal([]byte{0x08, 0x06}))
+				Expect(bytesOf(order, nlconst.HtonsFor(order, nlconst.ProtoAll))).To(Equal([]byte{0x00, 0x03}))
+			})
+
+			It("lays longs out in network byte order", func() {
+				b := make([]byte, 4)
+				order.PutUint32(b, nlconst.HtonlFor(order, 0x0a000001))
+				Expect(b).To(Equal([]byte{10, 0, 0, 1}))
+			})
+
+			It("keeps the priority of filters in host byte order and their protocol in network byte order", func() {
+				info := nlconst.FilterInfoFor(order, 10, nlconst.ProtoIPv6)
+				Expect(info >> 16).To(Equal(uint32(10)))
+				Expect(bytesOf(order, uint16(info))).To(Equal([]byte{0x86, 0xdd}))
+			})
+		})
+	}
+
+	It("swaps protocols on little-endian nodes only", func() {
+		Expect(nlconst.HtonsFor(binary.LittleEndian, nlconst.ProtoIP)).To(Equal(uint16(0x0008)))
+		Expect(nlconst.HtonsFor(binary.BigEndian, nlconst.ProtoIP)).To(Equal(uint16(0x0800)))
+	})
+})
@@ -0,0 +1,63 @@
+// Package util holds the small helpers shared by the plugin, the agent and their subsystems: bounded string
+// prefixes, interface name limits and writes to kernel files.
+package util
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+)
+
+// MaxIfNameLen is the longest interface name the kernel accepts, IFNAMSIZ less the terminating NUL.
+const MaxIfNameLen = syscall.IFNAMSIZ - 1
+
+// Min returns the smaller of a and b.
+func Min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Prefix returns the first n bytes of s, or all of s if it is shorter. A negative n gives "".
+func Prefix(s string, n int) string {
+	if n < 0 {
+		return ""
+	}
+	return s[:Min(n, len(s))]
+}
+
+// TruncateIfName cuts an interface name to the longest the kernel accepts.
+func TruncateIfName(name string) string {
+	return Prefix(name, MaxIfNameLen)
+}
+
+// CheckIfName returns an error if the kernel would reject name as an interface name for its length, or for being
+// empty.
+func CheckIfName(name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("interface name is empty")
+	case len(name) > MaxIfNameLen:
+		return fmt.Errorf("interface name %q is longer than %d characters", name, MaxIfNameLen)
+	}
+	return nil
+}
+
+// WriteProc writes value to an existing kernel file under /proc or /sys in a single write, as the kernel parses
+// each write on its own, and fails if it wasn't all taken.
+func WriteProc(path, value string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	n, err := f.Write([]byte(value))
+	if err == nil && n < len(value) {
+		err = io.ErrShortWrite
+	}
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
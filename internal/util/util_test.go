@@ -0,0 +1,67 @@
+package util_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/cni-plugin/internal/util"
+)
+
+var _ = Describe("Min", func() {
+	It("returns the smaller argument", func() {
+		Expect(util.Min(1, 2)).To(Equal(1))
+		Expect(util.Min(2, 1)).To(Equal(1))
+		Expect(util.Min(-3, 0)).To(Equal(-3))
+	})
+})
+
+var _ = Describe("Prefix", func() {
+	It("bounds the prefix by the length of the string", func() {
+		Expect(util.Prefix("abcdef", 3)).To(Equal("abc"))
+		Expect(util.Prefix("ab", 11)).To(Equal("ab"))
+		Expect(util.Prefix("", 11)).To(Equal(""))
+		Expect(util.Prefix("abc", -1)).To(Equal(""))
+	})
+})
+
+var _ = Describe("Interface names", func() {
+	It("truncates names to IFNAMSIZ less the NUL", func() {
+		Expect(util.TruncateIfName("cali0123456789abcdef")).To(Equal("cali0123456789a"))
+		Expect(util.TruncateIfName("eth0")).To(Equal("eth0"))
+	})
+
+	It("accepts names up to the limit and rejects longer or empty ones", func() {
+		Expect(util.CheckIfName(strings.Repeat("a", util.MaxIfNameLen))).To(Succeed())
+		Expect(util.CheckIfName(strings.Repeat("a", util.MaxIfNameLen+1))).NotTo(Succeed())
+		Expect(util.CheckIfName("")).NotTo(Succeed())
+	})
+})
+
+var _ = Describe("WriteProc", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "util")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("writes existing files", func() {
+		path := filepath.Join(dir, "proxy_arp")
+		Expect(ioutil.WriteFile(path, []byte("0"), 0600)).To(Succeed())
+		Expect(util.WriteProc(path, "1")).To(Succeed())
+		Expect(ioutil.ReadFile(path)).To(Equal([]byte("1")))
+	})
+
+	It("doesn't create missing files", func() {
+		Expect(util.WriteProc(filepath.Join(dir, "missing"), "1")).NotTo(Succeed())
+	})
+})
@@ -17,6 +17,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strconv"
 	"strings"
 
 	"os"
@@ -25,9 +26,12 @@ import (
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
 	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/projectcalico/cni-plugin/policy"
+	"github.com/projectcalico/cni-plugin/quota"
+	"github.com/projectcalico/cni-plugin/state"
+	"github.com/projectcalico/cni-plugin/tracing"
 	"github.com/projectcalico/cni-plugin/utils"
 	"github.com/projectcalico/libcalico-go/lib/api"
-	k8sbackend "github.com/projectcalico/libcalico-go/lib/backend/k8s"
 	cerrors "github.com/projectcalico/libcalico-go/lib/errors"
 	cnet "github.com/projectcalico/libcalico-go/lib/net"
 
@@ -55,7 +59,7 @@ func CmdAddK8s(args *skel.CmdArgs, conf utils.NetConf, nodename string, calicoCl
 		return nil, err
 	}
 
-	utils.ConfigureLogging(conf.LogLevel)
+	utils.ConfigureLogging(conf, args)
 
 	workload, orchestrator, err := utils.GetIdentifiers(args)
 	if err != nil {
@@ -67,6 +71,9 @@ func CmdAddK8s(args *skel.CmdArgs, conf utils.NetConf, nodename string, calicoCl
 		"Node":         nodename,
 	}).Info("Extracted identifiers for CmdAddK8s")
 
+	// With the bandwidth capability, the runtime passes the rates of the pod, even when it isn't read from the API.
+	ingress_bandwidth, egress_bandwidth = utils.RuntimeBandwidth(&conf)
+
 	if endpoint != nil {
 		// This happens when Docker or the node restarts. K8s calls CNI with the same parameters as before.
 		// Do the networking (since the network namespace was destroyed and recreated).
@@ -77,6 +84,15 @@ func CmdAddK8s(args *skel.CmdArgs, conf utils.NetConf, nodename string, calicoCl
 			return nil, err
 		}
 		logger.WithField("result", result).Debug("Created result from existing endpoint")
+		// The pod is shaped again as it was, with the bandwidth of its annotations.
+		client, err := newK8sClient(conf, logger)
+		if err != nil {
+			return nil, err
+		}
+		if _, _, ingress_bandwidth, egress_bandwidth, err = podBandwidth(client, &conf, args, k8sArgs, ingress_bandwidth,
+			egress_bandwidth, logger); err != nil {
+			return nil, err
+		}
 		// If any labels changed whilst the container was being restarted, they will be picked up by the policy
 		// controller so there's no need to update the labels here.
 	} else {
@@ -89,7 +105,7 @@ func CmdAddK8s(args *skel.CmdArgs, conf utils.NetConf, nodename string, calicoCl
 		if conf.IPAM.Type == "host-local" && strings.EqualFold(conf.IPAM.Subnet, "usePodCidr") {
 			// We've been told to use the "host-local" IPAM plugin with the Kubernetes podCidr for this node.
 			// Replace the actual value in the args.StdinData as that's what's passed to the IPAM plugin.
-			fmt.Fprintf(os.Stderr, "Calico CNI fetching podCidr from Kubernetes\n")
+			logger.Info("Fetching podCidr from Kubernetes")
 			var stdinData map[string]interface{}
 			if err := json.Unmarshal(args.StdinData, &stdinData); err != nil {
 				return nil, err
@@ -100,7 +116,7 @@ func CmdAddK8s(args *skel.CmdArgs, conf utils.NetConf, nodename string, calicoCl
 			}
 			logger.WithField("podCidr", podCidr).Info("Fetched podCidr")
 			stdinData["ipam"].(map[string]interface{})["subnet"] = podCidr
-			fmt.Fprintf(os.Stderr, "Calico CNI passing podCidr to host-local IPAM: %s\n", podCidr)
+			logger.WithField("podCidr", podCidr).Info("Passing podCidr to host-local IPAM")
 			args.StdinData, err = json.Marshal(stdinData)
 			if err != nil {
 				return nil, err
@@ -108,82 +124,66 @@ func CmdAddK8s(args *skel.CmdArgs, conf utils.NetConf, nodename string, calicoCl
 			logger.WithField("stdin", string(args.StdinData)).Debug("Updated stdin data")
 		}
 
-		labels := make(map[string]string)
-		annot := make(map[string]string)
-
-		// Only attempt to fetch the labels and annotations from Kubernetes
-		// if the policy type has been set to "k8s". This allows users to
-		// run the plugin under Kubernetes without needing it to access the
-		// Kubernetes API
-		if conf.Policy.PolicyType == "k8s" {
-			var err error
+		var labels, annot map[string]string
+		labels, annot, ingress_bandwidth, egress_bandwidth, err = podBandwidth(client, &conf, args, k8sArgs,
+			ingress_bandwidth, egress_bandwidth, logger)
+		if err != nil {
+			return nil, err
+		}
+		// Pods that would take their namespace over a bandwidth quota fail, and are retried by the kubelet.
+		if err := quota.Check(conf.StateDir, string(k8sArgs.K8S_POD_NAMESPACE), ingress_bandwidth, egress_bandwidth); err != nil {
+			return nil, err
+		}
+		logger.WithField("labels", labels).Debug("Fetched K8s labels")
+		logger.WithField("annotations", annot).Debug("Fetched K8s annotations")
 
-			labels, annot, err = getK8sLabelsAnnotations(client, k8sArgs)
-			ingress_bandwidth = annot["kubernetes.io/ingress-bandwidth"]
-			egress_bandwidth = annot["kubernetes.io/egress-bandwidth"]
-			if egress_bandwidth == "" {
-				logger.Infof("daikuan is wrong")
-			}
-			//if label =="" {
-			//	logger.Infof("lables is wrong")
-			//}
-                        logger.Infof("ljin is : %s M", ingress_bandwidth)
-			logger.Infof("ljout is : %s M", ingress_bandwidth)
-		       //ingress_bandwidth = "123"
-			if err != nil {
-				return nil, err
-			}
-			logger.WithField("labels", labels).Debug("Fetched K8s labels")
-			logger.WithField("annotations", annot).Debug("Fetched K8s annotations")
+		// Check for calico IPAM specific annotations and set them if needed.
+		if conf.IPAM.Type == "calico-ipam" {
 
-			// Check for calico IPAM specific annotations and set them if needed.
-			if conf.IPAM.Type == "calico-ipam" {
+			v4pools := annot["cni.projectcalico.org/ipv4pools"]
+			v6pools := annot["cni.projectcalico.org/ipv6pools"]
 
-				v4pools := annot["cni.projectcalico.org/ipv4pools"]
-				v6pools := annot["cni.projectcalico.org/ipv6pools"]
+			if len(v4pools) != 0 || len(v6pools) != 0 {
+				var stdinData map[string]interface{}
+				if err := json.Unmarshal(args.StdinData, &stdinData); err != nil {
+					return nil, err
+				}
+				var v4PoolSlice, v6PoolSlice []string
 
-				if len(v4pools) != 0 || len(v6pools) != 0 {
-					var stdinData map[string]interface{}
-					if err := json.Unmarshal(args.StdinData, &stdinData); err != nil {
+				if len(v4pools) > 0 {
+					if err := json.Unmarshal([]byte(v4pools), &v4PoolSlice); err != nil {
+						logger.WithField("IPv4Pool", v4pools).Error("Error parsing IPv4 IPPools")
 						return nil, err
 					}
-					var v4PoolSlice, v6PoolSlice []string
-
-					if len(v4pools) > 0 {
-						if err := json.Unmarshal([]byte(v4pools), &v4PoolSlice); err != nil {
-							logger.WithField("IPv4Pool", v4pools).Error("Error parsing IPv4 IPPools")
-							return nil, err
-						}
-
-						if _, ok := stdinData["ipam"].(map[string]interface{}); !ok {
-							logger.Fatal("Error asserting stdinData type")
-							os.Exit(0)
-						}
-						stdinData["ipam"].(map[string]interface{})["ipv4_pools"] = v4PoolSlice
-						logger.WithField("ipv4_pools", v4pools).Debug("Setting IPv4 Pools")
+
+					if _, ok := stdinData["ipam"].(map[string]interface{}); !ok {
+						logger.Fatal("Error asserting stdinData type")
+						os.Exit(0)
 					}
-					if len(v6pools) > 0 {
-						if err := json.Unmarshal([]byte(v6pools), &v6PoolSlice); err != nil {
-							logger.WithField("IPv6Pool", v6pools).Error("Error parsing IPv6 IPPools")
-							return nil, err
-						}
-
-						if _, ok := stdinData["ipam"].(map[string]interface{}); !ok {
-							logger.Fatal("Error asserting stdinData type")
-							os.Exit(0)
-						}
-						stdinData["ipam"].(map[string]interface{})["ipv6_pools"] = v6PoolSlice
-						logger.WithField("ipv6_pools", v6pools).Debug("Setting IPv6 Pools")
+					stdinData["ipam"].(map[string]interface{})["ipv4_pools"] = v4PoolSlice
+					logger.WithField("ipv4_pools", v4pools).Debug("Setting IPv4 Pools")
+				}
+				if len(v6pools) > 0 {
+					if err := json.Unmarshal([]byte(v6pools), &v6PoolSlice); err != nil {
+						logger.WithField("IPv6Pool", v6pools).Error("Error parsing IPv6 IPPools")
+						return nil, err
 					}
 
-					newData, err := json.Marshal(stdinData)
-					if err != nil {
-						logger.WithField("stdinData", stdinData).Error("Error Marshaling data")
-						return nil, err
+					if _, ok := stdinData["ipam"].(map[string]interface{}); !ok {
+						logger.Fatal("Error asserting stdinData type")
+						os.Exit(0)
 					}
-					args.StdinData = newData
-					logger.WithField("stdin", string(args.StdinData)).Debug("Updated stdin data")
+					stdinData["ipam"].(map[string]interface{})["ipv6_pools"] = v6PoolSlice
+					logger.WithField("ipv6_pools", v6pools).Debug("Setting IPv6 Pools")
 				}
+
+				newData, err := json.Marshal(stdinData)
+				if err != nil {
+					logger.WithField("stdinData", stdinData).Error("Error Marshaling data")
+					return nil, err
+				}
+				args.StdinData = newData
+				logger.WithField("stdin", string(args.StdinData)).Debug("Updated stdin data")
 			}
 		}
 
@@ -195,7 +195,9 @@ func CmdAddK8s(args *skel.CmdArgs, conf utils.NetConf, nodename string, calicoCl
 		case ipAddrs == "" && ipAddrsNoIpam == "":
 			// Call IPAM plugin if ipAddrsNoIpam or ipAddrs annotation is not present.
 			logger.Debugf("Calling IPAM plugin %s", conf.IPAM.Type)
+			span := tracing.Start("ipam")
 			ipamResult, err := ipam.ExecAdd(conf.IPAM.Type, args.StdinData)
+			span.End(err)
 			if err != nil {
 				return nil, err
 			}
@@ -276,11 +278,10 @@ func CmdAddK8s(args *skel.CmdArgs, conf utils.NetConf, nodename string, calicoCl
 		}
 		logger.WithField("endpoint", endpoint).Info("Populated endpoint")
 	}
-	fmt.Fprintf(os.Stderr, "Calico CNI using IPs: %s\n", endpoint.Spec.IPNetworks)
+	logger.WithField("IPs", endpoint.Spec.IPNetworks).Info("Using IPs")
 
 	// Whether the endpoint existed or not, the veth needs (re)creating.
-	hostVethName := k8sbackend.VethNameForWorkload(workload)
-	_, contVethMac, err := utils.DoNetworking(args, conf, result, logger, hostVethName, ingress_bandwidth, egress_bandwidth)
+	hostVethName, contVethMac, err := utils.DoNetworking(args, conf, result, logger, "", ingress_bandwidth, egress_bandwidth)
 	if err != nil {
 		// Cleanup IP allocation and return the error.
 		logger.Errorf("Error setting up networking: %s", err)
@@ -364,9 +365,8 @@ func CmdDelK8s(c *calicoclient.Client, ep api.WorkloadEndpointMetadata, args *sk
 	// Release the IP address by calling the configured IPAM plugin.
 	ipamErr := utils.CleanUpIPAM(conf, args, logger)
 
-	// Clean up namespace by removing the interfaces.
-	err = utils.CleanUpNamespace(args, logger)
-	if err != nil {
+	// Remove the shaping, routes, interfaces and shaping state of the container, in that order.
+	if err = utils.TeardownContainer(args, conf, logger); err != nil {
 		return err
 	}
 
@@ -447,7 +447,9 @@ func callIPAMWithIP(ip net.IP, conf utils.NetConf, args *skel.CmdArgs, logger *l
 
 	// Run the IPAM plugin.
 	logger.Debugf("Calling IPAM plugin %s", conf.IPAM.Type)
+	span := tracing.Start("ipam")
 	r, err := ipam.ExecAdd(conf.IPAM.Type, args.StdinData)
+	span.End(err)
 	if err != nil {
 		// Restore the CNI_ARGS ENV var to it's original value,
 		// so the subsequent calls don't get polluted by the old IP value.
@@ -590,6 +592,117 @@ func parseIPAddrs(ipAddrsStr string, logger *log.Entry) ([]string, error) {
 	return ips, nil
 }
 
+// podBandwidth returns the bandwidths of the interface args.IfName of the pod of k8sArgs, given ingress and egress,
+// those the runtime passed, and sets the shaping options of the pod's annotations and of the cluster policy in conf.
+// It also returns the labels and annotations of the pod. The pod is read from the Kubernetes API with the "k8s"
+// policy type, or for its bandwidth annotations when the runtime passed no bandwidth; its labels are only used with
+// the "k8s" policy type. Without it, a pod that can't be read is shaped with the rates the runtime passed.
+func podBandwidth(client *kubernetes.Clientset, conf *utils.NetConf, args *skel.CmdArgs, k8sArgs utils.K8sArgs,
+	ingress, egress string, logger *log.Entry) (map[string]string, map[string]string, string, string, error) {
+	labels, annot := map[string]string{}, map[string]string{}
+	k8sPolicy := conf.Policy.PolicyType == "k8s"
+	if k8sPolicy || (ingress == "" && egress == "") {
+		podLabels, podAnnot, err := getK8sLabelsAnnotations(client, k8sArgs)
+		switch {
+		case err != nil && k8sPolicy:
+			return nil, nil, "", "", err
+		case err != nil:
+			logger.WithError(err).Warn("Failed to read pod from the Kubernetes API, using the rates of the runtime only")
+		default:
+			if k8sPolicy {
+				labels = podLabels
+			}
+			if podAnnot != nil {
+				annot = podAnnot
+			}
+		}
+	}
+	if latencyClass := annot["flowcontrol.cni/latency-class"]; latencyClass != "" {
+		conf.LatencyClass = latencyClass
+	}
+	if ceil := annot["flowcontrol.cni/ingress-ceil"]; ceil != "" {
+		conf.IngressCeil = ceil
+	}
+	if ceil := annot["flowcontrol.cni/egress-ceil"]; ceil != "" {
+		conf.EgressCeil = ceil
+	}
+	if mirrorTo := annot["flowcontrol.cni/mirror-to"]; mirrorTo != "" {
+		conf.MirrorTo = mirrorTo
+	}
+	if limit, err := strconv.ParseUint(annot["flowcontrol.cni/max-pps"], 10, 64); err == nil {
+		conf.MaxPPS = limit
+	}
+	if limit, err := strconv.ParseUint(annot["flowcontrol.cni/max-connections"], 10, 64); err == nil {
+		conf.MaxConnections = limit
+	}
+	// The priority tiers of the node rank the pod by its labels or QoS class, unless the cluster policy
+	// gives it a class priority below.
+	if len(conf.QoSPriorities) > 0 || len(conf.LabelPriorities) > 0 {
+		qosClass, err := getK8sQoSClass(client, k8sArgs)
+		if err != nil {
+			logger.WithError(err).Warn("Failed to get QoS class of pod, ranking it by its labels only")
+		}
+		if prio, ok := utils.TierPriority(*conf, labels, qosClass); ok {
+			conf.ClassPriority = prio
+		}
+	}
+
+	// Fill in defaults and exemptions from the cluster policy distributed by the agent.
+	p, err := policy.Load(conf.StateDir)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to load cluster flow control policy, using annotations only")
+		p = nil
+	}
+	if p != nil {
+		// Pods of PriorityClasses the policy treats specially get the class priority and preset of their class.
+		if len(p.PriorityClasses) > 0 {
+			priorityClass, err := getK8sPriorityClass(client, k8sArgs)
+			if err != nil {
+				logger.WithError(err).Warn("Failed to get PriorityClass of pod, treating it as the default")
+			}
+			if name, treatment, ok := p.Treatment(priorityClass); ok {
+				conf.PriorityClass, conf.ClassPriority = name, treatment.ClassPriority
+				p = p.WithTreatment(treatment)
+			}
+		}
+	}
+	// The rates the runtime passed take precedence over the annotations they come from.
+	ingress, egress = utils.InterfaceBandwidth(p, string(k8sArgs.K8S_POD_NAMESPACE), args.IfName, annot, ingress, egress)
+	logger.WithFields(log.Fields{
+		"ingressBandwidth": ingress,
+		"egressBandwidth":  egress,
+	}).Info("Read bandwidth of pod")
+
+	// The presets and templates of the policy are those of the primary interface of the pod.
+	if p != nil && !state.Secondary(args.IfName) {
+		conf.Preset = p.Preset(string(k8sArgs.K8S_POD_NAMESPACE), annot)
+		conf.DNSRateLimit, conf.ICMPRateLimit, conf.ICMPv6RateLimit = p.PacketRates(string(k8sArgs.K8S_POD_NAMESPACE), annot)
+
+		// A template of the policy matching the pod computes its rates from its metadata instead.
+		rendered, err := p.Render(policy.Pod{
+			Namespace:   string(k8sArgs.K8S_POD_NAMESPACE),
+			Name:        string(k8sArgs.K8S_POD_NAME),
+			Labels:      labels,
+			Annotations: annot,
+		})
+		if err != nil {
+			logger.WithError(err).Warn("Failed to render flow control template, using annotations and presets")
+		} else if rendered != nil {
+			conf.Template = rendered.Template
+			if rendered.Ingress != "" {
+				ingress = rendered.Ingress
+			}
+			if rendered.Egress != "" {
+				egress = rendered.Egress
+			}
+			if rendered.ClassPriority != nil {
+				conf.ClassPriority = *rendered.ClassPriority
+			}
+		}
+	}
+	return labels, annot, ingress, egress, nil
+}
+
 func newK8sClient(conf utils.NetConf, logger *log.Entry) (*kubernetes.Clientset, error) {
 	// Some config can be passed in a kubeconfig file
 	kubeconfig := conf.Kubernetes.Kubeconfig
@@ -655,6 +768,50 @@ func getK8sLabelsAnnotations(client *kubernetes.Clientset, k8sargs utils.K8sArgs
 	return labels, pod.Annotations, nil
 }
 
+// getK8sPriorityClass returns the name of the PriorityClass of the pod, or "" if it has none. The vendored API types
+// predate the field, so it is read from the raw pod.
+func getK8sPriorityClass(client *kubernetes.Clientset, k8sargs utils.K8sArgs) (string, error) {
+	data, err := client.Core().RESTClient().Get().
+		Namespace(string(k8sargs.K8S_POD_NAMESPACE)).
+		Resource("pods").
+		Name(string(k8sargs.K8S_POD_NAME)).
+		Do().Raw()
+	if err != nil {
+		return "", err
+	}
+	var pod struct {
+		Spec struct {
+			PriorityClassName string `json:"priorityClassName"`
+		} `json:"spec"`
+	}
+	if err = json.Unmarshal(data, &pod); err != nil {
+		return "", fmt.Errorf("failed to parse pod %s: %v", k8sargs.K8S_POD_NAME, err)
+	}
+	return pod.Spec.PriorityClassName, nil
+}
+
+// getK8sQoSClass returns the QoS class of the pod. The vendored API types predate the field, so it is read from the
+// raw pod.
+func getK8sQoSClass(client *kubernetes.Clientset, k8sargs utils.K8sArgs) (string, error) {
+	data, err := client.Core().RESTClient().Get().
+		Namespace(string(k8sargs.K8S_POD_NAMESPACE)).
+		Resource("pods").
+		Name(string(k8sargs.K8S_POD_NAME)).
+		Do().Raw()
+	if err != nil {
+		return "", err
+	}
+	var pod struct {
+		Status struct {
+			QOSClass string `json:"qosClass"`
+		} `json:"status"`
+	}
+	if err = json.Unmarshal(data, &pod); err != nil {
+		return "", fmt.Errorf("failed to parse pod %s: %v", k8sargs.K8S_POD_NAME, err)
+	}
+	return pod.Status.QOSClass, nil
+}
+
 func getPodCidr(client *kubernetes.Clientset, conf utils.NetConf, nodename string) (string, error) {
 	// Pull the node name out of the config if it's set. Defaults to nodename
 	if conf.Kubernetes.NodeName != "" {
@@ -0,0 +1,162 @@
+// Package logging gives each subsystem of the plugin and agent a logger of its own, so that their levels can be set
+// independently, e.g. to debug tc programming without drowning in the rest of the datapath logs.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Subsystems, the keys of the logLevels configuration.
+const (
+	// Datapath covers veths, addresses, routes and sysctls, and everything not in another subsystem.
+	Datapath = "datapath"
+	// TC covers qdiscs, classes, filters and packet rate limits.
+	TC = "tc"
+	// IPAM covers address assignment by the calico-ipam plugin.
+	IPAM = "ipam"
+	// Agent covers the node agent.
+	Agent = "agent"
+)
+
+// Formats of the log output, the values of the log_format configuration.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+var loggers = map[string]*log.Logger{
+	Datapath: log.New(),
+	TC:       log.New(),
+	IPAM:     log.New(),
+	Agent:    log.New(),
+}
+
+// Logger returns an entry logging to the logger of subsystem, which must be one of the constants above.
+func Logger(subsystem string) *log.Entry {
+	logger, ok := loggers[subsystem]
+	if !ok {
+		panic(fmt.Sprintf("unknown logging subsystem %q", subsystem))
+	}
+	return log.NewEntry(logger).WithField("subsystem", subsystem)
+}
+
+// In returns an entry with the fields of e logging to the logger of subsystem instead, so that context such as the
+// workload is kept when a subsystem takes over.
+func In(subsystem string, e *log.Entry) *log.Entry {
+	return Logger(subsystem).WithFields(e.Data)
+}
+
+// Configure sets every subsystem to level, then those in levels to their own, given by name ("debug", "info",
+// "warn"...). The loggers write to the output of the standard logger, in its format. It fails on unknown subsystems
+// or levels without changing anything.
+func Configure(level log.Level, levels map[string]string) error {
+	parsed := map[string]log.Level{}
+	for subsystem, name := range levels {
+		if _, ok := loggers[subsystem]; !ok {
+			return fmt.Errorf("unknown logging subsystem %q, must be one of %s", subsystem, strings.Join(Subsystems(), ", "))
+		}
+		l, err := log.ParseLevel(name)
+		if err != nil {
+			return fmt.Errorf("invalid log level %q for %s: %v", name, subsystem, err)
+		}
+		parsed[subsystem] = l
+	}
+
+	std := log.StandardLogger()
+	for subsystem, logger := range loggers {
+		logger.Out = std.Out
+		logger.Formatter = std.Formatter
+		logger.Hooks = std.Hooks
+		logger.Level = level
+		if l, ok := parsed[subsystem]; ok {
+			logger.Level = l
+		}
+	}
+	return nil
+}
+
+// SetOutput makes the standard logger, which the subsystems follow on Configure, write to the file at path, appended
+// to, or to stderr if path is empty, in format, with fields on every entry, such as the container the plugin runs
+// for. The file stays open for the life of the process. It fails on unknown formats or files that can't be opened
+// without changing anything.
+func SetOutput(path, format string, fields log.Fields) error {
+	var formatter log.Formatter
+	switch format {
+	case "", FormatText:
+		formatter = &log.TextFormatter{}
+	case FormatJSON:
+		formatter = &log.JSONFormatter{}
+	default:
+		return fmt.Errorf("unknown log format %q, must be %q or %q", format, FormatText, FormatJSON)
+	}
+	var out io.Writer = os.Stderr
+	if path != "" {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return fmt.Errorf("failed to create directory of log file %s: %v", path, err)
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to open log file %s: %v", path, err)
+		}
+		out = f
+	}
+	log.SetOutput(out)
+	log.SetFormatter(&contextFormatter{Formatter: formatter, fields: fields})
+	return nil
+}
+
+// contextFormatter adds fields to every entry it formats, under those of the entry. Entries are copied rather than
+// added to, as they may be logged from several goroutines.
+type contextFormatter struct {
+	log.Formatter
+	fields log.Fields
+}
+
+func (f *contextFormatter) Format(e *log.Entry) ([]byte, error) {
+	if len(f.fields) == 0 {
+		return f.Formatter.Format(e)
+	}
+	data := make(log.Fields, len(f.fields)+len(e.Data))
+	for k, v := range f.fields {
+		data[k] = v
+	}
+	for k, v := range e.Data {
+		data[k] = v
+	}
+	entry := *e
+	entry.Data = data
+	return f.Formatter.Format(&entry)
+}
+
+// ParseLevels parses levels given as comma-separated subsystem=level pairs, e.g. "tc=debug,agent=warn".
+func ParseLevels(s string) (map[string]string, error) {
+	levels := map[string]string{}
+	if s == "" {
+		return levels, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid log level %q, must be subsystem=level", pair)
+		}
+		levels[parts[0]] = parts[1]
+	}
+	return levels, nil
+}
+
+// Subsystems returns the names of the subsystems, sorted.
+func Subsystems() []string {
+	var names []string
+	for name := range loggers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
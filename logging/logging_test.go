@@ -0,0 +1,102 @@
+package logging_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/cni-plugin/logging"
+)
+
+var _ = Describe("Configure", func() {
+	var out *bytes.Buffer
+
+	BeforeEach(func() {
+		out = &bytes.Buffer{}
+		log.SetOutput(out)
+	})
+
+	AfterEach(func() {
+		log.SetOutput(os.Stderr)
+		Expect(logging.Configure(log.InfoLevel, nil)).To(Succeed())
+	})
+
+	It("sets the level of each subsystem independently", func() {
+		Expect(logging.Configure(log.InfoLevel, map[string]string{"tc": "debug", "agent": "warn"})).To(Succeed())
+		logging.Logger(logging.TC).Debug("tc detail")
+		logging.Logger(logging.Datapath).Debug("datapath detail")
+		logging.Logger(logging.Datapath).Info("datapath summary")
+		logging.Logger(logging.Agent).Info("agent summary")
+
+		Expect(out.String()).To(ContainSubstring("tc detail"))
+		Expect(out.String()).To(ContainSubstring("subsystem=tc"))
+		Expect(out.String()).To(ContainSubstring("datapath summary"))
+		Expect(out.String()).NotTo(ContainSubstring("datapath detail"))
+		Expect(out.String()).NotTo(ContainSubstring("agent summary"))
+	})
+
+	It("keeps the fields of entries moved to a subsystem", func() {
+		Expect(logging.Configure(log.InfoLevel, nil)).To(Succeed())
+		logging.In(logging.TC, log.WithField("workload", "default.pod")).Info("shaped")
+		Expect(out.String()).To(ContainSubstring("workload=default.pod"))
+		Expect(out.String()).To(ContainSubstring("subsystem=tc"))
+	})
+
+	It("rejects unknown subsystems and levels", func() {
+		Expect(logging.Configure(log.InfoLevel, map[string]string{"bgp": "debug"})).NotTo(Succeed())
+		Expect(logging.Configure(log.InfoLevel, map[string]string{"tc": "loud"})).NotTo(Succeed())
+	})
+})
+
+var _ = Describe("SetOutput", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "logging")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		log.SetOutput(os.Stderr)
+		log.SetFormatter(&log.TextFormatter{})
+		Expect(logging.Configure(log.InfoLevel, nil)).To(Succeed())
+		os.RemoveAll(dir)
+	})
+
+	It("writes JSON entries with the context fields to the log file", func() {
+		path := filepath.Join(dir, "sub", "cni.log")
+		Expect(logging.SetOutput(path, logging.FormatJSON, log.Fields{"ContainerID": "abc"})).To(Succeed())
+		Expect(logging.Configure(log.InfoLevel, nil)).To(Succeed())
+		logging.Logger(logging.TC).WithField("interface", "cali1").Info("shaped")
+
+		data, err := ioutil.ReadFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		var entry map[string]interface{}
+		Expect(json.Unmarshal(data, &entry)).To(Succeed())
+		Expect(entry).To(HaveKeyWithValue("ContainerID", "abc"))
+		Expect(entry).To(HaveKeyWithValue("interface", "cali1"))
+		Expect(entry).To(HaveKeyWithValue("subsystem", "tc"))
+		Expect(entry).To(HaveKeyWithValue("msg", "shaped"))
+	})
+
+	It("rejects unknown formats", func() {
+		Expect(logging.SetOutput("", "xml", nil)).NotTo(Succeed())
+	})
+})
+
+var _ = Describe("ParseLevels", func() {
+	It("parses subsystem=level pairs", func() {
+		levels, err := logging.ParseLevels("tc=debug,agent=warn")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(levels).To(Equal(map[string]string{"tc": "debug", "agent": "warn"}))
+
+		_, err = logging.ParseLevels("tc")
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,65 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Names of the supported metrics backends.
+const (
+	BackendPrometheus = "prometheus"
+	BackendStatsd     = "statsd"
+	BackendOTLP       = "otlp"
+)
+
+// DefaultPushInterval is how often push based exporters send the metrics.
+const DefaultPushInterval = 10 * time.Second
+
+// Exporter ships the metrics of a registry to a monitoring backend.
+type Exporter interface {
+	// Start begins exporting in the background. It returns an error if the exporter can't start at all.
+	Start(r *Registry) error
+}
+
+// NewExporter returns the exporter for backend. For Prometheus addr is the address to serve metrics on; for the
+// push based backends it is where metrics are sent: a host:port for statsd, an OTLP/HTTP endpoint URL for OTLP.
+func NewExporter(backend, addr string) (Exporter, error) {
+	switch backend {
+	case "", BackendPrometheus:
+		return &PrometheusExporter{Addr: addr}, nil
+	case BackendStatsd:
+		return &StatsdExporter{Addr: addr, Prefix: "flowcontrol.", Interval: DefaultPushInterval}, nil
+	case BackendOTLP:
+		return &OTLPExporter{Endpoint: addr, Interval: DefaultPushInterval}, nil
+	}
+	return nil, fmt.Errorf("unknown metrics backend %q", backend)
+}
+
+// PrometheusExporter serves the metrics for scraping.
+type PrometheusExporter struct {
+	Addr string
+}
+
+// Start implements Exporter.
+func (e *PrometheusExporter) Start(r *Registry) error {
+	go func() {
+		log.WithField("address", e.Addr).Info("Serving metrics")
+		if err := http.ListenAndServe(e.Addr, r.Handler()); err != nil {
+			log.WithError(err).Error("Metrics server failed")
+		}
+	}()
+	return nil
+}
+
+// pushEvery calls push with a snapshot of r every interval, forever.
+func pushEvery(r *Registry, interval time.Duration, backend string, push func([]Family) error) {
+	for {
+		time.Sleep(interval)
+		if err := push(r.Gather()); err != nil {
+			log.WithError(err).WithField("backend", backend).Warn("Failed to push metrics")
+		}
+	}
+}
@@ -0,0 +1,228 @@
+// Package metrics is a small registry of counters and gauges, exported by the agent to Prometheus, statsd or an
+// OpenTelemetry collector.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	kindCounter = "counter"
+	kindGauge   = "gauge"
+)
+
+// Registry holds a set of metrics.
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]*metric
+}
+
+// DefaultRegistry is the registry metrics are created in, and which Handler exposes.
+var DefaultRegistry = NewRegistry()
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{metrics: map[string]*metric{}}
+}
+
+type metric struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+	values     map[string]float64
+}
+
+func (r *Registry) register(name, help, kind string, labelNames []string) *metric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.metrics[name]; ok {
+		panic(fmt.Sprintf("metric %s registered twice", name))
+	}
+	m := &metric{name: name, help: help, kind: kind, labelNames: labelNames, values: map[string]float64{}}
+	r.metrics[name] = m
+	return m
+}
+
+// update applies f to the value of the series with the given label values.
+func (r *Registry) update(m *metric, labelValues []string, f func(float64) float64) {
+	if len(labelValues) != len(m.labelNames) {
+		panic(fmt.Sprintf("metric %s takes %d labels, got %d", m.name, len(m.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	r.mu.Lock()
+	m.values[key] = f(m.values[key])
+	r.mu.Unlock()
+}
+
+// reset removes every series of m.
+func (r *Registry) reset(m *metric) {
+	r.mu.Lock()
+	m.values = map[string]float64{}
+	r.mu.Unlock()
+}
+
+// Counter is a monotonically increasing metric.
+type Counter struct {
+	r *Registry
+	m *metric
+}
+
+// NewCounter creates a counter in the default registry.
+func NewCounter(name, help string, labelNames ...string) *Counter {
+	return DefaultRegistry.NewCounter(name, help, labelNames...)
+}
+
+// NewCounter creates a counter in the registry.
+func (r *Registry) NewCounter(name, help string, labelNames ...string) *Counter {
+	return &Counter{r: r, m: r.register(name, help, kindCounter, labelNames)}
+}
+
+// Add increases the series with the given label values by v.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	c.r.update(c.m, labelValues, func(old float64) float64 { return old + v })
+}
+
+// Inc increases the series with the given label values by one.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Set sets the series with the given label values to v, for counters mirroring a total kept elsewhere. v must not
+// be below the previous value of the series.
+func (c *Counter) Set(v float64, labelValues ...string) {
+	c.r.update(c.m, labelValues, func(float64) float64 { return v })
+}
+
+// Reset removes every series of the counter, for counters mirroring totals of objects that come and go.
+func (c *Counter) Reset() {
+	c.r.reset(c.m)
+}
+
+// Gauge is a metric that can go up and down.
+type Gauge struct {
+	r *Registry
+	m *metric
+}
+
+// NewGauge creates a gauge in the default registry.
+func NewGauge(name, help string, labelNames ...string) *Gauge {
+	return DefaultRegistry.NewGauge(name, help, labelNames...)
+}
+
+// NewGauge creates a gauge in the registry.
+func (r *Registry) NewGauge(name, help string, labelNames ...string) *Gauge {
+	return &Gauge{r: r, m: r.register(name, help, kindGauge, labelNames)}
+}
+
+// Set sets the series with the given label values to v.
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.r.update(g.m, labelValues, func(float64) float64 { return v })
+}
+
+// Reset removes every series of the gauge, for gauges whose label values come and go.
+func (g *Gauge) Reset() {
+	g.r.reset(g.m)
+}
+
+// Series is the value of a metric for one set of label values.
+type Series struct {
+	Labels map[string]string
+	Value  float64
+}
+
+// Family is a snapshot of a metric and all of its series.
+type Family struct {
+	Name   string
+	Help   string
+	Kind   string
+	Series []Series
+}
+
+// Gather returns a snapshot of all metrics, sorted by name and then by label values.
+func (r *Registry) Gather() []Family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var names []string
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	families := make([]Family, 0, len(names))
+	for _, name := range names {
+		m := r.metrics[name]
+		var keys []string
+		for key := range m.values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		f := Family{Name: m.name, Help: m.help, Kind: m.kind}
+		for _, key := range keys {
+			labels := map[string]string{}
+			if len(m.labelNames) > 0 {
+				for i, value := range strings.Split(key, "\xff") {
+					labels[m.labelNames[i]] = value
+				}
+			}
+			f.Series = append(f.Series, Series{Labels: labels, Value: m.values[key]})
+		}
+		families = append(families, f)
+	}
+	return families
+}
+
+// sortedLabelNames returns the label names of s in a stable order.
+func (s Series) sortedLabelNames() []string {
+	names := make([]string, 0, len(s.Labels))
+	for name := range s.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// WriteText writes all metrics in the Prometheus text exposition format.
+func (r *Registry) WriteText(w io.Writer) error {
+	for _, f := range r.Gather() {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.Name, f.Help, f.Name, f.Kind); err != nil {
+			return err
+		}
+		for _, s := range f.Series {
+			if _, err := fmt.Fprintf(w, "%s%s %v\n", f.Name, formatLabels(s), s.Value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func formatLabels(s Series) string {
+	if len(s.Labels) == 0 {
+		return ""
+	}
+	var pairs []string
+	for _, name := range s.sortedLabelNames() {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, s.Labels[name]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Handler serves the metrics of the registry in the Prometheus text format.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		r.WriteText(w)
+	})
+}
+
+// Handler serves the default registry.
+func Handler() http.Handler {
+	return DefaultRegistry.Handler()
+}
@@ -0,0 +1,144 @@
+package metrics_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/cni-plugin/metrics"
+)
+
+var _ = Describe("Registry", func() {
+	It("writes counters and gauges in the text format", func() {
+		r := metrics.NewRegistry()
+		c := r.NewCounter("test_total", "A counter.", "op")
+		g := r.NewGauge("test_gauge", "A gauge.")
+		c.Inc("add")
+		c.Add(2, "add")
+		c.Inc("del")
+		g.Set(7)
+
+		buf := &bytes.Buffer{}
+		Expect(r.WriteText(buf)).To(Succeed())
+		Expect(buf.String()).To(Equal(`# HELP test_gauge A gauge.
+# TYPE test_gauge gauge
+test_gauge 7
+# HELP test_total A counter.
+# TYPE test_total counter
+test_total{op="add"} 3
+test_total{op="del"} 1
+`))
+	})
+
+	It("drops the series of reset gauges", func() {
+		r := metrics.NewRegistry()
+		g := r.NewGauge("test_gauge", "A gauge.", "namespace")
+		g.Set(1, "a")
+		g.Reset()
+		g.Set(2, "b")
+
+		buf := &bytes.Buffer{}
+		Expect(r.WriteText(buf)).To(Succeed())
+		Expect(buf.String()).To(ContainSubstring(`test_gauge{namespace="b"} 2`))
+		Expect(buf.String()).NotTo(ContainSubstring(`namespace="a"`))
+	})
+
+	It("mirrors totals in counters", func() {
+		r := metrics.NewRegistry()
+		c := r.NewCounter("test_bytes_total", "A counter.", "pod")
+		c.Set(10, "a")
+		c.Set(20, "a")
+		c.Reset()
+		c.Set(5, "b")
+
+		buf := &bytes.Buffer{}
+		Expect(r.WriteText(buf)).To(Succeed())
+		Expect(buf.String()).To(ContainSubstring(`test_bytes_total{pod="b"} 5`))
+		Expect(buf.String()).NotTo(ContainSubstring(`pod="a"`))
+	})
+
+	It("rejects the wrong number of labels", func() {
+		c := metrics.NewRegistry().NewCounter("test_total", "A counter.", "op")
+		Expect(func() { c.Inc() }).To(Panic())
+	})
+})
+
+var _ = Describe("Exporters", func() {
+	var r *metrics.Registry
+
+	BeforeEach(func() {
+		r = metrics.NewRegistry()
+		r.NewCounter("test_total", "A counter.", "op").Add(3, "add")
+		r.NewGauge("test_gauge", "A gauge.").Set(7)
+	})
+
+	It("pushes counters and gauges to statsd", func() {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+
+		e := &metrics.StatsdExporter{Addr: conn.LocalAddr().String(), Prefix: "fc.", Interval: 10 * time.Millisecond}
+		Expect(e.Start(r)).To(Succeed())
+
+		buf := make([]byte, 1500)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(buf[:n])).To(Equal("fc.test_gauge:7|g\nfc.test_total:3|c|#op:add"))
+	})
+
+	It("pushes OTLP JSON", func() {
+		bodies := make(chan string, 10)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			body, _ := ioutil.ReadAll(req.Body)
+			bodies <- string(body)
+		}))
+		defer server.Close()
+
+		e := &metrics.OTLPExporter{Endpoint: server.URL, Interval: 10 * time.Millisecond}
+		Expect(e.Start(r)).To(Succeed())
+
+		var body string
+		Eventually(bodies).Should(Receive(&body))
+		Expect(body).To(ContainSubstring(`"name":"test_total"`))
+		Expect(body).To(ContainSubstring(`"isMonotonic":true`))
+		Expect(body).To(ContainSubstring(`"gauge":{"dataPoints"`))
+	})
+
+	It("rejects unknown backends", func() {
+		_, err := metrics.NewExporter("graphite", "")
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("Spool", func() {
+	It("adds spooled counters to the same counters of another registry", func() {
+		dir, err := ioutil.TempDir("", "spool")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		plugin := metrics.NewRegistry()
+		plugin.NewCounter("test_total", "A counter.", "op", "errno").Add(2, "QdiscAdd", "EBUSY")
+		plugin.NewGauge("test_gauge", "A gauge.").Set(7)
+		Expect(plugin.WriteSpool(dir)).To(Succeed())
+
+		agent := metrics.NewRegistry()
+		c := agent.NewCounter("test_total", "A counter.", "op", "errno")
+		c.Inc("QdiscAdd", "EBUSY")
+		Expect(agent.ReadSpool(dir)).To(Succeed())
+
+		buf := &bytes.Buffer{}
+		Expect(agent.WriteText(buf)).To(Succeed())
+		Expect(buf.String()).To(ContainSubstring(`test_total{errno="EBUSY",op="QdiscAdd"} 3`))
+
+		files, err := ioutil.ReadDir(dir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(files).To(BeEmpty())
+	})
+})
@@ -0,0 +1,120 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// otlpCumulative is AGGREGATION_TEMPORALITY_CUMULATIVE.
+const otlpCumulative = 2
+
+// OTLPExporter pushes the metrics to an OpenTelemetry collector using OTLP/HTTP with the JSON encoding, e.g. to
+// http://localhost:4318/v1/metrics.
+type OTLPExporter struct {
+	Endpoint string
+	Interval time.Duration
+
+	// ServiceName is reported as the service.name resource attribute.
+	ServiceName string
+
+	start  time.Time
+	client *http.Client
+}
+
+// Start implements Exporter.
+func (e *OTLPExporter) Start(r *Registry) error {
+	if e.Endpoint == "" {
+		return fmt.Errorf("no OTLP endpoint configured")
+	}
+	if e.ServiceName == "" {
+		e.ServiceName = "flowcontrol-agent"
+	}
+	e.start = time.Now()
+	e.client = &http.Client{Timeout: e.Interval}
+	go pushEvery(r, e.Interval, BackendOTLP, e.push)
+	return nil
+}
+
+type otlpKeyValue struct {
+	Key   string            `json:"key"`
+	Value map[string]string `json:"value"`
+}
+
+type otlpDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	AsDouble          float64        `json:"asDouble"`
+}
+
+type otlpMetric struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description,omitempty"`
+	Sum         map[string]interface{} `json:"sum,omitempty"`
+	Gauge       map[string]interface{} `json:"gauge,omitempty"`
+}
+
+func otlpString(key, value string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: map[string]string{"stringValue": value}}
+}
+
+// request builds the body of an ExportMetricsServiceRequest.
+func (e *OTLPExporter) request(families []Family, now time.Time) map[string]interface{} {
+	start := strconv.FormatInt(e.start.UnixNano(), 10)
+	ts := strconv.FormatInt(now.UnixNano(), 10)
+
+	var metrics []otlpMetric
+	for _, f := range families {
+		var points []otlpDataPoint
+		for _, s := range f.Series {
+			p := otlpDataPoint{StartTimeUnixNano: start, TimeUnixNano: ts, AsDouble: s.Value}
+			for _, name := range s.sortedLabelNames() {
+				p.Attributes = append(p.Attributes, otlpString(name, s.Labels[name]))
+			}
+			points = append(points, p)
+		}
+		m := otlpMetric{Name: f.Name, Description: f.Help}
+		if f.Kind == kindGauge {
+			m.Gauge = map[string]interface{}{"dataPoints": points}
+		} else {
+			m.Sum = map[string]interface{}{
+				"dataPoints":             points,
+				"aggregationTemporality": otlpCumulative,
+				"isMonotonic":            true,
+			}
+		}
+		metrics = append(metrics, m)
+	}
+
+	return map[string]interface{}{
+		"resourceMetrics": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpKeyValue{otlpString("service.name", e.ServiceName)},
+			},
+			"scopeMetrics": []interface{}{map[string]interface{}{
+				"scope":   map[string]string{"name": "github.com/projectcalico/cni-plugin/metrics"},
+				"metrics": metrics,
+			}},
+		}},
+	}
+}
+
+func (e *OTLPExporter) push(families []Family) error {
+	body, err := json.Marshal(e.request(families, time.Now()))
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.Endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("OTLP endpoint %s returned %s", e.Endpoint, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The CNI plugin runs for a moment per operation, so nothing can scrape it. Instead it spools its counters to a
+// directory before exiting, one new file per process, and the agent adds them to its own counters of the same
+// name.
+
+// WriteSpool writes the non-zero counters of r to a new file in dir. Nothing is written if there are none.
+func (r *Registry) WriteSpool(dir string) error {
+	var families []Family
+	for _, f := range r.Gather() {
+		if f.Kind == kindCounter && len(f.Series) > 0 {
+			families = append(families, f)
+		}
+	}
+	if len(families) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(families)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	// Write under a dot name first so that ReadSpool never sees a partial file.
+	name := fmt.Sprintf("%d-%d.json", time.Now().UnixNano(), os.Getpid())
+	tmp := filepath.Join(dir, "."+name)
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, name))
+}
+
+// ReadSpool adds the counters spooled in dir to the counters of r with the same names and label names, and removes
+// the files. Spooled series r has no matching counter for are dropped.
+func (r *Registry) ReadSpool(dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		// Remove the file before counting it, so that a file that can't be removed isn't counted repeatedly.
+		if err = os.Remove(path); err != nil {
+			return err
+		}
+		var families []Family
+		if err = json.Unmarshal(data, &families); err != nil {
+			continue
+		}
+		for _, fam := range families {
+			r.addSpooled(fam)
+		}
+	}
+	return nil
+}
+
+func (r *Registry) addSpooled(f Family) {
+	r.mu.Lock()
+	m, ok := r.metrics[f.Name]
+	r.mu.Unlock()
+	if !ok || m.kind != kindCounter {
+		return
+	}
+	for _, s := range f.Series {
+		if len(s.Labels) != len(m.labelNames) {
+			continue
+		}
+		values := make([]string, len(m.labelNames))
+		for i, labelName := range m.labelNames {
+			if values[i], ok = s.Labels[labelName]; !ok {
+				break
+			}
+		}
+		if ok {
+			v := s.Value
+			r.update(m, values, func(old float64) float64 { return old + v })
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// maxStatsdPacket keeps datagrams under the typical MTU so they aren't fragmented.
+const maxStatsdPacket = 1400
+
+// StatsdExporter pushes the metrics to a statsd agent over UDP. Counters are sent as the increase since the last
+// push and gauges as their value. Labels are sent as DogStatsD tags, which most current agents understand.
+type StatsdExporter struct {
+	Addr     string
+	Prefix   string
+	Interval time.Duration
+
+	conn net.Conn
+	sent map[string]float64
+}
+
+// Start implements Exporter.
+func (e *StatsdExporter) Start(r *Registry) error {
+	conn, err := net.Dial("udp", e.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to statsd at %s: %v", e.Addr, err)
+	}
+	e.conn = conn
+	e.sent = map[string]float64{}
+	go pushEvery(r, e.Interval, BackendStatsd, e.push)
+	return nil
+}
+
+func (e *StatsdExporter) push(families []Family) error {
+	var packet bytes.Buffer
+	for _, line := range e.lines(families) {
+		if packet.Len() > 0 && packet.Len()+len(line)+1 > maxStatsdPacket {
+			if _, err := e.conn.Write(packet.Bytes()); err != nil {
+				return err
+			}
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	if packet.Len() > 0 {
+		_, err := e.conn.Write(packet.Bytes())
+		return err
+	}
+	return nil
+}
+
+// lines formats the families as statsd lines, and remembers the counter values sent.
+func (e *StatsdExporter) lines(families []Family) []string {
+	var lines []string
+	for _, f := range families {
+		for _, s := range f.Series {
+			var tags []string
+			for _, name := range s.sortedLabelNames() {
+				tags = append(tags, name+":"+s.Labels[name])
+			}
+			suffix := ""
+			if len(tags) > 0 {
+				suffix = "|#" + strings.Join(tags, ",")
+			}
+
+			if f.Kind == kindGauge {
+				lines = append(lines, fmt.Sprintf("%s%s:%v|g%s", e.Prefix, f.Name, s.Value, suffix))
+				continue
+			}
+			key := f.Name + suffix
+			delta := s.Value - e.sent[key]
+			e.sent[key] = s.Value
+			if delta != 0 {
+				lines = append(lines, fmt.Sprintf("%s%s:%v|c%s", e.Prefix, f.Name, delta, suffix))
+			}
+		}
+	}
+	return lines
+}
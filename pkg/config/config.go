@@ -0,0 +1,111 @@
+// Package config parses and validates the network configuration of the plugin: the JSON the runtime passes it, with
+// the rates of the pod given like the Kubernetes bandwidth annotations.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/cni-plugin/utils"
+)
+
+// NetConf is the network configuration of the plugin. Its fields are the settings downstream code reads and sets;
+// the other settings of the configuration are kept as parsed and passed on to the plugin unchanged.
+type NetConf struct {
+	CNIVersion string
+	Name       string
+	Type       string
+	MTU        int
+	// StateDir is the directory the records of the pods are stored in.
+	StateDir string
+	// ShapingMode is where pods are shaped: on their veth, the default if empty, on the uplink or with nftables.
+	ShapingMode string
+	// IngressRate and EgressRate are the rates guaranteed to pods, and IngressCeil and EgressCeil the most they may
+	// borrow up to, as bandwidths like "10M".
+	IngressRate string
+	EgressRate  string
+	IngressCeil string
+	EgressCeil  string
+	// IngressBurst and EgressBurst are the buffers of the classes of each direction, in bytes, or zero for the
+	// default.
+	IngressBurst uint32
+	EgressBurst  uint32
+
+	// conf is the configuration as the plugin parsed it.
+	conf utils.NetConf
+}
+
+// netConf returns the configuration of the plugin with the settings of c.
+func (c *NetConf) netConf() utils.NetConf {
+	conf := c.conf
+	conf.CNIVersion, conf.Name, conf.Type, conf.MTU = c.CNIVersion, c.Name, c.Type, c.MTU
+	conf.StateDir, conf.ShapingMode = c.StateDir, c.ShapingMode
+	conf.IngressRate, conf.EgressRate = c.IngressRate, c.EgressRate
+	conf.IngressCeil, conf.EgressCeil = c.IngressCeil, c.EgressCeil
+	conf.IngressBurst, conf.EgressBurst = c.IngressBurst, c.EgressBurst
+	return conf
+}
+
+// setNetConf sets c to the configuration of the plugin conf.
+func (c *NetConf) setNetConf(conf utils.NetConf) {
+	*c = NetConf{
+		CNIVersion:   conf.CNIVersion,
+		Name:         conf.Name,
+		Type:         conf.Type,
+		MTU:          conf.MTU,
+		StateDir:     conf.StateDir,
+		ShapingMode:  conf.ShapingMode,
+		IngressRate:  conf.IngressRate,
+		EgressRate:   conf.EgressRate,
+		IngressCeil:  conf.IngressCeil,
+		EgressCeil:   conf.EgressCeil,
+		IngressBurst: conf.IngressBurst,
+		EgressBurst:  conf.EgressBurst,
+		conf:         conf,
+	}
+}
+
+// Rates are the limits of a pod, in bits per second, as the configuration and its bandwidths set them. A zero rate
+// leaves its direction unlimited, and a zero ceil keeps it to its rate.
+type Rates struct {
+	Ingress     uint64
+	Egress      uint64
+	IngressCeil uint64
+	EgressCeil  uint64
+}
+
+// Parse parses the network configuration data.
+func Parse(data []byte) (*NetConf, error) {
+	conf := utils.NetConf{}
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+	c := &NetConf{}
+	c.setNetConf(conf)
+	return c, nil
+}
+
+// ParseRates validates conf and returns the limits of a pod with the ingress and egress bandwidths, like "10M", of
+// which either may be empty for no limit.
+func ParseRates(conf *NetConf, ingress, egress string) (Rates, error) {
+	rates, err := utils.ParseShapingRates(conf.netConf(), ingress, egress, log.WithField("api", "config"))
+	if err != nil {
+		return Rates{}, err
+	}
+	return Rates{
+		Ingress:     rates.Ingress,
+		Egress:      rates.Egress,
+		IngressCeil: rates.IngressCeil,
+		EgressCeil:  rates.EgressCeil,
+	}, nil
+}
+
+// RuntimeBandwidth returns the bandwidths the runtime passed for the pod in the runtimeConfig of conf, empty for
+// the directions it passed none, and sets the bursts it passed in conf.
+func RuntimeBandwidth(conf *NetConf) (ingress, egress string) {
+	c := conf.netConf()
+	ingress, egress = utils.RuntimeBandwidth(&c)
+	conf.setNetConf(c)
+	return ingress, egress
+}
@@ -0,0 +1,116 @@
+// Package datapath changes, checks and removes the shaping of the pods the plugin recorded, in whichever mode they
+// are shaped.
+package datapath
+
+import (
+	"github.com/projectcalico/cni-plugin/pkg/state"
+	istate "github.com/projectcalico/cni-plugin/state"
+	"github.com/projectcalico/cni-plugin/utils"
+)
+
+// record returns the store of the plugin in the directory of store and the record it keeps for the pod of r.
+func record(store *state.Store, r *state.Record) (*istate.Store, *istate.Record, error) {
+	s := istate.NewStore(store.Dir())
+	rec, err := s.Load(istate.RecordKey(r.ContainerID, r.IfName))
+	return s, rec, err
+}
+
+// save saves rec in s, and updates r to it.
+func save(store *state.Store, s *istate.Store, rec *istate.Record, r *state.Record) error {
+	if err := s.Save(rec); err != nil {
+		return err
+	}
+	saved, err := store.Load(rec.ContainerID, rec.IfName)
+	if err != nil {
+		return err
+	}
+	*r = *saved
+	return nil
+}
+
+// SetRates changes the rates of the pod of r, in bits per second, keeping its ceils where they are still above them,
+// and records them in store and r. A zero rate leaves its direction alone.
+func SetRates(store *state.Store, r *state.Record, ingressRate, egressRate uint64) error {
+	s, rec, err := record(store, r)
+	if err != nil {
+		return err
+	}
+	if ingressRate == 0 {
+		ingressRate = rec.IngressRate
+	}
+	if egressRate == 0 {
+		egressRate = rec.EgressRate
+	}
+	if err = utils.SetRecordRates(rec, ingressRate, egressRate); err != nil {
+		return err
+	}
+	rec.IngressRate, rec.EgressRate = ingressRate, egressRate
+	if rec.IngressCeil <= ingressRate {
+		rec.IngressCeil = 0
+	}
+	if rec.EgressCeil <= egressRate {
+		rec.EgressCeil = 0
+	}
+	return save(store, s, rec, r)
+}
+
+// SetLimits changes the rates and ceils of the pod of r, in bits per second, and records them in store and r.
+func SetLimits(store *state.Store, r *state.Record, ingressRate, egressRate, ingressCeil, egressCeil uint64) error {
+	s, rec, err := record(store, r)
+	if err != nil {
+		return err
+	}
+	if err = utils.SetRecordLimits(rec, ingressRate, egressRate, ingressCeil, egressCeil); err != nil {
+		return err
+	}
+	rec.IngressRate, rec.EgressRate, rec.IngressCeil, rec.EgressCeil = ingressRate, egressRate, ingressCeil, egressCeil
+	return save(store, s, rec, r)
+}
+
+// Verify compares the shaping programmed for the pod of r with what store records of it, and returns the mismatches
+// found.
+func Verify(store *state.Store, r *state.Record) ([]string, error) {
+	_, rec, err := record(store, r)
+	if err != nil {
+		return nil, err
+	}
+	return utils.VerifyShaping(rec), nil
+}
+
+// Traffic returns what the classes of the pod of r counted, falling back on last for the directions that can't be
+// read.
+func Traffic(store *state.Store, r *state.Record, last state.Traffic) (state.Traffic, error) {
+	_, rec, err := record(store, r)
+	if err != nil {
+		return last, err
+	}
+	t := utils.ReadTraffic(rec, istate.Traffic{
+		IngressBytes:      last.IngressBytes,
+		IngressPackets:    last.IngressPackets,
+		IngressDrops:      last.IngressDrops,
+		IngressOverlimits: last.IngressOverlimits,
+		EgressBytes:       last.EgressBytes,
+		EgressPackets:     last.EgressPackets,
+		EgressDrops:       last.EgressDrops,
+		EgressOverlimits:  last.EgressOverlimits,
+	})
+	return state.Traffic{
+		IngressBytes:      t.IngressBytes,
+		IngressPackets:    t.IngressPackets,
+		IngressDrops:      t.IngressDrops,
+		IngressOverlimits: t.IngressOverlimits,
+		EgressBytes:       t.EgressBytes,
+		EgressPackets:     t.EgressPackets,
+		EgressDrops:       t.EgressDrops,
+		EgressOverlimits:  t.EgressOverlimits,
+	}, nil
+}
+
+// RemoveNICShaping removes the shaping of the pod of r on the uplink, if it is shaped there.
+func RemoveNICShaping(store *state.Store, r *state.Record) error {
+	s, rec, err := record(store, r)
+	if err != nil {
+		return err
+	}
+	return utils.CleanUpNICShaping(s, rec)
+}
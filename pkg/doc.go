@@ -0,0 +1,16 @@
+// Package pkg holds the public Go API of the plugin, for operators and tools that drive its shaping from their own
+// code. The packages under it are covered by semantic versioning with the release tags: their exported names only
+// change incompatibly in a major release. Everything else in the repository, including the utils, shaping and state
+// packages these wrap, is internal to the plugin and changes shape as it needs to. The types of the packages under
+// pkg are their own, converted to and from the internal ones, so that the internal types can change without changing
+// the API.
+//
+//   - config parses and validates the network configuration of the plugin.
+//   - state reads the records of the pods it shapes.
+//   - shaping programs the tc hierarchies shaping a device.
+//   - datapath changes, checks and removes the shaping of recorded pods.
+//   - flowcontrol shapes devices of the caller's own by name, without records.
+package pkg
+
+// APIVersion is the version of the API of the packages under pkg. It follows the release it ships in.
+const APIVersion = "v1.0.0"
@@ -0,0 +1,100 @@
+// Package flowcontrol shapes network devices by name with the tc hierarchies the plugin shapes pods with, for Go
+// programs, like device plugins and operators, that shape devices of their own without running the plugin. It keeps
+// no records: the devices it shapes are the caller's to track.
+package flowcontrol
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/projectcalico/cni-plugin/internal/util"
+	"github.com/projectcalico/cni-plugin/shaping"
+	"github.com/vishvananda/netlink"
+)
+
+// ifbPrefix starts the names of the IFB devices the received traffic of devices is shaped on.
+const ifbPrefix = "fcl"
+
+// Limits are the rates, in bits per second, a device is shaped to: Egress for what it transmits and Ingress for
+// what it receives. A zero rate leaves its direction unshaped.
+type Limits struct {
+	Egress  uint64
+	Ingress uint64
+	// EgressBurst and IngressBurst are the buffers of the classes of each direction, in bytes, or zero for
+	// DefaultBurst.
+	EgressBurst  uint32
+	IngressBurst uint32
+	// Ceil, if above the rates, is the most either direction may send by borrowing above its rate.
+	Ceil uint64
+}
+
+// Stats are what the shaping of a device counted, for each direction.
+type Stats struct {
+	EgressBytes       uint64
+	EgressPackets     uint64
+	EgressDrops       uint64
+	EgressOverlimits  uint64
+	IngressBytes      uint64
+	IngressPackets    uint64
+	IngressDrops      uint64
+	IngressOverlimits uint64
+}
+
+// DefaultBurst is the buffer, in bytes, of a direction whose burst Limits leaves unset.
+const DefaultBurst = shaping.DefaultBurst
+
+// ApplyLimits shapes the device linkName to limits, replacing the limits it was shaped to before.
+func ApplyLimits(linkName string, limits Limits) error {
+	link, err := netlink.LinkByName(linkName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", linkName, err)
+	}
+	return shaping.ApplyLimits(link, ifbName(linkName), shaping.Limits{
+		Egress:       limits.Egress,
+		Ingress:      limits.Ingress,
+		EgressBurst:  limits.EgressBurst,
+		IngressBurst: limits.IngressBurst,
+		Ceil:         limits.Ceil,
+	})
+}
+
+// RemoveLimits removes the shaping of the device linkName, with the IFB device its received traffic was shaped on.
+func RemoveLimits(linkName string) error {
+	link, err := netlink.LinkByName(linkName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", linkName, err)
+	}
+	shaping.Teardown(link)
+	_, err = shaping.DeleteIFB(ifbName(linkName))
+	return err
+}
+
+// GetStats returns what the shaping of the device linkName counted since it was applied.
+func GetStats(linkName string) (Stats, error) {
+	link, err := netlink.LinkByName(linkName)
+	if err != nil {
+		return Stats{}, fmt.Errorf("failed to lookup %q: %v", linkName, err)
+	}
+	stats, err := shaping.ReadStats(link, ifbName(linkName))
+	if err != nil {
+		return Stats{}, err
+	}
+	return Stats{
+		EgressBytes:       stats.EgressBytes,
+		EgressPackets:     stats.EgressPackets,
+		EgressDrops:       stats.EgressDrops,
+		EgressOverlimits:  stats.EgressOverlimits,
+		IngressBytes:      stats.IngressBytes,
+		IngressPackets:    stats.IngressPackets,
+		IngressDrops:      stats.IngressDrops,
+		IngressOverlimits: stats.IngressOverlimits,
+	}, nil
+}
+
+// ifbName returns the name of the IFB device of linkName, after a hash of it, as the names of the two can't both
+// fit an interface name.
+func ifbName(linkName string) string {
+	sum := sha1.Sum([]byte(linkName))
+	return util.TruncateIfName(ifbPrefix + hex.EncodeToString(sum[:]))
+}
@@ -0,0 +1,118 @@
+// Package shaping programs the tc hierarchies shaping the traffic of a device: an HTB qdisc at its root shapes what
+// it transmits, and what it receives is redirected to an IFB device whose root HTB qdisc shapes it. It knows nothing
+// of CNI or of the records of the plugin.
+package shaping
+
+import (
+	"github.com/projectcalico/cni-plugin/shaping"
+	"github.com/vishvananda/netlink"
+)
+
+// MaxDSCP is the largest DSCP traffic can be marked with.
+const MaxDSCP = shaping.MaxDSCP
+
+// Shaper programs the classes and filters of one generation of the shaping of a device.
+type Shaper struct {
+	// Generation is the generation, 0 or 1, of the classes and filters.
+	Generation int
+	// Prio is the HTB priority of the classes; 0 is served first when classes share a parent.
+	Prio uint32
+	// Cbuffer is how much the classes may send back to back above their rate, in bytes, or zero for the kernel's
+	// default.
+	Cbuffer uint32
+	// Ceil, if above the rate, is the most the classes may send, in bits per second, by borrowing from a parent
+	// class of that rate.
+	Ceil uint64
+	// LowLatency attaches an fq_codel qdisc under the classes so that their queues are kept short, whatever Leaf.
+	LowLatency bool
+	// Leaf is the qdisc attached under the classes: LeafFQCodel, LeafSFQ, LeafPFIFO or, if empty, none.
+	Leaf string
+	// SeparateIPv6 gives IPv6 traffic a class of its own with the full rate, rather than sharing the IPv4 class.
+	SeparateIPv6 bool
+	// NonIP is what is done with traffic that is neither IPv4 nor IPv6: NonIPUnshaped, the default if empty,
+	// NonIPShaped or NonIPDrop.
+	NonIP string
+	// DSCP, if set, is marked on the IP traffic SetupIngress redirects.
+	DSCP *uint8
+}
+
+// shaper returns the shaper of the shaping package programming what s describes.
+func (s *Shaper) shaper() *shaping.Shaper {
+	return &shaping.Shaper{
+		Generation:   s.Generation,
+		Prio:         s.Prio,
+		Cbuffer:      s.Cbuffer,
+		Ceil:         s.Ceil,
+		LowLatency:   s.LowLatency,
+		Leaf:         s.Leaf,
+		SeparateIPv6: s.SeparateIPv6,
+		NonIP:        s.NonIP,
+		DSCP:         s.DSCP,
+	}
+}
+
+// SetupEgress shapes the traffic link transmits to rate bits per second with an HTB qdisc at the root of link, with
+// classes of burst bytes of buffer.
+func (s *Shaper) SetupEgress(link netlink.Link, rate uint64, burst uint32) error {
+	return apiError(s.shaper().SetupEgress(link, rate, burst))
+}
+
+// SetupIngress shapes the traffic link receives to rate bits per second, by redirecting it to the IFB device
+// ifbName, which is created if needed, and shaping it there, with classes of burst bytes of buffer.
+func (s *Shaper) SetupIngress(link netlink.Link, ifbName string, rate uint64, burst uint32) error {
+	return apiError(s.shaper().SetupIngress(link, ifbName, rate, burst))
+}
+
+// What the shaping of a device does with traffic that is neither IPv4 nor IPv6, for Shaper.NonIP.
+const (
+	NonIPUnshaped = shaping.NonIPUnshaped
+	NonIPShaped   = shaping.NonIPShaped
+	NonIPDrop     = shaping.NonIPDrop
+)
+
+// Leaf qdiscs that can be attached under the classes, for Shaper.Leaf.
+const (
+	LeafFQCodel = shaping.LeafFQCodel
+	LeafSFQ     = shaping.LeafSFQ
+	LeafPFIFO   = shaping.LeafPFIFO
+)
+
+// ConflictError is returned when a device the shaping needs exists as something else.
+type ConflictError struct {
+	Err error
+}
+
+func (e *ConflictError) Error() string {
+	return e.Err.Error()
+}
+
+// apiError returns err with the errors of the shaping package this package documents converted to its own.
+func apiError(err error) error {
+	if c, ok := err.(*shaping.ConflictError); ok {
+		return &ConflictError{Err: c.Err}
+	}
+	return err
+}
+
+// Teardown removes the shaping programmed on link, of every generation. The IFB device its traffic was redirected
+// to is left to the caller; see DeleteIFB.
+func Teardown(link netlink.Link) {
+	shaping.Teardown(link)
+}
+
+// EnsureIFB returns the IFB device name, creating it and setting it up if needed.
+func EnsureIFB(name string) (netlink.Link, error) {
+	link, err := shaping.EnsureIFB(name)
+	return link, apiError(err)
+}
+
+// DeleteIFB deletes the IFB device name, and reports whether there was one.
+func DeleteIFB(name string) (bool, error) {
+	return shaping.DeleteIFB(name)
+}
+
+// SetupPolicer polices what link receives to rate bits per second, with burst bytes of credit, for kernels that
+// can't create IFB devices to shape it on.
+func SetupPolicer(link netlink.Link, rate uint64, burst uint32) error {
+	return shaping.SetupPolicer(link, rate, burst)
+}
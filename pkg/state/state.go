@@ -0,0 +1,130 @@
+// Package state reads the records the plugin keeps of the pods it shapes, which the agent and flowctl act on.
+package state
+
+import (
+	"time"
+
+	"github.com/projectcalico/cni-plugin/state"
+)
+
+// DefaultDir is the directory records are stored in when none is configured.
+const DefaultDir = state.DefaultDir
+
+// ErrNotFound is returned when no record is stored for a container.
+var ErrNotFound = state.ErrNotFound
+
+// Store is a directory of records, one per container.
+type Store struct {
+	store *state.Store
+}
+
+// Record is what the plugin set up for a container: its devices, its limits and how they are enforced.
+type Record struct {
+	ContainerID string
+	// IfName is the interface of the container the record is of.
+	IfName    string
+	Namespace string
+	Pod       string
+
+	// HostVeth is the host end of the veth of the container, and IFB the device its traffic leaving the pod is
+	// shaped on, if it has one.
+	HostVeth string
+	IFB      string
+	// ShapingMode is where the pod is shaped: on its veth, on the uplink or with nftables.
+	ShapingMode string
+
+	// IngressRate and EgressRate are the rates of the pod in bits per second, zero for an unlimited direction, and
+	// IngressCeil and EgressCeil the most it may borrow up to, zero when it is kept to its rates.
+	IngressRate uint64
+	EgressRate  uint64
+	IngressCeil uint64
+	EgressCeil  uint64
+	Classes     []TrafficClass
+
+	// Status is whether the limits of the pod are applied, and StatusReason why not if they aren't.
+	Status       string
+	StatusReason string
+	// Paused is set while the shaping of the pod is paused.
+	Paused bool
+
+	Updated time.Time
+}
+
+// TrafficClass is a class the traffic of a pod matching it is shaped in, apart from the rest.
+type TrafficClass struct {
+	Name      string
+	Direction string
+	// Rate and Ceil are the guaranteed and the most the class may send, in bits per second.
+	Rate uint64
+	Ceil uint64
+}
+
+// Traffic is what the classes of a pod counted.
+type Traffic struct {
+	IngressBytes      uint64
+	IngressPackets    uint64
+	IngressDrops      uint64
+	IngressOverlimits uint64
+	EgressBytes       uint64
+	EgressPackets     uint64
+	EgressDrops       uint64
+	EgressOverlimits  uint64
+}
+
+// Open returns the store of the records in dir, or in DefaultDir if dir is empty.
+func Open(dir string) *Store {
+	return &Store{store: state.NewStore(dir)}
+}
+
+// Dir returns the directory of s.
+func (s *Store) Dir() string {
+	return s.store.Dir
+}
+
+// Load returns the record of the interface ifName of the container containerID, or ErrNotFound.
+func (s *Store) Load(containerID, ifName string) (*Record, error) {
+	r, err := s.store.Load(state.RecordKey(containerID, ifName))
+	if err != nil {
+		return nil, err
+	}
+	return recordOf(r), nil
+}
+
+// List returns the records in s.
+func (s *Store) List() ([]*Record, error) {
+	records, err := s.store.List()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*Record, 0, len(records))
+	for _, r := range records {
+		list = append(list, recordOf(r))
+	}
+	return list, nil
+}
+
+// recordOf returns the record of the API for the record r of the plugin.
+func recordOf(r *state.Record) *Record {
+	record := &Record{
+		ContainerID:  r.ContainerID,
+		IfName:       r.IfName,
+		Namespace:    r.Namespace,
+		Pod:          r.Pod,
+		HostVeth:     r.HostVeth,
+		IFB:          r.IFB,
+		ShapingMode:  r.ShapingMode,
+		IngressRate:  r.IngressRate,
+		EgressRate:   r.EgressRate,
+		IngressCeil:  r.IngressCeil,
+		EgressCeil:   r.EgressCeil,
+		Status:       r.Status,
+		StatusReason: r.StatusReason,
+		Paused:       r.Paused,
+		Updated:      r.Updated,
+	}
+	for _, c := range r.Classes {
+		record.Classes = append(record.Classes, TrafficClass{Name: c.Name, Direction: c.Direction, Rate: c.Rate,
+			Ceil: c.Ceil})
+	}
+	return record
+}
@@ -0,0 +1,289 @@
+// Package policy holds the cluster-wide flow control defaults. Platform operators publish them in a ConfigMap,
+// which the agent on each node copies to a local file for the CNI plugin to read on ADD, so that changing them
+// doesn't require rewriting the CNI configuration of every node.
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/projectcalico/cni-plugin/state"
+)
+
+const (
+	// ConfigMapKey is the key of the ConfigMap data holding the policy document.
+	ConfigMapKey = "policy.json"
+
+	// PresetAnnotation selects one of the policy's presets for a pod.
+	PresetAnnotation = "flowcontrol.cni/preset"
+	// DNSRateLimitAnnotation, ICMPRateLimitAnnotation and ICMPv6RateLimitAnnotation override the policy's packet
+	// rate limits for a pod, in packets per second. 0 lifts a limit.
+	DNSRateLimitAnnotation    = "flowcontrol.cni/dns-rate-limit"
+	ICMPRateLimitAnnotation   = "flowcontrol.cni/icmp-rate-limit"
+	ICMPv6RateLimitAnnotation = "flowcontrol.cni/icmpv6-rate-limit"
+
+	ingressAnnotation = "kubernetes.io/ingress-bandwidth"
+	egressAnnotation  = "kubernetes.io/egress-bandwidth"
+
+	// MaxClassPriority is the lowest HTB priority a PriorityClass can be given.
+	MaxClassPriority = 7
+)
+
+// Rates are a pair of limits in bits per second, from the point of view of the pod. Zero means unlimited.
+type Rates struct {
+	Ingress uint64 `json:"ingress"`
+	Egress  uint64 `json:"egress"`
+}
+
+// Treatment is how the pods of a Kubernetes PriorityClass are shaped.
+type Treatment struct {
+	// Preset is the preset pods of the class without bandwidth or preset annotations get their rates from, in place
+	// of DefaultPreset.
+	Preset string `json:"preset,omitempty"`
+	// ClassPriority is the HTB priority of the classes of the pods, from 0, which is served first when classes
+	// share spare bandwidth and the priority of pods without a treatment, to MaxClassPriority. Priority 0 is kept for
+	// pods in the low latency class, so the classes of other pods get at least 1.
+	ClassPriority uint32 `json:"classPriority,omitempty"`
+}
+
+// Policy is the cluster-wide flow control policy.
+type Policy struct {
+	// Presets are named rates pods can select with the flowcontrol.cni/preset annotation.
+	Presets map[string]Rates `json:"presets,omitempty"`
+	// DefaultPreset, if set, applies to pods without bandwidth annotations.
+	DefaultPreset string `json:"defaultPreset,omitempty"`
+	// ExemptNamespaces are never shaped.
+	ExemptNamespaces []string `json:"exemptNamespaces,omitempty"`
+	// DNSRateLimit, if set, polices the DNS queries of every pod, to port 53 over UDP and TCP, to this many packets
+	// per second, so that a flooding workload can't overwhelm cluster DNS.
+	DNSRateLimit uint64 `json:"dnsRateLimit,omitempty"`
+	// ICMPRateLimit and ICMPv6RateLimit, if set, police the ICMP and ICMPv6 of every pod to this many packets per
+	// second, against ping floods and traceroute storms.
+	ICMPRateLimit   uint64 `json:"icmpRateLimit,omitempty"`
+	ICMPv6RateLimit uint64 `json:"icmpv6RateLimit,omitempty"`
+	// NodeCapacity is the uplink capacity in bits per second by instance type. No pod is given a limit above the
+	// capacity of its node.
+	NodeCapacity map[string]uint64 `json:"nodeCapacity,omitempty"`
+	// PriorityClasses are the treatments of pods by the name of their Kubernetes PriorityClass, so that
+	// cluster-critical pods get better treatment without bandwidth annotations of their own.
+	PriorityClasses map[string]Treatment `json:"priorityClasses,omitempty"`
+	// Templates compute the rates and class priority of pods from their namespace, labels and annotations, in
+	// place of their annotations and presets. The first template matching a pod applies.
+	Templates []Template `json:"templates,omitempty"`
+
+	// Capacity is the entry of NodeCapacity for the local node, resolved by the agent, or the bandwidth of its
+	// instance type discovered from cloud metadata.
+	Capacity uint64 `json:"capacity,omitempty"`
+	// DefaultPriorityClass is the PriorityClass marked as the global default, resolved by the agent, which pods
+	// without a PriorityClass are treated as.
+	DefaultPriorityClass string `json:"defaultPriorityClass,omitempty"`
+}
+
+// Parse decodes and validates a policy document.
+func Parse(data []byte) (*Policy, error) {
+	p := &Policy{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("failed to parse flow control policy: %v", err)
+	}
+	if _, ok := p.Presets[p.DefaultPreset]; p.DefaultPreset != "" && !ok {
+		return nil, fmt.Errorf("default preset %q is not defined", p.DefaultPreset)
+	}
+	for name, t := range p.PriorityClasses {
+		if _, ok := p.Presets[t.Preset]; t.Preset != "" && !ok {
+			return nil, fmt.Errorf("preset %q of priority class %q is not defined", t.Preset, name)
+		}
+		if t.ClassPriority > MaxClassPriority {
+			return nil, fmt.Errorf("class priority %d of priority class %q is above %d", t.ClassPriority, name, MaxClassPriority)
+		}
+	}
+	names := map[string]bool{}
+	for i := range p.Templates {
+		t := &p.Templates[i]
+		if t.Name == "" || names[t.Name] {
+			return nil, fmt.Errorf("template %d must have a unique name", i)
+		}
+		names[t.Name] = true
+		if err := t.compile(); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func path(dir string) string {
+	if dir == "" {
+		dir = state.DefaultDir
+	}
+	return filepath.Join(dir, "policy", "cluster.json")
+}
+
+// Load reads the local copy of the policy from the state directory. If there is none, an empty policy is returned.
+func Load(dir string) (*Policy, error) {
+	data, err := ioutil.ReadFile(path(dir))
+	if os.IsNotExist(err) {
+		return &Policy{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Save writes the local copy of the policy to the state directory, atomically.
+func Save(dir string, p *Policy) error {
+	file := path(dir)
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// Remove deletes the local copy of the policy. Removing a missing policy is not an error.
+func Remove(dir string) error {
+	if err := os.Remove(path(dir)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Exempt reports whether pods in namespace are exempt from shaping.
+func (p *Policy) Exempt(namespace string) bool {
+	for _, ns := range p.ExemptNamespaces {
+		if ns == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// Treatment returns the name of the PriorityClass a pod in priorityClass is treated as, its own or DefaultPriorityClass
+// if it has none, and the treatment of that class, if the policy has one.
+func (p *Policy) Treatment(priorityClass string) (string, Treatment, bool) {
+	if priorityClass == "" {
+		priorityClass = p.DefaultPriorityClass
+	}
+	t, ok := p.PriorityClasses[priorityClass]
+	return priorityClass, t, ok
+}
+
+// WithTreatment returns the policy applying to pods given treatment t: a copy of p with the preset of t, if any, as
+// the default preset.
+func (p *Policy) WithTreatment(t Treatment) *Policy {
+	withTreatment := *p
+	if t.Preset != "" {
+		withTreatment.DefaultPreset = t.Preset
+	}
+	return &withTreatment
+}
+
+// Apply returns the ingress and egress bandwidth of a pod, in the annotation format, given its namespace and
+// annotations: nothing for exempt namespaces, otherwise the annotated rates, falling back to the selected or
+// default preset, and capped at the node capacity.
+func (p *Policy) Apply(namespace string, annotations map[string]string) (ingress, egress string) {
+	if p.Exempt(namespace) {
+		return "", ""
+	}
+	ingress, egress = annotations[ingressAnnotation], annotations[egressAnnotation]
+	if rates, ok := p.Presets[p.Preset(namespace, annotations)]; ok {
+		if ingress == "" && rates.Ingress != 0 {
+			ingress = strconv.FormatUint(rates.Ingress, 10)
+		}
+		if egress == "" && rates.Egress != 0 {
+			egress = strconv.FormatUint(rates.Egress, 10)
+		}
+	}
+	return p.capRate(ingress), p.capRate(egress)
+}
+
+// Preset returns the name of the preset Apply fills in the rates of a pod from, or "" if none applies.
+func (p *Policy) Preset(namespace string, annotations map[string]string) string {
+	if p.Exempt(namespace) {
+		return ""
+	}
+	preset := annotations[PresetAnnotation]
+	if preset == "" && annotations[ingressAnnotation] == "" && annotations[egressAnnotation] == "" {
+		preset = p.DefaultPreset
+	}
+	if _, ok := p.Presets[preset]; !ok {
+		return ""
+	}
+	return preset
+}
+
+// PacketRates returns the rates in packets per second the DNS queries, ICMP and ICMPv6 of a pod are policed to,
+// given its namespace and annotations: nothing for exempt namespaces, otherwise the annotated limits, falling back
+// to the policy's.
+func (p *Policy) PacketRates(namespace string, annotations map[string]string) (dns, icmp, icmpv6 uint64) {
+	if p.Exempt(namespace) {
+		return 0, 0, 0
+	}
+	return packetRate(annotations[DNSRateLimitAnnotation], p.DNSRateLimit),
+		packetRate(annotations[ICMPRateLimitAnnotation], p.ICMPRateLimit),
+		packetRate(annotations[ICMPv6RateLimitAnnotation], p.ICMPv6RateLimit)
+}
+
+// packetRate parses an annotated packet rate limit, falling back to def if it is unset or invalid.
+func packetRate(annotation string, def uint64) uint64 {
+	if limit, err := strconv.ParseUint(annotation, 10, 64); err == nil {
+		return limit
+	}
+	return def
+}
+
+// rateSuffixes are the multipliers of the suffixes ParseRate accepts, those of Kubernetes quantities.
+var rateSuffixes = map[string]float64{
+	"":   1,
+	"k":  1e3,
+	"M":  1e6,
+	"G":  1e9,
+	"T":  1e12,
+	"Ki": 1 << 10,
+	"Mi": 1 << 20,
+	"Gi": 1 << 30,
+	"Ti": 1 << 40,
+}
+
+// ParseRate parses a bandwidth annotation into bits per second. Besides plain integers it accepts decimal and
+// binary suffixes and fractions, such as "10M" or "0.5M", rounding to the nearest bit.
+func ParseRate(rate string) (uint64, error) {
+	i := strings.IndexFunc(rate, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i < 0 {
+		i = len(rate)
+	}
+	mult, ok := rateSuffixes[rate[i:]]
+	if !ok {
+		return 0, fmt.Errorf("invalid rate %q: unknown suffix %q", rate, rate[i:])
+	}
+	v, err := strconv.ParseFloat(rate[:i], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %q", rate)
+	}
+	v = math.Floor(v*mult + 0.5)
+	if v >= math.MaxUint64 {
+		return 0, fmt.Errorf("rate %q is out of range", rate)
+	}
+	return uint64(v), nil
+}
+
+func (p *Policy) capRate(rate string) string {
+	if p.Capacity == 0 || rate == "" {
+		return rate
+	}
+	if r, err := ParseRate(rate); err == nil && r > p.Capacity {
+		return strconv.FormatUint(p.Capacity, 10)
+	}
+	return rate
+}
@@ -0,0 +1,237 @@
+package policy_test
+
+import (
+	"io/ioutil"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/cni-plugin/policy"
+)
+
+var _ = Describe("Policy", func() {
+	var p *policy.Policy
+
+	BeforeEach(func() {
+		var err error
+		p, err = policy.Parse([]byte(`{
+			"presets": {"bronze": {"ingress": 1000000, "egress": 500000}, "silver": {"ingress": 5000000}},
+			"defaultPreset": "bronze",
+			"exemptNamespaces": ["kube-system"]
+		}`))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("rejects an undefined default preset", func() {
+		_, err := policy.Parse([]byte(`{"defaultPreset": "gold"}`))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("rejects invalid priority class treatments", func() {
+		_, err := policy.Parse([]byte(`{"priorityClasses": {"system-cluster-critical": {"preset": "gold"}}}`))
+		Expect(err).To(HaveOccurred())
+		_, err = policy.Parse([]byte(`{"priorityClasses": {"system-cluster-critical": {"classPriority": 8}}}`))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("applies the preset of the treatment of a priority class", func() {
+		p.PriorityClasses = map[string]policy.Treatment{
+			"system-cluster-critical": {Preset: "silver", ClassPriority: 0},
+			"batch":                   {ClassPriority: 5},
+		}
+
+		name, t, ok := p.Treatment("system-cluster-critical")
+		Expect(ok).To(BeTrue())
+		Expect(name).To(Equal("system-cluster-critical"))
+		ingress, _ := p.WithTreatment(t).Apply("default", nil)
+		Expect(ingress).To(Equal("5000000"))
+		Expect(p.WithTreatment(t).Preset("default", map[string]string{"flowcontrol.cni/preset": "bronze"})).To(Equal("bronze"))
+		Expect(p.DefaultPreset).To(Equal("bronze"))
+
+		_, t, ok = p.Treatment("batch")
+		Expect(ok).To(BeTrue())
+		Expect(t.ClassPriority).To(BeEquivalentTo(5))
+		Expect(p.WithTreatment(t).Preset("default", nil)).To(Equal("bronze"))
+
+		_, _, ok = p.Treatment("")
+		Expect(ok).To(BeFalse())
+		p.DefaultPriorityClass = "batch"
+		name, _, ok = p.Treatment("")
+		Expect(ok).To(BeTrue())
+		Expect(name).To(Equal("batch"))
+	})
+
+	It("applies the default preset to unannotated pods", func() {
+		ingress, egress := p.Apply("default", nil)
+		Expect(ingress).To(Equal("1000000"))
+		Expect(egress).To(Equal("500000"))
+	})
+
+	It("prefers annotations over the selected preset", func() {
+		ingress, egress := p.Apply("default", map[string]string{
+			"flowcontrol.cni/preset":         "silver",
+			"kubernetes.io/egress-bandwidth": "2000000",
+		})
+		Expect(ingress).To(Equal("5000000"))
+		Expect(egress).To(Equal("2000000"))
+	})
+
+	It("reports the preset rates came from", func() {
+		Expect(p.Preset("default", nil)).To(Equal("bronze"))
+		Expect(p.Preset("default", map[string]string{"flowcontrol.cni/preset": "silver"})).To(Equal("silver"))
+		Expect(p.Preset("default", map[string]string{"kubernetes.io/egress-bandwidth": "2000000"})).To(BeEmpty())
+		Expect(p.Preset("kube-system", nil)).To(BeEmpty())
+	})
+
+	It("lets pods override packet rate limits", func() {
+		p.DNSRateLimit, p.ICMPRateLimit = 100, 10
+		dns, icmp, icmpv6 := p.PacketRates("default", nil)
+		Expect([]uint64{dns, icmp, icmpv6}).To(Equal([]uint64{100, 10, 0}))
+
+		dns, icmp, icmpv6 = p.PacketRates("default", map[string]string{
+			"flowcontrol.cni/dns-rate-limit":    "0",
+			"flowcontrol.cni/icmp-rate-limit":   "lots",
+			"flowcontrol.cni/icmpv6-rate-limit": "20",
+		})
+		Expect([]uint64{dns, icmp, icmpv6}).To(Equal([]uint64{0, 10, 20}))
+
+		dns, icmp, icmpv6 = p.PacketRates("kube-system", nil)
+		Expect([]uint64{dns, icmp, icmpv6}).To(Equal([]uint64{0, 0, 0}))
+	})
+
+	It("doesn't shape exempt namespaces", func() {
+		ingress, egress := p.Apply("kube-system", map[string]string{"kubernetes.io/ingress-bandwidth": "1000"})
+		Expect(ingress).To(BeEmpty())
+		Expect(egress).To(BeEmpty())
+	})
+
+	It("caps rates at the node capacity", func() {
+		p.Capacity = 700000
+		ingress, egress := p.Apply("default", nil)
+		Expect(ingress).To(Equal("700000"))
+		Expect(egress).To(Equal("500000"))
+	})
+
+	It("caps suffixed rates at the node capacity", func() {
+		p.Capacity = 700000
+		ingress, egress := p.Apply("default", map[string]string{
+			"kubernetes.io/ingress-bandwidth": "1M",
+			"kubernetes.io/egress-bandwidth":  "0.5M",
+		})
+		Expect(ingress).To(Equal("700000"))
+		Expect(egress).To(Equal("0.5M"))
+	})
+
+	It("round-trips through the state directory", func() {
+		dir, err := ioutil.TempDir("", "flowcontrol-policy")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		empty, err := policy.Load(dir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(empty.Presets).To(BeEmpty())
+
+		Expect(policy.Save(dir, p)).To(Succeed())
+		loaded, err := policy.Load(dir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(loaded.DefaultPreset).To(Equal("bronze"))
+
+		Expect(policy.Remove(dir)).To(Succeed())
+		Expect(policy.Remove(dir)).To(Succeed())
+	})
+})
+
+var _ = Describe("ParseRate", func() {
+	It("parses plain, suffixed and fractional rates", func() {
+		for rate, expected := range map[string]uint64{
+			"500000": 500000,
+			"10M":    10000000,
+			"0.5M":   500000,
+			"1.5k":   1500,
+			"64Ki":   65536,
+			"0.25":   0,
+			"0.5":    1,
+		} {
+			Expect(policy.ParseRate(rate)).To(Equal(expected), rate)
+		}
+	})
+
+	It("rejects malformed rates", func() {
+		for _, rate := range []string{"", "M", "10X", "-1", "1.2.3k"} {
+			_, err := policy.ParseRate(rate)
+			Expect(err).To(HaveOccurred(), rate)
+		}
+	})
+})
+
+var _ = Describe("Templates", func() {
+	var p *policy.Policy
+
+	BeforeEach(func() {
+		var err error
+		p, err = policy.Parse([]byte(`{
+			"exemptNamespaces": ["kube-system"],
+			"templates": [
+				{"name": "weighted", "selector": {"tier": "web"},
+				 "ingress": "{{ mul (rate \"10M\") (index .Labels \"replicasWeight\" | default \"1\") }}",
+				 "classPriority": "{{ if eq .Namespace \"prod\" }}1{{ else }}4{{ end }}"},
+				{"name": "batch", "namespaces": ["batch"], "egress": "500k"}
+			]
+		}`))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("renders the first matching template from the pod's metadata", func() {
+		r, err := p.Render(policy.Pod{Namespace: "prod", Labels: map[string]string{"tier": "web", "replicasWeight": "3"}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(r.Template).To(Equal("weighted"))
+		Expect(r.Ingress).To(Equal("30000000"))
+		Expect(r.Egress).To(BeEmpty())
+		Expect(*r.ClassPriority).To(BeEquivalentTo(1))
+
+		r, err = p.Render(policy.Pod{Namespace: "dev", Labels: map[string]string{"tier": "web"}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(r.Ingress).To(Equal("10000000"))
+		Expect(*r.ClassPriority).To(BeEquivalentTo(4))
+
+		r, err = p.Render(policy.Pod{Namespace: "batch"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(r.Template).To(Equal("batch"))
+		Expect(r.Egress).To(Equal("500000"))
+		Expect(r.ClassPriority).To(BeNil())
+	})
+
+	It("renders nothing for unmatched pods and exempt namespaces", func() {
+		Expect(p.Render(policy.Pod{Namespace: "dev"})).To(BeNil())
+		Expect(p.Render(policy.Pod{Namespace: "kube-system", Labels: map[string]string{"tier": "web"}})).To(BeNil())
+	})
+
+	It("caps rendered rates at the node capacity", func() {
+		p.Capacity = 20000000
+		r, err := p.Render(policy.Pod{Namespace: "dev", Labels: map[string]string{"tier": "web", "replicasWeight": "5"}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(r.Ingress).To(Equal("20000000"))
+	})
+
+	It("fails to render invalid results", func() {
+		_, err := p.Render(policy.Pod{Namespace: "dev", Labels: map[string]string{"tier": "web", "replicasWeight": "x"}})
+		Expect(err).To(HaveOccurred())
+
+		p, err = policy.Parse([]byte(`{"templates": [{"name": "t", "classPriority": "9"}]}`))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = p.Render(policy.Pod{})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("rejects templates that don't parse, are unnamed or call unknown functions", func() {
+		for _, doc := range []string{
+			`{"templates": [{"name": "t", "ingress": "{{ mul 1"}]}`,
+			`{"templates": [{"ingress": "1M"}]}`,
+			`{"templates": [{"name": "t"}, {"name": "t"}]}`,
+			`{"templates": [{"name": "t", "ingress": "{{ env \"HOME\" }}"}]}`,
+		} {
+			_, err := policy.Parse([]byte(doc))
+			Expect(err).To(HaveOccurred(), doc)
+		}
+	})
+})
@@ -0,0 +1,241 @@
+package policy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// maxTemplateOutput bounds what a template may render, so that a runaway template fails rather than growing
+// without limit.
+const maxTemplateOutput = 256
+
+// Template computes the rates and class priority of pods from their metadata, e.g.
+// `{{ mul (rate "10M") (index .Labels "replicasWeight" | default "1") }}` for 10Mbit/s per unit of weight. The
+// templates are Go text/templates restricted to the data of the pod and the arithmetic functions of templateFuncs.
+type Template struct {
+	Name string `json:"name"`
+	// Namespaces and Selector restrict the template to pods in one of the namespaces, if any, whose labels include
+	// those of the selector.
+	Namespaces []string          `json:"namespaces,omitempty"`
+	Selector   map[string]string `json:"selector,omitempty"`
+	// Ingress and Egress render to rates, as plain numbers of bits per second or in the format of the bandwidth
+	// annotations. A template that is unset or renders to nothing leaves the direction to the rest of the policy.
+	Ingress string `json:"ingress,omitempty"`
+	Egress  string `json:"egress,omitempty"`
+	// ClassPriority renders to the HTB priority of the pod's classes, from 0 to MaxClassPriority.
+	ClassPriority string `json:"classPriority,omitempty"`
+
+	ingress, egress, classPriority *template.Template
+}
+
+// Pod is the data templates are rendered with.
+type Pod struct {
+	Namespace   string
+	Name        string
+	Labels      map[string]string
+	Annotations map[string]string
+}
+
+// Rendered is what a template gives a pod. Empty rates and a nil ClassPriority are left to the rest of the policy.
+type Rendered struct {
+	Template      string
+	Ingress       string
+	Egress        string
+	ClassPriority *uint32
+}
+
+// templateFuncs are the only functions templates can call: conversions and arithmetic, on float64.
+var templateFuncs = template.FuncMap{
+	"rate": func(s string) (float64, error) {
+		r, err := ParseRate(s)
+		return float64(r), err
+	},
+	"num": toFloat,
+	"add": func(a, b interface{}) (float64, error) {
+		return arith(a, b, func(x, y float64) float64 { return x + y })
+	},
+	"sub": func(a, b interface{}) (float64, error) {
+		return arith(a, b, func(x, y float64) float64 { return x - y })
+	},
+	"mul": func(a, b interface{}) (float64, error) {
+		return arith(a, b, func(x, y float64) float64 { return x * y })
+	},
+	"div": func(a, b interface{}) (float64, error) {
+		if y, err := toFloat(b); err == nil && y == 0 {
+			return 0, errors.New("division by zero")
+		}
+		return arith(a, b, func(x, y float64) float64 { return x / y })
+	},
+	"min": func(a, b interface{}) (float64, error) { return arith(a, b, math.Min) },
+	"max": func(a, b interface{}) (float64, error) { return arith(a, b, math.Max) },
+	// default returns value, or def if value is empty, so that missing labels can be piped into it.
+	"default": func(def, value string) string {
+		if value == "" {
+			return def
+		}
+		return value
+	},
+}
+
+func toFloat(v interface{}) (float64, error) {
+	switch v := v.(type) {
+	case float64:
+		return v, nil
+	case int:
+		return float64(v), nil
+	case string:
+		return strconv.ParseFloat(strings.TrimSpace(v), 64)
+	}
+	return 0, fmt.Errorf("%v is not a number", v)
+}
+
+func arith(a, b interface{}, op func(x, y float64) float64) (float64, error) {
+	x, err := toFloat(a)
+	if err != nil {
+		return 0, err
+	}
+	y, err := toFloat(b)
+	if err != nil {
+		return 0, err
+	}
+	return op(x, y), nil
+}
+
+// compile parses the templates of t.
+func (t *Template) compile() error {
+	var err error
+	for _, field := range []struct {
+		name string
+		text string
+		tmpl **template.Template
+	}{
+		{"ingress", t.Ingress, &t.ingress},
+		{"egress", t.Egress, &t.egress},
+		{"classPriority", t.ClassPriority, &t.classPriority},
+	} {
+		if field.text == "" {
+			continue
+		}
+		*field.tmpl, err = template.New(field.name).Funcs(templateFuncs).Option("missingkey=zero").Parse(field.text)
+		if err != nil {
+			return fmt.Errorf("invalid %s of template %q: %v", field.name, t.Name, err)
+		}
+	}
+	return nil
+}
+
+// matches reports whether t applies to pod.
+func (t *Template) matches(pod Pod) bool {
+	if len(t.Namespaces) > 0 {
+		found := false
+		for _, ns := range t.Namespaces {
+			found = found || ns == pod.Namespace
+		}
+		if !found {
+			return false
+		}
+	}
+	for k, v := range t.Selector {
+		if pod.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// limitedBuffer fails writes beyond maxTemplateOutput.
+type limitedBuffer struct {
+	bytes.Buffer
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > maxTemplateOutput {
+		return 0, errors.New("template output too long")
+	}
+	return b.Buffer.Write(p)
+}
+
+func execute(tmpl *template.Template, pod Pod) (string, error) {
+	if tmpl == nil {
+		return "", nil
+	}
+	var out limitedBuffer
+	if err := tmpl.Execute(&out, pod); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out.String()), nil
+}
+
+// renderRate renders a rate template into bits per second, in the annotation format.
+func renderRate(tmpl *template.Template, pod Pod) (string, error) {
+	s, err := execute(tmpl, pod)
+	if err != nil || s == "" {
+		return "", err
+	}
+	// Arithmetic renders floats, possibly with exponents, which ParseRate doesn't take.
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		if f < 0 || f >= math.MaxUint64 {
+			return "", fmt.Errorf("rate %s is out of range", s)
+		}
+		return strconv.FormatUint(uint64(math.Floor(f+0.5)), 10), nil
+	}
+	r, err := ParseRate(s)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatUint(r, 10), nil
+}
+
+// Render returns what the first template matching pod gives it, or nil if none matches or its namespace is
+// exempt. Rates are capped at the node capacity.
+func (p *Policy) Render(pod Pod) (*Rendered, error) {
+	if p.Exempt(pod.Namespace) {
+		return nil, nil
+	}
+	for i := range p.Templates {
+		t := &p.Templates[i]
+		if !t.matches(pod) {
+			continue
+		}
+		if err := t.ensureCompiled(); err != nil {
+			return nil, err
+		}
+		r := &Rendered{Template: t.Name}
+		var err error
+		if r.Ingress, err = renderRate(t.ingress, pod); err != nil {
+			return nil, fmt.Errorf("failed to render ingress of template %q: %v", t.Name, err)
+		}
+		if r.Egress, err = renderRate(t.egress, pod); err != nil {
+			return nil, fmt.Errorf("failed to render egress of template %q: %v", t.Name, err)
+		}
+		s, err := execute(t.classPriority, pod)
+		if err != nil {
+			return nil, fmt.Errorf("failed to render class priority of template %q: %v", t.Name, err)
+		}
+		if s != "" {
+			prio, err := strconv.ParseUint(s, 10, 32)
+			if err != nil || prio > MaxClassPriority {
+				return nil, fmt.Errorf("class priority %q of template %q is not between 0 and %d", s, t.Name,
+					MaxClassPriority)
+			}
+			classPriority := uint32(prio)
+			r.ClassPriority = &classPriority
+		}
+		r.Ingress, r.Egress = p.capRate(r.Ingress), p.capRate(r.Egress)
+		return r, nil
+	}
+	return nil, nil
+}
+
+// ensureCompiled compiles the templates of a policy built without Parse.
+func (t *Template) ensureCompiled() error {
+	if t.ingress != nil || t.egress != nil || t.classPriority != nil {
+		return nil
+	}
+	return t.compile()
+}
@@ -0,0 +1,210 @@
+// Package quota implements per-namespace bandwidth quotas, in the spirit of Kubernetes ResourceQuotas. Operators
+// create BandwidthQuota objects, a custom resource, in a namespace to cap the sums of the limits of its pods. The
+// aggregator tracks what the pods of each namespace use across the cluster and writes it to the status of their
+// quotas; the agent on each node copies the quotas to a local file, which the CNI plugin checks on ADD, failing pods
+// that would take their namespace over a quota. The kubelet retries the sandboxes of failed pods with backoff, so
+// they are queued until usage drops.
+package quota
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/projectcalico/cni-plugin/policy"
+	"github.com/projectcalico/cni-plugin/state"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The API group, version and resource of BandwidthQuotas.
+const (
+	Group    = "flowcontrol.cni"
+	Version  = "v1alpha1"
+	Resource = "bandwidthquotas"
+	Kind     = "BandwidthQuota"
+)
+
+// BandwidthQuota caps the sums of the limits of the pods of its namespace.
+type BandwidthQuota struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              Spec   `json:"spec"`
+	Status            Status `json:"status,omitempty"`
+}
+
+// Spec is the quota: Ingress and Egress cap the sums of the ingress and egress limits of the pods of the namespace,
+// as rates such as "1G". An empty rate leaves its direction uncapped. Like with ResourceQuotas, pods must have a
+// limit in each direction that is capped.
+type Spec struct {
+	Ingress string `json:"ingress,omitempty"`
+	Egress  string `json:"egress,omitempty"`
+}
+
+// Status is what the pods of the namespace used when the aggregator last observed them. Rates are in bits per
+// second, zero in Hard meaning uncapped.
+type Status struct {
+	Hard policy.Rates `json:"hard"`
+	Used policy.Rates `json:"used"`
+	// Pods are the pods counted in Used.
+	Pods int `json:"pods"`
+	// Exceeded is set if Used is above Hard, as it can be after the quota was lowered or pods of the namespace
+	// started on several nodes between two observations.
+	Exceeded bool        `json:"exceeded,omitempty"`
+	Observed metav1.Time `json:"observed,omitempty"`
+	// Message says why Used may be off, or why the spec is invalid.
+	Message string `json:"message,omitempty"`
+}
+
+// List is a list of BandwidthQuotas, as returned by the API server.
+type List struct {
+	Items []BandwidthQuota `json:"items"`
+}
+
+// ListPath is the API path the BandwidthQuotas of every namespace are listed at.
+func ListPath() string {
+	return fmt.Sprintf("/apis/%s/%s/%s", Group, Version, Resource)
+}
+
+// StatusPath is the API path of the status subresource of a BandwidthQuota.
+func StatusPath(namespace, name string) string {
+	return fmt.Sprintf("/apis/%s/%s/namespaces/%s/%s/%s/status", Group, Version, namespace, Resource, name)
+}
+
+// Hard parses the rates of the spec of q.
+func (q *BandwidthQuota) Hard() (policy.Rates, error) {
+	hard := policy.Rates{}
+	var err error
+	if q.Spec.Ingress != "" {
+		if hard.Ingress, err = policy.ParseRate(q.Spec.Ingress); err != nil {
+			return hard, fmt.Errorf("invalid ingress of bandwidth quota %s/%s: %v", q.Namespace, q.Name, err)
+		}
+	}
+	if q.Spec.Egress != "" {
+		if hard.Egress, err = policy.ParseRate(q.Spec.Egress); err != nil {
+			return hard, fmt.Errorf("invalid egress of bandwidth quota %s/%s: %v", q.Namespace, q.Name, err)
+		}
+	}
+	return hard, nil
+}
+
+// Observe returns the status of q for the pods of its namespace using used, at now.
+func (q *BandwidthQuota) Observe(used policy.Rates, pods int, now time.Time) Status {
+	s := Status{Used: used, Pods: pods, Observed: metav1.NewTime(now)}
+	hard, err := q.Hard()
+	if err != nil {
+		s.Message = err.Error()
+		return s
+	}
+	s.Hard = hard
+	s.Exceeded = exceeds(used.Ingress, hard.Ingress) || exceeds(used.Egress, hard.Egress)
+	return s
+}
+
+func exceeds(used, hard uint64) bool {
+	return hard != 0 && used > hard
+}
+
+// Admit checks that a pod of namespace limited to ingress and egress, in bits per second with zero meaning
+// unlimited, fits in the quotas of its namespace on top of what its pods already use.
+func Admit(quotas []BandwidthQuota, namespace string, ingress, egress uint64) error {
+	for i := range quotas {
+		q := &quotas[i]
+		if q.Namespace != namespace {
+			continue
+		}
+		hard, err := q.Hard()
+		if err != nil {
+			return err
+		}
+		for _, d := range []struct {
+			direction         string
+			hard, used, limit uint64
+		}{
+			{"ingress", hard.Ingress, q.Status.Used.Ingress, ingress},
+			{"egress", hard.Egress, q.Status.Used.Egress, egress},
+		} {
+			if d.hard == 0 {
+				continue
+			}
+			if d.limit == 0 {
+				return fmt.Errorf("bandwidth quota %s/%s caps %s, so pods of the namespace must have an %s limit",
+					q.Namespace, q.Name, d.direction, d.direction)
+			}
+			if d.used+d.limit > d.hard {
+				return fmt.Errorf("bandwidth quota %s/%s exceeded: %s of %d bit/s requested with %d of %d in use",
+					q.Namespace, q.Name, d.direction, d.limit, d.used, d.hard)
+			}
+		}
+	}
+	return nil
+}
+
+// Check is Admit for the quotas copied to the state directory dir, with the rates of the pod as annotations.
+func Check(dir, namespace, ingress, egress string) error {
+	quotas, err := Load(dir)
+	if err != nil {
+		return fmt.Errorf("failed to load bandwidth quotas: %v", err)
+	}
+	var ingressRate, egressRate uint64
+	if ingress != "" {
+		if ingressRate, err = policy.ParseRate(ingress); err != nil {
+			return err
+		}
+	}
+	if egress != "" {
+		if egressRate, err = policy.ParseRate(egress); err != nil {
+			return err
+		}
+	}
+	return Admit(quotas, namespace, ingressRate, egressRate)
+}
+
+func path(dir string) string {
+	if dir == "" {
+		dir = state.DefaultDir
+	}
+	return filepath.Join(dir, "policy", "quotas.json")
+}
+
+// Load reads the local copy of the quotas from the state directory. If there is none, there are no quotas.
+func Load(dir string) ([]BandwidthQuota, error) {
+	data, err := ioutil.ReadFile(path(dir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	list := List{}
+	if err = json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse bandwidth quotas: %v", err)
+	}
+	return list.Items, nil
+}
+
+// Save writes the local copy of the quotas to the state directory, atomically.
+func Save(dir string, quotas []BandwidthQuota) error {
+	file := path(dir)
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(List{Items: quotas})
+	if err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// Remove deletes the local copy of the quotas. Removing missing quotas is not an error.
+func Remove(dir string) error {
+	if err := os.Remove(path(dir)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
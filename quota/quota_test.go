@@ -0,0 +1,71 @@
+package quota_test
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/cni-plugin/policy"
+	"github.com/projectcalico/cni-plugin/quota"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("BandwidthQuota", func() {
+	var q quota.BandwidthQuota
+
+	BeforeEach(func() {
+		q = quota.BandwidthQuota{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "bandwidth"},
+			Spec:       quota.Spec{Ingress: "100M"},
+		}
+	})
+
+	It("admits pods fitting in the quota of their namespace", func() {
+		q.Status.Used = policy.Rates{Ingress: 60000000}
+		quotas := []quota.BandwidthQuota{q}
+		Expect(quota.Admit(quotas, "team-a", 40000000, 0)).To(Succeed())
+		Expect(quota.Admit(quotas, "team-b", 0, 0)).To(Succeed())
+	})
+
+	It("rejects pods that would exceed the quota", func() {
+		q.Status.Used = policy.Rates{Ingress: 60000000}
+		err := quota.Admit([]quota.BandwidthQuota{q}, "team-a", 50000000, 0)
+		Expect(err).To(MatchError(ContainSubstring("bandwidth quota team-a/bandwidth exceeded")))
+	})
+
+	It("requires a limit in the directions it caps", func() {
+		err := quota.Admit([]quota.BandwidthQuota{q}, "team-a", 0, 1000000)
+		Expect(err).To(MatchError(ContainSubstring("must have an ingress limit")))
+	})
+
+	It("reports usage above the quota in its status", func() {
+		now := time.Now()
+		s := q.Observe(policy.Rates{Ingress: 120000000, Egress: 5000000}, 3, now)
+		Expect(s.Hard).To(Equal(policy.Rates{Ingress: 100000000}))
+		Expect(s.Pods).To(Equal(3))
+		Expect(s.Exceeded).To(BeTrue())
+
+		q.Spec.Ingress = "lots"
+		s = q.Observe(policy.Rates{}, 0, now)
+		Expect(s.Message).To(ContainSubstring("invalid ingress"))
+	})
+
+	It("round-trips through the state directory", func() {
+		dir, err := ioutil.TempDir("", "flowcontrol-quota")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		Expect(quota.Check(dir, "team-a", "", "")).To(Succeed())
+		Expect(quota.Save(dir, []quota.BandwidthQuota{q})).To(Succeed())
+		loaded, err := quota.Load(dir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(loaded).To(HaveLen(1))
+		Expect(loaded[0].Spec.Ingress).To(Equal("100M"))
+		Expect(quota.Check(dir, "team-a", "200M", "")).NotTo(Succeed())
+
+		Expect(quota.Remove(dir)).To(Succeed())
+		Expect(quota.Remove(dir)).To(Succeed())
+	})
+})
@@ -0,0 +1,324 @@
+package shaping
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// The BPF programs shaping a pod are assembled here rather than compiled from C, so that the plugin needs no
+// compiler or object files on the node. Each is a handful of instructions around an array map of one bpfLimit,
+// pinned in the BPF filesystem so that its rate can be changed without reloading the program.
+
+// bpf(2) commands, map and program types, and helpers; see include/uapi/linux/bpf.h.
+const (
+	bpfMapCreate     = 0
+	bpfMapLookupElem = 1
+	bpfMapUpdateElem = 2
+	bpfProgLoad      = 5
+	bpfObjPin        = 6
+	bpfObjGet        = 7
+
+	bpfMapTypeArray     = 2
+	bpfProgTypeSchedCls = 3
+
+	bpfFuncMapLookupElem = 1
+	bpfFuncKtimeGetNs    = 5
+
+	bpfPseudoMapFD = 1
+	bpfFSMagic     = 0xcafe4a11
+)
+
+// Opcodes of the instructions the programs use.
+const (
+	bpfLdImm64  = 0x18
+	bpfLdxW     = 0x61
+	bpfLdxDW    = 0x79
+	bpfStW      = 0x62
+	bpfStxDW    = 0x7b
+	bpfAdd64Imm = 0x07
+	bpfAdd64Reg = 0x0f
+	bpfSub64Reg = 0x1f
+	bpfMul64Imm = 0x27
+	bpfDiv64Reg = 0x3f
+	bpfMov64Imm = 0xb7
+	bpfMov64Reg = 0xbf
+	bpfJeqImm   = 0x15
+	bpfJgtReg   = 0x2d
+	bpfJgeReg   = 0x3d
+	bpfCall     = 0x85
+	bpfExit     = 0x95
+)
+
+// Registers: r0 holds return values, r1 to r5 arguments, which calls clobber, r6 to r9 survive calls and r10 is the
+// read-only frame pointer.
+const (
+	r0 = iota
+	r1
+	r2
+	r3
+	r4
+	r5
+	r6
+	r7
+	r8
+	r9
+	r10
+)
+
+// Offsets in struct __sk_buff and verdicts of tc programs.
+const (
+	skbLen    = 0
+	skbTstamp = 152
+
+	tcActOK   = 0
+	tcActShot = 2
+)
+
+// bpfLimit is the value of the map of a program: the rate in bytes per second, the limit in nanoseconds, which is
+// the horizon of EDT and the burst of the policer, and when the next packet may leave, in the monotonic clock.
+type bpfLimit struct {
+	Rate  uint64
+	Limit uint64
+	Next  uint64
+}
+
+// Offsets of the fields of bpfLimit.
+const (
+	limitRate  = 0
+	limitLimit = 8
+	limitNext  = 16
+)
+
+// bpfInsn is an instruction, with the destination register in the low nibble of regs and the source in the high.
+type bpfInsn struct {
+	code uint8
+	regs uint8
+	off  int16
+	imm  int32
+}
+
+// bpfAsm assembles a program, resolving the jumps to its labels.
+type bpfAsm struct {
+	insns  []bpfInsn
+	labels map[string]int
+	jumps  map[int]string
+}
+
+func (a *bpfAsm) emit(code, dst, src uint8, off int16, imm int32) {
+	a.insns = append(a.insns, bpfInsn{code: code, regs: dst | src<<4, off: off, imm: imm})
+}
+
+// jump emits a conditional jump to label.
+func (a *bpfAsm) jump(code, dst, src uint8, imm int32, label string) {
+	if a.jumps == nil {
+		a.jumps = map[int]string{}
+	}
+	a.jumps[len(a.insns)] = label
+	a.emit(code, dst, src, 0, imm)
+}
+
+// label names the next instruction.
+func (a *bpfAsm) label(name string) {
+	if a.labels == nil {
+		a.labels = map[string]int{}
+	}
+	a.labels[name] = len(a.insns)
+}
+
+// loadMap loads the map fd into dst, which takes two instructions.
+func (a *bpfAsm) loadMap(dst uint8, fd int) {
+	a.emit(bpfLdImm64, dst, bpfPseudoMapFD, 0, int32(fd))
+	a.emit(0, 0, 0, 0, 0)
+}
+
+func (a *bpfAsm) assemble() []bpfInsn {
+	for pc, label := range a.jumps {
+		a.insns[pc].off = int16(a.labels[label] - pc - 1)
+	}
+	return a.insns
+}
+
+// limitProgram returns a program limiting a direction to the bpfLimit in the map fd. It computes how long the
+// packet takes at the rate; packets pass untouched while the map holds no rate. With edt, packets are stamped with
+// when they may leave, for the fq qdisc of the device to hold them until then, and dropped if that is beyond the
+// horizon. Otherwise they are policed: dropped if they would leave later than now, with the burst as credit.
+func limitProgram(fd int, edt bool) []bpfInsn {
+	a := &bpfAsm{}
+	a.emit(bpfMov64Reg, r6, r1, 0, 0)
+	a.emit(bpfCall, 0, 0, 0, bpfFuncKtimeGetNs)
+	a.emit(bpfMov64Reg, r7, r0, 0, 0)
+	a.emit(bpfStW, r10, 0, -4, 0)
+	a.emit(bpfMov64Reg, r2, r10, 0, 0)
+	a.emit(bpfAdd64Imm, r2, 0, 0, -4)
+	a.loadMap(r1, fd)
+	a.emit(bpfCall, 0, 0, 0, bpfFuncMapLookupElem)
+	a.jump(bpfJeqImm, r0, 0, 0, "pass")
+	a.emit(bpfMov64Reg, r8, r0, 0, 0)
+	// r1 is how long the packet takes at the rate, r3 when the previous one left.
+	a.emit(bpfLdxW, r1, r6, skbLen, 0)
+	a.emit(bpfMul64Imm, r1, 0, 0, 1000000000)
+	a.emit(bpfLdxDW, r2, r8, limitRate, 0)
+	a.jump(bpfJeqImm, r2, 0, 0, "pass")
+	a.emit(bpfDiv64Reg, r1, r2, 0, 0)
+	a.emit(bpfLdxDW, r3, r8, limitNext, 0)
+	a.emit(bpfLdxDW, r5, r8, limitLimit, 0)
+	if edt {
+		a.jump(bpfJgeReg, r3, r7, 0, "late")
+		a.emit(bpfMov64Reg, r3, r7, 0, 0)
+		a.label("late")
+		a.emit(bpfMov64Reg, r4, r3, 0, 0)
+		a.emit(bpfSub64Reg, r4, r7, 0, 0)
+		a.jump(bpfJgtReg, r4, r5, 0, "drop")
+		a.emit(bpfStxDW, r6, r3, skbTstamp, 0)
+		a.emit(bpfAdd64Reg, r3, r1, 0, 0)
+	} else {
+		a.emit(bpfMov64Reg, r4, r7, 0, 0)
+		a.emit(bpfSub64Reg, r4, r5, 0, 0)
+		a.jump(bpfJgeReg, r3, r4, 0, "credit")
+		a.emit(bpfMov64Reg, r3, r4, 0, 0)
+		a.label("credit")
+		a.emit(bpfAdd64Reg, r3, r1, 0, 0)
+		a.jump(bpfJgtReg, r3, r7, 0, "drop")
+	}
+	a.emit(bpfStxDW, r8, r3, limitNext, 0)
+	a.label("pass")
+	a.emit(bpfMov64Imm, r0, 0, 0, tcActOK)
+	a.emit(bpfExit, 0, 0, 0, 0)
+	a.label("drop")
+	a.emit(bpfMov64Imm, r0, 0, 0, tcActShot)
+	a.emit(bpfExit, 0, 0, 0, 0)
+	return a.assemble()
+}
+
+func bpfSyscall(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	fd, _, errno := unix.Syscall(unix.SYS_BPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+// createLimitMap creates the array map of one bpfLimit a program reads.
+func createLimitMap() (int, error) {
+	attr := struct {
+		mapType, keySize, valueSize, maxEntries, mapFlags uint32
+	}{bpfMapTypeArray, 4, uint32(unsafe.Sizeof(bpfLimit{})), 1, 0}
+	fd, err := bpfSyscall(bpfMapCreate, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return -1, fmt.Errorf("failed to create BPF map: %v", err)
+	}
+	return fd, nil
+}
+
+// mapElem looks up, or updates, the bpfLimit in the map fd.
+func mapElem(cmd, fd int, limit *bpfLimit) error {
+	var key uint32
+	attr := struct {
+		mapFD, _   uint32
+		key, value uint64
+		flags      uint64
+	}{mapFD: uint32(fd), key: uint64(uintptr(unsafe.Pointer(&key))), value: uint64(uintptr(unsafe.Pointer(limit)))}
+	_, err := bpfSyscall(cmd, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(&key)
+	runtime.KeepAlive(limit)
+	return err
+}
+
+// loadProgram loads insns as a tc classifier, returning the verifier's log with the error if it is rejected.
+func loadProgram(insns []bpfInsn) (int, error) {
+	license := []byte("GPL\x00")
+	log := make([]byte, 64<<10)
+	attr := struct {
+		progType, insnCnt  uint32
+		insns, license     uint64
+		logLevel, logSize  uint32
+		logBuf             uint64
+		kernVersion, flags uint32
+	}{
+		progType: bpfProgTypeSchedCls,
+		insnCnt:  uint32(len(insns)),
+		insns:    uint64(uintptr(unsafe.Pointer(&insns[0]))),
+		license:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+		logLevel: 1,
+		logSize:  uint32(len(log)),
+		logBuf:   uint64(uintptr(unsafe.Pointer(&log[0]))),
+	}
+	fd, err := bpfSyscall(bpfProgLoad, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(insns)
+	runtime.KeepAlive(license)
+	runtime.KeepAlive(log)
+	if err != nil {
+		if n := clen(log); n != 0 {
+			return -1, fmt.Errorf("failed to load BPF program: %v: %s", err, log[:n])
+		}
+		return -1, fmt.Errorf("failed to load BPF program: %v", err)
+	}
+	return fd, nil
+}
+
+func clen(b []byte) int {
+	for i, c := range b {
+		if c == 0 {
+			return i
+		}
+	}
+	return len(b)
+}
+
+// objPath calls cmd, bpfObjPin or bpfObjGet, on the pinned object at path.
+func objPath(cmd int, path string, fd int) (int, error) {
+	p, err := unix.BytePtrFromString(path)
+	if err != nil {
+		return -1, err
+	}
+	attr := struct {
+		pathname uint64
+		fd       uint32
+		flags    uint32
+	}{pathname: uint64(uintptr(unsafe.Pointer(p))), fd: uint32(fd)}
+	fd, err = bpfSyscall(cmd, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(p)
+	return fd, err
+}
+
+// ensureLimitMap returns the map pinned at path, creating and pinning it if there is none.
+func ensureLimitMap(path string) (int, error) {
+	if fd, err := objPath(bpfObjGet, path, 0); err == nil {
+		return fd, nil
+	}
+	if err := ensureBPFFS(); err != nil {
+		return -1, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return -1, fmt.Errorf("failed to create %s: %v", filepath.Dir(path), err)
+	}
+	fd, err := createLimitMap()
+	if err != nil {
+		return -1, err
+	}
+	if _, err = objPath(bpfObjPin, path, fd); err != nil {
+		unix.Close(fd)
+		return -1, fmt.Errorf("failed to pin BPF map at %s: %v", path, err)
+	}
+	return fd, nil
+}
+
+// ensureBPFFS mounts the BPF filesystem at BPFFSRoot unless it is already.
+func ensureBPFFS() error {
+	var fs unix.Statfs_t
+	if err := unix.Statfs(BPFFSRoot, &fs); err == nil && uint32(fs.Type) == bpfFSMagic {
+		return nil
+	}
+	if err := os.MkdirAll(BPFFSRoot, 0700); err != nil {
+		return err
+	}
+	if err := unix.Mount("bpf", BPFFSRoot, "bpf", 0, ""); err != nil {
+		return fmt.Errorf("failed to mount the BPF filesystem at %s: %v", BPFFSRoot, err)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package shaping
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+// The devices a pod is shaped on are reconciled with what is programmed rather than assumed to be bare, so that
+// setting up shaping can be retried, as the kubelet retries ADD after a timeout, without failing on, or
+// duplicating, what the earlier attempt left behind.
+
+// EnsureIFB creates the IFB device name, or takes the one an earlier attempt created, and sets it up.
+func EnsureIFB(name string) (netlink.Link, error) {
+	err := CountNetlink("LinkAdd", func() error {
+		return netlink.LinkAdd(&netlink.Ifb{LinkAttrs: netlink.LinkAttrs{Name: name, TxQLen: 1000}})
+	})
+	if err != nil && err != syscall.EEXIST {
+		return nil, moduleError(err, "create IFB device "+name, "ifb")
+	}
+	ifb, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup %q: %v", name, err)
+	}
+	if _, ok := ifb.(*netlink.Ifb); !ok {
+		return nil, &ConflictError{Err: fmt.Errorf("%q already exists and isn't an IFB device", name)}
+	}
+	if err = CountNetlink("LinkSetUp", func() error { return netlink.LinkSetUp(ifb) }); err != nil {
+		return nil, fmt.Errorf("failed to set %q up: %v", name, err)
+	}
+	return ifb, nil
+}
+
+// DeleteIFB deletes the IFB device name. Nothing is deleted if there is no such device, or if it isn't an IFB.
+func DeleteIFB(name string) (bool, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return false, nil
+	}
+	if _, ok := link.(*netlink.Ifb); !ok {
+		return false, nil
+	}
+	if err = CountNetlink("LinkDel", func() error { return netlink.LinkDel(link) }); err != nil {
+		return false, fmt.Errorf("failed to delete IFB device %q: %v", name, err)
+	}
+	return true, nil
+}
+
+// EnsureQdisc adds the qdisc unless the link already has one with the same handle.
+func EnsureQdisc(link netlink.Link, qdisc netlink.Qdisc) error {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return err
+	}
+	for _, q := range qdiscs {
+		if q.Attrs().Handle == qdisc.Attrs().Handle && q.Type() == qdisc.Type() {
+			return nil
+		}
+	}
+	// A process that doesn't hold the tc lock, such as an older plugin, may have added it since it was listed.
+	err = CountNetlink("QdiscAdd", func() error { return netlink.QdiscAdd(qdisc) })
+	if err != nil && err != syscall.EEXIST {
+		return fmt.Errorf("failed to add %s qdisc to %s: %v", qdisc.Type(), link.Attrs().Name, err)
+	}
+	return nil
+}
+
+// replaceRootQdisc makes qdisc the root qdisc of link. A root qdisc of the same kind and handle is kept, with its
+// classes, to be reconciled class by class; any other is replaced.
+func replaceRootQdisc(link netlink.Link, qdisc netlink.Qdisc) error {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return fmt.Errorf("failed to list qdiscs of %q: %v", link.Attrs().Name, err)
+	}
+	for _, q := range qdiscs {
+		if q.Attrs().Parent == netlink.HANDLE_ROOT && q.Attrs().Handle == qdisc.Attrs().Handle &&
+			q.Type() == qdisc.Type() {
+			return nil
+		}
+	}
+	return CountNetlink("QdiscReplace", func() error { return netlink.QdiscReplace(qdisc) })
+}
@@ -0,0 +1,171 @@
+package shaping
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/projectcalico/cni-plugin/internal/nlconst"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// Traffic of a pod is marked with a DSCP, for the underlay network to prioritize it, by a pedit action on the u32
+// filter classifying or redirecting it, ahead of what the filter does with it. netlink has no pedit action, so the
+// filters that mark are built here. Rewriting the DS field of IPv4 packets also takes a csum action to fix their
+// header checksum; IPv6 headers have none.
+
+// MaxDSCP is the largest DSCP, which has six bits.
+const MaxDSCP = 63
+
+// Attributes and flags of the pedit and csum actions; see include/uapi/linux/tc_act.
+const (
+	tcaPeditParms            = 2
+	tcaCsumParms             = 1
+	tcaCsumUpdateFlagIPv4Hdr = 1
+
+	// sizeofTcGen is the size of struct tc_gen, which starts the parameters of every action.
+	sizeofTcGen = 20
+)
+
+// dsField returns the mask and value of the pedit key setting the DSCP of the first word of the IP header of
+// protocol to dscp, in host byte order: the DS field is the second byte of IPv4 headers, and spans the first two
+// bytes of IPv6 ones, after the version.
+func dsField(protocol uint16, dscp uint8) (mask, val uint32) {
+	shift := uint32(18)
+	if protocol == nlconst.ProtoIPv6 {
+		shift = 22
+	}
+	return ^(uint32(MaxDSCP) << shift), uint32(dscp) << shift
+}
+
+// peditParms serializes struct tc_pedit_sel with the one key setting the DSCP of traffic of protocol, the packet
+// going on to the next action.
+func peditParms(protocol uint16, dscp uint8) []byte {
+	mask, val := dsField(protocol, dscp)
+	b := make([]byte, sizeofTcGen+4+24)
+	nlconst.Native.PutUint32(b[8:], uint32(netlink.TC_ACT_PIPE))
+	b[sizeofTcGen] = 1 // nkeys
+	key := b[sizeofTcGen+4:]
+	// The packet is edited as it is laid out, so the key is in network byte order; it applies at offset 0 of the
+	// network header.
+	nlconst.Native.PutUint32(key[0:], nlconst.Htonl(mask))
+	nlconst.Native.PutUint32(key[4:], nlconst.Htonl(val))
+	return b
+}
+
+// csumParms serializes struct tc_csum recomputing the IPv4 header checksum, the packet going on to the next action.
+func csumParms() []byte {
+	b := make([]byte, sizeofTcGen+4)
+	nlconst.Native.PutUint32(b[8:], uint32(netlink.TC_ACT_PIPE))
+	nlconst.Native.PutUint32(b[sizeofTcGen:], tcaCsumUpdateFlagIPv4Hdr)
+	return b
+}
+
+// u32Sel converts the selector of a u32 filter to the kernel's, whose keys are in network byte order.
+func u32Sel(sel *netlink.TcU32Sel) *nl.TcU32Sel {
+	if sel == nil {
+		sel = &netlink.TcU32Sel{Keys: []netlink.TcU32Key{{}}, Flags: netlink.TC_U32_TERMINAL}
+	}
+	out := &nl.TcU32Sel{
+		Flags:    sel.Flags,
+		Offshift: sel.Offshift,
+		Nkeys:    uint8(len(sel.Keys)),
+		Offmask:  nlconst.Htons(sel.Offmask),
+		Off:      sel.Off,
+		Offoff:   sel.Offoff,
+		Hoff:     sel.Hoff,
+		Hmask:    nlconst.Htonl(sel.Hmask),
+	}
+	for _, k := range sel.Keys {
+		out.Keys = append(out.Keys, nl.TcU32Key{
+			Mask:    nlconst.Htonl(k.Mask),
+			Val:     nlconst.Htonl(k.Val),
+			Off:     k.Off,
+			OffMask: k.OffMask,
+		})
+	}
+	return out
+}
+
+// AddMarkingFilter adds the u32 filter, which must match IPv4 or IPv6 traffic, with its traffic marked with dscp
+// before it is classified into the class of the filter or redirected to its device.
+func AddMarkingFilter(filter *netlink.U32, dscp uint8) error {
+	attrs := filter.Attrs()
+	if attrs.Protocol != nlconst.ProtoIP && attrs.Protocol != nlconst.ProtoIPv6 {
+		return fmt.Errorf("only IPv4 and IPv6 traffic can be marked with a DSCP")
+	}
+	req := nl.NewNetlinkRequest(syscall.RTM_NEWTFILTER, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL|syscall.NLM_F_ACK)
+	req.AddData(&nl.TcMsg{
+		Family:  nl.FAMILY_ALL,
+		Ifindex: int32(attrs.LinkIndex),
+		Handle:  attrs.Handle,
+		Parent:  attrs.Parent,
+		Info:    nlconst.FilterInfo(attrs.Priority, attrs.Protocol),
+	})
+	req.AddData(nl.NewRtAttr(nl.TCA_KIND, nl.ZeroTerminated("u32")))
+
+	options := nl.NewRtAttr(nl.TCA_OPTIONS, nil)
+	nl.NewRtAttrChild(options, nl.TCA_U32_SEL, u32Sel(filter.Sel).Serialize())
+	if filter.ClassId != 0 {
+		nl.NewRtAttrChild(options, nl.TCA_U32_CLASSID, nl.Uint32Attr(filter.ClassId))
+	}
+	actions := nl.NewRtAttrChild(options, nl.TCA_U32_ACT, nil)
+	tab := nl.TCA_ACT_TAB
+	action := func(kind string) *nl.RtAttr {
+		a := nl.NewRtAttrChild(actions, tab, nil)
+		tab++
+		nl.NewRtAttrChild(a, nl.TCA_ACT_KIND, nl.ZeroTerminated(kind))
+		return nl.NewRtAttrChild(a, nl.TCA_ACT_OPTIONS, nil)
+	}
+	nl.NewRtAttrChild(action("pedit"), tcaPeditParms, peditParms(attrs.Protocol, dscp))
+	if attrs.Protocol == nlconst.ProtoIP {
+		nl.NewRtAttrChild(action("csum"), tcaCsumParms, csumParms())
+	}
+	if filter.RedirIndex != 0 {
+		mirred := nl.TcMirred{Eaction: int32(netlink.TCA_EGRESS_REDIR), Ifindex: uint32(filter.RedirIndex)}
+		mirred.Action = int32(netlink.TC_ACT_STOLEN)
+		nl.NewRtAttrChild(action("mirred"), nl.TCA_MIRRED_PARMS, mirred.Serialize())
+	}
+	req.AddData(options)
+
+	return CountNetlink("FilterAdd", func() error {
+		_, err := req.Execute(syscall.NETLINK_ROUTE, 0)
+		return err
+	})
+}
+
+// ReplaceMarkingFilter is ReplaceFilter for a filter marking its traffic with dscp, as AddMarkingFilter adds.
+func ReplaceMarkingFilter(link netlink.Link, filter *netlink.U32, dscp uint8) error {
+	if err := clearFilterPrio(link, filter.Attrs()); err != nil {
+		return err
+	}
+	return AddMarkingFilter(filter, dscp)
+}
+
+// AddMarkingRedirectFilters adds the filters AddIPv4Filter and AddIPv6Filter add to redirect the IP traffic under
+// parent on link to the device with index redirIndex, in the filter band starting at base, with that traffic marked
+// with dscp. The IPv6 filter is a u32 one in place of the matchall, as only u32 ones are built with pedit here.
+func AddMarkingRedirectFilters(link netlink.Link, parent uint32, base uint16, redirIndex int, dscp uint8) error {
+	for _, f := range []struct {
+		name     string
+		prio     uint16
+		protocol uint16
+	}{
+		{"IPv4", base, nlconst.ProtoIP},
+		{"IPv6", base + ipv6FilterPrio, nlconst.ProtoIPv6},
+	} {
+		filter := &netlink.U32{
+			FilterAttrs: netlink.FilterAttrs{
+				LinkIndex: link.Attrs().Index,
+				Parent:    parent,
+				Priority:  f.prio,
+				Protocol:  f.protocol,
+			},
+			RedirIndex: redirIndex,
+		}
+		if err := ReplaceMarkingFilter(link, filter, dscp); err != nil {
+			return fmt.Errorf("failed to add marking %s filter on %q: %v", f.name, link.Attrs().Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package shaping
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// BPFFSRoot is where the BPF filesystem holding the maps of the BPF shaping is mounted.
+const BPFFSRoot = "/sys/fs/bpf"
+
+// Priority of the BPF filters on the clsact hooks of a link.
+const bpfFilterPrio = 1
+
+// SetupEDT shapes the traffic link transmits, which for a host veth is the traffic entering the pod, to rate bits
+// per second without an IFB device or HTB classes: a BPF program on the egress hook of a clsact qdisc stamps each
+// packet with its earliest departure time, which an fq qdisc at the root of link enforces. Packets that would wait
+// longer than horizon are dropped. The program's map is pinned at pin, to be found by SetBPFRate.
+func SetupEDT(link netlink.Link, pin string, rate uint64, horizon time.Duration) error {
+	fq := &netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(HostVethQdiscMajor, 0),
+			Parent:    netlink.HANDLE_ROOT,
+		},
+		QdiscType: "fq",
+	}
+	if err := replaceRootQdisc(link, fq); err != nil {
+		return moduleError(err, "add fq qdisc to "+link.Attrs().Name, "sch_fq")
+	}
+	return attachLimit(link, netlink.HANDLE_MIN_EGRESS, pin, true, bpfLimit{Rate: rate / 8, Limit: uint64(horizon)})
+}
+
+// SetupBPFPolicer limits the traffic link receives, which for a host veth is the traffic leaving the pod, to rate
+// bits per second with a BPF program on the ingress hook of a clsact qdisc, dropping what exceeds it beyond burst
+// bytes. The program's map is pinned at pin, to be found by SetBPFRate.
+func SetupBPFPolicer(link netlink.Link, pin string, rate uint64, burst uint32) error {
+	return attachLimit(link, netlink.HANDLE_MIN_INGRESS, pin, false, bpfLimit{Rate: rate / 8, Limit: BurstNanos(rate, burst)})
+}
+
+// BurstNanos returns how long rate, in bits per second, takes to send burst bytes, which is the credit the BPF
+// policer gives a direction.
+func BurstNanos(rate uint64, burst uint32) uint64 {
+	if rate < 8 {
+		return 0
+	}
+	return uint64(burst) * uint64(time.Second) / (rate / 8)
+}
+
+// attachLimit loads the program limiting a direction to limit, with its map at pin, and attaches it to hook of the
+// clsact qdisc of link, replacing a program attached by an earlier attempt.
+func attachLimit(link netlink.Link, hook uint32, pin string, edt bool, limit bpfLimit) error {
+	if err := ensureClsact(link); err != nil {
+		return err
+	}
+	mapFD, err := ensureLimitMap(pin)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(mapFD)
+	if err = mapElem(bpfMapUpdateElem, mapFD, &limit); err != nil {
+		return fmt.Errorf("failed to set BPF limit at %s: %v", pin, err)
+	}
+	progFD, err := loadProgram(limitProgram(mapFD, edt))
+	if err != nil {
+		return err
+	}
+	defer unix.Close(progFD)
+	name := "flowcontrol_police"
+	if edt {
+		name = "flowcontrol_edt"
+	}
+	filter := &netlink.BpfFilter{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    hook,
+			Handle:    1,
+			Priority:  bpfFilterPrio,
+			Protocol:  syscall.ETH_P_ALL,
+		},
+		Fd:           progFD,
+		Name:         name,
+		DirectAction: true,
+	}
+	if err = ReplaceFilter(link, filter); err != nil {
+		return fmt.Errorf("failed to attach BPF program to %q: %v", link.Attrs().Name, err)
+	}
+	return nil
+}
+
+// ensureClsact adds a clsact qdisc to link, replacing an ingress qdisc, which takes the same place.
+func ensureClsact(link netlink.Link) error {
+	if q := IngressQdisc(link); q != nil && q.Type() != "clsact" {
+		if err := CountNetlink("QdiscDel", func() error { return netlink.QdiscDel(q) }); err != nil {
+			return fmt.Errorf("failed to remove %s qdisc of %q: %v", q.Type(), link.Attrs().Name, err)
+		}
+	}
+	clsact := &netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_CLSACT,
+		},
+		QdiscType: "clsact",
+	}
+	if err := EnsureQdisc(link, clsact); err != nil {
+		return moduleError(err, "add clsact qdisc to "+link.Attrs().Name, "sch_ingress")
+	}
+	return nil
+}
+
+// IngressQdisc returns the ingress or clsact qdisc of link, or nil if it has none.
+func IngressQdisc(link netlink.Link) netlink.Qdisc {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return nil
+	}
+	for _, q := range qdiscs {
+		if q.Attrs().Parent == netlink.HANDLE_INGRESS {
+			return q
+		}
+	}
+	return nil
+}
+
+// SetBPFRate changes the rate, in bits per second, and limit of the BPF program whose map is pinned at pin: the
+// horizon of SetupEDT or the burst, as BurstNanos, of SetupBPFPolicer.
+func SetBPFRate(pin string, rate uint64, limit uint64) error {
+	fd, err := objPath(bpfObjGet, pin, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open BPF map %s: %v", pin, err)
+	}
+	defer unix.Close(fd)
+	l := bpfLimit{}
+	if err = mapElem(bpfMapLookupElem, fd, &l); err != nil {
+		return fmt.Errorf("failed to read BPF map %s: %v", pin, err)
+	}
+	l.Rate, l.Limit = rate/8, limit
+	if err = mapElem(bpfMapUpdateElem, fd, &l); err != nil {
+		return fmt.Errorf("failed to update BPF map %s: %v", pin, err)
+	}
+	return nil
+}
+
+// BPFRate returns the rate, in bits per second, of the BPF program whose map is pinned at pin.
+func BPFRate(pin string) (uint64, error) {
+	fd, err := objPath(bpfObjGet, pin, 0)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open BPF map %s: %v", pin, err)
+	}
+	defer unix.Close(fd)
+	l := bpfLimit{}
+	if err = mapElem(bpfMapLookupElem, fd, &l); err != nil {
+		return 0, fmt.Errorf("failed to read BPF map %s: %v", pin, err)
+	}
+	return l.Rate * 8, nil
+}
+
+// HasBPFFilter reports whether the hook, netlink.HANDLE_MIN_INGRESS or netlink.HANDLE_MIN_EGRESS, of the clsact
+// qdisc of link has a BPF program attached.
+func HasBPFFilter(link netlink.Link, hook uint32) bool {
+	filters, err := netlink.FilterList(link, hook)
+	if err != nil {
+		return false
+	}
+	for _, f := range filters {
+		if _, ok := f.(*netlink.BpfFilter); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// RemovePins removes the maps pinned under dir.
+func RemovePins(dir string) error {
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("failed to remove BPF maps in %s: %v", dir, err)
+	}
+	return nil
+}
+
+// ProbeBPF checks that the kernel can shape with SetupEDT and SetupBPFPolicer: that the BPF filesystem can be
+// mounted, and that it accepts both programs, which need a kernel letting tc programs set departure times.
+func ProbeBPF() error {
+	if err := ensureBPFFS(); err != nil {
+		return err
+	}
+	mapFD, err := createLimitMap()
+	if err != nil {
+		return err
+	}
+	defer unix.Close(mapFD)
+	for _, edt := range []bool{true, false} {
+		progFD, err := loadProgram(limitProgram(mapFD, edt))
+		if err != nil {
+			return err
+		}
+		unix.Close(progFD)
+	}
+	return nil
+}
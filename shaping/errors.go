@@ -0,0 +1,36 @@
+package shaping
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// ModuleError reports that the kernel module Module, needed for Op, appears to be missing.
+type ModuleError struct {
+	Op     string
+	Module string
+	Err    error
+}
+
+func (e *ModuleError) Error() string {
+	return fmt.Sprintf("failed to %s: %v", e.Op, e.Err)
+}
+
+// ConflictError reports that a device shaping needs is taken by someone else.
+type ConflictError struct {
+	Err error
+}
+
+func (e *ConflictError) Error() string {
+	return e.Err.Error()
+}
+
+// moduleError returns a *ModuleError if err is how the kernel reports that module, needed for op, isn't available,
+// and err, explained by op, otherwise.
+func moduleError(err error, op, module string) error {
+	switch err {
+	case syscall.ENOENT, syscall.EOPNOTSUPP:
+		return &ModuleError{Op: op, Module: module, Err: err}
+	}
+	return fmt.Errorf("failed to %s: %v", op, err)
+}
@@ -0,0 +1,187 @@
+package shaping
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+// What the shaping of a pod does with traffic its IP classifiers don't match. "unshaped" leaves it alone, "shaped"
+// puts it in the pod's shaping class and "drop" drops it. ARP is left alone unless it is shaped, since pods rely on
+// proxy ARP to reach their gateway.
+const (
+	NonIPUnshaped = "unshaped"
+	NonIPShaped   = "shaped"
+	NonIPDrop     = "drop"
+)
+
+// Filter priorities relative to the IPv4 classifier of a generation, at the base of its band. Each protocol needs
+// its own priority.
+const (
+	ipv6FilterPrio   = 1
+	nonIPPassARPPrio = 2
+	nonIPAllPrio     = 3
+)
+
+// AddIPv4Filter adds a filter matching all IPv4 traffic under parent on link, classifying it into classID or
+// redirecting it to the device with index redirIndex if that isn't zero.
+func AddIPv4Filter(link netlink.Link, parent uint32, prio uint16, classID uint32, redirIndex int) error {
+	filter := &netlink.U32{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    parent,
+			Priority:  prio,
+			Protocol:  syscall.ETH_P_IP,
+		},
+		Sel: &netlink.TcU32Sel{
+			Keys:  []netlink.TcU32Key{{}},
+			Flags: netlink.TC_U32_TERMINAL,
+		},
+		ClassId:    classID,
+		RedirIndex: redirIndex,
+	}
+	if err := ReplaceFilter(link, filter); err != nil {
+		return fmt.Errorf("failed to add IPv4 filter on %q: %v", link.Attrs().Name, err)
+	}
+	return nil
+}
+
+// AddIPv6Filter adds a filter matching all IPv6 traffic under parent on link, in the filter band starting at base,
+// classifying it into classID or redirecting it to the device with index redirIndex if that isn't zero. The traffic
+// is first copied to the device with index mirrorIndex if that isn't zero.
+func AddIPv6Filter(link netlink.Link, parent uint32, base uint16, classID uint32, redirIndex, mirrorIndex int) error {
+	filter := &netlink.MatchAll{FilterAttrs: netlink.FilterAttrs{
+		LinkIndex: link.Attrs().Index,
+		Parent:    parent,
+		Priority:  base + ipv6FilterPrio,
+		Protocol:  syscall.ETH_P_IPV6,
+	}, Actions: mirrorActions(mirrorIndex)}
+	if redirIndex != 0 {
+		filter.Actions = append(filter.Actions, netlink.NewMirredAction(redirIndex))
+	} else {
+		filter.ClassId = classID
+	}
+	if err := ReplaceFilter(link, filter); err != nil {
+		return fmt.Errorf("failed to add IPv6 filter on %q: %v", link.Attrs().Name, err)
+	}
+	return nil
+}
+
+// AddNonIPFilters adds the protocol-all matchall filters implementing policy under parent on link, in the filter
+// band starting at base. Traffic is classified into classID, or redirected to the device with index redirIndex if
+// that isn't zero. Traffic that isn't dropped is first copied to the device with index mirrorIndex if that isn't
+// zero.
+func AddNonIPFilters(link netlink.Link, parent uint32, base uint16, policy string, classID uint32, redirIndex, mirrorIndex int) error {
+	if policy == "" || policy == NonIPUnshaped {
+		return nil
+	}
+	attrs := func(prio, proto uint16) netlink.FilterAttrs {
+		return netlink.FilterAttrs{LinkIndex: link.Attrs().Index, Parent: parent, Priority: base + prio, Protocol: proto}
+	}
+
+	if policy == NonIPDrop {
+		pass := &netlink.MatchAll{
+			FilterAttrs: attrs(nonIPPassARPPrio, syscall.ETH_P_ARP),
+			Actions:     append(mirrorActions(mirrorIndex), gact(netlink.TC_ACT_OK)),
+		}
+		if err := ReplaceFilter(link, pass); err != nil {
+			return fmt.Errorf("failed to add ARP pass filter on %q: %v", link.Attrs().Name, err)
+		}
+	}
+
+	all := &netlink.MatchAll{FilterAttrs: attrs(nonIPAllPrio, syscall.ETH_P_ALL)}
+	switch {
+	case policy == NonIPDrop:
+		all.Actions = []netlink.Action{gact(netlink.TC_ACT_SHOT)}
+	case redirIndex != 0:
+		all.Actions = append(mirrorActions(mirrorIndex), netlink.NewMirredAction(redirIndex))
+	default:
+		all.ClassId = classID
+		all.Actions = mirrorActions(mirrorIndex)
+	}
+	if err := ReplaceFilter(link, all); err != nil {
+		return fmt.Errorf("failed to add non-IP filter on %q: %v", link.Attrs().Name, err)
+	}
+	return nil
+}
+
+// mirrorActions returns the actions a filter copies the traffic it matches to the device with index mirrorIndex
+// with, ahead of its own, or none if mirrorIndex is zero. The mirror pipes the traffic on, so the filter still
+// classifies or redirects it.
+func mirrorActions(mirrorIndex int) []netlink.Action {
+	if mirrorIndex == 0 {
+		return nil
+	}
+	return []netlink.Action{&netlink.MirredAction{
+		ActionAttrs:  netlink.ActionAttrs{Action: netlink.TC_ACT_PIPE},
+		MirredAction: netlink.TCA_EGRESS_MIRROR,
+		Ifindex:      mirrorIndex,
+	}}
+}
+
+func gact(action netlink.TcAct) *netlink.GenericAction {
+	return &netlink.GenericAction{ActionAttrs: netlink.ActionAttrs{Action: action}}
+}
+
+// ReplaceFilter adds filter in place of those at its priority under its parent. The kernel refuses a second
+// filter at a priority for most classifiers, and adds u32 ones next to the first, so the old ones go first.
+func ReplaceFilter(link netlink.Link, filter netlink.Filter) error {
+	if err := clearFilterPrio(link, filter.Attrs()); err != nil {
+		return err
+	}
+	return CountNetlink("FilterAdd", func() error { return netlink.FilterAdd(filter) })
+}
+
+// clearFilterPrio deletes the filters at the priority of attrs under its parent on link, if there are any.
+func clearFilterPrio(link netlink.Link, attrs *netlink.FilterAttrs) error {
+	filters, err := netlink.FilterList(link, attrs.Parent)
+	if err != nil {
+		return fmt.Errorf("failed to list filters on %q: %v", link.Attrs().Name, err)
+	}
+	for _, f := range filters {
+		if f.Attrs().Priority == attrs.Priority {
+			return deleteFilterPrio(link, f)
+		}
+	}
+	return nil
+}
+
+// DeleteFilterBand deletes the filters of generation gen under parent on link. Each priority is deleted as a whole,
+// which also removes the hash tables of u32 filters.
+func DeleteFilterBand(link netlink.Link, parent uint32, gen int) error {
+	filters, err := netlink.FilterList(link, parent)
+	if err != nil {
+		return fmt.Errorf("failed to list filters on %q: %v", link.Attrs().Name, err)
+	}
+	base := FilterBase(gen)
+	deleted := map[uint16]bool{}
+	for _, f := range filters {
+		attrs := f.Attrs()
+		if attrs.Priority < base || attrs.Priority >= base+filterBandSize || deleted[attrs.Priority] {
+			continue
+		}
+		deleted[attrs.Priority] = true
+		if err = deleteFilterPrio(link, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteFilterPrio deletes the priority of f under its parent on link as a whole, which also removes the hash
+// tables of u32 filters.
+func deleteFilterPrio(link netlink.Link, f netlink.Filter) error {
+	attrs := f.Attrs()
+	prio := &netlink.GenericFilter{FilterAttrs: netlink.FilterAttrs{
+		LinkIndex: attrs.LinkIndex,
+		Parent:    attrs.Parent,
+		Priority:  attrs.Priority,
+		Protocol:  attrs.Protocol,
+	}, FilterType: f.Type()}
+	err := CountNetlink("FilterDel", func() error { return netlink.FilterDel(prio) })
+	if err != nil && err != syscall.ENOENT {
+		return fmt.Errorf("failed to delete filters at priority %d on %q: %v", attrs.Priority, link.Attrs().Name, err)
+	}
+	return nil
+}
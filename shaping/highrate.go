@@ -0,0 +1,136 @@
+package shaping
+
+import (
+	"errors"
+	"math"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// High-rate mode: classes of HighRate bits per second and above, as pods get on 25 and 100 Gbit nodes, are sized for
+// their rate rather than by HTB's defaults, which undershoot it by far. The default egress buffer lasts
+// microseconds at these rates, less than the timer granularity HTB refills its tokens at, and netlink programs a
+// fixed quantum of 10 bytes, so that classes sharing a parent take a round per packet.
+const (
+	HighRate = 10 * 1000 * 1000 * 1000
+
+	// highRateBurstTime is how long, in microseconds, the buffer of a high-rate class lasts at its rate.
+	highRateBurstTime = 1000
+	// highRateQuantumTime is how long, in microseconds, a high-rate class sends for in a round.
+	highRateQuantumTime = 100
+	// minHighRateQuantum is the smallest quantum of a high-rate class: a full GSO segment, so that one is never
+	// split across rounds.
+	minHighRateQuantum = 64 * 1024
+	// maxHighRateBuffer bounds the buffers of high-rate classes.
+	maxHighRateBuffer = 64 << 20
+
+	// htbR2Q is the default rate to quantum divisor of HTB qdiscs, and minHTBQuantum and maxHTBQuantum the bounds
+	// the kernel clamps the quantum it derives with it to.
+	htbR2Q        = 10
+	minHTBQuantum = 1000
+	maxHTBQuantum = 200000
+
+	// netlinkQuantum is the fixed quantum netlink.NewHtbClass gives classes.
+	netlinkQuantum = 10
+)
+
+// HighRateBuffer returns the buffer, in bytes, of a high-rate class of rate bits per second: what it sends in
+// highRateBurstTime.
+func HighRateBuffer(rate uint64) uint32 {
+	buffer := rate / 8 * highRateBurstTime / 1e6
+	if buffer > maxHighRateBuffer {
+		return maxHighRateBuffer
+	}
+	return uint32(buffer)
+}
+
+// highRateQuantum returns the quantum, in bytes, of a high-rate class of rate bytes per second.
+func highRateQuantum(rate uint64) uint32 {
+	quantum := rate * highRateQuantumTime / 1e6
+	if quantum < minHighRateQuantum {
+		return minHighRateQuantum
+	}
+	if quantum > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	return uint32(quantum)
+}
+
+// Quantum returns the quantum, in bytes, the kernel uses for a class of rate bits per second added by ReplaceClass:
+// that of high-rate mode, or the rate over the r2q of the qdisc, 10 by default, within the bounds HTB clamps it to.
+// It is how much the class sends in a round when classes sharing a parent borrow from it.
+func Quantum(rate uint64) uint32 {
+	if rate >= HighRate {
+		return highRateQuantum(rate / 8)
+	}
+	quantum := rate / 8 / htbR2Q
+	switch {
+	case quantum < minHTBQuantum:
+		return minHTBQuantum
+	case quantum > maxHTBQuantum:
+		return maxHTBQuantum
+	}
+	return uint32(quantum)
+}
+
+// ReplaceClass adds class, or replaces the class with its handle, as netlink.ClassReplace does, with class built by
+// netlink.NewHtbClass. A class in high-rate mode gets a quantum scaled to its rate, unless it was given one. netlink.ClassReplace truncates
+// rates to the 32 bits of tc_ratespec, which only holds up to about 34 Gbit/s, so the rate and ceil of classes above
+// it are sent in the 64-bit attributes the kernel takes them in.
+func ReplaceClass(class *netlink.HtbClass) error {
+	if class.Rate >= HighRate/8 && class.Quantum == netlinkQuantum {
+		class.Quantum = highRateQuantum(class.Rate)
+	}
+	if class.Rate <= math.MaxUint32 && class.Ceil <= math.MaxUint32 {
+		return CountNetlink("ClassReplace", func() error { return netlink.ClassReplace(class) })
+	}
+	return CountNetlink("ClassReplace", func() error { return replaceClass64(class) })
+}
+
+// replaceClass64 is netlink.ClassReplace for HTB classes, with the rate and ceil also in TCA_HTB_RATE64 and
+// TCA_HTB_CEIL64. tc_ratespec then holds the largest rate it can, as tc(8) does.
+func replaceClass64(class *netlink.HtbClass) error {
+	req := nl.NewNetlinkRequest(syscall.RTM_NEWTCLASS, syscall.NLM_F_CREATE|syscall.NLM_F_ACK)
+	req.AddData(&nl.TcMsg{
+		Family:  nl.FAMILY_ALL,
+		Ifindex: int32(class.LinkIndex),
+		Handle:  class.Handle,
+		Parent:  class.Parent,
+	})
+	req.AddData(nl.NewRtAttr(nl.TCA_KIND, nl.ZeroTerminated(class.Type())))
+
+	opt := nl.TcHtbCopt{
+		Rate:    nl.TcRateSpec{Rate: clamp32(class.Rate)},
+		Ceil:    nl.TcRateSpec{Rate: clamp32(class.Ceil)},
+		Buffer:  class.Buffer,
+		Cbuffer: class.Cbuffer,
+		Quantum: class.Quantum,
+		Level:   class.Level,
+		Prio:    class.Prio,
+	}
+	var rtab, ctab [256]uint32
+	if netlink.CalcRtable(&opt.Rate, rtab, -1, 1600, nl.LINKLAYER_ETHERNET) < 0 {
+		return errors.New("HTB: failed to calculate rate table")
+	}
+	if netlink.CalcRtable(&opt.Ceil, ctab, -1, 1600, nl.LINKLAYER_ETHERNET) < 0 {
+		return errors.New("HTB: failed to calculate ceil rate table")
+	}
+	options := nl.NewRtAttr(nl.TCA_OPTIONS, nil)
+	nl.NewRtAttrChild(options, nl.TCA_HTB_PARMS, opt.Serialize())
+	nl.NewRtAttrChild(options, nl.TCA_HTB_RTAB, netlink.SerializeRtab(rtab))
+	nl.NewRtAttrChild(options, nl.TCA_HTB_CTAB, netlink.SerializeRtab(ctab))
+	nl.NewRtAttrChild(options, nl.TCA_HTB_RATE64, nl.Uint64Attr(class.Rate))
+	nl.NewRtAttrChild(options, nl.TCA_HTB_CEIL64, nl.Uint64Attr(class.Ceil))
+	req.AddData(options)
+	_, err := req.Execute(syscall.NETLINK_ROUTE, 0)
+	return err
+}
+
+func clamp32(v uint64) uint32 {
+	if v > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(v)
+}
@@ -0,0 +1,109 @@
+package shaping
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+)
+
+// DefaultBurst is the buffer, in bytes, of the classes ApplyLimits programs when Limits leaves it unset.
+const DefaultBurst = 32 * 1024
+
+// Limits are the rates, in bits per second, a device of the caller's own is shaped to, apart from the pods of the
+// plugin. A zero rate leaves its direction unshaped.
+type Limits struct {
+	// Egress is the rate of what the device transmits, shaped by an HTB qdisc at its root.
+	Egress uint64
+	// Ingress is the rate of what the device receives, redirected to an IFB device whose root HTB qdisc shapes it.
+	Ingress uint64
+	// EgressBurst and IngressBurst are the buffers of the classes of each direction, in bytes, or zero for
+	// DefaultBurst, or for the buffer of the rate in high-rate mode if it is larger.
+	EgressBurst  uint32
+	IngressBurst uint32
+	// Ceil, if above the rates, is the most either direction may send by borrowing above its rate.
+	Ceil uint64
+}
+
+// Stats are what the classes ApplyLimits programmed counted, for each direction.
+type Stats struct {
+	EgressBytes       uint64
+	EgressPackets     uint64
+	EgressDrops       uint64
+	EgressOverlimits  uint64
+	IngressBytes      uint64
+	IngressPackets    uint64
+	IngressDrops      uint64
+	IngressOverlimits uint64
+}
+
+// ApplyLimits shapes link to limits, replacing what an earlier call programmed, with the traffic it receives
+// redirected to the IFB device ifbName. The shaping of a direction without a rate is removed, with the IFB device
+// for ingress.
+func ApplyLimits(link netlink.Link, ifbName string, limits Limits) error {
+	s := &Shaper{Ceil: limits.Ceil}
+	if limits.Egress != 0 {
+		if err := s.SetupEgress(link, limits.Egress, limitsBurst(limits.EgressBurst, limits.Egress)); err != nil {
+			return err
+		}
+	} else {
+		DeleteRootQdisc(link)
+	}
+	if limits.Ingress != 0 {
+		return s.SetupIngress(link, ifbName, limits.Ingress, limitsBurst(limits.IngressBurst, limits.Ingress))
+	}
+	if ingress := IngressQdisc(link); ingress != nil {
+		if err := CountNetlink("QdiscDel", func() error { return netlink.QdiscDel(ingress) }); err != nil {
+			return fmt.Errorf("failed to remove ingress qdisc of %q: %v", link.Attrs().Name, err)
+		}
+	}
+	_, err := DeleteIFB(ifbName)
+	return err
+}
+
+// limitsBurst returns burst, or the default buffer of a class of rate bits per second if it is zero.
+func limitsBurst(burst uint32, rate uint64) uint32 {
+	if burst != 0 {
+		return burst
+	}
+	if rate >= HighRate && HighRateBuffer(rate) > DefaultBurst {
+		return HighRateBuffer(rate)
+	}
+	return DefaultBurst
+}
+
+// ReadStats returns what the classes ApplyLimits programmed on link, and on the IFB device ifbName, counted. A
+// direction that isn't shaped counts nothing.
+func ReadStats(link netlink.Link, ifbName string) (Stats, error) {
+	var stats Stats
+	err := readClassStats(link, HostVethQdiscMajor, &stats.EgressBytes, &stats.EgressPackets, &stats.EgressDrops,
+		&stats.EgressOverlimits)
+	if err != nil {
+		return stats, err
+	}
+	ifb, err := netlink.LinkByName(ifbName)
+	if err != nil {
+		return stats, nil
+	}
+	err = readClassStats(ifb, IFBQdiscMajor, &stats.IngressBytes, &stats.IngressPackets, &stats.IngressDrops,
+		&stats.IngressOverlimits)
+	return stats, err
+}
+
+// readClassStats reads the counters of the class of generation 0 under the root HTB qdisc major: of link.
+func readClassStats(link netlink.Link, major uint16, bytes, packets, drops, overlimits *uint64) error {
+	classes, err := netlink.ClassList(link, netlink.MakeHandle(major, 0))
+	if err != nil {
+		return fmt.Errorf("failed to list classes of %q: %v", link.Attrs().Name, err)
+	}
+	for _, c := range classes {
+		stats := c.Attrs().Statistics
+		if c.Attrs().Handle != netlink.MakeHandle(major, ClassMinor(0)) || stats == nil || stats.Basic == nil {
+			continue
+		}
+		*bytes, *packets = stats.Basic.Bytes, uint64(stats.Basic.Packets)
+		if stats.Queue != nil {
+			*drops, *overlimits = uint64(stats.Queue.Drops), uint64(stats.Queue.Overlimits)
+		}
+	}
+	return nil
+}
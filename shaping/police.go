@@ -0,0 +1,130 @@
+package shaping
+
+import (
+	"math"
+	"syscall"
+
+	"github.com/projectcalico/cni-plugin/internal/nlconst"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// Without IFB devices, the traffic a host veth receives can't be shaped, only policed: a police action on a u32
+// filter of its ingress qdisc drops what exceeds the rate. netlink has no police action, so the filter is built here,
+// as the marking filters are.
+
+// policeMTU is the largest packet the police action passes, which is the largest GSO packet a veth receives rather
+// than its MTU. The burst of the action is at least as large, or it would drop every such packet.
+const policeMTU = 64 * 1024
+
+// SetupPolicer polices the traffic link receives, which for a host veth is the traffic leaving the pod, to rate bits
+// per second, with burst bytes of credit, by a filter at the first priority of its ingress qdisc. The filter an
+// earlier attempt left there is replaced.
+func SetupPolicer(link netlink.Link, rate uint64, burst uint32) error {
+	ingress := netlink.MakeHandle(0xffff, 0)
+	qdiscIngress := &netlink.Ingress{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    ingress,
+			Parent:    netlink.HANDLE_INGRESS,
+		},
+	}
+	if err := EnsureQdisc(link, qdiscIngress); err != nil {
+		return err
+	}
+	return addPolicer(link, ingress, rate, burst)
+}
+
+// SetupHookPolicer polices the traffic crossing hook, netlink.HANDLE_MIN_INGRESS or netlink.HANDLE_MIN_EGRESS, of a
+// clsact qdisc of link, which replaces its ingress qdisc, to rate bits per second, with burst bytes of credit. With
+// both hooks of a host veth policed, both directions of the pod are limited without queueing any of its traffic.
+// The filter an earlier attempt left on hook is replaced.
+func SetupHookPolicer(link netlink.Link, hook uint32, rate uint64, burst uint32) error {
+	if err := ensureClsact(link); err != nil {
+		return err
+	}
+	return addPolicer(link, hook, rate, burst)
+}
+
+// HasPolicer reports whether there is a filter at the priority of the policers under parent, an ingress qdisc or a
+// hook of a clsact qdisc, of link.
+func HasPolicer(link netlink.Link, parent uint32) bool {
+	filters, err := netlink.FilterList(link, parent)
+	if err != nil {
+		return false
+	}
+	for _, f := range filters {
+		if f.Attrs().Priority == FilterBase(0) {
+			return true
+		}
+	}
+	return false
+}
+
+// addPolicer adds the u32 filter policing all the traffic under parent on link to rate bits per second, with burst
+// bytes of credit, at the first priority, in place of the filters there.
+func addPolicer(link netlink.Link, parent uint32, rate uint64, burst uint32) error {
+	attrs := &netlink.FilterAttrs{
+		LinkIndex: link.Attrs().Index,
+		Parent:    parent,
+		Priority:  FilterBase(0),
+		Protocol:  nlconst.ProtoAll,
+	}
+	if err := clearFilterPrio(link, attrs); err != nil {
+		return err
+	}
+	req := nl.NewNetlinkRequest(syscall.RTM_NEWTFILTER, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL|syscall.NLM_F_ACK)
+	req.AddData(&nl.TcMsg{
+		Family:  nl.FAMILY_ALL,
+		Ifindex: int32(attrs.LinkIndex),
+		Parent:  attrs.Parent,
+		Info:    nlconst.FilterInfo(attrs.Priority, attrs.Protocol),
+	})
+	req.AddData(nl.NewRtAttr(nl.TCA_KIND, nl.ZeroTerminated("u32")))
+
+	options := nl.NewRtAttr(nl.TCA_OPTIONS, nil)
+	nl.NewRtAttrChild(options, nl.TCA_U32_SEL, u32Sel(nil).Serialize())
+	actions := nl.NewRtAttrChild(options, nl.TCA_U32_ACT, nil)
+	action := nl.NewRtAttrChild(actions, nl.TCA_ACT_TAB, nil)
+	nl.NewRtAttrChild(action, nl.TCA_ACT_KIND, nl.ZeroTerminated("police"))
+	parms := nl.NewRtAttrChild(action, nl.TCA_ACT_OPTIONS, nil)
+	police, rtab := policeParms(rate, burst)
+	nl.NewRtAttrChild(parms, nl.TCA_POLICE_TBF, police.Serialize())
+	nl.NewRtAttrChild(parms, nl.TCA_POLICE_RATE, rtab)
+	req.AddData(options)
+
+	err := CountNetlink("FilterAdd", func() error {
+		_, err := req.Execute(syscall.NETLINK_ROUTE, 0)
+		return err
+	})
+	if err != nil {
+		return moduleError(err, "add policer to "+link.Attrs().Name, "act_police")
+	}
+	return nil
+}
+
+// policeParms returns the parameters of a police action dropping what exceeds rate bits per second, with burst
+// bytes of credit, and its rate table: how long each of 256 cells of packet sizes, up to policeMTU, takes to send.
+// The rate spec holds 32 bits of bytes per second, so faster rates are policed at its largest.
+func policeParms(rate uint64, burst uint32) (*nl.TcPolice, []byte) {
+	bytesPerSec := rate / 8
+	if bytesPerSec > math.MaxUint32 {
+		bytesPerSec = math.MaxUint32
+	}
+	if burst < policeMTU {
+		burst = policeMTU
+	}
+	police := &nl.TcPolice{Action: int32(netlink.TC_POLICE_SHOT), Mtu: policeMTU}
+	police.Rate.Rate = uint32(bytesPerSec)
+	police.Rate.Linklayer = nl.LINKLAYER_ETHERNET
+	for policeMTU>>police.Rate.CellLog > 255 {
+		police.Rate.CellLog++
+	}
+	police.Burst = uint32(netlink.Xmittime(bytesPerSec, burst))
+	rtab := make([]byte, 256*4)
+	for i := 0; i < 256; i++ {
+		size := uint32(i+1) << police.Rate.CellLog
+		nlconst.Native.PutUint32(rtab[4*i:], uint32(netlink.Xmittime(bytesPerSec, size)))
+	}
+	return police, rtab
+}
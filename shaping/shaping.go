@@ -0,0 +1,358 @@
+// Package shaping programs the tc hierarchies that shape the traffic of a pod on its host veth: an HTB qdisc at the
+// root of the veth shapes what it transmits to the pod, and what it receives from the pod is redirected to an IFB
+// device whose root HTB qdisc shapes it. Alternatively, BPF programs on a clsact qdisc of the veth pace what it
+// transmits and police what it receives, with no IFB device. The package knows nothing of CNI, so the plugin, a
+// standalone tool or a daemon can all drive it.
+package shaping
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/projectcalico/cni-plugin/logging"
+	"github.com/vishvananda/netlink"
+)
+
+var tcLog = logging.Logger(logging.TC)
+
+// Handles of the HTB hierarchies. The host veth root qdisc shapes traffic into the pod, and the IFB device (fed by
+// a redirect from the host veth ingress qdisc) shapes traffic out of it.
+const (
+	HostVethQdiscMajor = 0x2
+	IFBQdiscMajor      = 0x1
+	shapingClassMinor  = 0x56cb
+
+	// leafMajor is the handle major of the leaf qdisc attached under the class of generation 0.
+	leafMajor = 0x10
+
+	// ParentClassMinor is the class of a device the classes of a pod borrow from, up to their ceil, when it is above
+	// their rate.
+	ParentClassMinor = 0x1
+)
+
+// The classes and filters of a pod alternate between two generations, so that a new set can be built next to the
+// current one before traffic is switched over to it. Generation gen uses class minor ClassMinor(gen), leaf qdisc
+// major leafMajor+gen and the filter priorities from FilterBase(gen) up to, but excluding,
+// FilterBase(gen)+filterBandSize.
+const filterBandSize = 10
+
+// ClassMinor is the minor of the shaping class of generation gen.
+func ClassMinor(gen int) uint16 {
+	return shapingClassMinor + uint16(gen)
+}
+
+// FilterBase is the first filter priority of generation gen.
+func FilterBase(gen int) uint16 {
+	return 1 + filterBandSize*uint16(gen)
+}
+
+// ParentMinor returns the minor of the class the classes of a pod with rate and ceil are under: ParentClassMinor
+// if they borrow above their rate, and 0, the root qdisc, otherwise.
+func ParentMinor(rate, ceil uint64) uint16 {
+	if ceil > rate {
+		return ParentClassMinor
+	}
+	return 0
+}
+
+// Leaf qdiscs that can be attached under the classes, with the kernel's defaults: fq_codel keeps the queue of each
+// flow short, sfq shares the class fairly between flows, and pfifo is a plain packet FIFO, as HTB uses when a class
+// has no leaf.
+const (
+	LeafFQCodel = "fq_codel"
+	LeafSFQ     = "sfq"
+	LeafPFIFO   = "pfifo"
+)
+
+// Classifiers of the catch-all filters classifying the IPv4 traffic of a pod into its class, and redirecting it to
+// its IFB device: a u32 filter with a key of empty mask, which matches everything, or a matchall filter, which
+// needs kernel 4.8 but doesn't depend on how u32 treats such keys. IPv6 and non-IP traffic always has matchall
+// filters, and the redirect filters marking a DSCP are u32 ones.
+const (
+	ClassifierU32      = "u32"
+	ClassifierMatchAll = "matchall"
+)
+
+// IPv6Generation is the generation whose class holds the IPv6 traffic of generation gen when IPv6 has a class of
+// its own. Its class minor and leaf qdisc don't collide with those of either generation.
+func IPv6Generation(gen int) int {
+	return gen + 2
+}
+
+// CountNetlink runs call, the netlink operation op. The plugin replaces it to count and time the operations of the
+// package with its own.
+var CountNetlink = func(op string, call func() error) error {
+	return call()
+}
+
+// Shaper programs the classes and filters of one generation of the shaping of a pod.
+type Shaper struct {
+	// Generation is the generation, 0 or 1, of the classes and filters.
+	Generation int
+	// Prio is the HTB priority of the classes; 0 is served first when classes share a parent.
+	Prio uint32
+	// Cbuffer is how much the classes may send back to back above their rate, in bytes, or zero for the kernel's
+	// default.
+	Cbuffer uint32
+	// Ceil is the most the classes may send, in bits per second, by borrowing from a class of that rate at
+	// ParentClassMinor. The classes are kept to their rate, under the root qdisc, unless it is above it. The parent
+	// class is per device, so a rate below the ceil only guarantees anything between the classes of the device.
+	Ceil uint64
+	// LowLatency attaches an fq_codel qdisc under the classes so that their queues are kept short, whatever Leaf.
+	LowLatency bool
+	// Leaf is the qdisc attached under the classes: LeafFQCodel, LeafSFQ, LeafPFIFO or, if empty, none.
+	Leaf string
+	// SeparateIPv6 gives IPv6 traffic a class of its own with the full rate, rather than sharing the IPv4 class.
+	SeparateIPv6 bool
+	// NonIP is what is done with traffic that is neither IPv4 nor IPv6: NonIPUnshaped, the default if empty,
+	// NonIPShaped or NonIPDrop.
+	NonIP string
+	// DSCP, if set, is marked on the IP traffic SetupIngress redirects, for the network to prioritize the traffic
+	// of the pod.
+	DSCP *uint8
+	// Classifier is the classifier of the catch-all IPv4 filters: ClassifierU32, the default if empty, or
+	// ClassifierMatchAll.
+	Classifier string
+	// MirrorTo, if set, is the device the IP and shaped non-IP traffic of the pod is copied to, in both directions,
+	// by the filters classifying and redirecting it, for it to be analysed. It isn't supported with DSCP.
+	MirrorTo string
+}
+
+// mirrorIndex returns the index of the MirrorTo device of s, or zero if s mirrors nothing.
+func (s *Shaper) mirrorIndex() (int, error) {
+	if s.MirrorTo == "" {
+		return 0, nil
+	}
+	link, err := netlink.LinkByName(s.MirrorTo)
+	if err != nil {
+		return 0, fmt.Errorf("failed to lookup mirror device %q: %v", s.MirrorTo, err)
+	}
+	return link.Attrs().Index, nil
+}
+
+// SetupEgress shapes the traffic link transmits, which for a host veth is the traffic entering the pod, to rate
+// bits per second with an HTB qdisc at the root of link. burst is the buffer of the class in bytes. Shaping left on
+// link by an earlier attempt is reconciled with it.
+func (s *Shaper) SetupEgress(link netlink.Link, rate uint64, burst uint32) error {
+	mirror, err := s.mirrorIndex()
+	if err != nil {
+		return err
+	}
+	qdisc := netlink.NewHtb(netlink.QdiscAttrs{
+		LinkIndex: link.Attrs().Index,
+		Handle:    netlink.MakeHandle(HostVethQdiscMajor, 0x0),
+		Parent:    netlink.HANDLE_ROOT,
+	})
+	if err := replaceRootQdisc(link, qdisc); err != nil {
+		return moduleError(err, "add HTB qdisc to "+link.Attrs().Name, "sch_htb")
+	}
+	return s.setupClassifier(link, HostVethQdiscMajor, rate, burst, s.NonIP, 16, mirror)
+}
+
+// SetupIngress shapes the traffic link receives, which for a host veth is the traffic leaving the pod, to rate bits
+// per second: it is redirected to the IFB device ifbName, whose root HTB qdisc shapes it. burst is the buffer of the
+// class in bytes. An IFB device and shaping left by an earlier attempt are reconciled with it.
+func (s *Shaper) SetupIngress(link netlink.Link, ifbName string, rate uint64, burst uint32) error {
+	mirror, err := s.mirrorIndex()
+	if err != nil {
+		return err
+	}
+	redir, err := EnsureIFB(ifbName)
+	if err != nil {
+		return err
+	}
+	ingress := netlink.MakeHandle(0xffff, 0)
+	qdiscIngress := &netlink.Ingress{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    ingress,
+			Parent:    netlink.HANDLE_INGRESS,
+		},
+	}
+	if err = EnsureQdisc(link, qdiscIngress); err != nil {
+		return err
+	}
+	base := FilterBase(s.Generation)
+	if s.DSCP != nil {
+		err = AddMarkingRedirectFilters(link, ingress, base, redir.Attrs().Index, *s.DSCP)
+	} else if err = s.addIPv4Filter(link, ingress, base, 0, redir.Attrs().Index, 0, mirror); err == nil {
+		err = AddIPv6Filter(link, ingress, base, 0, redir.Attrs().Index, mirror)
+	}
+	if err != nil {
+		return err
+	}
+	// Non-IP traffic is dropped before it is redirected, or redirected to be shaped with the rest.
+	if err = AddNonIPFilters(link, ingress, base, s.NonIP, 0, redir.Attrs().Index, mirror); err != nil {
+		return err
+	}
+
+	qdisc := netlink.NewHtb(netlink.QdiscAttrs{
+		LinkIndex: redir.Attrs().Index,
+		Handle:    netlink.MakeHandle(IFBQdiscMajor, 0x0),
+		Parent:    netlink.HANDLE_ROOT,
+	})
+	if err = replaceRootQdisc(redir, qdisc); err != nil {
+		return moduleError(err, "add HTB qdisc to "+ifbName, "sch_htb")
+	}
+	nonIP := ""
+	if s.NonIP == NonIPShaped {
+		// Other non-IP traffic was already dealt with on link.
+		nonIP = NonIPShaped
+	}
+	// The traffic was mirrored as it was redirected.
+	return s.setupClassifier(redir, IFBQdiscMajor, rate, burst, nonIP, 12, 0)
+}
+
+// setupClassifier programs the class of the generation of s under the root HTB qdisc major: of link, with the
+// parent class it borrows from if it has a ceil, and the filters classifying traffic into it. The IPv4 filter
+// matches the word at offset keyOff of the IP header with an empty mask, so it matches everything. The filters copy
+// the traffic to the device with index mirror first if that isn't zero.
+func (s *Shaper) setupClassifier(link netlink.Link, major uint16, rate uint64, burst uint32, nonIP string, keyOff int32, mirror int) error {
+	qdiscHandle := netlink.MakeHandle(major, 0x0)
+	classID := netlink.MakeHandle(major, ClassMinor(s.Generation))
+	if ParentMinor(rate, s.Ceil) != 0 {
+		parent := netlink.NewHtbClass(netlink.ClassAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    netlink.MakeHandle(major, 0),
+			Handle:    netlink.MakeHandle(major, ParentClassMinor),
+		}, netlink.HtbClassAttrs{
+			Rate:    s.Ceil,
+			Ceil:    s.Ceil,
+			Buffer:  burst,
+			Cbuffer: s.Cbuffer,
+		})
+		if err := ReplaceClass(parent); err != nil {
+			return fmt.Errorf("failed to add parent HTB class on %q: %v", link.Attrs().Name, err)
+		}
+	}
+	if err := s.addClass(link, major, s.Generation, rate, burst); err != nil {
+		return err
+	}
+	if err := s.addIPv4Filter(link, qdiscHandle, FilterBase(s.Generation), classID, 0, keyOff, mirror); err != nil {
+		return err
+	}
+	v6Class := classID
+	if s.SeparateIPv6 {
+		gen := IPv6Generation(s.Generation)
+		if err := s.addClass(link, major, gen, rate, burst); err != nil {
+			return err
+		}
+		v6Class = netlink.MakeHandle(major, ClassMinor(gen))
+	}
+	if err := AddIPv6Filter(link, qdiscHandle, FilterBase(s.Generation), v6Class, 0, mirror); err != nil {
+		return err
+	}
+	return AddNonIPFilters(link, qdiscHandle, FilterBase(s.Generation), nonIP, classID, 0, mirror)
+}
+
+// addIPv4Filter adds the catch-all filter of the classifier of s matching all IPv4 traffic under parent on link,
+// classifying it into classID or redirecting it to the device with index redirIndex if that isn't zero, after
+// copying it to the device with index mirrorIndex if that isn't zero. The key of a u32 filter is at offset keyOff of
+// the IP header.
+func (s *Shaper) addIPv4Filter(link netlink.Link, parent uint32, prio uint16, classID uint32, redirIndex int, keyOff int32, mirrorIndex int) error {
+	attrs := netlink.FilterAttrs{
+		LinkIndex: link.Attrs().Index,
+		Parent:    parent,
+		Priority:  prio,
+		Protocol:  syscall.ETH_P_IP,
+	}
+	actions := mirrorActions(mirrorIndex)
+	if redirIndex != 0 {
+		actions = append(actions, netlink.NewMirredAction(redirIndex))
+	}
+	var filter netlink.Filter
+	switch {
+	case s.Classifier == ClassifierMatchAll:
+		filter = &netlink.MatchAll{FilterAttrs: attrs, ClassId: classID, Actions: actions}
+	default:
+		filter = &netlink.U32{
+			FilterAttrs: attrs,
+			Sel: &netlink.TcU32Sel{
+				Keys:  []netlink.TcU32Key{{Off: keyOff}},
+				Flags: netlink.TC_U32_TERMINAL,
+			},
+			// The redirect is among the actions, after the mirror, rather than in RedirIndex, which would put it
+			// first.
+			ClassId: classID,
+			Actions: append([]netlink.Action{}, actions...),
+		}
+	}
+	if err := ReplaceFilter(link, filter); err != nil {
+		return fmt.Errorf("failed to add IPv4 filter on %q: %v", link.Attrs().Name, err)
+	}
+	return nil
+}
+
+// addClass adds, or updates, the shaping class of generation gen under the root HTB qdisc major: of link, with the
+// given rate and buffer and the ceil, priority, cbuffer and leaf qdisc of s.
+func (s *Shaper) addClass(link netlink.Link, major uint16, gen int, rate uint64, burst uint32) error {
+	classID := netlink.MakeHandle(major, ClassMinor(gen))
+	ceil := rate
+	if s.Ceil > rate {
+		ceil = s.Ceil
+	}
+	class := netlink.NewHtbClass(netlink.ClassAttrs{
+		LinkIndex: link.Attrs().Index,
+		Parent:    netlink.MakeHandle(major, ParentMinor(rate, s.Ceil)),
+		Handle:    classID,
+	}, netlink.HtbClassAttrs{
+		Rate:    rate,
+		Ceil:    ceil,
+		Buffer:  burst,
+		Cbuffer: s.Cbuffer,
+		Prio:    s.Prio,
+	})
+	if err := ReplaceClass(class); err != nil {
+		return fmt.Errorf("failed to add HTB class on %q: %v", link.Attrs().Name, err)
+	}
+	kind := s.Leaf
+	if s.LowLatency {
+		kind = LeafFQCodel
+	}
+	if kind == "" {
+		return nil
+	}
+	attrs := netlink.QdiscAttrs{
+		LinkIndex: link.Attrs().Index,
+		Handle:    netlink.MakeHandle(leafMajor+uint16(gen), 0),
+		Parent:    classID,
+	}
+	var leaf netlink.Qdisc = &netlink.GenericQdisc{QdiscAttrs: attrs, QdiscType: kind}
+	if kind == LeafFQCodel {
+		leaf = netlink.NewFqCodel(attrs)
+	}
+	if err := CountNetlink("QdiscReplace", func() error { return netlink.QdiscReplace(leaf) }); err != nil {
+		return moduleError(err, fmt.Sprintf("add %s under class %x", kind, classID), "sch_"+kind)
+	}
+	return nil
+}
+
+// Teardown removes the shaping SetupEgress and SetupIngress, SetupEDT and SetupBPFPolicer, or the policers of
+// SetupPolicer and SetupHookPolicer, programmed on link, of every generation: its root and ingress or clsact qdiscs,
+// with their classes, filters and programs. The IFB device traffic was redirected to and the pinned maps of the
+// programs are left to the caller, which named them; see DeleteIFB and RemovePins.
+func Teardown(link netlink.Link) {
+	if ingress := IngressQdisc(link); ingress != nil {
+		if err := CountNetlink("QdiscDel", func() error { return netlink.QdiscDel(ingress) }); err != nil {
+			tcLog.WithError(err).WithField("interface", link.Attrs().Name).Debug("Failed to remove ingress qdisc")
+		}
+	}
+	DeleteRootQdisc(link)
+}
+
+// DeleteRootQdisc removes the root qdisc of link, whatever its kind; the kernel refuses to delete a qdisc by handle
+// under a different kind.
+func DeleteRootQdisc(link netlink.Link) {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return
+	}
+	for _, q := range qdiscs {
+		if q.Attrs().Parent != netlink.HANDLE_ROOT {
+			continue
+		}
+		if err = CountNetlink("QdiscDel", func() error { return netlink.QdiscDel(q) }); err != nil {
+			tcLog.WithError(err).WithField("interface", link.Attrs().Name).Debug("Failed to remove root qdisc")
+		}
+	}
+}
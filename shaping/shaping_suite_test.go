@@ -0,0 +1,13 @@
+package shaping_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestShaping(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Shaping Suite")
+}
@@ -0,0 +1,257 @@
+package shaping_test
+
+import (
+	"math"
+	"path/filepath"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/ns"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/cni-plugin/shaping"
+	"github.com/vishvananda/netlink"
+)
+
+var _ = Describe("Generations", func() {
+	It("don't share class minors or filter priorities", func() {
+		minors := map[uint16]bool{}
+		for _, gen := range []int{0, 1, shaping.IPv6Generation(0), shaping.IPv6Generation(1)} {
+			Expect(minors).NotTo(HaveKey(shaping.ClassMinor(gen)))
+			minors[shaping.ClassMinor(gen)] = true
+		}
+		Expect(shaping.FilterBase(1)).To(BeNumerically(">", shaping.FilterBase(0)+3))
+	})
+})
+
+var _ = Describe("HighRateBuffer", func() {
+	It("lasts a millisecond at the rate", func() {
+		Expect(shaping.HighRateBuffer(10 * 1000 * 1000 * 1000)).To(Equal(uint32(1250 * 1000)))
+	})
+
+	It("is bounded", func() {
+		Expect(shaping.HighRateBuffer(math.MaxUint64)).To(Equal(uint32(64 << 20)))
+	})
+})
+
+// The tests below program tc in a scratch network namespace, so they need to run as root.
+var _ = Describe("Shaper", func() {
+	var testNS ns.NetNS
+	var veth netlink.Link
+
+	BeforeEach(func() {
+		var err error
+		testNS, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		err = testNS.Do(func(ns.NetNS) error {
+			err := netlink.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "shtest0"}, PeerName: "shtest1"})
+			if err != nil {
+				return err
+			}
+			if veth, err = netlink.LinkByName("shtest0"); err != nil {
+				return err
+			}
+			return netlink.LinkSetUp(veth)
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(testNS.Close()).To(Succeed())
+	})
+
+	// inNS runs f in the scratch namespace.
+	inNS := func(f func()) {
+		Expect(testNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			f()
+			return nil
+		})).To(Succeed())
+	}
+
+	rootQdisc := func(link netlink.Link) netlink.Qdisc {
+		qdiscs, err := netlink.QdiscList(link)
+		Expect(err).NotTo(HaveOccurred())
+		for _, q := range qdiscs {
+			if q.Attrs().Parent == netlink.HANDLE_ROOT {
+				return q
+			}
+		}
+		return nil
+	}
+
+	It("shapes what a link transmits with an HTB class", func() {
+		inNS(func() {
+			s := &shaping.Shaper{}
+			Expect(s.SetupEgress(veth, 10*1000*1000, 32*1024)).To(Succeed())
+			Expect(rootQdisc(veth)).To(BeAssignableToTypeOf(&netlink.Htb{}))
+			classes, err := netlink.ClassList(veth, netlink.MakeHandle(shaping.HostVethQdiscMajor, 0))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(classes).To(HaveLen(1))
+			Expect(classes[0].(*netlink.HtbClass).Rate).To(Equal(uint64(10 * 1000 * 1000 / 8)))
+		})
+	})
+
+	It("puts classes with a ceil under a parent class they borrow from", func() {
+		inNS(func() {
+			s := &shaping.Shaper{Ceil: 50 * 1000 * 1000}
+			Expect(s.SetupEgress(veth, 10*1000*1000, 32*1024)).To(Succeed())
+			classes, err := netlink.ClassList(veth, netlink.MakeHandle(shaping.HostVethQdiscMajor, 0))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(classes).To(HaveLen(2))
+			for _, c := range classes {
+				htb := c.(*netlink.HtbClass)
+				Expect(htb.Ceil).To(Equal(uint64(50 * 1000 * 1000 / 8)))
+				if c.Attrs().Handle != netlink.MakeHandle(shaping.HostVethQdiscMajor, shaping.ParentClassMinor) {
+					Expect(c.Attrs().Parent).To(Equal(netlink.MakeHandle(shaping.HostVethQdiscMajor, shaping.ParentClassMinor)))
+					Expect(htb.Rate).To(Equal(uint64(10 * 1000 * 1000 / 8)))
+				}
+			}
+		})
+	})
+
+	It("attaches the leaf qdisc under the class", func() {
+		inNS(func() {
+			s := &shaping.Shaper{Leaf: shaping.LeafSFQ}
+			Expect(s.SetupEgress(veth, 10*1000*1000, 32*1024)).To(Succeed())
+			qdiscs, err := netlink.QdiscList(veth)
+			Expect(err).NotTo(HaveOccurred())
+			var leaves []string
+			for _, q := range qdiscs {
+				if q.Attrs().Parent == netlink.MakeHandle(shaping.HostVethQdiscMajor, shaping.ClassMinor(0)) {
+					leaves = append(leaves, q.Type())
+				}
+			}
+			Expect(leaves).To(Equal([]string{shaping.LeafSFQ}))
+		})
+	})
+
+	It("programs rates that don't fit in 32 bits", func() {
+		inNS(func() {
+			s := &shaping.Shaper{}
+			Expect(s.SetupEgress(veth, 40*1000*1000*1000, shaping.HighRateBuffer(40*1000*1000*1000))).To(Succeed())
+			classes, err := netlink.ClassList(veth, netlink.MakeHandle(shaping.HostVethQdiscMajor, 0))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(classes).To(HaveLen(1))
+			// The kernel reports the largest 32-bit rate, and the rate itself in an attribute netlink doesn't read.
+			Expect(classes[0].(*netlink.HtbClass).Rate).To(Equal(uint64(math.MaxUint32)))
+		})
+	})
+
+	It("reconciles a retried setup rather than duplicating it", func() {
+		inNS(func() {
+			s := &shaping.Shaper{}
+			parent := netlink.MakeHandle(shaping.HostVethQdiscMajor, 0)
+			Expect(s.SetupEgress(veth, 10*1000*1000, 32*1024)).To(Succeed())
+			filters, err := netlink.FilterList(veth, parent)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(s.SetupEgress(veth, 10*1000*1000, 32*1024)).To(Succeed())
+			again, err := netlink.FilterList(veth, parent)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(again).To(HaveLen(len(filters)))
+		})
+	})
+
+	It("shapes what a link receives on an IFB device", func() {
+		inNS(func() {
+			s := &shaping.Shaper{}
+			Expect(s.SetupIngress(veth, "shtestifb", 10*1000*1000, 32*1024)).To(Succeed())
+			ifb, err := netlink.LinkByName("shtestifb")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rootQdisc(ifb)).To(BeAssignableToTypeOf(&netlink.Htb{}))
+			filters, err := netlink.FilterList(veth, netlink.MakeHandle(0xffff, 0))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filters).NotTo(BeEmpty())
+		})
+	})
+
+	It("marks what it redirects to the IFB device with a DSCP", func() {
+		inNS(func() {
+			dscp := uint8(46)
+			s := &shaping.Shaper{DSCP: &dscp}
+			Expect(s.SetupIngress(veth, "shtestifb", 10*1000*1000, 32*1024)).To(Succeed())
+			filters, err := netlink.FilterList(veth, netlink.MakeHandle(0xffff, 0))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filters).NotTo(BeEmpty())
+			for _, f := range filters {
+				Expect(f).To(BeAssignableToTypeOf(&netlink.U32{}))
+			}
+			Expect(s.SetupIngress(veth, "shtestifb", 10*1000*1000, 32*1024)).To(Succeed())
+			again, err := netlink.FilterList(veth, netlink.MakeHandle(0xffff, 0))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(again).To(HaveLen(len(filters)))
+		})
+	})
+
+	It("polices what a link receives without an IFB device", func() {
+		inNS(func() {
+			Expect(shaping.SetupPolicer(veth, 10*1000*1000, 32*1024)).To(Succeed())
+			Expect(shaping.SetupPolicer(veth, 20*1000*1000, 32*1024)).To(Succeed())
+			filters, err := netlink.FilterList(veth, netlink.MakeHandle(0xffff, 0))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filters).To(HaveLen(1))
+			Expect(filters[0]).To(BeAssignableToTypeOf(&netlink.U32{}))
+			_, err = netlink.LinkByName("shtestifb")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	It("refuses to take a device that isn't an IFB", func() {
+		inNS(func() {
+			Expect(netlink.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "shtestifb"}})).To(Succeed())
+			s := &shaping.Shaper{}
+			err := s.SetupIngress(veth, "shtestifb", 10*1000*1000, 32*1024)
+			Expect(err).To(BeAssignableToTypeOf(&shaping.ConflictError{}))
+		})
+	})
+
+	It("tears the shaping of a link down", func() {
+		inNS(func() {
+			s := &shaping.Shaper{}
+			Expect(s.SetupEgress(veth, 10*1000*1000, 32*1024)).To(Succeed())
+			Expect(s.SetupIngress(veth, "shtestifb", 10*1000*1000, 32*1024)).To(Succeed())
+			shaping.Teardown(veth)
+			Expect(rootQdisc(veth)).NotTo(BeAssignableToTypeOf(&netlink.Htb{}))
+			deleted, err := shaping.DeleteIFB("shtestifb")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(deleted).To(BeTrue())
+		})
+	})
+
+	It("applies and lifts the limits of a link", func() {
+		inNS(func() {
+			limits := shaping.Limits{Egress: 10 * 1000 * 1000, Ingress: 20 * 1000 * 1000}
+			Expect(shaping.ApplyLimits(veth, "shtestifb", limits)).To(Succeed())
+			Expect(rootQdisc(veth)).To(BeAssignableToTypeOf(&netlink.Htb{}))
+			_, err := shaping.ReadStats(veth, "shtestifb")
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(shaping.ApplyLimits(veth, "shtestifb", shaping.Limits{Egress: limits.Egress})).To(Succeed())
+			_, err = netlink.LinkByName("shtestifb")
+			Expect(err).To(HaveOccurred())
+			Expect(shaping.IngressQdisc(veth)).To(BeNil())
+		})
+	})
+
+	It("paces and polices a link with BPF programs", func() {
+		if err := shaping.ProbeBPF(); err != nil {
+			Skip("kernel can't run the BPF programs: " + err.Error())
+		}
+		dir := filepath.Join(shaping.BPFFSRoot, "cni_flow_control_test")
+		defer shaping.RemovePins(dir)
+		inNS(func() {
+			ingress, egress := filepath.Join(dir, "ingress"), filepath.Join(dir, "egress")
+			Expect(shaping.SetupEDT(veth, ingress, 10*1000*1000, 50*time.Millisecond)).To(Succeed())
+			Expect(shaping.SetupBPFPolicer(veth, egress, 10*1000*1000, 32*1024)).To(Succeed())
+			Expect(rootQdisc(veth).Type()).To(Equal("fq"))
+			Expect(shaping.IngressQdisc(veth).Type()).To(Equal("clsact"))
+			Expect(shaping.HasBPFFilter(veth, netlink.HANDLE_MIN_EGRESS)).To(BeTrue())
+			Expect(shaping.HasBPFFilter(veth, netlink.HANDLE_MIN_INGRESS)).To(BeTrue())
+
+			Expect(shaping.SetBPFRate(egress, 20*1000*1000, shaping.BurstNanos(20*1000*1000, 32*1024))).To(Succeed())
+			Expect(shaping.BPFRate(egress)).To(Equal(uint64(20 * 1000 * 1000)))
+
+			shaping.Teardown(veth)
+			Expect(shaping.IngressQdisc(veth)).To(BeNil())
+		})
+	})
+})
@@ -0,0 +1,427 @@
+// Package simulate estimates how HTB shares the uplink of a node among the pods shaped on it in NIC mode, for
+// capacity planning. Given the node, the pods on it and how much each tries to send and receive, it computes the
+// rates they settle at under contention, from the classes, priorities and quanta the plugin would program for them,
+// so that platform teams can evaluate changes to presets and to the hierarchy of the node offline.
+//
+// The model is that of HTB in steady state: every class first gets what it wants up to its rate, and what its parent
+// has left is lent to the classes wanting more, up to their ceils, those of the lowest priority first and those of
+// the same priority in proportion to their quanta. HTB lets classes send at their rate whatever their parents, so
+// when the rates of the classes under a parent add up to more than it gets, as when the uplink is oversubscribed, the
+// simulation scales them down in proportion, as a saturated link does.
+package simulate
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/projectcalico/cni-plugin/policy"
+	"github.com/projectcalico/cni-plugin/shaping"
+	"github.com/projectcalico/cni-plugin/utils"
+)
+
+// Node is the node the pods are simulated on.
+type Node struct {
+	// Capacity is the speed of the uplink in bits per second. It defaults to the rate of the hierarchy.
+	Capacity uint64 `json:"capacity,omitempty"`
+	// Hierarchy is the nicHierarchy of the node, if any.
+	Hierarchy *utils.NICHierarchy `json:"hierarchy,omitempty"`
+}
+
+// Pod is a pod shaped on the node. Rates are in bits per second, from the point of view of the pod.
+type Pod struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	// Preset is the preset of the cluster policy the pod selects, which places it in the hierarchy and, with
+	// WithPolicy, gives it its limits.
+	Preset string `json:"preset,omitempty"`
+	// Limits are the rates of the classes of the pod, where zero leaves a direction unshaped, and Ceils what they
+	// borrow up to, if above their rates.
+	Limits        policy.Rates `json:"limits"`
+	Ceils         policy.Rates `json:"ceils,omitempty"`
+	LatencyClass  string       `json:"latencyClass,omitempty"`
+	ClassPriority uint32       `json:"classPriority,omitempty"`
+	// Demand is what the pod tries to receive and send.
+	Demand policy.Rates `json:"demand"`
+}
+
+// Result is the steady state of the node.
+type Result struct {
+	Pods   []PodResult   `json:"pods"`
+	Groups []GroupResult `json:"groups,omitempty"`
+	// Oversubscribed lists the directions, "ingress" or "egress", in which the rates of classes add up to more than
+	// their parents get, so that some of them get less than their rate.
+	Oversubscribed []string `json:"oversubscribed,omitempty"`
+}
+
+// PodResult is what a pod gets in each direction.
+type PodResult struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	// Group is the path of the group of the hierarchy the pod is in, such as "team-a/batch".
+	Group   string `json:"group,omitempty"`
+	Ingress Share  `json:"ingress"`
+	Egress  Share  `json:"egress"`
+}
+
+// Share is what a pod gets in one direction, in bits per second.
+type Share struct {
+	// Unshaped is set if the pod has no class in the direction, so that it isn't simulated.
+	Unshaped bool   `json:"unshaped,omitempty"`
+	Demand   uint64 `json:"demand"`
+	// Rate is the rate of its class, which it gets unless oversubscribed, and Borrowed what it gets above it.
+	Rate     uint64 `json:"rate"`
+	Borrowed uint64 `json:"borrowed"`
+	// Allocated is the rate the pod settles at.
+	Allocated uint64 `json:"allocated"`
+}
+
+// GroupResult is what the pods of a group of the hierarchy get together in each direction, in bits per second.
+type GroupResult struct {
+	Name    string `json:"name"`
+	Ingress uint64 `json:"ingress"`
+	Egress  uint64 `json:"egress"`
+}
+
+// WithPolicy returns pods with the limits of those that have none filled in from p, as the CNI plugin computes them
+// from the preset of the pod, or the default preset of p.
+func WithPolicy(p *policy.Policy, pods []Pod) ([]Pod, error) {
+	result := make([]Pod, len(pods))
+	for i, pod := range pods {
+		if pod.Limits.Ingress == 0 && pod.Limits.Egress == 0 {
+			annotations := map[string]string{}
+			if pod.Preset != "" {
+				annotations[policy.PresetAnnotation] = pod.Preset
+			}
+			ingress, egress := p.Apply(pod.Namespace, annotations)
+			var err error
+			if ingress != "" {
+				if pod.Limits.Ingress, err = policy.ParseRate(ingress); err != nil {
+					return nil, err
+				}
+			}
+			if egress != "" {
+				if pod.Limits.Egress, err = policy.ParseRate(egress); err != nil {
+					return nil, err
+				}
+			}
+			pod.Preset = p.Preset(pod.Namespace, annotations)
+		}
+		result[i] = pod
+	}
+	return result, nil
+}
+
+// class is a class of the simulated hierarchy.
+type class struct {
+	name       string
+	rate, ceil uint64
+	prio       uint32
+	quantum    uint32
+	// demand is what the pod of a leaf class tries to send; pod is its index, or -1 for the classes of groups.
+	demand   uint64
+	pod      int
+	children []*class
+
+	allocated uint64
+}
+
+// tier is what a class wants at a priority, where guaranteed stands for what it wants within the rates of its
+// classes, which come before any borrowing.
+type tier struct {
+	prio   int
+	amount uint64
+}
+
+const guaranteed = -1
+
+// Run simulates the pods on node and returns the rates they settle at.
+func Run(node Node, pods []Pod) (*Result, error) {
+	capacity := node.Capacity
+	if node.Hierarchy != nil {
+		if node.Hierarchy.Rate == 0 {
+			return nil, fmt.Errorf("the hierarchy needs the rate of the node root class")
+		}
+		if capacity == 0 || capacity > node.Hierarchy.Rate {
+			capacity = node.Hierarchy.Rate
+		}
+	}
+	if capacity == 0 {
+		return nil, fmt.Errorf("the node needs a capacity")
+	}
+
+	result := &Result{Pods: make([]PodResult, len(pods))}
+	for i, pod := range pods {
+		result.Pods[i] = PodResult{
+			Namespace: pod.Namespace,
+			Name:      pod.Name,
+			Group:     strings.Join(node.Hierarchy.GroupPath(pod.Namespace, pod.Preset), "/"),
+		}
+	}
+	groups := map[string]*GroupResult{}
+	for _, d := range []struct {
+		direction string
+		limit     func(*Pod) (rate, ceil, demand uint64)
+		share     func(*PodResult) *Share
+		group     func(*GroupResult) *uint64
+	}{
+		{
+			"ingress",
+			func(p *Pod) (uint64, uint64, uint64) { return p.Limits.Ingress, p.Ceils.Ingress, p.Demand.Ingress },
+			func(r *PodResult) *Share { return &r.Ingress },
+			func(g *GroupResult) *uint64 { return &g.Ingress },
+		},
+		{
+			"egress",
+			func(p *Pod) (uint64, uint64, uint64) { return p.Limits.Egress, p.Ceils.Egress, p.Demand.Egress },
+			func(r *PodResult) *Share { return &r.Egress },
+			func(g *GroupResult) *uint64 { return &g.Egress },
+		},
+	} {
+		root, byName := build(node.Hierarchy, capacity)
+		for i := range pods {
+			p := &pods[i]
+			rate, ceil, demand := d.limit(p)
+			share := d.share(&result.Pods[i])
+			share.Demand = demand
+			if rate == 0 {
+				share.Unshaped = true
+				continue
+			}
+			if ceil < rate {
+				ceil = rate
+			}
+			parent := root
+			if path := node.Hierarchy.GroupPath(p.Namespace, p.Preset); len(path) > 0 {
+				parent = byName[path[len(path)-1]]
+			}
+			parent.children = append(parent.children, &class{
+				name:    p.Namespace + "/" + p.Name,
+				rate:    rate,
+				ceil:    ceil,
+				prio:    utils.HTBPrio(p.LatencyClass, p.ClassPriority),
+				quantum: shaping.Quantum(rate),
+				demand:  demand,
+				pod:     i,
+			})
+		}
+
+		budget := sum(root.tiers())
+		if budget > capacity {
+			budget = capacity
+		}
+		if root.allocate(budget) {
+			result.Oversubscribed = append(result.Oversubscribed, d.direction)
+		}
+		root.walk(func(c *class) {
+			switch {
+			case c.pod >= 0:
+				share := d.share(&result.Pods[c.pod])
+				share.Rate, share.Allocated = c.rate, c.allocated
+				if c.allocated > c.rate {
+					share.Borrowed = c.allocated - c.rate
+				}
+			case c != root:
+				g, ok := groups[c.name]
+				if !ok {
+					g = &GroupResult{Name: c.name}
+					groups[c.name] = g
+				}
+				*d.group(g) = c.allocated
+			}
+		})
+	}
+	for _, g := range groups {
+		result.Groups = append(result.Groups, *g)
+	}
+	sort.Slice(result.Groups, func(i, j int) bool { return result.Groups[i].Name < result.Groups[j].Name })
+	return result, nil
+}
+
+// build returns the root of the classes of h, or a class of capacity standing for the root qdisc without one, and
+// the classes of its groups by name.
+func build(h *utils.NICHierarchy, capacity uint64) (*class, map[string]*class) {
+	root := &class{name: "root", rate: capacity, ceil: capacity, pod: -1}
+	byName := map[string]*class{}
+	if h == nil {
+		return root, byName
+	}
+	var add func(groups []utils.NICGroup, parent *class)
+	add = func(groups []utils.NICGroup, parent *class) {
+		for _, g := range groups {
+			c := &class{name: g.Name, rate: g.Rate, ceil: g.Ceil, quantum: shaping.Quantum(g.Rate), pod: -1}
+			if c.ceil == 0 {
+				c.ceil = parent.rate
+			}
+			parent.children = append(parent.children, c)
+			byName[g.Name] = c
+			add(g.Groups, c)
+		}
+	}
+	add(h.Groups, root)
+	return root, byName
+}
+
+// tiers returns what c wants by priority, lowest first: what it wants within its rate as guaranteed, and what it
+// wants to borrow above it at the priorities of the leaf classes below it, cut at its ceil.
+func (c *class) tiers() []tier {
+	if c.pod >= 0 {
+		want := c.demand
+		if want > c.ceil {
+			want = c.ceil
+		}
+		if want <= c.rate {
+			return []tier{{guaranteed, want}}
+		}
+		return []tier{{guaranteed, c.rate}, {int(c.prio), want - c.rate}}
+	}
+	levels := map[int]uint64{}
+	for _, child := range c.children {
+		for _, t := range child.tiers() {
+			levels[t.prio] += t.amount
+		}
+	}
+	var merged []tier
+	for prio, amount := range levels {
+		merged = append(merged, tier{prio, amount})
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].prio < merged[j].prio })
+
+	// The rate of c guarantees what its children want first, whatever their priority, and its ceil cuts what the
+	// lowest priority ones want.
+	ceil, rate := c.ceil, c.rate
+	result := []tier{{guaranteed, 0}}
+	for _, t := range merged {
+		if t.amount > ceil {
+			t.amount = ceil
+		}
+		ceil -= t.amount
+		within := t.amount
+		if within > rate {
+			within = rate
+		}
+		rate -= within
+		result[0].amount += within
+		if t.amount > within {
+			result = append(result, tier{t.prio, t.amount - within})
+		}
+	}
+	return result
+}
+
+// allocate gives c budget and divides it among its children. It reports whether the rates of the children of c, or
+// of classes below them, added up to more than they got.
+func (c *class) allocate(budget uint64) bool {
+	c.allocated = budget
+	if len(c.children) == 0 {
+		return false
+	}
+	wants := make([]map[int]uint64, len(c.children))
+	prios := map[int]bool{}
+	for i, child := range c.children {
+		wants[i] = map[int]uint64{}
+		for _, t := range child.tiers() {
+			wants[i][t.prio] += t.amount
+			if t.prio != guaranteed {
+				prios[t.prio] = true
+			}
+		}
+	}
+
+	given := make([]uint64, len(c.children))
+	oversubscribed := false
+	var total uint64
+	for i := range c.children {
+		total += wants[i][guaranteed]
+	}
+	if total > budget {
+		// The link can't give every class its rate: they get it in proportion.
+		oversubscribed = true
+		for i := range c.children {
+			given[i] = uint64(float64(wants[i][guaranteed]) * float64(budget) / float64(total))
+		}
+		budget = 0
+	} else {
+		for i := range c.children {
+			given[i] = wants[i][guaranteed]
+		}
+		budget -= total
+	}
+
+	var order []int
+	for prio := range prios {
+		order = append(order, prio)
+	}
+	sort.Ints(order)
+	for _, prio := range order {
+		caps := make([]uint64, len(c.children))
+		weights := make([]uint32, len(c.children))
+		for i, child := range c.children {
+			caps[i], weights[i] = wants[i][prio], child.quantum
+		}
+		for i, extra := range fill(budget, caps, weights) {
+			given[i] += extra
+			budget -= extra
+		}
+	}
+
+	for i, child := range c.children {
+		if child.allocate(given[i]) {
+			oversubscribed = true
+		}
+	}
+	return oversubscribed
+}
+
+// fill divides amount among classes wanting caps, in proportion to their weights, until it runs out or they all
+// have what they want, as the deficit round robin of HTB does.
+func fill(amount uint64, caps []uint64, weights []uint32) []uint64 {
+	given := make([]uint64, len(caps))
+	for amount > 0 {
+		var total float64
+		for i := range caps {
+			if given[i] < caps[i] {
+				total += float64(weights[i])
+			}
+		}
+		if total == 0 {
+			break
+		}
+		var spent uint64
+		for i := range caps {
+			if given[i] >= caps[i] {
+				continue
+			}
+			share := uint64(float64(amount) * float64(weights[i]) / total)
+			if share == 0 {
+				share = 1
+			}
+			if share > caps[i]-given[i] {
+				share = caps[i] - given[i]
+			}
+			if share > amount-spent {
+				share = amount - spent
+			}
+			given[i] += share
+			spent += share
+		}
+		amount -= spent
+	}
+	return given
+}
+
+// walk calls f on c and every class below it.
+func (c *class) walk(f func(*class)) {
+	f(c)
+	for _, child := range c.children {
+		child.walk(f)
+	}
+}
+
+func sum(tiers []tier) uint64 {
+	var total uint64
+	for _, t := range tiers {
+		total += t.amount
+	}
+	return total
+}
@@ -0,0 +1,13 @@
+package simulate_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestSimulate(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Simulate Suite")
+}
@@ -0,0 +1,104 @@
+package simulate_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/cni-plugin/policy"
+	"github.com/projectcalico/cni-plugin/simulate"
+	"github.com/projectcalico/cni-plugin/utils"
+)
+
+const mbit = 1000 * 1000
+
+// greedy is a pod limited to rate in egress, borrowing up to 100 Mbit/s and trying to send that much.
+func greedy(namespace, name string, rate uint64) simulate.Pod {
+	return simulate.Pod{
+		Namespace: namespace,
+		Name:      name,
+		Limits:    policy.Rates{Egress: rate},
+		Ceils:     policy.Rates{Egress: 100 * mbit},
+		Demand:    policy.Rates{Egress: 100 * mbit},
+	}
+}
+
+var _ = Describe("Run", func() {
+	It("gives pods what they want below their rates", func() {
+		a := greedy("web", "a", 20*mbit)
+		a.Demand.Egress = 5 * mbit
+		r, err := simulate.Run(simulate.Node{Capacity: 100 * mbit}, []simulate.Pod{a})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(r.Pods[0].Egress).To(Equal(simulate.Share{Demand: 5 * mbit, Rate: 20 * mbit, Allocated: 5 * mbit}))
+		Expect(r.Pods[0].Ingress.Unshaped).To(BeTrue())
+	})
+
+	It("shares what is left in proportion to the quanta of the classes", func() {
+		r, err := simulate.Run(simulate.Node{Capacity: 11 * mbit}, []simulate.Pod{
+			greedy("web", "a", 1*mbit),
+			greedy("web", "b", 4*mbit),
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(r.Pods[0].Egress.Allocated).To(BeEquivalentTo(2200000))
+		Expect(r.Pods[1].Egress.Allocated).To(BeEquivalentTo(8800000))
+		Expect(r.Pods[1].Egress.Borrowed).To(BeEquivalentTo(4800000))
+	})
+
+	It("lends to classes of the lowest priority first", func() {
+		a := greedy("web", "a", 20*mbit)
+		a.LatencyClass = utils.LatencyClassLow
+		b := greedy("batch", "b", 20*mbit)
+		b.ClassPriority = 1
+		r, err := simulate.Run(simulate.Node{Capacity: 100 * mbit}, []simulate.Pod{a, b})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(r.Pods[0].Egress.Allocated).To(BeEquivalentTo(80 * mbit))
+		Expect(r.Pods[1].Egress.Allocated).To(BeEquivalentTo(20 * mbit))
+	})
+
+	It("bounds what the pods of a group borrow at its ceil", func() {
+		h := &utils.NICHierarchy{Rate: 100 * mbit, Groups: []utils.NICGroup{
+			{Name: "team-a", Rate: 30 * mbit, Ceil: 50 * mbit, Namespaces: []string{"team-a"}},
+		}}
+		r, err := simulate.Run(simulate.Node{Hierarchy: h}, []simulate.Pod{
+			greedy("team-a", "a", 10*mbit),
+			greedy("web", "b", 10*mbit),
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(r.Pods[0].Group).To(Equal("team-a"))
+		Expect(r.Pods[0].Egress.Allocated).To(BeEquivalentTo(50 * mbit))
+		Expect(r.Pods[1].Egress.Allocated).To(BeEquivalentTo(50 * mbit))
+		Expect(r.Groups).To(Equal([]simulate.GroupResult{{Name: "team-a", Egress: 50 * mbit}}))
+	})
+
+	It("scales rates down when the node is oversubscribed", func() {
+		a, b := greedy("web", "a", 8*mbit), greedy("web", "b", 8*mbit)
+		a.Demand.Egress, b.Demand.Egress = 8*mbit, 8*mbit
+		r, err := simulate.Run(simulate.Node{Capacity: 10 * mbit}, []simulate.Pod{a, b})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(r.Pods[0].Egress.Allocated).To(BeEquivalentTo(5 * mbit))
+		Expect(r.Oversubscribed).To(Equal([]string{"egress"}))
+	})
+
+	It("needs the capacity of the node", func() {
+		_, err := simulate.Run(simulate.Node{}, nil)
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("WithPolicy", func() {
+	It("fills in the limits of pods from their presets", func() {
+		p, err := policy.Parse([]byte(`{
+			"presets": {"gold": {"ingress": 5000000, "egress": 2000000}, "bronze": {"egress": 1000000}},
+			"defaultPreset": "bronze"
+		}`))
+		Expect(err).NotTo(HaveOccurred())
+		pods, err := simulate.WithPolicy(p, []simulate.Pod{
+			{Namespace: "web", Name: "a", Preset: "gold"},
+			{Namespace: "web", Name: "b"},
+			{Namespace: "web", Name: "c", Limits: policy.Rates{Egress: 3 * mbit}},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pods[0].Limits).To(Equal(policy.Rates{Ingress: 5 * mbit, Egress: 2 * mbit}))
+		Expect(pods[1].Limits).To(Equal(policy.Rates{Egress: 1 * mbit}))
+		Expect(pods[1].Preset).To(Equal("bronze"))
+		Expect(pods[2].Limits).To(Equal(policy.Rates{Egress: 3 * mbit}))
+	})
+})
@@ -0,0 +1,76 @@
+// Package specversion keeps the plugins usable by runtimes that still speak CNI 0.1.0 or 0.2.0. Those runtimes expect
+// at most one address per IP family and no interface list in the result, and some of them leave empty pairs in
+// CNI_ARGS that the argument parser rejects.
+package specversion
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/020"
+	"github.com/containernetworking/cni/pkg/types/current"
+)
+
+// Legacy reports whether cniVersion predates the 0.3.0 result format. An empty version is what 0.1.0 runtimes send.
+func Legacy(cniVersion string) bool {
+	switch cniVersion {
+	case "", "0.1.0", "0.2.0":
+		return true
+	}
+	return false
+}
+
+// Convert returns result in the format of cniVersion. Legacy results carry the first address of each family, the
+// routes of the families that have one, and the DNS settings; everything else is dropped.
+func Convert(result *current.Result, cniVersion string) (types.Result, error) {
+	if !Legacy(cniVersion) {
+		return result.GetAsVersion(cniVersion)
+	}
+	r := &types020.Result{CNIVersion: cniVersion, DNS: result.DNS}
+	if r.CNIVersion == "" {
+		r.CNIVersion = "0.1.0"
+	}
+	for _, ip := range result.IPs {
+		c := &types020.IPConfig{IP: ip.Address, Gateway: ip.Gateway}
+		switch {
+		case ip.Version == "4" && r.IP4 == nil:
+			r.IP4 = c
+		case ip.Version == "6" && r.IP6 == nil:
+			r.IP6 = c
+		}
+	}
+	if r.IP4 == nil && r.IP6 == nil {
+		return nil, fmt.Errorf("result can't be represented in CNI %s: no IP addresses", r.CNIVersion)
+	}
+	for _, route := range result.Routes {
+		if route.Dst.IP.To4() != nil {
+			if r.IP4 != nil {
+				r.IP4.Routes = append(r.IP4.Routes, *route)
+			}
+		} else if r.IP6 != nil {
+			r.IP6.Routes = append(r.IP6.Routes, *route)
+		}
+	}
+	return r, nil
+}
+
+// Print writes result to stdout in the format of cniVersion.
+func Print(result *current.Result, cniVersion string) error {
+	r, err := Convert(result, cniVersion)
+	if err != nil {
+		return err
+	}
+	return r.Print()
+}
+
+// CleanArgs drops the empty pairs of a CNI_ARGS value, such as the trailing ";" some legacy runtimes append.
+func CleanArgs(args string) string {
+	var pairs []string
+	for _, pair := range strings.Split(args, ";") {
+		if strings.TrimSpace(pair) != "" {
+			pairs = append(pairs, pair)
+		}
+	}
+	return strings.Join(pairs, ";")
+}
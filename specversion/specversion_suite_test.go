@@ -0,0 +1,13 @@
+package specversion_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestSpecversion(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Specversion Suite")
+}
@@ -0,0 +1,110 @@
+package specversion_test
+
+import (
+	"net"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/020"
+	"github.com/containernetworking/cni/pkg/types/current"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/cni-plugin/specversion"
+)
+
+func mustCIDR(s string) net.IPNet {
+	ip, n, err := net.ParseCIDR(s)
+	Expect(err).NotTo(HaveOccurred())
+	n.IP = ip
+	return *n
+}
+
+func dualStackResult() *current.Result {
+	return &current.Result{
+		Interfaces: []*current.Interface{{Name: "eth0"}, {Name: "cali1234", Mac: "02:00:00:00:00:01"}},
+		IPs: []*current.IPConfig{
+			{Version: "4", Address: mustCIDR("10.0.0.1/32")},
+			{Version: "4", Address: mustCIDR("10.0.0.2/32")},
+			{Version: "6", Address: mustCIDR("fd00::1/128")},
+		},
+		Routes: []*types.Route{
+			{Dst: mustCIDR("0.0.0.0/0")},
+			{Dst: mustCIDR("::/0")},
+		},
+		DNS: types.DNS{Nameservers: []string{"10.96.0.10"}},
+	}
+}
+
+var _ = Describe("Legacy", func() {
+	DescribeTable("classifies spec versions",
+		func(version string, legacy bool) {
+			Expect(specversion.Legacy(version)).To(Equal(legacy))
+		},
+		Entry("unset", "", true),
+		Entry("0.1.0", "0.1.0", true),
+		Entry("0.2.0", "0.2.0", true),
+		Entry("0.3.0", "0.3.0", false),
+		Entry("0.3.1", "0.3.1", false),
+	)
+})
+
+var _ = Describe("Convert", func() {
+	DescribeTable("down-converts dual stack results for legacy versions",
+		func(version, expected string) {
+			r, err := specversion.Convert(dualStackResult(), version)
+			Expect(err).NotTo(HaveOccurred())
+			old, ok := r.(*types020.Result)
+			Expect(ok).To(BeTrue())
+			Expect(old.CNIVersion).To(Equal(expected))
+			Expect(old.IP4.IP.String()).To(Equal("10.0.0.1/32"))
+			Expect(old.IP4.Routes).To(HaveLen(1))
+			Expect(old.IP6.IP.String()).To(Equal("fd00::1/128"))
+			Expect(old.IP6.Routes).To(HaveLen(1))
+			Expect(old.DNS.Nameservers).To(Equal([]string{"10.96.0.10"}))
+		},
+		Entry("unset", "", "0.1.0"),
+		Entry("0.1.0", "0.1.0", "0.1.0"),
+		Entry("0.2.0", "0.2.0", "0.2.0"),
+	)
+
+	DescribeTable("keeps the current format for newer versions",
+		func(version string) {
+			r, err := specversion.Convert(dualStackResult(), version)
+			Expect(err).NotTo(HaveOccurred())
+			res, ok := r.(*current.Result)
+			Expect(ok).To(BeTrue())
+			Expect(res.IPs).To(HaveLen(3))
+			Expect(res.Interfaces).To(HaveLen(2))
+		},
+		Entry("0.3.0", "0.3.0"),
+		Entry("0.3.1", "0.3.1"),
+	)
+
+	It("drops the routes of families without an address", func() {
+		result := dualStackResult()
+		result.IPs = result.IPs[:1]
+		r, err := specversion.Convert(result, "0.2.0")
+		Expect(err).NotTo(HaveOccurred())
+		old := r.(*types020.Result)
+		Expect(old.IP6).To(BeNil())
+		Expect(old.IP4.Routes).To(HaveLen(1))
+	})
+
+	It("fails legacy conversion without addresses", func() {
+		_, err := specversion.Convert(&current.Result{}, "0.2.0")
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("CleanArgs", func() {
+	DescribeTable("drops empty pairs",
+		func(args, expected string) {
+			Expect(specversion.CleanArgs(args)).To(Equal(expected))
+		},
+		Entry("empty", "", ""),
+		Entry("untouched", "K8S_POD_NAME=a;K8S_POD_NAMESPACE=b", "K8S_POD_NAME=a;K8S_POD_NAMESPACE=b"),
+		Entry("trailing separator", "K8S_POD_NAME=a;", "K8S_POD_NAME=a"),
+		Entry("doubled separator", "K8S_POD_NAME=a;;K8S_POD_NAMESPACE=b", "K8S_POD_NAME=a;K8S_POD_NAMESPACE=b"),
+		Entry("only separators", ";;", ""),
+	)
+})
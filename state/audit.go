@@ -0,0 +1,184 @@
+package state
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// Actions of audit entries.
+const (
+	AuditCreate = "create"
+	AuditUpdate = "update"
+	AuditDelete = "delete"
+)
+
+// Triggers of audit entries: what made the plugin or the agent change the shaping of a pod.
+const (
+	AuditTriggerCNIAdd     = "cni-add"
+	AuditTriggerCNIDel     = "cni-del"
+	AuditTriggerAPI        = "api"
+	AuditTriggerPolicy     = "policy"
+	AuditTriggerAnnotation = "annotation"
+	AuditTriggerReconcile  = "reconcile"
+	AuditTriggerGC         = "gc"
+	// AuditTriggerExpiry is the end of a pause, throttle or maintenance with a TTL.
+	AuditTriggerExpiry = "expiry"
+	// AuditTriggerSchedule is a pod entering or leaving a window of its bandwidth schedule.
+	AuditTriggerSchedule = "schedule"
+)
+
+const (
+	// DefaultAuditMaxBytes is the size the audit log is rotated at.
+	DefaultAuditMaxBytes = 10 << 20
+	// DefaultAuditFiles is how many rotated files of the audit log are kept besides the current one.
+	DefaultAuditFiles = 5
+)
+
+// AuditEntry records a change to the shaping of a pod, or of the node as a whole if it has no container ID.
+type AuditEntry struct {
+	Time        time.Time `json:"time"`
+	Action      string    `json:"action"`
+	Trigger     string    `json:"trigger"`
+	ContainerID string    `json:"container_id,omitempty"`
+	Workload    string    `json:"workload,omitempty"`
+	// IngressRate and EgressRate are the recorded rates of the pod after the change.
+	IngressRate uint64 `json:"ingress_rate,omitempty"`
+	EgressRate  uint64 `json:"egress_rate,omitempty"`
+	// Detail describes the change.
+	Detail string `json:"detail,omitempty"`
+	// PID is the process that made the change: a plugin invocation or the agent.
+	PID int `json:"pid"`
+}
+
+// AuditLog is an append-only log of the changes made to the shaping of pods, shared by the plugin and the agent. It
+// is kept as JSON lines in <dir>/audit/audit.log, rotated to audit.log.1 and so on once it reaches MaxBytes, keeping
+// Files rotated files.
+type AuditLog struct {
+	Dir      string
+	MaxBytes int64
+	Files    int
+}
+
+// NewAuditLog returns the audit log of the state directory dir, or of DefaultDir if dir is empty.
+func NewAuditLog(dir string) *AuditLog {
+	if dir == "" {
+		dir = DefaultDir
+	}
+	return &AuditLog{Dir: filepath.Join(dir, "audit"), MaxBytes: DefaultAuditMaxBytes, Files: DefaultAuditFiles}
+}
+
+func (l *AuditLog) path(n int) string {
+	if n == 0 {
+		return filepath.Join(l.Dir, "audit.log")
+	}
+	return filepath.Join(l.Dir, fmt.Sprintf("audit.log.%d", n))
+}
+
+// Append adds e to the log, filling in its time and process, holding a lock on the log so that concurrent plugin
+// invocations and the agent neither interleave entries nor rotate the log under each other.
+func (l *AuditLog) Append(e *AuditEntry) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.PID = os.Getpid()
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if err = os.MkdirAll(l.Dir, 0700); err != nil {
+		return fmt.Errorf("failed to create audit directory %s: %v", l.Dir, err)
+	}
+	lock, err := os.OpenFile(filepath.Join(l.Dir, ".audit.lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to lock audit log: %v", err)
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	if info, err := os.Stat(l.path(0)); err == nil && info.Size()+int64(len(data)) > l.MaxBytes {
+		if err = l.rotate(); err != nil {
+			return fmt.Errorf("failed to rotate audit log: %v", err)
+		}
+	}
+	f, err := os.OpenFile(l.path(0), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// rotate shifts the files of the log by one, dropping the oldest. The caller must hold the lock.
+func (l *AuditLog) rotate() error {
+	if err := os.Remove(l.path(l.Files)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for n := l.Files - 1; n >= 0; n-- {
+		if err := os.Rename(l.path(n), l.path(n+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// AuditQuery selects entries of the audit log. Empty fields select everything.
+type AuditQuery struct {
+	// ID is a container ID or workload.
+	ID      string
+	Trigger string
+	Since   time.Time
+	// Limit keeps only the last Limit matching entries, if positive.
+	Limit int
+}
+
+func (q AuditQuery) matches(e *AuditEntry) bool {
+	return (q.ID == "" || e.ContainerID == q.ID || e.Workload == q.ID) &&
+		(q.Trigger == "" || e.Trigger == q.Trigger) &&
+		!e.Time.Before(q.Since)
+}
+
+// Query returns the entries of the log, rotated files included, matching q, oldest first.
+func (l *AuditLog) Query(q AuditQuery) ([]*AuditEntry, error) {
+	entries := []*AuditEntry{}
+	for n := l.Files; n >= 0; n-- {
+		f, err := os.Open(l.path(n))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			e := &AuditEntry{}
+			if err = json.Unmarshal(scanner.Bytes(), e); err != nil {
+				// A write cut short by a crash leaves a partial line, which is skipped.
+				continue
+			}
+			if q.matches(e) {
+				entries = append(entries, e)
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read audit log %s: %v", l.path(n), err)
+		}
+	}
+	if q.Limit > 0 && len(entries) > q.Limit {
+		entries = entries[len(entries)-q.Limit:]
+	}
+	return entries, nil
+}
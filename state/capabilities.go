@@ -0,0 +1,54 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Capabilities are the shaping features the kernel of the node was found to support. They are cached in
+// <dir>/capabilities/kernel.json, so that the kernel is only probed again when its release changes.
+type Capabilities struct {
+	KernelRelease string    `json:"kernel_release"`
+	Probed        time.Time `json:"probed"`
+	// TCShaping is whether HTB qdiscs can be created, and TCShapingError why not otherwise.
+	TCShaping      bool   `json:"tc_shaping"`
+	TCShapingError string `json:"tc_shaping_error,omitempty"`
+	// IFBError is why IFB devices can't be created, if they can't. The egress of pods is policed on their host
+	// veth instead of shaped on one.
+	IFBError string `json:"ifb_error,omitempty"`
+	// EBPF is whether the BPF programs of backend "ebpf" load, and EBPFError why not otherwise.
+	EBPF      bool   `json:"ebpf"`
+	EBPFError string `json:"ebpf_error,omitempty"`
+}
+
+func (s *Store) capabilitiesDir() string {
+	return filepath.Join(s.Dir, "capabilities")
+}
+
+// LoadCapabilities returns the cached capabilities of the kernel, or ErrNotFound if it was never probed.
+func (s *Store) LoadCapabilities() (*Capabilities, error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.capabilitiesDir(), "kernel.json"))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	c := &Capabilities{}
+	if err = json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("corrupt kernel capabilities: %v", err)
+	}
+	return c, nil
+}
+
+// SaveCapabilities caches the capabilities of the kernel.
+func (s *Store) SaveCapabilities(c *Capabilities) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return writeAtomic(s.capabilitiesDir(), "kernel", data)
+}
@@ -0,0 +1,127 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Traffic is what the classes of a pod have counted, from the point of view of the pod. Drops are the packets the
+// classes dropped and Overlimits how often they held back a packet over their rate; pods without HTB classes count
+// neither.
+type Traffic struct {
+	IngressBytes      uint64 `json:"ingress_bytes"`
+	IngressPackets    uint64 `json:"ingress_packets"`
+	IngressDrops      uint64 `json:"ingress_drops,omitempty"`
+	IngressOverlimits uint64 `json:"ingress_overlimits,omitempty"`
+	EgressBytes       uint64 `json:"egress_bytes"`
+	EgressPackets     uint64 `json:"egress_packets"`
+	EgressDrops       uint64 `json:"egress_drops,omitempty"`
+	EgressOverlimits  uint64 `json:"egress_overlimits,omitempty"`
+}
+
+// Add returns the sum of t and o.
+func (t Traffic) Add(o Traffic) Traffic {
+	return Traffic{
+		IngressBytes:      t.IngressBytes + o.IngressBytes,
+		IngressPackets:    t.IngressPackets + o.IngressPackets,
+		IngressDrops:      t.IngressDrops + o.IngressDrops,
+		IngressOverlimits: t.IngressOverlimits + o.IngressOverlimits,
+		EgressBytes:       t.EgressBytes + o.EgressBytes,
+		EgressPackets:     t.EgressPackets + o.EgressPackets,
+		EgressDrops:       t.EgressDrops + o.EgressDrops,
+		EgressOverlimits:  t.EgressOverlimits + o.EgressOverlimits,
+	}
+}
+
+// ingress and egress return the counts of one direction of t.
+func (t Traffic) ingress() Traffic {
+	return Traffic{IngressBytes: t.IngressBytes, IngressPackets: t.IngressPackets, IngressDrops: t.IngressDrops,
+		IngressOverlimits: t.IngressOverlimits}
+}
+
+func (t Traffic) egress() Traffic {
+	return Traffic{EgressBytes: t.EgressBytes, EgressPackets: t.EgressPackets, EgressDrops: t.EgressDrops,
+		EgressOverlimits: t.EgressOverlimits}
+}
+
+// Counters carries the traffic of a pod across rebuilds of its classes, which reset the kernel's counters. The agent
+// checkpoints them in <dir>/counters/<container ID>.json, apart from the records so that checkpoints don't count as
+// updates of the shaping.
+type Counters struct {
+	// Retired is the traffic counted by the classes the pod had before its current ones.
+	Retired Traffic `json:"retired"`
+	// Current is the traffic counted by the current classes when they were last read.
+	Current Traffic `json:"current"`
+}
+
+// Total is the cumulative traffic of the pod.
+func (c *Counters) Total() Traffic {
+	return c.Retired.Add(c.Current)
+}
+
+// Observe records a reading of the current classes. A reading below the previous one in a direction means its
+// classes were rebuilt without being retired first, e.g. by a reboot, so the previous reading is retired; traffic
+// counted between the last reading and the rebuild is lost.
+func (c *Counters) Observe(t Traffic) {
+	if t.IngressBytes < c.Current.IngressBytes || t.IngressPackets < c.Current.IngressPackets {
+		c.Retired = c.Retired.Add(c.Current.ingress())
+	}
+	if t.EgressBytes < c.Current.EgressBytes || t.EgressPackets < c.Current.EgressPackets {
+		c.Retired = c.Retired.Add(c.Current.egress())
+	}
+	c.Current = t
+}
+
+// Retire records a last reading of the classes of the given directions before they are replaced, so that the
+// readings of their replacements start from zero.
+func (c *Counters) Retire(t Traffic, ingress, egress bool) {
+	c.Observe(t)
+	if ingress {
+		c.Retired = c.Retired.Add(c.Current.ingress())
+		c.Current = c.Current.egress()
+	}
+	if egress {
+		c.Retired = c.Retired.Add(c.Current.egress())
+		c.Current = c.Current.ingress()
+	}
+}
+
+func (s *Store) countersPath(key string) string {
+	return filepath.Join(s.Dir, "counters", key+".json")
+}
+
+// LoadCounters returns the checkpointed counters of the interface stored under key, or ErrNotFound if there are
+// none.
+func (s *Store) LoadCounters(key string) (*Counters, error) {
+	data, err := ioutil.ReadFile(s.countersPath(key))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	c := &Counters{}
+	if err = json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("corrupt counters for %s: %v", key, err)
+	}
+	return c, nil
+}
+
+// SaveCounters checkpoints the counters of the interface stored under key.
+func (s *Store) SaveCounters(key string, c *Counters) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return writeAtomic(filepath.Dir(s.countersPath(key)), key, data)
+}
+
+// DeleteCounters removes the counters of the interface stored under key. Deleting missing counters is not an error.
+func (s *Store) DeleteCounters(key string) error {
+	if err := os.Remove(s.countersPath(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
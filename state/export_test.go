@@ -0,0 +1,4 @@
+package state
+
+// LockTCAt takes the tc lock at path in place of TCLockPath, for the tests.
+var LockTCAt = lockTC
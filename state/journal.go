@@ -0,0 +1,105 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Entry is the journal entry of a CNI operation in progress. It is written before the operation touches anything
+// and removed once it completes, so an entry left behind means the operation was interrupted and its devices may
+// need cleaning up.
+type Entry struct {
+	ContainerID string    `json:"container_id"`
+	IfName      string    `json:"if_name,omitempty"`
+	Op          string    `json:"op"`
+	PID         int       `json:"pid"`
+	Started     time.Time `json:"started"`
+
+	// Devices the operation may create, which are removed when cleaning up after it.
+	HostVeth string `json:"host_veth,omitempty"`
+	IFB      string `json:"ifb,omitempty"`
+
+	// Interrupted is the signal the plugin received, if it had the chance to record it.
+	Interrupted string `json:"interrupted,omitempty"`
+}
+
+// Key returns the RecordKey of the interface the operation is on.
+func (e *Entry) Key() string {
+	return RecordKey(e.ContainerID, e.IfName)
+}
+
+// Journal is a directory of entries, one file per interface of a container, kept inside the state directory.
+type Journal struct {
+	Dir string
+}
+
+// NewJournal returns the journal of the state directory dir, or of DefaultDir if dir is empty.
+func NewJournal(dir string) *Journal {
+	if dir == "" {
+		dir = DefaultDir
+	}
+	return &Journal{Dir: filepath.Join(dir, "journal")}
+}
+
+// Write records the entry, replacing any existing entry for the interface.
+func (j *Journal) Write(e *Entry) error {
+	if e.ContainerID == "" {
+		return fmt.Errorf("cannot journal an operation without a container ID")
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return writeAtomic(j.Dir, e.Key(), data)
+}
+
+// Load returns the entry stored under key, or ErrNotFound.
+func (j *Journal) Load(key string) (*Entry, error) {
+	data, err := ioutil.ReadFile(filepath.Join(j.Dir, key+".json"))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	e := &Entry{}
+	if err = json.Unmarshal(data, e); err != nil {
+		return nil, fmt.Errorf("corrupt journal entry for %s: %v", key, err)
+	}
+	return e, nil
+}
+
+// Complete removes the entry stored under key. Completing a missing entry is not an error.
+func (j *Journal) Complete(key string) error {
+	if err := os.Remove(filepath.Join(j.Dir, key+".json")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// List returns all entries in the journal.
+func (j *Journal) List() ([]*Entry, error) {
+	files, err := ioutil.ReadDir(j.Dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var entries []*Entry
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		e, err := j.Load(strings.TrimSuffix(name, ".json"))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
@@ -0,0 +1,83 @@
+package state
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// TCLockPath is the file the plugin and the agent lock to change the tc configuration of the node one at a time.
+const TCLockPath = "/var/run/cni_flow_control.lock"
+
+// LockTC waits for the lock on the tc configuration of the node and returns the function releasing it. Without it,
+// the ADDs of pods scheduled together race creating IFB devices and reconciling the qdiscs and filters they list.
+// The lock is held by an open file, so a holder that takes it again waits for itself; test binaries panic instead.
+func LockTC() (func(), error) {
+	return lockTC(TCLockPath)
+}
+
+func lockTC(path string) (func(), error) {
+	release := holding(path)
+	lock, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		release()
+		return nil, fmt.Errorf("failed to open tc lock: %v", err)
+	}
+	if err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		lock.Close()
+		release()
+		return nil, fmt.Errorf("failed to lock tc configuration: %v", err)
+	}
+	return func() {
+		syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+		lock.Close()
+		release()
+	}, nil
+}
+
+// checkNesting makes lockTC panic when a goroutine takes a lock it already holds. It is only on in test binaries,
+// as finding the goroutine costs a stack dump.
+var checkNesting = strings.HasSuffix(os.Args[0], ".test")
+
+var (
+	holdersMu sync.Mutex
+	// holders are the goroutines holding each lock, when checkNesting is on.
+	holders = map[string]map[uint64]bool{}
+)
+
+// holding records that the calling goroutine is taking the lock at path, panicking if it already holds it, and
+// returns the function forgetting it.
+func holding(path string) func() {
+	if !checkNesting {
+		return func() {}
+	}
+	id := goroutineID()
+	holdersMu.Lock()
+	defer holdersMu.Unlock()
+	if holders[path][id] {
+		panic(fmt.Sprintf("tc lock %s taken again by the goroutine holding it, which would wait for itself", path))
+	}
+	if holders[path] == nil {
+		holders[path] = map[uint64]bool{}
+	}
+	holders[path][id] = true
+	return func() {
+		holdersMu.Lock()
+		defer holdersMu.Unlock()
+		delete(holders[path], id)
+	}
+}
+
+// goroutineID returns the ID of the calling goroutine, from the "goroutine N [running]:" header of its stack.
+func goroutineID() uint64 {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	buf = bytes.TrimPrefix(buf, []byte("goroutine "))
+	id, _ := strconv.ParseUint(string(buf[:bytes.IndexByte(buf, ' ')]), 10, 64)
+	return id
+}
@@ -0,0 +1,63 @@
+package state_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/cni-plugin/state"
+)
+
+var _ = Describe("LockTC", func() {
+	var dir, path string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "flowcontrol-lock")
+		Expect(err).NotTo(HaveOccurred())
+		path = filepath.Join(dir, "tc.lock")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("makes a second locker wait for the first to release it", func() {
+		unlock, err := state.LockTCAt(path)
+		Expect(err).NotTo(HaveOccurred())
+
+		locked := make(chan func())
+		go func() {
+			defer GinkgoRecover()
+			unlock, err := state.LockTCAt(path)
+			Expect(err).NotTo(HaveOccurred())
+			locked <- unlock
+		}()
+		Consistently(locked, "200ms").ShouldNot(Receive())
+
+		unlock()
+		var unlockSecond func()
+		Eventually(locked).Should(Receive(&unlockSecond))
+		unlockSecond()
+	})
+
+	It("panics when its holder takes it again instead of waiting for itself", func() {
+		unlock, err := state.LockTCAt(path)
+		Expect(err).NotTo(HaveOccurred())
+		defer unlock()
+
+		Expect(func() { state.LockTCAt(path) }).To(Panic())
+	})
+
+	It("can be taken again once released", func() {
+		unlock, err := state.LockTCAt(path)
+		Expect(err).NotTo(HaveOccurred())
+		unlock()
+
+		unlock, err = state.LockTCAt(path)
+		Expect(err).NotTo(HaveOccurred())
+		unlock()
+	})
+})
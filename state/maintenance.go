@@ -0,0 +1,55 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Maintenance is the maintenance mode of the node, during which the agent relaxes the limits of every pod until it
+// is turned off or Until has passed. It is kept in <dir>/maintenance/node.json, so that an agent restarted during
+// maintenance still ends it on time.
+type Maintenance struct {
+	Since  time.Time `json:"since"`
+	Until  time.Time `json:"until"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+func (s *Store) maintenancePath() string {
+	return filepath.Join(s.Dir, "maintenance", "node.json")
+}
+
+// LoadMaintenance returns the maintenance mode of the node, or ErrNotFound if it isn't in maintenance.
+func (s *Store) LoadMaintenance() (*Maintenance, error) {
+	data, err := ioutil.ReadFile(s.maintenancePath())
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	m := &Maintenance{}
+	if err = json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("corrupt maintenance mode: %v", err)
+	}
+	return m, nil
+}
+
+// SaveMaintenance puts the node in maintenance, or updates its maintenance mode.
+func (s *Store) SaveMaintenance(m *Maintenance) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return writeAtomic(filepath.Dir(s.maintenancePath()), "node", data)
+}
+
+// DeleteMaintenance takes the node out of maintenance. Doing so when it isn't in maintenance is not an error.
+func (s *Store) DeleteMaintenance() error {
+	if err := os.Remove(s.maintenancePath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Names is the registry of the sequential naming strategy: the number in the device names of each interface of a
+// container, by RecordKey. It is kept in <dir>/names/sequential.json.
+type Names struct {
+	Numbers map[string]int `json:"numbers"`
+}
+
+// Allocate returns the number of the interface stored under key, allocating the lowest free one up to max if it
+// has none.
+func (n *Names) Allocate(key string, max int) (int, error) {
+	if number, ok := n.Numbers[key]; ok {
+		return number, nil
+	}
+	used := map[int]bool{}
+	for _, number := range n.Numbers {
+		used[number] = true
+	}
+	for number := 0; number <= max; number++ {
+		if !used[number] {
+			n.Numbers[key] = number
+			return number, nil
+		}
+	}
+	return 0, fmt.Errorf("no free device names left")
+}
+
+// Release frees the number of the interface stored under key, if any.
+func (n *Names) Release(key string) {
+	delete(n.Numbers, key)
+}
+
+func (s *Store) namesDir() string {
+	return filepath.Join(s.Dir, "names")
+}
+
+// LoadNames returns the registry of the sequential naming strategy, or ErrNotFound if it was never used.
+func (s *Store) LoadNames() (*Names, error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.namesDir(), "sequential.json"))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	n := &Names{}
+	if err = json.Unmarshal(data, n); err != nil {
+		return nil, fmt.Errorf("corrupt name registry: %v", err)
+	}
+	if n.Numbers == nil {
+		n.Numbers = map[string]int{}
+	}
+	return n, nil
+}
+
+// UpdateNames applies update to the registry of the sequential naming strategy and saves it, holding a lock on the
+// registry so that concurrent ADDs don't allocate the same number.
+func (s *Store) UpdateNames(update func(n *Names) error) error {
+	if err := os.MkdirAll(s.namesDir(), 0700); err != nil {
+		return fmt.Errorf("failed to create state directory %s: %v", s.namesDir(), err)
+	}
+	lock, err := os.OpenFile(filepath.Join(s.namesDir(), ".sequential.lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to lock name registry: %v", err)
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	n, err := s.LoadNames()
+	if err == ErrNotFound {
+		n = &Names{Numbers: map[string]int{}}
+	} else if err != nil {
+		return err
+	}
+	if err = update(n); err != nil {
+		return err
+	}
+	data, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	return writeAtomic(s.namesDir(), "sequential", data)
+}
@@ -0,0 +1,123 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// ErrNICClassesExhausted is returned when every class minor of an uplink is taken.
+var ErrNICClassesExhausted = errors.New("no free shaping classes left")
+
+// NICClass is the owner of a class in the shared hierarchy of an uplink, as recorded when the class is allocated.
+type NICClass struct {
+	ContainerID string `json:"container_id"`
+	IfName      string `json:"if_name,omitempty"`
+	Workload    string `json:"workload"`
+	Namespace   string `json:"namespace,omitempty"`
+	Pod         string `json:"pod,omitempty"`
+	HostNetwork bool   `json:"host_network,omitempty"`
+	// Preset is the cluster policy preset the pod's rates came from, if any.
+	Preset string `json:"preset,omitempty"`
+}
+
+// Key returns the RecordKey of the interface owning the class.
+func (o *NICClass) Key() string {
+	return RecordKey(o.ContainerID, o.IfName)
+}
+
+// NICClasses is the handle registry of an uplink: the owner of each class minor allocated on its HTB qdiscs. It is
+// kept in <dir>/nic/<uplink>.json, so that every class on the uplink can be attributed to a pod.
+type NICClasses struct {
+	NIC     string               `json:"nic"`
+	Classes map[uint16]*NICClass `json:"classes"`
+	// Groups are the names of the classes of the uplink's borrow hierarchy, if it has one, by minor.
+	Groups map[uint16]string `json:"groups,omitempty"`
+}
+
+// Allocate returns the minor of the class owned by owner's interface, allocating the lowest free minor up to max
+// if it has none.
+func (c *NICClasses) Allocate(owner *NICClass, max uint16) (uint16, error) {
+	for minor, o := range c.Classes {
+		if o.Key() == owner.Key() {
+			c.Classes[minor] = owner
+			return minor, nil
+		}
+	}
+	for minor := uint16(1); minor <= max; minor++ {
+		if _, ok := c.Classes[minor]; !ok {
+			c.Classes[minor] = owner
+			return minor, nil
+		}
+	}
+	return 0, ErrNICClassesExhausted
+}
+
+// Release frees the class owned by the interface stored under key, if any.
+func (c *NICClasses) Release(key string) {
+	for minor, o := range c.Classes {
+		if o.Key() == key {
+			delete(c.Classes, minor)
+		}
+	}
+}
+
+func (s *Store) nicDir() string {
+	return filepath.Join(s.Dir, "nic")
+}
+
+// LoadNICClasses returns the registry of the uplink nic, or ErrNotFound if nothing was ever allocated on it.
+func (s *Store) LoadNICClasses(nic string) (*NICClasses, error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.nicDir(), nic+".json"))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	c := &NICClasses{}
+	if err = json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("corrupt class registry for %s: %v", nic, err)
+	}
+	if c.Classes == nil {
+		c.Classes = map[uint16]*NICClass{}
+	}
+	return c, nil
+}
+
+// UpdateNICClasses applies update to the registry of the uplink nic and saves it, holding a lock on the registry so
+// that the plugin and the agent don't allocate classes concurrently. A missing registry is passed to update empty,
+// with created set so that update can fill it in from existing records.
+func (s *Store) UpdateNICClasses(nic string, update func(c *NICClasses, created bool) error) error {
+	if err := os.MkdirAll(s.nicDir(), 0700); err != nil {
+		return fmt.Errorf("failed to create state directory %s: %v", s.nicDir(), err)
+	}
+	lock, err := os.OpenFile(filepath.Join(s.nicDir(), "."+nic+".lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to lock class registry for %s: %v", nic, err)
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	c, err := s.LoadNICClasses(nic)
+	created := err == ErrNotFound
+	if created {
+		c = &NICClasses{NIC: nic, Classes: map[uint16]*NICClass{}}
+	} else if err != nil {
+		return err
+	}
+	if err = update(c, created); err != nil {
+		return err
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return writeAtomic(s.nicDir(), nic, data)
+}
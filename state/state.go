@@ -0,0 +1,426 @@
+// Package state persists the shaping state the plugin programs for each container, so that the agent and later
+// CNI invocations can find the devices and rates of a container without recomputing them.
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultDir is the directory records are stored in when none is configured.
+const DefaultDir = "/var/lib/cni_flow_control"
+
+// DefaultIfName is the interface containers are attached with first, which Kubernetes names eth0.
+const DefaultIfName = "eth0"
+
+// Secondary reports whether ifName is a secondary interface of a container, such as one Multus attaches.
+func Secondary(ifName string) bool {
+	return ifName != "" && ifName != DefaultIfName
+}
+
+// RecordKey returns the key the state of the interface ifName of a container is stored under: the container ID for
+// its primary interface, as before containers could have several, and the container ID and interface name for its
+// secondary ones.
+func RecordKey(containerID, ifName string) string {
+	if !Secondary(ifName) {
+		return containerID
+	}
+	return containerID + "_" + ifName
+}
+
+// ErrNotFound is returned when no record exists for the requested container.
+var ErrNotFound = errors.New("no shaping state recorded for container")
+
+// Values of Record.Status.
+const (
+	// StatusApplied means the shaping is believed to be in place.
+	StatusApplied = "Applied"
+	// StatusDegraded means part of the shaping was found missing or modified since it was applied.
+	StatusDegraded = "Degraded"
+	// StatusUnsupported means the pod requested limits the plugin cannot apply, e.g. because it is a hostNetwork
+	// pod; StatusReason says why.
+	StatusUnsupported = "Unsupported"
+	// StatusFailed means the agent tried and failed to rebuild degraded shaping.
+	StatusFailed = "Failed"
+)
+
+// Record is the shaping state of an interface of a container.
+type Record struct {
+	ContainerID string `json:"container_id"`
+	IfName      string `json:"if_name"`
+	Workload    string `json:"workload"`
+	// Namespace and Pod identify the Kubernetes pod, if any.
+	Namespace string `json:"namespace,omitempty"`
+	Pod       string `json:"pod,omitempty"`
+
+	// HostNetwork records are written by the agent for hostNetwork pods, which have no interfaces of their own.
+	HostNetwork bool   `json:"host_network,omitempty"`
+	HostVeth    string `json:"host_veth"`
+	IFB         string `json:"ifb"`
+	// Attachment is the mode the container was attached with, if not ptp. Containers attached with an ipvlan or
+	// macvlan device have no host veth.
+	Attachment string `json:"attachment,omitempty"`
+
+	// HostVethMAC and ContainerMAC are the MACs of the two ends of the pod's veth.
+	HostVethMAC  string `json:"host_veth_mac,omitempty"`
+	ContainerMAC string `json:"container_mac,omitempty"`
+
+	// Rates are in bits per second, from the point of view of the pod.
+	IngressRate uint64 `json:"ingress_rate"`
+	EgressRate  uint64 `json:"egress_rate"`
+	// IngressCeil and EgressCeil are what each direction may borrow up to, in bits per second, if above its rate.
+	IngressCeil  uint64 `json:"ingress_ceil,omitempty"`
+	EgressCeil   uint64 `json:"egress_ceil,omitempty"`
+	LatencyClass string `json:"latency_class,omitempty"`
+	// LeafQdisc is the kind of the qdisc under the veth classes of the pod, if any.
+	LeafQdisc   string `json:"leaf_qdisc,omitempty"`
+	NonIPPolicy string `json:"non_ip_policy,omitempty"`
+	// IPFamilyBudget is "separate" if IPv4 and IPv6 each have a class with the full rate, rather than sharing one.
+	IPFamilyBudget string `json:"ip_family_budget,omitempty"`
+	// DSCP is marked on the IP traffic leaving the pod, if set.
+	DSCP *uint8 `json:"dscp,omitempty"`
+	// Classifier is the classifier of the pod's veth shaping, if not u32.
+	Classifier string `json:"classifier,omitempty"`
+	// MirrorTo is the host interface the traffic of the pod is mirrored to, if any.
+	MirrorTo string `json:"mirror_to,omitempty"`
+	// TCPShare and UDPShare are the percentages of each rate guaranteed to the pod's TCP and UDP traffic, in leaf
+	// classes under its veth classes, if its limits are split by protocol.
+	TCPShare uint32 `json:"tcp_share,omitempty"`
+	UDPShare uint32 `json:"udp_share,omitempty"`
+	// Classes are the classes the traffic of the pod matching them is shaped in apart from the rest, in leaf
+	// classes under its veth classes.
+	Classes []TrafficClass `json:"classes,omitempty"`
+	// IngressBurst, EgressBurst and Cbuffer are the configured burst sizes of the pod's veth shaping, in bytes, or
+	// zero for the defaults.
+	IngressBurst uint32 `json:"ingress_burst,omitempty"`
+	EgressBurst  uint32 `json:"egress_burst,omitempty"`
+	Cbuffer      uint32 `json:"cbuffer,omitempty"`
+	// Qdisc is "tbf" if each direction of the pod's veth shaping is a single TBF qdisc rather than HTB classes,
+	// "ebpf" if BPF programs on its host veth shape it, and "police" if police actions on its host veth drop what
+	// exceeds its rates.
+	Qdisc string `json:"qdisc,omitempty"`
+	// EgressPoliced is set if the egress of the pod is policed on its host veth, with no IFB device, as the kernel
+	// couldn't create one.
+	EgressPoliced bool `json:"egress_policed,omitempty"`
+	// Preset is the cluster policy preset the rates came from, if any.
+	Preset string `json:"preset,omitempty"`
+	// Template is the cluster policy template that computed the rates, if any.
+	Template string `json:"template,omitempty"`
+	// PriorityClass is the Kubernetes PriorityClass of the pod, if the cluster policy has a treatment for it, and
+	// ClassPriority the HTB priority of its classes.
+	PriorityClass string `json:"priority_class,omitempty"`
+	ClassPriority uint32 `json:"class_priority,omitempty"`
+
+	// ShapingGeneration is which of the two alternating sets of classes and filters the pod's veth shaping uses.
+	// It flips each time the hierarchy is swapped for new settings.
+	ShapingGeneration int `json:"shaping_generation,omitempty"`
+
+	// ShapingMode is "nic" for pods shaped on the node's uplink NIC, in class NICClassMinor of its HTB qdiscs,
+	// matching the pod's IPs, and "container" for pods shaped on their interface IfName inside their network
+	// namespace Netns.
+	ShapingMode   string `json:"shaping_mode,omitempty"`
+	Netns         string `json:"netns,omitempty"`
+	NIC           string `json:"nic,omitempty"`
+	NICClassMinor uint16 `json:"nic_class_minor,omitempty"`
+	// IPs are the pod's addresses.
+	IPs []string `json:"ips,omitempty"`
+	// NICParentMinor is the class of the uplink's borrow hierarchy the pod's class is under, or 0 for the root qdisc.
+	NICParentMinor uint16 `json:"nic_parent_minor,omitempty"`
+	// NICOverflow is set for pods shaped on their veth because the classes of the uplink ran out.
+	NICOverflow bool `json:"nic_overflow,omitempty"`
+	// NICOffloaded is set for pods whose ingress is also policed in the hardware of the uplink.
+	NICOffloaded bool `json:"nic_offloaded,omitempty"`
+
+	// ConntrackMark is the conntrack mark stamped on the pod's connections, if any.
+	ConntrackMark uint32 `json:"conntrack_mark,omitempty"`
+	// DNSRateLimit, ICMPRateLimit and ICMPv6RateLimit are the rates the pod's DNS queries, ICMP and ICMPv6 are
+	// policed to, in packets per second, if any.
+	DNSRateLimit    uint64 `json:"dns_rate_limit,omitempty"`
+	ICMPRateLimit   uint64 `json:"icmp_rate_limit,omitempty"`
+	ICMPv6RateLimit uint64 `json:"icmpv6_rate_limit,omitempty"`
+	// IngressPPS and EgressPPS are the packet rates all traffic to and from the pod is policed to, for bandwidth
+	// limits too low to shape with HTB, if any.
+	IngressPPS uint64 `json:"ingress_pps,omitempty"`
+	EgressPPS  uint64 `json:"egress_pps,omitempty"`
+	// MaxPPS is the packet rate all traffic from the pod is policed to, and MaxConnections how many connections it
+	// may have open at once, against floods, if any.
+	MaxPPS         uint64 `json:"max_pps,omitempty"`
+	MaxConnections uint64 `json:"max_connections,omitempty"`
+
+	Status       string `json:"status,omitempty"`
+	StatusReason string `json:"status_reason,omitempty"`
+
+	// Paused is set while shaping is suspended; PausedUntil is when it is automatically resumed.
+	Paused      bool       `json:"paused,omitempty"`
+	PausedUntil *time.Time `json:"paused_until,omitempty"`
+	// Throttle is a temporary limit applied through the agent in place of the recorded rates, if any.
+	Throttle *Throttle `json:"throttle,omitempty"`
+	// Schedule is the windows of the day the agent gives the pod other rates in, if any.
+	Schedule []ScheduleWindow `json:"schedule,omitempty"`
+
+	// Reconciled is when the shaping was last programmed or found intact.
+	Reconciled *time.Time `json:"reconciled,omitempty"`
+	// ReconcileAttempted is when the shaping was last programmed, checked or repaired, whether that succeeded or
+	// not, and ReconcileError why that last attempt failed, empty if it succeeded.
+	ReconcileAttempted *time.Time `json:"reconcile_attempted,omitempty"`
+	ReconcileError     string     `json:"reconcile_error,omitempty"`
+
+	Updated time.Time `json:"updated"`
+}
+
+// Throttle is a temporary limit on the rates of a pod, in bits per second. Its rates replace the recorded ones of
+// the directions they are set for until it is lifted, automatically at Until if that is set.
+type Throttle struct {
+	IngressRate uint64     `json:"ingress_rate,omitempty"`
+	EgressRate  uint64     `json:"egress_rate,omitempty"`
+	Until       *time.Time `json:"until,omitempty"`
+	// Reason is why the pod was throttled, as given by the operator or system that throttled it.
+	Reason string `json:"reason,omitempty"`
+}
+
+// ScheduleWindow is a window of the day a pod has other rates in, in bits per second, than the recorded ones of
+// the directions they are set for. From and To are minutes since midnight in the local time of the node; a window
+// whose To is before its From spans midnight.
+type ScheduleWindow struct {
+	From        int    `json:"from"`
+	To          int    `json:"to"`
+	IngressRate uint64 `json:"ingress_rate,omitempty"`
+	EgressRate  uint64 `json:"egress_rate,omitempty"`
+}
+
+// String returns the window as its times of day, like "09:00-18:00".
+func (w ScheduleWindow) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", w.From/60, w.From%60, w.To/60, w.To%60)
+}
+
+// Contains reports whether t is in the window, which includes its start but not its end.
+func (w ScheduleWindow) Contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	if w.From <= w.To {
+		return minute >= w.From && minute < w.To
+	}
+	return minute >= w.From || minute < w.To
+}
+
+// TrafficClass is a class of the traffic of a pod in one direction, shaped apart from the rest of it. Traffic
+// matches it if it matches every part of the match that is set.
+type TrafficClass struct {
+	Name string `json:"name"`
+	// Direction is "ingress" or "egress", from the point of view of the pod.
+	Direction string `json:"direction"`
+	// Dst and Src are the CIDRs the destination and source addresses are in, Protocol "tcp" or "udp" and Ports
+	// the port, or range of ports, the destination port is in.
+	Dst      string `json:"dst,omitempty"`
+	Src      string `json:"src,omitempty"`
+	Protocol string `json:"protocol,omitempty"`
+	Ports    string `json:"ports,omitempty"`
+	// Mark is the firewall mark the traffic of the class has, in place of the rest of the match, if set.
+	Mark uint32 `json:"mark,omitempty"`
+	// Peers are CIDRs one of which the address of the peer of the pod, the destination of egress and the source of
+	// ingress, is in.
+	Peers []string `json:"peers,omitempty"`
+	// Rate and Ceil are in bits per second. A class without them gets what the others leave of the rate of the
+	// pod, and borrows up to its ceil.
+	Rate uint64 `json:"rate"`
+	Ceil uint64 `json:"ceil"`
+	// DSCP is marked on the traffic of the class, if set.
+	DSCP *uint8 `json:"dscp,omitempty"`
+	// Prio, Quantum and Cbuffer are the HTB priority, quantum and cbuffer of the class, in place of the defaults
+	// of the pod, if set.
+	Prio    *uint32 `json:"prio,omitempty"`
+	Quantum uint32  `json:"quantum,omitempty"`
+	Cbuffer uint32  `json:"cbuffer,omitempty"`
+}
+
+// ActiveRates returns the rates the classes of the pod have now unless its shaping is paused: those of its
+// throttle where it sets them, else those of the window of its schedule it is in, otherwise the recorded ones.
+func (r *Record) ActiveRates() (ingress, egress uint64) {
+	return r.ActiveRatesAt(time.Now())
+}
+
+// ActiveRatesAt returns the rates the classes of the pod have at t unless its shaping is paused. A schedule only
+// changes the directions the pod is limited in.
+func (r *Record) ActiveRatesAt(t time.Time) (ingress, egress uint64) {
+	ingress, egress = r.IngressRate, r.EgressRate
+	if w := r.ActiveWindow(t); w >= 0 {
+		window := r.Schedule[w]
+		if ingress != 0 && window.IngressRate != 0 {
+			ingress = window.IngressRate
+		}
+		if egress != 0 && window.EgressRate != 0 {
+			egress = window.EgressRate
+		}
+	}
+	if r.Throttle != nil {
+		if r.Throttle.IngressRate != 0 {
+			ingress = r.Throttle.IngressRate
+		}
+		if r.Throttle.EgressRate != 0 {
+			egress = r.Throttle.EgressRate
+		}
+	}
+	return ingress, egress
+}
+
+// ActiveWindow returns the index of the window of the schedule of the pod t is in, the first of them if they
+// overlap, or -1 if it is in none.
+func (r *Record) ActiveWindow(t time.Time) int {
+	for i, w := range r.Schedule {
+		if w.Contains(t) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Key returns the RecordKey of the record.
+func (r *Record) Key() string {
+	return RecordKey(r.ContainerID, r.IfName)
+}
+
+// MarkReconciled records that the shaping of r was just programmed or found intact.
+func (r *Record) MarkReconciled() {
+	now := time.Now()
+	r.Reconciled = &now
+	r.ReconcileAttempted = &now
+	r.ReconcileError = ""
+}
+
+// MarkReconcileFailed records that programming, checking or repairing the shaping of r just failed with err.
+func (r *Record) MarkReconcileFailed(err error) {
+	now := time.Now()
+	r.ReconcileAttempted = &now
+	r.ReconcileError = err.Error()
+}
+
+// Store is a directory of JSON records, one file per interface of a container, named after its RecordKey.
+type Store struct {
+	Dir string
+}
+
+// NewStore returns a Store rooted at dir, or at DefaultDir if dir is empty.
+func NewStore(dir string) *Store {
+	if dir == "" {
+		dir = DefaultDir
+	}
+	return &Store{Dir: dir}
+}
+
+func (s *Store) path(key string) string {
+	return filepath.Join(s.Dir, key+".json")
+}
+
+// Save writes the record, replacing any existing record for the interface.
+func (s *Store) Save(r *Record) error {
+	if r.ContainerID == "" {
+		return errors.New("cannot save shaping state without a container ID")
+	}
+	r.Updated = time.Now()
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return writeAtomic(s.Dir, r.Key(), data)
+}
+
+// writeAtomic writes <dir>/<name>.json through a temporary file renamed into place, so that readers never see a
+// partial file.
+func writeAtomic(dir, name string, data []byte) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create state directory %s: %v", dir, err)
+	}
+	tmp, err := ioutil.TempFile(dir, "."+name)
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, name+".json"))
+}
+
+// Load returns the record stored under key, or ErrNotFound.
+func (s *Store) Load(key string) (*Record, error) {
+	data, err := ioutil.ReadFile(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	r := &Record{}
+	if err = json.Unmarshal(data, r); err != nil {
+		return nil, fmt.Errorf("corrupt shaping state for %s: %v", key, err)
+	}
+	return r, nil
+}
+
+// Find returns the record matching id, which is either a record key, the container ID of a primary interface, or a
+// workload name. A workload name finds the record of its primary interface if it has one.
+func (s *Store) Find(id string) (*Record, error) {
+	if r, err := s.Load(id); err != ErrNotFound {
+		return r, err
+	}
+	records, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	var found *Record
+	for _, r := range records {
+		if r.Workload != id {
+			continue
+		}
+		if !Secondary(r.IfName) {
+			return r, nil
+		}
+		if found == nil {
+			found = r
+		}
+	}
+	if found == nil {
+		return nil, ErrNotFound
+	}
+	return found, nil
+}
+
+// Delete removes the record stored under key. Deleting a missing record is not an error.
+func (s *Store) Delete(key string) error {
+	if err := os.Remove(s.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// List returns all records in the store.
+func (s *Store) List() ([]*Record, error) {
+	files, err := ioutil.ReadDir(s.Dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var records []*Record
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		r, err := s.Load(strings.TrimSuffix(name, ".json"))
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
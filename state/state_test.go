@@ -0,0 +1,352 @@
+package state_test
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/cni-plugin/state"
+)
+
+var _ = Describe("Store", func() {
+	var dir string
+	var store *state.Store
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "flowcontrol-state")
+		Expect(err).NotTo(HaveOccurred())
+		store = state.NewStore(dir)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("round-trips a record", func() {
+		r := &state.Record{ContainerID: "abc", HostVeth: "caliabc", IFB: "ifbabc", IngressRate: 1000, EgressRate: 2000}
+		Expect(store.Save(r)).To(Succeed())
+
+		loaded, err := store.Load("abc")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(loaded.HostVeth).To(Equal("caliabc"))
+		Expect(loaded.EgressRate).To(Equal(uint64(2000)))
+		Expect(loaded.Updated.IsZero()).To(BeFalse())
+	})
+
+	It("finds records by workload", func() {
+		Expect(store.Save(&state.Record{ContainerID: "abc", Workload: "default.nginx"})).To(Succeed())
+		r, err := store.Find("default.nginx")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(r.ContainerID).To(Equal("abc"))
+	})
+
+	It("keeps the records of the interfaces of a container apart", func() {
+		Expect(store.Save(&state.Record{ContainerID: "abc", IfName: "net1", Workload: "default.nginx"})).To(Succeed())
+		Expect(store.Save(&state.Record{ContainerID: "abc", IfName: "eth0", Workload: "default.nginx"})).To(Succeed())
+
+		r, err := store.Load(state.RecordKey("abc", "net1"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(r.IfName).To(Equal("net1"))
+		r, err = store.Find("default.nginx")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(r.Key()).To(Equal("abc"))
+	})
+
+	It("reports missing records", func() {
+		_, err := store.Load("missing")
+		Expect(err).To(Equal(state.ErrNotFound))
+		Expect(store.Delete("missing")).To(Succeed())
+	})
+
+	It("lists only records", func() {
+		Expect(store.Save(&state.Record{ContainerID: "a"})).To(Succeed())
+		Expect(store.Save(&state.Record{ContainerID: "b"})).To(Succeed())
+		Expect(ioutil.WriteFile(dir+"/.tmp", []byte("x"), 0600)).To(Succeed())
+		records, err := store.List()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(records).To(HaveLen(2))
+	})
+
+	It("registers uplink classes", func() {
+		allocate := func(id string) uint16 {
+			var minor uint16
+			Expect(store.UpdateNICClasses("eth0", func(c *state.NICClasses, _ bool) error {
+				var err error
+				minor, err = c.Allocate(&state.NICClass{ContainerID: id, Preset: "bronze"}, 2)
+				return err
+			})).To(Succeed())
+			return minor
+		}
+		Expect(allocate("a")).To(Equal(uint16(1)))
+		Expect(allocate("b")).To(Equal(uint16(2)))
+		Expect(allocate("a")).To(Equal(uint16(1)))
+
+		Expect(store.UpdateNICClasses("eth0", func(c *state.NICClasses, created bool) error {
+			Expect(created).To(BeFalse())
+			c.Release("a")
+			_, err := c.Allocate(&state.NICClass{ContainerID: "c"}, 2)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = c.Allocate(&state.NICClass{ContainerID: "d"}, 2)
+			Expect(err).To(Equal(state.ErrNICClassesExhausted))
+			return nil
+		})).To(Succeed())
+
+		c, err := store.LoadNICClasses("eth0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.Classes).To(HaveLen(2))
+		Expect(c.Classes[1].ContainerID).To(Equal("c"))
+		Expect(c.Classes[2].Preset).To(Equal("bronze"))
+
+		records, err := store.List()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(records).To(BeEmpty())
+	})
+
+	It("checkpoints counters apart from records", func() {
+		_, err := store.LoadCounters("abc")
+		Expect(err).To(Equal(state.ErrNotFound))
+		Expect(store.SaveCounters("abc", &state.Counters{Retired: state.Traffic{EgressBytes: 10}})).To(Succeed())
+		c, err := store.LoadCounters("abc")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.Total().EgressBytes).To(BeEquivalentTo(10))
+
+		records, err := store.List()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(records).To(BeEmpty())
+		Expect(store.DeleteCounters("abc")).To(Succeed())
+		Expect(store.DeleteCounters("abc")).To(Succeed())
+	})
+
+	It("numbers device names", func() {
+		_, err := store.LoadNames()
+		Expect(err).To(Equal(state.ErrNotFound))
+
+		allocate := func(id string) int {
+			var number int
+			Expect(store.UpdateNames(func(n *state.Names) error {
+				var err error
+				number, err = n.Allocate(id, 1)
+				return err
+			})).To(Succeed())
+			return number
+		}
+		Expect(allocate("a")).To(Equal(0))
+		Expect(allocate("b")).To(Equal(1))
+		Expect(allocate("a")).To(Equal(0))
+		Expect(store.UpdateNames(func(n *state.Names) error {
+			_, err := n.Allocate("c", 1)
+			return err
+		})).NotTo(Succeed())
+
+		Expect(store.UpdateNames(func(n *state.Names) error {
+			n.Release("a")
+			return nil
+		})).To(Succeed())
+		Expect(allocate("c")).To(Equal(0))
+
+		records, err := store.List()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(records).To(BeEmpty())
+	})
+
+	It("caches kernel capabilities apart from records", func() {
+		_, err := store.LoadCapabilities()
+		Expect(err).To(Equal(state.ErrNotFound))
+
+		Expect(store.SaveCapabilities(&state.Capabilities{KernelRelease: "5.4.0", TCShapingError: "no ifb"})).To(Succeed())
+		c, err := store.LoadCapabilities()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.KernelRelease).To(Equal("5.4.0"))
+		Expect(c.TCShaping).To(BeFalse())
+
+		records, err := store.List()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(records).To(BeEmpty())
+	})
+
+	It("keeps the maintenance mode of the node apart from records", func() {
+		_, err := store.LoadMaintenance()
+		Expect(err).To(Equal(state.ErrNotFound))
+
+		until := time.Now().Add(time.Hour)
+		Expect(store.SaveMaintenance(&state.Maintenance{Since: time.Now(), Until: until, Reason: "drain"})).To(Succeed())
+		m, err := store.LoadMaintenance()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(m.Until.Equal(until)).To(BeTrue())
+		Expect(m.Reason).To(Equal("drain"))
+		records, err := store.List()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(records).To(BeEmpty())
+
+		Expect(store.DeleteMaintenance()).To(Succeed())
+		_, err = store.LoadMaintenance()
+		Expect(err).To(Equal(state.ErrNotFound))
+		Expect(store.DeleteMaintenance()).To(Succeed())
+	})
+})
+
+var _ = Describe("Journal", func() {
+	var dir string
+	var journal *state.Journal
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "flowcontrol-journal")
+		Expect(err).NotTo(HaveOccurred())
+		journal = state.NewJournal(dir)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("keeps entries until they are completed", func() {
+		Expect(journal.Write(&state.Entry{ContainerID: "abc", Op: "ADD", IFB: "ifbabc"})).To(Succeed())
+		e, err := journal.Load("abc")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(e.IFB).To(Equal("ifbabc"))
+
+		Expect(journal.Complete("abc")).To(Succeed())
+		_, err = journal.Load("abc")
+		Expect(err).To(Equal(state.ErrNotFound))
+		Expect(journal.Complete("abc")).To(Succeed())
+	})
+
+	It("is not listed as shaping state", func() {
+		Expect(journal.Write(&state.Entry{ContainerID: "abc", Op: "DEL"})).To(Succeed())
+		records, err := state.NewStore(dir).List()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(records).To(BeEmpty())
+
+		entries, err := journal.List()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(HaveLen(1))
+	})
+})
+
+var _ = Describe("AuditLog", func() {
+	var dir string
+	var audit *state.AuditLog
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "flowcontrol-audit")
+		Expect(err).NotTo(HaveOccurred())
+		audit = state.NewAuditLog(dir)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("queries entries by pod and trigger", func() {
+		Expect(audit.Append(&state.AuditEntry{Action: state.AuditCreate, Trigger: state.AuditTriggerCNIAdd,
+			ContainerID: "abc", Workload: "default.nginx"})).To(Succeed())
+		Expect(audit.Append(&state.AuditEntry{Action: state.AuditUpdate, Trigger: state.AuditTriggerAPI,
+			ContainerID: "abc", Workload: "default.nginx", Detail: "paused"})).To(Succeed())
+		Expect(audit.Append(&state.AuditEntry{Action: state.AuditCreate, Trigger: state.AuditTriggerCNIAdd,
+			ContainerID: "def"})).To(Succeed())
+
+		entries, err := audit.Query(state.AuditQuery{ID: "default.nginx"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(HaveLen(2))
+		Expect(entries[1].Detail).To(Equal("paused"))
+		Expect(entries[1].PID).To(Equal(os.Getpid()))
+
+		entries, err = audit.Query(state.AuditQuery{Trigger: state.AuditTriggerCNIAdd, Limit: 1})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].ContainerID).To(Equal("def"))
+	})
+
+	It("rotates, dropping the oldest entries", func() {
+		audit.MaxBytes, audit.Files = 200, 1
+		for i := 0; i < 10; i++ {
+			Expect(audit.Append(&state.AuditEntry{Action: state.AuditUpdate, Trigger: state.AuditTriggerPolicy,
+				ContainerID: "abc", Detail: fmt.Sprintf("change %d", i)})).To(Succeed())
+		}
+		entries, err := audit.Query(state.AuditQuery{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(len(entries)).To(BeNumerically("<", 10))
+		Expect(entries[len(entries)-1].Detail).To(Equal("change 9"))
+	})
+})
+
+var _ = Describe("Record", func() {
+	It("prefers the rates of its throttle", func() {
+		r := &state.Record{IngressRate: 1000, EgressRate: 2000}
+		ingress, egress := r.ActiveRates()
+		Expect([]uint64{ingress, egress}).To(Equal([]uint64{1000, 2000}))
+
+		r.Throttle = &state.Throttle{EgressRate: 500}
+		ingress, egress = r.ActiveRates()
+		Expect([]uint64{ingress, egress}).To(Equal([]uint64{1000, 500}))
+	})
+
+	It("follows its schedule in the directions it is limited in", func() {
+		r := &state.Record{EgressRate: 2000, Schedule: []state.ScheduleWindow{
+			{From: 22 * 60, To: 6 * 60, IngressRate: 4000, EgressRate: 8000},
+		}}
+		night := time.Date(2017, 11, 1, 23, 30, 0, 0, time.Local)
+		ingress, egress := r.ActiveRatesAt(night)
+		Expect([]uint64{ingress, egress}).To(Equal([]uint64{0, 8000}))
+
+		day := time.Date(2017, 11, 1, 12, 0, 0, 0, time.Local)
+		Expect(r.ActiveWindow(day)).To(Equal(-1))
+		ingress, egress = r.ActiveRatesAt(day)
+		Expect([]uint64{ingress, egress}).To(Equal([]uint64{0, 2000}))
+
+		r.Throttle = &state.Throttle{EgressRate: 500}
+		ingress, egress = r.ActiveRatesAt(night)
+		Expect([]uint64{ingress, egress}).To(Equal([]uint64{0, 500}))
+	})
+
+	It("keeps the last reconcile error until a reconcile succeeds", func() {
+		r := &state.Record{}
+		r.MarkReconciled()
+		success := *r.Reconciled
+
+		r.MarkReconcileFailed(errors.New("no such device"))
+		Expect(r.ReconcileError).To(Equal("no such device"))
+		Expect(*r.Reconciled).To(Equal(success))
+		Expect(r.ReconcileAttempted.Before(success)).To(BeFalse())
+
+		r.MarkReconciled()
+		Expect(r.ReconcileError).To(BeEmpty())
+	})
+})
+
+var _ = Describe("Counters", func() {
+	It("carries traffic across rebuilds", func() {
+		c := &state.Counters{}
+		c.Observe(state.Traffic{IngressBytes: 100, IngressPackets: 2, EgressBytes: 50, EgressPackets: 1})
+		c.Observe(state.Traffic{IngressBytes: 300, IngressPackets: 4, EgressBytes: 80, EgressPackets: 2})
+		Expect(c.Total()).To(Equal(state.Traffic{IngressBytes: 300, IngressPackets: 4, EgressBytes: 80, EgressPackets: 2}))
+
+		// The egress classes are rebuilt, the ingress ones keep counting.
+		c.Retire(state.Traffic{IngressBytes: 400, IngressPackets: 5, EgressBytes: 90, EgressPackets: 3}, false, true)
+		c.Observe(state.Traffic{IngressBytes: 500, IngressPackets: 6, EgressBytes: 10, EgressPackets: 1})
+		Expect(c.Total()).To(Equal(state.Traffic{IngressBytes: 500, IngressPackets: 6, EgressBytes: 100, EgressPackets: 4}))
+
+		// A reboot resets both directions without warning.
+		c.Observe(state.Traffic{IngressBytes: 20, IngressPackets: 1})
+		Expect(c.Total()).To(Equal(state.Traffic{IngressBytes: 520, IngressPackets: 7, EgressBytes: 100, EgressPackets: 4}))
+	})
+
+	It("carries drops and overlimits with the rest of their direction", func() {
+		c := &state.Counters{}
+		c.Observe(state.Traffic{IngressBytes: 100, IngressPackets: 2, IngressDrops: 3, IngressOverlimits: 7, EgressBytes: 50,
+			EgressPackets: 1, EgressDrops: 1})
+		c.Retire(state.Traffic{IngressBytes: 200, IngressPackets: 4, IngressDrops: 5, IngressOverlimits: 9, EgressBytes: 60,
+			EgressPackets: 2, EgressDrops: 2}, true, false)
+		c.Observe(state.Traffic{IngressBytes: 10, IngressPackets: 1, IngressDrops: 1, EgressBytes: 70, EgressPackets: 3,
+			EgressDrops: 2})
+		Expect(c.Total()).To(Equal(state.Traffic{IngressBytes: 210, IngressPackets: 5, IngressDrops: 6, IngressOverlimits: 9,
+			EgressBytes: 70, EgressPackets: 3, EgressDrops: 2}))
+	})
+})
@@ -0,0 +1,156 @@
+// Package sysctl applies batches of kernel parameters through /proc/sys, verifying each value after writing it and
+// reporting every key that couldn't be applied rather than stopping at the first.
+//
+// Keys use sysctl(8)'s dotted syntax, e.g. net.ipv4.conf.eth0.forwarding. As with sysctl(8), a "/" in a key stands
+// for a "." inside a component, so net.ipv4.conf.eth0/100.forwarding refers to the VLAN interface eth0.100. The
+// component IFNAME is replaced by the interface the batch is applied for.
+package sysctl
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/projectcalico/cni-plugin/internal/util"
+)
+
+// DefaultRoot is where the kernel exposes its parameters.
+const DefaultRoot = "/proc/sys"
+
+// IfNamePlaceholder is the key component replaced by the interface name.
+const IfNamePlaceholder = "IFNAME"
+
+// Setting is a kernel parameter and the value to set it to.
+type Setting struct {
+	Key   string
+	Value string
+}
+
+// Batch is an ordered list of settings applied together.
+type Batch struct {
+	// Root is the directory the parameters are under; DefaultRoot if empty.
+	Root string
+
+	settings []Setting
+}
+
+// Set adds a setting to the batch. Later settings of the same key win.
+func (b *Batch) Set(key, value string) {
+	b.settings = append(b.settings, Setting{Key: key, Value: value})
+}
+
+// SetAll adds settings from a map, such as the sysctls of a network configuration, in key order.
+func (b *Batch) SetAll(settings map[string]string) {
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		b.Set(key, settings[key])
+	}
+}
+
+// Error lists the keys of a batch that couldn't be applied.
+type Error struct {
+	Failed []Failure
+}
+
+// Failure is a key that couldn't be applied and why.
+type Failure struct {
+	Key string
+	Err error
+}
+
+func (e *Error) Error() string {
+	msgs := make([]string, len(e.Failed))
+	for i, f := range e.Failed {
+		msgs[i] = fmt.Sprintf("%s: %v", f.Key, f.Err)
+	}
+	return fmt.Sprintf("failed to apply %d sysctl(s): %s", len(e.Failed), strings.Join(msgs, "; "))
+}
+
+// Path returns the file under root of key, with IFNAME replaced by ifName.
+func Path(root, key, ifName string) (string, error) {
+	if root == "" {
+		root = DefaultRoot
+	}
+	parts := strings.Split(key, ".")
+	for i, part := range parts {
+		if part == IfNamePlaceholder {
+			if ifName == "" {
+				return "", fmt.Errorf("sysctl key %q needs an interface name", key)
+			}
+			part = ifName
+		}
+		if part == "" {
+			return "", fmt.Errorf("invalid sysctl key %q", key)
+		}
+		part = strings.Replace(part, "/", ".", -1)
+		if part == "." || part == ".." {
+			return "", fmt.Errorf("invalid sysctl key %q", key)
+		}
+		parts[i] = part
+	}
+	return filepath.Join(append([]string{root}, parts...)...), nil
+}
+
+// Apply writes every setting, with IFNAME replaced by ifName, and reads each back to check it took. All settings
+// are attempted; if any failed, the returned *Error lists them.
+func (b *Batch) Apply(ifName string) error {
+	var failed []Failure
+	for _, s := range b.settings {
+		if err := apply(b.Root, s, ifName); err != nil {
+			failed = append(failed, Failure{Key: s.Key, Err: err})
+		}
+	}
+	if len(failed) > 0 {
+		return &Error{Failed: failed}
+	}
+	return nil
+}
+
+// Verify reads every setting, with IFNAME replaced by ifName, without writing any. If any doesn't have its value,
+// the returned *Error lists them.
+func (b *Batch) Verify(ifName string) error {
+	var failed []Failure
+	for _, s := range b.settings {
+		path, err := Path(b.Root, s.Key, ifName)
+		if err == nil {
+			err = readBack(path, s.Value, "expected")
+		}
+		if err != nil {
+			failed = append(failed, Failure{Key: s.Key, Err: err})
+		}
+	}
+	if len(failed) > 0 {
+		return &Error{Failed: failed}
+	}
+	return nil
+}
+
+func apply(root string, s Setting, ifName string) error {
+	path, err := Path(root, s.Key, ifName)
+	if err != nil {
+		return err
+	}
+	if err = util.WriteProc(path, s.Value); err != nil {
+		return err
+	}
+	return readBack(path, s.Value, "wrote")
+}
+
+// readBack checks that the parameter at path has value. verb says where value came from in the error.
+func readBack(path, value, verb string) error {
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read back %q: %v", path, err)
+	}
+	// The kernel echoes multi-valued parameters separated by tabs, so only compare the fields.
+	if strings.Join(strings.Fields(string(got)), " ") != strings.Join(strings.Fields(value), " ") {
+		return fmt.Errorf("%s %q but read back %q", verb, value, strings.TrimSpace(string(got)))
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package sysctl_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/cni-plugin/sysctl"
+)
+
+var _ = Describe("Path", func() {
+	It("maps dotted keys to files", func() {
+		Expect(sysctl.Path("", "net.ipv4.conf.IFNAME.proxy_arp", "cali1234")).To(Equal("/proc/sys/net/ipv4/conf/cali1234/proxy_arp"))
+	})
+
+	It("treats a slash as a dot inside a component", func() {
+		Expect(sysctl.Path("/r", "net.ipv4.conf.eth0/100.forwarding", "")).To(Equal("/r/net/ipv4/conf/eth0.100/forwarding"))
+	})
+
+	It("rejects keys escaping the root", func() {
+		_, err := sysctl.Path("", "net.ipv4..conf", "")
+		Expect(err).To(HaveOccurred())
+		_, err = sysctl.Path("", "net.ipv4.conf.IFNAME.forwarding", "")
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("Batch", func() {
+	var root string
+
+	BeforeEach(func() {
+		var err error
+		root, err = ioutil.TempDir("", "sysctl")
+		Expect(err).NotTo(HaveOccurred())
+		dir := filepath.Join(root, "net", "ipv4", "conf", "cali1234")
+		Expect(os.MkdirAll(dir, 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "forwarding"), []byte("0\n"), 0644)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(root)
+	})
+
+	It("applies every setting and reports the ones that failed", func() {
+		b := &sysctl.Batch{Root: root}
+		b.Set("net.ipv4.conf.IFNAME.missing", "1")
+		b.Set("net.ipv4.conf.IFNAME.forwarding", "1")
+
+		err := b.Apply("cali1234")
+		Expect(err).To(BeAssignableToTypeOf(&sysctl.Error{}))
+		failed := err.(*sysctl.Error).Failed
+		Expect(failed).To(HaveLen(1))
+		Expect(failed[0].Key).To(Equal("net.ipv4.conf.IFNAME.missing"))
+
+		data, err := ioutil.ReadFile(filepath.Join(root, "net", "ipv4", "conf", "cali1234", "forwarding"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(Equal("1\n"))
+	})
+
+	It("verifies settings without writing them", func() {
+		b := &sysctl.Batch{Root: root}
+		b.Set("net.ipv4.conf.IFNAME.forwarding", "1")
+
+		err := b.Verify("cali1234")
+		Expect(err).To(BeAssignableToTypeOf(&sysctl.Error{}))
+		Expect(err.(*sysctl.Error).Failed[0].Key).To(Equal("net.ipv4.conf.IFNAME.forwarding"))
+
+		data, err := ioutil.ReadFile(filepath.Join(root, "net", "ipv4", "conf", "cali1234", "forwarding"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(Equal("0\n"))
+
+		Expect(b.Apply("cali1234")).To(Succeed())
+		Expect(b.Verify("cali1234")).To(Succeed())
+	})
+})
@@ -334,6 +334,21 @@ func DeleteContainerWithId(netconf, netnspath, name, containerId string) (exitCo
 	return
 }
 
+// RunCNICommand runs the plugin with an arbitrary CNI_COMMAND for a container, and returns what it printed on
+// stdout and its exit code. netnspath and containerId may be empty for commands that don't need them, like VERSION.
+func RunCNICommand(command, netconf, netnspath, containerId string) (stdout []byte, exitCode int, err error) {
+	cni_env := fmt.Sprintf("CNI_COMMAND=%s CNI_CONTAINERID=%s CNI_NETNS=%s CNI_IFNAME=eth0 CNI_PATH=dist", command, containerId, netnspath)
+	subProcess := exec.Command("bash", "-c", fmt.Sprintf("%s dist/%s", cni_env, os.Getenv("PLUGIN")))
+	subProcess.Stdin = strings.NewReader(netconf + "\n")
+
+	session, err := gexec.Start(subProcess, ginkgo.GinkgoWriter, ginkgo.GinkgoWriter)
+	if err != nil {
+		return
+	}
+	session.Wait(5)
+	return session.Out.Contents(), session.ExitCode(), nil
+}
+
 func Cmd(cmd string) string {
 	ginkgo.GinkgoWriter.Write([]byte(fmt.Sprintf("Running command [%s]\n", cmd)))
 	out, err := exec.Command("bash", "-c", cmd).Output()
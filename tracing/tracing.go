@@ -0,0 +1,199 @@
+// Package tracing records spans of a single CNI operation and exports them to an OpenTelemetry collector using
+// OTLP/HTTP with the JSON encoding, so that slow pod startups can be attributed to individual setup steps.
+//
+// A plugin process only ever handles one operation, so the package keeps a single trace: Init starts its root
+// span and Start adds children to it. When tracing isn't configured every function is a cheap no-op.
+package tracing
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// EndpointEnv is the standard OpenTelemetry variable naming the OTLP/HTTP traces endpoint, used when the network
+// configuration doesn't set one.
+const EndpointEnv = "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"
+
+// exportTimeout bounds how long an operation can be delayed by a slow collector.
+const exportTimeout = 2 * time.Second
+
+// OTLP status codes.
+const (
+	statusCodeOK    = 1
+	statusCodeError = 2
+)
+
+// Span is a timed step of the operation. A nil *Span is valid and does nothing.
+type Span struct {
+	name       string
+	id         string
+	parentID   string
+	start      time.Time
+	end        time.Time
+	attributes map[string]string
+	err        error
+}
+
+type tracer struct {
+	mu       sync.Mutex
+	endpoint string
+	service  string
+	traceID  string
+	root     *Span
+	spans    []*Span
+}
+
+var current *tracer
+
+func randomID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Init starts the trace of an operation of service and returns its root span. If endpoint is empty, EndpointEnv
+// is used; if that's empty too, tracing is disabled and nil is returned.
+func Init(endpoint, service, operation string) *Span {
+	if endpoint == "" {
+		endpoint = os.Getenv(EndpointEnv)
+	}
+	if endpoint == "" {
+		current = nil
+		return nil
+	}
+	current = &tracer{endpoint: endpoint, service: service, traceID: randomID(16)}
+	current.root = current.newSpan(operation, "")
+	return current.root
+}
+
+func (t *tracer) newSpan(name, parentID string) *Span {
+	s := &Span{name: name, id: randomID(8), parentID: parentID, start: time.Now(), attributes: map[string]string{}}
+	t.mu.Lock()
+	t.spans = append(t.spans, s)
+	t.mu.Unlock()
+	return s
+}
+
+// Start starts a span for a step of the operation, as a child of the root span.
+func Start(name string) *Span {
+	if current == nil {
+		return nil
+	}
+	return current.newSpan(name, current.root.id)
+}
+
+// SetAttribute records a string attribute on the span.
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.attributes[key] = value
+}
+
+// End ends the span, recording err if the step failed.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	s.err = err
+}
+
+// Flush exports the spans of the trace. Spans that haven't ended are exported as ending now.
+func Flush() error {
+	if current == nil {
+		return nil
+	}
+	body, err := json.Marshal(current.request())
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: exportTimeout}
+	resp, err := client.Post(current.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("OTLP endpoint %s returned %s", current.endpoint, resp.Status)
+	}
+	return nil
+}
+
+type keyValue struct {
+	Key   string            `json:"key"`
+	Value map[string]string `json:"value"`
+}
+
+func stringAttribute(key, value string) keyValue {
+	return keyValue{Key: key, Value: map[string]string{"stringValue": value}}
+}
+
+type status struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []keyValue `json:"attributes,omitempty"`
+	Status            status     `json:"status"`
+}
+
+// request builds the body of an ExportTraceServiceRequest.
+func (t *tracer) request() map[string]interface{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	var spans []otlpSpan
+	for _, s := range t.spans {
+		end := s.end
+		if end.IsZero() {
+			end = now
+		}
+		o := otlpSpan{
+			TraceID:           t.traceID,
+			SpanID:            s.id,
+			ParentSpanID:      s.parentID,
+			Name:              s.name,
+			Kind:              1, // SPAN_KIND_INTERNAL
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+			Status:            status{Code: statusCodeOK},
+		}
+		for key, value := range s.attributes {
+			o.Attributes = append(o.Attributes, stringAttribute(key, value))
+		}
+		if s.err != nil {
+			o.Status = status{Code: statusCodeError, Message: s.err.Error()}
+		}
+		spans = append(spans, o)
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []keyValue{stringAttribute("service.name", t.service)},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "github.com/projectcalico/cni-plugin/tracing"},
+				"spans": spans,
+			}},
+		}},
+	}
+}
@@ -0,0 +1,54 @@
+package tracing_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/cni-plugin/tracing"
+)
+
+var _ = Describe("Tracing", func() {
+	It("does nothing when no endpoint is configured", func() {
+		os.Unsetenv(tracing.EndpointEnv)
+		root := tracing.Init("", "test", "cni.ADD")
+		Expect(root).To(BeNil())
+		tracing.Start("veth").End(nil)
+		Expect(tracing.Flush()).To(Succeed())
+	})
+
+	It("exports the spans of the operation", func() {
+		var body string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			data, _ := ioutil.ReadAll(req.Body)
+			body = string(data)
+		}))
+		defer server.Close()
+
+		root := tracing.Init(server.URL, "test", "cni.ADD")
+		root.SetAttribute("cni.container_id", "abc")
+		tracing.Start("veth").End(nil)
+		tracing.Start("egress tc").End(errors.New("no such device"))
+		root.End(nil)
+		Expect(tracing.Flush()).To(Succeed())
+
+		Expect(body).To(ContainSubstring(`"name":"cni.ADD"`))
+		Expect(body).To(ContainSubstring(`"name":"veth"`))
+		Expect(body).To(ContainSubstring(`"status":{"code":2,"message":"no such device"}`))
+		Expect(body).To(ContainSubstring(`"stringValue":"abc"`))
+	})
+
+	It("reports collector errors", func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusBadRequest)
+		}))
+		defer server.Close()
+
+		tracing.Init(server.URL, "test", "cni.DEL").End(nil)
+		Expect(tracing.Flush()).To(HaveOccurred())
+	})
+})
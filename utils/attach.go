@@ -0,0 +1,273 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/projectcalico/cni-plugin/internal/util"
+	"github.com/projectcalico/cni-plugin/sysctl"
+	"github.com/projectcalico/cni-plugin/tracing"
+	"github.com/vishvananda/netlink"
+)
+
+// Values of NetConf.Mode.
+const (
+	ModePTP     = "ptp"
+	ModeBridge  = "bridge"
+	ModeIPVLAN  = "ipvlan"
+	ModeMACVLAN = "macvlan"
+)
+
+// DefaultBridge is the bridge of the bridge mode when NetConf.Bridge isn't set.
+const DefaultBridge = "cni-fc0"
+
+// attachmentMode returns the mode conf attaches containers with.
+func attachmentMode(conf NetConf) string {
+	if conf.Mode == "" {
+		return ModePTP
+	}
+	return conf.Mode
+}
+
+// slaveMode reports whether mode attaches containers with a slave device of the master rather than a veth. The
+// device has no end in the host namespace to shape, so pods are shaped on the master with the nic shaping mode;
+// traffic between pods of the same master never goes through it, and isn't shaped.
+func slaveMode(mode string) bool {
+	return mode == ModeIPVLAN || mode == ModeMACVLAN
+}
+
+// bridgeName returns the bridge of the bridge mode.
+func bridgeName(conf NetConf) string {
+	if conf.Bridge == "" {
+		return DefaultBridge
+	}
+	return conf.Bridge
+}
+
+// programHostRoutes reports whether the host gets routes to the addresses of pods through their host veth, which
+// only the ptp mode routes through.
+func programHostRoutes(conf NetConf) bool {
+	return attachmentMode(conf) == ModePTP && (conf.ProgramHostRoutes == nil || *conf.ProgramHostRoutes)
+}
+
+// resolveMode checks the attachment mode of conf and the options it is combined with, and returns conf with what
+// the slave modes imply filled in: the master, which defaults to the uplink, is also the interface pods are shaped
+// on with the nic shaping mode.
+func resolveMode(conf NetConf) (NetConf, error) {
+	mode := attachmentMode(conf)
+	switch mode {
+	case ModePTP, ModeBridge, ModeIPVLAN, ModeMACVLAN:
+	default:
+		return conf, fmt.Errorf("unknown mode %q, must be %q, %q, %q or %q", mode, ModePTP, ModeBridge, ModeIPVLAN,
+			ModeMACVLAN)
+	}
+	switch {
+	case mode != ModePTP && conf.CalicoCompat:
+		return conf, fmt.Errorf("mode %q isn't supported in compatibility mode", mode)
+	case conf.Bridge != "" && mode != ModeBridge:
+		return conf, fmt.Errorf("bridge only applies to the %s mode", ModeBridge)
+	case conf.Master != "" && !slaveMode(mode):
+		return conf, fmt.Errorf("master only applies to the %s and %s modes", ModeIPVLAN, ModeMACVLAN)
+	case mode == ModeBridge:
+		return conf, checkIfName(bridgeName(conf))
+	case !slaveMode(mode):
+		return conf, nil
+	}
+
+	// Everything set up on the host veth has nowhere to go without one.
+	switch {
+	case conf.ShapingMode != "" && conf.ShapingMode != ShapingModeNIC:
+		return conf, fmt.Errorf("mode %q shapes pods on the master and needs the %s shaping mode", mode, ShapingModeNIC)
+	case conf.Master != "" && conf.NICName != "" && conf.Master != conf.NICName:
+		return conf, fmt.Errorf("master and nicName must be the same interface in mode %q", mode)
+	case conf.NICOverflow == NICOverflowVeth:
+		return conf, fmt.Errorf("nicOverflow %q isn't supported in mode %q, which has no host veth", NICOverflowVeth, mode)
+	case conf.LowRatePolicy == LowRatePolicyPolice:
+		return conf, fmt.Errorf("lowRatePolicy %q isn't supported in mode %q, which has no host veth", LowRatePolicyPolice,
+			mode)
+	case conf.ConntrackMark:
+		return conf, fmt.Errorf("conntrackMark isn't supported in mode %q, which has no host veth", mode)
+	case conf.MaxPPS != 0 || conf.MaxConnections != 0:
+		return conf, fmt.Errorf("max_pps and max_connections aren't supported in mode %q, which has no host veth", mode)
+	case conf.HostVethMAC:
+		return conf, fmt.Errorf("hostVethMAC isn't supported in mode %q, which has no host veth", mode)
+	}
+	if conf.Master == "" {
+		master, err := uplinkName(conf)
+		if err != nil {
+			return conf, fmt.Errorf("failed to find the master of mode %q: %v", mode, err)
+		}
+		conf.Master = master
+	}
+	conf.NICName = conf.Master
+	conf.ShapingMode = ShapingModeNIC
+	// Policing with nftables also matches on the host veth.
+	fallback := false
+	conf.NFTablesFallback = &fallback
+	return conf, nil
+}
+
+// ipamGateway returns the gateway IPAM gave with addr, which containers sharing a segment with it route through.
+func ipamGateway(addr *current.IPConfig) (net.IP, error) {
+	if addr.Gateway == nil {
+		return nil, fmt.Errorf("IPAM returned no gateway for %v, which the container routes through", addr.Address.String())
+	}
+	return addr.Gateway, nil
+}
+
+// attachToBridge makes the host veth a port of the bridge of conf, creating the bridge if it is missing. The
+// bridge is set up with the IPAM gateways of result, for the host to be the gateway of the containers on it, and
+// forwards their traffic. The bridge is shared by the containers of the node, so it is left behind on teardown.
+func attachToBridge(hostVeth netlink.Link, conf NetConf, result *current.Result) error {
+	name := bridgeName(conf)
+	bridge, err := netlink.LinkByName(name)
+	if err != nil {
+		br := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: name, MTU: conf.MTU}}
+		// Another ADD may create it first.
+		err = countNetlink("LinkAdd", func() error { return netlink.LinkAdd(br) })
+		if err != nil && err != syscall.EEXIST {
+			return fmt.Errorf("failed to create bridge %q: %v", name, err)
+		}
+		if bridge, err = netlink.LinkByName(name); err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", name, err)
+		}
+	}
+	if _, ok := bridge.(*netlink.Bridge); !ok {
+		return fmt.Errorf("%q is a %s device, not a bridge", name, bridge.Type())
+	}
+	if err = countNetlink("LinkSetUp", func() error { return netlink.LinkSetUp(bridge) }); err != nil {
+		return fmt.Errorf("failed to set %q up: %v", name, err)
+	}
+
+	b := &sysctl.Batch{}
+	for _, addr := range result.IPs {
+		gw, err := ipamGateway(addr)
+		if err != nil {
+			return err
+		}
+		gwNet := &net.IPNet{IP: gw, Mask: addr.Address.Mask}
+		// The containers of the bridge share their gateways, so it may already be there.
+		err = countNetlink("AddrAdd", func() error { return netlink.AddrAdd(bridge, &netlink.Addr{IPNet: gwNet}) })
+		if err != nil && err != syscall.EEXIST {
+			return fmt.Errorf("failed to add gateway %v to %q: %v", gwNet, name, err)
+		}
+		if gw.To4() != nil {
+			b.Set("net.ipv4.conf.IFNAME.forwarding", "1")
+		} else {
+			b.Set("net.ipv6.conf.IFNAME.forwarding", "1")
+		}
+	}
+	if conf.ManageSysctls == nil || *conf.ManageSysctls {
+		if err = b.Apply(name); err != nil {
+			return fmt.Errorf("error configuring sysctls for bridge: %s, error: %s", name, err)
+		}
+	}
+
+	if err = countNetlink("LinkSetMaster", func() error {
+		return netlink.LinkSetMaster(hostVeth, bridge.(*netlink.Bridge))
+	}); err != nil {
+		return fmt.Errorf("failed to add %q to bridge %q: %v", hostVeth.Attrs().Name, name, err)
+	}
+	return nil
+}
+
+// slaveTempName is the name the slave device of a container is created with, before it is renamed in the
+// container, as its interface name may be taken in the host namespace.
+func slaveTempName(containerID string) string {
+	return util.TruncateIfName("fcs" + containerID)
+}
+
+// doSlaveNetworking attaches a container with a slave device of conf.Master and shapes it on the master. The
+// device is deleted again if shaping fails.
+func doSlaveNetworking(args *skel.CmdArgs, conf NetConf, result *current.Result, rates ShapingRates, logger *log.Entry) (contMAC string, err error) {
+	container, err := setupSlave(args, conf, result, logger)
+	if err != nil {
+		return "", err
+	}
+	tx := newSetupTransaction(logger)
+	tx.created("container interface "+args.IfName, deleteLinkIn(args.Netns, args.IfName))
+	defer func() {
+		if err != nil {
+			tx.rollback()
+		}
+	}()
+	if err = setupShaping(args, conf, result, nil, container, rates, logger); err != nil {
+		return "", err
+	}
+	return container.ContVethMAC, nil
+}
+
+// setupSlave creates the ipvlan or macvlan slave device of conf.Master for a container, moves it to the network
+// namespace at args.Netns as args.IfName, and configures it with the addresses and routes of result, which go
+// through the IPAM gateways. The device is deleted again if a step fails after it is created.
+func setupSlave(args *skel.CmdArgs, conf NetConf, result *current.Result, logger *log.Entry) (ContainerSideResult, error) {
+	var out ContainerSideResult
+	mode := attachmentMode(conf)
+	master, err := netlink.LinkByName(conf.Master)
+	if err != nil {
+		return out, fmt.Errorf("failed to lookup master %q: %v", conf.Master, err)
+	}
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return out, fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close()
+
+	tmpName := slaveTempName(args.ContainerID)
+	attrs := netlink.LinkAttrs{
+		Name:        tmpName,
+		MTU:         conf.MTU,
+		ParentIndex: master.Attrs().Index,
+		Namespace:   netlink.NsFd(int(netns.Fd())),
+	}
+	var slave netlink.Link = &netlink.Macvlan{LinkAttrs: attrs, Mode: netlink.MACVLAN_MODE_BRIDGE}
+	if mode == ModeIPVLAN {
+		slave = &netlink.IPVlan{LinkAttrs: attrs, Mode: netlink.IPVLAN_MODE_L2}
+	}
+
+	span := tracing.Start(mode)
+	err = countNetlink("LinkAdd", func() error { return netlink.LinkAdd(slave) })
+	if err != nil {
+		err = fmt.Errorf("failed to create %s device on %q: %v", mode, conf.Master, err)
+	} else {
+		err = netns.Do(func(ns.NetNS) (err error) {
+			name := tmpName
+			defer func() {
+				if err != nil {
+					deleteLinkNamed(name)()
+				}
+			}()
+			link, err := netlink.LinkByName(tmpName)
+			if err != nil {
+				return fmt.Errorf("failed to lookup %q: %v", tmpName, err)
+			}
+			if err = countNetlink("LinkSetName", func() error { return netlink.LinkSetName(link, args.IfName) }); err != nil {
+				if err == syscall.EEXIST {
+					return conflictError(fmt.Errorf("failed to rename %q to %q: %v", tmpName, args.IfName, err))
+				}
+				return fmt.Errorf("failed to rename %q to %q: %v", tmpName, args.IfName, err)
+			}
+			name = args.IfName
+			if link, err = netlink.LinkByName(name); err != nil {
+				return fmt.Errorf("failed to lookup %q: %v", name, err)
+			}
+			if err = countNetlink("LinkSetUp", func() error { return netlink.LinkSetUp(link) }); err != nil {
+				return fmt.Errorf("failed to set %q up: %v", name, err)
+			}
+			out.ContVethMAC = link.Attrs().HardwareAddr.String()
+			return configureContainerLink(link, nil, result, conf.DefaultRoute == nil || *conf.DefaultRoute, true, &out,
+				logger)
+		})
+	}
+	span.End(err)
+	if err != nil {
+		logger.Errorf("Error creating %s device: %s", mode, err)
+		return ContainerSideResult{}, err
+	}
+	return out, nil
+}
@@ -0,0 +1,25 @@
+package utils
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/cni-plugin/metrics"
+	"github.com/projectcalico/cni-plugin/state"
+)
+
+var auditFailures = metrics.NewCounter("flowcontrol_audit_failures_total",
+	"Changes to the shaping of pods that couldn't be written to the audit log.")
+
+// AuditRecord writes the change action, made by trigger, to the shaping recorded in r, or to that of the node as a
+// whole if r is nil, to the audit log of the state directory of store. Failing to write it doesn't fail the change,
+// which has already been made.
+func AuditRecord(store *state.Store, r *state.Record, action, trigger, detail string, logger *log.Entry) {
+	e := &state.AuditEntry{Action: action, Trigger: trigger, Detail: detail}
+	if r != nil {
+		e.ContainerID, e.Workload = r.ContainerID, r.Workload
+		e.IngressRate, e.EgressRate = r.IngressRate, r.EgressRate
+	}
+	if err := state.NewAuditLog(store.Dir).Append(e); err != nil {
+		auditFailures.Inc()
+		logger.WithError(err).Warn("Failed to write audit log")
+	}
+}
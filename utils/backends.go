@@ -0,0 +1,144 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/cni-plugin/state"
+)
+
+// Shaping backends: how the rates of a pod are enforced. "htb" builds HTB classes, on the pod's veth or on the
+// uplink, "tbf" attaches TBF qdiscs to the pod's veth, "police" drops packets over the packet rate of rates too low
+// for HTB (lowRatePolicy "police"), "ebpf" paces and polices the pod's veth with BPF programs (backend "ebpf"),
+// and "nftables" polices every rate of the pod with nftables (shapingMode "nftables").
+const (
+	BackendHTB      = "htb"
+	BackendTBF      = "tbf"
+	BackendPolice   = "police"
+	BackendEBPF     = "ebpf"
+	BackendNFTables = "nftables"
+)
+
+// Features a backend may support.
+const (
+	// FeatureCeil is borrowing above the rate, up to a ceil.
+	FeatureCeil = "ceil"
+	// FeaturePriorities is serving the classes of a pod, or pods, in priority order.
+	FeaturePriorities = "priorities"
+	// FeatureProtocolSplit is guaranteeing shares of a pod's rate to its TCP and UDP traffic.
+	FeatureProtocolSplit = "protocol-split"
+	// FeaturePerPortRules is shaping the traffic of some ports of a pod apart from the rest.
+	FeaturePerPortRules = "per-port-rules"
+	// FeatureDSCP is classifying traffic by its DSCP.
+	FeatureDSCP = "dscp"
+	// FeatureDSCPMarking is marking the traffic of a pod, or its classes, with a DSCP.
+	FeatureDSCPMarking = "dscp-marking"
+	// FeatureIPv6 is shaping IPv6 traffic.
+	FeatureIPv6 = "ipv6"
+)
+
+// backendFeatures are the features each backend implements, whatever the kernel.
+var backendFeatures = map[string][]string{
+	BackendHTB:      {FeatureCeil, FeaturePriorities, FeatureProtocolSplit, FeaturePerPortRules, FeatureDSCPMarking, FeatureIPv6},
+	BackendTBF:      {FeatureIPv6},
+	BackendPolice:   {FeatureIPv6},
+	BackendEBPF:     {FeatureIPv6},
+	BackendNFTables: {FeatureIPv6},
+}
+
+// backendOrder is the order GetBackendCapabilities reports backends in.
+var backendOrder = []string{BackendHTB, BackendTBF, BackendPolice, BackendEBPF, BackendNFTables}
+
+// BackendCapabilities are the features of a shaping backend on the current node.
+type BackendCapabilities struct {
+	Backend string `json:"backend"`
+	// Available is false if the backend can't be used on the node, for Reason.
+	Available bool   `json:"available"`
+	Reason    string `json:"reason,omitempty"`
+	// Features tells for every feature whether the backend supports it on the node.
+	Features map[string]bool `json:"features"`
+}
+
+// GetBackendCapabilities returns the capability matrix of the shaping backends on the current kernel: the features
+// each implements, less those the kernel lacks. It probes the kernel as ProbeCapabilities does, caching the result
+// in store.
+func GetBackendCapabilities(store *state.Store, logger *log.Entry) ([]BackendCapabilities, error) {
+	caps, err := ProbeCapabilities(store, false, logger)
+	if err != nil {
+		return nil, err
+	}
+	_, err = os.Stat("/proc/sys/net/ipv6")
+	ipv6 := err == nil
+	_, err = exec.LookPath("nft")
+	nft := err == nil
+
+	var matrix []BackendCapabilities
+	for _, backend := range backendOrder {
+		c := BackendCapabilities{Backend: backend, Available: true, Features: map[string]bool{}}
+		switch {
+		case backend == BackendEBPF && !caps.EBPF:
+			c.Available, c.Reason = false, caps.EBPFError
+		case (backend == BackendHTB || backend == BackendTBF) && !caps.TCShaping:
+			c.Available, c.Reason = false, caps.TCShapingError
+		case (backend == BackendPolice || backend == BackendNFTables) && !nft:
+			c.Available, c.Reason = false, "nft(8) not found"
+		}
+		for _, feature := range []string{FeatureCeil, FeaturePriorities, FeatureProtocolSplit, FeaturePerPortRules,
+			FeatureDSCP, FeatureDSCPMarking, FeatureIPv6} {
+			c.Features[feature] = false
+		}
+		for _, feature := range backendFeatures[backend] {
+			c.Features[feature] = c.Available && (feature != FeatureIPv6 || ipv6)
+		}
+		matrix = append(matrix, c)
+	}
+	return matrix, nil
+}
+
+// backendOf returns the backend that shapes the pods configured by conf, unless their rates are too low for it.
+func backendOf(conf NetConf) string {
+	switch {
+	case conf.ShapingMode == ShapingModeNFTables:
+		return BackendNFTables
+	case conf.Backend == BackendEBPF:
+		return BackendEBPF
+	case conf.Shaper == QdiscTBF:
+		return BackendTBF
+	}
+	return BackendHTB
+}
+
+// checkBackendFeatures checks that the backend of conf implements the features its options need.
+func checkBackendFeatures(conf NetConf) error {
+	backend := backendOf(conf)
+	for _, need := range []struct {
+		feature, option string
+		set             bool
+	}{
+		{FeatureCeil, "cbuffer", conf.Cbuffer != 0},
+		{FeatureCeil, "ingress_ceil", conf.IngressCeil != ""},
+		{FeatureCeil, "egress_ceil", conf.EgressCeil != ""},
+		{FeaturePriorities, "latencyClass", conf.LatencyClass != ""},
+		{FeatureProtocolSplit, "protocolSplit", conf.ProtocolSplit != nil},
+		{FeaturePerPortRules, "classes", len(conf.Classes) != 0},
+		{FeaturePerPortRules, "cluster_cidrs", peersSet(conf)},
+		{FeatureDSCPMarking, "dscp", conf.DSCP != nil},
+	} {
+		if need.set && !backendSupports(backend, need.feature) {
+			return fmt.Errorf("backend %s doesn't support %s, needed by %s", backend, need.feature, need.option)
+		}
+	}
+	return nil
+}
+
+// backendSupports reports whether backend implements feature.
+func backendSupports(backend, feature string) bool {
+	for _, f := range backendFeatures[backend] {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
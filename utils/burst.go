@@ -0,0 +1,94 @@
+package utils
+
+import (
+	"fmt"
+
+	"github.com/projectcalico/cni-plugin/shaping"
+	"github.com/projectcalico/cni-plugin/state"
+)
+
+// maxBurst bounds the burst sizes, in bytes, that can be configured. Beyond it a pod could send for seconds above
+// its rate after being idle.
+const maxBurst = 64 << 20
+
+// Bursts are the burst sizes, in bytes, of the veth shaping of a pod: how much each direction may send back to back
+// before its rate applies, and how much the HTB classes may send back to back above their rate, up to their ceil.
+// Zero leaves a size to its default: hostVethClassBuffer for ingress, ifbClassBuffer for egress and, for Cbuffer, the
+// kernel's, one timer tick at the ceil.
+type Bursts struct {
+	Ingress uint32
+	Egress  uint32
+	Cbuffer uint32
+}
+
+// htbBuffer is the buffer and cbuffer of an HTB class, in bytes, where zero leaves them to the kernel.
+type htbBuffer struct {
+	buffer, cbuffer uint32
+}
+
+// nicClassBuffer returns the buffers of the class of a pod of rate bits per second on the uplink, which bursts don't
+// apply to.
+func nicClassBuffer(rate uint64) htbBuffer {
+	return Bursts{}.ingress(rate)
+}
+
+// burstsOf returns the bursts configured by conf.
+func burstsOf(conf NetConf) Bursts {
+	return Bursts{Ingress: conf.IngressBurst, Egress: conf.EgressBurst, Cbuffer: conf.Cbuffer}
+}
+
+// BurstsOf returns the bursts recorded for a pod.
+func BurstsOf(r *state.Record) Bursts {
+	return Bursts{Ingress: r.IngressBurst, Egress: r.EgressBurst, Cbuffer: r.Cbuffer}
+}
+
+// ingress returns the buffers of the ingress classes of rate bits per second, on the host veth.
+func (b Bursts) ingress(rate uint64) htbBuffer {
+	return b.buffers(b.Ingress, hostVethClassBuffer, rate)
+}
+
+// egress returns the buffers of the egress classes of rate bits per second, on the IFB device.
+func (b Bursts) egress(rate uint64) htbBuffer {
+	return b.buffers(b.Egress, ifbClassBuffer, rate)
+}
+
+// buffers returns the buffers of a class of rate bits per second with the given burst, or def if it is zero.
+// Classes in high-rate mode default to no less than a buffer scaled to their rate, and to a cbuffer of their buffer
+// rather than a tick at their ceil, which is a few bytes at such rates.
+func (b Bursts) buffers(burst, def uint32, rate uint64) htbBuffer {
+	highRate := rate >= shaping.HighRate
+	if highRate && shaping.HighRateBuffer(rate) > def {
+		def = shaping.HighRateBuffer(rate)
+	}
+	buffer := htbBuffer{burst, b.Cbuffer}
+	if burst == 0 {
+		buffer.buffer = def
+	}
+	if highRate && buffer.cbuffer == 0 {
+		buffer.cbuffer = buffer.buffer
+	}
+	return buffer
+}
+
+// checkBursts validates the burst options of conf. A burst must hold at least a packet of the pod's MTU, or HTB
+// and TBF can't send it at all.
+func checkBursts(conf NetConf) error {
+	mtu := conf.MTU
+	if mtu == 0 {
+		mtu = defaultMTU
+	}
+	for _, burst := range []struct {
+		name  string
+		value uint32
+	}{
+		{"ingress_burst", conf.IngressBurst},
+		{"egress_burst", conf.EgressBurst},
+		{"cbuffer", conf.Cbuffer},
+	} {
+		if burst.value != 0 && (burst.value < uint32(mtu) || burst.value > maxBurst) {
+			return fmt.Errorf("%s %d is out of range, must be between the MTU (%d) and %d bytes", burst.name,
+				burst.value, mtu, maxBurst)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/projectcalico/cni-plugin/internal/nlconst"
+	"github.com/vishvananda/netlink"
+)
+
+// DefaultCaptureSnaplen is how many bytes of each packet are captured by default, enough for any header.
+const DefaultCaptureSnaplen = 262144
+
+// captureReadTimeout bounds how long a read from the capture socket blocks, so that the end of a capture is noticed.
+const captureReadTimeout = 200 * time.Millisecond
+
+// Capture is a packet capture on an interface, through a raw AF_PACKET socket bound to it.
+type Capture struct {
+	fd      int
+	snaplen uint32
+}
+
+// OpenCapture starts capturing the packets crossing the interface ifName in either direction. filter is a pcap
+// filter expression such as "port 443", compiled with tcpdump; all packets are captured if it is empty. Only the
+// first snaplen bytes of each packet are kept.
+func OpenCapture(ifName, filter string, snaplen uint32) (*Capture, error) {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+	var program []syscall.SockFilter
+	if filter != "" {
+		if program, err = compileFilter(ifName, filter); err != nil {
+			return nil, err
+		}
+	}
+
+	// The socket receives nothing until it is bound, so that no packet gets through before the filter is attached.
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open packet socket: %v", err)
+	}
+	c := &Capture{fd: fd, snaplen: snaplen}
+	if program != nil {
+		if err = syscall.AttachLsf(fd, program); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("failed to attach capture filter: %v", err)
+		}
+	}
+	tv := syscall.NsecToTimeval(captureReadTimeout.Nanoseconds())
+	if err = syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("failed to set capture read timeout: %v", err)
+	}
+	addr := &syscall.SockaddrLinklayer{Protocol: nlconst.Htons(nlconst.ProtoAll), Ifindex: link.Attrs().Index}
+	if err = syscall.Bind(fd, addr); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("failed to bind packet socket to %q: %v", ifName, err)
+	}
+	return c, nil
+}
+
+// compileFilter compiles a pcap filter expression into a classic BPF program for the link type of ifName.
+func compileFilter(ifName, filter string) ([]syscall.SockFilter, error) {
+	out, err := exec.Command("tcpdump", "-i", ifName, "-ddd", filter).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("invalid capture filter %q: %v: %s", filter, err, bytes.TrimSpace(out))
+	}
+	// -ddd prints the number of instructions, then one "code jt jf k" line per instruction.
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	var program []syscall.SockFilter
+	for first := true; scanner.Scan(); first = false {
+		fields := strings.Fields(scanner.Text())
+		if first && len(fields) == 1 {
+			continue
+		}
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("unexpected tcpdump output compiling %q: %q", filter, scanner.Text())
+		}
+		var v [4]uint64
+		for i, f := range fields {
+			if v[i], err = strconv.ParseUint(f, 10, 32); err != nil {
+				return nil, fmt.Errorf("unexpected tcpdump output compiling %q: %q", filter, scanner.Text())
+			}
+		}
+		program = append(program, syscall.SockFilter{Code: uint16(v[0]), Jt: uint8(v[1]), Jf: uint8(v[2]), K: uint32(v[3])})
+	}
+	return program, nil
+}
+
+// WriteTo writes the captured packets to w in pcap format for duration, or until writing to w fails.
+func (c *Capture) WriteTo(w io.Writer, duration time.Duration) error {
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], c.snaplen)
+	// LINKTYPE_ETHERNET; host veths are Ethernet devices.
+	binary.LittleEndian.PutUint32(header[20:], 1)
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	buf := make([]byte, c.snaplen)
+	record := make([]byte, 16)
+	deadline := time.Now().Add(duration)
+	for time.Now().Before(deadline) {
+		// MSG_TRUNC makes recvfrom return the length of the packet rather than what fit in buf.
+		n, _, err := syscall.Recvfrom(c.fd, buf, syscall.MSG_TRUNC)
+		if err == syscall.EAGAIN || err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to read packet: %v", err)
+		}
+		captured := n
+		if captured > len(buf) {
+			captured = len(buf)
+		}
+		now := time.Now()
+		binary.LittleEndian.PutUint32(record[0:], uint32(now.Unix()))
+		binary.LittleEndian.PutUint32(record[4:], uint32(now.Nanosecond()/1000))
+		binary.LittleEndian.PutUint32(record[8:], uint32(captured))
+		binary.LittleEndian.PutUint32(record[12:], uint32(n))
+		if _, err = w.Write(record); err != nil {
+			return err
+		}
+		if _, err = w.Write(buf[:captured]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close stops the capture.
+func (c *Capture) Close() error {
+	return syscall.Close(c.fd)
+}
@@ -0,0 +1,130 @@
+package utils
+
+import (
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/cni-plugin/policy"
+	"github.com/projectcalico/cni-plugin/shaping"
+	"github.com/projectcalico/cni-plugin/state"
+)
+
+// The rate of a direction of a pod is what it is guaranteed, and its ceil, if above it, the most it may send by
+// borrowing what is left idle: on its veth, from a parent class of the ceil on its host veth or IFB device, which
+// the IPv4 and IPv6 classes and the leaf classes of the pod share; on the uplink, from the group classes of the
+// NIC hierarchy, shared with the other pods of the group.
+
+// checkCeils validates the ingress_rate, egress_rate, ingress_ceil and egress_ceil options: a configured rate must
+// not be above the ceil of its direction. Classes directly under the root qdisc of the uplink have nothing to borrow
+// from.
+func checkCeils(conf NetConf) error {
+	for _, d := range []struct{ direction, rate, ceil string }{
+		{"ingress", conf.IngressRate, conf.IngressCeil},
+		{"egress", conf.EgressRate, conf.EgressCeil},
+	} {
+		if d.rate == "" {
+			continue
+		}
+		rate, err := policy.ParseRate(d.rate)
+		if err != nil {
+			return fmt.Errorf("invalid %s_rate %q", d.direction, d.rate)
+		}
+		if d.ceil == "" {
+			continue
+		}
+		if ceil, err := policy.ParseRate(d.ceil); err == nil && ceil < rate {
+			return fmt.Errorf("%s_ceil %s is below %s_rate %s", d.direction, d.ceil, d.direction, d.rate)
+		}
+	}
+	if conf.IngressCeil == "" && conf.EgressCeil == "" {
+		return nil
+	}
+	if conf.ShapingMode == ShapingModeNIC && conf.NICHierarchy == nil {
+		return fmt.Errorf("ceils in the %s shaping mode need nicHierarchy, for classes to borrow from", ShapingModeNIC)
+	}
+	return nil
+}
+
+// parseCeil parses the ceil of direction, whose rate is rate. It returns 0 if the direction has no ceil above its
+// rate; an unlimited direction has nothing to borrow above.
+func parseCeil(direction, value string, rate uint64, logger *log.Entry) (uint64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	ceil, err := policy.ParseRate(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s ceil %q", direction, value)
+	}
+	if rate == 0 {
+		logger.Infof("Ignoring %s ceil of a direction without a rate", direction)
+		return 0, nil
+	}
+	if ceil < rate {
+		return 0, fmt.Errorf("%s ceil %s is below the rate of %d bit/s", direction, value, rate)
+	}
+	if ceil == rate {
+		return 0, nil
+	}
+	return ceil, nil
+}
+
+// configuredRates returns the bandwidths ingress and egress, with the ingress_rate and egress_rate of conf in place
+// of those that are empty.
+func configuredRates(conf NetConf, ingress, egress string) (string, string) {
+	if ingress == "" {
+		ingress = conf.IngressRate
+	}
+	if egress == "" {
+		egress = conf.EgressRate
+	}
+	return ingress, egress
+}
+
+// ceilOf returns the ceil of the classes of a direction of a pod set to rate, whose recorded rate and ceil are
+// recordedRate and recordedCeil: the recorded ceil while rate is the recorded rate, and the rate itself otherwise,
+// so that a throttle or pause replacing the rate replaces the ceil with it.
+func ceilOf(rate, recordedRate, recordedCeil uint64) uint64 {
+	if rate == recordedRate && recordedCeil > rate {
+		return recordedCeil
+	}
+	return rate
+}
+
+// CeilsOf returns the ceils of the classes of the pod of r set to ingressRate and egressRate.
+func CeilsOf(r *state.Record, ingressRate, egressRate uint64) (ingressCeil, egressCeil uint64) {
+	return ceilOf(ingressRate, r.IngressRate, r.IngressCeil), ceilOf(egressRate, r.EgressRate, r.EgressCeil)
+}
+
+// RelaxedLimits returns the rates and ceils the pod of r, set to ingressRate and egressRate, is relaxed to while it
+// is paused or the node is in maintenance: its classes keep their rates and borrow up to lineRate. Classes with
+// nothing to borrow from, under the root qdisc or shaped by TBF, BPF or nftables, are raised to lineRate instead.
+func RelaxedLimits(r *state.Record, ingressRate, egressRate, lineRate uint64) (ingress, egress, ingressCeil, egressCeil uint64) {
+	ingress, ingressCeil = relax(ingressRate, lineRate, borrows(r, r.IngressRate, r.IngressCeil))
+	egress, egressCeil = relax(egressRate, lineRate, borrows(r, r.EgressRate, r.EgressCeil))
+	return ingress, egress, ingressCeil, egressCeil
+}
+
+// borrows reports whether the classes of a direction of the pod of r, with the recorded rate and ceil, have a
+// parent class to borrow from.
+func borrows(r *state.Record, rate, ceil uint64) bool {
+	switch {
+	case r.ShapingMode == ShapingModeNFTables || r.Qdisc == QdiscTBF || r.Qdisc == QdiscEBPF || r.Qdisc == QdiscPolice:
+		return false
+	case r.ShapingMode == ShapingModeNIC:
+		return r.NICParentMinor != 0
+	default:
+		return shaping.ParentMinor(rate, ceil) != 0
+	}
+}
+
+// relax returns the rate and ceil of a class of rate relaxed to lineRate.
+func relax(rate, lineRate uint64, borrows bool) (uint64, uint64) {
+	switch {
+	case rate >= lineRate:
+		return rate, rate
+	case borrows:
+		return rate, lineRate
+	default:
+		return lineRate, lineRate
+	}
+}
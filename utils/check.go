@@ -0,0 +1,230 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/projectcalico/cni-plugin/state"
+	"github.com/projectcalico/cni-plugin/sysctl"
+	"github.com/projectcalico/cni-plugin/tracing"
+	"github.com/vishvananda/netlink"
+)
+
+// errCodeGeneric is the code of CNI errors without a more specific one, as skel reports them.
+const errCodeGeneric uint = 100
+
+// DriftError lists what no longer matches the networking ADD set up for a container.
+type DriftError struct {
+	ContainerID string
+	Problems    []string
+}
+
+func (e *DriftError) Error() string {
+	return fmt.Sprintf("networking of container %s has drifted: %s", e.ContainerID, strings.Join(e.Problems, "; "))
+}
+
+// CheckArgsFromEnv returns the arguments of a CHECK from the environment and stdin. The skel of the CNI release the
+// plugin is built with predates CHECK and only dispatches ADD and DEL, so the plugin reads CHECK's itself.
+func CheckArgsFromEnv() (*skel.CmdArgs, error) {
+	args := &skel.CmdArgs{
+		ContainerID: os.Getenv("CNI_CONTAINERID"),
+		Netns:       os.Getenv("CNI_NETNS"),
+		IfName:      os.Getenv("CNI_IFNAME"),
+		Args:        os.Getenv("CNI_ARGS"),
+		Path:        os.Getenv("CNI_PATH"),
+	}
+	for _, v := range []struct{ name, value string }{
+		{"CNI_CONTAINERID", args.ContainerID},
+		{"CNI_NETNS", args.Netns},
+		{"CNI_IFNAME", args.IfName},
+		{"CNI_PATH", args.Path},
+	} {
+		if v.value == "" {
+			return nil, fmt.Errorf("required env variable %s missing", v.name)
+		}
+	}
+	data, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return nil, fmt.Errorf("error reading from stdin: %v", err)
+	}
+	args.StdinData = data
+	return args, nil
+}
+
+// PrintError writes err to stdout as the CNI error runtimes expect from a failed command.
+func PrintError(err error) error {
+	e, ok := CNIError(err).(*types.Error)
+	if !ok {
+		e = &types.Error{Code: errCodeGeneric, Msg: err.Error()}
+	}
+	return e.Print()
+}
+
+// CheckContainer verifies that what ADD set up for a container is still in place: its interface in the container,
+// its host veth and whether it is up, the host routes to the addresses of prevResult, the sysctls of the host
+// veth unless manageSysctls is false, and the qdiscs, classes, rates and redirect filters of its shaping record. Anything that drifted is
+// returned in a *DriftError, so that the runtime can recreate the container. Only the interfaces and routes are
+// checked in compatibility mode, which keeps no record.
+func CheckContainer(args *skel.CmdArgs, conf NetConf) error {
+	var netConf struct {
+		PrevResult *current.Result `json:"prevResult"`
+	}
+	if err := json.Unmarshal(args.StdinData, &netConf); err != nil {
+		return fmt.Errorf("failed to parse prevResult: %v", err)
+	}
+	if netConf.PrevResult == nil {
+		return fmt.Errorf("CHECK needs the prevResult of ADD in the network configuration")
+	}
+	if err := checkManagedSysctls(conf); err != nil {
+		return invalidConfigError(err)
+	}
+
+	var problems []string
+	span := tracing.Start("container")
+	err := ns.WithNetNSPath(args.Netns, func(ns.NetNS) error {
+		if _, err := netlink.LinkByName(args.IfName); err != nil {
+			problems = append(problems, fmt.Sprintf("interface %s missing in the container", args.IfName))
+		}
+		return nil
+	})
+	span.End(err)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("network namespace %s missing", args.Netns))
+	}
+	err = withHostNetNS(conf.HostNetNS, func() error {
+		hostProblems, err := checkHost(args, conf, netConf.PrevResult)
+		problems = append(problems, hostProblems...)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return &DriftError{ContainerID: args.ContainerID, Problems: problems}
+	}
+	return nil
+}
+
+// checkHost returns what drifted in the host network namespace for a container.
+func checkHost(args *skel.CmdArgs, conf NetConf, result *current.Result) ([]string, error) {
+	r, hostVethName, _, err := containerDevices(state.NewStore(conf.StateDir), args, conf)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil && !conf.CalicoCompat {
+		return []string{"shaping record missing"}, nil
+	}
+	if r != nil && (r.HostNetwork || slaveMode(r.Attachment)) {
+		return verifyTraced(r), nil
+	}
+	if hostVethName == "" {
+		return nil, fmt.Errorf("can't name the host veth of container %s without its shaping record", args.ContainerID)
+	}
+
+	span := tracing.Start("veth")
+	hostVeth, err := netlink.LinkByName(hostVethName)
+	span.End(err)
+	if err != nil {
+		return []string{fmt.Sprintf("host veth %s missing", hostVethName)}, nil
+	}
+	var problems []string
+	if hostVeth.Attrs().Flags&net.FlagUp == 0 {
+		problems = append(problems, fmt.Sprintf("host veth %s is down", hostVethName))
+	}
+	if programHostRoutes(conf) {
+		span := tracing.Start("routes")
+		problems = append(problems, checkHostRoutes(hostVeth, result)...)
+		span.End(nil)
+	}
+	if attachmentMode(conf) == ModeBridge {
+		span := tracing.Start("bridge")
+		problems = append(problems, checkBridgePort(hostVeth, bridgeName(conf))...)
+		span.End(nil)
+	}
+
+	// Sysctls left alone by ADD are whatever the node set, so there is nothing to compare them with.
+	if conf.ManageSysctls == nil || *conf.ManageSysctls {
+		var hasIPv4, hasIPv6 bool
+		for _, addr := range result.IPs {
+			hasIPv4 = hasIPv4 || addr.Address.IP.To4() != nil
+			hasIPv6 = hasIPv6 || addr.Address.IP.To4() == nil
+		}
+		b, err := hostVethSysctls(hasIPv4, hasIPv6, conf)
+		if err != nil {
+			return nil, err
+		}
+		span := tracing.Start("sysctls")
+		err = b.Verify(hostVethName)
+		span.End(err)
+		if err != nil {
+			e, ok := err.(*sysctl.Error)
+			if !ok {
+				return nil, err
+			}
+			for _, f := range e.Failed {
+				problems = append(problems, fmt.Sprintf("sysctl %s of %s: %v", f.Key, hostVethName, f.Err))
+			}
+		}
+	}
+
+	if r != nil {
+		problems = append(problems, verifyTraced(r)...)
+	}
+	return problems, nil
+}
+
+// verifyTraced returns what VerifyShaping finds wrong with the shaping of r, in a span of the trace of CHECK.
+func verifyTraced(r *state.Record) []string {
+	span := tracing.Start("verify")
+	problems := VerifyShaping(r)
+	var err error
+	if len(problems) != 0 {
+		err = fmt.Errorf("shaping doesn't match what was programmed: %s", strings.Join(problems, "; "))
+	}
+	span.End(err)
+	return problems
+}
+
+// checkBridgePort returns the problem of the host veth not being a port of bridge, if it isn't.
+func checkBridgePort(hostVeth netlink.Link, bridge string) []string {
+	name := hostVeth.Attrs().Name
+	br, err := netlink.LinkByName(bridge)
+	if err != nil {
+		return []string{fmt.Sprintf("bridge %s missing", bridge)}
+	}
+	if hostVeth.Attrs().MasterIndex != br.Attrs().Index {
+		return []string{fmt.Sprintf("host veth %s isn't a port of bridge %s", name, bridge)}
+	}
+	return nil
+}
+
+// checkHostRoutes returns the addresses of result that no route through the host veth leads to.
+func checkHostRoutes(hostVeth netlink.Link, result *current.Result) []string {
+	name := hostVeth.Attrs().Name
+	routes, err := netlink.RouteList(hostVeth, netlink.FAMILY_ALL)
+	if err != nil {
+		return []string{fmt.Sprintf("failed to list routes of %s: %v", name, err)}
+	}
+	var problems []string
+	for _, addr := range result.IPs {
+		found := false
+		for _, route := range routes {
+			if route.Dst != nil && route.Dst.Contains(addr.Address.IP) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			problems = append(problems, fmt.Sprintf("route to %s through %s missing", addr.Address.IP, name))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,543 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/projectcalico/cni-plugin/policy"
+	"github.com/projectcalico/cni-plugin/shaping"
+	"github.com/projectcalico/cni-plugin/state"
+	"github.com/vishvananda/netlink"
+)
+
+// TrafficClass shapes the traffic of a pod in a direction that matches it apart from the rest, in a leaf class of
+// its own under the pod's class. Traffic matches it if it matches every part of the match that is set; the first
+// class matching it wins.
+type TrafficClass struct {
+	// Name identifies the class in errors and logs.
+	Name string `json:"name"`
+	// Direction is "egress" (default) or "ingress", from the point of view of the pod.
+	Direction string `json:"direction,omitempty"`
+	// Dst and Src are CIDRs the destination and source addresses must be in.
+	Dst string `json:"dst,omitempty"`
+	Src string `json:"src,omitempty"`
+	// Protocol is "tcp" or "udp", and Ports a port, e.g. "5432", or range, e.g. "8000-8080", the destination port
+	// must be in. Ports needs a protocol, and only matches packets without IP options or IPv6 extension headers.
+	Protocol string `json:"protocol,omitempty"`
+	Ports    string `json:"ports,omitempty"`
+	// Mark, with the fwmark classifier, is the firewall mark traffic matches the class by, in place of the rest of
+	// the match, as set by iptables rules. Only ingress classes can match a mark: egress traffic is shaped before
+	// the host's firewall sees it.
+	Mark uint32 `json:"mark,omitempty"`
+	// Rate is guaranteed to the class, and it borrows what the rest of the pod's traffic leaves idle up to Ceil, by
+	// default its rate. Both are bandwidths like the annotations, capped at the rate and ceil of the direction.
+	Rate string `json:"rate"`
+	Ceil string `json:"ceil,omitempty"`
+	// DSCP, if set, is marked on the traffic of an egress class in place of the DSCP of the pod.
+	DSCP *uint8 `json:"dscp,omitempty"`
+	// Prio, from 0 to 7, is the HTB priority of the class in place of that of the pod: the classes of the pod with
+	// the lowest one borrow what is left idle first. Quantum is how many bytes the class sends in a round when it
+	// borrows next to others of the same priority, so that they share in proportion to it rather than to their
+	// rates. Cbuffer is how many bytes it may send back to back above its rate, in place of the cbuffer option.
+	Prio    *uint32 `json:"prio,omitempty"`
+	Quantum uint32  `json:"quantum,omitempty"`
+	Cbuffer uint32  `json:"cbuffer,omitempty"`
+}
+
+const (
+	// maxTrafficClasses bounds the classes of a direction. Leaf classes take minors like those of a protocol split,
+	// which they can't be combined with, after the pod's class.
+	maxTrafficClasses = 16
+
+	// The filters attached to a class with traffic classes: a pair of IPv4 and IPv6 priorities per class from
+	// classFilterPrio, in order, then a catch-all for the default class at classOtherPrio.
+	classFilterPrio = 1
+	classOtherPrio  = 2*maxTrafficClasses + 1
+)
+
+// trafficClassesOf parses and validates the classes option of conf.
+func trafficClassesOf(conf NetConf) ([]state.TrafficClass, error) {
+	var classes []state.TrafficClass
+	names := map[string]bool{}
+	perDirection := map[string]int{}
+	for _, c := range conf.Classes {
+		tc := state.TrafficClass{
+			Name:      c.Name,
+			Direction: c.Direction,
+			Dst:       c.Dst,
+			Src:       c.Src,
+			Protocol:  c.Protocol,
+			Ports:     c.Ports,
+			Mark:      c.Mark,
+			DSCP:      c.DSCP,
+			Prio:      c.Prio,
+			Quantum:   c.Quantum,
+			Cbuffer:   c.Cbuffer,
+		}
+		if tc.Name == "" {
+			return nil, fmt.Errorf("classes need a name")
+		}
+		if names[tc.Name] {
+			return nil, fmt.Errorf("class %q is defined twice", tc.Name)
+		}
+		names[tc.Name] = true
+		switch tc.Direction {
+		case "":
+			tc.Direction = "egress"
+		case "egress", "ingress":
+		default:
+			return nil, fmt.Errorf("class %q: unknown direction %q", tc.Name, tc.Direction)
+		}
+		if perDirection[tc.Direction]++; perDirection[tc.Direction] > maxTrafficClasses {
+			return nil, fmt.Errorf("at most %d classes can be defined per direction", maxTrafficClasses)
+		}
+		switch {
+		case tc.Mark != 0 && conf.Classifier != ClassifierFWMark:
+			return nil, fmt.Errorf("class %q: marks need the %s classifier", tc.Name, ClassifierFWMark)
+		case tc.Mark != 0 && tc.Direction != "ingress":
+			return nil, fmt.Errorf("class %q: only ingress classes can match a mark, egress traffic is shaped before "+
+				"the firewall marks it", tc.Name)
+		case tc.Mark != 0 && (tc.Dst != "" || tc.Src != "" || tc.Protocol != ""):
+			return nil, fmt.Errorf("class %q matches a mark, it can't also match a dst, src or protocol", tc.Name)
+		case tc.Mark == 0 && tc.Dst == "" && tc.Src == "" && tc.Protocol == "":
+			return nil, fmt.Errorf("class %q matches nothing, it needs a dst, src, protocol or mark", tc.Name)
+		}
+		if _, err := classFamily(tc); err != nil {
+			return nil, fmt.Errorf("class %q: %v", tc.Name, err)
+		}
+		switch tc.Protocol {
+		case "", "tcp", "udp":
+		default:
+			return nil, fmt.Errorf("class %q: unknown protocol %q, expected tcp or udp", tc.Name, tc.Protocol)
+		}
+		if tc.DSCP != nil && *tc.DSCP > shaping.MaxDSCP {
+			return nil, fmt.Errorf("class %q: dscp %d is above %d", tc.Name, *tc.DSCP, shaping.MaxDSCP)
+		}
+		if tc.DSCP != nil && tc.Direction == "ingress" {
+			return nil, fmt.Errorf("class %q: only egress classes can set a dscp", tc.Name)
+		}
+		if tc.Prio != nil && *tc.Prio > policy.MaxClassPriority {
+			return nil, fmt.Errorf("class %q: prio %d is above %d", tc.Name, *tc.Prio, policy.MaxClassPriority)
+		}
+		if err := checkClassSizes(tc, conf.MTU); err != nil {
+			return nil, err
+		}
+		if tc.Ports != "" {
+			if tc.Protocol == "" {
+				return nil, fmt.Errorf("class %q: ports need a protocol", tc.Name)
+			}
+			if _, _, err := parsePortRange(tc.Ports); err != nil {
+				return nil, fmt.Errorf("class %q: %v", tc.Name, err)
+			}
+		}
+		var err error
+		if tc.Rate, err = policy.ParseRate(c.Rate); err != nil || tc.Rate == 0 {
+			return nil, fmt.Errorf("class %q: invalid rate %q", tc.Name, c.Rate)
+		}
+		tc.Ceil = tc.Rate
+		if c.Ceil != "" {
+			if tc.Ceil, err = policy.ParseRate(c.Ceil); err != nil {
+				return nil, fmt.Errorf("class %q: invalid ceil %q", tc.Name, c.Ceil)
+			}
+			if tc.Ceil < tc.Rate {
+				return nil, fmt.Errorf("class %q: ceil %s is below its rate %s", tc.Name, c.Ceil, c.Rate)
+			}
+		}
+		classes = append(classes, tc)
+	}
+	peers, err := peerClasses(conf)
+	if err != nil {
+		return nil, err
+	}
+	for _, tc := range peers {
+		if perDirection[tc.Direction]++; perDirection[tc.Direction] > maxTrafficClasses {
+			return nil, fmt.Errorf("at most %d classes can be defined per direction, with those of cluster_cidrs",
+				maxTrafficClasses)
+		}
+	}
+	return append(classes, peers...), nil
+}
+
+// checkTrafficClasses validates the classes option.
+func checkTrafficClasses(conf NetConf) error {
+	if len(conf.Classes) == 0 {
+		return nil
+	}
+	switch {
+	case conf.ShapingMode == ShapingModeNIC || conf.ShapingMode == ShapingModeNFTables:
+		return fmt.Errorf("classes aren't supported by the %s shaping mode", conf.ShapingMode)
+	case conf.LatencyClass == LatencyClassLow:
+		return fmt.Errorf("classes can't be combined with latencyClass %q", LatencyClassLow)
+	case conf.ProtocolSplit != nil:
+		return fmt.Errorf("classes can't be combined with protocolSplit")
+	}
+	_, err := trafficClassesOf(conf)
+	return err
+}
+
+// checkClassSizes checks that the quantum and cbuffer of c, if set, hold a packet of mtu and are at most maxBurst.
+func checkClassSizes(c state.TrafficClass, mtu int) error {
+	if mtu <= 0 {
+		mtu = defaultMTU
+	}
+	for _, size := range []struct {
+		name  string
+		value uint32
+	}{{"quantum", c.Quantum}, {"cbuffer", c.Cbuffer}} {
+		if size.value != 0 && (size.value < uint32(mtu) || size.value > maxBurst) {
+			return fmt.Errorf("class %q: %s %d is out of range, must be between the MTU (%d) and %d bytes", c.Name,
+				size.name, size.value, mtu, maxBurst)
+		}
+	}
+	return nil
+}
+
+// classesIn returns the classes of direction.
+func classesIn(classes []state.TrafficClass, direction string) []state.TrafficClass {
+	var in []state.TrafficClass
+	for _, c := range classes {
+		if c.Direction == direction {
+			in = append(in, c)
+		}
+	}
+	return in
+}
+
+// parsePortRange parses a port or a range of ports.
+func parsePortRange(ports string) (lo, hi uint16, err error) {
+	parts := strings.SplitN(ports, "-", 2)
+	first, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid ports %q", ports)
+	}
+	last := first
+	if len(parts) == 2 {
+		if last, err = strconv.ParseUint(parts[1], 10, 16); err != nil || last < first {
+			return 0, 0, fmt.Errorf("invalid ports %q", ports)
+		}
+	}
+	return uint16(first), uint16(last), nil
+}
+
+// portBlocks covers the ports lo to hi with the fewest blocks of ports a value and mask match.
+func portBlocks(lo, hi uint16) (vals, masks []uint16) {
+	for v := uint32(lo); v <= uint32(hi); {
+		size := uint32(1 << 16)
+		if v != 0 {
+			size = v & -v
+		}
+		for v+size-1 > uint32(hi) {
+			size /= 2
+		}
+		vals = append(vals, uint16(v))
+		masks = append(masks, uint16(^(size - 1)))
+		v += size
+	}
+	return vals, masks
+}
+
+// classFamily returns the address family the dst and src CIDRs of c restrict it to, or 0 if it has none.
+func classFamily(c state.TrafficClass) (int, error) {
+	family := 0
+	for _, cidr := range []string{c.Dst, c.Src} {
+		if cidr == "" {
+			continue
+		}
+		f, err := cidrFamily(cidr)
+		if err != nil {
+			return 0, err
+		}
+		if family != 0 && family != f {
+			return 0, fmt.Errorf("dst and src are of different address families")
+		}
+		family = f
+	}
+	return family, nil
+}
+
+// cidrFamily returns the address family of cidr.
+func cidrFamily(cidr string) (int, error) {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return 0, fmt.Errorf("invalid CIDR %q", cidr)
+	}
+	if ipNet.IP.To4() != nil {
+		return netlink.FAMILY_V4, nil
+	}
+	return netlink.FAMILY_V6, nil
+}
+
+// cidrKeys returns the u32 keys matching the addresses in cidr, at offset off of the IP header.
+func cidrKeys(cidr string, off int32) []netlink.TcU32Key {
+	_, ipNet, _ := net.ParseCIDR(cidr)
+	ip, mask := ipNet.IP.To4(), net.IP(ipNet.Mask)
+	if ip == nil {
+		ip = ipNet.IP.To16()
+	}
+	var keys []netlink.TcU32Key
+	for i := 0; i < len(ip); i += 4 {
+		m := uint32(mask[i])<<24 | uint32(mask[i+1])<<16 | uint32(mask[i+2])<<8 | uint32(mask[i+3])
+		if m == 0 {
+			continue
+		}
+		v := uint32(ip[i])<<24 | uint32(ip[i+1])<<16 | uint32(ip[i+2])<<8 | uint32(ip[i+3])
+		keys = append(keys, netlink.TcU32Key{Mask: m, Val: v & m, Off: off + int32(i)})
+	}
+	return keys
+}
+
+// classKeys returns the sets of u32 keys matching the traffic of c of the IP family, one per peer of the family and
+// block of its ports.
+func classKeys(c state.TrafficClass, family int) [][]netlink.TcU32Key {
+	// Offsets in the IP header of the source and destination addresses, the protocol, and the ports, past a header
+	// without options or extension headers.
+	srcOff, dstOff, protoOff, portsOff := int32(12), int32(16), int32(8), int32(20)
+	protoMask, protoShift := uint32(0x00ff0000), uint(16)
+	if family == netlink.FAMILY_V6 {
+		srcOff, dstOff, protoOff, portsOff = 8, 24, 4, 40
+		protoMask, protoShift = 0x0000ff00, 8
+	}
+	var keys []netlink.TcU32Key
+	if c.Src != "" {
+		keys = append(keys, cidrKeys(c.Src, srcOff)...)
+	}
+	if c.Dst != "" {
+		keys = append(keys, cidrKeys(c.Dst, dstOff)...)
+	}
+	if c.Protocol != "" {
+		proto := uint32(syscall.IPPROTO_TCP)
+		if c.Protocol == "udp" {
+			proto = syscall.IPPROTO_UDP
+		}
+		keys = append(keys, netlink.TcU32Key{Mask: protoMask, Val: proto << protoShift, Off: protoOff})
+	}
+	if len(c.Peers) == 0 {
+		return portKeys(c, keys, portsOff)
+	}
+	peerOff := dstOff
+	if c.Direction == "ingress" {
+		peerOff = srcOff
+	}
+	var sets [][]netlink.TcU32Key
+	for _, peer := range c.Peers {
+		if f, _ := cidrFamily(peer); f == family {
+			sets = append(sets, portKeys(c, append(cidrKeys(peer, peerOff), keys...), portsOff)...)
+		}
+	}
+	return sets
+}
+
+// portKeys returns the sets of keys, plus a key matching a block of the ports of c at portsOff, or keys alone if c
+// has no ports.
+func portKeys(c state.TrafficClass, keys []netlink.TcU32Key, portsOff int32) [][]netlink.TcU32Key {
+	if len(keys) == 0 {
+		// A CIDR covering every address; u32 needs a key, and one with an empty mask matches everything.
+		keys = append(keys, netlink.TcU32Key{})
+	}
+	if c.Ports == "" {
+		return [][]netlink.TcU32Key{keys}
+	}
+	lo, hi, _ := parsePortRange(c.Ports)
+	vals, masks := portBlocks(lo, hi)
+	sets := make([][]netlink.TcU32Key, len(vals))
+	for i := range vals {
+		// The destination port is the second half of the first word of the TCP and UDP headers.
+		port := netlink.TcU32Key{Mask: uint32(masks[i]), Val: uint32(vals[i]), Off: portsOff}
+		sets[i] = append(append([]netlink.TcU32Key{}, keys...), port)
+	}
+	return sets
+}
+
+// classGeneration divides the classes of generation gen under the root qdisc major of linkName, whose rate and ceil
+// are rate and ceil, into a leaf class per traffic class and a default one, and attaches the filters classifying
+// into them. With separate family budgets, the IPv6 class is divided alike. Nothing is done without classes.
+func classGeneration(linkName string, major uint16, gen int, rate, ceil uint64, buffer htbBuffer, prio uint32, budget string,
+	classes []state.TrafficClass) error {
+	if len(classes) == 0 {
+		return nil
+	}
+	link, err := netlink.LinkByName(linkName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", linkName, err)
+	}
+	minors := []uint16{shaping.ClassMinor(gen)}
+	if budget == IPFamilyBudgetSeparate {
+		minors = append(minors, shaping.ClassMinor(shaping.IPv6Generation(gen)))
+	}
+	for _, minor := range minors {
+		if err := setClassRates(linkName, major, minor, rate, ceil, buffer, prio, classes); err != nil {
+			return err
+		}
+		if err := addClassFilters(link, major, minor, classes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// classRates returns the rates and ceils of the leaf classes for classes under a class of rate and ceil, the default
+// one last. A class without a rate, or else the default class, is guaranteed what the others leave of rate, but at
+// least a hundredth of it; the default class after one gets a hundredth.
+func classRates(classes []state.TrafficClass, rate, ceil uint64) (rates, ceils []uint64) {
+	left := rate
+	for _, c := range classes {
+		r := c.Rate
+		if r > rate {
+			r = rate
+		}
+		if left > r {
+			left -= r
+		} else {
+			left = 0
+		}
+	}
+	rest := func() uint64 {
+		r := left
+		if r < rate/100 {
+			r = rate / 100
+		}
+		left = 0
+		return r
+	}
+	for _, c := range classes {
+		r, classCeil := c.Rate, c.Ceil
+		if r > rate {
+			r = rate
+		}
+		if r == 0 {
+			r = rest()
+		}
+		if classCeil > ceil || classCeil == 0 {
+			classCeil = ceil
+		}
+		rates, ceils = append(rates, r), append(ceils, classCeil)
+	}
+	return append(rates, rest()), append(ceils, ceil)
+}
+
+// setClassRates adds or updates the leaf classes of classes under the class major:minor with rate and ceil on
+// linkName. Classes get prio, and the cbuffer of buffer, unless they set their own. Nothing is done without classes.
+func setClassRates(linkName string, major, minor uint16, rate, ceil uint64, buffer htbBuffer, prio uint32,
+	classes []state.TrafficClass) error {
+	if len(classes) == 0 {
+		return nil
+	}
+	// As with a protocol split, leaves borrow much of their traffic, so their cbuffer defaults to their buffer.
+	cbuffer := buffer.cbuffer
+	if cbuffer == 0 {
+		cbuffer = buffer.buffer
+	}
+	link, err := netlink.LinkByName(linkName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", linkName, err)
+	}
+	rates, ceils := classRates(classes, rate, ceil)
+	for i := range rates {
+		name, classPrio, classCbuffer, quantum := "default", prio, cbuffer, uint32(0)
+		if i < len(classes) {
+			c := classes[i]
+			name, quantum = c.Name, c.Quantum
+			if c.Prio != nil {
+				classPrio = *c.Prio
+			}
+			if c.Cbuffer != 0 {
+				classCbuffer = c.Cbuffer
+			}
+		}
+		class := netlink.NewHtbClass(netlink.ClassAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    netlink.MakeHandle(major, minor),
+			Handle:    netlink.MakeHandle(major, splitMinor(minor, i)),
+		}, netlink.HtbClassAttrs{
+			Rate:    rates[i],
+			Ceil:    ceils[i],
+			Buffer:  buffer.buffer,
+			Cbuffer: classCbuffer,
+			Prio:    classPrio,
+		})
+		if quantum != 0 {
+			class.Quantum = quantum
+		}
+		if err = shaping.ReplaceClass(class); err != nil {
+			return fmt.Errorf("failed to add class %q on %q: %v", name, linkName, err)
+		}
+	}
+	return nil
+}
+
+// addClassFilters attaches the filters classifying the traffic reaching the class major:minor of link into the leaf
+// classes of classes, and what matches none of them into the default one.
+func addClassFilters(link netlink.Link, major, minor uint16, classes []state.TrafficClass) error {
+	parent := netlink.MakeHandle(major, minor)
+	for i, c := range classes {
+		classID := netlink.MakeHandle(major, splitMinor(minor, i))
+		if c.Mark != 0 {
+			if err := addMarkFilter(link, parent, classFilterPrio+2*uint16(i), c.Mark, classID); err != nil {
+				return fmt.Errorf("failed to add filter of class %q on %q: %v", c.Name, link.Attrs().Name, err)
+			}
+			continue
+		}
+		family, _ := classFamily(c)
+		for j, f := range []struct {
+			family int
+			proto  uint16
+		}{{netlink.FAMILY_V4, syscall.ETH_P_IP}, {netlink.FAMILY_V6, syscall.ETH_P_IPV6}} {
+			if family != 0 && family != f.family {
+				continue
+			}
+			prio := classFilterPrio + 2*uint16(i) + uint16(j)
+			for k, keys := range classKeys(c, f.family) {
+				var err error
+				filter := protocolFilter(link, parent, prio, f.proto, netlink.TcU32Key{}, classID)
+				filter.Sel.Keys = keys
+				// The first filter replaces those left at the priority, the rest of the blocks of a port range go
+				// next to it.
+				switch {
+				case k == 0 && c.DSCP != nil:
+					err = shaping.ReplaceMarkingFilter(link, filter, *c.DSCP)
+				case k == 0:
+					err = shaping.ReplaceFilter(link, filter)
+				case c.DSCP != nil:
+					err = shaping.AddMarkingFilter(filter, *c.DSCP)
+				default:
+					err = countNetlink("FilterAdd", func() error { return netlink.FilterAdd(filter) })
+				}
+				if err != nil {
+					return fmt.Errorf("failed to add filter of class %q on %q: %v", c.Name, link.Attrs().Name, err)
+				}
+			}
+		}
+	}
+	other := &netlink.MatchAll{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    parent,
+			Priority:  classOtherPrio,
+			Protocol:  syscall.ETH_P_ALL,
+		},
+		ClassId: netlink.MakeHandle(major, splitMinor(minor, len(classes))),
+	}
+	if err := shaping.ReplaceFilter(link, other); err != nil {
+		return fmt.Errorf("failed to add default class filter on %q: %v", link.Attrs().Name, err)
+	}
+	return nil
+}
+
+// addMarkFilter attaches a fw filter at prio under parent on link classifying the traffic of every protocol with
+// the firewall mark into classID. The handle of a fw filter is the mark it matches.
+func addMarkFilter(link netlink.Link, parent uint32, prio uint16, mark, classID uint32) error {
+	filter := &netlink.Fw{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    parent,
+			Handle:    mark,
+			Priority:  prio,
+			Protocol:  syscall.ETH_P_ALL,
+		},
+		ClassId: classID,
+	}
+	return shaping.ReplaceFilter(link, filter)
+}
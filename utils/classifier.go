@@ -0,0 +1,38 @@
+package utils
+
+import (
+	"fmt"
+
+	"github.com/projectcalico/cni-plugin/shaping"
+)
+
+// Values of NetConf.Classifier: the catch-all filters are u32 ones by default, or matchall ones, and fwmark also
+// has them matchall and lets ingress classes match the mark of their traffic.
+const (
+	ClassifierU32      = shaping.ClassifierU32
+	ClassifierMatchAll = shaping.ClassifierMatchAll
+	ClassifierFWMark   = "fwmark"
+)
+
+// checkClassifier validates the classifier option of conf.
+func checkClassifier(conf NetConf) error {
+	switch conf.Classifier {
+	case "", ClassifierU32, ClassifierMatchAll, ClassifierFWMark:
+	default:
+		return fmt.Errorf("unknown classifier %q, must be %q, %q or %q", conf.Classifier, ClassifierU32,
+			ClassifierMatchAll, ClassifierFWMark)
+	}
+	if conf.Classifier != "" && conf.Classifier != ClassifierU32 && conf.ShapingMode != "" &&
+		conf.ShapingMode != ShapingModeVeth {
+		return fmt.Errorf("classifier %q is only supported by the %s shaping mode", conf.Classifier, ShapingModeVeth)
+	}
+	return nil
+}
+
+// shaperClassifier returns the classifier of the catch-all filters of classifier, the classifier of a pod.
+func shaperClassifier(classifier string) string {
+	if classifier == ClassifierFWMark {
+		return ClassifierMatchAll
+	}
+	return classifier
+}
@@ -0,0 +1,301 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/projectcalico/cni-plugin/classify"
+	"github.com/projectcalico/cni-plugin/shaping"
+	"github.com/projectcalico/cni-plugin/state"
+	"github.com/vishvananda/netlink"
+)
+
+// maxClassifyHops bounds how many redirects ClassifyPacket follows, in case filters redirect in a loop.
+const maxClassifyHops = 4
+
+// Classification is the path a packet of a pod takes through the filters shaping it, as ClassifyPacket simulates it.
+type Classification struct {
+	ContainerID string          `json:"container_id"`
+	Workload    string          `json:"workload"`
+	Direction   string          `json:"direction"`
+	Packet      classify.Packet `json:"packet"`
+	// Hops are the decisions on each device the packet goes through, following redirects.
+	Hops []classify.Decision `json:"hops"`
+	// Result sums up what happens to the packet.
+	Result string `json:"result"`
+	// Rate is the rate, in bits per second, of the class the packet ends up in, if any.
+	Rate uint64 `json:"rate,omitempty"`
+	// Policers are the packet rate limits the packet counts against.
+	Policers []string `json:"policers,omitempty"`
+}
+
+// ClassifyPacket evaluates the filters currently programmed for the pod of r against a packet travelling in
+// direction ("ingress" or "egress", from the point of view of the pod), and reports the class or action the kernel
+// would pick for it. Addresses of the packet that aren't set are taken from the pod's recorded IPs where the pod is
+// the source or destination.
+func ClassifyPacket(r *state.Record, direction string, p classify.Packet) (*Classification, error) {
+	if direction != "ingress" && direction != "egress" {
+		return nil, fmt.Errorf("unknown direction %q, must be ingress or egress", direction)
+	}
+	fillPodAddress(r, direction, &p)
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+
+	device, parent := r.HostVeth, netlink.MakeHandle(shaping.HostVethQdiscMajor, 0)
+	if direction == "egress" {
+		parent = netlink.MakeHandle(0xffff, 0)
+	}
+	if r.ShapingMode == ShapingModeNIC {
+		device, parent = r.NIC, netlink.MakeHandle(nicQdiscMajor, 0)
+		if direction == "ingress" {
+			parent = netlink.MakeHandle(0xffff, 0)
+		}
+	}
+
+	c := &Classification{ContainerID: r.ContainerID, Workload: r.Workload, Direction: direction, Packet: p}
+	if r.ShapingMode == ShapingModeNFTables {
+		c.Result = "policed by nftables rather than shaped"
+		c.Policers = packetPolicers(PacketLimitsOf(r), direction, p)
+		return c, nil
+	}
+	if r.ShapingMode == ShapingModeContainer {
+		ingress, egress := r.ActiveRates()
+		c.Result, c.Rate = "policed on "+r.IfName+" in the network namespace of the pod", ingress
+		if direction == "egress" {
+			c.Result, c.Rate = "shaped on "+r.IfName+" in the network namespace of the pod", egress
+		}
+		if c.Rate == 0 {
+			c.Result, c.Rate = "sent without shaping", 0
+		}
+		return c, nil
+	}
+	if r.Qdisc == QdiscEBPF {
+		ingress, egress := r.ActiveRates()
+		c.Result, c.Rate = "paced by the BPF program of "+r.HostVeth, ingress
+		if direction == "egress" {
+			c.Result, c.Rate = "policed by the BPF program of "+r.HostVeth, egress
+		}
+		if c.Rate == 0 {
+			c.Result, c.Rate = "sent without shaping", 0
+		}
+		return c, nil
+	}
+	if r.Qdisc == QdiscPolice {
+		ingress, egress := r.ActiveRates()
+		c.Result, c.Rate = "policed on egress of "+r.HostVeth, ingress
+		if direction == "egress" {
+			c.Result, c.Rate = "policed on ingress of "+r.HostVeth, egress
+		}
+		if c.Rate == 0 {
+			c.Result, c.Rate = "sent without shaping", 0
+		}
+		return c, nil
+	}
+	if r.Qdisc == QdiscTBF {
+		ingress, egress := r.ActiveRates()
+		c.Result, c.Rate = "shaped by the TBF qdisc of "+r.HostVeth, ingress
+		if direction == "egress" {
+			c.Result, c.Rate = "shaped by the TBF qdisc of "+r.IFB, egress
+		}
+		if c.Rate == 0 {
+			c.Result, c.Rate = "sent without shaping", 0
+		}
+		return c, nil
+	}
+	for hop := 0; hop < maxClassifyHops; hop++ {
+		link, err := netlink.LinkByName(device)
+		if err != nil {
+			return nil, fmt.Errorf("failed to lookup %q: %v", device, err)
+		}
+		filters, err := classifierFilters(link, parent)
+		if err != nil {
+			return nil, err
+		}
+		decision := classify.Evaluate(device, filters, p)
+		c.Hops = append(c.Hops, decision)
+
+		verdict := decision.Verdict
+		switch {
+		case verdict == nil:
+			c.Result = fmt.Sprintf("unclassified on %s, sent without shaping", device)
+		case verdict.Action == classify.ActionClassify:
+			c.Result = fmt.Sprintf("shaped in class %s on %s", verdict.Class, device)
+			c.Rate = classRate(link, parent, verdict.Class)
+		case verdict.Action == classify.ActionRedirect:
+			if parent, err = rootQdisc(verdict.Device); err != nil {
+				return nil, err
+			}
+			if parent == 0 {
+				c.Result = fmt.Sprintf("redirected to %s, which has no root qdisc", verdict.Device)
+				break
+			}
+			device = verdict.Device
+			continue
+		case verdict.Action == classify.ActionDrop:
+			c.Result = fmt.Sprintf("dropped on %s", device)
+		default:
+			c.Result = fmt.Sprintf("passed on %s without shaping", device)
+		}
+		break
+	}
+	if c.Result == "" {
+		c.Result = fmt.Sprintf("gave up after %d redirects", maxClassifyHops)
+	}
+	if r.Paused {
+		c.Result += " (shaping is paused)"
+	}
+	c.Policers = packetPolicers(PacketLimitsOf(r), direction, p)
+	return c, nil
+}
+
+// fillPodAddress sets the pod's end of the packet to the first recorded IP of the packet's family, if it isn't set.
+func fillPodAddress(r *state.Record, direction string, p *classify.Packet) {
+	addr := &p.Src
+	if direction == "ingress" {
+		addr = &p.Dst
+	}
+	if *addr != nil || p.Proto == classify.ProtoARP {
+		return
+	}
+	for _, s := range r.IPs {
+		if ip := net.ParseIP(s); ip != nil && (ip.To4() == nil) == p.IPv6() {
+			*addr = ip
+			return
+		}
+	}
+}
+
+// classifierFilters lists the filters under parent on link in the form classify evaluates.
+func classifierFilters(link netlink.Link, parent uint32) ([]classify.Filter, error) {
+	list, err := netlink.FilterList(link, parent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list filters of %q: %v", link.Attrs().Name, err)
+	}
+	filters := make([]classify.Filter, 0, len(list))
+	for _, f := range list {
+		attrs := f.Attrs()
+		filter := classify.Filter{
+			Device:   link.Attrs().Name,
+			Parent:   netlink.HandleStr(attrs.Parent),
+			Priority: attrs.Priority,
+			Protocol: attrs.Protocol,
+			Kind:     f.Type(),
+		}
+		var classID uint32
+		var actions []netlink.Action
+		switch f := f.(type) {
+		case *netlink.U32:
+			// The RedirIndex netlink reads back is that of the last mirred action, which is among the actions.
+			classID, actions = f.ClassId, f.Actions
+			if f.Sel != nil {
+				for _, k := range f.Sel.Keys {
+					filter.Keys = append(filter.Keys, classify.Key{Val: k.Val, Mask: k.Mask, Off: k.Off})
+				}
+			}
+		case *netlink.MatchAll:
+			classID, actions = f.ClassId, f.Actions
+		}
+		filter.Verdict = filterVerdict(classID, actions)
+		filters = append(filters, filter)
+	}
+	return filters, nil
+}
+
+// filterVerdict works out what a filter does from its class ID and actions. Redirects and drops take the packet away
+// whatever the class, and a filter without either passes it on. Mirrors only copy the packet, so they are ignored.
+func filterVerdict(classID uint32, actions []netlink.Action) classify.Verdict {
+	var redirIndex int
+	for _, a := range actions {
+		switch a := a.(type) {
+		case *netlink.MirredAction:
+			if a.MirredAction == netlink.TCA_EGRESS_REDIR || a.MirredAction == netlink.TCA_INGRESS_REDIR {
+				redirIndex = a.Ifindex
+			}
+		case *netlink.GenericAction:
+			if a.Attrs().Action == netlink.TC_ACT_SHOT {
+				return classify.Verdict{Action: classify.ActionDrop}
+			}
+		}
+	}
+	if redirIndex != 0 {
+		name := fmt.Sprintf("ifindex %d", redirIndex)
+		if link, err := netlink.LinkByIndex(redirIndex); err == nil {
+			name = link.Attrs().Name
+		}
+		return classify.Verdict{Action: classify.ActionRedirect, Device: name}
+	}
+	if classID != 0 {
+		return classify.Verdict{Action: classify.ActionClassify, Class: netlink.HandleStr(classID)}
+	}
+	return classify.Verdict{Action: classify.ActionPass}
+}
+
+// rootQdisc returns the handle of the root qdisc of a device, or 0 if it has none.
+func rootQdisc(device string) (uint32, error) {
+	link, err := netlink.LinkByName(device)
+	if err != nil {
+		return 0, fmt.Errorf("failed to lookup %q: %v", device, err)
+	}
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list qdiscs of %q: %v", device, err)
+	}
+	for _, q := range qdiscs {
+		if q.Attrs().Parent == netlink.HANDLE_ROOT {
+			return q.Attrs().Handle, nil
+		}
+	}
+	return 0, nil
+}
+
+// classRate returns the rate, in bits per second, of the HTB class with ID classID under parent on link, or 0 if
+// there is no such class.
+func classRate(link netlink.Link, parent uint32, classID string) uint64 {
+	classes, err := netlink.ClassList(link, parent)
+	if err != nil {
+		return 0
+	}
+	for _, c := range classes {
+		if htb, ok := c.(*netlink.HtbClass); ok && netlink.HandleStr(c.Attrs().Handle) == classID {
+			return htb.Rate * 8
+		}
+	}
+	return 0
+}
+
+// packetPolicers lists the packet rate limits of the pod that apply to a packet travelling in direction.
+func packetPolicers(limits PacketLimits, direction string, p classify.Packet) []string {
+	var policers []string
+	if direction == "ingress" {
+		if limits.Ingress != 0 {
+			policers = append(policers, fmt.Sprintf("all traffic to the pod: %d packets/s", limits.Ingress))
+		}
+		if limits.IngressRate != 0 {
+			policers = append(policers, fmt.Sprintf("all traffic to the pod: %d bits/s", limits.IngressRate))
+		}
+		return policers
+	}
+	if limits.DNS != 0 && (p.Proto == classify.ProtoTCP || p.Proto == classify.ProtoUDP) && p.DstPort == 53 {
+		policers = append(policers, fmt.Sprintf("DNS queries: %d packets/s", limits.DNS))
+	}
+	if limits.ICMP != 0 && p.Proto == classify.ProtoICMP {
+		policers = append(policers, fmt.Sprintf("ICMP: %d packets/s", limits.ICMP))
+	}
+	if limits.ICMPv6 != 0 && p.Proto == classify.ProtoICMPv6 {
+		policers = append(policers, fmt.Sprintf("ICMPv6 other than neighbor discovery: %d packets/s", limits.ICMPv6))
+	}
+	if limits.Egress != 0 {
+		policers = append(policers, fmt.Sprintf("all traffic from the pod: %d packets/s", limits.Egress))
+	}
+	if limits.EgressRate != 0 {
+		policers = append(policers, fmt.Sprintf("all traffic from the pod: %d bits/s", limits.EgressRate))
+	}
+	if limits.MaxPPS != 0 {
+		policers = append(policers, fmt.Sprintf("all traffic from the pod: %d packets/s", limits.MaxPPS))
+	}
+	if limits.Connections != 0 {
+		policers = append(policers, fmt.Sprintf("new connections of the pod: %d open at once", limits.Connections))
+	}
+	return policers
+}
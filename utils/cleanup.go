@@ -0,0 +1,256 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/projectcalico/cni-plugin/shaping"
+	"github.com/projectcalico/cni-plugin/state"
+	"github.com/projectcalico/cni-plugin/tracing"
+	"github.com/vishvananda/netlink"
+)
+
+// teardownStep is a step of TeardownContainer. A step must succeed when what it removes is already gone, since DEL
+// may be retried after a partial teardown or called for a container whose namespace no longer exists.
+type teardownStep struct {
+	name string
+	run  func(t *teardown) error
+}
+
+// teardownSteps are the steps of TeardownContainer, in order. Each removes a layer that only makes sense while the
+// layers after it exist:
+//
+//   - shaping: the redirect filters and qdiscs of the host veth, the IFB device, the pod's class on the uplink and
+//     its nftables elements. The redirect goes before the IFB, so traffic is never redirected to a missing device.
+//   - routes: the host routes to the pod through its host veth. Removing them while the veth is still up makes the
+//     host stop routing to the pod at once, rather than through a device being deleted.
+//   - veth: the container end of the veth and, if it survived that, the host end.
+//   - state: the names, counters and record of the pod. The record names the devices the steps before look for,
+//     so it goes last, and stays if one of them fails for DEL to be retried.
+//
+// Subsystems that add devices or routes for a pod must remove them in the step of their layer.
+var teardownSteps = []teardownStep{
+	{"shaping", (*teardown).removeShaping},
+	{"routes", (*teardown).removeRoutes},
+	{"veth", (*teardown).removeVeth},
+	{"state", (*teardown).removeState},
+}
+
+// teardown is what the steps of TeardownContainer know of a container.
+type teardown struct {
+	args   *skel.CmdArgs
+	conf   NetConf
+	logger *log.Entry
+	store  *state.Store
+	// record is the shaping record of the container, or nil if it has none.
+	record *state.Record
+	// hostVeth is the host veth of the container, or nil if it is gone or belongs to another container.
+	hostVeth netlink.Link
+	// ifbName is the IFB device of the container, or empty if it has none of its own.
+	ifbName string
+}
+
+// CleanupNetworking deletes what ADD set up for the container of args, logging with the container ID. See
+// TeardownContainer.
+func CleanupNetworking(args *skel.CmdArgs, conf NetConf) error {
+	return TeardownContainer(args, conf, log.WithField("ContainerID", args.ContainerID))
+}
+
+// TeardownContainer deletes what ADD set up for a container, in the order of teardownSteps, in the host network
+// namespace of conf. The devices are those of the container's shaping record or, without one, those the naming
+// strategy gives it; devices that belong to another container are left alone. Only the container end of the veth
+// is deleted in compatibility mode, as calico-cni does. Unlike shaping.Teardown, which only removes the shaping of a
+// link, it removes the routes and veth of the container too.
+func TeardownContainer(args *skel.CmdArgs, conf NetConf, logger *log.Entry) error {
+	if conf.CalicoCompat {
+		return CleanUpNamespace(args, logger)
+	}
+	return withHostNetNS(conf.HostNetNS, func() error {
+		t, err := newTeardown(args, conf, logger)
+		if err != nil {
+			return err
+		}
+		for _, step := range teardownSteps {
+			span := tracing.Start(step.name)
+			err = step.run(t)
+			span.End(err)
+			if err != nil {
+				return fmt.Errorf("failed to tear down %s: %v", step.name, err)
+			}
+		}
+		return nil
+	})
+}
+
+func newTeardown(args *skel.CmdArgs, conf NetConf, logger *log.Entry) (*teardown, error) {
+	t := &teardown{args: args, conf: conf, logger: logger, store: state.NewStore(conf.StateDir)}
+	var hostVethName string
+	var err error
+	if t.record, hostVethName, t.ifbName, err = containerDevices(t.store, args, conf); err != nil {
+		return nil, err
+	}
+	if hostVethName != "" {
+		t.hostVeth = ownedHostVeth(hostVethName, args.ContainerID, t.record != nil, logger)
+	}
+	return t, nil
+}
+
+// ContainerDeviceNames returns the names of the host veth and IFB device of a container: those recorded in its
+// shaping record or, without one, those the naming strategy gives it. They are empty where the container has no
+// such device, or they can't be known.
+func ContainerDeviceNames(args *skel.CmdArgs, conf NetConf) (hostVeth, ifb string, err error) {
+	_, hostVeth, ifb, err = containerDevices(state.NewStore(conf.StateDir), args, conf)
+	return hostVeth, ifb, err
+}
+
+// containerDevices returns the shaping record of a container, or nil if it has none, and the names of its host
+// veth and IFB device: those of the record or, without one, those the naming strategy gives it. The names are
+// empty where the container has no such device, or they can't be known.
+func containerDevices(store *state.Store, args *skel.CmdArgs, conf NetConf) (*state.Record, string, string, error) {
+	if r, err := store.Load(state.RecordKey(args.ContainerID, args.IfName)); err == nil {
+		if r.HostNetwork {
+			return r, "", "", nil
+		}
+		return r, r.HostVeth, r.IFB, nil
+	}
+	if conf.Naming.Strategy == NamingSequential {
+		// Sequential names can't be derived without allocating one.
+		return nil, "", "", nil
+	}
+	namer, err := NewNamer(conf)
+	if err != nil {
+		return nil, "", "", err
+	}
+	hostVethName, err := namer.HostVethName(args)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("failed to name host veth: %v", err)
+	}
+	ifbName, err := namer.IFBName(args)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("failed to name IFB device: %v", err)
+	}
+	if claimedIFB(store, ifbName, state.RecordKey(args.ContainerID, args.IfName)) {
+		ifbName = ""
+	}
+	return nil, hostVethName, ifbName, nil
+}
+
+// removeShaping removes the shaping of the container: the ingress qdisc of its host veth, with the filters
+// redirecting to the IFB device, then its root qdisc, the IFB device, and what the record says was set up outside
+// them.
+func (t *teardown) removeShaping() error {
+	unlock, err := state.LockTC()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if t.hostVeth != nil {
+		shaping.Teardown(t.hostVeth)
+	}
+	if t.ifbName != "" {
+		deleted, err := shaping.DeleteIFB(t.ifbName)
+		if err != nil {
+			return err
+		}
+		if deleted {
+			t.logger.WithField("interface", t.ifbName).Info("Deleted IFB device")
+		}
+	}
+	if t.record != nil {
+		removeRecordedShaping(t.store, t.record, t.logger)
+	}
+	return nil
+}
+
+// removeRoutes deletes the routes through the host veth, which are the host routes to the pod's addresses.
+func (t *teardown) removeRoutes() error {
+	if t.hostVeth == nil {
+		return nil
+	}
+	var routes []netlink.Route
+	err := countNetlink("RouteList", func() (err error) {
+		routes, err = netlink.RouteList(t.hostVeth, netlink.FAMILY_ALL)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list routes of %q: %v", t.hostVeth.Attrs().Name, err)
+	}
+	for i := range routes {
+		route := &routes[i]
+		if route.Dst == nil || route.LinkIndex != t.hostVeth.Attrs().Index {
+			continue
+		}
+		err = countNetlink("RouteDel", func() error { return netlink.RouteDel(route) })
+		if err != nil && err != syscall.ESRCH {
+			return fmt.Errorf("failed to delete route to %v: %v", route.Dst, err)
+		}
+	}
+	return nil
+}
+
+// removeVeth deletes the container end of the veth, which takes the host end with it, and the host end if it
+// outlived its container end because the namespace was already gone.
+func (t *teardown) removeVeth() error {
+	if err := CleanUpNamespace(t.args, t.logger); err != nil {
+		return err
+	}
+	if t.hostVeth == nil {
+		return nil
+	}
+	name := t.hostVeth.Attrs().Name
+	if _, err := netlink.LinkByName(name); err != nil {
+		return nil
+	}
+	if err := countNetlink("LinkDel", func() error { return netlink.LinkDel(t.hostVeth) }); err != nil {
+		return fmt.Errorf("failed to delete host veth %q: %v", name, err)
+	}
+	t.logger.WithField("interface", name).Info("Deleted host veth")
+	return nil
+}
+
+// removeState deletes the names, counters and record of the interface of the container, then runs the hooks of
+// DEL if it had a record.
+func (t *teardown) removeState() error {
+	key := state.RecordKey(t.args.ContainerID, t.args.IfName)
+	if err := deleteShapingRecord(t.store, key, state.AuditTriggerCNIDel, "torn down", t.logger); err != nil {
+		return err
+	}
+	if t.record != nil {
+		runHooks(t.conf.Hooks, HookEventDel, t.record, t.logger)
+	}
+	return nil
+}
+
+// ownedHostVeth returns the host veth named hostVethName if its alias shows it belongs to the container, or the
+// container's record names it and no other container marked it, and nil otherwise.
+func ownedHostVeth(hostVethName, containerID string, recorded bool, logger *log.Entry) netlink.Link {
+	link, err := netlink.LinkByName(hostVethName)
+	if err != nil {
+		return nil
+	}
+	alias := link.Attrs().Alias
+	if alias != hostVethAlias(containerID) && (!recorded || strings.HasPrefix(alias, hostVethAliasPrefix)) {
+		logger.WithField("interface", hostVethName).Info("Host veth belongs to another container, not deleting it")
+		return nil
+	}
+	return link
+}
+
+// claimedIFB reports whether a record other than the one stored under key names ifbName, as may happen when names
+// are truncated container IDs.
+func claimedIFB(store *state.Store, ifbName, key string) bool {
+	records, err := store.List()
+	if err != nil {
+		// Without the records the IFB can't be known to be the container's.
+		return true
+	}
+	for _, r := range records {
+		if r.IFB == ifbName && r.Key() != key {
+			return true
+		}
+	}
+	return false
+}
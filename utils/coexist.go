@@ -0,0 +1,243 @@
+package utils
+
+import (
+	"crypto/sha512"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/projectcalico/cni-plugin/internal/util"
+	"github.com/projectcalico/cni-plugin/shaping"
+	"github.com/vishvananda/netlink"
+)
+
+// The upstream bandwidth plugin shapes pods with a TBF root qdisc on their host veth, and an IFB device fed by an
+// ingress qdisc on the veth, the same devices this plugin shapes on. Chained after this plugin, it fails the ADD of
+// every pod it has rates for, as the veth already has our qdiscs, and left over from a pod it shaped before this
+// plugin was installed, it makes ours fail. Both are detected before the pod is shaped, to fail with a clear error
+// rather than a netlink one, or, with takeover set, to replace the bandwidth plugin.
+
+const (
+	// DefaultCNIConfDir is where the runtime reads CNI configurations from, unless cni_conf_dir is set.
+	DefaultCNIConfDir = "/etc/cni/net.d"
+
+	bandwidthPluginType = "bandwidth"
+	// The bandwidth plugin names its IFB devices after a hash of the network and container, with this prefix.
+	bandwidthIFBPrefix = "bwp"
+	// bandwidthQdiscMajor is the handle of the TBF qdisc of the bandwidth plugin, ours being
+	// shaping.HostVethQdiscMajor.
+	bandwidthQdiscMajor = 0x1
+)
+
+// bandwidthIFBName is the name of the IFB device the bandwidth plugin creates for a container.
+func bandwidthIFBName(network, containerID string) string {
+	name := fmt.Sprintf("%s%x", bandwidthIFBPrefix, sha512.Sum512([]byte(network+containerID)))
+	return name[:util.MaxIfNameLen]
+}
+
+// bandwidthPlugin is the bandwidth plugin in the chain of the network, as configured in a conflist file.
+type bandwidthPlugin struct {
+	File string
+	// Capability is set if the plugin takes the rates of pods from the runtime, which passes it those of the
+	// kubernetes.io/ingress-bandwidth and egress-bandwidth annotations.
+	Capability bool
+	// IngressRate and EgressRate are the rates the plugin shapes every pod to, in bits per second.
+	IngressRate uint64
+	EgressRate  uint64
+}
+
+// acts tells whether the plugin shapes any pod.
+func (b *bandwidthPlugin) acts() bool {
+	return b.Capability || b.IngressRate != 0 || b.EgressRate != 0
+}
+
+// findBandwidthPlugin looks for the bandwidth plugin in the chain of network in the conflist files of dir. It
+// returns nil if there is no such chain, or the chain has no bandwidth plugin.
+func findBandwidthPlugin(dir, network string) (*bandwidthPlugin, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.conflist"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		list := struct {
+			Name    string `json:"name"`
+			Plugins []struct {
+				Type         string          `json:"type"`
+				Capabilities map[string]bool `json:"capabilities"`
+				IngressRate  uint64          `json:"ingressRate"`
+				EgressRate   uint64          `json:"egressRate"`
+			} `json:"plugins"`
+		}{}
+		if err = json.Unmarshal(data, &list); err != nil || list.Name != network {
+			continue
+		}
+		for _, p := range list.Plugins {
+			if p.Type == bandwidthPluginType {
+				return &bandwidthPlugin{
+					File:        file,
+					Capability:  p.Capabilities["bandwidth"],
+					IngressRate: p.IngressRate,
+					EgressRate:  p.EgressRate,
+				}, nil
+			}
+		}
+		return nil, nil
+	}
+	return nil, nil
+}
+
+// removeBandwidthPlugin rewrites the conflist file the bandwidth plugin was found in without it, atomically, for
+// the runtime to no longer chain it.
+func removeBandwidthPlugin(b *bandwidthPlugin) error {
+	data, err := ioutil.ReadFile(b.File)
+	if err != nil {
+		return err
+	}
+	// The file is edited generically so that the settings of the other plugins are kept as they are.
+	list := map[string]interface{}{}
+	if err = json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", b.File, err)
+	}
+	plugins, _ := list["plugins"].([]interface{})
+	kept := []interface{}{}
+	for _, p := range plugins {
+		if plugin, ok := p.(map[string]interface{}); ok && plugin["type"] == bandwidthPluginType {
+			continue
+		}
+		kept = append(kept, p)
+	}
+	list["plugins"] = kept
+	if data, err = json.MarshalIndent(list, "", "  "); err != nil {
+		return err
+	}
+	info, err := os.Stat(b.File)
+	if err != nil {
+		return err
+	}
+	tmp := b.File + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, info.Mode()); err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.File)
+}
+
+// bandwidthArtifacts lists what the bandwidth plugin set up for the container on hostVeth: its TBF root qdisc, and
+// its IFB device ifb.
+func bandwidthArtifacts(hostVeth netlink.Link, ifb string) ([]string, error) {
+	var found []string
+	qdiscs, err := netlink.QdiscList(hostVeth)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list qdiscs of %q: %v", hostVeth.Attrs().Name, err)
+	}
+	for _, q := range qdiscs {
+		attrs := q.Attrs()
+		if _, ok := q.(*netlink.Tbf); ok && attrs.Parent == netlink.HANDLE_ROOT &&
+			attrs.Handle == netlink.MakeHandle(bandwidthQdiscMajor, 0) {
+			found = append(found, fmt.Sprintf("TBF root qdisc on %s", hostVeth.Attrs().Name))
+		}
+	}
+	if link, err := netlink.LinkByName(ifb); err == nil {
+		if _, ok := link.(*netlink.Ifb); ok {
+			found = append(found, "IFB device "+ifb)
+		}
+	}
+	return found, nil
+}
+
+// removeBandwidthArtifacts deletes what the bandwidth plugin set up for the container. Deleting the root qdisc of
+// the veth also deletes its filters; the ingress qdisc redirecting to the IFB device is left for ours to replace.
+func removeBandwidthArtifacts(hostVeth netlink.Link, ifb string) error {
+	if _, err := shaping.DeleteIFB(ifb); err != nil {
+		return err
+	}
+	qdiscs, err := netlink.QdiscList(hostVeth)
+	if err != nil {
+		return fmt.Errorf("failed to list qdiscs of %q: %v", hostVeth.Attrs().Name, err)
+	}
+	for _, q := range qdiscs {
+		attrs := q.Attrs()
+		if _, ok := q.(*netlink.Tbf); !ok || attrs.Parent != netlink.HANDLE_ROOT ||
+			attrs.Handle != netlink.MakeHandle(bandwidthQdiscMajor, 0) {
+			continue
+		}
+		if err = countNetlink("QdiscDel", func() error { return netlink.QdiscDel(q) }); err != nil {
+			return fmt.Errorf("failed to delete TBF qdisc of %q: %v", hostVeth.Attrs().Name, err)
+		}
+	}
+	return nil
+}
+
+// checkBandwidthPlugin checks that the upstream bandwidth plugin doesn't compete with this plugin for shaping the
+// container. With takeover set, it removes the bandwidth plugin from the chain and what it set up for the
+// container instead, and the container is shaped to the static rates of the bandwidth plugin in the directions
+// rates leaves unlimited.
+func checkBandwidthPlugin(args *skel.CmdArgs, conf NetConf, hostVeth netlink.Link, rates *ShapingRates, logger *log.Entry) error {
+	dir := conf.CNIConfDir
+	if dir == "" {
+		dir = DefaultCNIConfDir
+	}
+	plugin, err := findBandwidthPlugin(dir, conf.Name)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to read the CNI configuration, not checking for the bandwidth plugin")
+	}
+	if plugin != nil && !plugin.acts() {
+		logger.WithField("file", plugin.File).Debug("The bandwidth plugin is chained but shapes no pods")
+		plugin = nil
+	}
+	ifb := bandwidthIFBName(conf.Name, args.ContainerID)
+	artifacts, err := bandwidthArtifacts(hostVeth, ifb)
+	if err != nil {
+		return err
+	}
+	if plugin == nil && len(artifacts) == 0 {
+		return nil
+	}
+
+	if !conf.Takeover {
+		err := fmt.Errorf("the bandwidth plugin competes with this plugin for shaping container %s", args.ContainerID)
+		hint := "set takeover to true to have this plugin replace the bandwidth plugin"
+		if plugin != nil {
+			err = fmt.Errorf("the bandwidth plugin is chained in %s and competes with this plugin for shaping container %s",
+				plugin.File, args.ContainerID)
+			hint = fmt.Sprintf("remove the bandwidth plugin from the chain in %s, as this plugin shapes pods to their "+
+				"kubernetes.io/ingress-bandwidth and egress-bandwidth annotations itself, or %s", plugin.File, hint)
+		}
+		if len(artifacts) != 0 {
+			err = fmt.Errorf("%v: found %s", err, strings.Join(artifacts, ", "))
+		}
+		logger.WithError(err).WithField("remediation", hint).Error("Conflict with the bandwidth plugin")
+		return &ShapingError{Code: ErrCodeConflict, Err: err, Hint: hint}
+	}
+
+	if len(artifacts) != 0 {
+		if err = removeBandwidthArtifacts(hostVeth, ifb); err != nil {
+			return conflictError(fmt.Errorf("failed to take over the shaping of the bandwidth plugin: %v", err))
+		}
+		logger.WithField("artifacts", strings.Join(artifacts, ", ")).Warn("Removed the shaping of the bandwidth plugin")
+	}
+	if plugin != nil {
+		if rates.Ingress == 0 {
+			rates.Ingress = plugin.IngressRate
+		}
+		if rates.Egress == 0 {
+			rates.Egress = plugin.EgressRate
+		}
+		// The runtime only reads the chain again for later pods, so the bandwidth plugin may still run, and fail,
+		// for this one; the runtime retries it.
+		if err = removeBandwidthPlugin(plugin); err != nil {
+			logger.WithError(err).WithField("file", plugin.File).Warn("Failed to remove the bandwidth plugin from the chain")
+		} else {
+			logger.WithField("file", plugin.File).Warn("Took over from the bandwidth plugin, removed it from the chain")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,237 @@
+package utils_test
+
+import (
+	"encoding/json"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/cni-plugin/policy"
+	"github.com/projectcalico/cni-plugin/utils"
+)
+
+var _ = Describe("ParseShapingRates", func() {
+	logger := log.WithField("test", "config")
+	dscp := func(v uint8) *uint8 { return &v }
+
+	DescribeTable("parses the bandwidths of a pod",
+		func(conf utils.NetConf, ingress, egress string, expected utils.ShapingRates) {
+			rates, err := utils.ParseShapingRates(conf, ingress, egress, logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rates).To(Equal(expected))
+		},
+		Entry("leaves a pod without bandwidths unlimited", utils.NetConf{}, "", "", utils.ShapingRates{}),
+		Entry("takes the suffixes of quantities", utils.NetConf{}, "10M", "1Gi",
+			utils.ShapingRates{Ingress: 10 * 1000 * 1000, Egress: 1 << 30}),
+		Entry("gives the low latency class a guarantee without a bandwidth", utils.NetConf{LatencyClass: utils.LatencyClassLow},
+			"", "", utils.ShapingRates{Ingress: 5 * 1000 * 1000, Egress: 5 * 1000 * 1000}),
+		Entry("sets a ceil above the rate", utils.NetConf{IngressCeil: "20M"}, "10M", "",
+			utils.ShapingRates{Ingress: 10 * 1000 * 1000, IngressCeil: 20 * 1000 * 1000}),
+		Entry("gives a pod without a bandwidth the configured rate below the ceil",
+			utils.NetConf{IngressRate: "10M", IngressCeil: "20M"}, "", "",
+			utils.ShapingRates{Ingress: 10 * 1000 * 1000, IngressCeil: 20 * 1000 * 1000}),
+		Entry("prefers the bandwidth of the pod to the configured rate", utils.NetConf{EgressRate: "10M"}, "", "30M",
+			utils.ShapingRates{Egress: 30 * 1000 * 1000}),
+		Entry("drops a ceil equal to the rate", utils.NetConf{EgressCeil: "10M"}, "", "10M",
+			utils.ShapingRates{Egress: 10 * 1000 * 1000}),
+		Entry("accepts a DSCP", utils.NetConf{DSCP: dscp(46)}, "", "10M", utils.ShapingRates{Egress: 10 * 1000 * 1000}),
+		Entry("accepts a leaf qdisc", utils.NetConf{LeafQdisc: "fq_codel"}, "10M", "",
+			utils.ShapingRates{Ingress: 10 * 1000 * 1000}),
+		Entry("gives the node total bandwidth of the host interface a hierarchy to borrow from",
+			utils.NetConf{HostInterface: "eth0", NodeTotalBandwidth: "1G", EgressCeil: "20M"}, "", "10M",
+			utils.ShapingRates{Egress: 10 * 1000 * 1000, EgressCeil: 20 * 1000 * 1000}),
+		Entry("gives a pod without a bandwidth the default of the schedule", utils.NetConf{BandwidthSchedule: []utils.ScheduleEntry{
+			{From: "09:00", To: "18:00", Egress: "50M"}, {Default: "200M"}}}, "", "10M",
+			utils.ShapingRates{Ingress: 200 * 1000 * 1000, Egress: 10 * 1000 * 1000}),
+		Entry("accepts rates by peer", utils.NetConf{ClusterCIDRs: []string{"10.244.0.0/16", "fd00:10::/56"},
+			ExternalBandwidth: &utils.PeerBandwidth{Egress: "50M"}}, "", "1G", utils.ShapingRates{Egress: 1000 * 1000 * 1000}),
+		Entry("accepts the matchall classifier", utils.NetConf{Classifier: utils.ClassifierMatchAll}, "10M", "",
+			utils.ShapingRates{Ingress: 10 * 1000 * 1000}),
+		Entry("accepts shaping in the container", utils.NetConf{ShapeInContainer: true}, "10M", "20M",
+			utils.ShapingRates{Ingress: 10 * 1000 * 1000, Egress: 20 * 1000 * 1000}),
+		Entry("accepts policing rather than shaping", utils.NetConf{Enforcement: utils.EnforcementPolice}, "10M", "20M",
+			utils.ShapingRates{Ingress: 10 * 1000 * 1000, Egress: 20 * 1000 * 1000}),
+		Entry("accepts mirroring to a host interface", utils.NetConf{MirrorTo: "vxlan-tap"}, "10M", "20M",
+			utils.ShapingRates{Ingress: 10 * 1000 * 1000, Egress: 20 * 1000 * 1000}),
+	)
+
+	DescribeTable("rejects invalid configurations",
+		func(conf utils.NetConf, ingress, egress string) {
+			_, err := utils.ParseShapingRates(conf, ingress, egress, logger)
+			Expect(err).To(HaveOccurred())
+		},
+		Entry("an unknown shaping mode", utils.NetConf{ShapingMode: "magic"}, "10M", ""),
+		Entry("a ceil below the rate", utils.NetConf{IngressCeil: "5M"}, "10M", ""),
+		Entry("a configured rate above the ceil", utils.NetConf{EgressRate: "30M", EgressCeil: "20M"}, "", "10M"),
+		Entry("an invalid configured rate", utils.NetConf{IngressRate: "fast"}, "", ""),
+		Entry("an unparseable ceil", utils.NetConf{IngressCeil: "lots"}, "10M", ""),
+		Entry("an unknown latency class", utils.NetConf{LatencyClass: "urgent"}, "10M", ""),
+		Entry("a DSCP out of range", utils.NetConf{DSCP: dscp(64)}, "", "10M"),
+		Entry("a DSCP with nftables", utils.NetConf{DSCP: dscp(46), ShapingMode: utils.ShapingModeNFTables}, "", "10M"),
+		Entry("an unknown leaf qdisc", utils.NetConf{LeafQdisc: "red"}, "10M", ""),
+		Entry("a leaf qdisc with a protocol split",
+			utils.NetConf{LeafQdisc: "sfq", ProtocolSplit: &utils.ProtocolSplit{TCP: 50, UDP: 20}}, "10M", ""),
+		Entry("a leaf qdisc other than fq_codel in the low latency class",
+			utils.NetConf{LeafQdisc: "sfq", LatencyClass: utils.LatencyClassLow}, "10M", ""),
+		Entry("QoS priorities without a shared hierarchy",
+			utils.NetConf{QoSPriorities: map[string]uint32{utils.QoSGuaranteed: 0}}, "10M", ""),
+		Entry("an unknown QoS class", utils.NetConf{ShapingMode: utils.ShapingModeNIC,
+			NICHierarchy: &utils.NICHierarchy{Rate: 1 << 30}, QoSPriorities: map[string]uint32{"Gold": 0}}, "10M", ""),
+		Entry("a label priority without a value", utils.NetConf{ShapingMode: utils.ShapingModeNIC,
+			NICHierarchy: &utils.NICHierarchy{Rate: 1 << 30}, LabelPriorities: map[string]uint32{"tier": 1}}, "10M", ""),
+		Entry("a host interface with the veth shaping mode",
+			utils.NetConf{HostInterface: "eth0", ShapingMode: utils.ShapingModeVeth}, "10M", ""),
+		Entry("a node total bandwidth without a host interface", utils.NetConf{NodeTotalBandwidth: "1G"}, "10M", ""),
+		Entry("a node total bandwidth other than the rate of the hierarchy", utils.NetConf{HostInterface: "eth0",
+			NodeTotalBandwidth: "1G", NICHierarchy: &utils.NICHierarchy{Rate: 1 << 30}}, "10M", ""),
+		Entry("a schedule window with a bad time of day", utils.NetConf{BandwidthSchedule: []utils.ScheduleEntry{
+			{From: "9am", To: "18:00", Egress: "50M"}}}, "10M", ""),
+		Entry("a schedule window without a bandwidth", utils.NetConf{BandwidthSchedule: []utils.ScheduleEntry{
+			{From: "09:00", To: "18:00"}}}, "10M", ""),
+		Entry("a schedule with two defaults", utils.NetConf{BandwidthSchedule: []utils.ScheduleEntry{
+			{Default: "100M"}, {Default: "200M"}}}, "10M", ""),
+		Entry("an unknown classifier", utils.NetConf{Classifier: "bpf"}, "10M", ""),
+		Entry("a peer bandwidth without cluster CIDRs",
+			utils.NetConf{ExternalBandwidth: &utils.PeerBandwidth{Egress: "50M"}}, "", "1G"),
+		Entry("cluster CIDRs without a peer bandwidth", utils.NetConf{ClusterCIDRs: []string{"10.244.0.0/16"}}, "", "1G"),
+		Entry("an invalid cluster CIDR", utils.NetConf{ClusterCIDRs: []string{"10.244.0.0"},
+			ExternalBandwidth: &utils.PeerBandwidth{Egress: "50M"}}, "", "1G"),
+		Entry("an invalid peer bandwidth", utils.NetConf{ClusterCIDRs: []string{"10.244.0.0/16"},
+			ClusterBandwidth: &utils.PeerBandwidth{Ingress: "fast"}}, "1G", ""),
+		Entry("a classifier other than u32 outside the veth shaping mode",
+			utils.NetConf{Classifier: utils.ClassifierFWMark, ShapingMode: utils.ShapingModeNFTables}, "10M", ""),
+		Entry("shaping in the container on the uplink",
+			utils.NetConf{ShapeInContainer: true, ShapingMode: utils.ShapingModeNIC}, "10M", ""),
+		Entry("shaping in the container with a protocol split",
+			utils.NetConf{ShapeInContainer: true, ProtocolSplit: &utils.ProtocolSplit{TCP: 50, UDP: 20}}, "", "10M"),
+		Entry("an unknown enforcement", utils.NetConf{Enforcement: "throttle"}, "10M", ""),
+		Entry("policing with a ceil", utils.NetConf{Enforcement: utils.EnforcementPolice, IngressCeil: "20M"}, "10M", ""),
+		Entry("policing on the uplink",
+			utils.NetConf{Enforcement: utils.EnforcementPolice, ShapingMode: utils.ShapingModeNIC}, "", "10M"),
+		Entry("mirroring to an invalid interface name", utils.NetConf{MirrorTo: "a-very-long-interface"}, "10M", ""),
+		Entry("mirroring with a DSCP", utils.NetConf{MirrorTo: "tap0", DSCP: dscp(46)}, "", "10M"),
+		Entry("mirroring with the tbf shaper", utils.NetConf{MirrorTo: "tap0", Shaper: utils.QdiscTBF}, "10M", ""),
+		Entry("a zero bandwidth", utils.NetConf{}, "0", "10M"),
+	)
+
+	It("rejects a bandwidth that can't be parsed with a CNI error rather than leaving its direction unlimited", func() {
+		_, err := utils.ParseShapingRates(utils.NetConf{}, "fast", "10M", logger)
+		Expect(err).To(BeAssignableToTypeOf(&utils.ShapingError{}))
+		Expect(err.(*utils.ShapingError).Code).To(Equal(utils.ErrCodeInvalidConfig))
+	})
+})
+
+var _ = Describe("TierPriority", func() {
+	conf := utils.NetConf{
+		QoSPriorities:   map[string]uint32{utils.QoSGuaranteed: 0, utils.QoSBurstable: 2},
+		LabelPriorities: map[string]uint32{"tier=gold": 1, "team=infra": 0},
+	}
+
+	DescribeTable("ranks pods",
+		func(labels map[string]string, qosClass string, expected uint32, ranked bool) {
+			prio, ok := utils.TierPriority(conf, labels, qosClass)
+			Expect(ok).To(Equal(ranked))
+			Expect(prio).To(Equal(expected))
+		},
+		Entry("by their QoS class", nil, utils.QoSBurstable, uint32(2), true),
+		Entry("by their labels before their QoS class", map[string]string{"tier": "gold"}, utils.QoSBurstable,
+			uint32(1), true),
+		Entry("by the highest priority of their labels", map[string]string{"tier": "gold", "team": "infra"}, "",
+			uint32(0), true),
+		Entry("not at all without a tier", map[string]string{"tier": "silver"}, utils.QoSBestEffort, uint32(0), false),
+	)
+})
+
+var _ = Describe("HTBPrio", func() {
+	DescribeTable("prioritizes the classes of pods",
+		func(latencyClass string, classPriority, prio uint32) {
+			Expect(utils.HTBPrio(latencyClass, classPriority)).To(Equal(prio))
+		},
+		Entry("serves low latency classes first", utils.LatencyClassLow, uint32(3), uint32(0)),
+		Entry("keeps bulk classes behind low latency ones", "", uint32(0), uint32(1)),
+		Entry("keeps the priority of the PriorityClass", "", uint32(5), uint32(5)),
+	)
+})
+
+var _ = Describe("InterfaceBandwidth", func() {
+	p := &policy.Policy{
+		Presets:       map[string]policy.Rates{"small": {Ingress: 1000000, Egress: 1000000}},
+		DefaultPreset: "small",
+	}
+
+	DescribeTable("picks the bandwidth of an interface",
+		func(ifName string, annot map[string]string, runtimeIngress, runtimeEgress, ingress, egress string) {
+			in, out := utils.InterfaceBandwidth(p, "default", ifName, annot, runtimeIngress, runtimeEgress)
+			Expect(in).To(Equal(ingress))
+			Expect(out).To(Equal(egress))
+		},
+		Entry("from the annotations for the primary interface", "eth0",
+			map[string]string{"kubernetes.io/ingress-bandwidth": "10M", "kubernetes.io/egress-bandwidth": "20M"},
+			"", "", "10M", "20M"),
+		Entry("from the runtime before the annotations for the primary interface", "eth0",
+			map[string]string{"kubernetes.io/ingress-bandwidth": "10M"}, "30M", "", "30M", ""),
+		Entry("from the network attachment of a secondary interface, not the annotations", "net1",
+			map[string]string{"kubernetes.io/ingress-bandwidth": "10M", "kubernetes.io/egress-bandwidth": "20M"},
+			"50M", "60M", "50M", "60M"),
+		Entry("without the presets of the policy for a secondary interface", "net1", map[string]string{}, "", "", "",
+			""),
+		Entry("from the default preset for an unannotated primary interface", "eth0", map[string]string{}, "", "",
+			"1000000", "1000000"),
+	)
+
+	It("doesn't write the rates of a secondary interface into the annotations", func() {
+		annot := map[string]string{"kubernetes.io/ingress-bandwidth": "10M"}
+		utils.InterfaceBandwidth(p, "default", "net1", annot, "50M", "")
+		Expect(annot).To(Equal(map[string]string{"kubernetes.io/ingress-bandwidth": "10M"}))
+	})
+})
+
+var _ = Describe("Validate", func() {
+	parse := func(data string) utils.NetConf {
+		var conf utils.NetConf
+		Expect(json.Unmarshal([]byte(data), &conf)).To(Succeed())
+		return conf
+	}
+
+	It("normalizes the host interface shorthand", func() {
+		conf := parse(`{"ipam": {"type": "host-local"}, "host_interface": "eth0", "node_total_bandwidth": "1G"}`)
+		Expect(conf.Validate()).To(Succeed())
+		Expect(conf.ShapingMode).To(Equal(utils.ShapingModeNIC))
+		Expect(conf.NICName).To(Equal("eth0"))
+		Expect(conf.NICHierarchy).To(Equal(&utils.NICHierarchy{Rate: 1000 * 1000 * 1000}))
+	})
+
+	DescribeTable("rejects invalid configurations with a CNI error",
+		func(data string) {
+			conf := parse(data)
+			err := conf.Validate()
+			Expect(err).To(BeAssignableToTypeOf(&utils.ShapingError{}))
+			Expect(err.(*utils.ShapingError).Code).To(Equal(utils.ErrCodeInvalidConfig))
+		},
+		Entry("without an IPAM section", `{}`),
+		Entry("an MTU out of range", `{"ipam": {"type": "host-local"}, "mtu": 70000}`),
+		Entry("a zero ceil", `{"ipam": {"type": "host-local"}, "ingress_ceil": "0"}`),
+		Entry("a negative ceil", `{"ipam": {"type": "host-local"}, "egress_ceil": "-10M"}`),
+		Entry("sysctls that aren't managed",
+			`{"ipam": {"type": "host-local"}, "manageSysctls": false, "sysctls": {"net.ipv4.conf.IFNAME.rp_filter": "1"}}`),
+		Entry("a webhook that isn't an http URL",
+			`{"ipam": {"type": "host-local"}, "hooks": {"post_add_url": "ftp://inventory.example.com/pods"}}`),
+		Entry("an empty hook command", `{"ipam": {"type": "host-local"}, "hooks": {"post_del_exec": []}}`),
+		Entry("proxy ARP off when sysctls aren't managed",
+			`{"ipam": {"type": "host-local"}, "manageSysctls": false, "proxyARP": false}`),
+		Entry("a host interface with the veth shaping mode",
+			`{"ipam": {"type": "host-local"}, "host_interface": "eth0", "shapingMode": "veth"}`),
+		Entry("a zero rate", `{"ipam": {"type": "host-local"}, "egress_rate": "0"}`),
+		Entry("a rate that can't be parsed", `{"ipam": {"type": "host-local"}, "ingress_rate": "fast"}`),
+		Entry("a rate above the ceil", `{"ipam": {"type": "host-local"}, "ingress_rate": "30M", "ingress_ceil": "20M"}`),
+		Entry("a hierarchy outside the nic shaping mode",
+			`{"ipam": {"type": "host-local"}, "nicHierarchy": {"rate": 1000000000}}`),
+		Entry("an overflow policy outside the nic shaping mode",
+			`{"ipam": {"type": "host-local"}, "shapingMode": "veth", "nicOverflow": "veth"}`),
+		Entry("a classifier the backend doesn't classify with",
+			`{"ipam": {"type": "host-local"}, "classifier": "matchall", "backend": "ebpf"}`),
+		Entry("strict shaping in compatibility mode",
+			`{"ipam": {"type": "host-local"}, "calico_compat": true, "strict_shaping": false}`),
+	)
+})
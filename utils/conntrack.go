@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"os/exec"
+)
+
+// The nftables table stamping pod connections. Connections entering from a pod's host veth get the pod's mark
+// from nftPodMarksMap; since it is a conntrack mark, replies carry it too.
+const (
+	nftTable       = "flowcontrol"
+	nftPodMarksMap = "pod_marks"
+)
+
+// nftStampRuleset creates the table, map and chain if needed. Re-adding existing objects is a no-op, while the
+// chain is flushed so that its single rule isn't duplicated; the map and its elements are left alone.
+const nftStampRuleset = `add table inet flowcontrol
+add map inet flowcontrol pod_marks { typeof iifname : ct mark; }
+add chain inet flowcontrol stamp { type filter hook prerouting priority mangle; policy accept; }
+flush chain inet flowcontrol stamp
+add rule inet flowcontrol stamp ct mark set iifname map @pod_marks
+`
+
+// ConntrackMark returns the conntrack mark of a container's connections, derived from its ID so that the same
+// container always gets the same mark. It is never zero, which means unmarked.
+func ConntrackMark(containerID string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(containerID))
+	if mark := h.Sum32(); mark != 0 {
+		return mark
+	}
+	return 1
+}
+
+func nft(script string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = bytes.NewBufferString(script)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("nft failed: %v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// stampConntrack marks the connections of the pod behind hostVethName with mark.
+func stampConntrack(hostVethName string, mark uint32) error {
+	return nft(nftStampRuleset + fmt.Sprintf("add element inet %s %s { %q : %#x }\n", nftTable, nftPodMarksMap, hostVethName, mark))
+}
+
+// UnstampConntrack stops marking the connections of the pod behind hostVethName.
+func UnstampConntrack(hostVethName string) error {
+	return nft(fmt.Sprintf("delete element inet %s %s { %q }\n", nftTable, nftPodMarksMap, hostVethName))
+}
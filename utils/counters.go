@@ -0,0 +1,112 @@
+package utils
+
+import (
+	"github.com/projectcalico/cni-plugin/shaping"
+	"github.com/projectcalico/cni-plugin/state"
+	"github.com/vishvananda/netlink"
+)
+
+// ReadTraffic returns what the current classes of the pod of r have counted. Directions whose classes can't be
+// found, e.g. because a device was deleted, keep their traffic in last, the previous reading, rather than counting
+// as zero, so that a transient failure isn't taken for a counter reset. Only HTB classes count drops and overlimits.
+func ReadTraffic(r *state.Record, last state.Traffic) state.Traffic {
+	t := last
+	read := func(device string, major uint16, minors []uint16, bytes, packets, drops, overlimits *uint64) {
+		if c, ok := classTraffic(device, major, minors); ok {
+			*bytes, *packets, *drops, *overlimits = c.bytes, c.packets, c.drops, c.overlimits
+		}
+	}
+	// Policed pods have no classes counting their traffic.
+	if r.ShapingMode == ShapingModeNFTables {
+		return t
+	}
+	if r.ShapingMode == ShapingModeNIC {
+		minors := []uint16{r.NICClassMinor}
+		read(r.NIC, nicQdiscMajor, minors, &t.EgressBytes, &t.EgressPackets, &t.EgressDrops, &t.EgressOverlimits)
+		if !r.HostNetwork {
+			read(nicIFBName(r.NIC), nicQdiscMajor, minors, &t.IngressBytes, &t.IngressPackets, &t.IngressDrops,
+				&t.IngressOverlimits)
+		}
+		return t
+	}
+
+	// Pods shaped with BPF have no classes either: the host veth counts what it transmitted through the fq qdisc, and
+	// what it received from the pod, policed or not. Policed pods are counted the same way. Pods shaped in their
+	// network namespace are shaped before their traffic reaches the host, so the host veth counts what got through.
+	if r.Qdisc == QdiscEBPF || r.Qdisc == QdiscPolice || r.ShapingMode == ShapingModeContainer {
+		if link, err := netlink.LinkByName(r.HostVeth); err == nil && link.Attrs().Statistics != nil {
+			stats := link.Attrs().Statistics
+			if r.IngressRate != 0 {
+				t.IngressBytes, t.IngressPackets = stats.TxBytes, stats.TxPackets
+			}
+			if r.EgressRate != 0 {
+				t.EgressBytes, t.EgressPackets = stats.RxBytes, stats.RxPackets
+			}
+		}
+		return t
+	}
+
+	// A TBF qdisc is the root of its device, so the device counts the same traffic.
+	if r.Qdisc == QdiscTBF {
+		if r.IngressRate != 0 {
+			if b, p, ok := linkTraffic(r.HostVeth); ok {
+				t.IngressBytes, t.IngressPackets = b, p
+			}
+		}
+		if r.IFB != "" {
+			if b, p, ok := linkTraffic(r.IFB); ok {
+				t.EgressBytes, t.EgressPackets = b, p
+			}
+		}
+		return t
+	}
+
+	minors := []uint16{shaping.ClassMinor(r.ShapingGeneration)}
+	if r.IPFamilyBudget == IPFamilyBudgetSeparate {
+		minors = append(minors, shaping.ClassMinor(shaping.IPv6Generation(r.ShapingGeneration)))
+	}
+	if r.IngressRate != 0 {
+		read(r.HostVeth, shaping.HostVethQdiscMajor, minors, &t.IngressBytes, &t.IngressPackets, &t.IngressDrops,
+			&t.IngressOverlimits)
+	}
+	if r.IFB != "" {
+		read(r.IFB, shaping.IFBQdiscMajor, minors, &t.EgressBytes, &t.EgressPackets, &t.EgressDrops, &t.EgressOverlimits)
+	}
+	return t
+}
+
+// classCounts are the counters of a class.
+type classCounts struct {
+	bytes, packets, drops, overlimits uint64
+}
+
+// classTraffic sums the counters of the classes with the given minors under the root qdisc major of a device. It
+// reports whether any of the classes was found.
+func classTraffic(device string, major uint16, minors []uint16) (counts classCounts, found bool) {
+	link, err := netlink.LinkByName(device)
+	if err != nil {
+		return counts, false
+	}
+	classes, err := netlink.ClassList(link, netlink.MakeHandle(major, 0))
+	if err != nil {
+		return counts, false
+	}
+	for _, c := range classes {
+		stats := c.Attrs().Statistics
+		if stats == nil || stats.Basic == nil {
+			continue
+		}
+		for _, minor := range minors {
+			if c.Attrs().Handle == netlink.MakeHandle(major, minor) {
+				counts.bytes += stats.Basic.Bytes
+				counts.packets += uint64(stats.Basic.Packets)
+				if stats.Queue != nil {
+					counts.drops += uint64(stats.Queue.Drops)
+					counts.overlimits += uint64(stats.Queue.Overlimits)
+				}
+				found = true
+			}
+		}
+	}
+	return counts, found
+}
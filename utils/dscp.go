@@ -0,0 +1,22 @@
+package utils
+
+import (
+	"fmt"
+
+	"github.com/projectcalico/cni-plugin/shaping"
+)
+
+// checkDSCP validates the dscp option. Traffic is marked by the filters redirecting it to the IFB device of a pod,
+// so only pods shaped on their veth can be marked.
+func checkDSCP(conf NetConf) error {
+	if conf.DSCP == nil {
+		return nil
+	}
+	if *conf.DSCP > shaping.MaxDSCP {
+		return fmt.Errorf("invalid dscp %d, must be at most %d", *conf.DSCP, shaping.MaxDSCP)
+	}
+	if conf.ShapingMode == ShapingModeNIC || conf.ShapingMode == ShapingModeNFTables {
+		return fmt.Errorf("dscp isn't supported by the %s shaping mode", conf.ShapingMode)
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package utils
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/cni-plugin/metrics"
+	"github.com/projectcalico/cni-plugin/shaping"
+	"github.com/projectcalico/cni-plugin/state"
+	"github.com/vishvananda/netlink"
+)
+
+// QdiscEBPF is the state.Record.Qdisc of pods shaped with backend "ebpf": BPF programs on a clsact qdisc of the host
+// veth pace traffic entering the pod for an fq qdisc at its root, and police traffic leaving it, with no IFB device.
+const QdiscEBPF = "ebpf"
+
+// edtHorizon is how far ahead packets entering a pod shaped with BPF may be scheduled before they are dropped,
+// which, like the latency of TBF, bounds its queue.
+const edtHorizon = 50 * time.Millisecond
+
+var ebpfFallbacks = metrics.NewCounter("flowcontrol_ebpf_fallbacks_total",
+	"Pods configured for the ebpf backend shaped with HTB because the kernel can't run its programs.")
+
+// checkBackend validates the backend option. The BPF programs enforce a single rate per direction of a pod on its
+// veth, so it rules out the shapers and the options that need classes or filters; the options that need features
+// it lacks are rejected by checkBackendFeatures.
+func checkBackend(conf NetConf) error {
+	switch conf.Backend {
+	case "":
+		return nil
+	case BackendEBPF:
+	default:
+		return fmt.Errorf("invalid backend %q, must be %q", conf.Backend, BackendEBPF)
+	}
+	for _, c := range []struct {
+		option string
+		set    bool
+	}{
+		{"shaper " + conf.Shaper, conf.Shaper != ""},
+		{"singleClassQdisc " + QdiscHTB, conf.SingleClassQdisc == QdiscHTB},
+		{"shapingMode " + conf.ShapingMode, conf.ShapingMode != "" && conf.ShapingMode != ShapingModeVeth},
+		{"ipFamilyBudget " + IPFamilyBudgetSeparate, conf.IPFamilyBudget == IPFamilyBudgetSeparate},
+		{"nonIPPolicy " + NonIPPolicyDrop, conf.NonIPPolicy == NonIPPolicyDrop},
+	} {
+		if c.set {
+			return fmt.Errorf("backend %q can't be combined with %s", BackendEBPF, c.option)
+		}
+	}
+	return nil
+}
+
+// useEBPF reports whether the pods configured by conf are shaped with BPF programs: if backend "ebpf" is set and
+// the kernel runs them. Otherwise they fall back to HTB classes and an IFB device.
+func useEBPF(conf NetConf, store *state.Store, logger *log.Entry) bool {
+	if conf.Backend != BackendEBPF {
+		return false
+	}
+	caps, err := ProbeCapabilities(store, false, logger)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to probe kernel capabilities, shaping with HTB")
+		ebpfFallbacks.Inc()
+		return false
+	}
+	if !caps.EBPF {
+		logger.WithField("reason", caps.EBPFError).Warn("Kernel can't shape with BPF, shaping with HTB instead")
+		ebpfFallbacks.Inc()
+		return false
+	}
+	return true
+}
+
+// bpfPinDir is the directory of the BPF filesystem holding the maps of the programs shaping the interface of a
+// container stored under key.
+func bpfPinDir(key string) string {
+	return filepath.Join(shaping.BPFFSRoot, "cni_flow_control", key)
+}
+
+// bpfPin is where the map of the program limiting direction, "ingress" or "egress", of the interface stored under
+// key is pinned.
+func bpfPin(key, direction string) string {
+	return filepath.Join(bpfPinDir(key), direction)
+}
+
+// setupIngressEBPF shapes traffic entering the pod by pacing what its host veth transmits.
+func setupIngressEBPF(hostVeth netlink.Link, key string, rate uint64) error {
+	return shaping.SetupEDT(hostVeth, bpfPin(key, "ingress"), rate, edtHorizon)
+}
+
+// setupEgressEBPF limits traffic leaving the pod by policing what its host veth receives.
+func setupEgressEBPF(hostVeth netlink.Link, key string, rate uint64, burst uint32) error {
+	return shaping.SetupBPFPolicer(hostVeth, bpfPin(key, "egress"), rate, burst)
+}
+
+// setEBPFRates replaces the rates of the BPF programs shaping the pod of r, in bits per second, in the maps they
+// read, keeping its bursts. Only the directions the pod was limited in when it was set up have programs.
+func setEBPFRates(r *state.Record, ingressRate, egressRate uint64) error {
+	if r.IngressRate != 0 {
+		if err := shaping.SetBPFRate(bpfPin(r.Key(), "ingress"), ingressRate, uint64(edtHorizon)); err != nil {
+			return err
+		}
+	}
+	if r.EgressRate != 0 {
+		burst := BurstsOf(r).egress(egressRate).buffer
+		return shaping.SetBPFRate(bpfPin(r.Key(), "egress"), egressRate, shaping.BurstNanos(egressRate, burst))
+	}
+	return nil
+}
+
+// RestoreEBPF rebuilds the BPF shaping of the requested directions of the pod of r, at the given rates.
+func RestoreEBPF(r *state.Record, ingress, egress bool, ingressRate, egressRate uint64) error {
+	hostVeth, err := netlink.LinkByName(r.HostVeth)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", r.HostVeth, err)
+	}
+	if ingress {
+		if err = setupIngressEBPF(hostVeth, r.Key(), ingressRate); err != nil {
+			return err
+		}
+	}
+	if egress {
+		return setupEgressEBPF(hostVeth, r.Key(), egressRate, BurstsOf(r).egress(egressRate).buffer)
+	}
+	return nil
+}
+
+// checkEBPF returns what is missing from the BPF shaping of a host veth: the root fq qdisc and pacing program if
+// ingress is limited, and the policing program if egress is.
+func checkEBPF(hostVeth netlink.Link, ingress, egress bool) ShapingDrift {
+	drift := ShapingDrift{}
+	name := hostVeth.Attrs().Name
+	if q := shaping.IngressQdisc(hostVeth); (ingress || egress) && (q == nil || q.Type() != "clsact") {
+		missing := []string{"clsact qdisc missing on " + name}
+		if ingress {
+			drift.Ingress = missing
+		}
+		if egress {
+			drift.Egress = missing
+		}
+		return drift
+	}
+	if ingress {
+		if !hasRootQdisc(hostVeth, "fq") {
+			drift.Ingress = append(drift.Ingress, "root fq qdisc missing on "+name)
+		}
+		if !shaping.HasBPFFilter(hostVeth, netlink.HANDLE_MIN_EGRESS) {
+			drift.Ingress = append(drift.Ingress, "BPF program missing on egress of "+name)
+		}
+	}
+	if egress && !shaping.HasBPFFilter(hostVeth, netlink.HANDLE_MIN_INGRESS) {
+		drift.Egress = append(drift.Egress, "BPF program missing on ingress of "+name)
+	}
+	return drift
+}
+
+// CheckEBPFShaping is CheckShaping for the pod of r, shaped with BPF, which has no IFB device to tell whether its
+// egress is limited.
+func CheckEBPFShaping(r *state.Record) (ShapingDrift, error) {
+	hostVeth, err := netlink.LinkByName(r.HostVeth)
+	if err != nil {
+		return ShapingDrift{}, fmt.Errorf("failed to lookup %q: %v", r.HostVeth, err)
+	}
+	return checkEBPF(hostVeth, r.IngressRate != 0, r.EgressRate != 0), nil
+}
+
+// hasRootQdisc reports whether the root qdisc of link is of kind.
+func hasRootQdisc(link netlink.Link, kind string) bool {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return false
+	}
+	for _, q := range qdiscs {
+		if q.Attrs().Parent == netlink.HANDLE_ROOT && q.Type() == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyEBPF compares the rates in the maps of the BPF programs shaping the pod of r with ingress and egress.
+func verifyEBPF(r *state.Record, ingress, egress uint64) []string {
+	hostVeth, err := netlink.LinkByName(r.HostVeth)
+	if err != nil {
+		return []string{fmt.Sprintf("host veth %s missing", r.HostVeth)}
+	}
+	drift := checkEBPF(hostVeth, r.IngressRate != 0, r.EgressRate != 0)
+	problems := append(drift.Ingress, drift.Egress...)
+	for _, d := range []struct {
+		direction string
+		limited   bool
+		want      uint64
+	}{{"ingress", r.IngressRate != 0, ingress}, {"egress", r.EgressRate != 0, egress}} {
+		if !d.limited {
+			continue
+		}
+		rate, err := shaping.BPFRate(bpfPin(r.Key(), d.direction))
+		if err != nil {
+			problems = append(problems, err.Error())
+		} else if !rateMatches(rate/8, d.want) {
+			problems = append(problems, fmt.Sprintf("BPF %s rate is %d bit/s, expected %d", d.direction, rate, d.want))
+		}
+	}
+	return problems
+}
+
+// removeEBPF removes the pinned maps of the BPF programs of the interface stored under key; the programs go with
+// the clsact qdisc of its host veth.
+func removeEBPF(key string, logger *log.Entry) {
+	if err := shaping.RemovePins(bpfPinDir(key)); err != nil {
+		logger.WithError(err).Warn("Failed to remove BPF maps")
+	}
+}
@@ -0,0 +1,128 @@
+package utils
+
+import (
+	"fmt"
+
+	"github.com/projectcalico/cni-plugin/shaping"
+	"github.com/projectcalico/cni-plugin/state"
+	"github.com/vishvananda/netlink"
+)
+
+// Values of NetConf.Enforcement: "shape" queues the traffic of pods over their rate in HTB classes, or TBF qdiscs,
+// and "police" drops it as soon as it exceeds the rate, with police actions on both hooks of a clsact qdisc of their
+// host veth. Queueing smooths bursts but hides overload behind a growing round trip time, which latency-sensitive
+// workloads would rather see as loss.
+const (
+	EnforcementShape  = "shape"
+	EnforcementPolice = "police"
+)
+
+// QdiscPolice is the state.Record.Qdisc of pods whose rates are enforced with enforcement "police", with no root
+// qdisc or IFB device.
+const QdiscPolice = "police"
+
+// checkEnforcement validates the enforcement option. A policer enforces a single rate per direction of a pod on its
+// veth, so policing rules out the options that need classes, queues or filters.
+func checkEnforcement(conf NetConf) error {
+	switch conf.Enforcement {
+	case "", EnforcementShape:
+		return nil
+	case EnforcementPolice:
+	default:
+		return fmt.Errorf("invalid enforcement %q, must be %q or %q", conf.Enforcement, EnforcementShape, EnforcementPolice)
+	}
+	for _, c := range []struct {
+		option string
+		set    bool
+	}{
+		{"shapingMode " + conf.ShapingMode, conf.ShapingMode != "" && conf.ShapingMode != ShapingModeVeth},
+		{"backend " + conf.Backend, conf.Backend != ""},
+		{"shaper " + conf.Shaper, conf.Shaper != ""},
+		{"singleClassQdisc " + QdiscHTB, conf.SingleClassQdisc == QdiscHTB},
+		{"latencyClass", conf.LatencyClass != ""},
+		{"ingress_ceil", conf.IngressCeil != ""},
+		{"egress_ceil", conf.EgressCeil != ""},
+		{"cbuffer", conf.Cbuffer != 0},
+		{"protocolSplit", conf.ProtocolSplit != nil},
+		{"classes", len(conf.Classes) != 0},
+		{"cluster_cidrs", peersSet(conf)},
+		{"ipFamilyBudget " + IPFamilyBudgetSeparate, conf.IPFamilyBudget == IPFamilyBudgetSeparate},
+		{"nonIPPolicy", conf.NonIPPolicy != ""},
+		{"dscp", conf.DSCP != nil},
+		{"leaf_qdisc", conf.LeafQdisc != ""},
+		{"mirror_to", conf.MirrorTo != ""},
+		{"shape_in_container", conf.ShapeInContainer},
+	} {
+		if c.set {
+			return fmt.Errorf("enforcement %q can't be combined with %s", EnforcementPolice, c.option)
+		}
+	}
+	return nil
+}
+
+// setupIngressPolice limits traffic entering the pod by policing what its host veth transmits.
+func setupIngressPolice(hostVeth netlink.Link, rate uint64, burst uint32) error {
+	return shaping.SetupHookPolicer(hostVeth, netlink.HANDLE_MIN_EGRESS, rate, burst)
+}
+
+// setupEgressPolice limits traffic leaving the pod by policing what its host veth receives.
+func setupEgressPolice(hostVeth netlink.Link, rate uint64, burst uint32) error {
+	return shaping.SetupHookPolicer(hostVeth, netlink.HANDLE_MIN_INGRESS, rate, burst)
+}
+
+// RestorePolice rebuilds the policers of the requested directions of the pod of r, at the given rates. A policer
+// is replaced in place, so this also changes the rates of the pod.
+func RestorePolice(r *state.Record, ingress, egress bool, ingressRate, egressRate uint64) error {
+	hostVeth, err := netlink.LinkByName(r.HostVeth)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", r.HostVeth, err)
+	}
+	bursts := BurstsOf(r)
+	if ingress {
+		if err = setupIngressPolice(hostVeth, ingressRate, bursts.ingress(ingressRate).buffer); err != nil {
+			return err
+		}
+	}
+	if egress {
+		return setupEgressPolice(hostVeth, egressRate, bursts.egress(egressRate).buffer)
+	}
+	return nil
+}
+
+// CheckPoliceShaping is CheckShaping for the pod of r, whose rates are policed on its host veth: the clsact qdisc,
+// and the policer of each limited direction on its hook, must be there.
+func CheckPoliceShaping(r *state.Record) (ShapingDrift, error) {
+	hostVeth, err := netlink.LinkByName(r.HostVeth)
+	if err != nil {
+		return ShapingDrift{}, fmt.Errorf("failed to lookup %q: %v", r.HostVeth, err)
+	}
+	drift := ShapingDrift{}
+	ingress, egress := r.IngressRate != 0, r.EgressRate != 0
+	if q := shaping.IngressQdisc(hostVeth); (ingress || egress) && (q == nil || q.Type() != "clsact") {
+		missing := []string{"clsact qdisc missing on " + r.HostVeth}
+		if ingress {
+			drift.Ingress = missing
+		}
+		if egress {
+			drift.Egress = missing
+		}
+		return drift, nil
+	}
+	if ingress && !shaping.HasPolicer(hostVeth, netlink.HANDLE_MIN_EGRESS) {
+		drift.Ingress = append(drift.Ingress, "policer missing on egress of "+r.HostVeth)
+	}
+	if egress && !shaping.HasPolicer(hostVeth, netlink.HANDLE_MIN_INGRESS) {
+		drift.Egress = append(drift.Egress, "policer missing on ingress of "+r.HostVeth)
+	}
+	return drift, nil
+}
+
+// verifyPolice checks that the policers of the pod of r are on its host veth. The kernel doesn't report the rates
+// of police actions in a form netlink decodes, so they aren't compared.
+func verifyPolice(r *state.Record) []string {
+	drift, err := CheckPoliceShaping(r)
+	if err != nil {
+		return []string{fmt.Sprintf("host veth %s missing", r.HostVeth)}
+	}
+	return append(drift.Ingress, drift.Egress...)
+}
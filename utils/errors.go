@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/projectcalico/cni-plugin/internal/util"
+	"github.com/projectcalico/cni-plugin/shaping"
+)
+
+// CNI error codes of the failures the plugin can explain. The spec leaves codes from 100 up to plugins.
+const (
+	ErrCodeKernelSupport      uint = 101
+	ErrCodeConflict           uint = 102
+	ErrCodeRateTooLow         uint = 103
+	ErrCodeNameTooLong        uint = 104
+	ErrCodeRateAboveLinkSpeed uint = 105
+	ErrCodeClassesExhausted   uint = 106
+	ErrCodeDrift              uint = 107
+	ErrCodeInvalidConfig      uint = 108
+)
+
+// ShapingError is a failure with a known cause. It is reported to the runtime as a CNI error carrying Hint in its
+// details, so that the events of the pod tell the operator how to fix it.
+type ShapingError struct {
+	Code uint
+	Err  error
+	Hint string
+}
+
+func (e *ShapingError) Error() string {
+	return e.Err.Error()
+}
+
+// CNIError returns err as it should be reported to the runtime. ShapingErrors, and the errors of the shaping package
+// they explain, become CNI errors with their code and hint, and DriftErrors with what drifted in their details;
+// anything else is returned unchanged.
+func CNIError(err error) error {
+	switch e := err.(type) {
+	case *ShapingError:
+		return &types.Error{Code: e.Code, Msg: e.Err.Error(), Details: e.Hint}
+	case *shaping.ModuleError:
+		return CNIError(kernelSupportError(e.Err, e.Op, e.Module))
+	case *shaping.ConflictError:
+		return CNIError(conflictError(e.Err))
+	case *DriftError:
+		return &types.Error{
+			Code:    ErrCodeDrift,
+			Msg:     fmt.Sprintf("networking of container %s has drifted", e.ContainerID),
+			Details: strings.Join(e.Problems, "; "),
+		}
+	}
+	return err
+}
+
+// kernelSupportError explains err if it is how the kernel reports that module, needed for op, isn't available.
+// Other errors are returned unchanged.
+func kernelSupportError(err error, op, module string) error {
+	switch err {
+	case syscall.ENOENT, syscall.EOPNOTSUPP:
+		return &ShapingError{
+			Code: ErrCodeKernelSupport,
+			Err:  fmt.Errorf("failed to %s: %v", op, err),
+			Hint: fmt.Sprintf("the kernel module %s appears to be missing; load it with \"modprobe %s\" on the node", module, module),
+		}
+	}
+	return fmt.Errorf("failed to %s: %v", op, err)
+}
+
+// conflictError reports that an interface the plugin needs is taken by someone else.
+func conflictError(err error) error {
+	return &ShapingError{
+		Code: ErrCodeConflict,
+		Err:  err,
+		Hint: "another CNI plugin or pod owns an interface with the same name; check the plugin chain for competing plugins and remove the stale interface if it is unused",
+	}
+}
+
+// classesExhaustedError reports that every class of the shared hierarchy of the uplink nic is taken.
+func classesExhaustedError(nic string) error {
+	return &ShapingError{
+		Code: ErrCodeClassesExhausted,
+		Err:  fmt.Errorf("no free shaping classes left on %s: %d pods are already shaped on it", nic, maxNICClassMinor),
+		Hint: fmt.Sprintf("set nicOverflow to %q to shape the pods that don't fit on their own veth and IFB device, or use shapingMode %q", NICOverflowVeth, ShapingModeVeth),
+	}
+}
+
+// isClassesExhausted reports whether err is a classesExhaustedError.
+func isClassesExhausted(err error) bool {
+	e, ok := err.(*ShapingError)
+	return ok && e.Code == ErrCodeClassesExhausted
+}
+
+// checkIfName rejects interface names the kernel won't accept.
+func checkIfName(name string) error {
+	if err := util.CheckIfName(name); err != nil {
+		return &ShapingError{
+			Code: ErrCodeNameTooLong,
+			Err:  err,
+			Hint: "shorten the configured interface name or prefix",
+		}
+	}
+	return nil
+}
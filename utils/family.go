@@ -0,0 +1,20 @@
+package utils
+
+import (
+	"fmt"
+)
+
+// Values of NetConf.IPFamilyBudget: whether the IPv4 and IPv6 traffic of a pod share the limit of each direction
+// (the default), or each get the full limit in a class of their own.
+const (
+	IPFamilyBudgetShared   = "shared"
+	IPFamilyBudgetSeparate = "separate"
+)
+
+func checkIPFamilyBudget(budget string) error {
+	switch budget {
+	case "", IPFamilyBudgetShared, IPFamilyBudgetSeparate:
+		return nil
+	}
+	return fmt.Errorf("unknown ipFamilyBudget %q", budget)
+}
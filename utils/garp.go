@@ -0,0 +1,112 @@
+package utils
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/projectcalico/cni-plugin/internal/nlconst"
+	"github.com/vishvananda/netlink"
+)
+
+// announceAddresses sends a gratuitous ARP for each IPv4 address of result, and an unsolicited neighbour
+// advertisement for each IPv6 one, from the interface ifName of the container at netnsPath, so that the neighbour
+// caches of the host and the network replace what they learnt from the previous owner of an address at once rather
+// than once their entries go stale. An announcement that fails only delays that, so failures are logged.
+func announceAddresses(netnsPath, ifName string, result *current.Result, logger *log.Entry) {
+	err := ns.WithNetNSPath(netnsPath, func(ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+		}
+		for _, addr := range result.IPs {
+			ip := addr.Address.IP
+			if ip.To4() != nil {
+				err = sendGratuitousARP(link, ip.To4())
+			} else {
+				err = sendUnsolicitedNA(link, ip)
+			}
+			if err != nil {
+				logger.WithError(err).WithField("address", ip).Warn("Failed to announce container address")
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logger.WithError(err).Warn("Failed to announce container addresses")
+	}
+}
+
+// sendGratuitousARP broadcasts an ARP request for ip from link, which owns it.
+func sendGratuitousARP(link netlink.Link, ip net.IP) error {
+	mac := link.Attrs().HardwareAddr
+	if len(mac) != 6 {
+		return fmt.Errorf("%q has no Ethernet address to announce", link.Attrs().Name)
+	}
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM, int(nlconst.Htons(nlconst.ProtoARP)))
+	if err != nil {
+		return fmt.Errorf("failed to open packet socket: %v", err)
+	}
+	defer syscall.Close(fd)
+
+	// The sender and target of a gratuitous ARP are both the announced address.
+	arp := make([]byte, 28)
+	binary.BigEndian.PutUint16(arp[0:], 1) // Ethernet
+	binary.BigEndian.PutUint16(arp[2:], nlconst.ProtoIP)
+	arp[4], arp[5] = 6, 4
+	binary.BigEndian.PutUint16(arp[6:], 1) // request
+	copy(arp[8:], mac)
+	copy(arp[14:], ip)
+	copy(arp[24:], ip)
+
+	to := &syscall.SockaddrLinklayer{
+		Protocol: nlconst.Htons(nlconst.ProtoARP),
+		Ifindex:  link.Attrs().Index,
+		Halen:    6,
+		Addr:     [8]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+	}
+	if err = syscall.Sendto(fd, arp, 0, to); err != nil {
+		return fmt.Errorf("failed to send gratuitous ARP for %v: %v", ip, err)
+	}
+	return nil
+}
+
+// sendUnsolicitedNA sends a neighbour advertisement for ip with the override flag set to all nodes from link, which
+// owns it. The kernel fills in the checksum of ICMPv6 sockets, and sends it from the link-local address of link, as
+// ip may still be tentative.
+func sendUnsolicitedNA(link netlink.Link, ip net.IP) error {
+	mac := link.Attrs().HardwareAddr
+	if len(mac) != 6 {
+		return fmt.Errorf("%q has no Ethernet address to announce", link.Attrs().Name)
+	}
+	fd, err := syscall.Socket(syscall.AF_INET6, syscall.SOCK_RAW, syscall.IPPROTO_ICMPV6)
+	if err != nil {
+		return fmt.Errorf("failed to open ICMPv6 socket: %v", err)
+	}
+	defer syscall.Close(fd)
+	// Neighbour discovery messages are dropped unless their hop limit is 255.
+	if err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, 255); err != nil {
+		return fmt.Errorf("failed to set hop limit: %v", err)
+	}
+	if err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_IF, link.Attrs().Index); err != nil {
+		return fmt.Errorf("failed to select %q: %v", link.Attrs().Name, err)
+	}
+
+	na := make([]byte, 32)
+	na[0] = 136  // neighbour advertisement
+	na[4] = 0x20 // override
+	copy(na[8:], ip)
+	na[24], na[25] = 2, 1 // target link-layer address option, 8 bytes long
+	copy(na[26:], mac)
+
+	to := &syscall.SockaddrInet6{ZoneId: uint32(link.Attrs().Index)}
+	copy(to.Addr[:], net.IPv6linklocalallnodes)
+	if err = syscall.Sendto(fd, na, 0, to); err != nil {
+		return fmt.Errorf("failed to send neighbour advertisement for %v: %v", ip, err)
+	}
+	return nil
+}
@@ -0,0 +1,279 @@
+package utils
+
+import (
+	"fmt"
+
+	"github.com/projectcalico/cni-plugin/policy"
+	"github.com/projectcalico/cni-plugin/shaping"
+	"github.com/projectcalico/cni-plugin/state"
+	"github.com/vishvananda/netlink"
+)
+
+// NICHierarchy arranges the classes of the pods shaped on the uplink into a borrow hierarchy: a node root class
+// bounding all of them, group classes nested under it, and the classes of pods as leaves of the deepest group they
+// belong to. Each group is guaranteed its rate and borrows up to its ceil from its parent, so that pods of a team can
+// use what other teams leave idle. Without a hierarchy, the classes of pods are flat under the root qdisc.
+type NICHierarchy struct {
+	// Rate is the rate of the node root class in bits per second, usually the speed of the uplink.
+	Rate   uint64     `json:"rate"`
+	Groups []NICGroup `json:"groups,omitempty"`
+}
+
+// NICGroup is a group class of a NICHierarchy.
+type NICGroup struct {
+	Name string `json:"name"`
+	// Rate is guaranteed to the group, and Ceil is the most it can borrow up to from its parent, in bits per second.
+	// Ceil defaults to the rate of the parent.
+	Rate uint64 `json:"rate"`
+	Ceil uint64 `json:"ceil,omitempty"`
+	// Namespaces and Presets select the pods of the group, by namespace or cluster policy preset. A pod belongs to
+	// the first group selecting it at each level, and is placed in the deepest one.
+	Namespaces []string   `json:"namespaces,omitempty"`
+	Presets    []string   `json:"presets,omitempty"`
+	Groups     []NICGroup `json:"groups,omitempty"`
+}
+
+const (
+	// nicRootMinor is the minor of the node root class; the classes of groups follow it, clear of the minors of
+	// pods (up to maxNICClassMinor).
+	nicRootMinor = 0x1000
+
+	// maxNICGroupDepth is how deep groups can nest: HTB supports eight levels of classes, and the node root class
+	// and the classes of pods take two.
+	maxNICGroupDepth = 6
+)
+
+// nicHierarchyClass is a class of the hierarchy, as built on the uplink and its IFB device.
+type nicHierarchyClass struct {
+	name   string
+	minor  uint16
+	parent uint16
+	rate   uint64
+	ceil   uint64
+	buffer uint32
+	group  *NICGroup
+}
+
+// classes flattens h into its classes, parents first: the node root class, then the groups depth first.
+func (h *NICHierarchy) classes() []nicHierarchyClass {
+	if h == nil {
+		return nil
+	}
+	classes := []nicHierarchyClass{{
+		name:   "root",
+		minor:  nicRootMinor,
+		rate:   h.Rate,
+		ceil:   h.Rate,
+		buffer: hierarchyBuffer(h.Rate, groupsDepth(h.Groups)),
+	}}
+	var add func(groups []NICGroup, parent nicHierarchyClass)
+	add = func(groups []NICGroup, parent nicHierarchyClass) {
+		for i := range groups {
+			g := &groups[i]
+			c := nicHierarchyClass{
+				name:   g.Name,
+				minor:  nicRootMinor + uint16(len(classes)),
+				parent: parent.minor,
+				rate:   g.Rate,
+				ceil:   g.Ceil,
+				group:  g,
+			}
+			if c.ceil == 0 {
+				c.ceil = parent.rate
+			}
+			c.buffer = hierarchyBuffer(c.ceil, groupsDepth(g.Groups))
+			classes = append(classes, c)
+			add(g.Groups, c)
+		}
+	}
+	add(h.Groups, classes[0])
+	return classes
+}
+
+// hierarchyBuffer returns the burst in bytes of a class of the hierarchy with levels of groups below it. HTB only
+// lends tokens to children as fast as the parent's bucket refills, so each level gets the burst of a pod class more
+// than the level below it, and never less than what its ceil sends in a timer tick.
+func hierarchyBuffer(ceil uint64, levels int) uint32 {
+	buffer := uint64(hostVethClassBuffer) * uint64(levels+2)
+	if tick := uint64(float64(ceil/8)/netlink.Hz()) + 1600; tick > buffer {
+		buffer = tick
+	}
+	return uint32(buffer)
+}
+
+// groupsDepth returns how many levels groups nest.
+func groupsDepth(groups []NICGroup) int {
+	depth := 0
+	for _, g := range groups {
+		if d := 1 + groupsDepth(g.Groups); d > depth {
+			depth = d
+		}
+	}
+	return depth
+}
+
+// parentMinor returns the minor of the class the class of a pod in namespace with preset goes under: the deepest
+// group selecting it, or the node root class. It is 0, the root qdisc, without a hierarchy.
+func (h *NICHierarchy) parentMinor(namespace, preset string) uint16 {
+	chain := h.placement(namespace, preset)
+	if chain == nil {
+		return 0
+	}
+	return chain[len(chain)-1].minor
+}
+
+// GroupPath returns the names of the groups the class of a pod in namespace with preset is nested in, outermost
+// first, which is empty for pods directly under the node root class and without a hierarchy.
+func (h *NICHierarchy) GroupPath(namespace, preset string) []string {
+	var path []string
+	for i, c := range h.placement(namespace, preset) {
+		if i > 0 {
+			path = append(path, c.name)
+		}
+	}
+	return path
+}
+
+// placement returns the classes the class of a pod in namespace with preset is nested in, from the node root class
+// to the deepest group selecting it, taking the first group selecting it at each level. It is nil without a
+// hierarchy.
+func (h *NICHierarchy) placement(namespace, preset string) []nicHierarchyClass {
+	classes := h.classes()
+	if classes == nil {
+		return nil
+	}
+	chain := []nicHierarchyClass{classes[0]}
+	for {
+		parent := chain[len(chain)-1]
+		var next *nicHierarchyClass
+		for i := range classes {
+			if classes[i].parent == parent.minor && classes[i].group != nil && classes[i].group.selects(namespace, preset) {
+				next = &classes[i]
+				break
+			}
+		}
+		if next == nil {
+			return chain
+		}
+		chain = append(chain, *next)
+	}
+}
+
+// selects reports whether g lists namespace or preset, or whether one of its subgroups selects the pod.
+func (g *NICGroup) selects(namespace, preset string) bool {
+	for _, n := range g.Namespaces {
+		if n == namespace {
+			return true
+		}
+	}
+	for _, p := range g.Presets {
+		if p != "" && p == preset {
+			return true
+		}
+	}
+	for i := range g.Groups {
+		if g.Groups[i].selects(namespace, preset) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkNICHierarchy validates the nicHierarchy option.
+func checkNICHierarchy(conf NetConf) error {
+	h := conf.NICHierarchy
+	if h == nil {
+		return nil
+	}
+	if conf.ShapingMode != ShapingModeNIC {
+		return fmt.Errorf("nicHierarchy requires shapingMode %q", ShapingModeNIC)
+	}
+	if h.Rate == 0 {
+		return fmt.Errorf("nicHierarchy needs the rate of the node root class")
+	}
+	if depth := groupsDepth(h.Groups); depth > maxNICGroupDepth {
+		return fmt.Errorf("nicHierarchy groups nest %d levels deep, at most %d are supported", depth, maxNICGroupDepth)
+	}
+	names := map[string]bool{}
+	for _, c := range h.classes()[1:] {
+		switch {
+		case c.name == "" || names[c.name]:
+			return fmt.Errorf("nicHierarchy groups need unique names, got %q", c.name)
+		case c.rate == 0:
+			return fmt.Errorf("nicHierarchy group %q needs a rate", c.name)
+		case c.ceil < c.rate:
+			return fmt.Errorf("ceil of nicHierarchy group %q is below its rate", c.name)
+		}
+		names[c.name] = true
+	}
+	return nil
+}
+
+// resolveHostInterface returns conf with the nic shaping mode, uplink and node root class its host_interface and
+// node_total_bandwidth options stand for, after checking them against the options they set.
+func resolveHostInterface(conf NetConf) (NetConf, error) {
+	if conf.HostInterface == "" && conf.NodeTotalBandwidth == "" {
+		return conf, nil
+	}
+	if conf.HostInterface != "" {
+		switch {
+		case conf.ShapingMode != "" && conf.ShapingMode != ShapingModeNIC:
+			return conf, fmt.Errorf("host_interface shapes pods on the uplink and needs shapingMode %q", ShapingModeNIC)
+		case conf.NICName != "" && conf.NICName != conf.HostInterface:
+			return conf, fmt.Errorf("host_interface and nicName must be the same interface")
+		}
+		conf.ShapingMode = ShapingModeNIC
+		conf.NICName = conf.HostInterface
+	}
+	if conf.NodeTotalBandwidth == "" {
+		return conf, nil
+	}
+	if conf.ShapingMode != ShapingModeNIC {
+		return conf, fmt.Errorf("node_total_bandwidth needs host_interface or shapingMode %q", ShapingModeNIC)
+	}
+	rate, err := policy.ParseRate(conf.NodeTotalBandwidth)
+	if err != nil || rate == 0 {
+		return conf, fmt.Errorf("invalid node_total_bandwidth %q", conf.NodeTotalBandwidth)
+	}
+	h := NICHierarchy{Rate: rate}
+	if conf.NICHierarchy != nil {
+		if conf.NICHierarchy.Rate != 0 && conf.NICHierarchy.Rate != rate {
+			return conf, fmt.Errorf("node_total_bandwidth %s isn't the rate %d of nicHierarchy", conf.NodeTotalBandwidth,
+				conf.NICHierarchy.Rate)
+		}
+		h.Groups = conf.NICHierarchy.Groups
+	}
+	conf.NICHierarchy = &h
+	return conf, nil
+}
+
+// ensureNICGroups creates or updates the classes of the hierarchy on link, the uplink or its IFB device, and records
+// their names in the class registry of the uplink nic so that they can be told apart from the classes of pods.
+func ensureNICGroups(store *state.Store, nic string, link netlink.Link, h *NICHierarchy) error {
+	classes := h.classes()
+	if classes == nil {
+		return nil
+	}
+	for _, c := range classes {
+		class := netlink.NewHtbClass(netlink.ClassAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    netlink.MakeHandle(nicQdiscMajor, c.parent),
+			Handle:    netlink.MakeHandle(nicQdiscMajor, c.minor),
+		}, netlink.HtbClassAttrs{
+			Rate:    c.rate,
+			Ceil:    c.ceil,
+			Buffer:  c.buffer,
+			Cbuffer: c.buffer,
+		})
+		if err := shaping.ReplaceClass(class); err != nil {
+			return fmt.Errorf("failed to add class of group %q to %s: %v", c.name, link.Attrs().Name, err)
+		}
+	}
+	return store.UpdateNICClasses(nic, func(r *state.NICClasses, _ bool) error {
+		r.Groups = map[uint16]string{}
+		for _, c := range classes {
+			r.Groups[c.minor] = c.name
+		}
+		return nil
+	})
+}
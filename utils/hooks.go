@@ -0,0 +1,187 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/cni-plugin/metrics"
+	"github.com/projectcalico/cni-plugin/state"
+)
+
+// Hooks tell external systems, such as inventory or billing, which pod got which bandwidth: once the shaping of a
+// pod is applied by ADD, and once it is removed by DEL, each command is run with a HookEvent as JSON on its stdin,
+// and it is POSTed to each URL. A hook that fails or times out is logged, and doesn't fail the operation.
+type Hooks struct {
+	// PostAddExec and PostDelExec are the commands run after ADD and DEL, as argv lists, e.g.
+	// ["/usr/local/bin/notify", "--add"].
+	PostAddExec []string `json:"post_add_exec,omitempty"`
+	PostDelExec []string `json:"post_del_exec,omitempty"`
+	// PostAddURL and PostDelURL are the http or https URLs notified after ADD and DEL.
+	PostAddURL string `json:"post_add_url,omitempty"`
+	PostDelURL string `json:"post_del_url,omitempty"`
+	// Timeout bounds each command and request, as a duration such as "2s". Defaults to DefaultHookTimeout.
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// DefaultHookTimeout is how long a hook may take by default. ADD and DEL wait for their hooks, so it is short.
+const DefaultHookTimeout = 5 * time.Second
+
+// Events of a HookEvent.
+const (
+	HookEventAdd = "add"
+	HookEventDel = "del"
+)
+
+var hookFailures = metrics.NewCounter("flowcontrol_hook_failures_total",
+	"Hook commands and webhooks that failed or timed out.")
+
+// HookEvent is what hooks are given about the shaping of a pod.
+type HookEvent struct {
+	// Event is HookEventAdd or HookEventDel.
+	Event       string   `json:"event"`
+	ContainerID string   `json:"containerID"`
+	IfName      string   `json:"ifName"`
+	Namespace   string   `json:"namespace,omitempty"`
+	Pod         string   `json:"pod,omitempty"`
+	Workload    string   `json:"workload"`
+	IPs         []string `json:"ips,omitempty"`
+	HostVeth    string   `json:"hostVeth,omitempty"`
+	IFB         string   `json:"ifb,omitempty"`
+	ShapingMode string   `json:"shapingMode,omitempty"`
+	// Status is the status of the shaping after ADD, which is degraded if the pod was brought up without it.
+	Status string `json:"status,omitempty"`
+	// The rates of the pod in bits per second, zero if unlimited.
+	IngressRate uint64 `json:"ingressRate"`
+	EgressRate  uint64 `json:"egressRate"`
+	IngressCeil uint64 `json:"ingressCeil,omitempty"`
+	EgressCeil  uint64 `json:"egressCeil,omitempty"`
+}
+
+// checkHooks validates the hooks option.
+func checkHooks(h *Hooks) error {
+	if h == nil {
+		return nil
+	}
+	if h.Timeout != "" {
+		if d, err := time.ParseDuration(h.Timeout); err != nil || d <= 0 {
+			return fmt.Errorf("invalid hooks timeout %q, must be a positive duration", h.Timeout)
+		}
+	}
+	for _, c := range []struct {
+		name string
+		argv []string
+	}{{"post_add_exec", h.PostAddExec}, {"post_del_exec", h.PostDelExec}} {
+		if c.argv != nil && (len(c.argv) == 0 || c.argv[0] == "") {
+			return fmt.Errorf("hook %s has no command", c.name)
+		}
+	}
+	for _, c := range []struct{ name, url string }{{"post_add_url", h.PostAddURL}, {"post_del_url", h.PostDelURL}} {
+		if c.url == "" {
+			continue
+		}
+		if u, err := url.Parse(c.url); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("hook %s %q isn't an http or https URL", c.name, c.url)
+		}
+	}
+	return nil
+}
+
+// runHooks runs the hooks of h for event, HookEventAdd or HookEventDel, on the shaping recorded in r.
+func runHooks(h *Hooks, event string, r *state.Record, logger *log.Entry) {
+	if h == nil {
+		return
+	}
+	argv, hookURL := h.PostAddExec, h.PostAddURL
+	if event == HookEventDel {
+		argv, hookURL = h.PostDelExec, h.PostDelURL
+	}
+	if len(argv) == 0 && hookURL == "" {
+		return
+	}
+	timeout := DefaultHookTimeout
+	if h.Timeout != "" {
+		if d, err := time.ParseDuration(h.Timeout); err == nil && d > 0 {
+			timeout = d
+		}
+	}
+	body, err := json.Marshal(hookEvent(event, r))
+	if err != nil {
+		logger.WithError(err).Warn("Failed to encode hook event")
+		return
+	}
+	if len(argv) != 0 {
+		if err = execHook(argv, body, timeout); err != nil {
+			hookFailures.Inc()
+			logger.WithError(err).WithField("command", argv[0]).Warn("Hook command failed")
+		}
+	}
+	if hookURL != "" {
+		if err = postHook(hookURL, body, timeout); err != nil {
+			hookFailures.Inc()
+			logger.WithError(err).WithField("url", hookURL).Warn("Webhook failed")
+		}
+	}
+}
+
+// hookEvent returns the event of hooks on the shaping recorded in r.
+func hookEvent(event string, r *state.Record) *HookEvent {
+	return &HookEvent{
+		Event:       event,
+		ContainerID: r.ContainerID,
+		IfName:      r.IfName,
+		Namespace:   r.Namespace,
+		Pod:         r.Pod,
+		Workload:    r.Workload,
+		IPs:         r.IPs,
+		HostVeth:    r.HostVeth,
+		IFB:         r.IFB,
+		ShapingMode: r.ShapingMode,
+		Status:      r.Status,
+		IngressRate: r.IngressRate,
+		EgressRate:  r.EgressRate,
+		IngressCeil: r.IngressCeil,
+		EgressCeil:  r.EgressCeil,
+	}
+}
+
+// execHook runs the command argv with body on its stdin, killing it after timeout.
+func execHook(argv []string, body []byte, timeout time.Duration) error {
+	cmd := exec.Command(argv[0], argv[1:]...)
+	var stderr bytes.Buffer
+	cmd.Stdin, cmd.Stderr = bytes.NewReader(body), &stderr
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to run %s: %v", argv[0], err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("%s failed: %v: %s", argv[0], err, bytes.TrimSpace(stderr.Bytes()))
+		}
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		return fmt.Errorf("%s timed out after %v", argv[0], timeout)
+	}
+	return nil
+}
+
+// postHook POSTs body to hookURL as JSON, expecting a 2xx status.
+func postHook(hookURL string, body []byte, timeout time.Duration) error {
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Post(hookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/cni-plugin/internal/nlconst"
+	"github.com/projectcalico/cni-plugin/metrics"
+	"github.com/projectcalico/cni-plugin/state"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// Hardware offload: with NetConf.NICOffload, the traffic to a pod shaped on the uplink is also policed to its rate
+// by flower filters that only exist in the hardware of the uplink (skip_sw), so that the NIC drops what exceeds the
+// rate before it costs the host anything. The pod's class on the IFB device stays in place behind them; it counts
+// the traffic and only has to hold it back where the hardware let through more than the rate. NICs that refuse the
+// filters leave the pod shaped in software alone. Traffic from pods leaves through the root HTB qdisc of the uplink,
+// which can't be offloaded, and is always shaped in software.
+
+var nicOffloadFallbacks = metrics.NewCounter("flowcontrol_nic_offload_fallbacks_total",
+	"Pods whose traffic the uplink refused to police in hardware, shaped in software instead, by uplink.", "nic")
+
+// Attributes of the flower classifier and flags of tc classifiers, from linux/pkt_cls.h, which netlink lacks.
+const (
+	tcaFlowerAct           = 3
+	tcaFlowerKeyEthType    = 8
+	tcaFlowerKeyIPv4Dst    = 12
+	tcaFlowerKeyIPv4DstMsk = 13
+	tcaFlowerKeyIPv6Dst    = 16
+	tcaFlowerKeyIPv6DstMsk = 17
+	tcaFlowerFlags         = 22
+
+	tcaClsFlagsSkipSW = 1 << 1
+)
+
+// Priorities of the offloaded filters on the ingress qdisc of the uplink, after the redirect to its IFB device.
+// Filters that skip software are never run by the host, so their order only matters to the NIC.
+const (
+	nicOffloadPrioV4 = 2
+	nicOffloadPrioV6 = 3
+)
+
+// checkNICOffload validates the nicOffload option.
+func checkNICOffload(conf NetConf) error {
+	if conf.NICOffload && conf.ShapingMode != ShapingModeNIC {
+		return fmt.Errorf("nicOffload requires shapingMode %q", ShapingModeNIC)
+	}
+	return nil
+}
+
+// setupNICOffload polices the traffic to the addresses of the pod with the given class minor to rate bits per
+// second in the hardware of nic. It returns whether the NIC took the filters; if it didn't, whatever it took of
+// them is removed, so that the pod is only shaped in software.
+func setupNICOffload(nic netlink.Link, minor uint16, rate uint64, ips []net.IP) bool {
+	err := replaceNICOffload(nic, minor, rate, ips)
+	if err == nil {
+		return true
+	}
+	nicOffloadFallbacks.Inc(nic.Attrs().Name)
+	tcLog.WithError(err).WithFields(log.Fields{"nic": nic.Attrs().Name, "class": minor}).Warn(
+		"Uplink refused to police pod in hardware, shaping it in software")
+	deleteNICOffload(nic, minor)
+	return false
+}
+
+// replaceNICOffload adds, or updates, the offloaded filters policing the traffic to each of ips.
+func replaceNICOffload(nic netlink.Link, minor uint16, rate uint64, ips []net.IP) error {
+	if rate/8 > math.MaxUint32 {
+		return fmt.Errorf("rate %d is too high to police in hardware", rate)
+	}
+	for i, ip := range ips {
+		handle := nicFilterHandle(minor, i)
+		err := countNetlink("FilterReplace", func() error { return replaceOffloadFilter(nic, handle, rate, ip) })
+		if err != nil {
+			return fmt.Errorf("failed to offload filter for %s to %s: %v", ip, nic.Attrs().Name, err)
+		}
+	}
+	return nil
+}
+
+// replaceOffloadFilter adds, or replaces, the flower filter with handle on the ingress qdisc of nic, only in its
+// hardware, that drops traffic to ip over rate bits per second.
+func replaceOffloadFilter(nic netlink.Link, handle uint32, rate uint64, ip net.IP) error {
+	prio, proto := uint16(nicOffloadPrioV4), nlconst.ProtoIP
+	dstAttr, maskAttr := tcaFlowerKeyIPv4Dst, tcaFlowerKeyIPv4DstMsk
+	addr := ip.To4()
+	if addr == nil {
+		prio, proto = nicOffloadPrioV6, nlconst.ProtoIPv6
+		dstAttr, maskAttr = tcaFlowerKeyIPv6Dst, tcaFlowerKeyIPv6DstMsk
+		addr = ip.To16()
+	}
+	req := nl.NewNetlinkRequest(syscall.RTM_NEWTFILTER, syscall.NLM_F_CREATE|syscall.NLM_F_REPLACE|syscall.NLM_F_ACK)
+	req.AddData(&nl.TcMsg{
+		Family:  nl.FAMILY_ALL,
+		Ifindex: int32(nic.Attrs().Index),
+		Handle:  handle,
+		Parent:  netlink.MakeHandle(0xffff, 0),
+		Info:    nlconst.FilterInfo(prio, proto),
+	})
+	req.AddData(nl.NewRtAttr(nl.TCA_KIND, nl.ZeroTerminated("flower")))
+
+	options := nl.NewRtAttr(nl.TCA_OPTIONS, nil)
+	nl.NewRtAttrChild(options, tcaFlowerKeyEthType, nl.Uint16Attr(nlconst.Htons(proto)))
+	nl.NewRtAttrChild(options, dstAttr, []byte(addr))
+	mask := make([]byte, len(addr))
+	for i := range mask {
+		mask[i] = 0xff
+	}
+	nl.NewRtAttrChild(options, maskAttr, mask)
+	nl.NewRtAttrChild(options, tcaFlowerFlags, nl.Uint32Attr(tcaClsFlagsSkipSW))
+
+	police := nl.TcPolice{Action: netlink.TC_ACT_SHOT}
+	police.Rate.Rate = uint32(rate / 8)
+	var rtab [256]uint32
+	if netlink.CalcRtable(&police.Rate, rtab, -1, 0, nl.LINKLAYER_ETHERNET) < 0 {
+		return errors.New("police: failed to calculate rate table")
+	}
+	police.Burst = uint32(netlink.Xmittime(uint64(police.Rate.Rate), nicClassBuffer(rate).buffer))
+	actions := nl.NewRtAttrChild(options, tcaFlowerAct, nil)
+	action := nl.NewRtAttrChild(actions, 1, nil)
+	nl.NewRtAttrChild(action, nl.TCA_ACT_KIND, nl.ZeroTerminated("police"))
+	actOptions := nl.NewRtAttrChild(action, nl.TCA_ACT_OPTIONS, nil)
+	nl.NewRtAttrChild(actOptions, nl.TCA_POLICE_TBF, police.Serialize())
+	nl.NewRtAttrChild(actOptions, nl.TCA_POLICE_RATE, netlink.SerializeRtab(rtab))
+	req.AddData(options)
+
+	_, err := req.Execute(syscall.NETLINK_ROUTE, 0)
+	return err
+}
+
+// deleteNICOffload removes the offloaded filters of the pod with the given class minor from nic, if it has any.
+func deleteNICOffload(nic netlink.Link, minor uint16) {
+	filters, err := netlink.FilterList(nic, netlink.MakeHandle(0xffff, 0))
+	if err != nil {
+		return
+	}
+	for _, f := range filters {
+		attrs := f.Attrs()
+		if f.Type() != "flower" ||
+			(attrs.Handle != nicFilterHandle(minor, 0) && attrs.Handle != nicFilterHandle(minor, 1)) {
+			continue
+		}
+		if err = countNetlink("FilterDel", func() error { return netlink.FilterDel(f) }); err != nil && err != syscall.ENOENT {
+			tcLog.WithError(err).WithField("nic", nic.Attrs().Name).Warn("Failed to delete offloaded filter")
+		}
+	}
+}
+
+// recordIPs parses the addresses of the pod of r.
+func recordIPs(r *state.Record) []net.IP {
+	var ips []net.IP
+	for _, s := range r.IPs {
+		if ip := net.ParseIP(s); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// setNICOffloadRate changes the rate the traffic to the pod of r is policed to in hardware, if it is. A NIC that
+// refuses the new rate leaves the pod shaped in software alone, as if it never took the filters.
+func setNICOffloadRate(r *state.Record, rate uint64) error {
+	if !r.NICOffloaded {
+		return nil
+	}
+	nic, err := netlink.LinkByName(r.NIC)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", r.NIC, err)
+	}
+	r.NICOffloaded = setupNICOffload(nic, r.NICClassMinor, rate, recordIPs(r))
+	return nil
+}
@@ -0,0 +1,171 @@
+package utils
+
+import (
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/projectcalico/cni-plugin/shaping"
+	"github.com/projectcalico/cni-plugin/state"
+	"github.com/vishvananda/netlink"
+)
+
+// ShapingModeContainer is the shaping mode recorded for pods shaped inside their network namespace, on the
+// container end of their veth, with the shape_in_container option. What the container end transmits is what the pod
+// sends, so its root qdisc shapes egress, and what it receives can only be policed, by a filter of its ingress qdisc.
+const ShapingModeContainer = "container"
+
+// checkShapeInContainer validates the shape_in_container option. The qdiscs of the container end hold a single
+// class per direction, so the options that divide traffic into classes are rejected.
+func checkShapeInContainer(conf NetConf) error {
+	if !conf.ShapeInContainer {
+		return nil
+	}
+	switch {
+	case conf.ShapingMode == ShapingModeNIC || conf.ShapingMode == ShapingModeNFTables:
+		return fmt.Errorf("shape_in_container isn't supported by the %s shaping mode", conf.ShapingMode)
+	case conf.Backend == BackendEBPF:
+		return fmt.Errorf("shape_in_container can't be combined with backend %q", BackendEBPF)
+	case conf.ProtocolSplit != nil:
+		return fmt.Errorf("shape_in_container can't be combined with protocolSplit")
+	case len(conf.Classes) != 0 || peersSet(conf):
+		return fmt.Errorf("shape_in_container can't be combined with classes or cluster_cidrs")
+	case conf.DSCP != nil:
+		return fmt.Errorf("shape_in_container can't be combined with dscp")
+	}
+	return nil
+}
+
+// lazyContainerShaping reports whether the pod of rates is shaped in its network namespace for the lazy_ifb option,
+// rather than with an IFB device: it is only limited in egress, and conf has no option shaping in the namespace
+// can't do.
+func lazyContainerShaping(conf NetConf, rates ShapingRates) bool {
+	if !conf.LazyIFB || rates.Ingress != 0 || rates.Egress == 0 {
+		return false
+	}
+	conf.ShapeInContainer = true
+	return checkShapeInContainer(conf) == nil
+}
+
+// setupContainerShaping shapes the pod of record in its network namespace netns, on its interface ifName: egress
+// with a TBF qdisc, or the HTB class of generation 0 if the options need one, at its root, and ingress with a
+// policer on its ingress qdisc. record is filled in with what is set up before it is, for a failed setup to be
+// rolled back.
+func setupContainerShaping(netns, ifName string, conf NetConf, rates ShapingRates, record *state.Record, logger *log.Entry) error {
+	record.ShapingMode = ShapingModeContainer
+	record.Netns = netns
+	tbf := singleClass(conf) && conf.Backend == ""
+	if tbf {
+		record.Qdisc = QdiscTBF
+	}
+	bursts := burstsOf(conf)
+	_, egressCeil := CeilsOf(record, rates.Ingress, rates.Egress)
+	return ns.WithNetNSPath(netns, func(ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+		}
+		if rates.Egress != 0 {
+			if tbf {
+				err = replaceTBF(ifName, shaping.HostVethQdiscMajor, rates.Egress, bursts.egress(rates.Egress).buffer)
+			} else {
+				err = setupIngressShaping(link, 0, rates.Egress, egressCeil, bursts.egress(rates.Egress), conf.LatencyClass,
+					conf.LeafQdisc, conf.ClassPriority, conf.NonIPPolicy, conf.IPFamilyBudget, conf.Classifier, "")
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if rates.Ingress != 0 {
+			if err = shaping.SetupPolicer(link, rates.Ingress, bursts.ingress(rates.Ingress).buffer); err != nil {
+				return err
+			}
+		}
+		logger.WithFields(log.Fields{"interface": ifName, "netns": netns}).Info("Shaped pod inside its network namespace")
+		return nil
+	})
+}
+
+// teardownContainerShaping removes the qdiscs shaping the pod of r inside its network namespace, if it is still
+// there.
+func teardownContainerShaping(r *state.Record, logger *log.Entry) {
+	err := ns.WithNetNSPath(r.Netns, func(ns.NetNS) error {
+		link, err := netlink.LinkByName(r.IfName)
+		if err != nil {
+			return err
+		}
+		shaping.Teardown(link)
+		return nil
+	})
+	if err != nil {
+		logger.WithError(err).WithField("netns", r.Netns).Debug("No shaping to remove in the network namespace of the pod")
+	}
+}
+
+// setContainerRates changes the rates of the pod of r shaped inside its network namespace. Only directions that
+// were limited when the pod was set up have a qdisc or policer to change.
+func setContainerRates(r *state.Record, ingressRate, egressRate, egressCeil uint64) error {
+	bursts := BurstsOf(r)
+	return ns.WithNetNSPath(r.Netns, func(ns.NetNS) error {
+		if r.EgressRate != 0 {
+			var err error
+			if r.Qdisc == QdiscTBF {
+				err = replaceTBF(r.IfName, shaping.HostVethQdiscMajor, egressRate, bursts.egress(egressRate).buffer)
+			} else {
+				err = setGenerationRates(r.IfName, shaping.HostVethQdiscMajor, containerMinors(r), egressRate, egressCeil,
+					bursts.egress(egressRate), HTBPrio(r.LatencyClass, r.ClassPriority), ProtocolSplit{}, nil)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if r.IngressRate == 0 {
+			return nil
+		}
+		link, err := netlink.LinkByName(r.IfName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", r.IfName, err)
+		}
+		return shaping.SetupPolicer(link, ingressRate, bursts.ingress(ingressRate).buffer)
+	})
+}
+
+// verifyContainerShaping checks the root qdisc shaping the egress of the pod of r inside its network namespace
+// against egress and egressCeil. The policer of ingress has no rate to read back.
+func verifyContainerShaping(r *state.Record, egress, egressCeil uint64) []string {
+	if r.EgressRate == 0 {
+		return nil
+	}
+	var problems []string
+	err := ns.WithNetNSPath(r.Netns, func(ns.NetNS) error {
+		const major = shaping.HostVethQdiscMajor
+		if r.Qdisc == QdiscTBF {
+			problems = verifyTBF(r.IfName, major, egress)
+			return nil
+		}
+		problems = verifyRootQdisc(r.IfName, major, "htb")
+		parent := shaping.ParentMinor(egress, egressCeil)
+		if parent != 0 {
+			problems = append(problems, verifyClass(r.IfName, major, 0, parent, egressCeil)...)
+		}
+		for _, minor := range containerMinors(r) {
+			problems = append(problems, verifyClass(r.IfName, major, parent, minor, egress)...)
+		}
+		problems = append(problems, verifyClassifier(r.IfName, major, shaping.FilterBase(0), shaping.ClassMinor(0))...)
+		return nil
+	})
+	if err != nil {
+		return []string{fmt.Sprintf("network namespace %s not found", r.Netns)}
+	}
+	return problems
+}
+
+// containerMinors returns the minors of the HTB classes shaping the egress of the pod of r inside its network
+// namespace, which are those of generation 0: the hierarchy there is never swapped.
+func containerMinors(r *state.Record) []uint16 {
+	minors := []uint16{shaping.ClassMinor(0)}
+	if r.IPFamilyBudget == IPFamilyBudgetSeparate {
+		minors = append(minors, shaping.ClassMinor(shaping.IPv6Generation(0)))
+	}
+	return minors
+}
@@ -0,0 +1,36 @@
+package utils
+
+import (
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/cni-plugin/state"
+	"github.com/vishvananda/netlink"
+)
+
+// ProcessAlive reports whether the process with the given PID still exists.
+func ProcessAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// CleanUpInterrupted removes whatever an interrupted operation may have left behind: the devices it was creating
+// or deleting and, since the container's shaping is in an unknown state, its shaping record.
+func CleanUpInterrupted(conf NetConf, e *state.Entry, logger *log.Entry) error {
+	return withHostNetNS(conf.HostNetNS, func() error {
+		for _, name := range []string{e.IFB, e.HostVeth} {
+			if name == "" {
+				continue
+			}
+			link, err := netlink.LinkByName(name)
+			if err != nil {
+				continue
+			}
+			logger.WithField("interface", name).Info("Deleting interface left behind by an interrupted operation")
+			if err = countNetlink("LinkDel", func() error { return netlink.LinkDel(link) }); err != nil {
+				return err
+			}
+		}
+		return removeShapingRecord(state.NewStore(conf.StateDir), e.Key(), logger)
+	})
+}
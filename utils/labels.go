@@ -0,0 +1,155 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// LabelSource resolves the rates of containers started outside Kubernetes, by Docker or containerd directly, from
+// their labels, which the plugin reads from the container runtime when the bandwidth isn't otherwise given.
+type LabelSource struct {
+	// Runtime is "docker" or "containerd".
+	Runtime string `json:"runtime"`
+	// Endpoint is the runtime's socket, DefaultDockerEndpoint or DefaultContainerdEndpoint if empty.
+	Endpoint string `json:"endpoint"`
+	// Namespace is the containerd namespace of the containers, DefaultContainerdNamespace if empty.
+	Namespace string `json:"namespace"`
+	// IngressLabel and EgressLabel are the labels holding the rates, in the format of the bandwidth annotations.
+	// They default to the names of the annotations.
+	IngressLabel string `json:"ingressLabel"`
+	EgressLabel  string `json:"egressLabel"`
+	// Timeout bounds the query to the runtime, as a duration such as "2s". Defaults to DefaultLabelTimeout.
+	Timeout string `json:"timeout"`
+}
+
+// Values of LabelSource.Runtime.
+const (
+	LabelRuntimeDocker     = "docker"
+	LabelRuntimeContainerd = "containerd"
+)
+
+// Defaults of LabelSource.
+const (
+	DefaultDockerEndpoint      = "/var/run/docker.sock"
+	DefaultContainerdEndpoint  = "/run/containerd/containerd.sock"
+	DefaultContainerdNamespace = "default"
+	DefaultLabelTimeout        = 5 * time.Second
+
+	defaultIngressLabel = "kubernetes.io/ingress-bandwidth"
+	defaultEgressLabel  = "kubernetes.io/egress-bandwidth"
+)
+
+// ratesFromLabels returns the ingress and egress bandwidth labels of the container containerID, empty if it doesn't
+// have them.
+func ratesFromLabels(src *LabelSource, containerID string, logger *log.Entry) (string, string, error) {
+	var err error
+	timeout := DefaultLabelTimeout
+	if src.Timeout != "" {
+		if timeout, err = time.ParseDuration(src.Timeout); err != nil {
+			return "", "", fmt.Errorf("invalid labelSource timeout %q: %v", src.Timeout, err)
+		}
+	}
+	var labels map[string]string
+	switch src.Runtime {
+	case LabelRuntimeDocker:
+		labels, err = dockerLabels(src, containerID, timeout)
+	case LabelRuntimeContainerd:
+		labels, err = containerdLabels(src, containerID, timeout)
+	default:
+		return "", "", fmt.Errorf("unknown labelSource runtime %q, must be %q or %q", src.Runtime,
+			LabelRuntimeDocker, LabelRuntimeContainerd)
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read labels of container %q: %v", containerID, err)
+	}
+
+	ingressLabel, egressLabel := src.IngressLabel, src.EgressLabel
+	if ingressLabel == "" {
+		ingressLabel = defaultIngressLabel
+	}
+	if egressLabel == "" {
+		egressLabel = defaultEgressLabel
+	}
+	ingress, egress := labels[ingressLabel], labels[egressLabel]
+	logger.WithFields(log.Fields{
+		"runtime": src.Runtime,
+		"ingress": ingress,
+		"egress":  egress,
+	}).Debug("Read bandwidth from container labels")
+	return ingress, egress, nil
+}
+
+// dockerLabels inspects a container through the Docker Engine API.
+func dockerLabels(src *LabelSource, containerID string, timeout time.Duration) (map[string]string, error) {
+	endpoint := src.Endpoint
+	if endpoint == "" {
+		endpoint = DefaultDockerEndpoint
+	}
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Dial: func(_, _ string) (net.Conn, error) {
+				return net.Dial("unix", endpoint)
+			},
+		},
+	}
+	resp, err := client.Get("http://docker/containers/" + containerID + "/json")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("docker returned %s", resp.Status)
+	}
+	var inspect struct {
+		Config struct {
+			Labels map[string]string
+		}
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&inspect); err != nil {
+		return nil, fmt.Errorf("failed to decode container: %v", err)
+	}
+	return inspect.Config.Labels, nil
+}
+
+// containerdLabels reads the labels of a container with ctr, since containerd only serves its API over gRPC.
+func containerdLabels(src *LabelSource, containerID string, timeout time.Duration) (map[string]string, error) {
+	endpoint, namespace := src.Endpoint, src.Namespace
+	if endpoint == "" {
+		endpoint = DefaultContainerdEndpoint
+	}
+	if namespace == "" {
+		namespace = DefaultContainerdNamespace
+	}
+	cmd := exec.Command("ctr", "--address", endpoint, "--namespace", namespace, "containers", "info", containerID)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to run ctr: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			return nil, fmt.Errorf("ctr failed: %v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+		}
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		return nil, fmt.Errorf("ctr timed out after %v", timeout)
+	}
+	var info struct {
+		Labels map[string]string
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &info); err != nil {
+		return nil, fmt.Errorf("failed to decode container: %v", err)
+	}
+	return info.Labels, nil
+}
@@ -0,0 +1,37 @@
+package utils
+
+import (
+	"fmt"
+
+	"github.com/projectcalico/cni-plugin/shaping"
+)
+
+// checkLeafQdisc validates the leaf_qdisc option. The leaf qdisc goes under the class of each direction of a pod, so
+// it can't be combined with the leaf classes of a protocol split or traffic classes, and pods in the low latency
+// class always get fq_codel.
+func checkLeafQdisc(conf NetConf) error {
+	switch conf.LeafQdisc {
+	case "":
+		return nil
+	case shaping.LeafFQCodel, shaping.LeafSFQ, shaping.LeafPFIFO:
+	default:
+		return fmt.Errorf("invalid leaf_qdisc %q, must be %q, %q or %q", conf.LeafQdisc, shaping.LeafFQCodel,
+			shaping.LeafSFQ, shaping.LeafPFIFO)
+	}
+	switch {
+	case conf.ShapingMode == ShapingModeNIC || conf.ShapingMode == ShapingModeNFTables:
+		return fmt.Errorf("leaf_qdisc isn't supported by the %s shaping mode", conf.ShapingMode)
+	case conf.Backend == BackendEBPF:
+		return fmt.Errorf("leaf_qdisc isn't supported by the %s backend", BackendEBPF)
+	case conf.ProtocolSplit != nil:
+		return fmt.Errorf("leaf_qdisc can't be combined with protocolSplit")
+	case len(conf.Classes) != 0:
+		return fmt.Errorf("leaf_qdisc can't be combined with classes")
+	case peersSet(conf):
+		return fmt.Errorf("leaf_qdisc can't be combined with cluster_cidrs")
+	case conf.LatencyClass == LatencyClassLow && conf.LeafQdisc != shaping.LeafFQCodel:
+		return fmt.Errorf("latencyClass %q always uses %s, leaf_qdisc %q can't be combined with it", LatencyClassLow,
+			shaping.LeafFQCodel, conf.LeafQdisc)
+	}
+	return nil
+}
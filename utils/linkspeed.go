@@ -0,0 +1,89 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Values of NetConf.LinkSpeedPolicy.
+const (
+	LinkSpeedPolicyIgnore = "ignore"
+	LinkSpeedPolicyClamp  = "clamp"
+	LinkSpeedPolicyReject = "reject"
+)
+
+// sysClassNet is where the kernel reports the speed of network devices, as ethtool does.
+const sysClassNet = "/sys/class/net"
+
+// linkSpeed returns the speed of a device in bits per second, or 0 if it doesn't report one, as virtual devices
+// don't.
+func linkSpeed(name string) (uint64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(sysClassNet, name, "speed"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read the speed of %q: %v", name, err)
+	}
+	// Devices without a known speed, such as ones with no carrier, report -1.
+	mbps, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil || mbps <= 0 {
+		return 0, nil
+	}
+	return uint64(mbps) * 1000 * 1000, nil
+}
+
+// checkLinkSpeed applies conf.LinkSpeedPolicy to the rates of a pod, which can't be reached if they exceed the speed
+// of the node's uplink: they are left alone (the default), lowered to the link speed with a warning, or rejected.
+// The link speed isn't checked if the uplink doesn't report one.
+func checkLinkSpeed(conf NetConf, rates *ShapingRates, logger *log.Entry) error {
+	switch conf.LinkSpeedPolicy {
+	case "", LinkSpeedPolicyIgnore:
+		return nil
+	case LinkSpeedPolicyClamp, LinkSpeedPolicyReject:
+	default:
+		return fmt.Errorf("invalid linkSpeedPolicy %q, must be %q, %q or %q", conf.LinkSpeedPolicy,
+			LinkSpeedPolicyIgnore, LinkSpeedPolicyClamp, LinkSpeedPolicyReject)
+	}
+	if rates.Ingress == 0 && rates.Egress == 0 {
+		return nil
+	}
+	nic, err := uplinkName(conf)
+	if err != nil {
+		return err
+	}
+	speed, err := linkSpeed(nic)
+	if err != nil {
+		return err
+	}
+	if speed == 0 {
+		logger.WithField("nic", nic).Debug("Uplink doesn't report its speed, not checking rates against it")
+		return nil
+	}
+
+	for _, d := range []struct {
+		direction string
+		rate      *uint64
+	}{{"ingress", &rates.Ingress}, {"egress", &rates.Egress}} {
+		if *d.rate <= speed {
+			continue
+		}
+		if conf.LinkSpeedPolicy == LinkSpeedPolicyReject {
+			return &ShapingError{
+				Code: ErrCodeRateAboveLinkSpeed,
+				Err:  fmt.Errorf("%s rate %d bit/s is above the speed of %s, %d bit/s", d.direction, *d.rate, nic, speed),
+				Hint: fmt.Sprintf("request at most %d bit/s, or set linkSpeedPolicy to %q to lower rates to the link speed", speed, LinkSpeedPolicyClamp),
+			}
+		}
+		logger.WithFields(log.Fields{
+			"direction": d.direction,
+			"requested": *d.rate,
+			"nic":       nic,
+			"speed":     speed,
+		}).Warn("Requested rate is above the speed of the uplink, using the link speed instead")
+		*d.rate = speed
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// HostVethMAC returns the MAC of the host veth of the pod with the given UID: a unicast, locally administered
+// address derived from the UID, so that the pod keeps the same host-side MAC across restarts of its sandbox.
+func HostVethMAC(podUID string) net.HardwareAddr {
+	sum := sha256.Sum256([]byte(podUID))
+	mac := net.HardwareAddr(sum[:6])
+	mac[0] = mac[0]&^0x01 | 0x02
+	return mac
+}
+
+// podUID returns the UID of the Kubernetes pod from the CNI args, or the container ID if the runtime doesn't pass
+// it.
+func podUID(args *skel.CmdArgs) string {
+	k8sArgs := K8sArgs{}
+	if err := types.LoadArgs(args.Args, &k8sArgs); err == nil && k8sArgs.K8S_POD_UID != "" {
+		return string(k8sArgs.K8S_POD_UID)
+	}
+	return args.ContainerID
+}
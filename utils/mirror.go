@@ -0,0 +1,31 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxIfNameLen is the longest name the kernel accepts for a network interface.
+const maxIfNameLen = 15
+
+// checkMirrorTo validates the mirror_to option. Traffic is mirrored by the filters classifying it into the HTB
+// classes of the veth shaping of a pod and redirecting it to its IFB device, so the option is rejected where those
+// filters don't exist.
+func checkMirrorTo(conf NetConf) error {
+	if conf.MirrorTo == "" {
+		return nil
+	}
+	switch {
+	case len(conf.MirrorTo) > maxIfNameLen || strings.ContainsAny(conf.MirrorTo, "/ "):
+		return fmt.Errorf("invalid mirror_to %q, must be the name of a host interface", conf.MirrorTo)
+	case conf.ShapingMode == ShapingModeNIC || conf.ShapingMode == ShapingModeNFTables:
+		return fmt.Errorf("mirror_to isn't supported by the %s shaping mode", conf.ShapingMode)
+	case conf.Backend == BackendEBPF:
+		return fmt.Errorf("mirror_to can't be combined with backend %q", BackendEBPF)
+	case conf.ShapeInContainer:
+		return fmt.Errorf("mirror_to can't be combined with shape_in_container")
+	case conf.DSCP != nil:
+		return fmt.Errorf("mirror_to can't be combined with dscp")
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package utils
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/projectcalico/cni-plugin/internal/util"
+	"github.com/projectcalico/cni-plugin/state"
+	k8sbackend "github.com/projectcalico/libcalico-go/lib/backend/k8s"
+)
+
+// Values of NamingConf.Strategy.
+const (
+	// NamingCalico names devices as calico-cni does: host veths of Kubernetes pods after a hash of the workload,
+	// other host veths and IFB devices after the container ID, and those of secondary interfaces as the hash
+	// strategy does. It is the default, and the only strategy in compatibility mode.
+	NamingCalico = "calico"
+	// NamingPrefix appends as much of the container ID as fits to the prefixes, or for secondary interfaces what the
+	// hash strategy does.
+	NamingPrefix = "prefix"
+	// NamingHash appends as much of the SHA-1 of the container ID and interface name as fits to the prefixes, so
+	// that neither containers whose IDs share a prefix nor the interfaces of a container on several networks
+	// collide.
+	NamingHash = "hash"
+	// NamingSequential appends a number allocated from a registry in the state directory to the prefixes, so
+	// names stay short and predictable.
+	NamingSequential = "sequential"
+)
+
+// Default device name prefixes. Calico's Felix must be configured with the host veth prefix if it is changed.
+const (
+	defaultVethPrefix = "cali"
+	defaultIFBPrefix  = "ifb"
+)
+
+// NamingConf selects how the host-side devices of a container are named, so that they can follow the
+// interface-naming conventions of a fleet and match its monitoring.
+type NamingConf struct {
+	Strategy   string `json:"strategy"`
+	VethPrefix string `json:"vethPrefix"`
+	IFBPrefix  string `json:"ifbPrefix"`
+}
+
+// Namer picks the names of the host-side devices of a container. A namer returns the same names for a container
+// every time, until they are released.
+type Namer interface {
+	HostVethName(args *skel.CmdArgs) (string, error)
+	IFBName(args *skel.CmdArgs) (string, error)
+	// Release frees the names of the interface of a container stored under key, for namers that allocate them.
+	Release(key string) error
+}
+
+// NewNamer returns the namer configured in conf. The host_veth_prefix and ifb_prefix options set the prefixes of
+// the naming configuration, and select the hash strategy if it doesn't set one.
+func NewNamer(conf NetConf) (Namer, error) {
+	naming := conf.Naming
+	for _, p := range []struct {
+		option, value string
+		prefix        *string
+	}{
+		{"host_veth_prefix", conf.HostVethPrefix, &naming.VethPrefix},
+		{"ifb_prefix", conf.IFBPrefix, &naming.IFBPrefix},
+	} {
+		if p.value == "" {
+			continue
+		}
+		if *p.prefix != "" && *p.prefix != p.value {
+			return nil, fmt.Errorf("%s %q conflicts with the prefix %q of the naming configuration", p.option, p.value, *p.prefix)
+		}
+		*p.prefix = p.value
+		if naming.Strategy == "" {
+			naming.Strategy = NamingHash
+		}
+	}
+	if conf.CalicoCompat || naming.Strategy == "" || naming.Strategy == NamingCalico {
+		if naming.VethPrefix != "" || naming.IFBPrefix != "" {
+			return nil, fmt.Errorf("the %s naming strategy doesn't support custom prefixes", NamingCalico)
+		}
+		return calicoNamer{}, nil
+	}
+	if naming.VethPrefix == "" {
+		naming.VethPrefix = defaultVethPrefix
+	}
+	if naming.IFBPrefix == "" {
+		naming.IFBPrefix = defaultIFBPrefix
+	}
+	// Leave room for at least four characters after the prefixes.
+	for _, prefix := range []string{naming.VethPrefix, naming.IFBPrefix} {
+		if len(prefix) > util.MaxIfNameLen-4 {
+			return nil, fmt.Errorf("device name prefix %q is too long", prefix)
+		}
+	}
+	switch naming.Strategy {
+	case NamingPrefix:
+		return suffixNamer{naming, func(args *skel.CmdArgs) string {
+			if state.Secondary(args.IfName) {
+				return interfaceHash(args)
+			}
+			return args.ContainerID
+		}}, nil
+	case NamingHash:
+		return suffixNamer{naming, interfaceHash}, nil
+	case NamingSequential:
+		return &sequentialNamer{conf: naming, store: state.NewStore(conf.StateDir)}, nil
+	}
+	return nil, fmt.Errorf("unknown naming strategy %q", naming.Strategy)
+}
+
+// interfaceHash returns the SHA-1 of the container ID and interface name of args, in hex. The strategies that
+// don't name devices after it otherwise name those of secondary interfaces after it, so that they don't collide
+// with those of the primary one.
+func interfaceHash(args *skel.CmdArgs) string {
+	sum := sha1.Sum([]byte(args.ContainerID + args.IfName))
+	return hex.EncodeToString(sum[:])
+}
+
+type calicoNamer struct{}
+
+func (calicoNamer) HostVethName(args *skel.CmdArgs) (string, error) {
+	if state.Secondary(args.IfName) {
+		return "cali" + util.Prefix(interfaceHash(args), 11), nil
+	}
+	if workload, orchestrator, err := GetIdentifiers(args); err == nil && orchestrator == "k8s" {
+		return k8sbackend.VethNameForWorkload(workload), nil
+	}
+	return "cali" + util.Prefix(args.ContainerID, 11), nil
+}
+
+func (calicoNamer) IFBName(args *skel.CmdArgs) (string, error) {
+	if state.Secondary(args.IfName) {
+		return "ifb" + util.Prefix(interfaceHash(args), 11), nil
+	}
+	return "ifb" + util.Prefix(args.ContainerID, 11), nil
+}
+
+func (calicoNamer) Release(string) error {
+	return nil
+}
+
+// suffixNamer appends suffix(args), truncated, to the prefixes.
+type suffixNamer struct {
+	conf   NamingConf
+	suffix func(args *skel.CmdArgs) string
+}
+
+func (n suffixNamer) HostVethName(args *skel.CmdArgs) (string, error) {
+	return util.TruncateIfName(n.conf.VethPrefix + n.suffix(args)), nil
+}
+
+func (n suffixNamer) IFBName(args *skel.CmdArgs) (string, error) {
+	return util.TruncateIfName(n.conf.IFBPrefix + n.suffix(args)), nil
+}
+
+func (suffixNamer) Release(string) error {
+	return nil
+}
+
+type sequentialNamer struct {
+	conf  NamingConf
+	store *state.Store
+}
+
+func (n *sequentialNamer) number(containerID string) (string, error) {
+	// The longer prefix bounds how many digits fit.
+	prefix := len(n.conf.VethPrefix)
+	if len(n.conf.IFBPrefix) > prefix {
+		prefix = len(n.conf.IFBPrefix)
+	}
+	max := 1
+	for digits := util.Min(util.MaxIfNameLen-prefix, 9); digits > 0; digits-- {
+		max *= 10
+	}
+	max--
+	var number int
+	err := n.store.UpdateNames(func(names *state.Names) error {
+		var err error
+		number, err = names.Allocate(containerID, max)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return strconv.Itoa(number), nil
+}
+
+func (n *sequentialNamer) HostVethName(args *skel.CmdArgs) (string, error) {
+	number, err := n.number(state.RecordKey(args.ContainerID, args.IfName))
+	return n.conf.VethPrefix + number, err
+}
+
+func (n *sequentialNamer) IFBName(args *skel.CmdArgs) (string, error) {
+	number, err := n.number(state.RecordKey(args.ContainerID, args.IfName))
+	return n.conf.IFBPrefix + number, err
+}
+
+func (n *sequentialNamer) Release(key string) error {
+	return ReleaseNames(n.store, key)
+}
+
+// ReleaseNames frees the number of the interface stored under key in the registry of the sequential naming
+// strategy, if the strategy was ever used, so that records can be removed without knowing the configured strategy.
+func ReleaseNames(store *state.Store, key string) error {
+	names, err := store.LoadNames()
+	if err == state.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if _, ok := names.Numbers[key]; !ok {
+		return nil
+	}
+	return store.UpdateNames(func(names *state.Names) error {
+		names.Release(key)
+		return nil
+	})
+}
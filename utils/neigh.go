@@ -0,0 +1,80 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/projectcalico/cni-plugin/sysctl"
+)
+
+// NeighTiming overrides the neighbour discovery timings of the host veth, as durations such as "800ms". Fields left
+// empty keep their defaults: no proxy ARP delay, which a Calico network doesn't need, and the kernel's for the
+// rest.
+type NeighTiming struct {
+	// ProxyDelay is how long the host waits before answering an ARP request by proxy; the kernel default is 800ms.
+	ProxyDelay string `json:"proxyDelay"`
+	// BaseReachableTime, RetransTime, DelayFirstProbeTime and GCStaleTime tune how neighbour entries of the veth
+	// are confirmed and expired, for both IPv4 and IPv6.
+	BaseReachableTime   string `json:"baseReachableTime"`
+	RetransTime         string `json:"retransTime"`
+	DelayFirstProbeTime string `json:"delayFirstProbeTime"`
+	GCStaleTime         string `json:"gcStaleTime"`
+}
+
+// neighTimingParam is a timing sysctl of net.ipv{4,6}.neigh.IFNAME, with the range of durations it accepts and the
+// unit its value is written in.
+type neighTimingParam struct {
+	name     string
+	key      string
+	min, max time.Duration
+	unit     time.Duration
+	ipv4Only bool
+}
+
+// neighTimingParams are the parameters of NeighTiming. proxy_delay is in USER_HZ ticks.
+var neighTimingParams = []neighTimingParam{
+	{name: "proxyDelay", key: "proxy_delay", max: 10 * time.Second, unit: 10 * time.Millisecond, ipv4Only: true},
+	{name: "baseReachableTime", key: "base_reachable_time_ms", min: time.Second, max: time.Hour, unit: time.Millisecond},
+	{name: "retransTime", key: "retrans_time_ms", min: 10 * time.Millisecond, max: time.Minute, unit: time.Millisecond},
+	{name: "delayFirstProbeTime", key: "delay_first_probe_time", min: time.Second, max: time.Minute, unit: time.Second},
+	{name: "gcStaleTime", key: "gc_stale_time", min: time.Second, max: time.Hour, unit: time.Second},
+}
+
+// values returns the configured durations of t in the order of neighTimingParams, empty where unset.
+func (t *NeighTiming) values() []string {
+	if t == nil {
+		return make([]string, len(neighTimingParams))
+	}
+	return []string{t.ProxyDelay, t.BaseReachableTime, t.RetransTime, t.DelayFirstProbeTime, t.GCStaleTime}
+}
+
+// checkNeighTiming validates the neighTiming option.
+func checkNeighTiming(t *NeighTiming) error {
+	return t.set(&sysctl.Batch{}, true, true)
+}
+
+// set adds the timings of t to b, for the families the veth carries.
+func (t *NeighTiming) set(b *sysctl.Batch, hasIPv4, hasIPv6 bool) error {
+	for i, value := range t.values() {
+		if value == "" {
+			continue
+		}
+		p := neighTimingParams[i]
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid neighTiming %s %q: %v", p.name, value, err)
+		}
+		if d < p.min || d > p.max {
+			return fmt.Errorf("neighTiming %s %v is out of range, must be between %v and %v", p.name, d, p.min, p.max)
+		}
+		v := strconv.FormatInt(int64(d/p.unit), 10)
+		if hasIPv4 {
+			b.Set("net.ipv4.neigh.IFNAME."+p.key, v)
+		}
+		if hasIPv6 && !p.ipv4Only {
+			b.Set("net.ipv6.neigh.IFNAME."+p.key, v)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/ns"
+)
+
+// DefaultNetNSWaitTimeout is how long ADD waits for the container's network namespace by default.
+const DefaultNetNSWaitTimeout = 5 * time.Second
+
+// withHostNetNS runs f in the network namespace at path, or in the plugin's own if path is empty. It is where the
+// host veths, IFB devices and tc state of pods live, which isn't the plugin's own namespace when it runs nested,
+// e.g. inside a kind node or a containerized runtime. f runs on a locked thread, so the commands it runs and the
+// sysctls it writes are in the namespace too.
+func withHostNetNS(path string, f func() error) error {
+	if path == "" {
+		return f()
+	}
+	return ns.WithNetNSPath(path, func(ns.NetNS) error { return f() })
+}
+
+// netnsPollInterval is how often a missing network namespace is looked for again.
+const netnsPollInterval = 100 * time.Millisecond
+
+// waitForNetNS waits until the network namespace at path can be opened, for up to timeout (a duration string,
+// DefaultNetNSWaitTimeout if empty). Runtimes such as containerd may call the plugin before they have mounted the
+// namespace, so a path that doesn't exist yet or isn't a namespace yet is retried; other errors are not.
+func waitForNetNS(path, timeout string, logger *log.Entry) error {
+	wait := DefaultNetNSWaitTimeout
+	if timeout != "" {
+		var err error
+		if wait, err = time.ParseDuration(timeout); err != nil || wait < 0 {
+			return fmt.Errorf("invalid netnsWaitTimeout %q", timeout)
+		}
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		netns, err := ns.GetNS(path)
+		if err == nil {
+			netns.Close()
+			return nil
+		}
+		switch err.(type) {
+		case ns.NSPathNotExistErr, ns.NSPathNotNSErr:
+		default:
+			return fmt.Errorf("failed to open netns %q: %v", path, err)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("netns %q not available after %v: %v", path, wait, err)
+		}
+		logger.WithError(err).Debug("Waiting for netns")
+		time.Sleep(netnsPollInterval)
+	}
+}
@@ -6,62 +6,384 @@ import (
 	"github.com/containernetworking/cni/pkg/ip"
 	"github.com/containernetworking/cni/pkg/ns"
 	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
 	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/projectcalico/cni-plugin/logging"
+	"github.com/projectcalico/cni-plugin/metrics"
+	"github.com/projectcalico/cni-plugin/policy"
+	"github.com/projectcalico/cni-plugin/shaping"
+	"github.com/projectcalico/cni-plugin/state"
+	"github.com/projectcalico/cni-plugin/sysctl"
+	"github.com/projectcalico/cni-plugin/tracing"
 	"github.com/vishvananda/netlink"
-	"io"
 	"net"
-	"os"
-        "reflect"
+	"strings"
 	"syscall"
-	"strconv"
 )
 
-// DoNetworking performs the networking for the given config and IPAM result
+// DoNetworking performs the networking for the given config and IPAM result, with the host-side devices in the
+// host network namespace of conf.
 func DoNetworking(args *skel.CmdArgs, conf NetConf, result *current.Result, logger *log.Entry, desiredVethName string, ingress_bandwidth string, egress_bandwidth string) (hostVethName, contVethMAC string, err error) {
-	// Select the first 11 characters of the containerID for the host veth.
-	hostVethName = "cali" + args.ContainerID[:Min(11, len(args.ContainerID))]
-	ifbname := "ifb" + args.ContainerID[:Min(11, len(args.ContainerID))]
-	contVethName := args.IfName
-	var hasIPv4, hasIPv6 bool
+	err = withHostNetNS(conf.HostNetNS, func() error {
+		hostVethName, contVethMAC, err = doNetworking(args, conf, result, logger, desiredVethName, ingress_bandwidth, egress_bandwidth)
+		return err
+	})
+	return hostVethName, contVethMAC, err
+}
 
-	// If a desired veth name was passed in, use that instead.
-	if desiredVethName != "" {
-		hostVethName = desiredVethName
+func doNetworking(args *skel.CmdArgs, conf NetConf, result *current.Result, logger *log.Entry, desiredVethName string, ingress_bandwidth string, egress_bandwidth string) (hostVethName, contVethMAC string, err error) {
+	if conf, err = resolveHostInterface(conf); err != nil {
+		return "", "", err
+	}
+	if conf, err = resolveMode(conf); err != nil {
+		return "", "", err
+	}
+	mode := attachmentMode(conf)
+	if conf.MTU == 0 {
+		conf.MTU = detectMTU(conf, logger)
+	}
+	// Name the host veth with the configured strategy, unless a desired name was passed in. The slave devices of
+	// the slave modes have no host end to name.
+	hostVethName = desiredVethName
+	if !slaveMode(mode) {
+		if hostVethName == "" {
+			namer, err := NewNamer(conf)
+			if err != nil {
+				return "", "", err
+			}
+			if hostVethName, err = namer.HostVethName(args); err != nil {
+				return "", "", fmt.Errorf("failed to name host veth: %v", err)
+			}
+		}
+		if err = checkIfName(hostVethName); err != nil {
+			return "", "", err
+		}
+	}
+	if err = checkManagedSysctls(conf); err != nil {
+		return "", "", err
+	}
+	if err = checkRPFilter(conf.RPFilter); err != nil {
+		return "", "", err
+	}
+	if err = checkNeighTiming(conf.NeighTiming); err != nil {
+		return "", "", err
+	}
+	if err = checkOffloads(conf.Offloads); err != nil {
+		return "", "", err
+	}
+	if err = checkVethQueues(vethQueues(conf)); err != nil {
+		return "", "", err
+	}
+	if err = checkRoutes(conf.Routes); err != nil {
+		return "", "", err
+	}
+
+	// Check the requested shaping before touching any interfaces, so that a rejected configuration doesn't leave a
+	// half-configured pod behind. Bandwidth annotations are ignored in compatibility mode, as calico-cni would.
+	// Containers without them get the rates of their labels, if a label source is configured.
+	var rates ShapingRates
+	if !conf.CalicoCompat {
+		if ingress_bandwidth == "" && egress_bandwidth == "" && conf.LabelSource != nil {
+			if ingress_bandwidth, egress_bandwidth, err = ratesFromLabels(conf.LabelSource, args.ContainerID, logger); err != nil {
+				return "", "", err
+			}
+		}
+		if rates, err = ParseShapingRates(conf, ingress_bandwidth, egress_bandwidth, logger); err != nil {
+			return "", "", err
+		}
+	}
+
+	if err = waitForNetNS(args.Netns, conf.NetNSWaitTimeout, logger); err != nil {
+		return "", "", err
+	}
+	// The routes of the configuration are the container's as much as those of IPAM, and go into the result.
+	result.Routes = append(result.Routes, conf.Routes...)
+	if slaveMode(mode) {
+		// The master is the host-side device of the container, which it is shaped on.
+		if contVethMAC, err = doSlaveNetworking(args, conf, result, rates, logger); err != nil {
+			return "", "", err
+		}
+		reportInterfaces(result, &current.Interface{Name: args.IfName, Mac: contVethMAC, Sandbox: args.Netns})
+		if conf.SendGARP {
+			announceAddresses(args.Netns, args.IfName, result, logger)
+		}
+		return conf.Master, contVethMAC, nil
+	}
+
+	// Clean up if hostVeth exists and was left behind by an earlier attempt for this container.
+	var store *state.Store
+	if !conf.CalicoCompat {
+		store = state.NewStore(conf.StateDir)
+	}
+	if err = removeStaleHostVeth(store, hostVethName, args.ContainerID, args.IfName, logger); err != nil {
+		return "", "", err
 	}
 
-	// Clean up if hostVeth exists.
-	if oldHostVeth, err := netlink.LinkByName(hostVethName); err == nil {
-		if err = netlink.LinkDel(oldHostVeth); err != nil {
-			return "", "", fmt.Errorf("failed to delete old hostVeth %v: %v", hostVethName, err)
+	var hostVethMAC net.HardwareAddr
+	if conf.HostVethMAC {
+		hostVethMAC = HostVethMAC(podUID(args))
+	}
+	container, err := ContainerSideSetup(args.Netns, args.IfName, hostVethName, hostVethMAC, conf.MTU, vethQueues(conf), conf.Offloads,
+		conf.DefaultRoute == nil || *conf.DefaultRoute, mode == ModeBridge || conf.IPAMGateway, result, logger)
+	if err != nil {
+		return "", "", err
+	}
+	// From here on, a failed step deletes the veth, which was just created and so is safe to delete, taking the
+	// routes, sysctls and qdiscs of the host end with it; an unmarked or half-configured veth would block the retry.
+	tx := newSetupTransaction(logger)
+	tx.created("host veth "+hostVethName, deleteLinkNamed(hostVethName))
+	defer func() {
+		if err != nil {
+			tx.rollback()
 		}
-		logger.Infof("clean old hostVeth: %v", hostVethName)
+	}()
+	if err = markHostVeth(hostVethName, args.ContainerID); err != nil {
+		return "", "", err
+	}
+	reportInterfaces(result,
+		&current.Interface{Name: args.IfName, Mac: container.ContVethMAC, Sandbox: args.Netns},
+		&current.Interface{Name: hostVethName, Mac: container.HostVethMAC})
+	if err = HostSideSetup(args, conf, result, hostVethName, container, rates, logger); err != nil {
+		return "", "", err
+	}
+	// The routes to the container are in place, so the neighbours it announces itself to can reach it.
+	if conf.SendGARP {
+		announceAddresses(args.Netns, args.IfName, result, logger)
+	}
+	return hostVethName, container.ContVethMAC, nil
+}
+
+// reportInterfaces sets the interfaces of result, for chained plugins and CHECK to find: first the interface of
+// the container, which its addresses are put on, then the host veth if it has one. The slave modes report no
+// host-side device, as their master is the node's rather than the container's.
+func reportInterfaces(result *current.Result, interfaces ...*current.Interface) {
+	result.Interfaces = interfaces
+	for _, addr := range result.IPs {
+		index := 0
+		addr.Interface = &index
+	}
+}
+
+// ShapingRates are the limits, in bits per second and from the point of view of the pod, applied to a container.
+// Zero means the direction isn't limited. IngressCeil and EgressCeil are what limited directions may borrow up to,
+// or zero if they stay at their rate. IngressPPS and EgressPPS are the packet rates of directions policed instead,
+// whose rates are then zero.
+type ShapingRates struct {
+	Ingress     uint64
+	Egress      uint64
+	IngressCeil uint64
+	EgressCeil  uint64
+	IngressPPS  uint64
+	EgressPPS   uint64
+}
+
+// ParseShapingRates parses the requested bandwidth annotations and checks them against the shaping configuration.
+func ParseShapingRates(conf NetConf, ingress, egress string, logger *log.Entry) (ShapingRates, error) {
+	logger = logging.In(logging.TC, logger)
+	conf, err := resolveHostInterface(conf)
+	if err != nil {
+		return ShapingRates{}, err
+	}
+	switch conf.ShapingMode {
+	case "", ShapingModeVeth, ShapingModeNIC, ShapingModeNFTables:
+	default:
+		return ShapingRates{}, fmt.Errorf("unknown shapingMode %q", conf.ShapingMode)
+	}
+	if err := checkNICOverflow(conf.NICOverflow); err != nil {
+		return ShapingRates{}, err
+	}
+	if err := checkNICHierarchy(conf); err != nil {
+		return ShapingRates{}, err
+	}
+	if err := checkNICOffload(conf); err != nil {
+		return ShapingRates{}, err
+	}
+	if err := checkQoSPriorities(conf); err != nil {
+		return ShapingRates{}, err
+	}
+	if err := checkCeils(conf); err != nil {
+		return ShapingRates{}, err
+	}
+	if err := checkNonIPPolicy(conf.NonIPPolicy); err != nil {
+		return ShapingRates{}, err
+	}
+	if err := checkIPFamilyBudget(conf.IPFamilyBudget); err != nil {
+		return ShapingRates{}, err
+	}
+	if err := checkDSCP(conf); err != nil {
+		return ShapingRates{}, err
+	}
+	if err := checkLeafQdisc(conf); err != nil {
+		return ShapingRates{}, err
+	}
+	if err := checkBackendFeatures(conf); err != nil {
+		return ShapingRates{}, err
+	}
+	if err := checkProtocolSplit(conf); err != nil {
+		return ShapingRates{}, err
+	}
+	if err := checkTrafficClasses(conf); err != nil {
+		return ShapingRates{}, err
+	}
+	if err := checkPeers(conf); err != nil {
+		return ShapingRates{}, err
+	}
+	if err := checkShapeInContainer(conf); err != nil {
+		return ShapingRates{}, err
+	}
+	if err := checkMirrorTo(conf); err != nil {
+		return ShapingRates{}, err
+	}
+	if err := checkEnforcement(conf); err != nil {
+		return ShapingRates{}, err
+	}
+	if err := checkSingleClassQdisc(conf.SingleClassQdisc); err != nil {
+		return ShapingRates{}, err
+	}
+	if err := checkShaper(conf); err != nil {
+		return ShapingRates{}, err
+	}
+	if err := checkBackend(conf); err != nil {
+		return ShapingRates{}, err
+	}
+	if err := checkVerifyShaping(conf.VerifyShaping); err != nil {
+		return ShapingRates{}, err
+	}
+	if err := checkBursts(conf); err != nil {
+		return ShapingRates{}, err
+	}
+	if err := checkSchedule(conf); err != nil {
+		return ShapingRates{}, err
 	}
+	if err := checkClassifier(conf); err != nil {
+		return ShapingRates{}, err
+	}
+	separate := conf.IPFamilyBudget == IPFamilyBudgetSeparate
+	if separate && (conf.ShapingMode == ShapingModeNIC || conf.ShapingMode == ShapingModeNFTables) {
+		return ShapingRates{}, fmt.Errorf("ipFamilyBudget %q isn't supported by the %s shaping mode", IPFamilyBudgetSeparate, conf.ShapingMode)
+	}
+
+	var rates ShapingRates
+	bursts := burstsOf(conf)
+	ingress, egress = configuredRates(conf, ingress, egress)
+	ingress, egress = scheduleDefaults(conf, ingress, egress)
+	ingressRate, err := parseRate("ingress", ingress)
+	if err != nil {
+		return ShapingRates{}, err
+	}
+	if ingressRate, err = checkLatencyClass(conf, ingressRate); err != nil {
+		return ShapingRates{}, err
+	}
+	ingressRate, rates.IngressPPS = policeLowRate(conf, ingressRate, bursts.ingress(ingressRate).buffer)
+	if rates.Ingress, err = checkLowRate(conf, "ingress", ingressRate, bursts.ingress(ingressRate).buffer, logger); err != nil {
+		return ShapingRates{}, err
+	}
+	egressRate, err := parseRate("egress", egress)
+	if err != nil {
+		return ShapingRates{}, err
+	}
+	if egressRate, err = checkLatencyClass(conf, egressRate); err != nil {
+		return ShapingRates{}, err
+	}
+	egressRate, rates.EgressPPS = policeLowRate(conf, egressRate, bursts.egress(egressRate).buffer)
+	if rates.Egress, err = checkLowRate(conf, "egress", egressRate, bursts.egress(egressRate).buffer, logger); err != nil {
+		return ShapingRates{}, err
+	}
+	if err = checkLinkSpeed(conf, &rates, logger); err != nil {
+		return ShapingRates{}, err
+	}
+	if rates.IngressCeil, err = parseCeil("ingress", conf.IngressCeil, rates.Ingress, logger); err != nil {
+		return ShapingRates{}, err
+	}
+	if rates.EgressCeil, err = parseCeil("egress", conf.EgressCeil, rates.Egress, logger); err != nil {
+		return ShapingRates{}, err
+	}
+	return rates, nil
+}
+
+// parseRate parses a bandwidth annotation. An empty annotation means the direction isn't limited; one that isn't a
+// positive rate is rejected rather than ignored, so that a typo doesn't leave the pod unshaped.
+func parseRate(direction, value string) (uint64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	rate, err := policy.ParseRate(value)
+	if err != nil || rate == 0 {
+		return 0, invalidConfigError(fmt.Errorf("%s bandwidth %q isn't a positive rate", direction, value))
+	}
+	return rate, nil
+}
+
+// ContainerSideResult is what ContainerSideSetup found out that the host side setup needs.
+type ContainerSideResult struct {
+	ContVethMAC string
+	HostVethMAC string
+	HasIPv4     bool
+	HasIPv6     bool
+	// IPv6Gateway is the next hop of the container's IPv6 default route, if it has IPv6 addresses.
+	IPv6Gateway net.IP
+	// IPv6RouteGateways are the other IPv6 next hops of routes from IPAM and the configuration, which the host must
+	// answer for in the ptp mode.
+	IPv6RouteGateways []net.IP
+}
 
-	err = ns.WithNetNSPath(args.Netns, func(hostNS ns.NetNS) error {
+// ContainerSideSetup creates a veth pair in the network namespace at netnsPath, configures the container end with
+// the addresses and routes of result, and moves the host end to the host namespace. The host end gets hostVethMAC
+// unless it is nil, and both ends get the transmit queue length and queues of queues, and the offload features in
+// offloads. The container gets the routes of result, and default routes for the families result has none for, unless
+// defaultRoute is false, through the host or, if ipamGateways is set, through the IPAM gateways of result, which the
+// host answers for in their place. Everything it does happens inside the container's
+// namespace, so it is undone by deleting the container end or the namespace, which it does itself if a step fails
+// after the veth is created.
+func ContainerSideSetup(netnsPath, contVethName, hostVethName string, hostVethMAC net.HardwareAddr, mtu int, queues VethQueues, offloads map[string]bool, defaultRoute, ipamGateways bool, result *current.Result, logger *log.Entry) (ContainerSideResult, error) {
+	var out ContainerSideResult
+
+	span := tracing.Start("veth")
+	err := ns.WithNetNSPath(netnsPath, func(hostNS ns.NetNS) (err error) {
 		veth := &netlink.Veth{
 			LinkAttrs: netlink.LinkAttrs{
-				Name:  contVethName,
-				Flags: net.FlagUp,
-				MTU:   conf.MTU,
-				TxQLen: 1000,
+				Name:        contVethName,
+				Flags:       net.FlagUp,
+				MTU:         mtu,
+				TxQLen:      queues.txQLen(),
+				NumTxQueues: queues.NumTxQueues,
+				NumRxQueues: queues.NumRxQueues,
 			},
 			PeerName: hostVethName,
 		}
 
-		if err := netlink.LinkAdd(veth); err != nil {
+		if err := countNetlink("LinkAdd", func() error { return netlink.LinkAdd(veth) }); err != nil {
 			logger.Errorf("Error adding veth %+v: %s", veth, err)
+			if err == syscall.EEXIST {
+				return conflictError(fmt.Errorf("failed to create veth %q: %v", contVethName, err))
+			}
 			return err
 		}
+		defer func() {
+			if err != nil {
+				deleteLinkNamed(contVethName)()
+			}
+		}()
 
 		hostVeth, err := netlink.LinkByName(hostVethName)
 		if err != nil {
 			err = fmt.Errorf("failed to lookup %q: %v", hostVethName, err)
 			return err
 		}
+		if hostVethMAC != nil {
+			if err = countNetlink("LinkSetHardwareAddr", func() error {
+				return netlink.LinkSetHardwareAddr(hostVeth, hostVethMAC)
+			}); err != nil {
+				return fmt.Errorf("failed to set MAC of %q: %v", hostVethName, err)
+			}
+			out.HostVethMAC = hostVethMAC.String()
+		} else {
+			out.HostVethMAC = hostVeth.Attrs().HardwareAddr.String()
+		}
 
 		// Explicitly set the veth to UP state, because netlink doesn't always do that on all the platforms with net.FlagUp.
 		// veth won't get a link local address unless it's set to UP state.
-		if err = netlink.LinkSetUp(hostVeth); err != nil {
+		if err = countNetlink("LinkSetUp", func() error { return netlink.LinkSetUp(hostVeth) }); err != nil {
 			return fmt.Errorf("failed to set %q up: %v", hostVethName, err)
 		}
 
@@ -72,374 +394,832 @@ func DoNetworking(args *skel.CmdArgs, conf NetConf, result *current.Result, logg
 		}
 
 		// Fetch the MAC from the container Veth. This is needed by Calico.
-		contVethMAC = contVeth.Attrs().HardwareAddr.String()
-		logger.WithField("MAC", contVethMAC).Debug("Found MAC for container veth")
+		out.ContVethMAC = contVeth.Attrs().HardwareAddr.String()
+		logger.WithField("MAC", out.ContVethMAC).Debug("Found MAC for container veth")
+
+		// Both ends are still here, so the offloads of the pair are set in one go.
+		for _, name := range []string{contVethName, hostVethName} {
+			if err = setOffloads(name, offloads); err != nil {
+				return err
+			}
+		}
 
 		// At this point, the virtual ethernet pair has been created, and both ends have the right names.
 		// Both ends of the veth are still in the container's network namespace.
 
-		for _, addr := range result.IPs {
+		if err = configureContainerLink(contVeth, hostVeth, result, defaultRoute, ipamGateways, &out, logger); err != nil {
+			return err
+		}
 
-			// Before returning, create the routes inside the namespace, first for IPv4 then IPv6.
-			if addr.Version == "4" {
-				// Add a connected route to a dummy next hop so that a default route can be set
-				gw := net.IPv4(169, 254, 1, 1)
-				gwNet := &net.IPNet{IP: gw, Mask: net.CIDRMask(32, 32)}
-				if err = netlink.RouteAdd(&netlink.Route{
-					LinkIndex: contVeth.Attrs().Index,
-					Scope:     netlink.SCOPE_LINK,
-					Dst:       gwNet}); err != nil {
-					return fmt.Errorf("failed to add route %v", err)
+		// Now that the everything has been successfully set up in the container, move the "host" end of the
+		// veth into the host namespace.
+		if err = countNetlink("LinkSetNsFd", func() error {
+			return netlink.LinkSetNsFd(hostVeth, int(hostNS.Fd()))
+		}); err != nil {
+			if err == syscall.EEXIST {
+				return conflictError(fmt.Errorf("failed to move veth %q to host netns: %v", hostVethName, err))
+			}
+			return fmt.Errorf("failed to move veth to host netns: %v", err)
+		}
+
+		return nil
+	})
+	span.End(err)
+
+	if err != nil {
+		logger.Errorf("Error creating veth: %s", err)
+		return ContainerSideResult{}, err
+	}
+	return out, nil
+}
+
+// configureContainerLink configures link, the interface of a container, with the addresses and routes of result, and
+// default routes for the families result has none for, unless defaultRoute is false. The routes go through the host
+// end of the veth hostVeth, which answers for a dummy IPv4 gateway and its own IPv6 link-local address, or through
+// the IPAM gateways of result if ipamGateways is set. A family can have several addresses; its next hop is that of
+// its first one. It fills in the families and IPv6 gateways of out.
+func configureContainerLink(link, hostVeth netlink.Link, result *current.Result, defaultRoute, ipamGateways bool, out *ContainerSideResult, logger *log.Entry) error {
+	var err error
+	gw := net.IPv4(169, 254, 1, 1)
+	var gw6 net.IP
+	for _, addr := range result.IPs {
+
+		// Before returning, create the routes inside the namespace, first for IPv4 then IPv6.
+		if addr.Version == "4" && !out.HasIPv4 {
+			// Add a connected route to the next hop so that a default route can be set: a dummy one the host
+			// answers for by proxy ARP, or the IPAM gateway.
+			if ipamGateways {
+				if gw, err = ipamGateway(addr); err != nil {
+					return err
 				}
+			}
+			if err = addConnectedRoute(link, gw); err != nil {
+				return err
+			}
 
-				if err = ip.AddDefaultRoute(gw, contVeth); err != nil {
+			if defaultRoute && !hasDefaultRoute(result.Routes, false) {
+				if err = ip.AddDefaultRoute(gw, link); err != nil {
 					return fmt.Errorf("failed to add route %v", err)
 				}
+			}
+		}
+		if addr.Version == "4" {
+			if err = countNetlink("AddrAdd", func() error {
+				return netlink.AddrAdd(link, &netlink.Addr{IPNet: &addr.Address})
+			}); err != nil {
+				return fmt.Errorf("failed to add IP addr to %q: %v", link.Attrs().Name, err)
+			}
+			// Set HasIPv4 to true so sysctls for IPv4 can be programmed when the host side of
+			// the veth finishes moving to the host namespace.
+			out.HasIPv4 = true
+		}
 
-				if err = netlink.AddrAdd(contVeth, &netlink.Addr{IPNet: &addr.Address}); err != nil {
-					return fmt.Errorf("failed to add IP addr to %q: %v", contVethName, err)
-				}
-				// Set hasIPv4 to true so sysctls for IPv4 can be programmed when the host side of
-				// the veth finishes moving to the host namespace.
-				hasIPv4 = true
-			}
-
-			// Handle IPv6 routes
-			if addr.Version == "6" {
-				// No need to add a dummy next hop route as the host veth device will already have an IPv6
-				// link local address that can be used as a next hop.
-				// Just fetch the address of the host end of the veth and use it as the next hop.
-				addresses, err := netlink.AddrList(hostVeth, netlink.FAMILY_V6)
-				if err != nil {
-					logger.Errorf("Error listing IPv6 addresses: %s", err)
+		// Handle IPv6 routes
+		if addr.Version == "6" && !out.HasIPv6 {
+			// Through the host there's no need for a dummy next hop, as the host veth device will already have
+			// an IPv6 link local address that can be used as one.
+			if ipamGateways {
+				if gw6, err = ipamGateway(addr); err != nil {
 					return err
 				}
-
-				if len(addresses) < 1 {
-					// If the hostVeth doesn't have an IPv6 address then this host probably doesn't
-					// support IPv6. Since a IPv6 address has been allocated that can't be used,
-					// return an error.
-					return fmt.Errorf("failed to get IPv6 addresses for host side of the veth pair")
+				if err = addConnectedRoute(link, gw6); err != nil {
+					return err
 				}
+			} else if gw6, err = hostLinkLocal(hostVeth, logger); err != nil {
+				return err
+			}
 
-				hostIPv6Addr := addresses[0].IP
-
+			if defaultRoute && !hasDefaultRoute(result.Routes, true) {
 				_, defNet, _ := net.ParseCIDR("::/0")
-				if err = ip.AddRoute(defNet, hostIPv6Addr, contVeth); err != nil {
-					return fmt.Errorf("failed to add default gateway to %v %v", hostIPv6Addr, err)
+				if err = ip.AddRoute(defNet, gw6, link); err != nil {
+					return fmt.Errorf("failed to add default gateway to %v %v", gw6, err)
 				}
+			}
+			out.IPv6Gateway = gw6
+		}
+		if addr.Version == "6" {
+			if err = countNetlink("AddrAdd", func() error {
+				return netlink.AddrAdd(link, &netlink.Addr{IPNet: &addr.Address})
+			}); err != nil {
+				return fmt.Errorf("failed to add IP addr to %q: %v", link.Attrs().Name, err)
+			}
 
-				if err = netlink.AddrAdd(contVeth, &netlink.Addr{IPNet: &addr.Address}); err != nil {
-					return fmt.Errorf("failed to add IP addr to %q: %v", contVeth, err)
-				}
+			// Set HasIPv6 to true so sysctls for IPv6 can be programmed when the host side of
+			// the veth finishes moving to the host namespace.
+			out.HasIPv6 = true
+		}
+	}
 
-				// Set hasIPv6 to true so sysctls for IPv6 can be programmed when the host side of
-				// the veth finishes moving to the host namespace.
-				hasIPv6 = true
+	// Routes from IPAM go through their gateway, or the same next hop as the default route if they have none.
+	// Through the host, the only neighbour of the container is the host end of the veth, so a gateway is made
+	// reachable on it with a connected route, and the host answers for it by proxy ARP or NDP.
+	for _, route := range result.Routes {
+		ipv6 := route.Dst.IP.To4() == nil
+		via, present := gw, out.HasIPv4
+		if ipv6 {
+			via, present = gw6, out.HasIPv6
+		}
+		if !present {
+			logger.WithField("route", route.Dst.String()).Info("Skipping route of a family the container has no address of")
+			continue
+		}
+		if route.GW != nil && !route.GW.Equal(via) {
+			via = route.GW
+			if err = addConnectedRoute(link, via); err != nil {
+				return err
+			}
+			if ipv6 {
+				out.IPv6RouteGateways = append(out.IPv6RouteGateways, via)
 			}
 		}
-
-		// Now that the everything has been successfully set up in the container, move the "host" end of the
-		// veth into the host namespace.
-		if err = netlink.LinkSetNsFd(hostVeth, int(hostNS.Fd())); err != nil {
-			return fmt.Errorf("failed to move veth to host netns: %v", err)
+		dst := route.Dst
+		if err = ip.AddRoute(&dst, via, link); err != nil {
+			return fmt.Errorf("failed to add route to %v via %v: %v", dst.String(), via, err)
 		}
+	}
+	return nil
+}
 
-		return nil
+// hostLinkLocal returns the IPv6 link-local address of the host end of the veth, which the container routes
+// through.
+func hostLinkLocal(hostVeth netlink.Link, logger *log.Entry) (net.IP, error) {
+	addresses, err := netlink.AddrList(hostVeth, netlink.FAMILY_V6)
+	if err != nil {
+		logger.Errorf("Error listing IPv6 addresses: %s", err)
+		return nil, err
+	}
+
+	if len(addresses) < 1 {
+		// If the hostVeth doesn't have an IPv6 address then this host probably doesn't
+		// support IPv6. Since a IPv6 address has been allocated that can't be used,
+		// return an error.
+		return nil, fmt.Errorf("failed to get IPv6 addresses for host side of the veth pair")
+	}
+	return addresses[0].IP, nil
+}
+
+// addConnectedRoute adds a host route to gw on link, so that routes can go through it. Routes from IPAM can share a
+// gateway, so it may already be there.
+func addConnectedRoute(link netlink.Link, gw net.IP) error {
+	bits := 128
+	if gw.To4() != nil {
+		bits = 32
+	}
+	err := countNetlink("RouteAdd", func() error {
+		return netlink.RouteAdd(&netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Scope:     netlink.SCOPE_LINK,
+			Dst:       &net.IPNet{IP: gw, Mask: net.CIDRMask(bits, bits)},
+		})
 	})
+	if err != nil && err != syscall.EEXIST {
+		return fmt.Errorf("failed to add route to gateway %v: %v", gw, err)
+	}
+	return nil
+}
 
-	if err != nil {
-		logger.Errorf("Error creating veth: %s", err)
-		return "", "", err
+// checkRoutes checks that the routes of the configuration have a destination, and a gateway of its family if any.
+func checkRoutes(routes []*types.Route) error {
+	for _, route := range routes {
+		if route == nil || route.Dst.IP == nil || route.Dst.Mask == nil {
+			return fmt.Errorf("routes must have a dst")
+		}
+		if route.GW != nil && (route.GW.To4() == nil) != (route.Dst.IP.To4() == nil) {
+			return fmt.Errorf("route to %v has a gw of another IP family", route.Dst.String())
+		}
 	}
+	return nil
+}
 
-	err = configureSysctls(hostVethName, hasIPv4, hasIPv6)
-	if err != nil {
-		return "", "", fmt.Errorf("error configuring sysctls for interface: %s, error: %s", hostVethName, err)
+// hasDefaultRoute reports whether routes has a default route of IPv6 or of IPv4.
+func hasDefaultRoute(routes []*types.Route, ipv6 bool) bool {
+	for _, route := range routes {
+		ones, _ := route.Dst.Mask.Size()
+		if ones == 0 && (route.Dst.IP.To4() == nil) == ipv6 {
+			return true
+		}
+	}
+	return false
+}
+
+// HostSideSetup configures the host end of a container's veth once ContainerSideSetup has moved it to the host
+// namespace: sysctls, routes or, in the bridge mode, its bridge, and shaping, and records the shaping state. It only touches the host namespace and
+// can be retried on its own: if a step fails, the routes and proxy NDP entries it added are removed again, as
+// setupShaping removes the shaping. The sysctls of the veth go with it.
+func HostSideSetup(args *skel.CmdArgs, conf NetConf, result *current.Result, hostVethName string, container ContainerSideResult, rates ShapingRates, logger *log.Entry) (err error) {
+	tx := newSetupTransaction(logger)
+	defer func() {
+		if err != nil {
+			tx.rollback()
+		}
+	}()
+	if conf.ManageSysctls == nil || *conf.ManageSysctls {
+		span := tracing.Start("sysctls")
+		err := configureSysctls(hostVethName, container.HasIPv4, container.HasIPv6, conf)
+		span.End(err)
+		if err != nil {
+			return fmt.Errorf("error configuring sysctls for interface: %s, error: %s", hostVethName, err)
+		}
+		// The host answers for the IPv6 gateways of the container, unless they are on the bridge of the bridge mode.
+		var gateways []net.IP
+		if attachmentMode(conf) == ModePTP {
+			gateways = container.IPv6RouteGateways
+			if container.IPv6Gateway != nil {
+				gateways = append([]net.IP{container.IPv6Gateway}, gateways...)
+			}
+		}
+		for _, gw := range gateways {
+			if err = addProxyNDP(hostVethName, gw, tx); err != nil {
+				return err
+			}
+		}
+	} else {
+		logger.WithField("interface", hostVethName).Debug("Not configuring sysctls")
 	}
 
 	// Moving a veth between namespaces always leaves it in the "DOWN" state. Set it back to "UP" now that we're
 	// back in the host namespace.
 	hostVeth, err := netlink.LinkByName(hostVethName)
 	if err != nil {
-		return "", "", fmt.Errorf("failed to lookup %q: %v", hostVethName, err)
+		return fmt.Errorf("failed to lookup %q: %v", hostVethName, err)
 	}
 
-	if err = netlink.LinkSetUp(hostVeth); err != nil {
-		return "", "", fmt.Errorf("failed to set %q up: %v", hostVethName, err)
+	if err = countNetlink("LinkSetUp", func() error { return netlink.LinkSetUp(hostVeth) }); err != nil {
+		return fmt.Errorf("failed to set %q up: %v", hostVethName, err)
 	}
-        
-	// Now that the host side of the veth is moved, state set to UP, and configured with sysctls, we can add the routes to it in the host namespace.
-	err = setupRoutes(hostVeth, result)
-	if err != nil {
-		return "", "", fmt.Errorf("error adding host side routes for interface: %s, error: %s", hostVeth.Attrs().Name, err)
-	
-	
-     }
-              Rate1, err := strconv.Atoi(ingress_bandwidth)
-                if err != nil {
-			fmt.Println("convert fail")
-			      }
-		logger.Infof("lj speed: %s", Rate1)
-		Rate2, err := strconv.Atoi(egress_bandwidth)
-		if err != nil{
-			fmt.Println("convert fail")
-					}  
-	        logger.Infof("lj speed: %s", Rate2)
-         	index := hostVeth.Attrs().Index
-		qdiscHandle := netlink.MakeHandle(0x2, 0x0)
-		qdiscAttrs := netlink.QdiscAttrs{
-			LinkIndex: index,
-			Handle:    qdiscHandle,
-			Parent:    netlink.HANDLE_ROOT,
-		}
-		qdisc := netlink.NewHtb(qdiscAttrs)
-		if err := netlink.QdiscAdd(qdisc); err != nil {
-			fmt.Println("add qdisc err")
-		}
-		qdiscs, err := netlink.QdiscList(hostVeth)
+
+	// In the bridge mode, the host reaches the container through the bridge, whose addresses are its gateways.
+	if attachmentMode(conf) == ModeBridge {
+		span := tracing.Start("bridge")
+		err = attachToBridge(hostVeth, conf, result)
+		span.End(err)
 		if err != nil {
-			fmt.Println("list qdisc err")
+			return err
 		}
-		if len(qdiscs) != 1 {
-			fmt.Println("Failed to add qdisc")
+	}
+
+	// Now that the host side of the veth is moved, state set to UP, and configured with sysctls, we can add the routes to it in the host namespace.
+	if !programHostRoutes(conf) {
+		logger.WithField("interface", hostVeth.Attrs().Name).Debug("Not programming host routes")
+	} else {
+		span := tracing.Start("routes")
+		err = setupRoutes(hostVeth, result, tx)
+		span.End(err)
+		if err != nil {
+			return fmt.Errorf("error adding host side routes for interface: %s, error: %s", hostVeth.Attrs().Name, err)
 		}
-		_, ok := qdiscs[0].(*netlink.Htb)
-		if !ok {
-			fmt.Println("Qdisc is the wrong type")
+	}
+
+	// Finally, shape the traffic in both directions. calico-cni doesn't shape, so in compatibility mode the pod is
+	// left as it would have set it up.
+	if conf.CalicoCompat {
+		return nil
+	}
+	return setupShaping(args, conf, result, hostVeth, container, rates, logger)
+}
+
+var shapingFailures = metrics.NewCounter("flowcontrol_shaping_failures_total",
+	"Pods brought up unshaped because programming their shaping failed and strict_shaping is off.")
+
+// setupShaping shapes the traffic of a container whose host veth is set up, and records what was programmed so
+// the agent can find the devices and rates of the container later. hostVeth is nil for containers attached with a
+// slave device, which are shaped on their master.
+func setupShaping(args *skel.CmdArgs, conf NetConf, result *current.Result, hostVeth netlink.Link, container ContainerSideResult, rates ShapingRates, logger *log.Entry) error {
+	logger = logging.In(logging.TC, logger)
+	var hostVethName string
+	if hostVeth != nil {
+		if err := checkBandwidthPlugin(args, conf, hostVeth, &rates, logger); err != nil {
+			return err
 		}
+		hostVethName = hostVeth.Attrs().Name
+	}
+	workload, _, _ := GetIdentifiers(args)
+	record := &state.Record{
+		ContainerID:    args.ContainerID,
+		IfName:         args.IfName,
+		Workload:       workload,
+		HostVeth:       hostVethName,
+		HostVethMAC:    container.HostVethMAC,
+		ContainerMAC:   container.ContVethMAC,
+		IngressRate:    rates.Ingress,
+		EgressRate:     rates.Egress,
+		IngressCeil:    rates.IngressCeil,
+		EgressCeil:     rates.EgressCeil,
+		LatencyClass:   conf.LatencyClass,
+		NonIPPolicy:    conf.NonIPPolicy,
+		IPFamilyBudget: conf.IPFamilyBudget,
+		LeafQdisc:      conf.LeafQdisc,
+		DSCP:           conf.DSCP,
+		Classifier:     conf.Classifier,
+		MirrorTo:       conf.MirrorTo,
+		IngressBurst:   conf.IngressBurst,
+		EgressBurst:    conf.EgressBurst,
+		Cbuffer:        conf.Cbuffer,
+		Preset:         conf.Preset,
+		Template:       conf.Template,
+		PriorityClass:  conf.PriorityClass,
+		ClassPriority:  conf.ClassPriority,
+		Schedule:       scheduleWindows(conf),
+		Status:         state.StatusApplied,
+	}
+	if mode := attachmentMode(conf); mode != ModePTP {
+		record.Attachment = mode
+	}
+	k8sArgs := K8sArgs{}
+	if err := types.LoadArgs(args.Args, &k8sArgs); err == nil {
+		record.Namespace = string(k8sArgs.K8S_POD_NAMESPACE)
+		record.Pod = string(k8sArgs.K8S_POD_NAME)
+	}
+	for _, addr := range result.IPs {
+		record.IPs = append(record.IPs, addr.Address.IP.String())
+	}
+	store := state.NewStore(conf.StateDir)
 
-		classId := netlink.MakeHandle(0x2, 0x56cb)
-		classAttrs := netlink.ClassAttrs{
-			LinkIndex: index,
-			Parent:    qdiscHandle,
-			Handle:    classId,
+	// The hooks are told what was applied once the tc lock is released, as they may be slow.
+	var applied *state.Record
+	defer func() {
+		if applied != nil {
+			runHooks(conf.Hooks, HookEventAdd, applied, logger)
 		}
-		htbClassAttrs := netlink.HtbClassAttrs{
-			Rate:   uint64(Rate1),
-			Buffer: 32*100000,
+	}()
+
+	// The devices of the pod are programmed, checked and, on failure, rolled back under the tc lock of the node.
+	unlock, err := state.LockTC()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	intent := *record
+	mode, err := programShaping(args, conf, result, hostVeth, rates, record, store, logger)
+	if err != nil {
+		rollbackShaping(store, record, hostVeth, logger)
+		if conf.StrictShaping == nil || *conf.StrictShaping {
+			return err
 		}
-		htbClass := netlink.NewHtbClass(classAttrs, htbClassAttrs)
-		if err = netlink.ClassReplace(htbClass); err != nil {
-			fmt.Println("Failed to add a HTB class: %v", err)
+		// The pod comes up unshaped, recorded with the shaping it was meant to have for the agent to repair.
+		logger.WithError(err).Warn("Failed to shape pod, bringing it up unshaped as strict_shaping is off")
+		shapingFailures.Inc()
+		intent.Status = state.StatusDegraded
+		intent.StatusReason = "shaping failed: " + err.Error()
+		if flowControlUnavailable(err) {
+			// The agent can't repair what the node can't shape.
+			intent.Status, intent.StatusReason = state.StatusUnsupported, err.Error()
 		}
-		classes, err := netlink.ClassList(hostVeth, qdiscHandle)
-		if err != nil {
-			fmt.Println("list class err")
+		intent.MarkReconcileFailed(err)
+		if err = store.Save(&intent); err != nil {
+			logger.WithError(err).Warn("Failed to record shaping state")
 		}
-		if len(classes) != 1 {
-			fmt.Println("Failed to add class")
-			fmt.Println("length of classes is : %v", len(classes))
+		AuditRecord(store, &intent, state.AuditCreate, state.AuditTriggerCNIAdd, "failed to set up shaping, left unshaped",
+			logger)
+		applied = &intent
+		return nil
+	}
+
+	record.MarkReconciled()
+	if conf.VerifyShaping == VerifyShapingStrict || conf.VerifyShaping == VerifyShapingDegrade {
+		span := tracing.Start("verify")
+		problems := VerifyShaping(record)
+		var err error
+		if len(problems) != 0 {
+			err = fmt.Errorf("shaping doesn't match what was programmed: %s", strings.Join(problems, "; "))
 		}
-		_, ok = classes[0].(*netlink.HtbClass)
-		if !ok {
-			fmt.Println("Class is the wrong type")
+		span.End(err)
+		switch {
+		case err == nil:
+		case conf.VerifyShaping == VerifyShapingStrict:
+			return err
+		default:
+			logger.WithError(err).Warn("Marking pod degraded")
+			record.Status = state.StatusDegraded
+			record.StatusReason = strings.Join(problems, "; ")
+			record.MarkReconcileFailed(err)
 		}
-		u32SelKeys := []netlink.TcU32Key{
+	}
+	if err := store.Save(record); err != nil {
+		logger.WithError(err).Warn("Failed to record shaping state")
+	}
+	AuditRecord(store, record, state.AuditCreate, state.AuditTriggerCNIAdd, "set up "+mode+" shaping", logger)
+	applied = record
+	return nil
+}
 
-			netlink.TcU32Key{
-				Mask:    0x00000000,
-				Val:     0x00000000,
-				Off:     16,
-				OffMask: 0,
-			},
+// programShaping programs the shaping of a container on its host veth, IFB device or uplink, filling in record
+// with what it set up, and returns the shaping mode it used. What it set up before failing is left for
+// rollbackShaping to remove.
+func programShaping(args *skel.CmdArgs, conf NetConf, result *current.Result, hostVeth netlink.Link, rates ShapingRates, record *state.Record, store *state.Store, logger *log.Entry) (string, error) {
+	mode := effectiveShapingMode(conf, store, rates, logger)
+	if err := checkFlowControl(conf, mode, rates, store, logger); err != nil {
+		return mode, err
+	}
+	shapeVeth := mode == ShapingModeVeth
+	if mode == ShapingModeNFTables {
+		record.ShapingMode = ShapingModeNFTables
+		record.LatencyClass = ""
+	}
+	if (conf.ShapeInContainer || lazyContainerShaping(conf, rates)) && mode == ShapingModeVeth {
+		span := tracing.Start("container tc")
+		err := setupContainerShaping(args.Netns, args.IfName, conf, rates, record, logger)
+		span.End(err)
+		if err != nil {
+			return "", err
 		}
-		filter := &netlink.U32{
-			FilterAttrs: netlink.FilterAttrs{
-				LinkIndex: index,
-				Parent:    qdiscHandle,
-				Priority:  1,
-				Protocol:  syscall.ETH_P_IP,
-			},
-			Sel: &netlink.TcU32Sel{
-				Keys:  u32SelKeys,
-				Flags: netlink.TC_U32_TERMINAL,
-			},
-			ClassId: classId,
-			Actions: []netlink.Action{},
+		mode, shapeVeth = ShapingModeContainer, false
+	}
+	if mode == ShapingModeNIC {
+		var ips []net.IP
+		for _, addr := range result.IPs {
+			ips = append(ips, addr.Address.IP)
 		}
-
-		cFilter := *filter
-		if err := netlink.FilterAdd(filter); err != nil {
-			fmt.Println("add filter err")
+		span := tracing.Start("nic tc")
+		nic, minor, err := setupNICShaping(conf, store, record, ips, rates.Ingress, rates.Egress)
+		span.End(err)
+		switch {
+		case isClassesExhausted(err) && conf.NICOverflow == NICOverflowVeth:
+			// Nothing was added to the uplink before the allocation failed.
+			nicClassExhaustions.Inc(nic, "veth")
+			logger.WithError(err).Warn("Shaping pod on its veth instead of the uplink")
+			record.NICOverflow = true
+			shapeVeth = true
+		case isClassesExhausted(err):
+			nicClassExhaustions.Inc(nic, "rejected")
+			return "", err
+		case err != nil:
+			return "", err
+		default:
+			record.ShapingMode = ShapingModeNIC
+			record.NIC = nic
+			record.NICClassMinor = minor
 		}
-		if !reflect.DeepEqual(cFilter, *filter) {
-			fmt.Println("U32 %v and %v are not equal", cFilter, *filter)
+	}
+	if shapeVeth {
+		var split ProtocolSplit
+		if conf.ProtocolSplit != nil {
+			split = *conf.ProtocolSplit
+			record.TCPShare, record.UDPShare = split.TCP, split.UDP
 		}
-
-		filters, err := netlink.FilterList(hostVeth, qdiscHandle)
+		classes, err := trafficClassesOf(conf)
 		if err != nil {
-			fmt.Println("filter list err")
+			return "", err
+		}
+		record.Classes = classes
+		prio := HTBPrio(conf.LatencyClass, conf.ClassPriority)
+		bursts := burstsOf(conf)
+		ingressCeil, egressCeil := CeilsOf(record, rates.Ingress, rates.Egress)
+		ebpf := useEBPF(conf, store, logger)
+		police := conf.Enforcement == EnforcementPolice
+		tbf := singleClass(conf) && conf.Backend == "" && !police
+		switch {
+		case ebpf:
+			record.Qdisc = QdiscEBPF
+		case police:
+			record.Qdisc = QdiscPolice
+		case tbf:
+			record.Qdisc = QdiscTBF
+		}
+		// Each direction is only set up if it is limited, so an unlimited direction costs no qdiscs or devices. The
+		// IFB device and the ingress qdisc feeding it only exist to shape egress.
+		if rates.Ingress != 0 {
+			span := tracing.Start("ingress tc")
+			var err error
+			if ebpf {
+				err = setupIngressEBPF(hostVeth, record.Key(), rates.Ingress)
+			} else if police {
+				err = setupIngressPolice(hostVeth, rates.Ingress, bursts.ingress(rates.Ingress).buffer)
+			} else if tbf {
+				err = setupIngressTBF(hostVeth, rates.Ingress, bursts.ingress(rates.Ingress).buffer)
+			} else {
+				err = setupIngressShaping(hostVeth, 0, rates.Ingress, ingressCeil, bursts.ingress(rates.Ingress), conf.LatencyClass,
+					conf.LeafQdisc, conf.ClassPriority, conf.NonIPPolicy, conf.IPFamilyBudget, conf.Classifier, conf.MirrorTo)
+			}
+			if err == nil {
+				err = splitGeneration(hostVeth.Attrs().Name, shaping.HostVethQdiscMajor, 0, rates.Ingress, ingressCeil,
+					bursts.ingress(rates.Ingress), prio, conf.IPFamilyBudget, split)
+			}
+			if err == nil {
+				err = classGeneration(hostVeth.Attrs().Name, shaping.HostVethQdiscMajor, 0, rates.Ingress, ingressCeil,
+					bursts.ingress(rates.Ingress), prio, conf.IPFamilyBudget, classesIn(classes, "ingress"))
+			}
+			span.End(err)
+			if err != nil {
+				return "", err
+			}
 		}
-		if len(filters) != 1 {
-			fmt.Println("Failed to add filter")
+		// Without IFB devices, traffic leaving the pod can only be policed where the host veth receives it.
+		var noIFB string
+		if rates.Egress != 0 && !ebpf && !police {
+			noIFB = ifbUnavailable(store, logger)
+		}
+		if rates.Egress != 0 && ebpf {
+			// Traffic leaving the pod is policed where the host veth receives it, with no IFB device.
+			span := tracing.Start("egress tc")
+			err := setupEgressEBPF(hostVeth, record.Key(), rates.Egress, bursts.egress(rates.Egress).buffer)
+			span.End(err)
+			if err != nil {
+				return "", err
+			}
+		} else if rates.Egress != 0 && police {
+			// Traffic leaving the pod is dropped over its rate where the host veth receives it, with no IFB device.
+			span := tracing.Start("egress police")
+			err := setupEgressPolice(hostVeth, rates.Egress, bursts.egress(rates.Egress).buffer)
+			span.End(err)
+			if err != nil {
+				return "", err
+			}
+		} else if noIFB != "" {
+			span := tracing.Start("egress police")
+			err := shaping.SetupPolicer(hostVeth, rates.Egress, bursts.egress(rates.Egress).buffer)
+			span.End(err)
+			if err != nil {
+				return "", err
+			}
+			record.EgressPoliced = true
+			logger.WithFields(log.Fields{"egressStrategy": egressStrategyPolice, "reason": noIFB}).Warn(
+				"Kernel can't create IFB devices, policing egress instead of shaping it")
+		} else if rates.Egress != 0 {
+			namer, err := NewNamer(conf)
+			if err != nil {
+				return "", err
+			}
+			ifbname, err := namer.IFBName(args)
+			if err != nil {
+				return "", fmt.Errorf("failed to name IFB device: %v", err)
+			}
+			// The device is recorded before it is set up, for a failed setup to be rolled back.
+			record.IFB = ifbname
+			span := tracing.Start("egress tc")
+			if tbf {
+				err = setupEgressTBF(hostVeth, ifbname, rates.Egress, bursts.egress(rates.Egress).buffer, conf.NonIPPolicy)
+			} else {
+				err = setupEgressShaping(hostVeth, ifbname, 0, rates.Egress, egressCeil, bursts.egress(rates.Egress), conf.LatencyClass,
+					conf.LeafQdisc, conf.ClassPriority, conf.NonIPPolicy, conf.IPFamilyBudget, conf.Classifier, conf.MirrorTo, conf.DSCP)
+			}
+			if err == nil {
+				err = splitGeneration(ifbname, shaping.IFBQdiscMajor, 0, rates.Egress, egressCeil, bursts.egress(rates.Egress), prio,
+					conf.IPFamilyBudget, split)
+			}
+			if err == nil {
+				err = classGeneration(ifbname, shaping.IFBQdiscMajor, 0, rates.Egress, egressCeil, bursts.egress(rates.Egress), prio,
+					conf.IPFamilyBudget, classesIn(classes, "egress"))
+			}
+			span.End(err)
+			if err != nil {
+				return "", err
+			}
+			logger.WithFields(log.Fields{"egressStrategy": egressStrategyIFB, "ifb": ifbname}).Info("Shaped egress on IFB device")
+			// The IFB device is reported with the interfaces of the result, as a device on the host.
+			if result != nil {
+				result.Interfaces = append(result.Interfaces, &current.Interface{Name: ifbname})
+			}
 		}
-         if err := netlink.LinkAdd(&netlink.Ifb{netlink.LinkAttrs{Name: ifbname, TxQLen: 1000}}); err != nil {
-		fmt.Println("create ifb wrong")
 	}
-	redir, _ := netlink.LinkByName(ifbname)
-	if err := netlink.LinkSetUp(redir); err != nil {
-		fmt.Println("set up foo err")
+
+	if conf.ConntrackMark {
+		mark := ConntrackMark(args.ContainerID)
+		span := tracing.Start("conntrack mark")
+		err := stampConntrack(hostVeth.Attrs().Name, mark)
+		span.End(err)
+		if err != nil {
+			return "", fmt.Errorf("failed to stamp connections of %q: %v", hostVeth.Attrs().Name, err)
+		}
+		record.ConntrackMark = mark
 	}
-	qdisc_ingress := &netlink.Ingress{
-		QdiscAttrs: netlink.QdiscAttrs{
-			LinkIndex: hostVeth.Attrs().Index,
-			Handle:    netlink.MakeHandle(0xffff, 0),
-			Parent:    netlink.HANDLE_INGRESS,
-		},
+
+	limits := PacketLimits{
+		DNS:         conf.DNSRateLimit,
+		ICMP:        conf.ICMPRateLimit,
+		ICMPv6:      conf.ICMPv6RateLimit,
+		Ingress:     rates.IngressPPS,
+		Egress:      rates.EgressPPS,
+		MaxPPS:      conf.MaxPPS,
+		Connections: conf.MaxConnections,
 	}
-	if err := netlink.QdiscAdd(qdisc_ingress); err != nil {
-		fmt.Println("add qdisc err")
+	if mode == ShapingModeNFTables {
+		limits.IngressRate, limits.EgressRate = rates.Ingress, rates.Egress
 	}
-	classId_ingress := netlink.MakeHandle(1, 1)
-	filter_ingress := &netlink.U32{
-		FilterAttrs: netlink.FilterAttrs{
-			LinkIndex: hostVeth.Attrs().Index,
-			Parent:    netlink.MakeHandle(0xffff, 0),
-			Priority:  1,
-			Protocol:  syscall.ETH_P_IP,
-		},
-		RedirIndex: redir.Attrs().Index,
-		ClassId:    classId_ingress,
+	if !limits.Empty() && hostVeth == nil {
+		return "", fmt.Errorf("packet rate limits need a host veth, which mode %q has none of", attachmentMode(conf))
 	}
-	if err := netlink.FilterAdd(filter_ingress); err != nil {
-		fmt.Println("add filter err")
+	if !limits.Empty() {
+		span := tracing.Start("packet limits")
+		err := applyPacketLimits(hostVeth.Attrs().Name, limits)
+		span.End(err)
+		if err != nil {
+			return "", fmt.Errorf("failed to limit packet rates of %q: %v", hostVeth.Attrs().Name, err)
+		}
+		record.DNSRateLimit = limits.DNS
+		record.ICMPRateLimit = limits.ICMP
+		record.ICMPv6RateLimit = limits.ICMPv6
+		record.IngressPPS = limits.Ingress
+		record.EgressPPS = limits.Egress
+		record.MaxPPS = limits.MaxPPS
+		record.MaxConnections = limits.Connections
 	}
-	index_ingress := redir.Attrs().Index
+	return mode, nil
+}
 
-	qdiscHandle_ingress := netlink.MakeHandle(0x1, 0x0)
-	qdiscAttrs_ingress := netlink.QdiscAttrs{
-		LinkIndex: index_ingress,
-		Handle:    qdiscHandle_ingress,
-		Parent:    netlink.HANDLE_ROOT,
+// rollbackShaping removes what programShaping set up for the pod of record before it failed, so that a failed ADD
+// leaves no half-built shaping behind: the qdiscs of its host veth, if it has one, or of its interface if it is
+// shaped inside its network namespace, its IFB device, and what record says was set up outside them.
+func rollbackShaping(store *state.Store, record *state.Record, hostVeth netlink.Link, logger *log.Entry) {
+	if hostVeth != nil {
+		shaping.Teardown(hostVeth)
 	}
-
-	qdisc_ingress_2 := netlink.NewHtb(qdiscAttrs_ingress)
-	if err := netlink.QdiscAdd(qdisc_ingress_2); err != nil {
-		fmt.Println("add qdisc err")
+	if record.ShapingMode == ShapingModeContainer {
+		teardownContainerShaping(record, logger)
+	}
+	if record.IFB != "" {
+		if _, err := shaping.DeleteIFB(record.IFB); err != nil {
+			logger.WithError(err).WithField("interface", record.IFB).Warn("Failed to remove IFB device")
+		}
 	}
+	removeRecordedShaping(store, record, logger)
+}
 
-	classId_ingress_2 := netlink.MakeHandle(0x1, 0x56cb)
-	classAttrs_ingress := netlink.ClassAttrs{
-		LinkIndex: index_ingress,
-		Parent:    qdiscHandle_ingress,
-		Handle:    classId_ingress_2,
+// effectiveShapingMode returns the shaping mode of a pod: the configured one, unless the pod is limited and the
+// kernel can't shape with tc, in which case its rates are policed with nftables instead.
+func effectiveShapingMode(conf NetConf, store *state.Store, rates ShapingRates, logger *log.Entry) string {
+	mode := conf.ShapingMode
+	if mode == "" {
+		mode = ShapingModeVeth
 	}
-	htbClassAttrs_ingress := netlink.HtbClassAttrs{
-		Rate:   uint64(Rate2),
-		Buffer: 32 * 1024,
+	if mode == ShapingModeNFTables || (rates.Ingress == 0 && rates.Egress == 0) {
+		return mode
 	}
-	htbClass_ingress := netlink.NewHtbClass(classAttrs_ingress, htbClassAttrs_ingress)
-	if err := netlink.ClassReplace(htbClass_ingress); err != nil {
-		fmt.Println("Failed to add a HTB class: %v", err)
+	if conf.NFTablesFallback != nil && !*conf.NFTablesFallback {
+		return mode
 	}
-
-	u32SelKeys_ingress := []netlink.TcU32Key{
-
-		netlink.TcU32Key{
-			Mask:    0x00000000,
-			Val:     0x00000000,
-			Off:     12,
-			OffMask: 0,
-		},
+	caps, err := ProbeCapabilities(store, false, logger)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to probe kernel capabilities, assuming tc shaping works")
+		return mode
 	}
-	filter_ingress_2 := &netlink.U32{
-		FilterAttrs: netlink.FilterAttrs{
-			LinkIndex: index_ingress,
-			Parent:    qdiscHandle_ingress,
-			Priority:  1,
-			Protocol:  syscall.ETH_P_IP,
-		},
-		Sel: &netlink.TcU32Sel{
-			Keys:  u32SelKeys_ingress,
-			Flags: netlink.TC_U32_TERMINAL,
-		},
-		ClassId: classId_ingress_2,
-		Actions: []netlink.Action{},
+	if !caps.TCShaping {
+		logger.WithField("reason", caps.TCShapingError).Warn("Kernel can't shape with tc, policing rates with nftables instead")
+		return ShapingModeNFTables
 	}
+	return mode
+}
+
+// setupIngressShaping shapes traffic entering the pod, which the host veth transmits, with an HTB qdisc at the root
+// of the host veth, using the class and filters of generation gen, with the given ceil and buffers. familyBudget
+// decides whether IPv6 shares the class of IPv4, classifier which filters classify traffic, and the traffic is
+// mirrored to the device mirrorTo if it is set. Shaping left on the host veth by an earlier attempt is reconciled with
+// it.
+func setupIngressShaping(hostVeth netlink.Link, gen int, ingressRate, ceil uint64, buffer htbBuffer, latencyClass, leafQdisc string, classPriority uint32, nonIPPolicy, familyBudget, classifier, mirrorTo string) error {
+	s := vethShaper(gen, ceil, buffer.cbuffer, latencyClass, leafQdisc, classPriority, nonIPPolicy, familyBudget, classifier, mirrorTo)
+	return s.SetupEgress(hostVeth, ingressRate, buffer.buffer)
+}
 
-	if err := netlink.FilterAdd(filter_ingress_2); err != nil {
-		fmt.Println("add filter err")
+// setupEgressShaping shapes traffic leaving the pod, which the host veth receives: it is redirected to an IFB
+// device, whose root HTB qdisc enforces the egress rate. The filters and class are those of generation gen, and the
+// class has the given ceil and buffers. familyBudget decides whether IPv6 shares the class of IPv4, classifier which
+// filters classify and redirect traffic, the traffic is mirrored to the device mirrorTo if it is set, and the IP
+// traffic is marked with dscp if it is set. An IFB device and shaping left by an earlier attempt are reconciled with
+// it.
+func setupEgressShaping(hostVeth netlink.Link, ifbname string, gen int, egressRate, ceil uint64, buffer htbBuffer, latencyClass, leafQdisc string, classPriority uint32, nonIPPolicy, familyBudget, classifier, mirrorTo string, dscp *uint8) error {
+	s := vethShaper(gen, ceil, buffer.cbuffer, latencyClass, leafQdisc, classPriority, nonIPPolicy, familyBudget, classifier, mirrorTo)
+	s.DSCP = dscp
+	return s.SetupIngress(hostVeth, ifbname, egressRate, buffer.buffer)
+}
+
+// vethShaper returns the shaper of generation gen of the veth shaping of a pod, with the given ceil, cbuffer and
+// options.
+func vethShaper(gen int, ceil uint64, cbuffer uint32, latencyClass, leafQdisc string, classPriority uint32, nonIPPolicy, familyBudget, classifier, mirrorTo string) *shaping.Shaper {
+	return &shaping.Shaper{
+		Generation:   gen,
+		Prio:         HTBPrio(latencyClass, classPriority),
+		Cbuffer:      cbuffer,
+		Ceil:         ceil,
+		LowLatency:   latencyClass == LatencyClassLow,
+		Leaf:         leafQdisc,
+		SeparateIPv6: familyBudget == IPFamilyBudgetSeparate,
+		NonIP:        nonIPPolicy,
+		Classifier:   shaperClassifier(classifier),
+		MirrorTo:     mirrorTo,
 	}
-	return hostVethName, contVethMAC, err
 }
 
-// setupRoutes sets up the routes for the host side of the veth pair.
-func setupRoutes(hostVeth netlink.Link, result *current.Result) error {
+// setupRoutes sets up the routes for the host side of the veth pair, a host route to each address of the container
+// whatever its prefix, recording them in tx.
+func setupRoutes(hostVeth netlink.Link, result *current.Result, tx *setupTransaction) error {
+	added := map[string]bool{}
 	for _, ip := range result.IPs {
-		err := netlink.RouteAdd(
-			&netlink.Route{
-				LinkIndex: hostVeth.Attrs().Index,
-				Scope:     netlink.SCOPE_LINK,
-				Dst:       &ip.Address,
-			})
-			if err != nil {
-			return fmt.Errorf("failed to add route %v", err)
+		dst := hostRoute(ip.Address)
+		if added[dst.String()] {
+			continue
+		}
+		// Replace rather than add, so that a retried host side setup doesn't fail on routes it already added.
+		err := countNetlink("RouteReplace", func() error {
+			return netlink.RouteReplace(
+				&netlink.Route{
+					LinkIndex: hostVeth.Attrs().Index,
+					Scope:     netlink.SCOPE_LINK,
+					Dst:       &dst,
+				})
+		})
+		if err != nil {
+			return fmt.Errorf("failed to add route to %v: %v", dst.String(), err)
 		}
+		added[dst.String()] = true
+		tx.created("route to "+dst.String(), deleteRoute(hostVeth.Attrs().Index, dst))
 
-		log.Debugf("CNI adding route for interface: %v, IP: %s", hostVeth, ip.Address)
+		tx.logger.WithFields(log.Fields{"interface": hostVeth.Attrs().Name, "IP": dst.String()}).Debug("Added host route")
 	}
 	return nil
 }
 
-// configureSysctls configures necessary sysctls required for the host side of the veth pair for IPv4 and/or IPv6.
-func configureSysctls(hostVethName string, hasIPv4, hasIPv6 bool) error {
-	var err error
+// hostRoute returns the destination of the host route to the address of addr: a /32 for IPv4 and a /128 for IPv6.
+func hostRoute(addr net.IPNet) net.IPNet {
+	if v4 := addr.IP.To4(); v4 != nil {
+		return net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}
+	}
+	return net.IPNet{IP: addr.IP.To16(), Mask: net.CIDRMask(128, 128)}
+}
+
+// addProxyNDP makes the host answer neighbor solicitations for gw on the host veth. proxy_ndp only answers for
+// addresses with a proxy entry, and the link-local address the container was given as its gateway is the one the
+// veth had in the container's namespace: once the veth is moved to the host, it may get a different one, e.g. with
+// stable privacy addresses, or none until DAD completes.
+func addProxyNDP(hostVethName string, gw net.IP, tx *setupTransaction) error {
+	hostVeth, err := netlink.LinkByName(hostVethName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", hostVethName, err)
+	}
+	// Set rather than add, so that a retried host side setup doesn't fail on the entry it already added.
+	err = countNetlink("NeighSet", func() error {
+		return netlink.NeighSet(&netlink.Neigh{
+			LinkIndex: hostVeth.Attrs().Index,
+			Family:    netlink.FAMILY_V6,
+			Flags:     netlink.NTF_PROXY,
+			IP:        gw,
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add proxy NDP entry for %s on %q: %v", gw, hostVethName, err)
+	}
+	tx.created("proxy NDP entry for "+gw.String(), deleteProxyNDP(hostVeth.Attrs().Index, gw))
+	return nil
+}
+
+// configureSysctls configures necessary sysctls required for the host side of the veth pair for IPv4 and/or IPv6,
+// unless the network configuration turns them off, then the reverse path filter, neighbour timings and any extra
+// sysctls from the network configuration. All of them are attempted; the error names every key that couldn't be
+// applied.
+func configureSysctls(hostVethName string, hasIPv4, hasIPv6 bool, conf NetConf) error {
+	b, err := hostVethSysctls(hasIPv4, hasIPv6, conf)
+	if err != nil {
+		return err
+	}
+	return b.Apply(hostVethName)
+}
+
+// hostVethSysctls returns the sysctls configureSysctls sets on the host side of the veth pair.
+func hostVethSysctls(hasIPv4, hasIPv6 bool, conf NetConf) (*sysctl.Batch, error) {
+	b := &sysctl.Batch{}
 
-	if hasIPv4 {
+	// In the bridge mode the veth is a port of the bridge, which routes for the container instead.
+	routed := attachmentMode(conf) == ModePTP
+	proxyARP := conf.ProxyARP == nil || *conf.ProxyARP
+	forwarding := conf.Forwarding == nil || *conf.Forwarding
+
+	if hasIPv4 && routed && proxyARP {
 		// Enable proxy ARP, this makes the host respond to all ARP requests with its own
 		// MAC. We install explicit routes into the containers network
 		// namespace and we use a link-local address for the gateway.  Turing on proxy ARP
 		// means that we don't need to assign the link local address explicitly to each
 		// host side of the veth, which is one fewer thing to maintain and one fewer
 		// thing we may clash over.
-		if err = writeProcSys(fmt.Sprintf("/proc/sys/net/ipv4/conf/%s/proxy_arp", hostVethName), "1"); err != nil {
-			return err
-		}
+		b.Set("net.ipv4.conf.IFNAME.proxy_arp", "1")
 
 		// Normally, the kernel has a delay before responding to proxy ARP but we know
-		// that's not needed in a Calico network so we disable it.
-		if err = writeProcSys(fmt.Sprintf("/proc/sys/net/ipv4/neigh/%s/proxy_delay", hostVethName), "0"); err != nil {
-			return err
-		}
+		// that's not needed in a Calico network so we disable it, unless neighTiming
+		// asks for one.
+		b.Set("net.ipv4.neigh.IFNAME.proxy_delay", "0")
+	}
 
+	if hasIPv4 && routed && forwarding {
 		// Enable IP forwarding of packets coming _from_ this interface.  For packets to
 		// be forwarded in both directions we need this flag to be set on the fabric-facing
 		// interface too (or for the global default to be set).
-		if err = writeProcSys(fmt.Sprintf("/proc/sys/net/ipv4/conf/%s/forwarding", hostVethName), "1"); err != nil {
-			return err
-		}
+		b.Set("net.ipv4.conf.IFNAME.forwarding", "1")
 	}
 
-	if hasIPv6 {
+	if hasIPv6 && routed {
 		// Enable proxy NDP, similarly to proxy ARP, described above in IPv4 section.
-		if err = writeProcSys(fmt.Sprintf("/proc/sys/net/ipv6/conf/%s/proxy_ndp", hostVethName), "1"); err != nil {
-			return err
-		}
+		b.Set("net.ipv6.conf.IFNAME.proxy_ndp", "1")
+	}
 
+	if hasIPv6 && routed && forwarding {
 		// Enable IP forwarding of packets coming _from_ this interface.  For packets to
 		// be forwarded in both directions we need this flag to be set on the fabric-facing
 		// interface too (or for the global default to be set).
-		if err = writeProcSys(fmt.Sprintf("/proc/sys/net/ipv6/conf/%s/forwarding", hostVethName), "1"); err != nil {
-			return err
-		}
+		b.Set("net.ipv6.conf.IFNAME.forwarding", "1")
 	}
 
-	return nil
-}
-
-// writeProcSys takes the sysctl path and a string value to set i.e. "0" or "1" and sets the sysctl.
-func writeProcSys(path, value string) error {
-	f, err := os.OpenFile(path, os.O_WRONLY, 0)
-	if err != nil {
-		return err
-	}
-	n, err := f.Write([]byte(value))
-	if err == nil && n < len(value) {
-		err = io.ErrShortWrite
-	}
-	if err1 := f.Close(); err == nil {
-		err = err1
+	conf.RPFilter.set(b, hasIPv4)
+	if err := conf.NeighTiming.set(b, hasIPv4, hasIPv6); err != nil {
+		return nil, err
 	}
-	return err
+	b.SetAll(conf.Sysctls)
+	return b, nil
 }
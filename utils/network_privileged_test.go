@@ -0,0 +1,413 @@
+//go:build privileged
+// +build privileged
+
+package utils_test
+
+// These tests run DoNetworking against throwaway network namespaces standing in for the host and the pod, and check
+// what it programmed with netlink. They need root: go test -tags privileged ./utils/
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types/current"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/cni-plugin/shaping"
+	"github.com/projectcalico/cni-plugin/state"
+	"github.com/projectcalico/cni-plugin/utils"
+	"github.com/vishvananda/netlink"
+)
+
+var _ = Describe("DoNetworking", func() {
+	var hostNS, podNS ns.NetNS
+	var stateDir, confDir string
+	var conf utils.NetConf
+	var args *skel.CmdArgs
+	var result *current.Result
+	logger := log.WithField("test", "network")
+
+	BeforeEach(func() {
+		var err error
+		hostNS, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		podNS, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		stateDir, err = ioutil.TempDir("", "flowcontrol-state")
+		Expect(err).NotTo(HaveOccurred())
+		confDir, err = ioutil.TempDir("", "flowcontrol-cni")
+		Expect(err).NotTo(HaveOccurred())
+
+		conf = utils.NetConf{HostNetNS: hostNS.Path(), StateDir: stateDir, CNIConfDir: confDir}
+		conf.Name = "test"
+		args = &skel.CmdArgs{ContainerID: "0123456789abcdef", IfName: "eth0", Netns: podNS.Path()}
+		_, addr, _ := net.ParseCIDR("10.100.0.2/32")
+		addr.IP = net.ParseIP("10.100.0.2")
+		result = &current.Result{IPs: []*current.IPConfig{{Version: "4", Address: *addr}}}
+	})
+
+	AfterEach(func() {
+		Expect(podNS.Close()).To(Succeed())
+		Expect(hostNS.Close()).To(Succeed())
+		os.RemoveAll(stateDir)
+		os.RemoveAll(confDir)
+	})
+
+	// inHost runs f in the namespace standing in for the host.
+	inHost := func(f func()) {
+		Expect(hostNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			f()
+			return nil
+		})).To(Succeed())
+	}
+
+	rootQdisc := func(link netlink.Link) netlink.Qdisc {
+		qdiscs, err := netlink.QdiscList(link)
+		Expect(err).NotTo(HaveOccurred())
+		for _, q := range qdiscs {
+			if q.Attrs().Parent == netlink.HANDLE_ROOT {
+				return q
+			}
+		}
+		return nil
+	}
+
+	It("sets up the veth of an unlimited pod without shaping it", func() {
+		hostVethName, _, err := utils.DoNetworking(args, conf, result, logger, "", "", "")
+		Expect(err).NotTo(HaveOccurred())
+		inHost(func() {
+			veth, err := netlink.LinkByName(hostVethName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rootQdisc(veth)).NotTo(BeAssignableToTypeOf(&netlink.Htb{}))
+			routes, err := netlink.RouteList(veth, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(routes).To(HaveLen(1))
+			Expect(routes[0].Dst.String()).To(Equal("10.100.0.2/32"))
+		})
+	})
+
+	It("shapes both directions of a limited pod with HTB classes", func() {
+		conf.Shaper = utils.QdiscHTB
+		hostVethName, _, err := utils.DoNetworking(args, conf, result, logger, "", "10M", "20M")
+		Expect(err).NotTo(HaveOccurred())
+		r, err := state.NewStore(stateDir).Load(args.ContainerID)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(r.HostVeth).To(Equal(hostVethName))
+		inHost(func() {
+			veth, err := netlink.LinkByName(hostVethName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rootQdisc(veth)).To(BeAssignableToTypeOf(&netlink.Htb{}))
+			classes, err := netlink.ClassList(veth, netlink.MakeHandle(shaping.HostVethQdiscMajor, 0))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(classes).To(HaveLen(1))
+			Expect(classes[0].(*netlink.HtbClass).Rate).To(Equal(uint64(10 * 1000 * 1000 / 8)))
+
+			ifb, err := netlink.LinkByName(r.IFB)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rootQdisc(ifb)).To(BeAssignableToTypeOf(&netlink.Htb{}))
+			classes, err = netlink.ClassList(ifb, netlink.MakeHandle(shaping.IFBQdiscMajor, 0))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(classes).To(HaveLen(1))
+			Expect(classes[0].(*netlink.HtbClass).Rate).To(Equal(uint64(20 * 1000 * 1000 / 8)))
+			filters, err := netlink.FilterList(veth, netlink.MakeHandle(0xffff, 0))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filters).NotTo(BeEmpty())
+			Expect(utils.VerifyShaping(r)).To(BeEmpty())
+		})
+	})
+
+	It("shapes a pod with a single class per direction with TBF qdiscs", func() {
+		hostVethName, _, err := utils.DoNetworking(args, conf, result, logger, "", "10M", "")
+		Expect(err).NotTo(HaveOccurred())
+		inHost(func() {
+			veth, err := netlink.LinkByName(hostVethName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rootQdisc(veth)).To(BeAssignableToTypeOf(&netlink.Tbf{}))
+		})
+	})
+
+	It("serves low latency pods before bulk ones under the shared root class of the uplink", func() {
+		inHost(func() {
+			Expect(netlink.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "uplink0"}})).To(Succeed())
+			uplink, err := netlink.LinkByName("uplink0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(uplink)).To(Succeed())
+		})
+		fallback := false
+		conf.ShapingMode, conf.NICName, conf.NFTablesFallback = utils.ShapingModeNIC, "uplink0", &fallback
+		conf.NICHierarchy = &utils.NICHierarchy{Rate: 1000 * 1000 * 1000}
+		_, _, err := utils.DoNetworking(args, conf, result, logger, "", "10M", "10M")
+		Expect(err).NotTo(HaveOccurred())
+
+		latencyNS, err := ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer latencyNS.Close()
+		latencyArgs := &skel.CmdArgs{ContainerID: "fedcba9876543210", IfName: "eth0", Netns: latencyNS.Path()}
+		_, addr, _ := net.ParseCIDR("10.100.0.3/32")
+		addr.IP = net.ParseIP("10.100.0.3")
+		latencyResult := &current.Result{IPs: []*current.IPConfig{{Version: "4", Address: *addr}}}
+		conf.LatencyClass = utils.LatencyClassLow
+		_, _, err = utils.DoNetworking(latencyArgs, conf, latencyResult, logger, "", "10M", "10M")
+		Expect(err).NotTo(HaveOccurred())
+
+		store := state.NewStore(stateDir)
+		bulk, err := store.Load(args.ContainerID)
+		Expect(err).NotTo(HaveOccurred())
+		latency, err := store.Load(latencyArgs.ContainerID)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(latency.NICParentMinor).To(Equal(bulk.NICParentMinor))
+		inHost(func() {
+			uplink, err := netlink.LinkByName("uplink0")
+			Expect(err).NotTo(HaveOccurred())
+			classes, err := netlink.ClassList(uplink, 0)
+			Expect(err).NotTo(HaveOccurred())
+			prios := map[uint32]uint32{}
+			for _, c := range classes {
+				prios[c.Attrs().Handle] = c.(*netlink.HtbClass).Prio
+			}
+			Expect(prios).To(HaveKeyWithValue(netlink.MakeHandle(1, latency.NICClassMinor), uint32(0)))
+			Expect(prios).To(HaveKeyWithValue(netlink.MakeHandle(1, bulk.NICClassMinor), uint32(1)))
+		})
+	})
+
+	It("checks a pod whose sysctls it doesn't manage without reporting them as drifted", func() {
+		manage := false
+		conf.ManageSysctls = &manage
+		_, _, err := utils.DoNetworking(args, conf, result, logger, "", "", "")
+		Expect(err).NotTo(HaveOccurred())
+		args.StdinData, err = json.Marshal(map[string]interface{}{"prevResult": result})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(utils.CheckContainer(args, conf)).To(Succeed())
+	})
+
+	It("rolls the veth back when a later step fails", func() {
+		conf.Sysctls = map[string]string{"net.ipv4.conf.IFNAME.no_such_sysctl": "1"}
+		hostVethName, _, err := utils.DoNetworking(args, conf, result, logger, "", "10M", "")
+		Expect(err).To(HaveOccurred())
+		Expect(hostVethName).To(BeEmpty())
+		inHost(func() {
+			links, err := netlink.LinkList()
+			Expect(err).NotTo(HaveOccurred())
+			for _, l := range links {
+				Expect(l.Type()).NotTo(Equal("veth"))
+			}
+		})
+		Expect(podNS.Do(func(ns.NetNS) error {
+			_, err := netlink.LinkByName(args.IfName)
+			return err
+		})).NotTo(Succeed())
+	})
+
+	// takeIFBName makes the egress shaping of the pod fail, after its routes and its ingress shaping are set up, by
+	// giving its IFB name to a device that isn't an IFB, which the rollback must leave alone.
+	takeIFBName := func() {
+		namer, err := utils.NewNamer(conf)
+		Expect(err).NotTo(HaveOccurred())
+		name, err := namer.IFBName(args)
+		Expect(err).NotTo(HaveOccurred())
+		inHost(func() {
+			Expect(netlink.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: name}})).To(Succeed())
+		})
+	}
+
+	// expectNothingRouted checks that no route to the addresses of the pod and no proxy NDP entry is left on the host.
+	expectNothingRouted := func() {
+		inHost(func() {
+			routes, err := netlink.RouteList(nil, netlink.FAMILY_ALL)
+			Expect(err).NotTo(HaveOccurred())
+			for _, r := range routes {
+				for _, addr := range result.IPs {
+					Expect(r.Dst == nil || !r.Dst.IP.Equal(addr.Address.IP)).To(BeTrue(), "route to %s left", addr.Address.IP)
+				}
+			}
+			proxies, err := netlink.NeighProxyList(0, netlink.FAMILY_V6)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(proxies).To(BeEmpty())
+		})
+	}
+
+	DescribeTable("rolls a failed ADD back",
+		func(fail func(), shaper string, ingress, egress string) {
+			conf.Shaper = shaper
+			fail()
+			hostVethName, _, err := utils.DoNetworking(args, conf, result, logger, "", ingress, egress)
+			Expect(err).To(HaveOccurred())
+			Expect(hostVethName).To(BeEmpty())
+			inHost(func() {
+				links, err := netlink.LinkList()
+				Expect(err).NotTo(HaveOccurred())
+				for _, l := range links {
+					Expect(l.Type()).NotTo(Equal("veth"))
+					Expect(l.Type()).NotTo(Equal("ifb"))
+				}
+			})
+			Expect(podNS.Do(func(ns.NetNS) error {
+				_, err := netlink.LinkByName(args.IfName)
+				return err
+			})).NotTo(Succeed())
+			expectNothingRouted()
+			_, err = state.NewStore(stateDir).Load(args.ContainerID)
+			Expect(err).To(Equal(state.ErrNotFound))
+		},
+		Entry("when a sysctl can't be set", func() {
+			conf.Sysctls = map[string]string{"net.ipv4.conf.IFNAME.no_such_sysctl": "1"}
+		}, "", "10M", ""),
+		Entry("when egress can't be shaped with TBF", takeIFBName, "", "10M", "10M"),
+		Entry("when egress can't be shaped with HTB", takeIFBName, utils.QdiscHTB, "10M", "10M"),
+	)
+
+	DescribeTable("removes the routes, proxy NDP entries and shaping of a failed host side setup, keeping the veth",
+		func(shaper string) {
+			conf.Shaper = shaper
+			takeIFBName()
+			_, v6, _ := net.ParseCIDR("fd00::2/128")
+			v6.IP = net.ParseIP("fd00::2")
+			result.IPs = append(result.IPs, &current.IPConfig{Version: "6", Address: *v6})
+			container := utils.ContainerSideResult{HasIPv4: true, HasIPv6: true, IPv6Gateway: net.ParseIP("fe80::1")}
+			rates := utils.ShapingRates{Ingress: 10 * 1000 * 1000, Egress: 10 * 1000 * 1000}
+			inHost(func() {
+				Expect(netlink.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "calitest"},
+					PeerName: "calipeer"})).To(Succeed())
+				err := utils.HostSideSetup(args, conf, result, "calitest", container, rates, logger)
+				Expect(err).To(HaveOccurred())
+
+				veth, err := netlink.LinkByName("calitest")
+				Expect(err).NotTo(HaveOccurred())
+				qdiscs, err := netlink.QdiscList(veth)
+				Expect(err).NotTo(HaveOccurred())
+				for _, q := range qdiscs {
+					Expect([]string{"htb", "tbf", "ingress"}).NotTo(ContainElement(q.Type()))
+				}
+			})
+			expectNothingRouted()
+			_, err := state.NewStore(stateDir).Load(args.ContainerID)
+			Expect(err).To(Equal(state.ErrNotFound))
+		},
+		Entry("with TBF", ""),
+		Entry("with HTB", utils.QdiscHTB),
+	)
+
+	DescribeTable("brings a pod it can't shape up unshaped when strict_shaping is off, recording it degraded",
+		func(shaper string, ingress, egress string) {
+			strict := false
+			conf.StrictShaping, conf.Shaper = &strict, shaper
+			takeIFBName()
+			hostVethName, _, err := utils.DoNetworking(args, conf, result, logger, "", ingress, egress)
+			Expect(err).NotTo(HaveOccurred())
+			inHost(func() {
+				veth, err := netlink.LinkByName(hostVethName)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(veth.Attrs().Flags & net.FlagUp).NotTo(BeZero())
+				routes, err := netlink.RouteList(veth, netlink.FAMILY_V4)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(routes).To(HaveLen(1))
+				qdiscs, err := netlink.QdiscList(veth)
+				Expect(err).NotTo(HaveOccurred())
+				for _, q := range qdiscs {
+					Expect([]string{"htb", "tbf", "ingress"}).NotTo(ContainElement(q.Type()))
+				}
+			})
+			Expect(podNS.Do(func(ns.NetNS) error {
+				_, err := netlink.LinkByName(args.IfName)
+				return err
+			})).To(Succeed())
+
+			r, err := state.NewStore(stateDir).Load(args.ContainerID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(r.Status).To(Equal(state.StatusDegraded))
+			Expect(r.StatusReason).To(HavePrefix("shaping failed: "))
+			Expect(r.HostVeth).To(Equal(hostVethName))
+			// The record keeps the limits the pod was meant to have, for the agent to repair.
+			Expect(r.IngressRate).To(Equal(uint64(10 * 1000 * 1000)))
+			Expect(r.EgressRate).To(Equal(uint64(10 * 1000 * 1000)))
+		},
+		Entry("with TBF", "", "10M", "10M"),
+		Entry("with HTB", utils.QdiscHTB, "10M", "10M"),
+	)
+
+	Describe("TeardownContainer", func() {
+		var hostVethName, ifbName string
+
+		BeforeEach(func() {
+			namer, err := utils.NewNamer(conf)
+			Expect(err).NotTo(HaveOccurred())
+			hostVethName, err = namer.HostVethName(args)
+			Expect(err).NotTo(HaveOccurred())
+			ifbName, err = namer.IFBName(args)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		linkExists := func(name string) bool {
+			var err error
+			inHost(func() { _, err = netlink.LinkByName(name) })
+			return err == nil
+		}
+
+		DescribeTable("tears a pod down, whatever an interrupted DEL left of it, and again once it is gone",
+			func(interrupt func()) {
+				conf.Shaper = utils.QdiscHTB
+				_, _, err := utils.DoNetworking(args, conf, result, logger, "", "10M", "10M")
+				Expect(err).NotTo(HaveOccurred())
+				interrupt()
+
+				for i := 0; i < 2; i++ {
+					Expect(utils.TeardownContainer(args, conf, logger)).To(Succeed())
+					Expect(linkExists(hostVethName)).To(BeFalse())
+					Expect(linkExists(ifbName)).To(BeFalse())
+					expectNothingRouted()
+					_, err = state.NewStore(stateDir).Load(args.ContainerID)
+					Expect(err).To(Equal(state.ErrNotFound))
+				}
+			},
+			Entry("with nothing torn down", func() {}),
+			Entry("after its shaping", func() {
+				inHost(func() {
+					ifb, err := netlink.LinkByName(ifbName)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(netlink.LinkDel(ifb)).To(Succeed())
+				})
+			}),
+			Entry("after its veth", func() {
+				inHost(func() {
+					ifb, err := netlink.LinkByName(ifbName)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(netlink.LinkDel(ifb)).To(Succeed())
+					veth, err := netlink.LinkByName(hostVethName)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(netlink.LinkDel(veth)).To(Succeed())
+				})
+			}),
+		)
+
+		It("leaves a host veth with its name that another container marked", func() {
+			inHost(func() {
+				Expect(netlink.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: hostVethName},
+					PeerName: "calipeer"})).To(Succeed())
+				veth, err := netlink.LinkByName(hostVethName)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(netlink.LinkSetAlias(veth, "flowcontrol:0123456789abcdeg")).To(Succeed())
+			})
+			Expect(utils.TeardownContainer(args, conf, logger)).To(Succeed())
+			Expect(linkExists(hostVethName)).To(BeTrue())
+		})
+
+		It("leaves an IFB device with its name that the record of another container claims", func() {
+			other := &state.Record{ContainerID: "0123456789abcdeg", IfName: "eth0", IFB: ifbName}
+			Expect(state.NewStore(stateDir).Save(other)).To(Succeed())
+			inHost(func() {
+				Expect(netlink.LinkAdd(&netlink.Ifb{LinkAttrs: netlink.LinkAttrs{Name: ifbName}})).To(Succeed())
+			})
+			Expect(utils.TeardownContainer(args, conf, logger)).To(Succeed())
+			Expect(linkExists(ifbName)).To(BeTrue())
+			_, err := state.NewStore(stateDir).Load(state.RecordKey(other.ContainerID, other.IfName))
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+})
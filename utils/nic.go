@@ -0,0 +1,550 @@
+package utils
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/cni-plugin/internal/util"
+	"github.com/projectcalico/cni-plugin/metrics"
+	"github.com/projectcalico/cni-plugin/shaping"
+	"github.com/projectcalico/cni-plugin/state"
+	"github.com/vishvananda/netlink"
+)
+
+// Values of NetConf.ShapingMode.
+const (
+	// ShapingModeVeth shapes each pod on its own host veth and IFB device (the default).
+	ShapingModeVeth = "veth"
+	// ShapingModeNIC shapes all pods on the node's uplink: one class per pod on the uplink's root HTB qdisc,
+	// keyed by the pod's source IP, for egress; and one class per pod on a shared IFB device fed from the
+	// uplink's ingress, keyed by destination IP, for ingress.
+	ShapingModeNIC = "nic"
+	// ShapingModeNFTables polices the rates of each pod with nftables limit rules on its host veth, dropping what
+	// exceeds them. It is coarser than shaping, and is what pods fall back to on kernels without HTB or IFB.
+	ShapingModeNFTables = "nftables"
+)
+
+// Values of NetConf.NICOverflow.
+const (
+	// NICOverflowReject fails the ADD of pods that don't fit in the classes of the uplink (the default).
+	NICOverflowReject = "reject"
+	// NICOverflowVeth shapes pods that don't fit in the classes of the uplink on their own veth and IFB device.
+	NICOverflowVeth = "veth"
+)
+
+var nicClassExhaustions = metrics.NewCounter("flowcontrol_nic_class_exhaustions_total",
+	"Pods that found no free class on the uplink, by uplink and outcome (rejected, or veth if shaped on their veth).",
+	"nic", "outcome")
+
+// checkNICOverflow rejects unknown values of the nicOverflow option.
+func checkNICOverflow(overflow string) error {
+	switch overflow {
+	case "", NICOverflowReject, NICOverflowVeth:
+		return nil
+	}
+	return fmt.Errorf("unknown nicOverflow %q, must be %q or %q", overflow, NICOverflowReject, NICOverflowVeth)
+}
+
+const (
+	nicQdiscMajor = 0x1
+
+	// u32 node IDs are 12 bits and each pod takes two, which bounds the number of pods shaped on one uplink.
+	maxNICClassMinor = 0x7ff
+
+	nicFilterPrioV4 = 10
+	nicFilterPrioV6 = 11
+)
+
+// nicIFBName is the name of the shared IFB device carrying the ingress traffic of the uplink nic.
+func nicIFBName(nic string) string {
+	return util.TruncateIfName("ifb" + nic)
+}
+
+// uplinkName returns conf.NICName, or the interface of the IPv4 default route if it isn't set.
+func uplinkName(conf NetConf) (string, error) {
+	if conf.NICName != "" {
+		return conf.NICName, nil
+	}
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return "", err
+	}
+	for _, r := range routes {
+		if r.Dst == nil {
+			link, err := netlink.LinkByIndex(r.LinkIndex)
+			if err != nil {
+				return "", err
+			}
+			return link.Attrs().Name, nil
+		}
+	}
+	return "", fmt.Errorf("no default route to detect the uplink from, set nicName")
+}
+
+// detectMTU returns the MTU of the uplink, for the devices of containers when conf leaves it unset, so that
+// containers on uplinks with jumbo frames, or behind tunnels, don't default to 1500. It returns 0, leaving the MTU
+// to the kernel, if the uplink can't be found.
+func detectMTU(conf NetConf, logger *log.Entry) int {
+	name, err := uplinkName(conf)
+	if err != nil {
+		logger.WithError(err).Debug("Failed to find the uplink to take the MTU of")
+		return 0
+	}
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		logger.WithError(err).Debugf("Failed to lookup %q to take the MTU of", name)
+		return 0
+	}
+	logger.WithFields(log.Fields{"interface": name, "mtu": link.Attrs().MTU}).Debug("Detected MTU")
+	return link.Attrs().MTU
+}
+
+// ensureNICHierarchy creates the shared qdiscs on the uplink and its IFB device if they don't exist yet. The root
+// HTB qdiscs have no default class, so traffic not matching a pod's filter is not shaped.
+func ensureNICHierarchy(nic netlink.Link) (netlink.Link, error) {
+	root := netlink.NewHtb(netlink.QdiscAttrs{
+		LinkIndex: nic.Attrs().Index,
+		Handle:    netlink.MakeHandle(nicQdiscMajor, 0),
+		Parent:    netlink.HANDLE_ROOT,
+	})
+	if err := shaping.EnsureQdisc(nic, root); err != nil {
+		return nil, err
+	}
+
+	ifbName := nicIFBName(nic.Attrs().Name)
+	ifb, err := netlink.LinkByName(ifbName)
+	if err != nil {
+		if err = countNetlink("LinkAdd", func() error {
+			return netlink.LinkAdd(&netlink.Ifb{LinkAttrs: netlink.LinkAttrs{Name: ifbName, TxQLen: 1000}})
+		}); err != nil {
+			return nil, kernelSupportError(err, fmt.Sprintf("create %q", ifbName), "ifb")
+		}
+		if ifb, err = netlink.LinkByName(ifbName); err != nil {
+			return nil, err
+		}
+	}
+	if err = countNetlink("LinkSetUp", func() error { return netlink.LinkSetUp(ifb) }); err != nil {
+		return nil, fmt.Errorf("failed to set %q up: %v", ifbName, err)
+	}
+
+	ingress := &netlink.Ingress{QdiscAttrs: netlink.QdiscAttrs{
+		LinkIndex: nic.Attrs().Index,
+		Handle:    netlink.MakeHandle(0xffff, 0),
+		Parent:    netlink.HANDLE_INGRESS,
+	}}
+	if err = shaping.EnsureQdisc(nic, ingress); err != nil {
+		return nil, err
+	}
+	if filters, err := netlink.FilterList(nic, ingress.Handle); err != nil {
+		return nil, err
+	} else if len(filters) == 0 {
+		for _, proto := range []uint16{syscall.ETH_P_IP, syscall.ETH_P_IPV6} {
+			redirect := &netlink.U32{
+				FilterAttrs: netlink.FilterAttrs{
+					LinkIndex: nic.Attrs().Index,
+					Parent:    ingress.Handle,
+					Priority:  1,
+					Protocol:  proto,
+				},
+				RedirIndex: ifb.Attrs().Index,
+			}
+			if err = countNetlink("FilterAdd", func() error { return netlink.FilterAdd(redirect) }); err != nil {
+				return nil, fmt.Errorf("failed to redirect %s ingress to %s: %v", nic.Attrs().Name, ifbName, err)
+			}
+		}
+	}
+
+	ifbRoot := netlink.NewHtb(netlink.QdiscAttrs{
+		LinkIndex: ifb.Attrs().Index,
+		Handle:    netlink.MakeHandle(nicQdiscMajor, 0),
+		Parent:    netlink.HANDLE_ROOT,
+	})
+	if err = shaping.EnsureQdisc(ifb, ifbRoot); err != nil {
+		return nil, err
+	}
+	return ifb, nil
+}
+
+// allocateNICClass reserves a class minor for owner in the class registry of the uplink nic. A registry that
+// doesn't exist yet is seeded from the state records of pods already shaped on the uplink.
+func allocateNICClass(store *state.Store, nic string, owner *state.NICClass) (uint16, error) {
+	var minor uint16
+	err := store.UpdateNICClasses(nic, func(c *state.NICClasses, created bool) error {
+		if created {
+			records, err := store.List()
+			if err != nil {
+				return err
+			}
+			for _, r := range records {
+				if r.ShapingMode == ShapingModeNIC && r.NIC == nic {
+					c.Classes[r.NICClassMinor] = nicClassOwner(r)
+				}
+			}
+		}
+		var err error
+		minor, err = c.Allocate(owner, maxNICClassMinor)
+		return err
+	})
+	if err == state.ErrNICClassesExhausted {
+		return 0, classesExhaustedError(nic)
+	}
+	return minor, err
+}
+
+// releaseNICClass frees the class of the interface stored under key in the class registry of the uplink nic.
+func releaseNICClass(store *state.Store, nic, key string) error {
+	return store.UpdateNICClasses(nic, func(c *state.NICClasses, _ bool) error {
+		c.Release(key)
+		return nil
+	})
+}
+
+// nicClassOwner returns the class registry entry describing the pod of r.
+func nicClassOwner(r *state.Record) *state.NICClass {
+	return &state.NICClass{
+		ContainerID: r.ContainerID,
+		IfName:      r.IfName,
+		Workload:    r.Workload,
+		Namespace:   r.Namespace,
+		Pod:         r.Pod,
+		HostNetwork: r.HostNetwork,
+		Preset:      r.Preset,
+	}
+}
+
+// setupNICShaping adds a class and per-address filters for the pod of r to the shared hierarchy of the uplink, and
+// returns the uplink name and class minor used. The uplink name is also returned if no class is free on it.
+func setupNICShaping(conf NetConf, store *state.Store, r *state.Record, ips []net.IP, ingressRate, egressRate uint64) (string, uint16, error) {
+	nicName, err := uplinkName(conf)
+	if err != nil {
+		return "", 0, err
+	}
+	nic, err := netlink.LinkByName(nicName)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to lookup %q: %v", nicName, err)
+	}
+	ifb, err := ensureNICHierarchy(nic)
+	if err != nil {
+		return "", 0, err
+	}
+	minor, err := allocateNICClass(store, nicName, nicClassOwner(r))
+	if err != nil {
+		return nicName, 0, err
+	}
+	for _, link := range []netlink.Link{nic, ifb} {
+		if err = ensureNICGroups(store, nicName, link, conf.NICHierarchy); err != nil {
+			return "", 0, err
+		}
+	}
+	r.NICParentMinor = conf.NICHierarchy.parentMinor(r.Namespace, r.Preset)
+
+	// Egress leaves through the uplink and is matched on source address; ingress arrives on the IFB and is
+	// matched on destination address.
+	// The classes of all the pods share the root or group classes of the hierarchy, so this is where the priority
+	// of low latency pods over bulk ones applies.
+	ingressCeil, egressCeil := CeilsOf(r, ingressRate, egressRate)
+	prio := HTBPrio(r.LatencyClass, r.ClassPriority)
+	if egressRate != 0 {
+		if err = addNICClass(nic, minor, r.NICParentMinor, egressRate, egressCeil, prio, ips, true); err != nil {
+			return "", 0, err
+		}
+	}
+	if ingressRate != 0 {
+		if err = addNICClass(ifb, minor, r.NICParentMinor, ingressRate, ingressCeil, prio, ips, false); err != nil {
+			return "", 0, err
+		}
+		// Traffic policed in hardware can't borrow, so it is policed at the ceil.
+		if conf.NICOffload {
+			r.NICOffloaded = setupNICOffload(nic, minor, ingressCeil, ips)
+		}
+	}
+	tcLog.WithFields(log.Fields{"nic": nicName, "class": minor, "parent": r.NICParentMinor}).Info("Shaping pod on uplink")
+	return nicName, minor, nil
+}
+
+// addNICClass adds the class of a pod under class parent of the uplink's hierarchy (0 for the root qdisc), with
+// filters classifying the traffic of its addresses into it. The class borrows from its parent up to ceil.
+func addNICClass(link netlink.Link, minor, parent uint16, rate, ceil uint64, prio uint32, ips []net.IP, matchSource bool) error {
+	classID := netlink.MakeHandle(nicQdiscMajor, minor)
+	buffer := nicClassBuffer(rate)
+	class := netlink.NewHtbClass(netlink.ClassAttrs{
+		LinkIndex: link.Attrs().Index,
+		Parent:    netlink.MakeHandle(nicQdiscMajor, parent),
+		Handle:    classID,
+	}, netlink.HtbClassAttrs{
+		Rate:    rate,
+		Ceil:    ceil,
+		Buffer:  buffer.buffer,
+		Cbuffer: buffer.cbuffer,
+		Prio:    prio,
+	})
+	if err := shaping.ReplaceClass(class); err != nil {
+		return fmt.Errorf("failed to add class %x to %s: %v", classID, link.Attrs().Name, err)
+	}
+
+	for i, ip := range ips {
+		filter := &netlink.U32{
+			FilterAttrs: netlink.FilterAttrs{
+				LinkIndex: link.Attrs().Index,
+				Parent:    netlink.MakeHandle(nicQdiscMajor, 0),
+				// Each pod owns a node in the default u32 hash table (800:), one per address.
+				Handle:   nicFilterHandle(minor, i),
+				Priority: nicFilterPrioV4,
+				Protocol: syscall.ETH_P_IP,
+			},
+			Sel: &netlink.TcU32Sel{
+				Keys:  addressKeys(ip, matchSource),
+				Flags: netlink.TC_U32_TERMINAL,
+			},
+			ClassId: classID,
+		}
+		if ip.To4() == nil {
+			filter.Priority = nicFilterPrioV6
+			filter.Protocol = syscall.ETH_P_IPV6
+		}
+		if err := countNetlink("FilterAdd", func() error { return netlink.FilterAdd(filter) }); err != nil {
+			return fmt.Errorf("failed to add filter for %s to %s: %v", ip, link.Attrs().Name, err)
+		}
+	}
+	return nil
+}
+
+// nicFilterHandle returns the u32 handle of the filter matching the index'th address of the pod with the given
+// class minor. Pods have at most one address per family, so two nodes per pod are reserved.
+func nicFilterHandle(minor uint16, index int) uint32 {
+	return 0x80000000 | (uint32(minor)*2 + uint32(index))
+}
+
+// addressKeys returns u32 keys matching the source or destination address of IPv4 or IPv6 packets.
+func addressKeys(ip net.IP, matchSource bool) []netlink.TcU32Key {
+	if v4 := ip.To4(); v4 != nil {
+		off := int32(16)
+		if matchSource {
+			off = 12
+		}
+		return []netlink.TcU32Key{{Mask: 0xffffffff, Val: binary.BigEndian.Uint32(v4), Off: off}}
+	}
+	off := int32(24)
+	if matchSource {
+		off = 8
+	}
+	v6 := ip.To16()
+	keys := make([]netlink.TcU32Key, 4)
+	for i := range keys {
+		keys[i] = netlink.TcU32Key{Mask: 0xffffffff, Val: binary.BigEndian.Uint32(v6[i*4:]), Off: off + int32(i*4)}
+	}
+	return keys
+}
+
+// CleanUpNICShaping removes the class and filters of a pod shaped on the uplink, and frees the class in the
+// uplink's class registry.
+func CleanUpNICShaping(store *state.Store, r *state.Record) error {
+	if err := releaseNICClass(store, r.NIC, r.Key()); err != nil {
+		tcLog.WithError(err).WithField("nic", r.NIC).Warn("Failed to release uplink class")
+	}
+	nic, err := netlink.LinkByName(r.NIC)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", r.NIC, err)
+	}
+	if r.NICOffloaded {
+		deleteNICOffload(nic, r.NICClassMinor)
+	}
+	links := []netlink.Link{nic}
+	// hostNetwork pods only have an egress class.
+	if ifb, err := netlink.LinkByName(nicIFBName(r.NIC)); err == nil && !r.HostNetwork {
+		links = append(links, ifb)
+	}
+	for _, link := range links {
+		filters, err := netlink.FilterList(link, netlink.MakeHandle(nicQdiscMajor, 0))
+		if err != nil {
+			return err
+		}
+		for _, f := range filters {
+			if u, ok := f.(*netlink.U32); ok && u.ClassId == netlink.MakeHandle(nicQdiscMajor, r.NICClassMinor) {
+				if err = countNetlink("FilterDel", func() error { return netlink.FilterDel(f) }); err != nil {
+					return fmt.Errorf("failed to delete filter from %s: %v", link.Attrs().Name, err)
+				}
+			}
+		}
+		class := netlink.NewHtbClass(netlink.ClassAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    netlink.MakeHandle(nicQdiscMajor, r.NICParentMinor),
+			Handle:    netlink.MakeHandle(nicQdiscMajor, r.NICClassMinor),
+		}, netlink.HtbClassAttrs{})
+		if err = countNetlink("ClassDel", func() error { return netlink.ClassDel(class) }); err != nil {
+			tcLog.WithError(err).WithField("interface", link.Attrs().Name).Warn("Failed to delete uplink class")
+		}
+	}
+	return nil
+}
+
+// SetRecordRates changes the rates of the classes recorded for a pod, in whichever mode it is shaped.
+func SetRecordRates(r *state.Record, ingressRate, egressRate uint64) error {
+	ingressCeil, egressCeil := CeilsOf(r, ingressRate, egressRate)
+	return SetRecordLimits(r, ingressRate, egressRate, ingressCeil, egressCeil)
+}
+
+// SetRecordLimits changes the rates and ceils of the classes recorded for a pod, in whichever mode it is shaped.
+// Ceils only apply to HTB classes with a parent class to borrow from.
+func SetRecordLimits(r *state.Record, ingressRate, egressRate, ingressCeil, egressCeil uint64) error {
+	if r.HostNetwork && r.ShapingMode != ShapingModeNIC {
+		return fmt.Errorf("%s is a hostNetwork pod and isn't shaped", r.Workload)
+	}
+	if r.ShapingMode == ShapingModeNFTables {
+		limits := PacketLimitsOf(r)
+		limits.IngressRate, limits.EgressRate = 0, 0
+		if r.IngressRate != 0 {
+			limits.IngressRate = ingressRate
+		}
+		if r.EgressRate != 0 {
+			limits.EgressRate = egressRate
+		}
+		return applyPacketLimits(r.HostVeth, limits)
+	}
+	if r.ShapingMode == ShapingModeContainer {
+		return setContainerRates(r, ingressRate, egressRate, egressCeil)
+	}
+	prio := HTBPrio(r.LatencyClass, r.ClassPriority)
+	// Only directions that were limited when the pod was set up have classes to change.
+	if r.ShapingMode != ShapingModeNIC {
+		if r.Qdisc == QdiscEBPF {
+			return setEBPFRates(r, ingressRate, egressRate)
+		}
+		if r.Qdisc == QdiscPolice {
+			return RestorePolice(r, r.IngressRate != 0, r.EgressRate != 0, ingressRate, egressRate)
+		}
+		if r.EgressPoliced && r.EgressRate != 0 {
+			if err := RestoreEgressPolicer(r.HostVeth, egressRate, BurstsOf(r)); err != nil {
+				return err
+			}
+		}
+		hostVeth := r.HostVeth
+		if r.IngressRate == 0 {
+			hostVeth = ""
+		}
+		if r.Qdisc == QdiscTBF {
+			return setTBFRates(hostVeth, r.IFB, ingressRate, egressRate, BurstsOf(r))
+		}
+		return SetShapingRates(hostVeth, r.IFB, r.ShapingGeneration, ingressRate, egressRate, ingressCeil, egressCeil,
+			r.IPFamilyBudget, prio, ProtocolSplitOf(r), r.Classes, BurstsOf(r))
+	}
+	if r.EgressRate != 0 {
+		err := replaceHtbClass(r.NIC, nicQdiscMajor, r.NICParentMinor, r.NICClassMinor, egressRate, egressCeil,
+			nicClassBuffer(egressRate), prio)
+		if err != nil {
+			return err
+		}
+	}
+	if r.HostNetwork || r.IngressRate == 0 {
+		return nil
+	}
+	err := replaceHtbClass(nicIFBName(r.NIC), nicQdiscMajor, r.NICParentMinor, r.NICClassMinor, ingressRate, ingressCeil,
+		nicClassBuffer(ingressRate), prio)
+	if err != nil {
+		return err
+	}
+	return setNICOffloadRate(r, ingressCeil)
+}
+
+// nicFilterPrioCgroup is the priority of the cgroup filter classifying the traffic of hostNetwork pods, ahead of
+// the per-address filters.
+const nicFilterPrioCgroup = 5
+
+// cgroupRoots are where the net_cls hierarchy is commonly mounted.
+var cgroupRoots = []string{"/sys/fs/cgroup/net_cls", "/sys/fs/cgroup/net_cls,net_prio"}
+
+// SetupCgroupShaping shapes the egress of the hostNetwork pod of r, which shares the node's addresses and so can't
+// be classified by IP, on the uplink: the pod's net_cls cgroups are tagged with its class, which a cgroup filter on
+// the uplink's root qdisc classifies by. It returns the class minor used.
+func SetupCgroupShaping(store *state.Store, nicName string, r *state.Record, podUID string, rate uint64) (uint16, error) {
+	nic, err := netlink.LinkByName(nicName)
+	if err != nil {
+		return 0, fmt.Errorf("failed to lookup %q: %v", nicName, err)
+	}
+	if _, err = ensureNICHierarchy(nic); err != nil {
+		return 0, err
+	}
+	if err = ensureCgroupFilter(nic); err != nil {
+		return 0, err
+	}
+	dirs := podCgroupDirs(podUID)
+	if len(dirs) == 0 {
+		return 0, fmt.Errorf("no net_cls cgroup found for pod %s", podUID)
+	}
+	minor, err := allocateNICClass(store, nicName, nicClassOwner(r))
+	if err != nil {
+		return 0, err
+	}
+	// The agent doesn't know the hierarchy of the uplink, so hostNetwork pods stay under the root qdisc.
+	if err = addNICClass(nic, minor, 0, rate, rate, HTBPrio(r.LatencyClass, r.ClassPriority), nil, true); err != nil {
+		return 0, err
+	}
+
+	// Containers of the pod live in child cgroups, which don't inherit the class ID once created.
+	classID := fmt.Sprintf("%d", netlink.MakeHandle(nicQdiscMajor, minor))
+	for _, dir := range dirs {
+		err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || !info.IsDir() {
+				return err
+			}
+			return ioutil.WriteFile(filepath.Join(path, "net_cls.classid"), []byte(classID), 0644)
+		})
+		if err != nil {
+			return 0, fmt.Errorf("failed to set net_cls class of pod %s: %v", podUID, err)
+		}
+	}
+	return minor, nil
+}
+
+func ensureCgroupFilter(nic netlink.Link) error {
+	filters, err := netlink.FilterList(nic, netlink.MakeHandle(nicQdiscMajor, 0))
+	if err != nil {
+		return err
+	}
+	for _, f := range filters {
+		if f.Type() == "cgroup" {
+			return nil
+		}
+	}
+	filter := &netlink.GenericFilter{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: nic.Attrs().Index,
+			Parent:    netlink.MakeHandle(nicQdiscMajor, 0),
+			Priority:  nicFilterPrioCgroup,
+			Protocol:  syscall.ETH_P_ALL,
+		},
+		FilterType: "cgroup",
+	}
+	if err = countNetlink("FilterAdd", func() error { return netlink.FilterAdd(filter) }); err != nil {
+		return fmt.Errorf("failed to add cgroup filter to %s: %v", nic.Attrs().Name, err)
+	}
+	return nil
+}
+
+// podCgroupDirs returns the net_cls cgroups of a pod, for both the cgroupfs and systemd kubelet cgroup drivers.
+func podCgroupDirs(podUID string) []string {
+	systemdUID := strings.Replace(podUID, "-", "_", -1)
+	var dirs []string
+	for _, root := range cgroupRoots {
+		for _, pattern := range []string{
+			"kubepods/pod" + podUID,
+			"kubepods/*/pod" + podUID,
+			"kubepods.slice/kubepods-pod" + systemdUID + ".slice",
+			"kubepods.slice/*/kubepods-*-pod" + systemdUID + ".slice",
+		} {
+			matches, _ := filepath.Glob(filepath.Join(root, pattern))
+			dirs = append(dirs, matches...)
+		}
+		if len(dirs) > 0 {
+			break
+		}
+	}
+	return dirs
+}
@@ -0,0 +1,111 @@
+package utils
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/projectcalico/cni-plugin/state"
+	"github.com/vishvananda/netlink"
+)
+
+// NICClassInfo is a class of the shared hierarchy of an uplink, attributed to the pod owning it.
+type NICClassInfo struct {
+	Device string `json:"device"`
+	// Direction is from the point of view of the pod: egress classes are on the uplink, ingress ones on its IFB.
+	Direction string `json:"direction"`
+	ClassID   string `json:"class_id"`
+	Minor     uint16 `json:"minor"`
+	// Rate and Ceil are in bits per second.
+	Rate uint64 `json:"rate"`
+	Ceil uint64 `json:"ceil"`
+	// Owner is nil for classes the class registry doesn't know of.
+	Owner *state.NICClass `json:"owner,omitempty"`
+	// Group is the name of the class in the borrow hierarchy of the uplink, for classes that aren't a pod's.
+	Group string `json:"group,omitempty"`
+	// Missing is set for classes in the registry that aren't on the device.
+	Missing bool `json:"missing,omitempty"`
+}
+
+// InspectNIC lists the classes on the uplink nic and its IFB device, attributing each to a pod through the uplink's
+// class registry. Registered classes that are missing from a device they should be on are listed too.
+func InspectNIC(store *state.Store, nic string) ([]NICClassInfo, error) {
+	registry, err := store.LoadNICClasses(nic)
+	if err == state.ErrNotFound {
+		registry = &state.NICClasses{NIC: nic, Classes: map[uint16]*state.NICClass{}}
+	} else if err != nil {
+		return nil, err
+	}
+	records, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []NICClassInfo
+	for _, dev := range []struct{ name, direction string }{{nic, "egress"}, {nicIFBName(nic), "ingress"}} {
+		link, err := netlink.LinkByName(dev.name)
+		if err != nil {
+			if dev.direction == "ingress" {
+				// The IFB device is only created once a pod is shaped on the uplink.
+				continue
+			}
+			return nil, fmt.Errorf("failed to lookup %q: %v", dev.name, err)
+		}
+		classes, err := netlink.ClassList(link, netlink.MakeHandle(nicQdiscMajor, 0))
+		if err != nil {
+			return nil, fmt.Errorf("failed to list classes of %q: %v", dev.name, err)
+		}
+		seen := map[uint16]bool{}
+		for _, c := range classes {
+			major, minor := netlink.MajorMinor(c.Attrs().Handle)
+			if major != nicQdiscMajor || minor == 0 {
+				continue
+			}
+			info := NICClassInfo{
+				Device:    dev.name,
+				Direction: dev.direction,
+				ClassID:   netlink.HandleStr(c.Attrs().Handle),
+				Minor:     minor,
+				Owner:     registry.Classes[minor],
+				Group:     registry.Groups[minor],
+			}
+			if htb, ok := c.(*netlink.HtbClass); ok {
+				info.Rate, info.Ceil = htb.Rate*8, htb.Ceil*8
+			}
+			seen[minor] = true
+			infos = append(infos, info)
+		}
+		for minor, owner := range registry.Classes {
+			if !seen[minor] && expectsNICClass(records, owner.Key(), dev.direction) {
+				infos = append(infos, NICClassInfo{
+					Device:    dev.name,
+					Direction: dev.direction,
+					ClassID:   netlink.HandleStr(netlink.MakeHandle(nicQdiscMajor, minor)),
+					Minor:     minor,
+					Owner:     owner,
+					Missing:   true,
+				})
+			}
+		}
+	}
+	sort.SliceStable(infos, func(i, j int) bool {
+		if infos[i].Device != infos[j].Device {
+			return infos[i].Device < infos[j].Device
+		}
+		return infos[i].Minor < infos[j].Minor
+	})
+	return infos, nil
+}
+
+// expectsNICClass reports whether the record stored under key says it has a class for direction.
+func expectsNICClass(records []*state.Record, key, direction string) bool {
+	for _, r := range records {
+		if r.Key() != key {
+			continue
+		}
+		if direction == "egress" {
+			return r.EgressRate != 0
+		}
+		return r.IngressRate != 0 && !r.HostNetwork
+	}
+	return false
+}
@@ -0,0 +1,107 @@
+package utils
+
+import (
+	"fmt"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/cni-plugin/logging"
+	"github.com/projectcalico/cni-plugin/metrics"
+	"github.com/projectcalico/cni-plugin/shaping"
+	"github.com/projectcalico/cni-plugin/state"
+)
+
+// DefaultSlowNetlinkThreshold is how long a netlink operation may take before it is reported as slow by default.
+const DefaultSlowNetlinkThreshold = 200 * time.Millisecond
+
+// slowNetlinkThreshold is how long a netlink operation may take before it is reported as slow, or 0 to never report.
+var slowNetlinkThreshold = DefaultSlowNetlinkThreshold
+
+// MetricsSpoolDir is where the plugin spools its counters for the agent to export, inside the state directory.
+func MetricsSpoolDir(stateDir string) string {
+	if stateDir == "" {
+		stateDir = state.DefaultDir
+	}
+	return filepath.Join(stateDir, "metrics")
+}
+
+var (
+	netlinkErrors = metrics.NewCounter("flowcontrol_netlink_errors_total",
+		"Failed netlink operations, by operation and errno.", "op", "errno")
+	netlinkSlowOps = metrics.NewCounter("flowcontrol_netlink_slow_operations_total",
+		"Netlink operations that took longer than the slow operation threshold, by operation.", "op")
+)
+
+func init() {
+	shaping.CountNetlink = countNetlink
+}
+
+// SetSlowNetlinkThreshold sets how long a netlink operation may take before it is logged and counted as slow, a sign
+// of rtnetlink contention on the node. Zero disables the reporting.
+func SetSlowNetlinkThreshold(threshold time.Duration) {
+	slowNetlinkThreshold = threshold
+}
+
+// ConfigureSlowNetlink sets the slow netlink operation threshold from the slowNetlinkThreshold option, a duration
+// such as "500ms", or to DefaultSlowNetlinkThreshold if threshold is empty.
+func ConfigureSlowNetlink(threshold string) error {
+	if threshold == "" {
+		SetSlowNetlinkThreshold(DefaultSlowNetlinkThreshold)
+		return nil
+	}
+	d, err := time.ParseDuration(threshold)
+	if err != nil || d < 0 {
+		return fmt.Errorf("invalid slowNetlinkThreshold %q", threshold)
+	}
+	SetSlowNetlinkThreshold(d)
+	return nil
+}
+
+// errnoNames are the symbolic names of the errnos netlink operations commonly fail with.
+var errnoNames = map[syscall.Errno]string{
+	syscall.EPERM:      "EPERM",
+	syscall.ENOENT:     "ENOENT",
+	syscall.EAGAIN:     "EAGAIN",
+	syscall.ENOMEM:     "ENOMEM",
+	syscall.EBUSY:      "EBUSY",
+	syscall.EEXIST:     "EEXIST",
+	syscall.ENODEV:     "ENODEV",
+	syscall.EINVAL:     "EINVAL",
+	syscall.ENOSPC:     "ENOSPC",
+	syscall.ERANGE:     "ERANGE",
+	syscall.ENOBUFS:    "ENOBUFS",
+	syscall.EOPNOTSUPP: "EOPNOTSUPP",
+}
+
+// errnoName classifies err for the errno label.
+func errnoName(err error) string {
+	errno, ok := err.(syscall.Errno)
+	if !ok {
+		return "other"
+	}
+	if name, ok := errnoNames[errno]; ok {
+		return name
+	}
+	return fmt.Sprintf("errno%d", int(errno))
+}
+
+// countNetlink runs call, the netlink operation op, and returns its error. The error, if any, is counted as a failure
+// of op, and the operation is logged and counted if it took longer than the slow operation threshold.
+func countNetlink(op string, call func() error) error {
+	start := time.Now()
+	err := call()
+	if elapsed := time.Since(start); slowNetlinkThreshold > 0 && elapsed > slowNetlinkThreshold {
+		netlinkSlowOps.Inc(op)
+		logging.Logger(logging.Datapath).WithFields(log.Fields{
+			"op":        op,
+			"duration":  elapsed,
+			"threshold": slowNetlinkThreshold,
+		}).Warn("Slow netlink operation")
+	}
+	if err != nil {
+		netlinkErrors.Inc(op, errnoName(err))
+	}
+	return err
+}
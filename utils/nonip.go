@@ -0,0 +1,24 @@
+package utils
+
+import (
+	"fmt"
+
+	"github.com/projectcalico/cni-plugin/shaping"
+)
+
+// Policies for traffic the IP classifiers of a shaped pod don't match. "unshaped" leaves it alone, "shaped" puts
+// it in the pod's shaping class and "drop" drops it. ARP is left alone unless it is shaped, since pods rely on proxy
+// ARP to reach their gateway.
+const (
+	NonIPPolicyUnshaped = shaping.NonIPUnshaped
+	NonIPPolicyShaped   = shaping.NonIPShaped
+	NonIPPolicyDrop     = shaping.NonIPDrop
+)
+
+func checkNonIPPolicy(policy string) error {
+	switch policy {
+	case "", NonIPPolicyUnshaped, NonIPPolicyShaped, NonIPPolicyDrop:
+		return nil
+	}
+	return fmt.Errorf("unknown nonIPPolicy %q", policy)
+}
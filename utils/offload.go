@@ -0,0 +1,93 @@
+package utils
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// siocEthtool is the ioctl ethtool(8) configures devices with.
+const siocEthtool = 0x8946
+
+// offloadCommands are the ethtool commands setting the offload features that can be configured on the veth pair,
+// by their ethtool(8) names. Turning tx-checksumming off also turns off the features depending on it, such as
+// segmentation offloads, since the kernel can't segment without checksumming.
+var offloadCommands = map[string]uint32{
+	"rx-checksumming":              0x15, // ETHTOOL_SRXCSUM
+	"tx-checksumming":              0x17, // ETHTOOL_STXCSUM
+	"scatter-gather":               0x19, // ETHTOOL_SSG
+	"tcp-segmentation-offload":     0x1f, // ETHTOOL_STSO
+	"generic-segmentation-offload": 0x24, // ETHTOOL_SGSO
+	"generic-receive-offload":      0x2c, // ETHTOOL_SGRO
+}
+
+// offloadOrder is the order features are set in, so that features are enabled after those they depend on.
+var offloadOrder = []string{
+	"rx-checksumming",
+	"tx-checksumming",
+	"scatter-gather",
+	"tcp-segmentation-offload",
+	"generic-segmentation-offload",
+	"generic-receive-offload",
+}
+
+// ethtoolValue is struct ethtool_value.
+type ethtoolValue struct {
+	cmd  uint32
+	data uint32
+}
+
+// ifreqData is struct ifreq with the ifr_data member of the union.
+type ifreqData struct {
+	name [syscall.IFNAMSIZ]byte
+	data uintptr
+	_    [16]byte
+}
+
+// checkOffloads rejects offload features that can't be configured.
+func checkOffloads(offloads map[string]bool) error {
+	for feature := range offloads {
+		if _, ok := offloadCommands[feature]; !ok {
+			names := make([]string, 0, len(offloadCommands))
+			for name := range offloadCommands {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return fmt.Errorf("unknown offload feature %q, must be one of %s", feature, strings.Join(names, ", "))
+		}
+	}
+	return nil
+}
+
+// setOffloads turns the offload features of the interface ifName on or off, in the current network namespace.
+func setOffloads(ifName string, offloads map[string]bool) error {
+	if len(offloads) == 0 {
+		return nil
+	}
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open ethtool socket: %v", err)
+	}
+	defer syscall.Close(fd)
+
+	for _, feature := range offloadOrder {
+		on, ok := offloads[feature]
+		if !ok {
+			continue
+		}
+		value := ethtoolValue{cmd: offloadCommands[feature]}
+		if on {
+			value.data = 1
+		}
+		var req ifreqData
+		copy(req.name[:], ifName)
+		req.data = uintptr(unsafe.Pointer(&value))
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), siocEthtool, uintptr(unsafe.Pointer(&req)))
+		if errno != 0 {
+			return fmt.Errorf("failed to set %s of %q: %v", feature, ifName, errno)
+		}
+	}
+	return nil
+}
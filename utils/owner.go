@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/cni-plugin/state"
+	"github.com/vishvananda/netlink"
+)
+
+// hostVethAliasPrefix starts the alias of the host veths the plugin creates. The rest of the alias is the ID of the
+// container owning the veth.
+const hostVethAliasPrefix = "flowcontrol:"
+
+func hostVethAlias(containerID string) string {
+	return hostVethAliasPrefix + containerID
+}
+
+// markHostVeth records containerID as the owner of the host veth in its alias.
+func markHostVeth(hostVethName, containerID string) error {
+	link, err := netlink.LinkByName(hostVethName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", hostVethName, err)
+	}
+	if err = countNetlink("LinkSetAlias", func() error {
+		return netlink.LinkSetAlias(link, hostVethAlias(containerID))
+	}); err != nil {
+		return fmt.Errorf("failed to set alias of %q: %v", hostVethName, err)
+	}
+	return nil
+}
+
+// removeStaleHostVeth deletes the host veth left behind by an earlier ADD of the interface ifName of the
+// container, such as one retried by the runtime. The veth is only deleted if its alias or the state record of the
+// interface shows that it belongs to the container; an interface with the same name owned by anything else, such as another CNI plugin or a pod whose
+// ID shares the prefix used in the name, is a conflict. store is nil in compatibility mode, where nothing is
+// recorded.
+func removeStaleHostVeth(store *state.Store, hostVethName, containerID, ifName string, logger *log.Entry) error {
+	link, err := netlink.LinkByName(hostVethName)
+	if err != nil {
+		return nil
+	}
+	alias := link.Attrs().Alias
+	owned := alias == hostVethAlias(containerID)
+	if !owned && store != nil {
+		if r, err := store.Load(state.RecordKey(containerID, ifName)); err == nil && r.HostVeth == hostVethName {
+			owned = true
+		}
+	}
+	if !owned {
+		owner := "no ownership marker"
+		if strings.HasPrefix(alias, hostVethAliasPrefix) {
+			owner = "owned by container " + strings.TrimPrefix(alias, hostVethAliasPrefix)
+		} else if alias != "" {
+			owner = fmt.Sprintf("alias %q", alias)
+		}
+		return conflictError(fmt.Errorf("host veth %q already exists and doesn't belong to container %s (%s), not deleting it",
+			hostVethName, containerID, owner))
+	}
+	if err = countNetlink("LinkDel", func() error { return netlink.LinkDel(link) }); err != nil {
+		return fmt.Errorf("failed to delete old hostVeth %v: %v", hostVethName, err)
+	}
+	logger.Infof("clean old hostVeth: %v", hostVethName)
+	return nil
+}
@@ -0,0 +1,94 @@
+package utils
+
+import (
+	"fmt"
+
+	"github.com/projectcalico/cni-plugin/policy"
+	"github.com/projectcalico/cni-plugin/state"
+)
+
+// PeerBandwidth is the rate of the traffic of a pod with a kind of peer in each direction, as a bandwidth like the
+// annotations, e.g. "50M". A direction it leaves unset gets what the other peers leave of the limit of the pod.
+type PeerBandwidth struct {
+	Ingress string `json:"ingress,omitempty"`
+	Egress  string `json:"egress,omitempty"`
+}
+
+// Names of the classes the traffic of a pod is divided into by peer.
+const (
+	peerClassCluster  = "cluster"
+	peerClassExternal = "external"
+)
+
+// externalCIDRs match every peer: the external class follows the cluster one, so it gets the rest of the IP traffic.
+var externalCIDRs = []string{"0.0.0.0/0", "::/0"}
+
+// peersSet reports whether conf divides the traffic of pods by peer.
+func peersSet(conf NetConf) bool {
+	return len(conf.ClusterCIDRs) != 0 || conf.ClusterBandwidth != nil || conf.ExternalBandwidth != nil
+}
+
+// checkPeers validates the cluster_cidrs, cluster_bandwidth and external_bandwidth options.
+func checkPeers(conf NetConf) error {
+	if !peersSet(conf) {
+		return nil
+	}
+	switch {
+	case len(conf.ClusterCIDRs) == 0:
+		return fmt.Errorf("cluster_bandwidth and external_bandwidth need cluster_cidrs")
+	case conf.ClusterBandwidth == nil && conf.ExternalBandwidth == nil:
+		return fmt.Errorf("cluster_cidrs needs a cluster_bandwidth or external_bandwidth")
+	case conf.ShapingMode == ShapingModeNIC || conf.ShapingMode == ShapingModeNFTables:
+		return fmt.Errorf("cluster_cidrs isn't supported by the %s shaping mode", conf.ShapingMode)
+	case conf.LatencyClass == LatencyClassLow:
+		return fmt.Errorf("cluster_cidrs can't be combined with latencyClass %q", LatencyClassLow)
+	case conf.ProtocolSplit != nil:
+		return fmt.Errorf("cluster_cidrs can't be combined with protocolSplit")
+	}
+	for _, cidr := range conf.ClusterCIDRs {
+		if _, err := cidrFamily(cidr); err != nil {
+			return fmt.Errorf("cluster_cidrs: %v", err)
+		}
+	}
+	_, err := trafficClassesOf(conf)
+	return err
+}
+
+// peerClasses returns the classes conf divides the traffic of pods into by peer, in each direction it sets a peer
+// rate for: one for the traffic with peers in the cluster CIDRs, then one for the rest of the IP traffic.
+func peerClasses(conf NetConf) ([]state.TrafficClass, error) {
+	if len(conf.ClusterCIDRs) == 0 {
+		return nil, nil
+	}
+	var cluster, external PeerBandwidth
+	if conf.ClusterBandwidth != nil {
+		cluster = *conf.ClusterBandwidth
+	}
+	if conf.ExternalBandwidth != nil {
+		external = *conf.ExternalBandwidth
+	}
+	var classes []state.TrafficClass
+	for _, d := range []struct {
+		direction         string
+		cluster, external string
+	}{{"egress", cluster.Egress, external.Egress}, {"ingress", cluster.Ingress, external.Ingress}} {
+		if d.cluster == "" && d.external == "" {
+			continue
+		}
+		for _, p := range []struct {
+			name, bandwidth string
+			peers           []string
+		}{{peerClassCluster, d.cluster, conf.ClusterCIDRs}, {peerClassExternal, d.external, externalCIDRs}} {
+			c := state.TrafficClass{Name: p.name, Direction: d.direction, Peers: p.peers}
+			if p.bandwidth != "" {
+				rate, err := policy.ParseRate(p.bandwidth)
+				if err != nil || rate == 0 {
+					return nil, fmt.Errorf("invalid %s bandwidth %q of %s", p.name, p.bandwidth, d.direction)
+				}
+				c.Rate, c.Ceil = rate, rate
+			}
+			classes = append(classes, c)
+		}
+	}
+	return classes, nil
+}
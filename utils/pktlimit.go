@@ -0,0 +1,156 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/projectcalico/cni-plugin/state"
+)
+
+// Packet rate limits police traffic of a pod by packets per second rather than bytes, in the flowcontrol nftables
+// table. Packets entering from a limited pod's host veth jump from the limit chain to a chain of the pod's own,
+// through nftPodLimitsMap, and packets leaving through it jump from the limit_ingress chain to another one, through
+// nftPodIngressLimitsMap; packets over a limit are dropped.
+const (
+	nftPodLimitsMap        = "pod_limits"
+	nftPodIngressLimitsMap = "pod_ingress_limits"
+)
+
+// nftLimitRuleset creates the maps and the chains dispatching on them if needed. The limit chain runs at filter
+// priority, after Service DNAT, so that it sees the destination port of the backend; limit_ingress runs at
+// postrouting so that it also sees traffic from the host to the pod.
+const nftLimitRuleset = `add table inet flowcontrol
+add map inet flowcontrol pod_limits { type ifname : verdict; }
+add chain inet flowcontrol limit { type filter hook prerouting priority filter; policy accept; }
+flush chain inet flowcontrol limit
+add rule inet flowcontrol limit iifname vmap @pod_limits
+add map inet flowcontrol pod_ingress_limits { type ifname : verdict; }
+add chain inet flowcontrol limit_ingress { type filter hook postrouting priority filter; policy accept; }
+flush chain inet flowcontrol limit_ingress
+add rule inet flowcontrol limit_ingress oifname vmap @pod_ingress_limits
+`
+
+// PacketLimits are the packet rate limits of a pod, in packets per second. Zero means unlimited.
+type PacketLimits struct {
+	// DNS limits queries to port 53 over UDP and TCP.
+	DNS uint64
+	// ICMP and ICMPv6 limit ping floods and traceroute storms. Neighbor discovery is exempt from the ICMPv6 limit,
+	// since the pod can't reach its gateway without it.
+	ICMP   uint64
+	ICMPv6 uint64
+	// Ingress and Egress limit all traffic to and from the pod, standing in for bandwidth limits too low to shape.
+	Ingress uint64
+	Egress  uint64
+	// IngressRate and EgressRate limit all traffic to and from the pod in bits per second, standing in for its
+	// classes in the nftables shaping mode.
+	IngressRate uint64
+	EgressRate  uint64
+	// MaxPPS limits all traffic from the pod, and Connections the connections it has open at once, whose new
+	// connections over the limit are dropped, against pods flooding the node with packets or SYNs.
+	MaxPPS      uint64
+	Connections uint64
+}
+
+// Empty reports whether no limit is set.
+func (l PacketLimits) Empty() bool {
+	return l == PacketLimits{}
+}
+
+// PacketLimitsOf returns the packet rate limits recorded for a pod.
+func PacketLimitsOf(r *state.Record) PacketLimits {
+	l := PacketLimits{
+		DNS:         r.DNSRateLimit,
+		ICMP:        r.ICMPRateLimit,
+		ICMPv6:      r.ICMPv6RateLimit,
+		Ingress:     r.IngressPPS,
+		Egress:      r.EgressPPS,
+		MaxPPS:      r.MaxPPS,
+		Connections: r.MaxConnections,
+	}
+	if r.ShapingMode == ShapingModeNFTables {
+		l.IngressRate, l.EgressRate = r.ActiveRates()
+	}
+	return l
+}
+
+// nftRateBurst returns the burst in bytes allowed over a rate in bits per second: a tenth of a second of traffic,
+// and at least enough for a TCP window to open.
+func nftRateBurst(rate uint64) uint64 {
+	if burst := rate / 8 / 10; burst > 64*1024 {
+		return burst
+	}
+	return 64 * 1024
+}
+
+func podLimitChain(hostVethName string) string {
+	return "limit_" + hostVethName
+}
+
+func podIngressLimitChain(hostVethName string) string {
+	return "limit_in_" + hostVethName
+}
+
+// podLimitElements adds the chains of the pod behind hostVethName and the map elements jumping to them to script.
+// Adding an element that is already there is a no-op, so this also makes sure they exist before they are deleted.
+func podLimitElements(script *bytes.Buffer, hostVethName string) {
+	chain, ingressChain := podLimitChain(hostVethName), podIngressLimitChain(hostVethName)
+	fmt.Fprintf(script, "add chain inet %s %s\n", nftTable, chain)
+	fmt.Fprintf(script, "add chain inet %s %s\n", nftTable, ingressChain)
+	fmt.Fprintf(script, "add element inet %s %s { %q : jump %s }\n", nftTable, nftPodLimitsMap, hostVethName, chain)
+	fmt.Fprintf(script, "add element inet %s %s { %q : jump %s }\n", nftTable, nftPodIngressLimitsMap, hostVethName, ingressChain)
+}
+
+// applyPacketLimits replaces the packet rate limits of the pod behind hostVethName with limits.
+func applyPacketLimits(hostVethName string, limits PacketLimits) error {
+	chain, ingressChain := podLimitChain(hostVethName), podIngressLimitChain(hostVethName)
+	script := bytes.NewBufferString(nftLimitRuleset)
+	podLimitElements(script, hostVethName)
+	fmt.Fprintf(script, "flush chain inet %s %s\n", nftTable, chain)
+	fmt.Fprintf(script, "flush chain inet %s %s\n", nftTable, ingressChain)
+	if limits.DNS != 0 {
+		fmt.Fprintf(script, "add rule inet %s %s meta l4proto { udp, tcp } th dport 53 limit rate over %d/second drop\n",
+			nftTable, chain, limits.DNS)
+	}
+	if limits.ICMP != 0 {
+		fmt.Fprintf(script, "add rule inet %s %s meta l4proto icmp limit rate over %d/second drop\n", nftTable, chain, limits.ICMP)
+	}
+	if limits.ICMPv6 != 0 {
+		fmt.Fprintf(script, "add rule inet %s %s meta l4proto ipv6-icmp "+
+			"icmpv6 type != { nd-router-solicit, nd-neighbor-solicit, nd-neighbor-advert } limit rate over %d/second drop\n",
+			nftTable, chain, limits.ICMPv6)
+	}
+	if limits.Egress != 0 {
+		fmt.Fprintf(script, "add rule inet %s %s limit rate over %d/second drop\n", nftTable, chain, limits.Egress)
+	}
+	if limits.Ingress != 0 {
+		fmt.Fprintf(script, "add rule inet %s %s limit rate over %d/second drop\n", nftTable, ingressChain, limits.Ingress)
+	}
+	if limits.MaxPPS != 0 {
+		fmt.Fprintf(script, "add rule inet %s %s limit rate over %d/second drop\n", nftTable, chain, limits.MaxPPS)
+	}
+	if limits.Connections != 0 {
+		// The count of the rule is of the connections it saw open, those of the pod.
+		fmt.Fprintf(script, "add rule inet %s %s ct state new ct count over %d drop\n", nftTable, chain, limits.Connections)
+	}
+	if limits.EgressRate != 0 {
+		fmt.Fprintf(script, "add rule inet %s %s limit rate over %d bytes/second burst %d bytes drop\n",
+			nftTable, chain, limits.EgressRate/8, nftRateBurst(limits.EgressRate))
+	}
+	if limits.IngressRate != 0 {
+		fmt.Fprintf(script, "add rule inet %s %s limit rate over %d bytes/second burst %d bytes drop\n",
+			nftTable, ingressChain, limits.IngressRate/8, nftRateBurst(limits.IngressRate))
+	}
+	return nft(script.String())
+}
+
+// RemovePacketLimits stops limiting the packet rates of the pod behind hostVethName.
+func RemovePacketLimits(hostVethName string) error {
+	script := bytes.NewBufferString(nftLimitRuleset)
+	podLimitElements(script, hostVethName)
+	fmt.Fprintf(script, "delete element inet %s %s { %q }\n", nftTable, nftPodLimitsMap, hostVethName)
+	fmt.Fprintf(script, "delete element inet %s %s { %q }\n", nftTable, nftPodIngressLimitsMap, hostVethName)
+	for _, chain := range []string{podLimitChain(hostVethName), podIngressLimitChain(hostVethName)} {
+		fmt.Fprintf(script, "flush chain inet %s %s\ndelete chain inet %s %s\n", nftTable, chain, nftTable, chain)
+	}
+	return nft(script.String())
+}
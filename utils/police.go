@@ -0,0 +1,38 @@
+package utils
+
+import (
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/cni-plugin/shaping"
+	"github.com/projectcalico/cni-plugin/state"
+	"github.com/vishvananda/netlink"
+)
+
+// Strategies of the egress of pods shaped on their veth, as logged: shaped on an IFB device, or, on kernels that
+// can't create IFB devices, policed where the host veth receives the traffic. Policing only enforces the rate of the
+// pod; its ceil, egress classes and DSCP need the IFB device.
+const (
+	egressStrategyIFB    = "ifb"
+	egressStrategyPolice = "police"
+)
+
+// ifbUnavailable returns why the kernel can't create IFB devices, or "" if it can, or couldn't be probed.
+func ifbUnavailable(store *state.Store, logger *log.Entry) string {
+	caps, err := ProbeCapabilities(store, false, logger)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to probe kernel capabilities, assuming IFB devices can be created")
+		return ""
+	}
+	return caps.IFBError
+}
+
+// RestoreEgressPolicer rebuilds the policer of a container whose egress is policed on its host veth, at rate with
+// the buffer of bursts.
+func RestoreEgressPolicer(hostVethName string, rate uint64, bursts Bursts) error {
+	hostVeth, err := netlink.LinkByName(hostVethName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", hostVethName, err)
+	}
+	return shaping.SetupPolicer(hostVeth, rate, bursts.egress(rate).buffer)
+}
@@ -0,0 +1,155 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/cni-plugin/shaping"
+	"github.com/projectcalico/cni-plugin/state"
+	"github.com/vishvananda/netlink"
+)
+
+// kernelRelease returns the release of the running kernel, e.g. "5.4.0-42-generic".
+func kernelRelease() (string, error) {
+	data, err := ioutil.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// ProbeCapabilities returns the shaping features the kernel supports, probing it if it wasn't probed since it was
+// booted, or if force is set. On platforms other than Linux nothing can be shaped, and nothing is probed.
+func ProbeCapabilities(store *state.Store, force bool, logger *log.Entry) (*state.Capabilities, error) {
+	if runtime.GOOS != "linux" {
+		reason := "flow control isn't supported on " + runtime.GOOS
+		return &state.Capabilities{Probed: time.Now(), TCShapingError: reason, IFBError: reason, EBPFError: reason}, nil
+	}
+	release, err := kernelRelease()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read kernel release: %v", err)
+	}
+	if c, err := store.LoadCapabilities(); err == nil && c.KernelRelease == release && !force {
+		return c, nil
+	}
+
+	c := &state.Capabilities{KernelRelease: release, Probed: time.Now(), TCShaping: true}
+	for _, module := range []string{"ifb", "sch_htb", "cls_u32"} {
+		loadModule(module, logger)
+	}
+	ifbErr, err := probeTCShaping()
+	if err != nil {
+		c.TCShaping, c.TCShapingError = false, err.Error()
+	}
+	if ifbErr != nil {
+		c.IFBError = ifbErr.Error()
+	}
+	c.EBPF = true
+	if err = shaping.ProbeBPF(); err != nil {
+		c.EBPF, c.EBPFError = false, err.Error()
+	}
+	logger.WithFields(log.Fields{"kernel": release, "tcShaping": c.TCShaping, "ifb": c.IFBError == "", "ebpf": c.EBPF}).Info(
+		"Probed kernel shaping capabilities")
+	if err = store.SaveCapabilities(c); err != nil {
+		logger.WithError(err).Warn("Failed to cache kernel capabilities")
+	}
+	return c, nil
+}
+
+// probeTCShaping creates a throwaway IFB device with an HTB qdisc and a u32 filter, which is what veth shaping needs
+// of the kernel.
+// ifbErr is why the IFB device couldn't be created, in which case HTB is probed on a dummy device instead, as pods
+// can still be shaped with their egress policed. err is why HTB qdiscs can't be created.
+func probeTCShaping() (ifbErr, err error) {
+	name := fmt.Sprintf("fcprobe%d", os.Getpid()%100000)
+	var probe netlink.Link = &netlink.Ifb{LinkAttrs: netlink.LinkAttrs{Name: name}}
+	if err = countNetlink("LinkAdd", func() error { return netlink.LinkAdd(probe) }); err != nil {
+		ifbErr = kernelSupportError(err, "create an IFB device", "ifb")
+		probe = &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: name}}
+		if err = countNetlink("LinkAdd", func() error { return netlink.LinkAdd(probe) }); err != nil {
+			return ifbErr, ifbErr
+		}
+	}
+	defer netlink.LinkDel(probe)
+
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return ifbErr, err
+	}
+	htb := netlink.NewHtb(netlink.QdiscAttrs{
+		LinkIndex: link.Attrs().Index,
+		Handle:    netlink.MakeHandle(1, 0),
+		Parent:    netlink.HANDLE_ROOT,
+	})
+	if err = countNetlink("QdiscAdd", func() error { return netlink.QdiscAdd(htb) }); err != nil {
+		return ifbErr, kernelSupportError(err, "add an HTB qdisc", "sch_htb")
+	}
+	filter := &netlink.U32{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    htb.Handle,
+			Priority:  1,
+			Protocol:  syscall.ETH_P_ALL,
+		},
+		ClassId: netlink.MakeHandle(1, 1),
+	}
+	if err = countNetlink("FilterAdd", func() error { return netlink.FilterAdd(filter) }); err != nil {
+		return ifbErr, kernelSupportError(err, "add a u32 filter", "cls_u32")
+	}
+	return ifbErr, nil
+}
+
+// checkFlowControl fails with a ShapingError of code ErrCodeKernelSupport if the pod, limited to rates, is to be
+// shaped in mode with tc on a node that can't: a kernel without the IFB, HTB or u32 modules, or a platform other
+// than Linux. It is checked before anything is programmed, so that such a pod is either refused or, without
+// strict_shaping, brought up without shaping and recorded as unsupported, rather than left with whatever part of
+// its shaping the kernel took. Pods shaped with BPF programs the kernel runs, or policed with nftables on Linux,
+// don't need the modules.
+func checkFlowControl(conf NetConf, mode string, rates ShapingRates, store *state.Store, logger *log.Entry) error {
+	if (mode == ShapingModeNFTables && runtime.GOOS == "linux") || (rates.Ingress == 0 && rates.Egress == 0) {
+		return nil
+	}
+	caps, err := ProbeCapabilities(store, false, logger)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to probe kernel capabilities, assuming tc shaping works")
+		return nil
+	}
+	if caps.TCShaping || (conf.Backend == BackendEBPF && caps.EBPF) {
+		return nil
+	}
+	return &ShapingError{
+		Code: ErrCodeKernelSupport,
+		Err:  fmt.Errorf("flow control unavailable, networking configured without shaping: %s", caps.TCShapingError),
+		Hint: "load the ifb, sch_htb and cls_u32 kernel modules on the node, or set nftablesFallback to police the " +
+			"rates of pods with nftables",
+	}
+}
+
+// flowControlUnavailable reports whether err is checkFlowControl's, or another failure of the kernel to provide a
+// module shaping needs.
+func flowControlUnavailable(err error) bool {
+	e, ok := err.(*ShapingError)
+	return ok && e.Code == ErrCodeKernelSupport
+}
+
+// loadModule loads the kernel module name with modprobe unless it is loaded, for a kernel that doesn't load it on
+// demand. A module built into the kernel is loaded; one that can't be loaded is left to the probes to report.
+func loadModule(name string, logger *log.Entry) {
+	if _, err := os.Stat("/sys/module/" + name); err == nil {
+		return
+	}
+	out, err := exec.Command("modprobe", name).CombinedOutput()
+	if err != nil {
+		logger.WithError(err).WithFields(log.Fields{"module": name, "output": strings.TrimSpace(string(out))}).Warn(
+			"Failed to load kernel module")
+		return
+	}
+	logger.WithField("module", name).Info("Loaded kernel module")
+}
@@ -0,0 +1,234 @@
+package utils
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/projectcalico/cni-plugin/shaping"
+	"github.com/projectcalico/cni-plugin/state"
+	"github.com/vishvananda/netlink"
+)
+
+// ProtocolSplit divides the limit of each direction of a pod into guaranteed shares, in percent, for its TCP and
+// UDP traffic, e.g. so that a UDP flood of the pod can't starve its own TCP connections. The rest of the limit is
+// guaranteed to its other traffic. Each share borrows what the others leave idle, up to the full limit.
+type ProtocolSplit struct {
+	TCP uint32 `json:"tcp"`
+	UDP uint32 `json:"udp"`
+}
+
+func (s ProtocolSplit) enabled() bool {
+	return s.TCP != 0 || s.UDP != 0
+}
+
+// shares returns the percentages of the limit guaranteed to each of splitClasses.
+func (s ProtocolSplit) shares() []uint32 {
+	return []uint32{s.TCP, s.UDP, 100 - s.TCP - s.UDP}
+}
+
+// ProtocolSplitOf returns the protocol split of the classes of a pod, as recorded when it was set up.
+func ProtocolSplitOf(r *state.Record) ProtocolSplit {
+	return ProtocolSplit{TCP: r.TCPShare, UDP: r.UDPShare}
+}
+
+// splitClasses are the leaf classes a split class of a pod is divided into. Traffic of other protocols, including
+// non-IP traffic shaped into the class, goes to the last one.
+var splitClasses = []struct {
+	name  string
+	proto uint8
+}{
+	{"tcp", syscall.IPPROTO_TCP},
+	{"udp", syscall.IPPROTO_UDP},
+	{"other", 0},
+}
+
+const (
+	// splitMinorOffset separates the minors of the leaf classes of a split class from its own and from each other,
+	// clear of the minors of the classes of both generations and of separate IPv6 classes.
+	splitMinorOffset = 0x10
+
+	// The filters attached to a split class: a pair of IPv4 and IPv6 filters per protocol from splitFilterPrio,
+	// then a catch-all at splitOtherPrio.
+	splitFilterPrio = 1
+	splitOtherPrio  = 10
+)
+
+func splitMinor(minor uint16, i int) uint16 {
+	return minor + splitMinorOffset*uint16(i+1)
+}
+
+// checkProtocolSplit validates the protocolSplit option.
+func checkProtocolSplit(conf NetConf) error {
+	s := conf.ProtocolSplit
+	if s == nil {
+		return nil
+	}
+	switch {
+	case conf.ShapingMode == ShapingModeNIC || conf.ShapingMode == ShapingModeNFTables:
+		return fmt.Errorf("protocolSplit isn't supported by the %s shaping mode", conf.ShapingMode)
+	case conf.LatencyClass == LatencyClassLow:
+		return fmt.Errorf("protocolSplit can't be combined with latencyClass %q", LatencyClassLow)
+	case s.TCP == 0 || s.UDP == 0:
+		return fmt.Errorf("protocolSplit needs both a TCP and a UDP share")
+	case s.TCP+s.UDP >= 100:
+		return fmt.Errorf("protocolSplit shares add up to %d%%, leaving nothing for other traffic", s.TCP+s.UDP)
+	}
+	return nil
+}
+
+// splitGeneration divides the classes of generation gen under the root qdisc major of linkName, whose rate and ceil
+// are rate and ceil, into leaf classes per protocol, and attaches the filters classifying into them. With separate
+// family budgets, the IPv6 class is divided alike. Nothing is done if s isn't enabled.
+func splitGeneration(linkName string, major uint16, gen int, rate, ceil uint64, buffer htbBuffer, prio uint32, budget string,
+	s ProtocolSplit) error {
+	if !s.enabled() {
+		return nil
+	}
+	link, err := netlink.LinkByName(linkName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", linkName, err)
+	}
+	minors := []uint16{shaping.ClassMinor(gen)}
+	if budget == IPFamilyBudgetSeparate {
+		minors = append(minors, shaping.ClassMinor(shaping.IPv6Generation(gen)))
+	}
+	for _, minor := range minors {
+		if err := setSplitRates(linkName, major, minor, rate, ceil, buffer, prio, s); err != nil {
+			return err
+		}
+		if err := addSplitFilters(link, major, minor); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setSplitRates adds or updates the leaf classes of the split class major:minor with rate and ceil on linkName. Each
+// is guaranteed its share of rate, and borrows up to the ceil. Nothing is done if s isn't enabled.
+func setSplitRates(linkName string, major, minor uint16, rate, ceil uint64, buffer htbBuffer, prio uint32, s ProtocolSplit) error {
+	if !s.enabled() {
+		return nil
+	}
+	// Leaves borrow most of their traffic, so their cbuffer defaults to their buffer rather than a tick at the ceil.
+	cbuffer := buffer.cbuffer
+	if cbuffer == 0 {
+		cbuffer = buffer.buffer
+	}
+	link, err := netlink.LinkByName(linkName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", linkName, err)
+	}
+	for i, share := range s.shares() {
+		class := netlink.NewHtbClass(netlink.ClassAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    netlink.MakeHandle(major, minor),
+			Handle:    netlink.MakeHandle(major, splitMinor(minor, i)),
+		}, netlink.HtbClassAttrs{
+			Rate:    rate * uint64(share) / 100,
+			Ceil:    ceil,
+			Buffer:  buffer.buffer,
+			Cbuffer: cbuffer,
+			Prio:    prio,
+		})
+		if err = shaping.ReplaceClass(class); err != nil {
+			return fmt.Errorf("failed to add %s class on %q: %v", splitClasses[i].name, linkName, err)
+		}
+	}
+	return nil
+}
+
+// addSplitFilters attaches the filters classifying the traffic reaching the split class major:minor of link into
+// its leaf classes, by the protocol field of IPv4 and the next header of IPv6.
+func addSplitFilters(link netlink.Link, major, minor uint16) error {
+	parent := netlink.MakeHandle(major, minor)
+	for i, c := range splitClasses {
+		classID := netlink.MakeHandle(major, splitMinor(minor, i))
+		var filters []netlink.Filter
+		if c.proto == 0 {
+			filters = append(filters, &netlink.MatchAll{
+				FilterAttrs: netlink.FilterAttrs{
+					LinkIndex: link.Attrs().Index,
+					Parent:    parent,
+					Priority:  splitOtherPrio,
+					Protocol:  syscall.ETH_P_ALL,
+				},
+				ClassId: classID,
+			})
+		} else {
+			// The protocol is the second byte of the third word of an IPv4 header, and the next header the third
+			// byte of the second word of an IPv6 header.
+			v4 := netlink.TcU32Key{Mask: 0x00ff0000, Val: uint32(c.proto) << 16, Off: 8}
+			v6 := netlink.TcU32Key{Mask: 0x0000ff00, Val: uint32(c.proto) << 8, Off: 4}
+			prio := splitFilterPrio + 2*uint16(i)
+			filters = append(filters,
+				protocolFilter(link, parent, prio, syscall.ETH_P_IP, v4, classID),
+				protocolFilter(link, parent, prio+1, syscall.ETH_P_IPV6, v6, classID))
+		}
+		for _, f := range filters {
+			if err := shaping.ReplaceFilter(link, f); err != nil {
+				return fmt.Errorf("failed to add %s filter on %q: %v", c.name, link.Attrs().Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// protocolFilter returns a u32 filter under parent on link matching key in packets of the ethertype proto, and
+// classifying them into classID.
+func protocolFilter(link netlink.Link, parent uint32, prio, proto uint16, key netlink.TcU32Key,
+	classID uint32) *netlink.U32 {
+	return &netlink.U32{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    parent,
+			Priority:  prio,
+			Protocol:  proto,
+		},
+		Sel: &netlink.TcU32Sel{
+			Keys:  []netlink.TcU32Key{key},
+			Flags: netlink.TC_U32_TERMINAL,
+		},
+		ClassId: classID,
+	}
+}
+
+// deleteLeafClasses removes the filters and leaf classes of the class major:minor from link, if it is divided by a
+// protocol split or traffic classes. HTB refuses to delete a class while it has children or filters classify into
+// it.
+func deleteLeafClasses(link netlink.Link, major, minor uint16) {
+	parent := netlink.MakeHandle(major, minor)
+	filters, err := netlink.FilterList(link, parent)
+	if err != nil {
+		return
+	}
+	deleted := map[uint16]bool{}
+	for _, f := range filters {
+		attrs := f.Attrs()
+		if deleted[attrs.Priority] {
+			continue
+		}
+		deleted[attrs.Priority] = true
+		prio := &netlink.GenericFilter{FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: attrs.LinkIndex,
+			Parent:    parent,
+			Priority:  attrs.Priority,
+			Protocol:  attrs.Protocol,
+		}, FilterType: f.Type()}
+		err = countNetlink("FilterDel", func() error { return netlink.FilterDel(prio) })
+		if err != nil && err != syscall.ENOENT {
+			tcLog.WithError(err).WithField("interface", link.Attrs().Name).Warn("Failed to remove leaf class filter")
+		}
+	}
+	classes, err := netlink.ClassList(link, parent)
+	if err != nil {
+		return
+	}
+	for _, class := range classes {
+		if class.Attrs().Parent != parent {
+			continue
+		}
+		if err := netlink.ClassDel(class); err != nil && err != syscall.ENOENT {
+			tcLog.WithError(err).WithField("interface", link.Attrs().Name).Warn("Failed to remove leaf class")
+		}
+	}
+}
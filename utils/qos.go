@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/projectcalico/cni-plugin/policy"
+)
+
+// The QoS classes of pods, as Kubernetes reports them in their status.
+const (
+	QoSGuaranteed = "Guaranteed"
+	QoSBurstable  = "Burstable"
+	QoSBestEffort = "BestEffort"
+)
+
+// checkQoSPriorities checks the priority tiers of conf. HTB priorities only decide which of the classes borrowing
+// from the same parent gets the spare bandwidth first, and pods only share a parent class on the uplink, so tiers
+// need the nic shaping mode with a hierarchy.
+func checkQoSPriorities(conf NetConf) error {
+	if len(conf.QoSPriorities) == 0 && len(conf.LabelPriorities) == 0 {
+		return nil
+	}
+	if conf.ShapingMode != ShapingModeNIC || conf.NICHierarchy == nil {
+		return fmt.Errorf("qosPriorities and labelPriorities need the %s shaping mode with a nicHierarchy, for pods to "+
+			"share a parent class", ShapingModeNIC)
+	}
+	for class, prio := range conf.QoSPriorities {
+		switch class {
+		case QoSGuaranteed, QoSBurstable, QoSBestEffort:
+		default:
+			return fmt.Errorf("unknown QoS class %q in qosPriorities, must be %q, %q or %q", class, QoSGuaranteed,
+				QoSBurstable, QoSBestEffort)
+		}
+		if prio > policy.MaxClassPriority {
+			return fmt.Errorf("priority %d of QoS class %s is above %d", prio, class, policy.MaxClassPriority)
+		}
+	}
+	for label, prio := range conf.LabelPriorities {
+		if i := strings.Index(label, "="); i <= 0 {
+			return fmt.Errorf("invalid label %q in labelPriorities, must be key=value", label)
+		}
+		if prio > policy.MaxClassPriority {
+			return fmt.Errorf("priority %d of label %s is above %d", prio, label, policy.MaxClassPriority)
+		}
+	}
+	return nil
+}
+
+// TierPriority returns the HTB priority the tiers of conf give a pod with labels and QoS class qosClass, and
+// whether they give it one: the highest of those of its labels in LabelPriorities or, if it has none of them, that
+// of its QoS class in QoSPriorities.
+func TierPriority(conf NetConf, labels map[string]string, qosClass string) (uint32, bool) {
+	keys := make([]string, 0, len(conf.LabelPriorities))
+	for label := range conf.LabelPriorities {
+		keys = append(keys, label)
+	}
+	sort.Strings(keys)
+	var prio uint32
+	found := false
+	for _, label := range keys {
+		kv := strings.SplitN(label, "=", 2)
+		if v, ok := labels[kv[0]]; !ok || len(kv) != 2 || v != kv[1] {
+			continue
+		}
+		if p := conf.LabelPriorities[label]; !found || p < prio {
+			prio, found = p, true
+		}
+	}
+	if found {
+		return prio, true
+	}
+	prio, found = conf.QoSPriorities[qosClass]
+	return prio, found
+}
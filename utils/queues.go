@@ -0,0 +1,47 @@
+package utils
+
+import "fmt"
+
+// DefaultTxQLen is the transmit queue length of the veth pair unless txqlen is set.
+const DefaultTxQLen = 1000
+
+// maxVethQueues is the most transmit or receive queues the kernel gives a device.
+const maxVethQueues = 4096
+
+// VethQueues are the transmit queue length and the number of queues of both ends of the veth pair.
+type VethQueues struct {
+	// TxQLen is the length of the transmit queue, DefaultTxQLen if nil.
+	TxQLen *int
+	// NumTxQueues and NumRxQueues are the numbers of queues, the kernel's default of one if zero.
+	NumTxQueues int
+	NumRxQueues int
+}
+
+// vethQueues returns the queues of the veth pair of conf.
+func vethQueues(conf NetConf) VethQueues {
+	return VethQueues{TxQLen: conf.TxQLen, NumTxQueues: conf.NumTxQueues, NumRxQueues: conf.NumRxQueues}
+}
+
+// txQLen returns the length of the transmit queue of q.
+func (q VethQueues) txQLen() int {
+	if q.TxQLen == nil {
+		return DefaultTxQLen
+	}
+	return *q.TxQLen
+}
+
+// checkVethQueues validates the txqlen, num_tx_queues and num_rx_queues options.
+func checkVethQueues(q VethQueues) error {
+	if q.TxQLen != nil && *q.TxQLen < 0 {
+		return fmt.Errorf("invalid txqlen %d, must not be negative", *q.TxQLen)
+	}
+	for _, c := range []struct {
+		name string
+		n    int
+	}{{"num_tx_queues", q.NumTxQueues}, {"num_rx_queues", q.NumRxQueues}} {
+		if c.n < 0 || c.n > maxVethQueues {
+			return fmt.Errorf("invalid %s %d, must be between 0 and %d", c.name, c.n, maxVethQueues)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/projectcalico/cni-plugin/sysctl"
+)
+
+// Values of RPFilter.Mode, as in the rp_filter sysctl.
+const (
+	RPFilterOff    = 0
+	RPFilterStrict = 1
+	RPFilterLoose  = 2
+)
+
+// RPFilter sets the reverse path filter of the host veth. Strict filtering, the default on some distributions,
+// drops traffic of the pod that the host routes back through another interface, which the point-to-point and
+// proxy ARP model produces.
+type RPFilter struct {
+	// Mode is RPFilterOff, RPFilterStrict or RPFilterLoose.
+	Mode int `json:"mode"`
+	// All also sets net.ipv4.conf.all.rp_filter to Mode. The kernel applies the higher of it and the value of the
+	// interface, so a veth can't be filtered more loosely than all; setting it affects every interface of the host.
+	All bool `json:"all"`
+}
+
+// checkRPFilter validates the rpFilter option.
+func checkRPFilter(f *RPFilter) error {
+	if f == nil {
+		return nil
+	}
+	switch f.Mode {
+	case RPFilterOff, RPFilterStrict, RPFilterLoose:
+		return nil
+	}
+	return fmt.Errorf("invalid rpFilter mode %d, must be %d (off), %d (strict) or %d (loose)", f.Mode, RPFilterOff,
+		RPFilterStrict, RPFilterLoose)
+}
+
+// set adds the reverse path filter settings of f to b. rp_filter only exists for IPv4.
+func (f *RPFilter) set(b *sysctl.Batch, hasIPv4 bool) {
+	if f == nil || !hasIPv4 {
+		return
+	}
+	mode := strconv.Itoa(f.Mode)
+	if f.All {
+		b.Set("net.ipv4.conf.all.rp_filter", mode)
+	}
+	b.Set("net.ipv4.conf.IFNAME.rp_filter", mode)
+}
@@ -0,0 +1,61 @@
+package utils
+
+import (
+	"strconv"
+
+	"github.com/projectcalico/cni-plugin/policy"
+	"github.com/projectcalico/cni-plugin/state"
+)
+
+// capabilityBandwidth is the capability the runtime passes the bandwidth of pods for.
+const capabilityBandwidth = "bandwidth"
+
+// RuntimeBandwidth returns the rates the runtime passed for the container, as bandwidths like the annotations, if
+// the bandwidth capability is enabled, or else those of the bandwidth of conf; a direction without a rate is empty.
+// The bursts that come with them replace the configured ones in conf. Runtimes pass a huge burst to mean none was
+// requested, so bursts beyond what can be configured are ignored.
+func RuntimeBandwidth(conf *NetConf) (ingress, egress string) {
+	bw := conf.Bandwidth
+	if conf.Capabilities[capabilityBandwidth] && conf.RuntimeConfig.Bandwidth != nil {
+		bw = conf.RuntimeConfig.Bandwidth
+	}
+	if bw == nil {
+		return "", ""
+	}
+	if bw.IngressRate != 0 {
+		ingress = strconv.FormatUint(bw.IngressRate, 10)
+	}
+	if bw.EgressRate != 0 {
+		egress = strconv.FormatUint(bw.EgressRate, 10)
+	}
+	if burst := bw.IngressBurst / 8; burst != 0 && burst <= maxBurst {
+		conf.IngressBurst = uint32(burst)
+	}
+	if burst := bw.EgressBurst / 8; burst != 0 && burst <= maxBurst {
+		conf.EgressBurst = uint32(burst)
+	}
+	return ingress, egress
+}
+
+// InterfaceBandwidth returns the bandwidths of the interface ifName of a pod in namespace with the annotations annot,
+// given those the runtime passed for it by RuntimeBandwidth. The bandwidth annotations, and the presets of the
+// cluster policy p, if one was loaded, are those of the pod's primary interface, whose runtime rates take precedence
+// over the annotations and are written into annot, for the policy to see them as the pod's. A secondary interface
+// only gets the rates the runtime passed, or those of its own network configuration, such as a
+// NetworkAttachmentDefinition, and annot is left alone.
+func InterfaceBandwidth(p *policy.Policy, namespace, ifName string, annot map[string]string, runtimeIngress,
+	runtimeEgress string) (ingress, egress string) {
+	if state.Secondary(ifName) {
+		return runtimeIngress, runtimeEgress
+	}
+	if runtimeIngress != "" {
+		annot["kubernetes.io/ingress-bandwidth"] = runtimeIngress
+	}
+	if runtimeEgress != "" {
+		annot["kubernetes.io/egress-bandwidth"] = runtimeEgress
+	}
+	if p == nil {
+		return annot["kubernetes.io/ingress-bandwidth"], annot["kubernetes.io/egress-bandwidth"]
+	}
+	return p.Apply(namespace, annot)
+}
@@ -0,0 +1,102 @@
+package utils
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/projectcalico/cni-plugin/policy"
+	"github.com/projectcalico/cni-plugin/state"
+)
+
+// scheduleTimeFormat is the format of the times of day of bandwidth schedules.
+const scheduleTimeFormat = "15:04"
+
+// ScheduleEntry is an entry of a bandwidth schedule: a window of the day, from From up to To in the local time of
+// the node, like "09:00", with the bandwidths pods have in it, or, with only Default, the bandwidth pods have in
+// both directions outside the windows when they are given none.
+type ScheduleEntry struct {
+	From    string `json:"from,omitempty"`
+	To      string `json:"to,omitempty"`
+	Ingress string `json:"ingress,omitempty"`
+	Egress  string `json:"egress,omitempty"`
+	Default string `json:"default,omitempty"`
+}
+
+// parseSchedule parses the bandwidth schedule of conf into the windows recorded for pods and its default.
+func parseSchedule(conf NetConf) (windows []state.ScheduleWindow, def string, err error) {
+	for i, e := range conf.BandwidthSchedule {
+		if e.Default != "" {
+			switch {
+			case e.From != "" || e.To != "" || e.Ingress != "" || e.Egress != "":
+				return nil, "", fmt.Errorf("bandwidth_schedule entry %d has a default and a window", i)
+			case def != "":
+				return nil, "", fmt.Errorf("bandwidth_schedule has more than one default")
+			}
+			if _, err = policy.ParseRate(e.Default); err != nil {
+				return nil, "", fmt.Errorf("bandwidth_schedule default %q: %v", e.Default, err)
+			}
+			def = e.Default
+			continue
+		}
+		var w state.ScheduleWindow
+		if w.From, err = scheduleMinute(e.From); err != nil {
+			return nil, "", fmt.Errorf("bandwidth_schedule entry %d: from %v", i, err)
+		}
+		if w.To, err = scheduleMinute(e.To); err != nil {
+			return nil, "", fmt.Errorf("bandwidth_schedule entry %d: to %v", i, err)
+		}
+		if w.From == w.To {
+			return nil, "", fmt.Errorf("bandwidth_schedule entry %d is empty, from and to are both %s", i, e.From)
+		}
+		if e.Ingress == "" && e.Egress == "" {
+			return nil, "", fmt.Errorf("bandwidth_schedule entry %d has no ingress or egress bandwidth", i)
+		}
+		for _, o := range []struct {
+			name, value string
+			rate        *uint64
+		}{{"ingress", e.Ingress, &w.IngressRate}, {"egress", e.Egress, &w.EgressRate}} {
+			if o.value == "" {
+				continue
+			}
+			if *o.rate, err = policy.ParseRate(o.value); err != nil || *o.rate == 0 {
+				return nil, "", fmt.Errorf("bandwidth_schedule entry %d: %s %q isn't a positive rate", i, o.name, o.value)
+			}
+		}
+		windows = append(windows, w)
+	}
+	return windows, def, nil
+}
+
+// scheduleMinute parses a time of day of a bandwidth schedule into minutes since midnight.
+func scheduleMinute(value string) (int, error) {
+	t, err := time.Parse(scheduleTimeFormat, value)
+	if err != nil {
+		return 0, fmt.Errorf("%q isn't a time of day like 09:00", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// checkSchedule validates the bandwidth schedule of conf.
+func checkSchedule(conf NetConf) error {
+	_, _, err := parseSchedule(conf)
+	return err
+}
+
+// scheduleWindows returns the windows of the bandwidth schedule of conf, which ParseShapingRates has checked.
+func scheduleWindows(conf NetConf) []state.ScheduleWindow {
+	windows, _, _ := parseSchedule(conf)
+	return windows
+}
+
+// scheduleDefaults returns the bandwidths ingress and egress, with the default of the bandwidth schedule of conf in
+// place of those that are empty.
+func scheduleDefaults(conf NetConf, ingress, egress string) (string, string) {
+	_, def, _ := parseSchedule(conf)
+	if ingress == "" {
+		ingress = def
+	}
+	if egress == "" {
+		egress = def
+	}
+	return ingress, egress
+}
@@ -0,0 +1,203 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+// SelfTestTolerance is how far, as a fraction, the rate SelfTest measures may be from the shaped one.
+const SelfTestTolerance = 0.1
+
+// The scratch pod of SelfTest is addressed from the benchmarking range, which shouldn't be routed anywhere.
+const (
+	selfTestHostAddr = "198.18.0.1/30"
+	selfTestPodAddr  = "198.18.0.2/30"
+	selfTestPort     = 9999
+	// selfTestPayload is the size of the datagrams of the UDP blaster, which fit in the default MTU.
+	selfTestPayload = 1400
+	// udpOverhead is what the Ethernet, IPv4 and UDP headers add to each datagram. HTB counts them against the rate.
+	udpOverhead = 14 + 20 + 8
+)
+
+// SelfTestResult is what SelfTest measured in a direction of its scratch pod.
+type SelfTestResult struct {
+	Direction string `json:"direction"`
+	// Rate is the rate the direction was shaped to, and Achieved the rate measured, in bits per second.
+	Rate     uint64 `json:"rate"`
+	Achieved uint64 `json:"achieved"`
+	Passed   bool   `json:"passed"`
+}
+
+// SelfTest checks that the node can enforce rates: it sets up a scratch pod, a network namespace with a veth and
+// IFB device shaped as ADD shapes pods, to rate in both directions, blasts UDP through it in each direction for
+// duration and measures the rate that got through. Everything it creates is deleted before it returns. It runs in
+// the current network namespace, which must be the host's.
+func SelfTest(rate uint64, duration time.Duration) ([]SelfTestResult, error) {
+	podNS, err := ns.NewNS()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create network namespace: %v", err)
+	}
+	defer podNS.Close()
+
+	suffix := os.Getpid() % 100000
+	hostVethName := fmt.Sprintf("fcself%d", suffix)
+	podVethName := fmt.Sprintf("fcselfp%d", suffix)
+	ifbName := fmt.Sprintf("fcselfi%d", suffix)
+	defer func() {
+		for _, name := range []string{hostVethName, ifbName} {
+			if link, err := netlink.LinkByName(name); err == nil {
+				countNetlink("LinkDel", func() error { return netlink.LinkDel(link) })
+			}
+		}
+	}()
+	hostVeth, err := setupSelfTestPod(podNS, hostVethName, podVethName)
+	if err != nil {
+		return nil, err
+	}
+
+	bursts := Bursts{}
+	if err = setupIngressShaping(hostVeth, 0, rate, 0, bursts.ingress(rate), "", "", 0, "", "", "", ""); err != nil {
+		return nil, err
+	}
+	if err = setupEgressShaping(hostVeth, ifbName, 0, rate, 0, bursts.egress(rate), "", "", 0, "", "", "", "", nil); err != nil {
+		return nil, err
+	}
+
+	podIP, _, _ := net.ParseCIDR(selfTestPodAddr)
+	hostIP, _, _ := net.ParseCIDR(selfTestHostAddr)
+	var results []SelfTestResult
+	for _, d := range []struct {
+		direction        string
+		sender, receiver ns.NetNS
+		dst              net.IP
+	}{
+		{"ingress", nil, podNS, podIP},
+		{"egress", podNS, nil, hostIP},
+	} {
+		achieved, err := blastUDP(d.sender, d.receiver, d.dst, duration)
+		if err != nil {
+			return nil, fmt.Errorf("failed to measure %s: %v", d.direction, err)
+		}
+		diff := float64(achieved) - float64(rate)
+		if diff < 0 {
+			diff = -diff
+		}
+		results = append(results, SelfTestResult{
+			Direction: d.direction,
+			Rate:      rate,
+			Achieved:  achieved,
+			Passed:    diff <= float64(rate)*SelfTestTolerance,
+		})
+	}
+	return results, nil
+}
+
+// setupSelfTestPod creates the veth of the scratch pod, moves its pod end to podNS, and addresses and sets up both
+// ends. It returns the host end.
+func setupSelfTestPod(podNS ns.NetNS, hostVethName, podVethName string) (netlink.Link, error) {
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: hostVethName}, PeerName: podVethName}
+	if err := countNetlink("LinkAdd", func() error { return netlink.LinkAdd(veth) }); err != nil {
+		return nil, fmt.Errorf("failed to create veth %q: %v", hostVethName, err)
+	}
+	podVeth, err := netlink.LinkByName(podVethName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup %q: %v", podVethName, err)
+	}
+	if err = countNetlink("LinkSetNsFd", func() error { return netlink.LinkSetNsFd(podVeth, int(podNS.Fd())) }); err != nil {
+		return nil, fmt.Errorf("failed to move veth %q to the scratch namespace: %v", podVethName, err)
+	}
+	err = podNS.Do(func(ns.NetNS) error {
+		return setupSelfTestLink(podVethName, selfTestPodAddr)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = setupSelfTestLink(hostVethName, selfTestHostAddr); err != nil {
+		return nil, err
+	}
+	return netlink.LinkByName(hostVethName)
+}
+
+// setupSelfTestLink addresses the link name with addr and sets it up.
+func setupSelfTestLink(name, addr string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", name, err)
+	}
+	a, err := netlink.ParseAddr(addr)
+	if err != nil {
+		return err
+	}
+	if err = countNetlink("AddrAdd", func() error { return netlink.AddrAdd(link, a) }); err != nil {
+		return fmt.Errorf("failed to add %s to %q: %v", addr, name, err)
+	}
+	if err = countNetlink("LinkSetUp", func() error { return netlink.LinkSetUp(link) }); err != nil {
+		return fmt.Errorf("failed to set %q up: %v", name, err)
+	}
+	return nil
+}
+
+// blastUDP sends UDP datagrams as fast as it can from the sender namespace to dst in the receiver namespace for
+// duration, and returns the rate at which they arrived, in bits per second on the wire. A nil namespace is the
+// current one.
+func blastUDP(sender, receiver ns.NetNS, dst net.IP, duration time.Duration) (uint64, error) {
+	var in *net.UDPConn
+	err := doInNS(receiver, func() (err error) {
+		in, err = net.ListenUDP("udp4", &net.UDPAddr{IP: dst, Port: selfTestPort})
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	var out *net.UDPConn
+	err = doInNS(sender, func() (err error) {
+		out, err = net.DialUDP("udp4", nil, &net.UDPAddr{IP: dst, Port: selfTestPort})
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+
+	start := time.Now()
+	end := start.Add(duration)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		payload := make([]byte, selfTestPayload)
+		for time.Now().Before(end) {
+			// Writes fail with ENOBUFS while the shaped queue is full, which is the point.
+			out.Write(payload)
+		}
+	}()
+
+	var received uint64
+	buf := make([]byte, 65536)
+	in.SetReadDeadline(end)
+	for {
+		n, err := in.Read(buf)
+		if err != nil {
+			break
+		}
+		received += uint64(n + udpOverhead)
+	}
+	wg.Wait()
+	return uint64(float64(received*8) / time.Since(start).Seconds()), nil
+}
+
+// doInNS runs f in the network namespace netns, or in the current one if it is nil. Sockets opened by f stay in the
+// namespace they were opened in.
+func doInNS(netns ns.NetNS, f func() error) error {
+	if netns == nil {
+		return f()
+	}
+	return netns.Do(func(ns.NetNS) error { return f() })
+}
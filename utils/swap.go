@@ -0,0 +1,174 @@
+package utils
+
+import (
+	"fmt"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/cni-plugin/shaping"
+	"github.com/projectcalico/cni-plugin/state"
+	"github.com/vishvananda/netlink"
+)
+
+// SwapShaping rebuilds the veth shaping of a pod for new settings without dropping its traffic. The classes and
+// filters of the other generation are built next to the current ones; traffic switches over to them when the
+// current filters are deleted, after which the current classes are removed. Directions can't be added or removed
+// this way. On success the record is updated to the new settings, but not saved.
+func SwapShaping(r *state.Record, ingressRate, egressRate uint64, latencyClass, nonIPPolicy string) error {
+	if r.HostNetwork || r.ShapingMode == ShapingModeNIC || r.ShapingMode == ShapingModeNFTables ||
+		r.ShapingMode == ShapingModeContainer {
+		return fmt.Errorf("only veth shaping can be swapped")
+	}
+	if r.Qdisc == QdiscTBF {
+		return fmt.Errorf("pods shaped with a TBF qdisc have no classes to swap, set singleClassQdisc to %q", QdiscHTB)
+	}
+	if r.Qdisc == QdiscEBPF {
+		return fmt.Errorf("pods shaped with BPF have no classes to swap")
+	}
+	if r.Qdisc == QdiscPolice {
+		return fmt.Errorf("policed pods have no classes to swap")
+	}
+	if (r.IngressRate == 0) != (ingressRate == 0) || (r.EgressRate == 0) != (egressRate == 0) {
+		return fmt.Errorf("swapping can't add or remove a shaped direction")
+	}
+	if err := checkNonIPPolicy(nonIPPolicy); err != nil {
+		return err
+	}
+	split, bursts := ProtocolSplitOf(r), BurstsOf(r)
+	if split.enabled() && latencyClass == LatencyClassLow {
+		return fmt.Errorf("the classes of a pod split by protocol can't be moved to latencyClass %q", LatencyClassLow)
+	}
+	if len(r.Classes) != 0 && latencyClass == LatencyClassLow {
+		return fmt.Errorf("the classes of a pod with traffic classes can't be moved to latencyClass %q", LatencyClassLow)
+	}
+	hostVeth, err := netlink.LinkByName(r.HostVeth)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", r.HostVeth, err)
+	}
+	// A policed egress has no classes; its policer is replaced in place.
+	shapedEgress := r.EgressRate != 0 && !r.EgressPoliced
+	var ifb netlink.Link
+	if shapedEgress {
+		if ifb, err = netlink.LinkByName(r.IFB); err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", r.IFB, err)
+		}
+	}
+
+	// The trees holding classes and filters of each generation: the host veth root for ingress, and for egress the
+	// IFB root and the host veth ingress qdisc redirecting to it.
+	type tree struct {
+		link   netlink.Link
+		parent uint32
+		major  uint16
+	}
+	var trees []tree
+	if r.IngressRate != 0 {
+		trees = append(trees, tree{hostVeth, netlink.MakeHandle(shaping.HostVethQdiscMajor, 0), shaping.HostVethQdiscMajor})
+	}
+	if shapedEgress {
+		trees = append(trees,
+			tree{ifb, netlink.MakeHandle(shaping.IFBQdiscMajor, 0), shaping.IFBQdiscMajor},
+			tree{hostVeth, netlink.MakeHandle(0xffff, 0), 0})
+	}
+	removeGeneration := func(gen int) error {
+		for _, t := range trees {
+			if err := shaping.DeleteFilterBand(t.link, t.parent, gen); err != nil {
+				return err
+			}
+		}
+		for _, t := range trees {
+			if t.major != 0 {
+				deleteGenerationClass(t.link, t.major, gen)
+				if r.IPFamilyBudget == IPFamilyBudgetSeparate {
+					deleteGenerationClass(t.link, t.major, shaping.IPv6Generation(gen))
+				}
+			}
+		}
+		return nil
+	}
+
+	old, next := r.ShapingGeneration, 1-r.ShapingGeneration
+	// Clear out anything left of the other generation by a swap that failed part way.
+	if err = removeGeneration(next); err != nil {
+		return err
+	}
+
+	prio := HTBPrio(latencyClass, r.ClassPriority)
+	ingressCeil, egressCeil := CeilsOf(r, ingressRate, egressRate)
+	build := func() error {
+		if r.IngressRate != 0 {
+			buffer := bursts.ingress(ingressRate)
+			err := setupIngressShaping(hostVeth, next, ingressRate, ingressCeil, buffer, latencyClass, r.LeafQdisc,
+				r.ClassPriority, nonIPPolicy, r.IPFamilyBudget, r.Classifier, r.MirrorTo)
+			if err != nil {
+				return err
+			}
+			err = splitGeneration(r.HostVeth, shaping.HostVethQdiscMajor, next, ingressRate, ingressCeil, buffer, prio,
+				r.IPFamilyBudget, split)
+			if err != nil {
+				return err
+			}
+			err = classGeneration(r.HostVeth, shaping.HostVethQdiscMajor, next, ingressRate, ingressCeil, buffer, prio,
+				r.IPFamilyBudget, classesIn(r.Classes, "ingress"))
+			if err != nil {
+				return err
+			}
+		}
+		if r.EgressPoliced {
+			if err := shaping.SetupPolicer(hostVeth, egressRate, bursts.egress(egressRate).buffer); err != nil {
+				return err
+			}
+		} else if r.EgressRate != 0 {
+			// The IFB device and the ingress qdisc of the host veth are reconciled in place; the filters redirecting
+			// to the device move to the new generation with the classes.
+			buffer := bursts.egress(egressRate)
+			err := setupEgressShaping(hostVeth, r.IFB, next, egressRate, egressCeil, buffer, latencyClass, r.LeafQdisc,
+				r.ClassPriority, nonIPPolicy, r.IPFamilyBudget, r.Classifier, r.MirrorTo, r.DSCP)
+			if err != nil {
+				return err
+			}
+			err = splitGeneration(r.IFB, shaping.IFBQdiscMajor, next, egressRate, egressCeil, buffer, prio, r.IPFamilyBudget, split)
+			if err != nil {
+				return err
+			}
+			err = classGeneration(r.IFB, shaping.IFBQdiscMajor, next, egressRate, egressCeil, buffer, prio, r.IPFamilyBudget,
+				classesIn(r.Classes, "egress"))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err = build(); err != nil {
+		if cleanupErr := removeGeneration(next); cleanupErr != nil {
+			tcLog.WithError(cleanupErr).WithField("interface", r.HostVeth).Warn("Failed to remove partially built shaping")
+		}
+		return err
+	}
+
+	// Traffic still matches the current filters where they come first; once they are gone it all moves over.
+	if err = removeGeneration(old); err != nil {
+		return err
+	}
+
+	r.ShapingGeneration = next
+	r.IngressRate = ingressRate
+	r.EgressRate = egressRate
+	r.LatencyClass = latencyClass
+	r.NonIPPolicy = nonIPPolicy
+	return nil
+}
+
+// deleteGenerationClass removes the shaping class of generation gen, and with it any leaf qdisc or leaf classes,
+// from link. The class may not exist.
+func deleteGenerationClass(link netlink.Link, major uint16, gen int) {
+	deleteLeafClasses(link, major, shaping.ClassMinor(gen))
+	class := netlink.NewHtbClass(netlink.ClassAttrs{
+		LinkIndex: link.Attrs().Index,
+		Parent:    netlink.MakeHandle(major, 0),
+		Handle:    netlink.MakeHandle(major, shaping.ClassMinor(gen)),
+	}, netlink.HtbClassAttrs{})
+	if err := netlink.ClassDel(class); err != nil && err != syscall.ENOENT {
+		tcLog.WithError(err).WithField("interface", link.Attrs().Name).Warn("Failed to remove shaping class")
+	}
+}
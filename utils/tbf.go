@@ -0,0 +1,207 @@
+package utils
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/projectcalico/cni-plugin/shaping"
+	"github.com/vishvananda/netlink"
+)
+
+// Values of NetConf.Shaper, NetConf.SingleClassQdisc and state.Record.Qdisc: the root qdisc shaping each direction
+// of a pod on its veth.
+const (
+	QdiscHTB = "htb"
+	QdiscTBF = "tbf"
+)
+
+// tbfLatency is how long packets may wait in a TBF qdisc before they are dropped, which sizes its queue.
+const tbfLatency = 50 * time.Millisecond
+
+func checkSingleClassQdisc(qdisc string) error {
+	switch qdisc {
+	case "", QdiscHTB, QdiscTBF:
+		return nil
+	}
+	return fmt.Errorf("invalid singleClassQdisc %q, must be %q or %q", qdisc, QdiscTBF, QdiscHTB)
+}
+
+// checkShaper validates the shaper option. TBF can only enforce a single rate per direction, so it rules out the
+// options that need classes or filters, and shaping on the uplink, which is always HTB. The options that need
+// features TBF lacks are rejected by checkBackendFeatures.
+func checkShaper(conf NetConf) error {
+	switch conf.Shaper {
+	case "", QdiscHTB:
+		return nil
+	case QdiscTBF:
+	default:
+		return fmt.Errorf("invalid shaper %q, must be %q or %q", conf.Shaper, QdiscTBF, QdiscHTB)
+	}
+	for _, c := range []struct {
+		option string
+		set    bool
+	}{
+		{"singleClassQdisc " + QdiscHTB, conf.SingleClassQdisc == QdiscHTB},
+		{"shapingMode " + conf.ShapingMode, conf.ShapingMode != "" && conf.ShapingMode != ShapingModeVeth},
+		{"ipFamilyBudget " + IPFamilyBudgetSeparate, conf.IPFamilyBudget == IPFamilyBudgetSeparate},
+		{"nonIPPolicy " + NonIPPolicyDrop, conf.NonIPPolicy == NonIPPolicyDrop},
+		{"dscp", conf.DSCP != nil},
+		{"leaf_qdisc", conf.LeafQdisc != ""},
+		{"mirror_to", conf.MirrorTo != ""},
+	} {
+		if c.set {
+			return fmt.Errorf("shaper %q can't be combined with %s", QdiscTBF, c.option)
+		}
+	}
+	return nil
+}
+
+// singleClass reports whether the veth shaping of a pod configured by conf has a single class per direction and no
+// filters beyond the catch-alls, so that a TBF qdisc can enforce it more cheaply than an HTB hierarchy. Under TBF
+// any non-IP traffic of the pod is limited along with the rest.
+func singleClass(conf NetConf) bool {
+	return conf.Shaper != QdiscHTB &&
+		conf.SingleClassQdisc != QdiscHTB &&
+		conf.LatencyClass == "" &&
+		conf.ProtocolSplit == nil &&
+		len(conf.Classes) == 0 &&
+		!peersSet(conf) &&
+		conf.IngressCeil == "" && conf.EgressCeil == "" &&
+		conf.IPFamilyBudget != IPFamilyBudgetSeparate &&
+		conf.NonIPPolicy != NonIPPolicyDrop &&
+		conf.DSCP == nil &&
+		conf.LeafQdisc == "" &&
+		conf.MirrorTo == ""
+}
+
+// replaceTBF makes a TBF qdisc with rate, in bits per second, the root qdisc major:0 of linkName. burst is the
+// most bytes sent back to back, raised to what rate sends in a timer tick.
+func replaceTBF(linkName string, major uint16, rate uint64, burst uint32) error {
+	link, err := netlink.LinkByName(linkName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", linkName, err)
+	}
+	bytesPerSec := rate / 8
+	if tick := uint32(float64(bytesPerSec)/netlink.Hz()) + defaultMTU; tick > burst {
+		burst = tick
+	}
+	qdisc := &netlink.Tbf{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(major, 0),
+			Parent:    netlink.HANDLE_ROOT,
+		},
+		Rate:  bytesPerSec,
+		Limit: uint32(float64(bytesPerSec)*tbfLatency.Seconds()) + burst,
+		// The kernel takes the burst as the time it takes to send at rate, in scheduler ticks.
+		Buffer: uint32(float64(burst) * 1e6 / float64(bytesPerSec) * netlink.TickInUsec()),
+	}
+	if err = countNetlink("QdiscReplace", func() error { return netlink.QdiscReplace(qdisc) }); err != nil {
+		return kernelSupportError(err, "add TBF qdisc to "+linkName, "sch_tbf")
+	}
+	return nil
+}
+
+// setTBFRates replaces the rates of the TBF qdiscs on the host veth and IFB device of a container, in bits per
+// second, keeping the bursts of the pod. A device name may be empty to leave that direction untouched.
+func setTBFRates(hostVethName, ifbName string, ingressRate, egressRate uint64, bursts Bursts) error {
+	if hostVethName != "" {
+		if err := replaceTBF(hostVethName, shaping.HostVethQdiscMajor, ingressRate, bursts.ingress(ingressRate).buffer); err != nil {
+			return err
+		}
+	}
+	if ifbName != "" {
+		return replaceTBF(ifbName, shaping.IFBQdiscMajor, egressRate, bursts.egress(egressRate).buffer)
+	}
+	return nil
+}
+
+// setupIngressTBF shapes traffic entering the pod with a TBF qdisc at the root of its host veth.
+func setupIngressTBF(hostVeth netlink.Link, rate uint64, burst uint32) error {
+	return replaceTBF(hostVeth.Attrs().Name, shaping.HostVethQdiscMajor, rate, burst)
+}
+
+// setupEgressTBF shapes traffic leaving the pod: as with HTB, packets arriving on the host veth are redirected to an
+// IFB device, but its root qdisc is a TBF qdisc.
+func setupEgressTBF(hostVeth netlink.Link, ifbName string, rate uint64, burst uint32, nonIPPolicy string) error {
+	ifb, err := shaping.EnsureIFB(ifbName)
+	if err != nil {
+		return err
+	}
+	if err = replaceTBF(ifbName, shaping.IFBQdiscMajor, rate, burst); err != nil {
+		return err
+	}
+
+	ingress := netlink.MakeHandle(0xffff, 0)
+	qdisc := &netlink.Ingress{QdiscAttrs: netlink.QdiscAttrs{
+		LinkIndex: hostVeth.Attrs().Index,
+		Handle:    ingress,
+		Parent:    netlink.HANDLE_INGRESS,
+	}}
+	if err = shaping.EnsureQdisc(hostVeth, qdisc); err != nil {
+		return err
+	}
+	if err = shaping.AddIPv4Filter(hostVeth, ingress, shaping.FilterBase(0), 0, ifb.Attrs().Index); err != nil {
+		return err
+	}
+	if err = shaping.AddIPv6Filter(hostVeth, ingress, shaping.FilterBase(0), 0, ifb.Attrs().Index, 0); err != nil {
+		return err
+	}
+	return shaping.AddNonIPFilters(hostVeth, ingress, shaping.FilterBase(0), nonIPPolicy, 0, ifb.Attrs().Index, 0)
+}
+
+// RestoreIngressTBF rebuilds the ingress shaping of a container shaped with TBF, replacing whatever root qdisc its
+// host veth has.
+func RestoreIngressTBF(hostVethName string, rate uint64, bursts Bursts) error {
+	hostVeth, err := netlink.LinkByName(hostVethName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", hostVethName, err)
+	}
+	shaping.DeleteRootQdisc(hostVeth)
+	return setupIngressTBF(hostVeth, rate, bursts.ingress(rate).buffer)
+}
+
+// RestoreEgressTBF rebuilds the egress shaping of a container shaped with TBF whose IFB device or redirect has
+// disappeared.
+func RestoreEgressTBF(hostVethName, ifbName string, rate uint64, bursts Bursts, nonIPPolicy string) error {
+	hostVeth, err := netlink.LinkByName(hostVethName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", hostVethName, err)
+	}
+	ingress := &netlink.Ingress{QdiscAttrs: netlink.QdiscAttrs{
+		LinkIndex: hostVeth.Attrs().Index,
+		Handle:    netlink.MakeHandle(0xffff, 0),
+		Parent:    netlink.HANDLE_INGRESS,
+	}}
+	if err = countNetlink("QdiscDel", func() error { return netlink.QdiscDel(ingress) }); err != nil {
+		tcLog.WithError(err).WithField("interface", hostVethName).Debug("No ingress qdisc to remove")
+	}
+	if ifb, err := netlink.LinkByName(ifbName); err == nil {
+		shaping.DeleteRootQdisc(ifb)
+	}
+	return setupEgressTBF(hostVeth, ifbName, rate, bursts.egress(rate).buffer, nonIPPolicy)
+}
+
+// checkTBF returns what is missing from the root TBF qdisc of a device.
+func checkTBF(link netlink.Link, major uint16) []string {
+	if qdiscs, err := netlink.QdiscList(link); err == nil {
+		for _, q := range qdiscs {
+			if _, ok := q.(*netlink.Tbf); ok && q.Attrs().Handle == netlink.MakeHandle(major, 0) &&
+				q.Attrs().Parent == netlink.HANDLE_ROOT {
+				return nil
+			}
+		}
+	}
+	return []string{"root TBF qdisc missing on " + link.Attrs().Name}
+}
+
+// linkTraffic returns the bytes and packets a device has sent, which is everything that went through its root
+// qdisc. It reports whether the device was found.
+func linkTraffic(device string) (bytes, packets uint64, found bool) {
+	link, err := netlink.LinkByName(device)
+	if err != nil || link.Attrs().Statistics == nil {
+		return 0, 0, false
+	}
+	stats := link.Attrs().Statistics
+	return stats.TxBytes, stats.TxPackets, true
+}
@@ -0,0 +1,392 @@
+package utils
+
+import (
+	"fmt"
+	"math"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/cni-plugin/logging"
+	"github.com/projectcalico/cni-plugin/shaping"
+	"github.com/projectcalico/cni-plugin/state"
+	"github.com/vishvananda/netlink"
+)
+
+// tcLog logs tc programming that happens outside the context of a workload's logger.
+var tcLog = logging.Logger(logging.TC)
+
+// Buffer sizes of the HTB classes HostSideSetup programs.
+const (
+	hostVethClassBuffer = 32 * 100000
+	ifbClassBuffer      = 32 * 1024
+
+	// htbR2Q is the kernel's default rate-to-quantum divisor for HTB classes.
+	htbR2Q = 10
+
+	defaultMTU = 1500
+)
+
+// Values of NetConf.LowRatePolicy.
+const (
+	LowRatePolicyAdjust = "adjust"
+	LowRatePolicyReject = "reject"
+	LowRatePolicyPolice = "police"
+)
+
+// Values of NetConf.LatencyClass.
+const (
+	LatencyClassLow = "low"
+)
+
+const (
+	// lowLatencyRate is the rate, in bits per second, guaranteed to a low latency class when the pod doesn't also
+	// request a bandwidth.
+	lowLatencyRate = 5 * 1000 * 1000
+
+	// latencyClassPrio is the HTB priority of low latency classes; 0 is served first when classes share a parent.
+	latencyClassPrio = 0
+	// bulkClassPrio is the lowest priority number of the other classes, so that low latency classes are served
+	// before them under the shared root and group classes of the uplink hierarchy.
+	bulkClassPrio = 1
+)
+
+// checkLatencyClass validates conf.LatencyClass and returns the rate to program for a direction: pods in the low
+// latency class that don't request a bandwidth get a modest guarantee rather than a bandwidth limit.
+func checkLatencyClass(conf NetConf, rate uint64) (uint64, error) {
+	switch conf.LatencyClass {
+	case "":
+		return rate, nil
+	case LatencyClassLow:
+		if rate == 0 {
+			return lowLatencyRate, nil
+		}
+		return rate, nil
+	default:
+		return 0, fmt.Errorf("invalid latencyClass %q, must be %q", conf.LatencyClass, LatencyClassLow)
+	}
+}
+
+// minHtbRate returns the lowest rate, in bits per second, an HTB class with the given buffer can enforce on links
+// with the given MTU. Below it the class quantum (rate / r2q) is smaller than one full-sized packet, and for very
+// large buffers the buffer expressed in kernel ticks no longer fits in 32 bits; either way HTB stalls.
+func minHtbRate(mtu int, buffer uint32) uint64 {
+	if mtu <= 0 {
+		mtu = defaultMTU
+	}
+	quantumMin := uint64(mtu) * htbR2Q * 8
+	tickMin := uint64(math.Ceil(float64(buffer) * 8 * 1e6 / math.MaxUint32))
+	if tickMin > quantumMin {
+		return tickMin
+	}
+	return quantumMin
+}
+
+// checkLowRate applies conf.LowRatePolicy to a requested rate that is below what HTB can enforce: the rate is
+// either raised to the minimum with a warning (the default), or rejected. A zero rate is not checked. Rates policed
+// by policeLowRate never get here; under the police policy, rates between its threshold and the minimum are raised.
+func checkLowRate(conf NetConf, direction string, rate uint64, buffer uint32, logger *log.Entry) (uint64, error) {
+	min := minHtbRate(conf.MTU, buffer)
+	if rate == 0 || rate >= min {
+		return rate, nil
+	}
+	switch conf.LowRatePolicy {
+	case "", LowRatePolicyAdjust, LowRatePolicyPolice:
+		logger.WithFields(log.Fields{
+			"direction": direction,
+			"requested": rate,
+			"minimum":   min,
+		}).Warn("Requested rate is too low to shape reliably, using the minimum instead")
+		return min, nil
+	case LowRatePolicyReject:
+		return 0, &ShapingError{
+			Code: ErrCodeRateTooLow,
+			Err:  fmt.Errorf("%s rate %d bit/s is below the minimum of %d bit/s HTB can enforce", direction, rate, min),
+			Hint: fmt.Sprintf("request at least %d bit/s, or set lowRatePolicy to %q to round small rates up", min, LowRatePolicyAdjust),
+		}
+	default:
+		return 0, fmt.Errorf("invalid lowRatePolicy %q, must be %q, %q or %q", conf.LowRatePolicy,
+			LowRatePolicyAdjust, LowRatePolicyReject, LowRatePolicyPolice)
+	}
+}
+
+// policeLowRate picks the packets per second a rate is policed to under the police policy, when it is below
+// conf.PoliceThreshold, or the lowest rate HTB can enforce if the threshold isn't set. It returns the rate left for
+// HTB to shape, zero if the rate is policed, and the packet rate, zero if it isn't. Packets are counted as full-sized,
+// so small packets get through at a lower bit rate than requested rather than a higher one.
+func policeLowRate(conf NetConf, rate uint64, buffer uint32) (uint64, uint64) {
+	if conf.LowRatePolicy != LowRatePolicyPolice || rate == 0 {
+		return rate, 0
+	}
+	threshold := conf.PoliceThreshold
+	if threshold == 0 {
+		threshold = minHtbRate(conf.MTU, buffer)
+	}
+	if rate >= threshold {
+		return rate, 0
+	}
+	mtu := conf.MTU
+	if mtu <= 0 {
+		mtu = defaultMTU
+	}
+	packetBits := uint64(mtu) * 8
+	pps := (rate + packetBits - 1) / packetBits
+	return 0, pps
+}
+
+// HTBPrio returns the HTB priority of the classes of a pod: latencyClassPrio in the low latency class, otherwise the
+// priority the cluster policy gives the pod's PriorityClass, no lower than bulkClassPrio.
+func HTBPrio(latencyClass string, classPriority uint32) uint32 {
+	if latencyClass == LatencyClassLow {
+		return latencyClassPrio
+	}
+	if classPriority < bulkClassPrio {
+		return bulkClassPrio
+	}
+	return classPriority
+}
+
+// SetShapingRates replaces the rate and ceil of the HTB classes on the host veth and IFB device of a container,
+// keeping the rest of the hierarchy in place. Rates and ceils are in bits per second; a device name may be empty to
+// leave that direction untouched. With separate family budgets, the IPv6 classes get the same rates. prio is the
+// HTB priority the classes keep, the leaf classes of a protocol split get their shares of the new rates, and those
+// of traffic classes their rates capped at them. The classes keep the buffers of bursts.
+func SetShapingRates(hostVethName, ifbName string, gen int, ingressRate, egressRate, ingressCeil, egressCeil uint64,
+	familyBudget string, prio uint32, split ProtocolSplit, classes []state.TrafficClass, bursts Bursts) error {
+	minors := []uint16{shaping.ClassMinor(gen)}
+	if familyBudget == IPFamilyBudgetSeparate {
+		minors = append(minors, shaping.ClassMinor(shaping.IPv6Generation(gen)))
+	}
+	if hostVethName != "" {
+		err := setGenerationRates(hostVethName, shaping.HostVethQdiscMajor, minors, ingressRate, ingressCeil,
+			bursts.ingress(ingressRate), prio, split, classesIn(classes, "ingress"))
+		if err != nil {
+			return err
+		}
+	}
+	if ifbName != "" {
+		return setGenerationRates(ifbName, shaping.IFBQdiscMajor, minors, egressRate, egressCeil,
+			bursts.egress(egressRate), prio, split, classesIn(classes, "egress"))
+	}
+	return nil
+}
+
+// setGenerationRates replaces the rate and ceil of the classes major:minor of linkName, for each of minors, and of
+// the leaf classes under them. The classes stay under the parent they were added under: a class with a parent
+// class gets ceil, and its parent, shared by minors, is set to it; one under the root qdisc has nothing to borrow
+// from, so its ceil is its rate.
+func setGenerationRates(linkName string, major uint16, minors []uint16, rate, ceil uint64, buffer htbBuffer,
+	prio uint32, split ProtocolSplit, classes []state.TrafficClass) error {
+	for i, minor := range minors {
+		classCeil := rate
+		parent := classParent(linkName, major, minor)
+		if parent != 0 && ceil > rate {
+			classCeil = ceil
+		}
+		if parent != 0 && i == 0 {
+			if err := replaceHtbClass(linkName, major, 0, parent, classCeil, classCeil, buffer, 0); err != nil {
+				return err
+			}
+		}
+		if err := replaceHtbClass(linkName, major, parent, minor, rate, classCeil, buffer, prio); err != nil {
+			return err
+		}
+		if err := setSplitRates(linkName, major, minor, rate, classCeil, buffer, prio, split); err != nil {
+			return err
+		}
+		if err := setClassRates(linkName, major, minor, rate, classCeil, buffer, prio, classes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// classParent returns the minor of the parent of class major:minor of linkName, or 0 if it is under the root qdisc
+// or can't be read.
+func classParent(linkName string, major, minor uint16) uint16 {
+	link, err := netlink.LinkByName(linkName)
+	if err != nil {
+		return 0
+	}
+	classes, err := netlink.ClassList(link, netlink.MakeHandle(major, 0))
+	if err != nil {
+		return 0
+	}
+	for _, c := range classes {
+		if c.Attrs().Handle == netlink.MakeHandle(major, minor) {
+			_, parent := netlink.MajorMinor(c.Attrs().Parent)
+			return parent
+		}
+	}
+	return 0
+}
+
+// RestoreIngressShaping rebuilds the ingress shaping of a container by replacing the root qdisc of its host veth.
+func RestoreIngressShaping(hostVethName string, gen int, rate, ceil uint64, latencyClass, leafQdisc string, classPriority uint32, nonIPPolicy, familyBudget, classifier, mirrorTo string,
+	split ProtocolSplit, classes []state.TrafficClass, bursts Bursts) error {
+	hostVeth, err := netlink.LinkByName(hostVethName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", hostVethName, err)
+	}
+	root := netlink.NewHtb(netlink.QdiscAttrs{
+		LinkIndex: hostVeth.Attrs().Index,
+		Handle:    netlink.MakeHandle(shaping.HostVethQdiscMajor, 0),
+		Parent:    netlink.HANDLE_ROOT,
+	})
+	if err = countNetlink("QdiscDel", func() error { return netlink.QdiscDel(root) }); err != nil {
+		tcLog.WithError(err).WithField("interface", hostVethName).Debug("No root qdisc to remove")
+	}
+	if err = setupIngressShaping(hostVeth, gen, rate, ceil, bursts.ingress(rate), latencyClass, leafQdisc, classPriority, nonIPPolicy, familyBudget, classifier, mirrorTo); err != nil {
+		return err
+	}
+	prio := HTBPrio(latencyClass, classPriority)
+	if err = splitGeneration(hostVethName, shaping.HostVethQdiscMajor, gen, rate, ceil, bursts.ingress(rate), prio, familyBudget, split); err != nil {
+		return err
+	}
+	return classGeneration(hostVethName, shaping.HostVethQdiscMajor, gen, rate, ceil, bursts.ingress(rate), prio, familyBudget,
+		classesIn(classes, "ingress"))
+}
+
+// RestoreEgressShaping rebuilds the egress shaping of a container whose IFB device has disappeared. The ingress
+// qdisc of the host veth still redirects to the old device, so it is removed and recreated along with the IFB.
+func RestoreEgressShaping(hostVethName, ifbName string, gen int, rate, ceil uint64, latencyClass, leafQdisc string, classPriority uint32, nonIPPolicy, familyBudget, classifier, mirrorTo string,
+	dscp *uint8, split ProtocolSplit, classes []state.TrafficClass, bursts Bursts) error {
+	hostVeth, err := netlink.LinkByName(hostVethName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", hostVethName, err)
+	}
+	ingress := &netlink.Ingress{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: hostVeth.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_INGRESS,
+		},
+	}
+	if err = countNetlink("QdiscDel", func() error { return netlink.QdiscDel(ingress) }); err != nil {
+		tcLog.WithError(err).WithField("interface", hostVethName).Debug("No ingress qdisc to remove")
+	}
+	if err = setupEgressShaping(hostVeth, ifbName, gen, rate, ceil, bursts.egress(rate), latencyClass, leafQdisc, classPriority, nonIPPolicy, familyBudget, classifier, mirrorTo, dscp); err != nil {
+		return err
+	}
+	prio := HTBPrio(latencyClass, classPriority)
+	if err = splitGeneration(ifbName, shaping.IFBQdiscMajor, gen, rate, ceil, bursts.egress(rate), prio, familyBudget, split); err != nil {
+		return err
+	}
+	return classGeneration(ifbName, shaping.IFBQdiscMajor, gen, rate, ceil, bursts.egress(rate), prio, familyBudget,
+		classesIn(classes, "egress"))
+}
+
+// ShapingDrift lists the parts of a container's shaping hierarchy that are missing, per direction.
+type ShapingDrift struct {
+	Ingress []string
+	Egress  []string
+}
+
+// Empty reports whether nothing has drifted.
+func (d ShapingDrift) Empty() bool {
+	return len(d.Ingress) == 0 && len(d.Egress) == 0
+}
+
+// CheckShaping compares the qdiscs, classes and filters on the host veth and IFB device of a container with the
+// hierarchy HostSideSetup programs. ingress is false if the container's ingress isn't limited, and ifbName is
+// empty if it has no IFB device because its egress isn't. An error is returned only if the host veth itself can't
+// be found. gen is the generation of the hierarchy, and qdisc the root qdisc of each direction as recorded.
+func CheckShaping(hostVethName, ifbName string, gen int, qdisc string, ingress bool) (ShapingDrift, error) {
+	drift := ShapingDrift{}
+	hostVeth, err := netlink.LinkByName(hostVethName)
+	if err != nil {
+		return drift, fmt.Errorf("failed to lookup %q: %v", hostVethName, err)
+	}
+	checkRoot := func(link netlink.Link, major uint16) []string {
+		if qdisc == QdiscTBF {
+			return checkTBF(link, major)
+		}
+		return checkHtb(link, major, gen)
+	}
+
+	if ingress {
+		drift.Ingress = checkRoot(hostVeth, shaping.HostVethQdiscMajor)
+	}
+	if ifbName == "" {
+		return drift, nil
+	}
+	hasIngressQdisc := false
+	if qdiscs, err := netlink.QdiscList(hostVeth); err == nil {
+		for _, q := range qdiscs {
+			if _, ok := q.(*netlink.Ingress); ok {
+				hasIngressQdisc = true
+			}
+		}
+	}
+	if !hasIngressQdisc {
+		drift.Egress = append(drift.Egress, "ingress qdisc missing on "+hostVethName)
+	} else if filters, err := netlink.FilterList(hostVeth, netlink.MakeHandle(0xffff, 0)); err != nil || len(filters) == 0 {
+		drift.Egress = append(drift.Egress, "redirect filter missing on "+hostVethName)
+	}
+
+	ifb, err := netlink.LinkByName(ifbName)
+	if err != nil {
+		drift.Egress = append(drift.Egress, "IFB device "+ifbName+" missing")
+		return drift, nil
+	}
+	drift.Egress = append(drift.Egress, checkRoot(ifb, shaping.IFBQdiscMajor)...)
+	return drift, nil
+}
+
+// checkHtb returns what is missing from the root HTB qdisc, shaping class of generation gen and catch-all filter
+// on a device.
+func checkHtb(link netlink.Link, major uint16, gen int) []string {
+	name := link.Attrs().Name
+	qdiscHandle := netlink.MakeHandle(major, 0)
+	var problems []string
+
+	hasQdisc := false
+	if qdiscs, err := netlink.QdiscList(link); err == nil {
+		for _, q := range qdiscs {
+			if _, ok := q.(*netlink.Htb); ok && q.Attrs().Handle == qdiscHandle && q.Attrs().Parent == netlink.HANDLE_ROOT {
+				hasQdisc = true
+			}
+		}
+	}
+	if !hasQdisc {
+		return append(problems, "root HTB qdisc missing on "+name)
+	}
+
+	hasClass := false
+	if classes, err := netlink.ClassList(link, qdiscHandle); err == nil {
+		for _, c := range classes {
+			if c.Attrs().Handle == netlink.MakeHandle(major, shaping.ClassMinor(gen)) {
+				hasClass = true
+			}
+		}
+	}
+	if !hasClass {
+		problems = append(problems, "HTB class missing on "+name)
+	}
+	if filters, err := netlink.FilterList(link, qdiscHandle); err != nil || len(filters) == 0 {
+		problems = append(problems, "classifier filter missing on "+name)
+	}
+	return problems
+}
+
+// replaceHtbClass changes the rate and ceil of class major:minor under class major:parent, where parent 0 is the
+// root qdisc.
+func replaceHtbClass(linkName string, major, parent, minor uint16, rate, ceil uint64, buffer htbBuffer, prio uint32) error {
+	link, err := netlink.LinkByName(linkName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", linkName, err)
+	}
+	class := netlink.NewHtbClass(netlink.ClassAttrs{
+		LinkIndex: link.Attrs().Index,
+		Parent:    netlink.MakeHandle(major, parent),
+		Handle:    netlink.MakeHandle(major, minor),
+	}, netlink.HtbClassAttrs{
+		Rate:    rate,
+		Ceil:    ceil,
+		Buffer:  buffer.buffer,
+		Cbuffer: buffer.cbuffer,
+		Prio:    prio,
+	})
+	if err = shaping.ReplaceClass(class); err != nil {
+		return fmt.Errorf("failed to replace HTB class on %q: %v", linkName, err)
+	}
+	return nil
+}
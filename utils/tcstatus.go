@@ -0,0 +1,215 @@
+package utils
+
+import (
+	"fmt"
+
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/projectcalico/cni-plugin/state"
+	"github.com/vishvananda/netlink"
+)
+
+// TCStatus is the tc state of the devices shaping a pod, as the kernel has it, next to the rates recorded for it.
+type TCStatus struct {
+	ContainerID string `json:"containerID"`
+	Workload    string `json:"workload"`
+	ShapingMode string `json:"shapingMode,omitempty"`
+	// IngressRate and EgressRate are the recorded rates of the pod in bits per second, zero if unlimited.
+	IngressRate uint64     `json:"ingressRate"`
+	EgressRate  uint64     `json:"egressRate"`
+	Devices     []TCDevice `json:"devices"`
+}
+
+// TCDevice is the tc state of a device shaping a pod in a direction. A device that doesn't exist is Missing.
+type TCDevice struct {
+	Name      string `json:"name"`
+	Direction string `json:"direction"`
+	Missing   bool   `json:"missing,omitempty"`
+	// The counters of the device: what it transmitted is what its root qdisc let through.
+	TxBytes   uint64 `json:"txBytes"`
+	TxPackets uint64 `json:"txPackets"`
+	TxDropped uint64 `json:"txDropped"`
+
+	Qdiscs  []TCQdisc  `json:"qdiscs"`
+	Classes []TCClass  `json:"classes"`
+	Filters []TCFilter `json:"filters"`
+}
+
+// TCQdisc is a qdisc of a device. Rate is only known for TBF qdiscs, in bits per second.
+type TCQdisc struct {
+	Kind   string `json:"kind"`
+	Handle string `json:"handle"`
+	Parent string `json:"parent"`
+	Rate   uint64 `json:"rate,omitempty"`
+}
+
+// TCClass is a class of a device with its counters. Rate and Ceil are only known for HTB classes, in bits per second.
+type TCClass struct {
+	Kind       string `json:"kind"`
+	Handle     string `json:"handle"`
+	Parent     string `json:"parent"`
+	Rate       uint64 `json:"rate,omitempty"`
+	Ceil       uint64 `json:"ceil,omitempty"`
+	Bytes      uint64 `json:"bytes"`
+	Packets    uint64 `json:"packets"`
+	Drops      uint64 `json:"drops"`
+	Overlimits uint64 `json:"overlimits"`
+}
+
+// TCFilter is a filter of a device. ClassID is the class it sends the packets it matches to, if any.
+type TCFilter struct {
+	Kind     string `json:"kind"`
+	Parent   string `json:"parent"`
+	Priority uint16 `json:"priority"`
+	Protocol uint16 `json:"protocol"`
+	ClassID  string `json:"classID,omitempty"`
+}
+
+// ReadTCStatus reads the tc state of the devices shaping the pod of r. On a shared uplink only the classes of the
+// pod, and the filters sending packets to them, are read, as the rest belong to other pods. Pods shaped in their
+// network namespace have their interface read there.
+func ReadTCStatus(r *state.Record) (*TCStatus, error) {
+	status := &TCStatus{
+		ContainerID: r.ContainerID,
+		Workload:    r.Workload,
+		ShapingMode: r.ShapingMode,
+		IngressRate: r.IngressRate,
+		EgressRate:  r.EgressRate,
+	}
+	var devices []struct{ name, direction string }
+	var keep func(handle uint32) bool
+	switch {
+	case r.ShapingMode == ShapingModeContainer:
+		err := ns.WithNetNSPath(r.Netns, func(ns.NetNS) error {
+			d, err := readTCDevice(r.IfName, "egress", nil)
+			if err == nil {
+				status.Devices = append(status.Devices, *d)
+			}
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		return status, nil
+	case r.ShapingMode == ShapingModeNIC:
+		devices = append(devices, struct{ name, direction string }{r.NIC, "egress"})
+		if !r.HostNetwork {
+			devices = append(devices, struct{ name, direction string }{nicIFBName(r.NIC), "ingress"})
+		}
+		keep = func(handle uint32) bool {
+			major, minor := netlink.MajorMinor(handle)
+			return major == nicQdiscMajor && minor != 0 && (minor == r.NICClassMinor || minor == r.NICParentMinor)
+		}
+	default:
+		// The host veth shapes what the pod receives and the IFB device what it sends.
+		if r.HostVeth != "" {
+			devices = append(devices, struct{ name, direction string }{r.HostVeth, "ingress"})
+		}
+		if r.IFB != "" {
+			devices = append(devices, struct{ name, direction string }{r.IFB, "egress"})
+		}
+	}
+	for _, dev := range devices {
+		d, err := readTCDevice(dev.name, dev.direction, keep)
+		if err != nil {
+			return nil, err
+		}
+		status.Devices = append(status.Devices, *d)
+	}
+	return status, nil
+}
+
+// readTCDevice reads the qdiscs, classes and filters of the device name. If keep is set, only the classes it keeps,
+// and the filters sending packets to them, are read.
+func readTCDevice(name, direction string, keep func(handle uint32) bool) (*TCDevice, error) {
+	d := &TCDevice{Name: name, Direction: direction}
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			d.Missing = true
+			return d, nil
+		}
+		return nil, fmt.Errorf("failed to lookup %q: %v", name, err)
+	}
+	if stats := link.Attrs().Statistics; stats != nil {
+		d.TxBytes, d.TxPackets, d.TxDropped = stats.TxBytes, stats.TxPackets, stats.TxDropped
+	}
+
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list qdiscs of %q: %v", name, err)
+	}
+	for _, q := range qdiscs {
+		attrs := q.Attrs()
+		tq := TCQdisc{Kind: q.Type(), Handle: netlink.HandleStr(attrs.Handle), Parent: netlink.HandleStr(attrs.Parent)}
+		if tbf, ok := q.(*netlink.Tbf); ok {
+			tq.Rate = tbf.Rate * 8
+		}
+		d.Qdiscs = append(d.Qdiscs, tq)
+
+		// The filters of a clsact qdisc hang off its hooks rather than its handle.
+		parents := []uint32{attrs.Handle}
+		if q.Type() == "clsact" {
+			parents = []uint32{netlink.HANDLE_MIN_INGRESS, netlink.HANDLE_MIN_EGRESS}
+		}
+		for _, parent := range parents {
+			filters, err := netlink.FilterList(link, parent)
+			if err != nil {
+				return nil, fmt.Errorf("failed to list filters of %q: %v", name, err)
+			}
+			for _, f := range filters {
+				tf := TCFilter{
+					Kind:     f.Type(),
+					Parent:   netlink.HandleStr(f.Attrs().Parent),
+					Priority: f.Attrs().Priority,
+					Protocol: f.Attrs().Protocol,
+				}
+				classID := filterClassID(f)
+				if classID != 0 {
+					tf.ClassID = netlink.HandleStr(classID)
+				}
+				if keep != nil && !keep(classID) {
+					continue
+				}
+				d.Filters = append(d.Filters, tf)
+			}
+		}
+	}
+
+	classes, err := netlink.ClassList(link, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list classes of %q: %v", name, err)
+	}
+	for _, c := range classes {
+		attrs := c.Attrs()
+		if keep != nil && !keep(attrs.Handle) {
+			continue
+		}
+		tc := TCClass{Kind: c.Type(), Handle: netlink.HandleStr(attrs.Handle), Parent: netlink.HandleStr(attrs.Parent)}
+		if htb, ok := c.(*netlink.HtbClass); ok {
+			tc.Rate, tc.Ceil = htb.Rate*8, htb.Ceil*8
+		}
+		if stats := attrs.Statistics; stats != nil && stats.Basic != nil {
+			tc.Bytes, tc.Packets = stats.Basic.Bytes, uint64(stats.Basic.Packets)
+			if stats.Queue != nil {
+				tc.Drops, tc.Overlimits = uint64(stats.Queue.Drops), uint64(stats.Queue.Overlimits)
+			}
+		}
+		d.Classes = append(d.Classes, tc)
+	}
+	return d, nil
+}
+
+// filterClassID returns the class filter f sends the packets it matches to, or zero if it doesn't classify them.
+func filterClassID(f netlink.Filter) uint32 {
+	switch f := f.(type) {
+	case *netlink.U32:
+		return f.ClassId
+	case *netlink.Fw:
+		return f.ClassId
+	case *netlink.BpfFilter:
+		return f.ClassId
+	case *netlink.MatchAll:
+		return f.ClassId
+	}
+	return 0
+}
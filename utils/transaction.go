@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+// setupTransaction records what the setup of a container created, so that a step failing part way through doesn't
+// leave the resources of the steps before it behind for a retry to trip over. Resources are undone in the reverse
+// order they were created in, as later ones may depend on earlier ones.
+type setupTransaction struct {
+	logger *log.Entry
+	steps  []undoStep
+}
+
+// undoStep removes a resource the setup created.
+type undoStep struct {
+	resource string
+	undo     func() error
+}
+
+func newSetupTransaction(logger *log.Entry) *setupTransaction {
+	return &setupTransaction{logger: logger}
+}
+
+// created records that the setup created resource, which undo removes.
+func (t *setupTransaction) created(resource string, undo func() error) {
+	t.steps = append(t.steps, undoStep{resource, undo})
+}
+
+// rollback removes every resource recorded, latest first. Failures are logged rather than returned, so that one
+// resource that can't be removed doesn't keep the others around; the error of the setup is what the caller reports.
+func (t *setupTransaction) rollback() {
+	for i := len(t.steps) - 1; i >= 0; i-- {
+		step := t.steps[i]
+		if err := step.undo(); err != nil {
+			t.logger.WithError(err).WithField("resource", step.resource).Warn("Failed to roll back")
+		} else {
+			t.logger.WithField("resource", step.resource).Info("Rolled back")
+		}
+	}
+	t.steps = nil
+}
+
+// deleteLinkNamed returns the undo step deleting the link name, which also removes its routes, neighbour entries,
+// qdiscs and per-interface sysctls. A link that is already gone is not an error.
+func deleteLinkNamed(name string) func() error {
+	return func() error {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			return nil
+		}
+		if err = countNetlink("LinkDel", func() error { return netlink.LinkDel(link) }); err != nil {
+			return fmt.Errorf("failed to delete %q: %v", name, err)
+		}
+		return nil
+	}
+}
+
+// deleteLinkIn returns the undo step deleting the link name in the network namespace at netnsPath.
+func deleteLinkIn(netnsPath, name string) func() error {
+	return func() error {
+		return ns.WithNetNSPath(netnsPath, func(ns.NetNS) error { return deleteLinkNamed(name)() })
+	}
+}
+
+// deleteRoute returns the undo step deleting the route to dst on the link with index linkIndex.
+func deleteRoute(linkIndex int, dst net.IPNet) func() error {
+	return func() error {
+		return countNetlink("RouteDel", func() error {
+			return netlink.RouteDel(&netlink.Route{LinkIndex: linkIndex, Scope: netlink.SCOPE_LINK, Dst: &dst})
+		})
+	}
+}
+
+// deleteProxyNDP returns the undo step deleting the proxy NDP entry for gw on the link with index linkIndex.
+func deleteProxyNDP(linkIndex int, gw net.IP) func() error {
+	return func() error {
+		return countNetlink("NeighDel", func() error {
+			return netlink.NeighDel(&netlink.Neigh{LinkIndex: linkIndex, Family: netlink.FAMILY_V6, Flags: netlink.NTF_PROXY, IP: gw})
+		})
+	}
+}
@@ -41,6 +41,20 @@ type NetworkInfo struct {
 	} `json:"labels,omitempty"`
 }
 
+// RuntimeConfig is what the runtime passes for the capabilities of the plugin.
+type RuntimeConfig struct {
+	Bandwidth *BandwidthEntry `json:"bandwidth,omitempty"`
+}
+
+// BandwidthEntry is the bandwidth of a pod as the runtime passes it, as for the upstream bandwidth plugin: rates in
+// bits per second and bursts in bits, zero meaning unset.
+type BandwidthEntry struct {
+	IngressRate  uint64 `json:"ingressRate"`
+	IngressBurst uint64 `json:"ingressBurst"`
+	EgressRate   uint64 `json:"egressRate"`
+	EgressBurst  uint64 `json:"egressBurst"`
+}
+
 // NetConf stores the common network config for Calico CNI plugin
 type NetConf struct {
 	CNIVersion string `json:"cniVersion,omitempty"`
@@ -69,6 +83,315 @@ type NetConf struct {
 	EtcdKeyFile    string     `json:"etcd_key_file"`
 	EtcdCertFile   string     `json:"etcd_cert_file"`
 	EtcdCaCertFile string     `json:"etcd_ca_cert_file"`
+	// StateDir holds the shaping records of containers, which DEL and CHECK find their devices by, in
+	// /var/lib/cni_flow_control if empty. It can be put with the runtime's CNI cache, like
+	// /var/lib/cni/cni_flow_control, to be cleaned up along with it.
+	StateDir string `json:"state_dir"`
+
+	// DNS is returned in the result for runtimes that configure the container's resolver from it. Fields set here
+	// take precedence over those returned by IPAM.
+	DNS types.DNS `json:"dns"`
+
+	// LogLevels overrides LogLevel for individual subsystems ("datapath", "tc", "ipam"), e.g. {"tc": "debug"} to
+	// trace tc programming alone.
+	LogLevels map[string]string `json:"logLevels,omitempty"`
+	// LogFile is the file the logs are appended to instead of stderr, and LogFormat their format: "text" (default),
+	// or "json" for log collectors.
+	LogFile   string `json:"log_file"`
+	LogFormat string `json:"log_format"`
+
+	// LowRatePolicy decides what happens to rates too low for HTB to enforce: "adjust" (default), "reject", or
+	// "police" to drop the packets over a packets-per-second limit instead of shaping. Rates below PoliceThreshold
+	// bits per second are policed, or below the lowest rate HTB can enforce if it is zero.
+	LowRatePolicy   string `json:"lowRatePolicy"`
+	PoliceThreshold uint64 `json:"policeThreshold"`
+
+	// LinkSpeedPolicy decides what happens to rates above the speed of the node's uplink (NICName, or the interface
+	// of the default route), which can never be reached: "ignore" (default), "clamp" to the link speed, or "reject".
+	LinkSpeedPolicy string `json:"linkSpeedPolicy"`
+
+	// LatencyClass "low" gives the pod a small strict-priority class with an fq_codel leaf, for workloads where
+	// latency rather than throughput is the objective.
+	LatencyClass string `json:"latencyClass"`
+
+	// LeafQdisc is the qdisc attached under the HTB classes of pods shaped on their veth, to keep latency low for
+	// interactive traffic inside the limit: "fq_codel", "sfq" or "pfifo". By default the classes have no leaf
+	// qdisc, and a bursty flow can fill the queue of the whole limit. Pods in latencyClass "low" get fq_codel.
+	LeafQdisc string `json:"leaf_qdisc"`
+
+	// Naming selects how host veths and IFB devices are named. HostVethPrefix and IFBPrefix set its prefixes,
+	// e.g. to keep the host veths of pods apart from those of a Calico install on the same nodes, and select the
+	// hash strategy unless it sets another.
+	Naming         NamingConf `json:"naming"`
+	HostVethPrefix string     `json:"host_veth_prefix"`
+	IFBPrefix      string     `json:"ifb_prefix"`
+
+	// IPFamilyBudget "separate" gives the IPv4 and IPv6 traffic of a pod each the full limit of a direction, in
+	// classes of their own. By default ("shared") both families are classified into one class per direction.
+	IPFamilyBudget string `json:"ipFamilyBudget"`
+
+	// ProtocolSplit guarantees shares of the limit of each direction to the pod's TCP and UDP traffic, as sibling
+	// classes that borrow from each other, e.g. {"tcp": 70, "udp": 20} to protect TCP from the pod's own UDP floods.
+	// Only pods shaped on their veth are split.
+	ProtocolSplit *ProtocolSplit `json:"protocolSplit,omitempty"`
+	// Classes shape the traffic of a pod matching each of them apart from the rest of the direction, with a rate
+	// and ceil of their own, e.g. to give the pod's traffic to a database a different limit than the rest of its
+	// egress. Traffic matching none of them is shaped in a default class. Only pods shaped on their veth get
+	// classes, in the directions they are limited in.
+	Classes []TrafficClass `json:"classes,omitempty"`
+	// ClusterCIDRs are the pod, service and node CIDRs of the cluster. ClusterBandwidth and ExternalBandwidth shape
+	// the traffic of pods with peers in them, and with any other peer, in classes of their own, e.g. to cap the
+	// egress of pods to the internet while leaving the traffic between pods fast. They follow the classes of the
+	// Classes option, and are only set up like them.
+	ClusterCIDRs      []string       `json:"cluster_cidrs,omitempty"`
+	ClusterBandwidth  *PeerBandwidth `json:"cluster_bandwidth,omitempty"`
+	ExternalBandwidth *PeerBandwidth `json:"external_bandwidth,omitempty"`
+	// DSCP, from 0 to 63, is marked on the IP traffic leaving pods shaped on their veth, so that the underlay
+	// network can prioritize it like the node does. Egress classes can set a DSCP of their own.
+	DSCP *uint8 `json:"dscp,omitempty"`
+	// Classifier is how the veth shaping of pods classifies their traffic: "u32" (default) with catch-all u32
+	// filters, "matchall" with matchall ones, which don't depend on how the kernel treats u32 keys of empty mask, or
+	// "fwmark", which also lets ingress classes match the firewall mark of traffic, for iptables and ipsets to steer
+	// flows into them.
+	Classifier string `json:"classifier"`
+	// MirrorTo is a host interface, e.g. a VXLAN device towards an analysis host, that the filters of the veth
+	// shaping of pods copy their traffic to, in the directions they are limited in, for it to be inspected without
+	// touching the pods. The flowcontrol.cni/mirror-to annotation sets it for a pod.
+	MirrorTo string `json:"mirror_to,omitempty"`
+	// Enforcement is how the veth of pods enforces their rates: "shape" (default) queues what exceeds them in HTB
+	// classes or TBF qdiscs, and "police" drops it at once, for workloads that would rather see loss than the round
+	// trip times of a queue hiding overload.
+	Enforcement string `json:"enforcement,omitempty"`
+
+	// SingleClassQdisc is the qdisc shaping pods whose veth shaping needs a single class per direction and no
+	// filters beyond the catch-alls: "tbf" (default), cheaper and simpler, or "htb" to always build HTB classes, which
+	// the agent can later swap for settings that need them.
+	SingleClassQdisc string `json:"singleClassQdisc"`
+	// Shaper picks the qdisc shaping every pod on its veth: "htb" always builds HTB classes and filters, and "tbf"
+	// attaches a TBF qdisc to the host veth for ingress and to the IFB device for egress, with no classes or filters
+	// to fail, and rejects the options that need them. Unset, SingleClassQdisc decides.
+	Shaper string `json:"shaper"`
+	// Backend "ebpf" shapes every pod on its veth with BPF programs on a clsact qdisc of the host veth instead of
+	// qdiscs and an IFB device: traffic entering the pod is paced by departure time for an fq qdisc, and traffic
+	// leaving it policed. It enforces a single rate per direction, so it rejects the options that need classes or
+	// filters. Pods fall back to HTB on kernels that can't run the programs. Unset, Shaper decides.
+	Backend string `json:"backend"`
+	// ShapeInContainer shapes pods inside their network namespace, on the container end of their veth, for hosts
+	// where IFB devices can't be created or the qdiscs of host-side devices can't be touched: traffic leaving the
+	// pod is shaped by a qdisc at the root of the container end, and traffic entering it policed where it arrives.
+	// It rejects the options that divide traffic into classes.
+	ShapeInContainer bool `json:"shape_in_container,omitempty"`
+	// LazyIFB only gives an IFB device, and the ingress qdisc redirecting to it, to pods limited in ingress: pods
+	// with an egress limit only are shaped on the container end of their veth instead, as with ShapeInContainer,
+	// unless they have options that need classes. It saves a device and its handles per egress-only pod.
+	LazyIFB bool `json:"lazy_ifb,omitempty"`
+
+	// IngressBurst and EgressBurst are how many bytes each direction of a pod shaped on its veth may send back to
+	// back before its rate applies, by default 3200000 for ingress and 32768 for egress. Cbuffer is how many the HTB
+	// classes may send back to back above their rate, up to their ceil; by default what the ceil sends in a timer
+	// tick. Each must be at least the MTU.
+	IngressBurst uint32 `json:"ingress_burst"`
+	EgressBurst  uint32 `json:"egress_burst"`
+	Cbuffer      uint32 `json:"cbuffer"`
+	// IngressRate and EgressRate are what each direction of a pod without a bandwidth annotation, or a rate passed
+	// by the runtime, is guaranteed, as bandwidths like the annotations, for clusters that don't annotate their pods.
+	// Each must be at most the ceil of its direction. A rate below the ceil only guarantees anything where classes
+	// borrow from the same parent: between the traffic classes of a pod, and between pods in the nic shaping mode. A
+	// pod shaped on its own veth with a single class has its parent class, and so its ceil, to itself.
+	IngressRate string `json:"ingress_rate,omitempty"`
+	EgressRate  string `json:"egress_rate,omitempty"`
+	// IngressCeil and EgressCeil are the most each direction of a pod may send by borrowing bandwidth left idle, as
+	// bandwidths like the annotations, whose rates are then what the pod is guaranteed as far as the rates above say.
+	// Pods override them with the flowcontrol.cni/ingress-ceil and flowcontrol.cni/egress-ceil annotations.
+	IngressCeil string `json:"ingress_ceil"`
+	EgressCeil  string `json:"egress_ceil"`
+	// BandwidthSchedule gives pods other bandwidths at times of the day, which the agent switches their classes to
+	// and back at the boundaries of the windows, so that batch workloads get more overnight, say. An entry with a
+	// default gives pods that bandwidth in both directions outside the windows, in place of none.
+	BandwidthSchedule []ScheduleEntry `json:"bandwidth_schedule,omitempty"`
+
+	// VerifyShaping re-reads the shaping of the pod from the kernel once ADD has programmed it and compares it with
+	// what was intended: "off" (default), "strict" to fail the ADD on a mismatch, or "degrade" to only mark the pod
+	// degraded, for the agent to report and repair.
+	VerifyShaping string `json:"verifyShaping"`
+	// StrictShaping decides what a failure to program the shaping of a pod does: fail the ADD (true, the default),
+	// or only log it and bring the pod up unshaped, recorded as degraded, or as unsupported if the node can't shape
+	// at all. Either way what was programmed before the failure is rolled back.
+	StrictShaping *bool `json:"strict_shaping,omitempty"`
+	// Takeover has the plugin replace the upstream bandwidth plugin when it finds it chained in the CNI
+	// configuration of CNIConfDir, DefaultCNIConfDir if empty, or what it set up for a pod: it is removed from the
+	// chain, and its static rates shape the pods without annotations. Without it finding the bandwidth plugin fails
+	// the ADD, as it would fail on the qdiscs of this plugin.
+	Takeover   bool   `json:"takeover,omitempty"`
+	CNIConfDir string `json:"cni_conf_dir,omitempty"`
+
+	// Capabilities are the capabilities of the plugin enabled in the conflist. With "bandwidth" enabled, the runtime
+	// passes the rates of the kubernetes.io/ingress-bandwidth and egress-bandwidth annotations of pods in
+	// RuntimeConfig, and they take precedence over the annotations read from the API and the configured bursts.
+	Capabilities  map[string]bool `json:"capabilities,omitempty"`
+	RuntimeConfig RuntimeConfig   `json:"runtimeConfig,omitempty"`
+	// Bandwidth is the bandwidth of the interface the configuration attaches, in the format of RuntimeConfig, for
+	// attachments such as those of Multus network-attachment definitions, whose secondary interfaces the
+	// bandwidth annotations of pods, which apply to their primary one, don't describe. The rates the runtime passes
+	// take precedence.
+	Bandwidth *BandwidthEntry `json:"bandwidth,omitempty"`
+
+	// ShapingMode "nic" shapes pods on the node's uplink instead of their host veth, for clusters where traffic
+	// bypasses veth-level shaping. NICName is the uplink; the interface of the default route if empty.
+	ShapingMode string `json:"shapingMode"`
+	NICName     string `json:"nicName"`
+	// NICOverflow decides what happens to pods once every class of the uplink is taken: "reject" (default), or
+	// "veth" to shape them on their own veth and IFB device instead.
+	NICOverflow string `json:"nicOverflow"`
+	// NICHierarchy nests the classes of pods on the uplink under a node root class and group classes they borrow
+	// from, instead of leaving them flat under the root qdisc.
+	NICHierarchy *NICHierarchy `json:"nicHierarchy,omitempty"`
+	// HostInterface and NodeTotalBandwidth are a shorthand for the above: HostInterface shapes pods on it with the
+	// nic shaping mode, one class each, and NodeTotalBandwidth, like "10G", is the rate of the node root class of
+	// their hierarchy, which keeps pods from saturating the uplink together. Without a nicHierarchy, the hierarchy
+	// has no groups.
+	HostInterface      string `json:"host_interface"`
+	NodeTotalBandwidth string `json:"node_total_bandwidth"`
+	// QoSPriorities maps the QoS classes of pods, "Guaranteed", "Burstable" and "BestEffort", to the HTB priority of
+	// their classes on the uplink, 0 being the highest, and LabelPriorities pod labels, as "key=value", to one, which
+	// takes precedence. Under contention the spare bandwidth of the hierarchy goes to the pods of the higher
+	// priorities first, the others borrowing what they leave up to their ceils. They need nicHierarchy, and the
+	// cluster policy overrides them for the pods it gives a class priority.
+	QoSPriorities   map[string]uint32 `json:"qosPriorities,omitempty"`
+	LabelPriorities map[string]uint32 `json:"labelPriorities,omitempty"`
+	// NICOffload also polices the traffic to each pod on the uplink in the uplink's hardware, with flower filters
+	// that skip software, on NICs that support it. Pods on NICs that refuse the filters are shaped in software as
+	// without it.
+	NICOffload bool `json:"nicOffload"`
+	// NFTablesFallback false fails the ADD of limited pods on kernels that can't shape with tc, instead of policing
+	// their rates with nftables (shapingMode "nftables"). Defaults to true.
+	NFTablesFallback *bool `json:"nftablesFallback,omitempty"`
+
+	// LabelSource reads the rates of containers from their labels in Docker or containerd, for containers started
+	// outside Kubernetes that have no bandwidth annotations.
+	LabelSource *LabelSource `json:"labelSource,omitempty"`
+	// Hooks are commands run and webhooks notified with the shaping of pods once ADD applies it and DEL removes it.
+	Hooks *Hooks `json:"hooks,omitempty"`
+
+	// OTLPTracesEndpoint is the OTLP/HTTP endpoint spans of ADD, DEL and CHECK are exported to, e.g.
+	// http://127.0.0.1:4318/v1/traces. Tracing is disabled if neither it nor OTEL_EXPORTER_OTLP_TRACES_ENDPOINT is set.
+	OTLPTracesEndpoint string `json:"otlp_traces_endpoint"`
+	// Sysctls are extra kernel parameters set when configuring the host veth, in sysctl(8)'s dotted syntax, after
+	// the ones the plugin sets. The component IFNAME is replaced by the host veth's name, e.g.
+	// {"net.ipv4.conf.IFNAME.arp_ignore": "1", "net.ipv6.conf.IFNAME.accept_ra": "0"}.
+	Sysctls map[string]string `json:"sysctls,omitempty"`
+	// ManageSysctls false leaves the kernel parameters and proxy NDP entries of the host veth alone, for when a
+	// plugin chained before this one owns the pod's connectivity and configures them itself. Sysctls must then be
+	// empty. Defaults to true.
+	ManageSysctls *bool `json:"manageSysctls,omitempty"`
+	// NeighTiming tunes the proxy ARP delay and neighbour discovery timings of the host veth, within validated
+	// ranges. Sysctls set the same keys without validation and win over it.
+	NeighTiming *NeighTiming `json:"neighTiming,omitempty"`
+	// RPFilter manages the reverse path filter of the host veth, and optionally of all interfaces. Left alone if
+	// unset.
+	RPFilter *RPFilter `json:"rpFilter,omitempty"`
+	// ProxyARP false leaves proxy ARP off on the host veth, for environments that must not enable it on host
+	// interfaces; the gateway of the pod must then be answered for some other way. Defaults to true.
+	ProxyARP *bool `json:"proxyARP,omitempty"`
+	// Forwarding false leaves IP forwarding of the host veth to the defaults of the host, for hosts that enable it
+	// globally or must not enable it per interface. Defaults to true.
+	Forwarding *bool `json:"forwarding,omitempty"`
+
+	// CalicoCompat makes the plugin leave exactly the artifacts calico-cni would: the same interfaces, result and
+	// workload endpoint, without any shaping, shaping records or journal entries.
+	CalicoCompat bool `json:"calico_compat"`
+
+	// ConntrackMark stamps the connections of each pod with a conntrack mark derived from its container ID, using
+	// nftables, so that other host subsystems can tell which pod a flow belongs to. The mark is in its state record.
+	ConntrackMark bool `json:"conntrackMark"`
+
+	// NonIPPolicy is what happens to traffic of shaped pods that isn't IP, such as ARP storms or custom ethertypes:
+	// "unshaped" (default), "shaped" into the pod's class, or "drop".
+	NonIPPolicy string `json:"nonIPPolicy"`
+
+	// NetNSWaitTimeout is how long ADD waits for the container's network namespace to become available, as a
+	// duration such as "5s". The runtime can call the plugin before the namespace is mounted. Defaults to
+	// DefaultNetNSWaitTimeout; "0s" fails immediately.
+	NetNSWaitTimeout string `json:"netnsWaitTimeout"`
+
+	// SlowNetlinkThreshold is how long a single netlink operation may take before it is logged as slow and counted
+	// in flowcontrol_netlink_slow_operations_total, as a duration such as "500ms", to catch nodes where rtnetlink
+	// contention degrades pod startup. Defaults to DefaultSlowNetlinkThreshold; "0s" disables the reporting.
+	SlowNetlinkThreshold string `json:"slowNetlinkThreshold"`
+
+	// HostVethMAC gives each host veth a deterministic MAC derived from the pod UID, for fabrics such as EVPN that
+	// need stable host-side MACs. Both MACs are then reported in the result's interfaces.
+	HostVethMAC bool `json:"hostVethMAC"`
+
+	// Offloads turns offload features of both ends of the veth pair on or off, by their ethtool(8) names, e.g.
+	// {"tx-checksumming": false} for encapsulations that mishandle partial checksums, or {"generic-segmentation-offload":
+	// false} so that shaping sees packets of their wire size rather than large segments.
+	Offloads map[string]bool `json:"offloads,omitempty"`
+
+	// TxQLen is the transmit queue length of both ends of the veth pair, DefaultTxQLen if unset. Pods limited to a
+	// few Mbit/s are better off with a short queue, or none with 0, as a full default queue holds seconds of their
+	// traffic. Accurate shaping of such low rates also needs generic-segmentation-offload turned off in Offloads.
+	TxQLen *int `json:"txqlen,omitempty"`
+	// NumTxQueues and NumRxQueues are the numbers of transmit and receive queues of the veth pair, for pods whose
+	// traffic is spread over several CPUs. Left to the kernel if zero.
+	NumTxQueues int `json:"num_tx_queues,omitempty"`
+	NumRxQueues int `json:"num_rx_queues,omitempty"`
+
+	// ProgramHostRoutes false leaves out the /32 and /128 routes to the pod's addresses through its host veth, for
+	// when a plugin chained before this one or BGP already routes them. Shaping doesn't depend on them. Defaults to
+	// true.
+	ProgramHostRoutes *bool `json:"programHostRoutes,omitempty"`
+	// HostNetNS is the path of the network namespace the host veths, IFB devices and tc state of pods are created
+	// in, e.g. /proc/1/ns/net, for when the plugin runs in a nested namespace, as in kind or nested runtimes, rather
+	// than in the host's. Defaults to the plugin's own namespace.
+	HostNetNS string `json:"hostNetns"`
+	// DefaultRoute false leaves out the default routes through the host the container gets for each family its IPAM
+	// result has no default route for, for deployments where IPAM supplies the routes. Defaults to true.
+	DefaultRoute *bool `json:"defaultRoute,omitempty"`
+	// Routes are added in the container with those of the IPAM result, as {"dst": "10.0.0.0/8", "gw": "10.1.0.1"},
+	// each through its gw or, without one, the next hop of the default route of its family. A default route among
+	// them replaces the one the container would get.
+	Routes []*types.Route `json:"routes,omitempty"`
+	// IPAMGateway routes the container through the gateways of the IPAM result, which the host answers for, rather
+	// than the dummy 169.254.1.1 and the link-local address of the host veth. The bridge and slave modes always do.
+	IPAMGateway bool `json:"ipamGateway"`
+	// SendGARP announces the addresses of the container once it is set up, with a gratuitous ARP for each IPv4 one
+	// and an unsolicited neighbour advertisement for each IPv6 one, so that pods rescheduled with the addresses of
+	// earlier ones are reachable at once rather than once the neighbour caches pointing at the old ones expire.
+	SendGARP bool `json:"send_garp"`
+	// Mode is how containers are attached: "ptp" (default) gives each a veth the host routes to, "bridge" a veth
+	// that is a port of Bridge, whose addresses are the IPAM gateways, and "ipvlan" and "macvlan" a slave device of
+	// Master instead of a veth. Pods are shaped on their host veth in the veth modes, and with the nic shaping mode
+	// on Master in the slave modes, which have no host-side device of their own.
+	Mode string `json:"mode"`
+	// Bridge is the bridge of the bridge mode, created if missing. Defaults to DefaultBridge.
+	Bridge string `json:"bridge"`
+	// Master is the interface the slave devices of the ipvlan and macvlan modes are created on. Defaults to nicName,
+	// or the interface of the default route.
+	Master string `json:"master"`
+
+	// DNSRateLimit, ICMPRateLimit and ICMPv6RateLimit are the rates in packets per second the pod's DNS queries,
+	// ICMP and ICMPv6 are policed to, filled in on ADD from the cluster policy and the pod's annotations rather than
+	// configured. Zero means unlimited.
+	DNSRateLimit    uint64 `json:"-"`
+	ICMPRateLimit   uint64 `json:"-"`
+	ICMPv6RateLimit uint64 `json:"-"`
+	// MaxPPS is the rate in packets per second all traffic from each pod is policed to, and MaxConnections how many
+	// connections each pod may have open at once, its new ones over it being dropped, against pods flooding the
+	// node with small packets or SYNs rather than bytes. The flowcontrol.cni/max-pps and
+	// flowcontrol.cni/max-connections annotations of pods override them. Zero means unlimited.
+	MaxPPS         uint64 `json:"max_pps"`
+	MaxConnections uint64 `json:"max_connections"`
+
+	// Preset is the cluster policy preset the pod's rates came from, filled in on ADD rather than configured.
+	Preset string `json:"-"`
+	// Template is the cluster policy template that computed the pod's rates, filled in on ADD.
+	Template string `json:"-"`
+
+	// PriorityClass is the pod's Kubernetes PriorityClass and ClassPriority the HTB priority the cluster policy
+	// gives it, filled in on ADD rather than configured.
+	PriorityClass string `json:"-"`
+	ClassPriority uint32 `json:"-"`
 }
 
 // K8sArgs is the valid CNI_ARGS used for Kubernetes
@@ -78,4 +401,5 @@ type K8sArgs struct {
 	K8S_POD_NAME               types.UnmarshallableString
 	K8S_POD_NAMESPACE          types.UnmarshallableString
 	K8S_POD_INFRA_CONTAINER_ID types.UnmarshallableString
+	K8S_POD_UID                types.UnmarshallableString
 }
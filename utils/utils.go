@@ -25,27 +25,38 @@ import (
 
 	"strings"
 
+	"github.com/projectcalico/cni-plugin/logging"
+
 	"github.com/containernetworking/cni/pkg/ip"
 	"github.com/containernetworking/cni/pkg/ipam"
 	"github.com/containernetworking/cni/pkg/ns"
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
 	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/projectcalico/cni-plugin/specversion"
+	"github.com/projectcalico/cni-plugin/state"
+	"github.com/projectcalico/cni-plugin/tracing"
 	"github.com/projectcalico/libcalico-go/lib/api"
 	"github.com/projectcalico/libcalico-go/lib/client"
 	cnet "github.com/projectcalico/libcalico-go/lib/net"
 	"github.com/vishvananda/netlink"
+
+	"github.com/projectcalico/cni-plugin/internal/util"
 )
 
+// Min returns the smaller of a and b.
+//
+// Deprecated: Min moved to internal/util and is only kept here for one release; code outside the plugin, which
+// can't import internal/util, should compare the ints itself.
 func Min(a, b int) int {
-	if a < b {
-		return a
-	}
-	return b
+	return util.Min(a, b)
 }
 
 // CleanUpNamespace deletes the devices in the network namespace.
-func CleanUpNamespace(args *skel.CmdArgs, logger *log.Entry) error {
+func CleanUpNamespace(args *skel.CmdArgs, logger *log.Entry) (err error) {
+	span := tracing.Start("veth")
+	defer func() { span.End(err) }()
+
 	// Only try to delete the device if a namespace was passed in.
 	if args.Netns != "" {
 		logger.Debug("Checking namespace & device exist.")
@@ -72,6 +83,57 @@ func CleanUpNamespace(args *skel.CmdArgs, logger *log.Entry) error {
 	return nil
 }
 
+func removeShapingRecord(store *state.Store, key string, logger *log.Entry) error {
+	if r, err := store.Load(key); err == nil {
+		removeRecordedShaping(store, r, logger)
+	}
+	return deleteShapingRecord(store, key, state.AuditTriggerReconcile, "cleaned up after an interrupted operation", logger)
+}
+
+// removeRecordedShaping removes the shaping of a pod that doesn't go with its devices. Pods shaped on the uplink
+// leave a class behind in the shared hierarchy, stamped or packet-limited pods elements in the nftables table, and
+// pods shaped with BPF maps in the BPF filesystem, which must be removed explicitly.
+func removeRecordedShaping(store *state.Store, r *state.Record, logger *log.Entry) {
+	if r.ShapingMode == ShapingModeNIC {
+		if err := CleanUpNICShaping(store, r); err != nil {
+			logger.WithError(err).Warn("Failed to remove uplink shaping")
+		}
+	}
+	if r.ConntrackMark != 0 {
+		if err := UnstampConntrack(r.HostVeth); err != nil {
+			logger.WithError(err).Warn("Failed to stop stamping connections")
+		}
+	}
+	if !PacketLimitsOf(r).Empty() {
+		if err := RemovePacketLimits(r.HostVeth); err != nil {
+			logger.WithError(err).Warn("Failed to remove packet rate limits")
+		}
+	}
+	if r.Qdisc == QdiscEBPF {
+		removeEBPF(r.Key(), logger)
+	}
+}
+
+// deleteShapingRecord deletes the shaping record stored under key with its names and counters, auditing the
+// deletion as made by trigger.
+func deleteShapingRecord(store *state.Store, key, trigger, detail string, logger *log.Entry) error {
+	r, loadErr := store.Load(key)
+	if err := ReleaseNames(store, key); err != nil {
+		logger.WithError(err).Warn("Failed to release device names")
+	}
+	if err := store.DeleteCounters(key); err != nil {
+		logger.WithError(err).Warn("Failed to remove traffic counters")
+	}
+	if err := store.Delete(key); err != nil {
+		logger.WithError(err).Error("Failed to remove shaping state")
+		return err
+	}
+	if loadErr == nil {
+		AuditRecord(store, r, state.AuditDelete, trigger, detail, logger)
+	}
+	return nil
+}
+
 // CleanUpIPAM calls IPAM plugin to release the IP address.
 // It also contains IPAM plugin specific changes needed before calling the plugin.
 func CleanUpIPAM(conf NetConf, args *skel.CmdArgs, logger *log.Entry) error {
@@ -101,7 +163,9 @@ func CleanUpIPAM(conf NetConf, args *skel.CmdArgs, logger *log.Entry) error {
 		logger.WithField("stdin", string(args.StdinData)).Debug("Updated stdin data for Delete Cmd")
 	}
 
+	span := tracing.Start("ipam")
 	err := ipam.ExecDel(conf.IPAM.Type, args.StdinData)
+	span.End(err)
 
 	if err != nil {
 		logger.Error(err)
@@ -125,10 +189,11 @@ func ValidateNetworkName(name string) error {
 
 // AddIgnoreUnknownArgs appends the 'IgnoreUnknown=1' option to CNI_ARGS before calling the IPAM plugin. Otherwise, it will
 // complain about the Kubernetes arguments. See https://github.com/kubernetes/kubernetes/pull/24983
+// Empty pairs left by legacy runtimes are dropped, as the argument parser rejects them.
 func AddIgnoreUnknownArgs() error {
 	cniArgs := "IgnoreUnknown=1"
-	if os.Getenv("CNI_ARGS") != "" {
-		cniArgs = fmt.Sprintf("%s;%s", cniArgs, os.Getenv("CNI_ARGS"))
+	if args := specversion.CleanArgs(os.Getenv("CNI_ARGS")); args != "" {
+		cniArgs = fmt.Sprintf("%s;%s", cniArgs, args)
 	}
 	return os.Setenv("CNI_ARGS", cniArgs)
 }
@@ -153,6 +218,23 @@ func CreateResultFromEndpoint(ep *api.WorkloadEndpoint) (*current.Result, error)
 	return result, nil
 }
 
+// MergeDNS sets the DNS configuration of result from dns, keeping what IPAM returned for the fields dns leaves
+// empty.
+func MergeDNS(result *current.Result, dns types.DNS) {
+	if len(dns.Nameservers) != 0 {
+		result.DNS.Nameservers = dns.Nameservers
+	}
+	if dns.Domain != "" {
+		result.DNS.Domain = dns.Domain
+	}
+	if len(dns.Search) != 0 {
+		result.DNS.Search = dns.Search
+	}
+	if len(dns.Options) != 0 {
+		result.DNS.Options = dns.Options
+	}
+}
+
 func GetIdentifiers(args *skel.CmdArgs) (workloadID string, orchestratorID string, err error) {
 	// Determine if running under k8s by checking the CNI args
 	k8sArgs := K8sArgs{}
@@ -278,25 +360,48 @@ func ReleaseIPAllocation(logger *log.Entry, ipamType string, stdinData []byte) {
 	}
 }
 
-// Set up logging for both Calico and libcalico using the provided log level,
-func ConfigureLogging(logLevel string) {
-	if strings.EqualFold(logLevel, "debug") {
-		log.SetLevel(log.DebugLevel)
-	} else if strings.EqualFold(logLevel, "info") {
-		log.SetLevel(log.InfoLevel)
-	} else {
-		// Default level
-		log.SetLevel(log.WarnLevel)
+// Set up logging for both Calico and libcalico from conf: the level, those of the subsystems, and the file and
+// format of the output. Every entry carries the container ID of args and, under Kubernetes, the pod. Invalid
+// settings are logged and ignored, rather than failing the command.
+func ConfigureLogging(conf NetConf, args *skel.CmdArgs) {
+	var problems []error
+	// Default level
+	level := log.WarnLevel
+	if conf.LogLevel != "" {
+		l, err := log.ParseLevel(strings.ToLower(conf.LogLevel))
+		if err != nil {
+			problems = append(problems, fmt.Errorf("ignoring log_level: %v", err))
+		} else {
+			level = l
+		}
+	}
+	log.SetLevel(level)
+
+	fields := log.Fields{"ContainerID": args.ContainerID}
+	k8sArgs := K8sArgs{}
+	if err := types.LoadArgs(args.Args, &k8sArgs); err == nil && k8sArgs.K8S_POD_NAME != "" {
+		fields["Pod"] = fmt.Sprintf("%s/%s", k8sArgs.K8S_POD_NAMESPACE, k8sArgs.K8S_POD_NAME)
+	}
+	if err := logging.SetOutput(conf.LogFile, conf.LogFormat, fields); err != nil {
+		problems = append(problems, fmt.Errorf("ignoring log_file and log_format: %v", err))
+		logging.SetOutput("", "", fields)
 	}
 
-	log.SetOutput(os.Stderr)
+	// Subsystems default to the level above unless logLevels overrides them.
+	if err := logging.Configure(log.GetLevel(), conf.LogLevels); err != nil {
+		problems = append(problems, fmt.Errorf("ignoring logLevels: %v", err))
+		logging.Configure(log.GetLevel(), nil)
+	}
+	for _, err := range problems {
+		log.Warn(err)
+	}
 }
 
 // Create a logger which always includes common fields
 func CreateContextLogger(workload string) *log.Entry {
 	// A common pattern is to re-use fields between logging statements by re-using
 	// the logrus.Entry returned from WithFields()
-	contextLogger := log.WithFields(log.Fields{
+	contextLogger := logging.Logger(logging.Datapath).WithFields(log.Fields{
 		"Workload": workload,
 	})
 
@@ -0,0 +1,107 @@
+package utils
+
+import (
+	"fmt"
+
+	"github.com/projectcalico/cni-plugin/policy"
+)
+
+// The MTUs Linux accepts on an interface carrying IPv4.
+const (
+	minMTU = 68
+	maxMTU = 65535
+)
+
+// Validate checks conf for mistakes that can be told before anything is set up, and replaces the shorthands it has
+// for other options with them. ADD validates its configuration first, so that a mistake fails it with a CNI error
+// explaining it, rather than part way through setting up the container.
+func (c *NetConf) Validate() error {
+	conf, err := resolveHostInterface(*c)
+	if err != nil {
+		return invalidConfigError(err)
+	}
+	*c = conf
+	switch {
+	case c.IPAM.Type == "":
+		return invalidConfigError(fmt.Errorf("ipam section missing or without a type"))
+	case c.MTU != 0 && (c.MTU < minMTU || c.MTU > maxMTU):
+		return invalidConfigError(fmt.Errorf("mtu %d is out of range, must be between %d and %d", c.MTU, minMTU, maxMTU))
+	}
+	for _, check := range []func(NetConf) error{checkManagedSysctls, checkExclusiveOptions, checkClassifier} {
+		if err := check(*c); err != nil {
+			return invalidConfigError(err)
+		}
+	}
+	if err := checkHooks(c.Hooks); err != nil {
+		return invalidConfigError(err)
+	}
+	for _, d := range []struct{ direction, rate, ceil string }{
+		{"ingress", c.IngressRate, c.IngressCeil},
+		{"egress", c.EgressRate, c.EgressCeil},
+	} {
+		rate, err := positiveRate(d.direction+"_rate", d.rate)
+		if err != nil {
+			return invalidConfigError(err)
+		}
+		ceil, err := positiveRate(d.direction+"_ceil", d.ceil)
+		if err != nil {
+			return invalidConfigError(err)
+		}
+		if rate != 0 && ceil != 0 && rate > ceil {
+			return invalidConfigError(fmt.Errorf("%s_rate %s is above %s_ceil %s", d.direction, d.rate, d.direction,
+				d.ceil))
+		}
+	}
+	return nil
+}
+
+// positiveRate parses the rate value of the option name, which must be positive if it is set, and returns 0 if it
+// isn't.
+func positiveRate(name, value string) (uint64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	rate, err := policy.ParseRate(value)
+	if err != nil || rate == 0 {
+		return 0, fmt.Errorf("%s %q isn't a positive rate", name, value)
+	}
+	return rate, nil
+}
+
+// checkManagedSysctls rejects sysctls configured while manageSysctls leaves them to someone else.
+func checkManagedSysctls(conf NetConf) error {
+	if conf.ManageSysctls != nil && !*conf.ManageSysctls && (len(conf.Sysctls) != 0 || conf.NeighTiming != nil ||
+		conf.RPFilter != nil || conf.ProxyARP != nil || conf.Forwarding != nil) {
+		return fmt.Errorf("sysctls, neighTiming, rpFilter, proxyARP and forwarding can't be set when manageSysctls is false")
+	}
+	return nil
+}
+
+// checkExclusiveOptions rejects options that can't be combined: the options of the uplink hierarchy outside the nic
+// shaping mode, classifiers the backend doesn't classify with, and strict_shaping in compatibility mode, which
+// doesn't shape pods.
+func checkExclusiveOptions(conf NetConf) error {
+	nic := conf.ShapingMode == ShapingModeNIC
+	switch {
+	case conf.NICHierarchy != nil && !nic:
+		return fmt.Errorf("nicHierarchy requires shapingMode %q", ShapingModeNIC)
+	case conf.NICOverflow != "" && !nic:
+		return fmt.Errorf("nicOverflow requires shapingMode %q", ShapingModeNIC)
+	case conf.NICOffload && !nic:
+		return fmt.Errorf("nicOffload requires shapingMode %q", ShapingModeNIC)
+	case conf.Classifier != "" && conf.Classifier != ClassifierU32 && backendOf(conf) != BackendHTB:
+		return fmt.Errorf("classifier %q needs the %s backend, not %s", conf.Classifier, BackendHTB, backendOf(conf))
+	case conf.StrictShaping != nil && conf.CalicoCompat:
+		return fmt.Errorf("strict_shaping can't be set with calico_compat, which doesn't shape pods")
+	}
+	return nil
+}
+
+// invalidConfigError reports that the network configuration is invalid.
+func invalidConfigError(err error) error {
+	return &ShapingError{
+		Code: ErrCodeInvalidConfig,
+		Err:  fmt.Errorf("invalid network configuration: %v", err),
+		Hint: "fix the plugin's entry in the CNI configuration of the node",
+	}
+}
@@ -0,0 +1,262 @@
+package utils
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/projectcalico/cni-plugin/shaping"
+	"github.com/projectcalico/cni-plugin/state"
+	"github.com/vishvananda/netlink"
+)
+
+// Values of NetConf.VerifyShaping: what happens when the shaping read back from the kernel after ADD doesn't match
+// what was programmed.
+const (
+	VerifyShapingOff     = "off"
+	VerifyShapingStrict  = "strict"
+	VerifyShapingDegrade = "degrade"
+)
+
+// verifyRateTolerance is how far, as a fraction, a rate read back may be from the programmed one. The kernel keeps
+// rates in bytes per second, so rates that aren't a multiple of 8 bits come back slightly lower.
+const verifyRateTolerance = 0.01
+
+func checkVerifyShaping(mode string) error {
+	switch mode {
+	case "", VerifyShapingOff, VerifyShapingStrict, VerifyShapingDegrade:
+		return nil
+	}
+	return fmt.Errorf("invalid verifyShaping %q, must be %q, %q or %q", mode, VerifyShapingOff, VerifyShapingStrict,
+		VerifyShapingDegrade)
+}
+
+// VerifyShaping re-reads the qdiscs, classes and filters shaping the pod of r and compares them with what r says
+// was programmed: the kind and handle of the root qdiscs, the parents and rates of the classes, within
+// verifyRateTolerance, and the filters classifying into them. It returns the mismatches found. Pods policed with
+// nftables have nothing to verify.
+func VerifyShaping(r *state.Record) []string {
+	ingress, egress := r.ActiveRates()
+	var problems []string
+	switch {
+	case r.ShapingMode == ShapingModeNFTables:
+	case r.ShapingMode == ShapingModeContainer:
+		_, egressCeil := CeilsOf(r, ingress, egress)
+		problems = verifyContainerShaping(r, egress, egressCeil)
+	case r.ShapingMode == ShapingModeNIC:
+		if r.EgressRate != 0 {
+			problems = append(problems, verifyClass(r.NIC, nicQdiscMajor, r.NICParentMinor, r.NICClassMinor, egress)...)
+		}
+		if r.IngressRate != 0 && !r.HostNetwork {
+			problems = append(problems,
+				verifyClass(nicIFBName(r.NIC), nicQdiscMajor, r.NICParentMinor, r.NICClassMinor, ingress)...)
+		}
+	case r.Qdisc == QdiscEBPF:
+		problems = append(problems, verifyEBPF(r, ingress, egress)...)
+	case r.Qdisc == QdiscPolice:
+		problems = append(problems, verifyPolice(r)...)
+	case r.Qdisc == QdiscTBF:
+		if r.IngressRate != 0 {
+			problems = append(problems, verifyTBF(r.HostVeth, shaping.HostVethQdiscMajor, ingress)...)
+		}
+		if r.IFB != "" {
+			problems = append(problems, verifyRedirect(r.HostVeth, shaping.FilterBase(0), r.IFB)...)
+			problems = append(problems, verifyTBF(r.IFB, shaping.IFBQdiscMajor, egress)...)
+		}
+	default:
+		gen := r.ShapingGeneration
+		ingressCeil, egressCeil := CeilsOf(r, ingress, egress)
+		minors := []uint16{shaping.ClassMinor(gen)}
+		if r.IPFamilyBudget == IPFamilyBudgetSeparate {
+			minors = append(minors, shaping.ClassMinor(shaping.IPv6Generation(gen)))
+		}
+		verifyHtb := func(device string, major uint16, rate, ceil uint64, classes []state.TrafficClass) {
+			problems = append(problems, verifyRootQdisc(device, major, "htb")...)
+			parent := shaping.ParentMinor(rate, ceil)
+			if parent != 0 {
+				problems = append(problems, verifyClass(device, major, 0, parent, ceil)...)
+			}
+			for _, minor := range minors {
+				problems = append(problems, verifyClass(device, major, parent, minor, rate)...)
+				if split := ProtocolSplitOf(r); split.enabled() {
+					for i, share := range split.shares() {
+						problems = append(problems,
+							verifyClass(device, major, minor, splitMinor(minor, i), rate*uint64(share)/100)...)
+					}
+				}
+				if len(classes) != 0 {
+					rates, _ := classRates(classes, rate, ceil)
+					for i, classRate := range rates {
+						problems = append(problems, verifyClass(device, major, minor, splitMinor(minor, i), classRate)...)
+					}
+				}
+			}
+			problems = append(problems, verifyClassifier(device, major, shaping.FilterBase(gen), shaping.ClassMinor(gen))...)
+		}
+		if r.IngressRate != 0 {
+			verifyHtb(r.HostVeth, shaping.HostVethQdiscMajor, ingress, ingressCeil, classesIn(r.Classes, "ingress"))
+		}
+		if r.IFB != "" {
+			problems = append(problems, verifyRedirect(r.HostVeth, shaping.FilterBase(gen), r.IFB)...)
+			verifyHtb(r.IFB, shaping.IFBQdiscMajor, egress, egressCeil, classesIn(r.Classes, "egress"))
+		}
+	}
+	return problems
+}
+
+// rateMatches reports whether a rate in bytes per second read back from the kernel is the programmed rate, in bits
+// per second, within verifyRateTolerance. The kernel reports rates that don't fit the 32 bits of tc_ratespec as its
+// largest value, and the rest in an attribute netlink doesn't read, so they only need to be at least that.
+func rateMatches(readBytes, programmed uint64) bool {
+	if readBytes == math.MaxUint32 {
+		return programmed/8 >= math.MaxUint32
+	}
+	diff := float64(readBytes*8) - float64(programmed)
+	if diff < 0 {
+		diff = -diff
+	}
+	return diff <= float64(programmed)*verifyRateTolerance
+}
+
+// verifyRootQdisc checks that the root qdisc of device is of kind with handle major:0.
+func verifyRootQdisc(device string, major uint16, kind string) []string {
+	link, err := netlink.LinkByName(device)
+	if err != nil {
+		return []string{fmt.Sprintf("%s not found", device)}
+	}
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return []string{fmt.Sprintf("failed to list qdiscs of %s: %v", device, err)}
+	}
+	for _, q := range qdiscs {
+		if q.Attrs().Parent != netlink.HANDLE_ROOT {
+			continue
+		}
+		if q.Type() != kind || q.Attrs().Handle != netlink.MakeHandle(major, 0) {
+			return []string{fmt.Sprintf("root qdisc of %s is %s %s, expected %s %x:", device, q.Type(),
+				netlink.HandleStr(q.Attrs().Handle), kind, major)}
+		}
+		return nil
+	}
+	return []string{fmt.Sprintf("root %s qdisc missing on %s", kind, device)}
+}
+
+// verifyTBF checks the root TBF qdisc of device and its rate.
+func verifyTBF(device string, major uint16, rate uint64) []string {
+	if problems := verifyRootQdisc(device, major, "tbf"); problems != nil {
+		return problems
+	}
+	link, err := netlink.LinkByName(device)
+	if err != nil {
+		return []string{fmt.Sprintf("%s not found", device)}
+	}
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return []string{fmt.Sprintf("failed to list qdiscs of %s: %v", device, err)}
+	}
+	for _, q := range qdiscs {
+		if tbf, ok := q.(*netlink.Tbf); ok && q.Attrs().Parent == netlink.HANDLE_ROOT && !rateMatches(tbf.Rate, rate) {
+			return []string{fmt.Sprintf("TBF qdisc of %s has rate %d bit/s, expected %d", device, tbf.Rate*8, rate)}
+		}
+	}
+	return nil
+}
+
+// verifyClass checks that the HTB class major:minor of device is under major:parent, where parent 0 is the root
+// qdisc, and has rate.
+func verifyClass(device string, major, parent, minor uint16, rate uint64) []string {
+	link, err := netlink.LinkByName(device)
+	if err != nil {
+		return []string{fmt.Sprintf("%s not found", device)}
+	}
+	classes, err := netlink.ClassList(link, 0)
+	if err != nil {
+		return []string{fmt.Sprintf("failed to list classes of %s: %v", device, err)}
+	}
+	handle := netlink.MakeHandle(major, minor)
+	for _, c := range classes {
+		if c.Attrs().Handle != handle {
+			continue
+		}
+		htb, ok := c.(*netlink.HtbClass)
+		switch {
+		case !ok:
+			return []string{fmt.Sprintf("class %s of %s isn't an HTB class", netlink.HandleStr(handle), device)}
+		case c.Attrs().Parent != netlink.MakeHandle(major, parent):
+			return []string{fmt.Sprintf("class %s of %s is under %s, expected %s", netlink.HandleStr(handle), device,
+				netlink.HandleStr(c.Attrs().Parent), netlink.HandleStr(netlink.MakeHandle(major, parent)))}
+		case !rateMatches(htb.Rate, rate):
+			return []string{fmt.Sprintf("class %s of %s has rate %d bit/s, expected %d", netlink.HandleStr(handle),
+				device, htb.Rate*8, rate)}
+		}
+		return nil
+	}
+	return []string{fmt.Sprintf("class %s missing on %s", netlink.HandleStr(handle), device)}
+}
+
+// verifyClassifier checks that a filter at priority prio under the root qdisc major:0 of device classifies into
+// class major:minor.
+func verifyClassifier(device string, major uint16, prio, minor uint16) []string {
+	link, err := netlink.LinkByName(device)
+	if err != nil {
+		return []string{fmt.Sprintf("%s not found", device)}
+	}
+	filters, err := netlink.FilterList(link, netlink.MakeHandle(major, 0))
+	if err != nil {
+		return []string{fmt.Sprintf("failed to list filters of %s: %v", device, err)}
+	}
+	classID := netlink.MakeHandle(major, minor)
+	for _, f := range filters {
+		if f.Attrs().Priority != prio {
+			continue
+		}
+		switch f := f.(type) {
+		case *netlink.U32:
+			if f.ClassId == classID {
+				return nil
+			}
+		case *netlink.MatchAll:
+			if f.ClassId == classID {
+				return nil
+			}
+		}
+	}
+	return []string{fmt.Sprintf("no filter at priority %d of %s classifies into %s", prio, device,
+		netlink.HandleStr(classID))}
+}
+
+// verifyRedirect checks that a filter at priority prio of the ingress qdisc of device redirects to ifbName.
+func verifyRedirect(device string, prio uint16, ifbName string) []string {
+	link, err := netlink.LinkByName(device)
+	if err != nil {
+		return []string{fmt.Sprintf("%s not found", device)}
+	}
+	ifb, err := netlink.LinkByName(ifbName)
+	if err != nil {
+		return []string{fmt.Sprintf("IFB device %s not found", ifbName)}
+	}
+	filters, err := netlink.FilterList(link, netlink.MakeHandle(0xffff, 0))
+	if err != nil {
+		return []string{fmt.Sprintf("failed to list ingress filters of %s: %v", device, err)}
+	}
+	for _, f := range filters {
+		if f.Attrs().Priority != prio {
+			continue
+		}
+		var actions []netlink.Action
+		switch f := f.(type) {
+		case *netlink.U32:
+			if f.RedirIndex == ifb.Attrs().Index {
+				return nil
+			}
+			actions = f.Actions
+		case *netlink.MatchAll:
+			actions = f.Actions
+		}
+		for _, a := range actions {
+			if m, ok := a.(*netlink.MirredAction); ok && m.Ifindex == ifb.Attrs().Index {
+				return nil
+			}
+		}
+	}
+	return []string{fmt.Sprintf("no filter at priority %d of %s redirects to %s", prio, device, ifbName)}
+}